@@ -0,0 +1,136 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// accessEntry is an entry of the server's ban and allow lists, as returned
+// by its HTTP API
+type accessEntry struct {
+	List    string    `json:"list"`
+	User    string    `json:"user,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// accessCommand sets up an access subcommand, which manages the ban and
+// allow lists of a running server
+func accessCommand(command string) func(fs *flag.FlagSet) func() {
+	return func(fs *flag.FlagSet) func() {
+		var (
+			api      = addAPIFlags(fs)
+			reason   = fs.String("reason", "", "Reason shown to banned users and kept with the entry")
+			duration = fs.Duration("for", 0, "How long the entry lasts (0 = until removed)")
+			output   = outputFlag(fs)
+		)
+		return func() {
+			checkOutput(*output)
+			endpoint := api.baseURL() + "/api/access"
+			client, err := api.client(30 * time.Second)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+
+			// Entries are for a user, or for a key given by its fingerprint
+			subject := func() (user, key string) {
+				if fs.NArg() != 1 {
+					fs.Usage()
+					os.Exit(2)
+				}
+				if strings.HasPrefix(fs.Arg(0), "SHA256:") {
+					return "", fs.Arg(0)
+				}
+				return fs.Arg(0), ""
+			}
+
+			switch command {
+			case "list":
+				err = listAccess(client, endpoint, *output)
+			case "ban", "allow":
+				entry := accessEntry{List: command, Reason: *reason}
+				entry.User, entry.Key = subject()
+				if *duration > 0 {
+					entry.Expires = time.Now().Add(*duration).UTC()
+				}
+				var body []byte
+				if body, err = json.Marshal(entry); err == nil {
+					err = accessRequest(client, http.MethodPost, endpoint, bytes.NewReader(body), http.StatusCreated)
+				}
+			case "unban", "unallow":
+				user, key := subject()
+				query := url.Values{}
+				if user != "" {
+					query.Set("user", user)
+				} else {
+					query.Set("key", key)
+				}
+				list := strings.TrimPrefix(command, "un")
+				err = accessRequest(client, http.MethodDelete, endpoint+"/"+list+"?"+query.Encode(), nil, http.StatusNoContent)
+			}
+			if err != nil {
+				log.Fatalf("Failed to %s: %v", command, err)
+			}
+		}
+	}
+}
+
+// listAccess prints the entries of the ban and allow lists in a format
+func listAccess(client *http.Client, endpoint, format string) error {
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var entries []accessEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, e := range entries {
+		expires := "never"
+		if !e.Expires.IsZero() {
+			expires = e.Expires.Local().Format(time.DateTime)
+		}
+		rows = append(rows, []string{e.List, e.User + e.Key, expires, e.Reason})
+	}
+	return writeOutput(os.Stdout, format, entries, []string{"LIST", "SUBJECT", "EXPIRES", "REASON"}, rows)
+}
+
+// accessRequest sends a request to the access API, expecting status want
+func accessRequest(client *http.Client, method, endpoint string, body io.Reader, want int) error {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// apiTokenEnv is the environment variable API tokens are read from when
+// -token isn't given, which keeps them out of process listings
+const apiTokenEnv = "SSH_HYPERVISOR_TOKEN"
+
+// apiFlags are the options of subcommands that talk to a server's HTTP API
+type apiFlags struct {
+	server *string
+	token  *string
+	cert   *string
+	key    *string
+	ca     *string
+}
+
+// addAPIFlags adds the options for reaching a server's HTTP API to fs
+func addAPIFlags(fs *flag.FlagSet) *apiFlags {
+	return &apiFlags{
+		server: fs.String("server", "http://127.0.0.1:9090", "URL of the server's HTTP listener (-http-addr)"),
+		token:  fs.String("token", os.Getenv(apiTokenEnv), "API token, if the server has -api-tokens (default $"+apiTokenEnv+")"),
+		cert:   fs.String("cert", "", "Client certificate, if the server has -http-client-ca"),
+		key:    fs.String("key", "", "Private key of the client certificate"),
+		ca:     fs.String("ca", "", "CA certificate to verify an https:// server with (default: system roots)"),
+	}
+}
+
+// tokenTransport adds a bearer token to every request
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
+// baseURL returns the server URL without a trailing slash
+func (f *apiFlags) baseURL() string {
+	return strings.TrimSuffix(*f.server, "/")
+}
+
+// client returns an HTTP client that authenticates to the server with the
+// configured token and client certificate
+func (f *apiFlags) client(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if *f.cert != "" || *f.key != "" {
+		cert, err := tls.LoadX509KeyPair(*f.cert, *f.key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if *f.ca != "" {
+		pem, err := os.ReadFile(*f.ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *f.ca)
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	var rt http.RoundTripper = transport
+	if *f.token != "" {
+		rt = &tokenTransport{token: *f.token, next: transport}
+	}
+	return &http.Client{Timeout: timeout, Transport: rt}, nil
+}
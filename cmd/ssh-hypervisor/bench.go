@@ -0,0 +1,341 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"github.com/sirupsen/logrus"
+)
+
+// benchScenarios are the scenarios the bench subcommand runs, in order
+var benchScenarios = []string{"cold-boot", "warm-boot", "snapshot-restore", "concurrent-boot"}
+
+// benchScenario is the timings of one benchmark scenario, from starting a
+// boot until a command ran in the VM
+type benchScenario struct {
+	Name       string    `json:"name"`
+	Runs       []float64 `json:"runs"` // Seconds of each run
+	Min        float64   `json:"min"`
+	Median     float64   `json:"median"`
+	Max        float64   `json:"max"`
+	Error      string    `json:"error,omitempty"`
+	Regression string    `json:"regression,omitempty"` // How it is slower than the baseline, if too much
+}
+
+// benchResult is the outcome of a benchmark
+type benchResult struct {
+	OK        bool            `json:"ok"`
+	Versions  vm.Versions     `json:"versions"`
+	Scenarios []benchScenario `json:"scenarios"`
+}
+
+// benchCommand sets up the bench subcommand, which times VM boots in
+// standard scenarios so performance regressions show up before a release
+func benchCommand(fs *flag.FlagSet) func() {
+	var (
+		dataDir       = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+		rootfs        = fs.String("rootfs", "", "Path to rootfs image (required)")
+		rootfsMode    = fs.String("rootfs-mode", internal.RootfsCopy, "How VMs get a writable rootfs: copy, overlay, or ephemeral")
+		vmCIDR        = fs.String("vm-cidr", "192.168.100.0/24", "CIDR blocks for VM IP addresses, separated by commas")
+		vmMemory      = fs.Int("vm-memory", 128, "VM memory in MB")
+		scenarios     = fs.String("scenarios", strings.Join(benchScenarios, ","), "Scenarios to run, separated by commas")
+		runs          = fs.Int("runs", 3, "Times each scenario is run")
+		concurrency   = fs.Int("concurrency", 10, "VMs booted at once in the concurrent-boot scenario")
+		baseline      = fs.String("baseline", "", "Results of an earlier run with -output json to compare against")
+		maxRegression = fs.Float64("max-regression", 0.2, "Fail when a scenario's median is this fraction slower than in the baseline")
+		timeout       = fs.Duration("timeout", 15*time.Minute, "How long the whole benchmark may take")
+		verbose       = fs.Bool("v", false, "Log what the VM manager does")
+		output        = outputFlag(fs)
+	)
+	return func() {
+		checkOutput(*output)
+		if *runs < 1 || *concurrency < 1 {
+			log.Fatalf("-runs and -concurrency must be at least 1")
+		}
+		selected := strings.Split(*scenarios, ",")
+		for _, name := range selected {
+			if !slices.Contains(benchScenarios, name) {
+				log.Fatalf("Unknown scenario %q (expected %s)", name, strings.Join(benchScenarios, ", "))
+			}
+		}
+		var base *benchResult
+		if *baseline != "" {
+			data, err := os.ReadFile(*baseline)
+			if err == nil {
+				err = json.Unmarshal(data, &base)
+			}
+			if err != nil {
+				log.Fatalf("Failed to read baseline: %v", err)
+			}
+		}
+		if !*verbose {
+			log.SetLevel(logrus.WarnLevel)
+		}
+		config := &internal.Config{
+			Port:            2222,
+			VMCIDR:          *vmCIDR,
+			VMMemory:        *vmMemory,
+			VMCPUs:          1,
+			DataDir:         *dataDir,
+			Rootfs:          *rootfs,
+			RootfsMode:      *rootfsMode,
+			OverlaySize:     1024,
+			Snapshots:       1,
+			ShutdownTimeout: 3 * time.Second,
+			VMLogLevel:      "warn",
+			VMLogMaxSize:    10,
+			VMLogMaxFiles:   3,
+		}
+		if err := config.Validate(); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		manager, err := vm.NewManager(config, logrus.NewEntry(log), vm.GetFirecrackerBinary(), vm.GetVmlinuxBinary())
+		if err != nil {
+			log.Fatalf("Failed to set up host: %v", err)
+		}
+		b := &bench{manager: manager, dataDir: *dataDir, runs: *runs, concurrency: *concurrency}
+		result := b.run(ctx, selected)
+		if base != nil {
+			compareBench(result, base, *maxRegression)
+		}
+
+		var rows [][]string
+		for _, s := range result.Scenarios {
+			detail := s.Error
+			if s.Regression != "" {
+				detail = s.Regression
+			}
+			rows = append(rows, []string{s.Name, fmt.Sprint(len(s.Runs)),
+				fmt.Sprintf("%.3fs", s.Min), fmt.Sprintf("%.3fs", s.Median), fmt.Sprintf("%.3fs", s.Max), detail})
+		}
+		if err := writeOutput(os.Stdout, *output, result, []string{"SCENARIO", "RUNS", "MIN", "MEDIAN", "MAX", "DETAIL"}, rows); err != nil {
+			log.Fatalf("Failed to print results: %v", err)
+		}
+		if !result.OK {
+			os.Exit(1)
+		}
+	}
+}
+
+// bench runs benchmark scenarios with throwaway VMs, which get random IDs so
+// they never touch a user's VM
+type bench struct {
+	manager     *vm.Manager
+	dataDir     string
+	runs        int
+	concurrency int
+}
+
+// run runs the scenarios in order, removing every VM they created afterward
+func (b *bench) run(ctx context.Context, scenarios []string) *benchResult {
+	result := &benchResult{OK: true, Scenarios: []benchScenario{}}
+	result.Versions, _ = b.manager.Versions()
+	for _, name := range scenarios {
+		var runs []float64
+		var err error
+		switch name {
+		case "cold-boot":
+			runs, err = b.coldBoot(ctx)
+		case "warm-boot":
+			runs, err = b.warmBoot(ctx)
+		case "snapshot-restore":
+			runs, err = b.snapshotRestore(ctx)
+		case "concurrent-boot":
+			runs, err = b.concurrentBoot(ctx)
+		}
+		scenario := summarizeRuns(name, runs)
+		if err != nil {
+			scenario.Error = err.Error()
+			result.OK = false
+		}
+		result.Scenarios = append(result.Scenarios, scenario)
+	}
+	return result
+}
+
+// newVM returns a random ID for a throwaway VM
+func (b *bench) newVM() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return "bench-" + hex.EncodeToString(id)
+}
+
+// remove stops a throwaway VM and deletes its data
+func (b *bench) remove(vmID string) {
+	b.manager.DestroyVM(context.Background(), vmID)
+	os.RemoveAll(filepath.Join(b.dataDir, vmID))
+}
+
+// boot starts a VM, waits until a command runs in it, and stops it again,
+// keeping its disk. It returns how long the VM took to run the command.
+func (b *bench) boot(ctx context.Context, vmID string) (float64, error) {
+	start := time.Now()
+	v, err := b.manager.GetOrCreateVM(ctx, vmID, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create VM: %w", err)
+	}
+	defer b.manager.DestroyVM(context.Background(), vmID)
+	if err := b.manager.WaitReady(ctx, v, nil); err != nil {
+		return 0, fmt.Errorf("VM didn't boot: %w", err)
+	}
+	if out, err := v.RunCommand(ctx, "true"); err != nil {
+		if out = strings.TrimSpace(out); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return 0, fmt.Errorf("failed to run a command in the VM: %w", err)
+	}
+	return time.Since(start).Seconds(), nil
+}
+
+// coldBoot boots new VMs, whose disks are made from the rootfs first
+func (b *bench) coldBoot(ctx context.Context) ([]float64, error) {
+	var runs []float64
+	for range b.runs {
+		vmID := b.newVM()
+		seconds, err := b.boot(ctx, vmID)
+		b.remove(vmID)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, seconds)
+	}
+	return runs, nil
+}
+
+// warmBoot boots a VM whose disk is already prepared, like a returning
+// user's or one booted ahead of time by provision
+func (b *bench) warmBoot(ctx context.Context) ([]float64, error) {
+	vmID := b.newVM()
+	defer b.remove(vmID)
+	if _, err := b.boot(ctx, vmID); err != nil {
+		return nil, err
+	}
+	var runs []float64
+	for range b.runs {
+		seconds, err := b.boot(ctx, vmID)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, seconds)
+	}
+	return runs, nil
+}
+
+// snapshotRestore puts a VM's disk back to a snapshot and boots it, timing
+// both together
+func (b *bench) snapshotRestore(ctx context.Context) ([]float64, error) {
+	vmID := b.newVM()
+	defer b.remove(vmID)
+	if _, err := b.boot(ctx, vmID); err != nil {
+		return nil, err
+	}
+	if err := b.manager.SnapshotVM(ctx, vmID, "bench"); err != nil {
+		return nil, fmt.Errorf("failed to snapshot VM: %w", err)
+	}
+	var runs []float64
+	for range b.runs {
+		start := time.Now()
+		if err := b.manager.RestoreSnapshot(ctx, vmID, "bench"); err != nil {
+			return runs, fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+		if _, err := b.boot(ctx, vmID); err != nil {
+			return runs, err
+		}
+		runs = append(runs, time.Since(start).Seconds())
+	}
+	return runs, nil
+}
+
+// concurrentBoot boots new VMs all at once, timing how long until every one
+// of them ran a command
+func (b *bench) concurrentBoot(ctx context.Context) ([]float64, error) {
+	var runs []float64
+	for range b.runs {
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			firstErr error
+		)
+		start := time.Now()
+		for range b.concurrency {
+			vmID := b.newVM()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := b.boot(ctx, vmID)
+				b.remove(vmID)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return runs, firstErr
+		}
+		runs = append(runs, time.Since(start).Seconds())
+	}
+	return runs, nil
+}
+
+// summarizeRuns returns a scenario with the minimum, median, and maximum of
+// its runs' seconds
+func summarizeRuns(name string, runs []float64) benchScenario {
+	s := benchScenario{Name: name, Runs: runs}
+	if s.Runs == nil {
+		s.Runs = []float64{}
+	}
+	if len(runs) == 0 {
+		return s
+	}
+	sorted := slices.Clone(runs)
+	slices.Sort(sorted)
+	s.Min, s.Max = sorted[0], sorted[len(sorted)-1]
+	s.Median = sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		s.Median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+	return s
+}
+
+// compareBench marks the scenarios whose median is more than maxRegression
+// slower than the same scenario's in base, failing the result
+func compareBench(result, base *benchResult, maxRegression float64) {
+	for i, s := range result.Scenarios {
+		for _, old := range base.Scenarios {
+			if old.Name != s.Name || old.Median <= 0 || s.Median <= 0 {
+				continue
+			}
+			if slower := s.Median/old.Median - 1; slower > maxRegression {
+				result.Scenarios[i].Regression = fmt.Sprintf("%.0f%% slower than the baseline's %.3fs", slower*100, old.Median)
+				result.OK = false
+			}
+		}
+	}
+}
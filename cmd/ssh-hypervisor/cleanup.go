@@ -0,0 +1,34 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// cleanupCommand sets up the cleanup subcommand, which undoes the server's
+// changes to the host
+func cleanupCommand(fs *flag.FlagSet) func() {
+	var (
+		dataDir    = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+		removeData = fs.Bool("remove-data", false, "Also remove the data directories of all VMs, including users' disks")
+		dryRun     = fs.Bool("dry-run", false, "Print what would be removed without removing anything")
+	)
+	return func() {
+		opts := vm.CleanupOptions{RemoveData: *removeData, DryRun: *dryRun}
+		err := vm.Cleanup(*dataDir, opts, func(action string) {
+			if *dryRun {
+				fmt.Println("Would " + action)
+			} else {
+				fmt.Println(strings.ToUpper(action[:1]) + action[1:])
+			}
+		})
+		if err != nil {
+			log.Fatalf("Cleanup failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of ssh-hypervisor. Dispatch, usage messages, shell
+// completions, and the man page are all generated from these definitions.
+type command struct {
+	name    string                        // Words after the program name, like "image build"
+	args    string                        // Arguments after the options, like "SPEC"
+	summary string                        // One line for lists of commands
+	help    string                        // Longer description for -h and the man page
+	setup   func(fs *flag.FlagSet) func() // Adds the options to fs and returns the action, nil for groups
+}
+
+// subcommands returns the subcommands, with each group before its commands
+func subcommands() []command {
+	return []command{
+		{
+			name:    "gc",
+			summary: "Remove data of stopped VMs and unreferenced artifacts",
+			help: "Remove data directories of stopped VMs, then kernels, images, and snapshots\n" +
+				"in the content store that nothing references. VMs with a running Firecracker\n" +
+				"process are never removed, so this is safe to run beside a live server.",
+			setup: gcCommand,
+		},
+		{
+			name:    "sshfp",
+			args:    "NAME",
+			summary: "Print SSHFP DNS records for the host key",
+			help: "Print SSHFP DNS records for the server's host key, to publish in the zone\n" +
+				"of NAME so clients with VerifyHostKeyDNS can check the host's identity.",
+			setup: sshfpCommand,
+		},
+		{
+			name:    "provision",
+			args:    "USERS_FILE",
+			summary: "Boot VMs ahead of time for a list of users",
+			help: "Boot VMs ahead of time for the users listed one per line in USERS_FILE\n" +
+				"(or - for stdin), so they get a shell instantly when they connect. Each\n" +
+				"VM's disk stays prepared after the hold, so later boots are fast too.",
+			setup: provisionCommand,
+		},
+		{
+			name:    "access",
+			summary: "Manage the ban and allow lists of a running server",
+			help: "Manage who may get a VM. Banned users and keys are refused, and when the\n" +
+				"allow list has entries, only the users and keys on it get VMs.",
+		},
+		{name: "access list", summary: "Print the ban and allow lists", setup: accessCommand("list")},
+		{name: "access ban", args: "USER|SHA256:KEY", summary: "Refuse VMs to a user or key", setup: accessCommand("ban")},
+		{name: "access allow", args: "USER|SHA256:KEY", summary: "Add a user or key to the allow list", setup: accessCommand("allow")},
+		{name: "access unban", args: "USER|SHA256:KEY", summary: "Lift a ban", setup: accessCommand("unban")},
+		{name: "access unallow", args: "USER|SHA256:KEY", summary: "Remove a user or key from the allow list", setup: accessCommand("unallow")},
+		{
+			name:    "stats",
+			summary: "Show, export, import, or merge user statistics",
+			help: "Show user statistics (connection history and boot times), export them as\n" +
+				"JSON, replace them with an export from another host, or merge exports from\n" +
+				"several nodes into them. Stop the server before importing or merging, since\n" +
+				"it saves its own statistics on exit. FILE may be - for stdin.",
+		},
+		{name: "stats show", summary: "Print users' connection history", setup: statsCommand("show")},
+		{name: "stats export", summary: "Export user statistics as JSON", setup: statsCommand("export")},
+		{name: "stats import", args: "FILE", summary: "Replace user statistics with an export", setup: statsCommand("import")},
+		{name: "stats merge", args: "FILE...", summary: "Merge exports from other nodes into user statistics", setup: statsCommand("merge")},
+		{
+			name:    "image",
+			summary: "Build rootfs images and list image catalogs",
+		},
+		{
+			name:    "image build",
+			args:    "SPEC",
+			summary: "Build a rootfs image from a spec",
+			help: "Build a bootable ext4 rootfs from a spec file with FROM, SIZE, PACKAGES,\n" +
+				"COPY, RUN, and SERVICE lines, optionally adding it to an image catalog.\n" +
+				"Requires root and docker.",
+			setup: imageBuildCommand,
+		},
+		{name: "image list", summary: "Print the images in a catalog", setup: imageListCommand},
+		{
+			name:    "vm",
+			summary: "Inspect the VMs of a running server",
+		},
+		{
+			name:    "vm list",
+			summary: "Print a running server's VMs",
+			help:    "List running VMs and stopped VMs with labels on a running server.",
+			setup:   vmListCommand,
+		},
+		{
+			name:    "selftest",
+			summary: "Boot a throwaway VM to check that the host works",
+			help: "Set up networking, boot a throwaway VM, wait for its SSH server, and run\n" +
+				"true in it, printing how long each step took. Exits non-zero if any step\n" +
+				"fails, for deployment health checks and checking a new install. Stop the\n" +
+				"server or give it a different -vm-cidr, so their VMs' addresses don't clash.",
+			setup: selftestCommand,
+		},
+		{
+			name:    "bench",
+			summary: "Time VM boots in standard scenarios",
+			help: "Boot throwaway VMs in standard scenarios (cold-boot, warm-boot,\n" +
+				"snapshot-restore, and concurrent-boot) and print how long each took until a\n" +
+				"command ran. With -baseline, exits non-zero if a scenario got slower than in\n" +
+				"an earlier run's -output json by more than -max-regression, for CI. Stop the\n" +
+				"server or give it a different -vm-cidr, so their VMs' addresses don't clash.",
+			setup: benchCommand,
+		},
+		{
+			name:    "cleanup",
+			summary: "Undo the server's changes to the host",
+			help: "Remove the network bridge, TAP devices, and iptables rules the server set\n" +
+				"up, and sockets left by stopped VMs. Refuses to run while any VM is running.",
+			setup: cleanupCommand,
+		},
+		{
+			name:    "completion",
+			args:    "bash|zsh|fish",
+			summary: "Print a shell completion script",
+			help: "Print a completion script for bash, zsh, or fish. Load it in the current\n" +
+				"shell with 'source <(ssh-hypervisor completion bash)', or install it where\n" +
+				"the shell looks for completions.",
+			setup: completionCommand,
+		},
+		{
+			name:    "man",
+			summary: "Print the man page",
+			help:    "Print the man page in roff, to install as ssh-hypervisor.1.",
+			setup:   manCommand,
+		},
+	}
+}
+
+// synopsis returns how to run the command
+func (c command) synopsis(prog string) string {
+	if c.setup == nil {
+		return prog + " " + c.name + " COMMAND [options]"
+	}
+	return strings.TrimSpace(prog + " " + c.name + " [options] " + c.args)
+}
+
+// description returns the command's help, or its summary if it has none
+func (c command) description() string {
+	if c.help != "" {
+		return c.help
+	}
+	return c.summary + "."
+}
+
+// children returns the commands in a group, or the top-level commands for ""
+func children(commands []command, group string) []command {
+	var found []command
+	for _, c := range commands {
+		parent, word := "", c.name
+		if i := strings.LastIndex(c.name, " "); i >= 0 {
+			parent, word = c.name[:i], c.name[i+1:]
+		}
+		if parent == group {
+			c.name = word
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// printCommands writes a list of commands with their summaries
+func printCommands(commands []command) {
+	tw := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+}
+
+// runCommand runs the subcommand named by the leading words of args
+func runCommand(args []string) {
+	commands := subcommands()
+	var match *command
+	for i, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			match = &commands[i]
+		}
+	}
+	if match == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
+	if match.setup == nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n", match.synopsis(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "%s\n\n", match.description())
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		printCommands(children(commands, match.name))
+		fmt.Fprintf(os.Stderr, "\nRun '%s %s COMMAND -h' for options.\n", os.Args[0], match.name)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(match.name, flag.ExitOnError)
+	action := match.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n", match.synopsis(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "%s\n\n", match.description())
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[len(strings.Fields(match.name)):])
+	action()
+}
@@ -0,0 +1,241 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/shell"
+)
+
+// completionCommand sets up the completion subcommand, which prints a shell
+// completion script
+func completionCommand(fs *flag.FlagSet) func() {
+	return func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var err error
+		switch fs.Arg(0) {
+		case "bash":
+			err = writeBashCompletion(os.Stdout, subcommands())
+		case "zsh":
+			err = writeZshCompletion(os.Stdout, subcommands())
+		case "fish":
+			err = writeFishCompletion(os.Stdout, subcommands())
+		default:
+			fs.Usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatalf("Failed to write completion: %v", err)
+		}
+	}
+}
+
+// commandFlags returns the options of a command, or the server's for a
+// group, whose commands have their own
+func commandFlags(c command) *flag.FlagSet {
+	if c.name == "" {
+		return flag.CommandLine
+	}
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	if c.setup != nil {
+		c.setup(fs)
+	}
+	return fs
+}
+
+// completionPaths returns the server itself, as a command named "", and
+// then the subcommands
+func completionPaths(commands []command) []command {
+	return append([]command{{}}, commands...)
+}
+
+// isBoolFlag reports whether a flag is set without a value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagSummary returns the first sentence of a flag's usage, for shells that
+// show descriptions beside completions
+func flagSummary(f *flag.Flag) string {
+	_, usage := flag.UnquoteUsage(f)
+	if i := strings.Index(usage, " ("); i > 0 {
+		usage = usage[:i]
+	}
+	if i := strings.Index(usage, "; "); i > 0 {
+		usage = usage[:i]
+	}
+	return usage
+}
+
+// commandPattern returns a case pattern matching the names of commands
+func commandPattern(commands []command) string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, shell.Quote(c.name))
+	}
+	return strings.Join(names, "|")
+}
+
+// writeBashCompletion writes a bash completion script. It completes command
+// names and options, and files everywhere else.
+func writeBashCompletion(w io.Writer, commands []command) error {
+	var b strings.Builder
+	b.WriteString("# bash completion for ssh-hypervisor, generated by 'ssh-hypervisor completion bash'\n\n")
+	b.WriteString("_ssh_hypervisor() {\n")
+	b.WriteString("    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	b.WriteString("    local cmd=\"\" next i\n")
+	b.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("        next=\"${cmd:+$cmd }${COMP_WORDS[i]}\"\n")
+	b.WriteString("        case $next in\n")
+	fmt.Fprintf(&b, "        %s) cmd=$next ;;\n", commandPattern(commands))
+	b.WriteString("        *) break ;;\n")
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n\n")
+	b.WriteString("    local words=\"\" flags=\"\" values=\"\"\n")
+	b.WriteString("    case $cmd in\n")
+	for _, c := range completionPaths(commands) {
+		var words, flags, values []string
+		for _, child := range children(commands, c.name) {
+			words = append(words, child.name)
+		}
+		commandFlags(c).VisitAll(func(f *flag.Flag) {
+			flags = append(flags, "-"+f.Name)
+			if !isBoolFlag(f) {
+				values = append(values, "-"+f.Name)
+			}
+		})
+		fmt.Fprintf(&b, "    %s)\n", shell.Quote(c.name))
+		fmt.Fprintf(&b, "        words=%s\n", shell.Quote(strings.Join(words, " ")))
+		fmt.Fprintf(&b, "        flags=%s\n", shell.Quote(strings.Join(flags, " ")))
+		fmt.Fprintf(&b, "        values=%s\n", shell.Quote(strings.Join(values, " ")))
+		b.WriteString("        ;;\n")
+	}
+	b.WriteString("    esac\n\n")
+	b.WriteString("    COMPREPLY=()\n")
+	b.WriteString("    if [[ \" $values \" == *\" $prev \"* ]]; then\n")
+	b.WriteString("        return\n")
+	b.WriteString("    elif [[ $cur == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("    elif [[ -n $words && $i -eq $COMP_CWORD ]]; then\n")
+	b.WriteString("        COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n\n")
+	b.WriteString("complete -o default -F _ssh_hypervisor ssh-hypervisor\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeZshCompletion writes a zsh completion script, which works both from a
+// directory in fpath and when sourced
+func writeZshCompletion(w io.Writer, commands []command) error {
+	var b strings.Builder
+	b.WriteString("#compdef ssh-hypervisor\n")
+	b.WriteString("# zsh completion for ssh-hypervisor, generated by 'ssh-hypervisor completion zsh'\n\n")
+	b.WriteString("_ssh_hypervisor() {\n")
+	b.WriteString("    local cmd=\"\" next i\n")
+	b.WriteString("    local -a cmds flags values\n")
+	b.WriteString("    for ((i = 2; i < CURRENT; i++)); do\n")
+	b.WriteString("        next=\"${cmd:+$cmd }${words[i]}\"\n")
+	b.WriteString("        case $next in\n")
+	fmt.Fprintf(&b, "        (%s) cmd=$next ;;\n", commandPattern(commands))
+	b.WriteString("        (*) break ;;\n")
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n\n")
+	b.WriteString("    case $cmd in\n")
+	for _, c := range completionPaths(commands) {
+		fmt.Fprintf(&b, "    (%s)\n", shell.Quote(c.name))
+		b.WriteString("        cmds=(")
+		for _, child := range children(commands, c.name) {
+			fmt.Fprintf(&b, "\n            %s", shell.Quote(child.name+":"+child.summary))
+		}
+		b.WriteString(")\n")
+		b.WriteString("        flags=(")
+		var values []string
+		commandFlags(c).VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(&b, "\n            %s", shell.Quote("-"+f.Name+":"+flagSummary(f)))
+			if !isBoolFlag(f) {
+				values = append(values, shell.Quote("-"+f.Name))
+			}
+		})
+		b.WriteString(")\n")
+		fmt.Fprintf(&b, "        values=(%s)\n", strings.Join(values, " "))
+		b.WriteString("        ;;\n")
+	}
+	b.WriteString("    esac\n\n")
+	b.WriteString("    if (( ${values[(Ie)${words[CURRENT-1]}]} )); then\n")
+	b.WriteString("        _files\n")
+	b.WriteString("    elif [[ ${words[CURRENT]} == -* ]]; then\n")
+	b.WriteString("        _describe -o option flags\n")
+	b.WriteString("    elif (( i == CURRENT && $#cmds )); then\n")
+	b.WriteString("        _describe command cmds\n")
+	b.WriteString("    else\n")
+	b.WriteString("        _files\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n\n")
+	b.WriteString("if [[ $funcstack[1] == _ssh_hypervisor ]]; then\n")
+	b.WriteString("    _ssh_hypervisor \"$@\"\n")
+	b.WriteString("else\n")
+	b.WriteString("    compdef _ssh_hypervisor ssh-hypervisor\n")
+	b.WriteString("fi\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeFishCompletion writes a fish completion script
+func writeFishCompletion(w io.Writer, commands []command) error {
+	var b strings.Builder
+	b.WriteString("# fish completion for ssh-hypervisor, generated by 'ssh-hypervisor completion fish'\n\n")
+
+	// __ssh_hypervisor_command prints the command named by the words before
+	// the cursor, and fails if other arguments follow it
+	b.WriteString("function __ssh_hypervisor_command\n")
+	b.WriteString("    set -l commands")
+	for _, c := range commands {
+		b.WriteString(" " + shell.Quote(c.name))
+	}
+	b.WriteString("\n")
+	b.WriteString("    set -l cmd ''\n")
+	b.WriteString("    for word in (commandline -opc)[2..-1]\n")
+	b.WriteString("        set -l next (string trim -- \"$cmd $word\")\n")
+	b.WriteString("        if not contains -- $next $commands\n")
+	b.WriteString("            echo $cmd\n")
+	b.WriteString("            return 1\n")
+	b.WriteString("        end\n")
+	b.WriteString("        set cmd $next\n")
+	b.WriteString("    end\n")
+	b.WriteString("    echo $cmd\n")
+	b.WriteString("end\n\n")
+	b.WriteString("function __ssh_hypervisor_using\n")
+	b.WriteString("    set -l cmd (__ssh_hypervisor_command)\n")
+	b.WriteString("    test \"$cmd\" = \"$argv[1]\"\n")
+	b.WriteString("end\n\n")
+	b.WriteString("function __ssh_hypervisor_needs\n")
+	b.WriteString("    set -l cmd (__ssh_hypervisor_command); and test \"$cmd\" = \"$argv[1]\"\n")
+	b.WriteString("end\n\n")
+
+	for _, c := range completionPaths(commands) {
+		for _, child := range children(commands, c.name) {
+			fmt.Fprintf(&b, "complete -c ssh-hypervisor -f -n %s -a %s -d %s\n",
+				shell.Quote(`__ssh_hypervisor_needs "`+c.name+`"`), shell.Quote(child.name), shell.Quote(child.summary))
+		}
+		commandFlags(c).VisitAll(func(f *flag.Flag) {
+			value := ""
+			if !isBoolFlag(f) {
+				value = " -r"
+			}
+			fmt.Fprintf(&b, "complete -c ssh-hypervisor -n %s -o %s%s -d %s\n",
+				shell.Quote(`__ssh_hypervisor_using "`+c.name+`"`), f.Name, value, shell.Quote(flagSummary(f)))
+		})
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
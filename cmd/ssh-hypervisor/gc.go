@@ -0,0 +1,55 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// gcCommand sets up the gc subcommand, which prunes data of stopped VMs and
+// unreferenced artifacts
+func gcCommand(fs *flag.FlagSet) func() {
+	var (
+		dataDir = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+		keepFor = fs.Duration("keep-for", 0, "Remove data of VMs unused for longer than this (0 = no age limit)")
+		maxSize = fs.Int("max-size", 0, "Remove least recently used VMs until per-VM data fits in this many MB (0 = unlimited)")
+		dryRun  = fs.Bool("dry-run", false, "Print what would be removed without removing anything")
+	)
+	return func() {
+		policy := vm.GCPolicy{
+			KeepFor: *keepFor,
+			MaxSize: int64(*maxSize) * 1024 * 1024,
+			DryRun:  *dryRun,
+		}
+		pruned, err := vm.CollectGarbage(*dataDir, policy, nil)
+
+		var freed int64
+		for _, p := range pruned {
+			fmt.Printf("%s\t%d MB\tlast used %s\n", p.ID, p.Size/(1024*1024), p.LastUsed.Format(time.RFC3339))
+			freed += p.Size
+		}
+		verb := "Removed"
+		if *dryRun {
+			verb = "Would remove"
+		}
+		fmt.Printf("%s %d VMs, freeing %d MB\n", verb, len(pruned), freed/(1024*1024))
+		if err != nil {
+			log.Fatalf("Garbage collection failed: %v", err)
+		}
+
+		blobs, err := vm.CollectArtifacts(*dataDir, *dryRun)
+		freed = 0
+		for _, b := range blobs {
+			fmt.Printf("%s\t%d MB\n", b.Digest, b.Size/(1024*1024))
+			freed += b.Size
+		}
+		fmt.Printf("%s %d artifacts, freeing %d MB\n", verb, len(blobs), freed/(1024*1024))
+		if err != nil {
+			log.Fatalf("Garbage collection failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/harden"
+)
+
+// applyLimits sets the umask and raises the open file limit, exiting if it
+// is still too low for the configured number of VMs
+func applyLimits(config *internal.Config) {
+	if config.Umask != "" {
+		mask, _ := strconv.ParseUint(config.Umask, 8, 32) // Checked by Validate
+		syscall.Umask(int(mask))
+	}
+
+	limit, err := harden.RaiseFileLimit()
+	if err != nil {
+		log.Warnf("Failed to raise open file limit: %v", err)
+	}
+	if err := harden.CheckFileLimit(limit, config.MaxConcurrentVMs); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if config.MaxConcurrentVMs == 0 {
+		log.Printf("Open file limit is %d, enough for about %d VMs", limit, harden.MaxVMs(limit))
+	}
+}
+
+// applyLandlock keeps the server and the Firecracker processes it starts
+// from writing outside the paths it needs, once everything outside of them
+// has been set up
+func applyLandlock(config *internal.Config) {
+	writable := []string{config.DataDir, "/dev", "/proc", "/sys", "/run", os.TempDir()}
+	if err := harden.Landlock(writable); err != nil {
+		log.Fatalf("Failed to enable Landlock: %v", err)
+	}
+	log.Printf("Landlock enabled, writes are limited to %v", writable)
+}
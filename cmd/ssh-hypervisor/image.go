@@ -0,0 +1,104 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+)
+
+// imageBuildCommand sets up image build, which builds a rootfs from a spec
+func imageBuildCommand(fs *flag.FlagSet) func() {
+	var (
+		output      = fs.String("o", "rootfs.ext4", "File to write the image to")
+		catalog     = fs.String("catalog", "", "Image catalog to add the image to, as used by -images (empty = none)")
+		name        = fs.String("name", "", "Name of the image in the catalog (default: the spec's file name)")
+		description = fs.String("description", "", "Description of the image shown to users picking one")
+	)
+	return func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to open spec: %v", err)
+		}
+		spec, err := image.ParseSpec(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Invalid spec %s: %v", fs.Arg(0), err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := image.Build(ctx, spec, filepath.Dir(fs.Arg(0)), *output, os.Stderr); err != nil {
+			log.Fatalf("Image build failed: %v", err)
+		}
+		fmt.Printf("Built %s\n", *output)
+
+		if *catalog == "" {
+			return
+		}
+		if *name == "" {
+			*name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+		}
+		rootfs, err := filepath.Abs(*output)
+		if err != nil {
+			log.Fatalf("Failed to add image to catalog: %v", err)
+		}
+		sum, err := image.FileSHA256(rootfs)
+		if err != nil {
+			log.Fatalf("Failed to add image to catalog: %v", err)
+		}
+		img := image.Image{Name: *name, Rootfs: rootfs, SHA256: sum, Description: *description}
+		if err := image.AddToCatalog(*catalog, img); err != nil {
+			log.Fatalf("Failed to add image to catalog: %v", err)
+		}
+		fmt.Printf("Added %s to %s\n", *name, *catalog)
+	}
+}
+
+// imageListCommand sets up image list, which prints a catalog's images
+func imageListCommand(fs *flag.FlagSet) func() {
+	var (
+		catalog = fs.String("catalog", "images.json", "Image catalog to list, as used by -images")
+		output  = outputFlag(fs)
+	)
+	return func() {
+		checkOutput(*output)
+
+		images, err := image.LoadCatalog(*catalog)
+		if err != nil {
+			log.Fatalf("Failed to load catalog: %v", err)
+		}
+		var rows [][]string
+		for i, img := range images {
+			name := img.Name
+			if i == 0 {
+				name += " (default)"
+			}
+			memory, cpus := "-", "-"
+			if img.Memory != 0 {
+				memory = fmt.Sprintf("%d MB", img.Memory)
+			}
+			if img.CPUs != 0 {
+				cpus = strconv.Itoa(img.CPUs)
+			}
+			rows = append(rows, []string{name, img.Rootfs, memory, cpus, img.Description})
+		}
+		if err := writeOutput(os.Stdout, *output, images, []string{"NAME", "ROOTFS", "MEMORY", "CPUS", "DESCRIPTION"}, rows); err != nil {
+			log.Fatalf("Failed to list images: %v", err)
+		}
+	}
+}
@@ -8,10 +8,15 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/objstore"
 	"github.com/ekzhang/ssh-hypervisor/internal/server"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,45 +32,304 @@ func main() {
 	var (
 		port             = flag.Int("port", 2222, "SSH server port")
 		hostKey          = flag.String("host-key", "", "Path to SSH host key (generated if not provided)")
-		vmCIDR           = flag.String("vm-cidr", "192.168.100.0/24", "CIDR block for VM IP addresses")
+		vmCIDR           = flag.String("vm-cidr", "192.168.100.0/24", "CIDR blocks for VM IP addresses, separated by commas")
 		vmMemory         = flag.Int("vm-memory", 128, "VM memory in MB")
+		vmMaxMemory      = flag.Int("vm-max-memory", 0, "Memory in MB that running VMs can be resized up to with the memory command (0 = no resizing)")
 		vmCPUs           = flag.Int("vm-cpus", 1, "Number of VM CPUs")
 		maxConcurrentVMs = flag.Int("max-concurrent-vms", 16, "Maximum number of concurrent VMs (0 = unlimited)")
 		dataDir          = flag.String("data-dir", "./data", "Directory for VM snapshots and data")
-		rootfs           = flag.String("rootfs", "", "Path to rootfs image (required)")
+		rootfs           = flag.String("rootfs", "", "Path to rootfs image, or an s3:// URL to download it from (required unless -images is set)")
+		images           = flag.String("images", "", "JSON catalog of rootfs images with per-image defaults, which users pick from when their VM is created, instead of -rootfs")
 		allowInternet    = flag.Bool("allow-internet", false, "Allow VMs to access the internet")
+		countTraffic     = flag.Bool("count-traffic", false, "Count each VM's bytes and packets to and from beyond the host with iptables rules, for metrics, the API, user stats, and usage records")
+		egressBlock      = flag.String("egress-block", vm.DefaultEgressBlock, "Outbound ports rejected for VMs with Internet access, as tcp/PORTS or udp/PORTS separated by commas (empty = none)")
+		egressMaxConns   = flag.Int("egress-max-conns", 0, "Quarantine VMs with more open outbound connections than this (0 = unlimited)")
+		egressMaxDests   = flag.Int("egress-max-dests", 0, "Quarantine VMs connected to more distinct destinations than this, as in port scans (0 = unlimited)")
+		egressLog        = flag.Bool("egress-log", false, "Log each VM's new outbound flows to egress.jsonl in its data directory")
+		breakInCheck     = flag.Bool("break-in-check", false, "Alert when anything but the hypervisor connects to a VM's SSH server, which means network isolation was bypassed")
+		containerMode    = flag.Bool("container", false, "Run inside a container: reuse pre-created TAP devices and leave sysctls such as ip_forward to the orchestrator")
+		macPrefix        = flag.String("mac-prefix", "02:FC", "Leading 1-3 bytes of VM MAC addresses; give each host on a shared L2 segment a different locally administered prefix")
+		vmHostname       = flag.String("vm-hostname", "", "Template of guests' hostnames with .User, .Image, and .Node, like {{.User}}.box (default: the user name)")
+		vmHosts          = flag.String("vm-hosts", "", "Names for the host in guests' /etc/hosts, resolving to their gateway, separated by commas, like hypervisor")
+		mdns             = flag.Bool("mdns", false, "Announce each VM's hostname under .local over mDNS on the bridge, with the services in its mdns-services label like \"http:8080\", unless it is labeled mdns=off")
+		entropyRate      = flag.Int("entropy-rate", 40960, "Bytes per second each VM may read from its virtio-rng device (0 = unlimited, negative = no device, for old Firecracker versions)")
+		entropyBurst     = flag.Int("entropy-burst", 4096, "Bytes each VM may read from virtio-rng at once on top of -entropy-rate, like at boot")
+		entropySeed      = flag.Int("entropy-seed", 512, "Random bytes from the host mixed into each guest's entropy pool after boot (0 = none)")
+		nestedKVM        = flag.Bool("nested-kvm", false, "Let VMs labeled nested-kvm=on, like from a user's -vm-labels profile, run their own VMs with KVM, if the host's KVM module has nested virtualization")
+		allowUnsupported = flag.Bool("allow-unsupported", false, "Start even when the Firecracker or kernel binary is outside the supported versions shown by -version")
+		rootfsMode       = flag.String("rootfs-mode", internal.RootfsCopy, "How VMs get a writable rootfs: copy (full per-VM image), overlay (shared read-only image plus per-VM overlay drive), or ephemeral (shared read-only image plus in-memory overlay, for stateless demos)")
+		overlaySize      = flag.Int("overlay-size", 1024, "Size in MB of the per-VM overlay drive in overlay mode")
+		objectStore      = flag.String("object-store", "", "S3 URL like s3://bucket/prefix where stopped VMs' disks and snapshots are kept, so any host can start any VM; credentials and endpoint come from the AWS_* environment variables (empty = only on this host)")
+		userRootfs       = flag.Int("user-rootfs", 0, "Largest ext4 image in MB users may bring to replace their VM's disk, uploaded with \"sftp -s rootfs user@host\" or fetched with \"ssh user@host rootfs fetch URL\" (0 = disabled)")
+		diskQuota        = flag.Int("disk-quota", 0, "Disk space in MB each user's VM data may take, checked when they bring their own rootfs (0 = unlimited)")
+		snapshots        = flag.Int("snapshots", 3, "Snapshots of its disk each user may keep, saved and restored with \"ssh user@host snapshot\" (0 = disabled)")
+		storage          = flag.String("storage", internal.StorageCopy, "How VMs' rootfs copies are made in copy mode: copy, reflink (XFS or Btrfs), or a clone of the volume -rootfs names with lvm-thin, zfs-clone, or dm-thin")
+		sshCiphers       = flag.String("ssh-ciphers", "", "SSH ciphers offered to clients, separated by commas, like aes256-gcm@openssh.com,aes256-ctr (empty = library defaults)")
+		sshMACs          = flag.String("ssh-macs", "", "SSH MACs offered to clients, separated by commas (empty = library defaults)")
+		sshKex           = flag.String("ssh-kex", "", "SSH key exchanges offered to clients, separated by commas (empty = library defaults)")
+		sshMinRSABits    = flag.Int("ssh-min-rsa-bits", 0, "Smallest RSA key clients may authenticate with, like 2048; weaker keys fall back to other methods (0 = any)")
+		maxAuthTries     = flag.Int("max-auth-tries", 6, "Authentication attempts allowed per connection before it is closed")
+		authBanner       = flag.String("auth-banner", "", "Message shown to clients after their authentication is refused, like where to register a key")
+		encryptionKey    = flag.String("encryption-key", "", "File with a 32-byte master key, as hex or base64, that stopped VMs' disks are encrypted with (empty = disabled)")
+		umask            = flag.String("umask", "027", "File mode creation mask of the server, in octal, so VM disks and logs aren't readable by other users (empty = inherited)")
+		landlock         = flag.Bool("landlock", false, "Use Landlock to keep the server and Firecracker from writing outside the data directory, /dev, /proc, /sys, /run, and /tmp")
+		sharedDirs       = flag.String("shared-dirs", "", "Host directories to mount into VMs as HOST:GUEST[:ro], comma-separated; {user} in HOST is replaced by the username (requires a backend with virtio-fs)")
+		shutdownTimeout  = flag.Duration("shutdown-timeout", 3*time.Second, "How long to wait for a VM to shut down cleanly before killing it (0 = kill immediately)")
+		shutdownCommand  = flag.String("shutdown-command", "", "Command run in the guest over SSH to shut it down, e.g. reboot (default: send Ctrl+Alt+Del)")
+		clockSync        = flag.Duration("clock-sync", 0, "How often running VMs' clocks are set from the host's, besides after boot (0 = only after boot, negative = never)")
+		healthCheck      = flag.Duration("health-check", 30*time.Second, "How often booted VMs' guests are checked to answer SSH; VMs that miss 3 checks in a row are stopped and their sessions told (0 = never)")
+		tcpKeepAlive     = flag.Duration("tcp-keepalive", 30*time.Second, "TCP keep-alive period for client connections (negative to disable)")
+		clientRate       = flag.Int("client-rate", 0, "Output written to each SSH session's client, in KB per second (0 = unlimited)")
+		clientStall      = flag.Duration("client-stall", 2*time.Minute, "Close sessions whose client reads none of their output for this long (0 = never)")
+		wsPort           = flag.Int("ws-port", 0, "Port for SSH-over-WebSocket listener (0 = disabled)")
+		wsCert           = flag.String("ws-cert", "", "Path to TLS certificate for the WebSocket listener (serves wss://)")
+		wsKey            = flag.String("ws-key", "", "Path to TLS private key for the WebSocket listener")
+		vmLogLevel       = flag.String("vm-log-level", "warn", "Log level for the per-VM Firecracker and SDK logs (debug, info, warn, error)")
+		vmLogMaxSize     = flag.Int("vm-log-max-size", 10, "Size in MB at which per-VM console and SDK logs are rotated (0 = unlimited)")
+		vmLogMaxFiles    = flag.Int("vm-log-max-files", 3, "Number of rotated per-VM log files to keep")
+		consoleRate      = flag.Int("console-rate", 256, "Guest serial output kept in each VM's console.out, in KB per second after a one-second burst, beyond which it is dropped (0 = unlimited)")
+		vmLogRetention   = flag.Duration("vm-log-retention", 7*24*time.Hour, "How long to keep old per-VM logs before pruning (0 = forever)")
+		maxConcurrentIO  = flag.Int("max-concurrent-io", 2, "Maximum number of concurrent heavy disk operations such as rootfs copies (0 = unlimited)")
+		minFreeSpace     = flag.Int("min-free-space", 1024, "Free space in MB to keep on the data directory; new VMs are refused below this")
+		gcKeepFor        = flag.Duration("gc-keep-for", 0, "Remove data of VMs unused for longer than this (0 = keep forever)")
+		gcMaxSize        = flag.Int("gc-max-size", 0, "Total size in MB of per-VM data before the least recently used VMs are removed (0 = unlimited)")
+		schedule         = flag.String("schedule", "", "File of \"MIN HOUR DOM MON DOW stop|destroy [SELECTOR]\" jobs run in local time")
+		scheduleDryRun   = flag.Bool("schedule-dry-run", false, "Log what scheduled jobs would do without stopping or destroying VMs")
+		httpAddr         = flag.String("http-addr", "", "Address for the HTTP status and metrics listener, e.g. 127.0.0.1:9090 (empty = disabled)")
+		httpAllow        = flag.String("http-allow", "", "Client addresses allowed on the HTTP listener, as IPs or CIDRs separated by commas, like 10.0.0.0/8 (empty = all)")
+		httpProxies      = flag.String("http-proxies", "", "Reverse proxies in front of the HTTP listener, as IPs or CIDRs separated by commas, whose X-Forwarded-For is trusted for -http-allow and logs")
+		httpAccessLog    = flag.Bool("http-access-log", false, "Log every request to the HTTP listener")
+		httpCert         = flag.String("http-cert", "", "Path to TLS certificate for the HTTP listener (serves https://)")
+		httpKey          = flag.String("http-key", "", "Path to TLS private key for the HTTP listener")
+		httpClientCA     = flag.String("http-client-ca", "", "CA certificate whose client certificates may use the HTTP API, matched to -api-tokens names by common name if given (requires -http-cert)")
+		apiTokens        = flag.String("api-tokens", "", "File of \"NAME SCOPE TOKEN\" lines of clients allowed to use the HTTP API and metrics, with scope read or admin (empty = open)")
+		persistEvents    = flag.Bool("persist-events", false, "Append VM lifecycle events to events.jsonl in each VM's data directory")
+		activityFeed     = flag.String("activity-feed", "", "Publish recent logins at /feed.json and /feed.rss on the HTTP listener: names, anonymous (no usernames, hourly times), or empty to disable")
+		usageExport      = flag.String("usage-export", "", "Export per-user usage records to csv:PATH, jsonl:PATH, or an HTTP URL (empty = disabled)")
+		usageInterval    = flag.Duration("usage-interval", 5*time.Minute, "How often usage of running VMs is exported")
+		quotaHours       = flag.Int("quota-hours", 0, "Monthly VM-hours allowed per user (0 = unlimited)")
+		quotaTraffic     = flag.Int("quota-traffic-gb", 0, "Monthly GB of traffic beyond the host allowed per user, with -count-traffic (0 = unlimited)")
+		sessionCommand   = flag.String("session-command", "", "Program run in VMs instead of the default shell, e.g. a restricted shell or REPL")
+		sessionCommands  = flag.String("session-commands", "", "File of \"USER COMMAND\" lines overriding -session-command per user")
+		reattach         = flag.Duration("reattach", 0, "How long a VM keeps running after its user's last session ends; interactive sessions run in a multiplexer that reconnecting re-attaches to (0 = stop at once)")
+		multiplexer      = flag.String("multiplexer", internal.MultiplexerTmux, "Terminal multiplexer in the VM that -reattach runs sessions in: tmux or screen")
+		proxySubsystems  = flag.String("proxy-subsystems", "", "SSH subsystems forwarded to the VM's sshd, separated by commas, e.g. sftp")
+		vmLabels         = flag.String("vm-labels", "", "JSON file of labels given to each user's VM at creation, like {\"*\": {\"class\": \"workshop\"}}")
+		hooks            = flag.String("hooks", "", "Directory of pre-boot, post-boot, and pre-destroy executables run for each VM, with its ID, IP, user, and data dir in SSH_HYPERVISOR_* variables")
+		adminKeys        = flag.String("admin-keys", "", "authorized_keys file of admins who may attach to any user's VM as attach+USER")
+		adminNotify      = flag.Bool("admin-notify", false, "Notify users logged in to a VM when an admin attaches")
+		totpUsers        = flag.String("totp-users", "", "File of \"USER SECRET\" lines of users who must enter a TOTP code to log in, with base32 secrets")
+		tiers            = flag.String("tiers", "", "File of \"USER TIER\" lines putting users in the admin or supporter tier; at capacity, their new VMs stop idle VMs of lower tiers")
+		terms            = flag.String("terms", "", "File of terms of service shown to users, who must answer \"yes\" to accept them before their first VM boots")
+		termsVersion     = flag.String("terms-version", "", "Version of -terms recorded with each acceptance; users accept again when it changes (default: a hash of the file)")
+		dropPort         = flag.Int("drop-port", 0, "Port on the VM networks' gateways where VMs copy text to their users' clipboards and drop files for them (0 = disabled)")
+		egressProxy      = flag.Int("egress-proxy", 0, "Port on the VM networks' gateways of an HTTP(S) proxy that VMs without -allow-internet reach allowed domains through (0 = disabled)")
+		egressProxyAllow = flag.String("egress-proxy-allow", "", "File of domains the egress proxy may reach, one per line, with *.example.com for subdomains (empty = any)")
+		egressProxyMaxMB = flag.Int("egress-proxy-max-mb", 0, "Largest response in MB the egress proxy passes to a VM (0 = unlimited)")
+		packageCache     = flag.Int("package-cache", 0, "Port on the VM networks' gateways of a caching mirror of Alpine, Debian, PyPI, and npm that VMs are pointed at (0 = disabled)")
+		packageCacheGB   = flag.Int("package-cache-gb", 10, "Size the package cache is kept under, in GB (0 = unlimited)")
+		registryCache    = flag.Int("registry-cache", 0, "Port on the VM networks' gateways of a pull-through cache of Docker Hub that Docker and Podman in VMs are pointed at (0 = disabled)")
+		registryCacheGB  = flag.Int("registry-cache-gb", 20, "Size the registry cache is kept under, in GB (0 = unlimited)")
+		geoIPDB          = flag.String("geoip-db", "", "MaxMind country database (.mmdb), like GeoLite2-Country, to tag connections with their country")
+		geoIPAllow       = flag.String("geoip-allow", "", "Countries given VMs, as ISO codes separated by commas, like US,CA (empty = all)")
+		geoIPDeny        = flag.String("geoip-deny", "", "Countries refused VMs, as ISO codes separated by commas (\"unknown\" for addresses not in the database)")
+		geoIPMaxVMs      = flag.String("geoip-max-vms", "", "Running VMs allowed per country, like US=50,*=10 (empty = unlimited)")
+		messages         = flag.String("messages", "", "JSON file of translated messages shown to users, by language")
+		showCapacity     = flag.Bool("show-capacity", true, "Show how many VMs are in use out of the server's capacity in the welcome message")
+		animationMax     = flag.Int("animation-max", 100, "Sessions provisioning at once above which new sessions get a line per boot stage instead of an animated progress bar (0 = always animate)")
+		terminalTitle    = flag.Bool("terminal-title", true, "Set the client's terminal title to user@vm while connected, restoring it on exit")
+		coordinator      = flag.String("coordinator", "", "Base URL of a cluster coordinator to register this node's capacity with (empty = standalone)")
+		nodeName         = flag.String("node-name", "", "Name this node registers with the coordinator as (default: the hostname)")
+		advertiseAddr    = flag.String("advertise-addr", "", "SSH address advertised to the coordinator (default: node name and -port)")
+		heartbeat        = flag.Duration("heartbeat", 10*time.Second, "How often node status is sent to the coordinator")
+		publicHost       = flag.String("public-host", "", "Public hostname shown in connection instructions (default: address clients connected to)")
+		moshPorts        = flag.String("mosh-ports", "", "Host UDP port range relayed to VMs for mosh, e.g. 60000-60999 (empty = disabled)")
+		moshPortsPerVM   = flag.Int("mosh-ports-per-vm", 10, "Number of UDP ports relayed to each VM for mosh")
+		networkDryRun    = flag.Bool("network-dry-run", false, "Print the bridge, TAP, sysctl, and iptables commands the server would run to set up networking, then exit without running them")
 		version          = flag.Bool("version", false, "Show version information")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s COMMAND [options] [ARGS]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "ssh-hypervisor - SSH server that dynamically provisions Linux microVMs\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		printCommands(children(subcommands(), ""))
+		fmt.Fprintf(os.Stderr, "\nRun '%s COMMAND -h' for a command's options.\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
+	// Subcommands come after the server's options are defined, so the
+	// completion and man commands can describe them
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	flag.Parse()
 
 	if *version {
 		fmt.Printf("ssh-hypervisor %s\n", getVersion())
+		versions := vm.DetectVersions(vm.GetFirecrackerBinary(), vm.GetVmlinuxBinary())
+		fmt.Printf("firecracker %s\n", versions.Firecracker)
+		fmt.Printf("kernel %s\n", versions.Kernel)
+		for _, problem := range versions.Unsupported {
+			fmt.Printf("unsupported: %s\n", problem)
+		}
 		return
 	}
 
+	if *nodeName == "" {
+		*nodeName, _ = os.Hostname()
+	}
+
 	config := &internal.Config{
 		Port:             *port,
 		HostKey:          *hostKey,
 		VMCIDR:           *vmCIDR,
 		VMMemory:         *vmMemory,
+		VMMaxMemory:      *vmMaxMemory,
 		VMCPUs:           *vmCPUs,
 		MaxConcurrentVMs: *maxConcurrentVMs,
 		DataDir:          *dataDir,
 		Rootfs:           *rootfs,
 		AllowInternet:    *allowInternet,
+		CountTraffic:     *countTraffic,
+		EgressBlock:      *egressBlock,
+		BreakInCheck:     *breakInCheck,
+		EgressMaxConns:   *egressMaxConns,
+		EgressMaxDests:   *egressMaxDests,
+		EgressLog:        *egressLog,
+		MACPrefix:        *macPrefix,
+		VMHostname:       *vmHostname,
+		VMHosts:          *vmHosts,
+		MDNS:             *mdns,
+		EntropyRate:      *entropyRate,
+		EntropyBurst:     *entropyBurst,
+		EntropySeed:      *entropySeed,
+		NestedKVM:        *nestedKVM,
+		AllowUnsupported: *allowUnsupported,
+		ContainerMode:    *containerMode,
+		RootfsMode:       *rootfsMode,
+		OverlaySize:      *overlaySize,
+		Snapshots:        *snapshots,
+		Images:           *images,
+		UserRootfs:       *userRootfs,
+		DiskQuota:        *diskQuota,
+		ObjectStore:      *objectStore,
+		Storage:          *storage,
+		SharedDirs:       *sharedDirs,
+		SSHCiphers:       *sshCiphers,
+		SSHMACs:          *sshMACs,
+		SSHKeyExchanges:  *sshKex,
+		SSHMinRSABits:    *sshMinRSABits,
+		MaxAuthTries:     *maxAuthTries,
+		AuthBanner:       *authBanner,
+		EncryptionKey:    *encryptionKey,
+		Umask:            *umask,
+		Landlock:         *landlock,
+		ShutdownTimeout:  *shutdownTimeout,
+		ShutdownCommand:  *shutdownCommand,
+		ClockSync:        *clockSync,
+		HealthCheck:      *healthCheck,
+		TCPKeepAlive:     *tcpKeepAlive,
+		ClientRate:       *clientRate,
+		ClientStall:      *clientStall,
+		WebSocketPort:    *wsPort,
+		WebSocketCert:    *wsCert,
+		WebSocketKey:     *wsKey,
+		VMLogLevel:       *vmLogLevel,
+		VMLogMaxSize:     *vmLogMaxSize,
+		VMLogMaxFiles:    *vmLogMaxFiles,
+		ConsoleRate:      *consoleRate,
+		VMLogRetention:   *vmLogRetention,
+		MaxConcurrentIO:  *maxConcurrentIO,
+		MinFreeSpace:     *minFreeSpace,
+		GCKeepFor:        *gcKeepFor,
+		GCMaxSize:        *gcMaxSize,
+		Schedule:         *schedule,
+		ScheduleDryRun:   *scheduleDryRun,
+		HTTPAddr:         *httpAddr,
+		HTTPAllow:        *httpAllow,
+		HTTPProxies:      *httpProxies,
+		HTTPAccessLog:    *httpAccessLog,
+		HTTPCert:         *httpCert,
+		HTTPKey:          *httpKey,
+		HTTPClientCA:     *httpClientCA,
+		APITokens:        *apiTokens,
+		PersistEvents:    *persistEvents,
+		ActivityFeed:     *activityFeed,
+		UsageExport:      *usageExport,
+		UsageInterval:    *usageInterval,
+		QuotaHours:       *quotaHours,
+		QuotaTraffic:     *quotaTraffic,
+		ProxySubsystems:  *proxySubsystems,
+		VMLabels:         *vmLabels,
+		Hooks:            *hooks,
+		AdminKeys:        *adminKeys,
+		AdminNotify:      *adminNotify,
+		TOTPUsers:        *totpUsers,
+		Tiers:            *tiers,
+		Terms:            *terms,
+		TermsVersion:     *termsVersion,
+		DropPort:         *dropPort,
+		EgressProxy:      *egressProxy,
+		EgressProxyAllow: *egressProxyAllow,
+		EgressProxyMaxMB: *egressProxyMaxMB,
+		PackageCache:     *packageCache,
+		PackageCacheGB:   *packageCacheGB,
+		RegistryCache:    *registryCache,
+		RegistryCacheGB:  *registryCacheGB,
+		SessionCommand:   *sessionCommand,
+		SessionCommands:  *sessionCommands,
+		Reattach:         *reattach,
+		Multiplexer:      *multiplexer,
+		GeoIPDB:          *geoIPDB,
+		GeoIPAllow:       *geoIPAllow,
+		GeoIPDeny:        *geoIPDeny,
+		GeoIPMaxVMs:      *geoIPMaxVMs,
+		Messages:         *messages,
+		TerminalTitle:    *terminalTitle,
+		ShowCapacity:     *showCapacity,
+		AnimationMax:     *animationMax,
+		Coordinator:      *coordinator,
+		NodeName:         *nodeName,
+		AdvertiseAddr:    *advertiseAddr,
+		Heartbeat:        *heartbeat,
+		PublicHost:       *publicHost,
+		MoshPorts:        *moshPorts,
+		MoshPortsPerVM:   *moshPortsPerVM,
+	}
+
+	// A golden image in object storage is cached in the data directory and
+	// kept in its content store
+	if strings.HasPrefix(config.Rootfs, "s3://") {
+		path, err := objstore.Fetch(context.Background(), config.Rootfs, filepath.Join(config.DataDir, vm.ImageCacheDir))
+		if err != nil {
+			log.Fatalf("Failed to fetch rootfs: %v", err)
+		}
+		if path, err = vm.StoreImage(config.DataDir, "rootfs", path); err != nil {
+			log.Fatalf("Failed to fetch rootfs: %v", err)
+		}
+		log.Printf("Using rootfs %s from %s", path, config.Rootfs)
+		config.Rootfs = path
 	}
 
 	if err := config.Validate(); err != nil {
 		log.Fatalf("Configuration error: %v", err)
 	}
+	if *networkDryRun {
+		plan, err := vm.NetworkPlan(config)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		for _, line := range plan {
+			fmt.Println(line)
+		}
+		return
+	}
+	applyLimits(config)
 
 	log.Printf("Starting ssh-hypervisor on port %d", config.Port)
 	log.Printf("VM network: %s", config.VMCIDR)
@@ -78,6 +342,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
+	if config.Landlock {
+		applyLandlock(config)
+	}
 
 	if err := srv.Run(ctx); err != nil {
 		log.Fatalf("Server error: %v", err)
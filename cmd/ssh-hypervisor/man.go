@@ -0,0 +1,95 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// manCommand sets up the man subcommand, which prints the man page
+func manCommand(fs *flag.FlagSet) func() {
+	return func() {
+		if err := writeManPage(os.Stdout, subcommands()); err != nil {
+			log.Fatalf("Failed to write man page: %v", err)
+		}
+	}
+}
+
+// roffEscape escapes text for roff, so dashes, backslashes, and leading dots
+// aren't read as formatting
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeManOptions writes a command's options as a roff list
+func writeManOptions(b *strings.Builder, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		b.WriteString(".TP\n")
+		fmt.Fprintf(b, `\fB\-%s\fR`, roffEscape(f.Name))
+		if name != "" {
+			fmt.Fprintf(b, ` \fI%s\fR`, roffEscape(name))
+		}
+		b.WriteString("\n")
+		b.WriteString(roffEscape(usage))
+		// Defaults that come from the environment are described in the usage
+		// instead, since they would differ between hosts
+		switch f.DefValue {
+		case "", "0", "0s", "false":
+		default:
+			if !strings.Contains(usage, "(default") {
+				fmt.Fprintf(b, " (default %s)", roffEscape(f.DefValue))
+			}
+		}
+		b.WriteString("\n")
+	})
+}
+
+// writeManPage writes a man page in roff describing the server's options and
+// every subcommand
+func writeManPage(w io.Writer, commands []command) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH SSH\\-HYPERVISOR 1 \"\" \"ssh\\-hypervisor %s\" \"User Commands\"\n", roffEscape(getVersion()))
+	b.WriteString(".SH NAME\n")
+	b.WriteString("ssh\\-hypervisor \\- SSH server that dynamically provisions Linux microVMs\n")
+
+	b.WriteString(".SH SYNOPSIS\n")
+	b.WriteString(".B ssh\\-hypervisor\n[options]\n")
+	for _, c := range commands {
+		if c.setup == nil {
+			continue
+		}
+		b.WriteString(".br\n")
+		fmt.Fprintf(&b, ".B ssh\\-hypervisor %s\n", roffEscape(c.name))
+		fmt.Fprintf(&b, "%s\n", roffEscape(strings.TrimSpace("[options] "+c.args)))
+	}
+
+	b.WriteString(".SH DESCRIPTION\n")
+	b.WriteString("Without a command, ssh\\-hypervisor runs an SSH server that boots a Firecracker\n")
+	b.WriteString("microVM for each user who connects, and resumes it when they come back.\n")
+	b.WriteString("The commands manage its data, images, and users, and talk to a running server.\n")
+
+	b.WriteString(".SH OPTIONS\n")
+	writeManOptions(&b, flag.CommandLine)
+
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, ".SS \"%s\"\n", roffEscape(c.synopsis("ssh-hypervisor")))
+		b.WriteString(roffEscape(c.description()) + "\n")
+		writeManOptions(&b, commandFlags(c))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
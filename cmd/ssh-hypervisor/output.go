@@ -0,0 +1,74 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// outputFlag adds the -output option of subcommands that print data
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "table", "Output format: table, json, or yaml")
+}
+
+// checkOutput exits with a usage error if format isn't one writeOutput knows
+func checkOutput(format string) {
+	switch format {
+	case "table", "json", "yaml":
+	default:
+		log.Fatalf("Unknown output format %q (expected table, json, or yaml)", format)
+	}
+}
+
+// writeOutput writes v to w as JSON or YAML, with the same field names in
+// both, or as a table of rows under header for people to read
+func writeOutput(w io.Writer, format string, v any, header []string, rows [][]string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		// Going through JSON keeps its field names and their order, since
+		// JSON is YAML that yaml.v3 parses into a node tree
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		blockStyle(&node)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// blockStyle clears the flow and quoting styles that nodes parsed from JSON
+// have, so they are written as block YAML, quoted only where needed
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
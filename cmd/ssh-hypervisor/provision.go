@@ -0,0 +1,125 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provisionCommand sets up the provision subcommand, which boots VMs for a
+// list of users on a running server ahead of an event
+func provisionCommand(fs *flag.FlagSet) func() {
+	var (
+		api      = addAPIFlags(fs)
+		hold     = fs.Duration("hold", 30*time.Minute, "How long each VM is kept running for its user to connect (up to 1h)")
+		labels   = fs.String("labels", "", "Labels added to every VM, like workshop=2024,room=a")
+		parallel = fs.Int("parallel", 8, "Number of VMs booted at once")
+	)
+	return func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if *parallel < 1 {
+			log.Fatalf("-parallel must be at least 1")
+		}
+		users, err := readUsers(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to read users: %v", err)
+		}
+
+		query := url.Values{"hold": {hold.String()}}
+		for _, label := range strings.Split(*labels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				query.Add("label", label)
+			}
+		}
+
+		// Boot VMs in parallel, printing each result as it finishes
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			failed int
+		)
+		client, err := api.client(5 * time.Minute)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		slots := make(chan struct{}, *parallel)
+		for _, user := range users {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				start := time.Now()
+				err := provisionVM(client, api.baseURL(), user, query)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed++
+					fmt.Printf("%s\tfailed\t%v\n", user, err)
+				} else {
+					fmt.Printf("%s\tready\t%s\n", user, time.Since(start).Round(time.Millisecond))
+				}
+			}()
+		}
+		wg.Wait()
+
+		fmt.Printf("Provisioned %d of %d VMs\n", len(users)-failed, len(users))
+		if failed > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// provisionVM asks the server to boot a user's VM and keep it running for
+// the hold in query, after the request returns
+func provisionVM(client *http.Client, serverURL, user string, query url.Values) error {
+	endpoint := strings.TrimSuffix(serverURL, "/") + "/api/vms/" + url.PathEscape(user) + "?" + query.Encode()
+	resp, err := client.Post(endpoint, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// readUsers reads usernames one per line, skipping blank lines and lines
+// starting with #
+func readUsers(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var users []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		user := strings.TrimSpace(scanner.Text())
+		if user != "" && !strings.HasPrefix(user, "#") {
+			users = append(users, user)
+		}
+	}
+	return users, scanner.Err()
+}
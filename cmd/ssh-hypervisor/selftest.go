@@ -0,0 +1,171 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"github.com/sirupsen/logrus"
+)
+
+// selftestStep is a step of the self test, with the time since it started
+type selftestStep struct {
+	Step    string  `json:"step"`
+	Seconds float64 `json:"seconds"`
+	Detail  string  `json:"detail,omitempty"`
+}
+
+// selftestResult is the outcome of a self test
+type selftestResult struct {
+	OK      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Seconds float64        `json:"seconds"`
+	Steps   []selftestStep `json:"steps"`
+}
+
+// selftestCommand sets up the selftest subcommand, which boots a throwaway
+// VM end to end to check that the host can run VMs
+func selftestCommand(fs *flag.FlagSet) func() {
+	var (
+		dataDir    = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+		rootfs     = fs.String("rootfs", "", "Path to rootfs image (required)")
+		rootfsMode = fs.String("rootfs-mode", internal.RootfsCopy, "How the VM gets a writable rootfs: copy, overlay, or ephemeral")
+		vmCIDR     = fs.String("vm-cidr", "192.168.100.0/24", "CIDR blocks for VM IP addresses, separated by commas")
+		vmMemory   = fs.Int("vm-memory", 128, "VM memory in MB")
+		timeout    = fs.Duration("timeout", 2*time.Minute, "How long the whole test may take")
+		verbose    = fs.Bool("v", false, "Log what the VM manager does")
+		output     = outputFlag(fs)
+	)
+	return func() {
+		checkOutput(*output)
+		if !*verbose {
+			log.SetLevel(logrus.WarnLevel)
+		}
+		config := &internal.Config{
+			Port:            2222,
+			VMCIDR:          *vmCIDR,
+			VMMemory:        *vmMemory,
+			VMCPUs:          1,
+			DataDir:         *dataDir,
+			Rootfs:          *rootfs,
+			RootfsMode:      *rootfsMode,
+			OverlaySize:     1024,
+			ShutdownTimeout: 3 * time.Second,
+			VMLogLevel:      "warn",
+			VMLogMaxSize:    10,
+			VMLogMaxFiles:   3,
+		}
+		if err := config.Validate(); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		result := runSelftest(ctx, config)
+		var rows [][]string
+		for _, s := range result.Steps {
+			rows = append(rows, []string{s.Step, fmt.Sprintf("%.3fs", s.Seconds), s.Detail})
+		}
+		if err := writeOutput(os.Stdout, *output, result, []string{"STEP", "TIME", "DETAIL"}, rows); err != nil {
+			log.Fatalf("Failed to print results: %v", err)
+		}
+		if !result.OK {
+			if *output == "table" {
+				fmt.Printf("Self test failed after %.3fs: %s\n", result.Seconds, result.Error)
+			}
+			os.Exit(1)
+		}
+		if *output == "table" {
+			fmt.Printf("Self test passed in %.3fs\n", result.Seconds)
+		}
+	}
+}
+
+// runSelftest sets up the host, boots a VM, waits for its SSH server, runs
+// true in it, and tears it down, recording when each step finished. The VM
+// gets a random ID, so it never touches a user's VM.
+func runSelftest(ctx context.Context, config *internal.Config) *selftestResult {
+	result := &selftestResult{Steps: []selftestStep{}}
+	start := time.Now()
+	step := func(name string, at time.Time, detail string) {
+		result.Steps = append(result.Steps, selftestStep{Step: name, Seconds: at.Sub(start).Seconds(), Detail: detail})
+	}
+	fail := func(err error) *selftestResult {
+		result.Error = err.Error()
+		result.Seconds = time.Since(start).Seconds()
+		return result
+	}
+
+	manager, err := vm.NewManager(config, logrus.NewEntry(log), vm.GetFirecrackerBinary(), vm.GetVmlinuxBinary())
+	if err != nil {
+		return fail(fmt.Errorf("failed to set up host: %w", err))
+	}
+	step("host-ready", time.Now(), "network "+config.VMCIDR)
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	vmID := "selftest-" + hex.EncodeToString(id)
+
+	progress := make(chan vm.ProgressEvent, 16)
+	drain := func() {
+		for {
+			select {
+			case event := <-progress:
+				step(string(event.Stage), event.Time, event.Detail)
+			default:
+				return
+			}
+		}
+	}
+
+	v, err := manager.GetOrCreateVM(ctx, vmID, progress)
+	drain()
+	if err != nil {
+		os.RemoveAll(filepath.Join(config.DataDir, vmID))
+		return fail(fmt.Errorf("failed to create VM: %w", err))
+	}
+	defer func() {
+		stopStart := time.Now()
+		if err := manager.DestroyVM(context.Background(), vmID); err != nil && result.Error == "" {
+			result.OK = false
+			result.Error = fmt.Sprintf("failed to stop VM: %v", err)
+		}
+		os.RemoveAll(filepath.Join(config.DataDir, vmID))
+		step("stopped", time.Now(), "after "+time.Since(stopStart).Round(time.Millisecond).String())
+		result.Seconds = time.Since(start).Seconds()
+	}()
+
+	err = manager.WaitReady(ctx, v, progress)
+	drain()
+	if err != nil {
+		return fail(fmt.Errorf("VM didn't boot: %w", err))
+	}
+
+	execStart := time.Now()
+	out, err := v.RunCommand(ctx, "true")
+	if err != nil {
+		if out = strings.TrimSpace(out); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return fail(fmt.Errorf("failed to run a command in the VM: %w", err))
+	}
+	step("exec", time.Now(), "true ran in "+time.Since(execStart).Round(time.Millisecond).String())
+
+	result.OK = true
+	return result
+}
@@ -0,0 +1,46 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshfpCommand sets up the sshfp subcommand, which prints the host key's
+// fingerprint and DNS SSHFP records for it
+func sshfpCommand(fs *flag.FlagSet) func() {
+	var (
+		dataDir = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+		hostKey = fs.String("host-key", "", "Path to SSH host key (default: ssh_host_key in the data directory)")
+	)
+	return func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		keyPath := *hostKey
+		if keyPath == "" {
+			keyPath = filepath.Join(*dataDir, "ssh_host_key")
+		}
+		key, err := server.LoadHostPublicKey(keyPath)
+		if err != nil {
+			log.Fatalf("%v (start the server once to generate it)", err)
+		}
+		records, err := server.SSHFPRecords(fs.Arg(0), key)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		fmt.Printf("; %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+		for _, record := range records {
+			fmt.Println(record)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/server"
+)
+
+// statsCommand sets up a stats subcommand, which shows user statistics or
+// moves them between instances
+func statsCommand(command string) func(fs *flag.FlagSet) func() {
+	return func(fs *flag.FlagSet) func() {
+		var (
+			dataDir = fs.String("data-dir", "./data", "Directory for VM snapshots and data")
+			output  = fs.String("o", "-", "File to export to (- for stdout)")
+			format  = outputFlag(fs)
+		)
+		return func() {
+			checkOutput(*format)
+
+			stats := server.NewUserStats(*dataDir)
+			if err := stats.Load(); err != nil {
+				log.Fatalf("Failed to load user stats: %v", err)
+			}
+
+			switch command {
+			case "show":
+				users := stats.Export().Users
+				var rows [][]string
+				for _, u := range users {
+					rows = append(rows, []string{u.Username, strconv.Itoa(u.ConnectCount), u.LastConnected.Local().Format(time.DateTime), u.LastCountry,
+						strconv.FormatUint(u.TrafficIn, 10), strconv.FormatUint(u.TrafficOut, 10)})
+				}
+				if err := writeOutput(os.Stdout, *format, users, []string{"USER", "CONNECTIONS", "LAST CONNECTED", "COUNTRY", "BYTES IN", "BYTES OUT"}, rows); err != nil {
+					log.Fatalf("Failed to show user stats: %v", err)
+				}
+				return
+			case "export":
+				if err := exportStats(stats, *output); err != nil {
+					log.Fatalf("Failed to export user stats: %v", err)
+				}
+				return
+			case "import":
+				if fs.NArg() != 1 {
+					fs.Usage()
+					os.Exit(2)
+				}
+				archive, err := readStatsArchive(fs.Arg(0))
+				if err == nil {
+					err = stats.Import(archive)
+				}
+				if err != nil {
+					log.Fatalf("Failed to import %s: %v", fs.Arg(0), err)
+				}
+			case "merge":
+				if fs.NArg() == 0 {
+					fs.Usage()
+					os.Exit(2)
+				}
+				for _, path := range fs.Args() {
+					archive, err := readStatsArchive(path)
+					if err == nil {
+						err = stats.Merge(archive)
+					}
+					if err != nil {
+						log.Fatalf("Failed to merge %s: %v", path, err)
+					}
+				}
+			}
+
+			if err := stats.Save(); err != nil {
+				log.Fatalf("Failed to save user stats: %v", err)
+			}
+			fmt.Printf("Saved stats of %d users to %s\n", len(stats.Export().Users), *dataDir)
+		}
+	}
+}
+
+// exportStats writes all statistics as a JSON archive to path, or stdout
+func exportStats(stats *server.UserStats, path string) error {
+	data, err := json.MarshalIndent(stats.Export(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// readStatsArchive reads an exported archive from path, or stdin
+func readStatsArchive(path string) (*server.StatsArchive, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var archive server.StatsArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
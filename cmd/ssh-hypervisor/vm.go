@@ -0,0 +1,72 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// vmListCommand sets up vm list, which prints a running server's VMs
+func vmListCommand(fs *flag.FlagSet) func() {
+	var (
+		api      = addAPIFlags(fs)
+		selector = fs.String("label", "", "Only list VMs with these labels, like class=workshop,team=a")
+		output   = outputFlag(fs)
+	)
+	return func() {
+		checkOutput(*output)
+		client, err := api.client(30 * time.Second)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		endpoint := api.baseURL() + "/api/vms"
+		if *selector != "" {
+			endpoint += "?" + url.Values{"label": {*selector}}.Encode()
+		}
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			log.Fatalf("Failed to list VMs: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			log.Fatalf("Failed to list VMs: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		var vms []vm.VMInfo
+		if err := json.NewDecoder(resp.Body).Decode(&vms); err != nil {
+			log.Fatalf("Failed to list VMs: %v", err)
+		}
+
+		var rows [][]string
+		for _, v := range vms {
+			status := string(v.State)
+			if status == "" {
+				// Servers from before VM states
+				status = "stopped"
+				if v.Running {
+					status = "running"
+				}
+			}
+			var labels []string
+			for key, value := range v.Labels {
+				labels = append(labels, key+"="+value)
+			}
+			sort.Strings(labels)
+			rows = append(rows, []string{v.ID, status, v.IP, v.Image, strings.Join(labels, ",")})
+		}
+		if err := writeOutput(os.Stdout, *output, vms, []string{"ID", "STATUS", "IP", "IMAGE", "LABELS"}, rows); err != nil {
+			log.Fatalf("Failed to list VMs: %v", err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"github.com/olekukonko/tablewriter"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// benchResult is the outcome of booting a single VM in benchmark mode
+type benchResult struct {
+	vmID     string
+	create   time.Duration // Time until the VMM was started
+	bootSSH  time.Duration // Time until the guest SSH server accepted a session
+	command  time.Duration // Time to run the benchmark command, if any
+	output   string
+	err      error
+	teardown time.Duration
+}
+
+// benchReport summarizes a benchmark run across all VMs
+type benchReport struct {
+	results []benchResult
+	total   time.Duration
+}
+
+// runBenchmark boots count VMs concurrently, waits for each to accept SSH,
+// optionally runs a command in each, and tears everything down again
+func runBenchmark(ctx context.Context, manager *vm.Manager, count int, command string, timeout time.Duration) *benchReport {
+	log.Printf("Booting %d VMs concurrently...", count)
+
+	start := time.Now()
+	results := make([]benchResult, count)
+
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = benchOne(ctx, manager, fmt.Sprintf("bench-%d", i), command, timeout)
+		}()
+	}
+	wg.Wait()
+
+	return &benchReport{results: results, total: time.Since(start)}
+}
+
+// benchOne boots, measures, and destroys a single VM
+func benchOne(ctx context.Context, manager *vm.Manager, vmID string, command string, timeout time.Duration) benchResult {
+	result := benchResult{vmID: vmID}
+
+	// Always start from a fresh copy of the rootfs
+	if err := os.RemoveAll(filepath.Join(manager.DataDir(), vmID)); err != nil {
+		result.err = fmt.Errorf("remove existing VM data: %w", err)
+		return result
+	}
+
+	start := time.Now()
+	testVM, err := manager.GetOrCreateVM(ctx, vmID, nil)
+	if err != nil {
+		result.err = fmt.Errorf("create VM: %w", err)
+		return result
+	}
+	result.create = time.Since(start)
+
+	defer func() {
+		stopStart := time.Now()
+		if err := manager.DestroyVM(context.Background(), vmID); err != nil {
+			log.Errorf("Error destroying VM %s: %v", vmID, err)
+		}
+		result.teardown = time.Since(stopStart)
+		os.RemoveAll(filepath.Join(manager.DataDir(), vmID))
+	}()
+
+	client, err := dialVMSSH(ctx, testVM.SSHAddr(), timeout)
+	if err != nil {
+		result.err = fmt.Errorf("wait for SSH: %w", err)
+		return result
+	}
+	defer client.Close()
+	result.bootSSH = time.Since(start)
+
+	if command != "" {
+		session, err := client.NewSession()
+		if err != nil {
+			result.err = fmt.Errorf("open session: %w", err)
+			return result
+		}
+		defer session.Close()
+
+		cmdStart := time.Now()
+		output, err := session.CombinedOutput(command)
+		result.command = time.Since(cmdStart)
+		result.output = string(bytes.TrimSpace(output))
+		if err != nil {
+			result.err = fmt.Errorf("run command: %w", err)
+		}
+	}
+
+	return result
+}
+
+// dialVMSSH retries connecting to a VM's SSH server until it accepts a session
+func dialVMSSH(ctx context.Context, addr string, timeout time.Duration) (*cryptoSSH.Client, error) {
+	config := &cryptoSSH.ClientConfig{
+		User:            "root",
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.Password("")},
+		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+		Timeout:         time.Second,
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		client, err := cryptoSSH.Dial("tcp", addr, config)
+		if err == nil {
+			return client, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, fmt.Errorf("timeout after %s: %w", timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Failures returns the number of VMs that did not complete successfully
+func (r *benchReport) Failures() int {
+	failures := 0
+	for _, res := range r.results {
+		if res.err != nil {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Print writes a per-VM table and latency percentiles to w
+func (r *benchReport) Print(w io.Writer) {
+	table := tablewriter.NewTable(w,
+		tablewriter.WithHeader([]string{"VM", "Create", "Boot to SSH", "Command", "Teardown", "Result"}),
+	)
+	var create, bootSSH, command []time.Duration
+	for _, res := range r.results {
+		status := "ok"
+		if res.err != nil {
+			status = res.err.Error()
+		} else if res.output != "" {
+			status = res.output
+		}
+		table.Append([]string{
+			res.vmID,
+			formatDuration(res.create),
+			formatDuration(res.bootSSH),
+			formatDuration(res.command),
+			formatDuration(res.teardown),
+			status,
+		})
+		if res.err == nil {
+			create = append(create, res.create)
+			bootSSH = append(bootSSH, res.bootSSH)
+			command = append(command, res.command)
+		}
+	}
+	table.Render()
+
+	fmt.Fprintf(w, "\n%d/%d VMs succeeded in %s\n\n", len(r.results)-r.Failures(), len(r.results), formatDuration(r.total))
+
+	summary := tablewriter.NewTable(w,
+		tablewriter.WithHeader([]string{"Phase", "p50", "p90", "p99", "Max"}),
+	)
+	for _, phase := range []struct {
+		name      string
+		durations []time.Duration
+	}{
+		{"Create", create},
+		{"Boot to SSH", bootSSH},
+		{"Command", command},
+	} {
+		summary.Append([]string{
+			phase.name,
+			formatDuration(percentile(phase.durations, 0.50)),
+			formatDuration(percentile(phase.durations, 0.90)),
+			formatDuration(percentile(phase.durations, 0.99)),
+			formatDuration(percentile(phase.durations, 1.00)),
+		})
+	}
+	summary.Render()
+}
+
+// percentile returns the nearest-rank percentile p (0 < p <= 1) of durations
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+// formatDuration formats a duration in milliseconds, or "-" if unset
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
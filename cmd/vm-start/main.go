@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/ekzhang/ssh-hypervisor/internal"
 	"github.com/ekzhang/ssh-hypervisor/internal/vm"
@@ -29,6 +30,10 @@ func main() {
 		dataDir       = flag.String("data-dir", "./data", "Directory for VM snapshots and data")
 		rootfs        = flag.String("rootfs", "", "Path to rootfs image (required)")
 		allowInternet = flag.Bool("allow-internet", false, "Allow VMs to access the internet")
+		rootfsMode    = flag.String("rootfs-mode", internal.RootfsCopy, "How VMs get a writable rootfs: copy, overlay, or ephemeral")
+		count         = flag.Int("count", 1, "Number of VMs to boot concurrently (more than 1 runs a benchmark and exits)")
+		runCommand    = flag.String("run", "", "Command to run in each VM over SSH in benchmark mode")
+		bootTimeout   = flag.Duration("timeout", 60*time.Second, "Maximum time to wait for each VM's SSH server in benchmark mode")
 		version       = flag.Bool("version", false, "Show version information")
 	)
 
@@ -46,15 +51,25 @@ func main() {
 		return
 	}
 
+	if *count < 1 {
+		log.Fatalf("Count must be at least 1")
+	}
+
 	config := &internal.Config{
-		Port:          2222,
-		HostKey:       "",
-		VMCIDR:        "192.168.100.0/24",
-		VMMemory:      128,
-		VMCPUs:        1,
-		DataDir:       *dataDir,
-		Rootfs:        *rootfs,
-		AllowInternet: *allowInternet,
+		Port:            2222,
+		HostKey:         "",
+		VMCIDR:          "192.168.100.0/24",
+		VMMemory:        128,
+		VMCPUs:          1,
+		DataDir:         *dataDir,
+		Rootfs:          *rootfs,
+		AllowInternet:   *allowInternet,
+		RootfsMode:      *rootfsMode,
+		OverlaySize:     1024,
+		ShutdownTimeout: 3 * time.Second,
+		VMLogLevel:      "info",
+		VMLogMaxSize:    10,
+		VMLogMaxFiles:   3,
 	}
 
 	if err := config.Validate(); err != nil {
@@ -69,6 +84,15 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if *count > 1 || *runCommand != "" {
+		report := runBenchmark(ctx, manager, *count, *runCommand, *bootTimeout)
+		report.Print(os.Stdout)
+		if report.Failures() > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Printf("Creating Firecracker VM...")
 	log.Printf("VM network: %s", config.VMCIDR)
 	log.Printf("Data directory: %s", config.DataDir)
@@ -80,7 +104,7 @@ func main() {
 		log.Fatalf("Failed to remove existing VM data: %v", err)
 	}
 
-	testVM, err := manager.GetOrCreateVM(ctx, vmID)
+	testVM, err := manager.GetOrCreateVM(ctx, vmID, nil)
 	if err != nil {
 		log.Fatalf("Failed to create VM: %v", err)
 	}
@@ -99,7 +123,7 @@ func main() {
 	<-sigChan
 	log.Printf("Received shutdown signal, stopping VM...")
 
-	if err := manager.DestroyVM(testVM.ID); err != nil {
+	if err := manager.DestroyVM(context.Background(), testVM.ID); err != nil {
 		log.Errorf("Error stopping VM: %v", err)
 	} else {
 		log.Printf("VM stopped successfully")
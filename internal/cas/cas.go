@@ -0,0 +1,373 @@
+// Package cas keeps large files, like kernels, Firecracker binaries, golden
+// images, and snapshots, in a content-addressed store. Each file is stored
+// once, named by its SHA-256, so different versions never collide and
+// identical copies don't take space twice.
+//
+// A blob is referenced by named refs, small files holding its digest, or by
+// hard links to it elsewhere on the same filesystem. GC removes blobs with
+// neither, except those added recently, which may be about to be referenced.
+//
+// Several processes may share a store, like a server and a subcommand run
+// beside it. Blobs are written to temporary files and renamed into place
+// under a lock, and a blob that already exists is checked against its digest
+// before it is trusted, so a damaged one is replaced rather than reused.
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// GracePeriod is how long blobs are kept after they are added or used
+// before GC may remove them, so a blob is never removed between being added
+// and being referenced
+const GracePeriod = time.Hour
+
+// Store is a content-addressed store in a directory, with blobs in
+// blobs/ and refs in refs/
+type Store struct {
+	dir string
+}
+
+// Blob is a file in a store
+type Blob struct {
+	Digest string
+	Size   int64
+	Refs   int // Named refs and hard links to the blob
+}
+
+// Open opens the store in dir, creating it if needed
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{"blobs", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create content store: %w", err)
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the directory of the store
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Path returns the path of the blob with a digest. Blobs are read-only.
+func (s *Store) Path(digest string) string {
+	return filepath.Join(s.dir, "blobs", digest)
+}
+
+// Put adds the contents of r to the store with the given file mode, which
+// is made read-only, and returns its digest
+func (s *Store) Put(r io.Reader, mode fs.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to add to content store: %w", err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	return digest, s.insert(tmp.Name(), digest, mode)
+}
+
+// Adopt moves the file at path into the store and replaces it with a hard
+// link to the blob, so it takes no more space when the store already has
+// its contents and keeps the blob referenced while it exists. The file must
+// be on the same filesystem as the store and is made read-only.
+func (s *Store) Adopt(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	digest, err := FileDigest(path)
+	if err != nil {
+		return "", err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if s.verify(digest) == nil {
+		if err := replaceWithLink(s.Path(digest), path); err == nil {
+			return digest, nil
+		}
+	}
+	if err := os.Chmod(path, readOnly(info.Mode())); err != nil {
+		return "", err
+	}
+	// Link the file in under a temporary name first, so a damaged blob with
+	// the same digest is replaced in one step
+	tmp := filepath.Join(s.dir, "tmp", "adopt-"+digest)
+	os.Remove(tmp)
+	if err := os.Link(path, tmp); err != nil {
+		return "", fmt.Errorf("failed to add to content store: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path(digest)); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to add to content store: %w", err)
+	}
+	return digest, nil
+}
+
+// Import adds a copy of the file at path to the store and returns its
+// digest, leaving the file as is
+func (s *Store) Import(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return s.Put(f, info.Mode())
+}
+
+// insert moves a temporary file into the store as the blob with a digest,
+// unless the store already has it intact
+func (s *Store) insert(tmp, digest string, mode fs.FileMode) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if s.verify(digest) == nil {
+		return nil
+	}
+	if err := os.Chmod(tmp, readOnly(mode)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path(digest))
+}
+
+// touch marks a blob as just used, so GC keeps it for GracePeriod, or
+// returns an error if the store doesn't have it
+func (s *Store) touch(digest string) error {
+	now := time.Now()
+	return os.Chtimes(s.Path(digest), now, now)
+}
+
+// verify marks a blob as just used and checks that its contents still match
+// its digest, returning an error if it is missing or damaged
+func (s *Store) verify(digest string) error {
+	if err := s.touch(digest); err != nil {
+		return err
+	}
+	actual, err := FileDigest(s.Path(digest))
+	if err != nil {
+		return err
+	}
+	if actual != digest {
+		return fmt.Errorf("blob %s is damaged, its contents hash to %s", digest, actual)
+	}
+	return nil
+}
+
+// lock takes an exclusive lock on the store, shared with other processes,
+// and returns the function that releases it
+func (s *Store) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock content store: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock content store: %w", err)
+	}
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+// Ref points the named ref at a blob, replacing what it pointed at before.
+// Names may contain slashes, like "kernel/default".
+func (s *Store) Ref(name, digest string) error {
+	path, err := s.refPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.Path(digest)); err != nil {
+		return fmt.Errorf("content store has no blob %s", digest)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Each writer gets its own temporary file, so concurrent updates of a ref
+	// leave it pointing at one blob or the other, never a mix
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(digest + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Resolve returns the digest a named ref points at
+func (s *Store) Resolve(name string) (string, error) {
+	path, err := s.refPath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Unref removes a named ref, or every ref under a name like "images" that
+// refs were named under. Blobs they pointed at are removed by GC once
+// nothing else references them.
+func (s *Store) Unref(name string) error {
+	path, err := s.refPath(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// refPath returns the file of a named ref
+func (s *Store) refPath(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." || strings.HasSuffix(name, ".tmp") {
+		return "", fmt.Errorf("invalid ref name %q", name)
+	}
+	return filepath.Join(s.dir, "refs", filepath.FromSlash(name)), nil
+}
+
+// Blobs lists the blobs in the store with their reference counts
+func (s *Store) Blobs() ([]Blob, error) {
+	refs := make(map[string]int)
+	err := filepath.WalkDir(filepath.Join(s.dir, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			refs[strings.TrimSpace(string(data))]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content store refs: %w", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "blobs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content store: %w", err)
+	}
+	var blobs []Blob
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		blob := Blob{Digest: entry.Name(), Size: info.Size(), Refs: refs[entry.Name()]}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			blob.Refs += int(stat.Nlink) - 1
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+// GC removes blobs that nothing references and that weren't added or used
+// within GracePeriod, along with abandoned temporary files, and returns the
+// blobs removed. With dryRun, it only returns what it would remove.
+func (s *Store) GC(dryRun bool) ([]Blob, error) {
+	blobs, err := s.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	cutoff := time.Now().Add(-GracePeriod)
+	var removed []Blob
+	var errs []error
+	for _, blob := range blobs {
+		info, err := os.Stat(s.Path(blob.Digest))
+		if blob.Refs > 0 || err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(s.Path(blob.Digest)); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		removed = append(removed, blob)
+	}
+	if !dryRun {
+		entries, _ := os.ReadDir(filepath.Join(s.dir, "tmp"))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(filepath.Join(s.dir, "tmp", entry.Name()))
+			}
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// FileDigest returns the hex SHA-256 of a file, which is its digest in a store
+func FileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// replaceWithLink atomically replaces the file at path with a hard link to target
+func replaceWithLink(target, path string) error {
+	tmp := path + ".link"
+	os.Remove(tmp)
+	if err := os.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// readOnly drops the write bits of a file mode
+func readOnly(mode fs.FileMode) fs.FileMode {
+	return mode.Perm() &^ 0222
+}
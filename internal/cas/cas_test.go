@@ -0,0 +1,201 @@
+package cas
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// age makes a blob look added long ago, so GC doesn't keep it for being new
+func age(t *testing.T, s *Store, digest string) {
+	t.Helper()
+	old := time.Now().Add(-2 * GracePeriod)
+	if err := os.Chtimes(s.Path(digest), old, old); err != nil {
+		t.Fatalf("Failed to age blob: %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	root := t.TempDir()
+	s, err := Open(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	kernel, err := s.Put(strings.NewReader("kernel v1"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	if again, _ := s.Put(strings.NewReader("kernel v1"), 0644); again != kernel {
+		t.Errorf("Expected the same contents to get the same digest, got %s and %s", kernel, again)
+	}
+	if data, _ := os.ReadFile(s.Path(kernel)); string(data) != "kernel v1" {
+		t.Errorf("Unexpected blob contents %q", data)
+	}
+	if info, _ := os.Stat(s.Path(kernel)); info.Mode().Perm() != 0444 {
+		t.Errorf("Expected blobs to be read-only, got %v", info.Mode())
+	}
+	if err := s.Ref("kernel", kernel); err != nil {
+		t.Fatalf("Failed to ref blob: %v", err)
+	}
+	if got, _ := s.Resolve("kernel"); got != kernel {
+		t.Errorf("Expected ref to resolve to %s, got %s", kernel, got)
+	}
+	if err := s.Ref("../escape", kernel); err == nil {
+		t.Errorf("Expected a ref outside the store to be refused")
+	}
+	if err := s.Ref("missing", strings.Repeat("0", 64)); err == nil {
+		t.Errorf("Expected a ref to a missing blob to be refused")
+	}
+
+	// A new version gets its own blob instead of overwriting the old one
+	kernel2, _ := s.Put(strings.NewReader("kernel v2"), 0644)
+	s.Ref("kernel", kernel2)
+	if kernel2 == kernel {
+		t.Fatalf("Expected different contents to get different digests")
+	}
+
+	// Adopted files become links to their blob
+	snap1, snap2 := filepath.Join(root, "snap1"), filepath.Join(root, "snap2")
+	os.WriteFile(snap1, []byte("disk"), 0644)
+	os.WriteFile(snap2, []byte("disk"), 0644)
+	disk, err := s.Adopt(snap1)
+	if err != nil {
+		t.Fatalf("Failed to adopt file: %v", err)
+	}
+	if again, err := s.Adopt(snap2); err != nil || again != disk {
+		t.Fatalf("Expected identical files to share a blob, got %s, %v", again, err)
+	}
+	blobs, err := s.Blobs()
+	if err != nil {
+		t.Fatalf("Failed to list blobs: %v", err)
+	}
+	refs := make(map[string]int)
+	for _, b := range blobs {
+		refs[b.Digest] = b.Refs
+	}
+	if len(blobs) != 3 || refs[kernel] != 0 || refs[kernel2] != 1 || refs[disk] != 2 {
+		t.Errorf("Unexpected blobs %+v", blobs)
+	}
+
+	// Only old blobs nothing references are removed
+	for _, digest := range []string{kernel, kernel2, disk} {
+		age(t, s, digest)
+	}
+	removed, err := s.GC(true)
+	if err != nil || len(removed) != 1 || removed[0].Digest != kernel {
+		t.Fatalf("Expected dry run to find the old kernel, got %+v, %v", removed, err)
+	}
+	if _, err := os.Stat(s.Path(kernel)); err != nil {
+		t.Errorf("Expected dry run to keep the blob")
+	}
+	if removed, _ := s.GC(false); len(removed) != 1 {
+		t.Errorf("Expected the old kernel to be removed, got %+v", removed)
+	}
+	if _, err := os.Stat(s.Path(kernel)); err == nil {
+		t.Errorf("Expected the old kernel's blob to be gone")
+	}
+
+	// Blobs are kept while any link to them remains
+	os.Remove(snap1)
+	if removed, _ := s.GC(false); len(removed) != 0 {
+		t.Errorf("Expected a blob with a link to be kept, got %+v", removed)
+	}
+	os.Remove(snap2)
+	s.Unref("kernel")
+	if removed, _ := s.GC(false); len(removed) != 2 {
+		t.Errorf("Expected both unreferenced blobs to be removed, got %+v", removed)
+	}
+
+	// New blobs are kept for a while, since they may be about to be referenced
+	s.Put(strings.NewReader("new"), 0644)
+	if removed, _ := s.GC(false); len(removed) != 0 {
+		t.Errorf("Expected a new blob to be kept, got %+v", removed)
+	}
+}
+
+func TestUnrefTree(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	digest, _ := s.Put(strings.NewReader("image"), 0644)
+	s.Ref("catalog/images/alpine", digest)
+	s.Ref("catalog/kernels/alpine", digest)
+	s.Ref("rootfs", digest)
+	if err := s.Unref("catalog"); err != nil {
+		t.Fatalf("Failed to remove refs: %v", err)
+	}
+	if _, err := s.Resolve("catalog/images/alpine"); err == nil {
+		t.Errorf("Expected refs under catalog to be removed")
+	}
+	if got, _ := s.Resolve("rootfs"); got != digest {
+		t.Errorf("Expected other refs to be kept")
+	}
+	blobs, _ := s.Blobs()
+	if len(blobs) != 1 || blobs[0].Refs != 1 {
+		t.Errorf("Expected one reference left, got %+v", blobs)
+	}
+}
+
+func TestDamagedBlob(t *testing.T) {
+	root := t.TempDir()
+	s, err := Open(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	digest, _ := s.Put(strings.NewReader("firecracker"), 0755)
+
+	// A blob truncated by a crash or clobbered by another writer is replaced,
+	// not trusted because it exists
+	os.Chmod(s.Path(digest), 0644)
+	os.WriteFile(s.Path(digest), []byte("fire"), 0644)
+	if again, err := s.Put(strings.NewReader("firecracker"), 0755); err != nil || again != digest {
+		t.Fatalf("Failed to put blob again: %s, %v", again, err)
+	}
+	if data, _ := os.ReadFile(s.Path(digest)); string(data) != "firecracker" {
+		t.Errorf("Expected the damaged blob to be restored, got %q", data)
+	}
+
+	os.Chmod(s.Path(digest), 0644)
+	os.WriteFile(s.Path(digest), []byte("fire"), 0644)
+	path := filepath.Join(root, "firecracker")
+	os.WriteFile(path, []byte("firecracker"), 0755)
+	if again, err := s.Adopt(path); err != nil || again != digest {
+		t.Fatalf("Failed to adopt file: %s, %v", again, err)
+	}
+	if data, _ := os.ReadFile(s.Path(digest)); string(data) != "firecracker" {
+		t.Errorf("Expected the damaged blob to be replaced by the adopted file, got %q", data)
+	}
+
+	// Concurrent writers of the same blob and ref all succeed
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := s.Put(strings.NewReader("kernel"), 0644)
+			if err == nil {
+				err = s.Ref("kernel", d)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent put failed: %v", err)
+		}
+	}
+	if _, err := s.Resolve("kernel"); err != nil {
+		t.Errorf("Failed to resolve ref after concurrent writes: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "store", "refs", "*.tmp")); len(matches) != 0 {
+		t.Errorf("Expected no temporary ref files left, got %v", matches)
+	}
+}
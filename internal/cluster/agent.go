@@ -0,0 +1,104 @@
+// Package cluster registers a node's capacity with a coordinator, so that
+// several ssh-hypervisor nodes can serve users behind one load balancer.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NodeStatus is what a node reports to the coordinator on every heartbeat
+type NodeStatus struct {
+	Node        string    `json:"node"`
+	SSHAddr     string    `json:"ssh_addr"`              // Where users reach the node over SSH
+	HTTPAddr    string    `json:"http_addr,omitempty"`   // Where the coordinator schedules VMs, empty if it can't
+	Capacity    int       `json:"capacity"`              // Most VMs the node runs at once (0 = unlimited)
+	Active      int       `json:"active"`                // VMs running now
+	Maintenance bool      `json:"maintenance,omitempty"` // New VMs are refused, so none should be placed here
+	Time        time.Time `json:"time"`
+}
+
+// Agent sends a node's status to the coordinator at
+// PUT <coordinator>/v1/nodes/<node>, and deregisters with a DELETE there when
+// it stops. Coordinators should treat nodes that miss a few heartbeats as gone.
+type Agent struct {
+	endpoint string
+	status   func() NodeStatus
+	client   *http.Client
+	logger   logrus.FieldLogger
+}
+
+// NewAgent creates an agent for the node named node, reporting status from the
+// given function to the coordinator at the base URL coordinator
+func NewAgent(coordinator, node string, status func() NodeStatus, logger logrus.FieldLogger) (*Agent, error) {
+	base, err := url.Parse(coordinator)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid coordinator URL %q", coordinator)
+	}
+	return &Agent{
+		endpoint: base.JoinPath("v1", "nodes", node).String(),
+		status:   status,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+	}, nil
+}
+
+// Run sends a heartbeat every interval until ctx is done, then deregisters
+func (a *Agent) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Heartbeat(ctx); err != nil && ctx.Err() == nil {
+			a.logger.Warnf("Failed to send heartbeat to coordinator: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := a.send(deregisterCtx, http.MethodDelete, nil); err != nil {
+				a.logger.Warnf("Failed to deregister from coordinator: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Heartbeat sends the node's current status to the coordinator
+func (a *Agent) Heartbeat(ctx context.Context) error {
+	status := a.status()
+	status.Time = time.Now().UTC()
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return a.send(ctx, http.MethodPut, body)
+}
+
+// send makes a request to the node's endpoint, expecting a 2xx response
+func (a *Agent) send(ctx context.Context, method string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("coordinator returned %s", resp.Status)
+	}
+	return nil
+}
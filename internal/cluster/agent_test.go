@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAgent(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	var last NodeStatus
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/v1/nodes/node-a" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		methods = append(methods, r.Method)
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&last); err != nil {
+				t.Errorf("Failed to decode status: %v", err)
+			}
+		}
+	}))
+	defer coordinator.Close()
+
+	agent, err := NewAgent(coordinator.URL, "node-a", func() NodeStatus {
+		return NodeStatus{Node: "node-a", SSHAddr: "10.0.0.5:2222", Capacity: 16, Active: 3}
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		agent.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(35 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) < 2 || methods[0] != http.MethodPut || methods[len(methods)-1] != http.MethodDelete {
+		t.Errorf("Expected heartbeats then a deregistration, got %v", methods)
+	}
+	if last.SSHAddr != "10.0.0.5:2222" || last.Active != 3 || last.Time.IsZero() {
+		t.Errorf("Unexpected status %+v", last)
+	}
+}
+
+func TestAgentErrors(t *testing.T) {
+	if _, err := NewAgent("ftp://coordinator", "node-a", nil, logrus.New()); err == nil {
+		t.Errorf("Expected error for non-HTTP coordinator")
+	}
+
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusServiceUnavailable)
+	}))
+	defer coordinator.Close()
+	agent, _ := NewAgent(coordinator.URL, "node-a", func() NodeStatus { return NodeStatus{} }, logrus.New())
+	if err := agent.Heartbeat(context.Background()); err == nil {
+		t.Errorf("Expected error for non-2xx response")
+	}
+}
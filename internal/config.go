@@ -3,21 +3,187 @@ package internal
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// Rootfs modes, which decide how each VM gets a writable root filesystem
+const (
+	RootfsCopy      = "copy"      // Full per-VM copy of the golden image
+	RootfsOverlay   = "overlay"   // Shared read-only golden image plus a per-VM overlay drive
+	RootfsEphemeral = "ephemeral" // Shared read-only golden image plus a tmpfs overlay, nothing persists
+)
+
+// Storage drivers, which decide how the rootfs copy of each VM is made in
+// RootfsCopy mode
+const (
+	StorageCopy     = "copy"      // Copy the golden image byte for byte
+	StorageReflink  = "reflink"   // Share the golden image's blocks copy-on-write, on XFS or Btrfs
+	StorageLVMThin  = "lvm-thin"  // Thin snapshot of the golden image's LVM thin volume
+	StorageZFSClone = "zfs-clone" // Clone of a snapshot of the golden image's zvol
+	StorageDMThin   = "dm-thin"   // Snapshot of the golden image's device-mapper thin device
+)
+
+// Terminal multiplexers, which interactive sessions run in so users can
+// re-attach to them after reconnecting
+const (
+	MultiplexerTmux   = "tmux"
+	MultiplexerScreen = "screen"
 )
 
+// vmMaxAddresses is the most addresses all VM CIDRs may span together, so
+// every VM's allocation index fits in its TAP device name and MAC address
+const vmMaxAddresses = 1 << 20
+
 // Config holds all configuration options for the ssh-hypervisor
 type Config struct {
 	Port             int    // SSH server port
 	HostKey          string // Path to SSH host key
-	VMCIDR           string // CIDR block for VM IP addresses
+	VMCIDR           string // CIDR blocks for VM IP addresses, separated by commas
 	VMMemory         int    // VM memory in MB
+	VMMaxMemory      int    // Memory in MB that running VMs can be resized up to (0 = no resizing)
 	VMCPUs           int    // Number of VM CPUs
 	MaxConcurrentVMs int    // Maximum number of concurrent VMs (0 = unlimited)
 	DataDir          string // Directory for VM snapshots and data
-	Rootfs           string // Path to rootfs image
+	Rootfs           string // Path to rootfs image (empty if Images is set)
 	AllowInternet    bool   // Allow VMs to access the Internet
+	CountTraffic     bool   // Count each VM's bytes and packets beyond the host with iptables rules
+	ContainerMode    bool   // Running in a container: reuse pre-created TAP devices and never write sysctls
+	MACPrefix        string // Leading bytes of VM MAC addresses, like "02:FC", unique per host on an L2 segment
+	VMHostname       string // Template of guests' hostnames, like "{{.User}}.box" (empty = the VM ID)
+	VMHosts          string // Names guests' /etc/hosts gives their gateway, the host, separated by commas
+	MDNS             bool   // Announce booted VMs' hostnames and labeled services over mDNS on the bridge
+	EntropyRate      int    // Bytes per second each VM may read from its virtio-rng device (0 = unlimited, negative = no device)
+	EntropyBurst     int    // Bytes each VM may read from virtio-rng at once on top of the rate, like at boot
+	EntropySeed      int    // Random bytes from the host mixed into each guest's entropy pool after boot (0 = none)
+	NestedKVM        bool   // Let VMs labeled nested-kvm=on use KVM inside, if the host has nested virtualization
+	AllowUnsupported bool   // Start even when Firecracker or the kernel is outside the supported versions
+
+	RootfsMode  string // How VMs get a writable rootfs, RootfsCopy (default), RootfsOverlay, or RootfsEphemeral
+	OverlaySize int    // Size in MB of the per-VM overlay drive in overlay mode
+	Snapshots   int    // Snapshots of its disk each VM may keep (0 = disabled)
+	Images      string // JSON catalog of images users pick from, instead of a single Rootfs (empty = single image)
+	UserRootfs  int    // Largest rootfs image in MB users may upload or fetch to replace their VM's disk (0 = disabled)
+	DiskQuota   int    // Disk space in MB each user's VM data may take, checked when they bring a rootfs (0 = unlimited)
+	ObjectStore string // S3 URL like s3://bucket/prefix where stopped VMs' disks and snapshots are kept (empty = only on the host)
+	Storage     string // How rootfs copies are made in copy mode, StorageCopy (default), StorageReflink, or a block driver
+	SharedDirs  string // Host directories to mount into VMs, as HOST:GUEST[:ro] separated by commas
+
+	SSHCiphers      string // SSH ciphers offered to clients, separated by commas (empty = library defaults)
+	SSHMACs         string // SSH MACs offered to clients, separated by commas (empty = library defaults)
+	SSHKeyExchanges string // SSH key exchanges offered to clients, separated by commas (empty = library defaults)
+	SSHMinRSABits   int    // Smallest RSA key clients may authenticate with (0 = any)
+	MaxAuthTries    int    // Authentication attempts allowed per connection (0 = library default of 6)
+	AuthBanner      string // Message shown to clients after their authentication is refused (empty = none)
+
+	EncryptionKey string // File with a master key that per-VM disks are encrypted at rest with (empty = disabled)
+
+	Umask    string // File mode creation mask of the server process, in octal (empty = inherited)
+	Landlock bool   // Keep the server and its VMMs from writing outside the data directory and system paths
+
+	ShutdownTimeout time.Duration // How long to wait for a clean guest shutdown before killing the VM (0 = kill immediately)
+	ShutdownCommand string        // Command run in the guest over SSH to shut it down (empty = send Ctrl+Alt+Del)
+	ClockSync       time.Duration // How often running VMs' clocks are set from the host's, besides after boot (0 = only after boot, negative = never)
+	HealthCheck     time.Duration // How often booted VMs' guests are checked to answer SSH, stopping those that miss several checks (0 = never)
+
+	TCPKeepAlive  time.Duration // Keep-alive period for client TCP connections (negative = disabled)
+	ClientRate    int           // Output written to each SSH session's client, in KB per second (0 = unlimited)
+	ClientStall   time.Duration // How long a client may read none of its session's output before the session is closed (0 = forever)
+	WebSocketPort int           // Port for SSH-over-WebSocket listener (0 = disabled)
+	WebSocketCert string        // Path to TLS certificate for the WebSocket listener
+	WebSocketKey  string        // Path to TLS private key for the WebSocket listener
+
+	EgressBlock    string // Outbound ports rejected for VMs with Internet access, like "tcp/25,udp/137-138"
+	EgressMaxConns int    // Quarantine VMs with more open outbound connections than this (0 = unlimited)
+	EgressMaxDests int    // Quarantine VMs connected to more distinct destinations than this (0 = unlimited)
+	EgressLog      bool   // Log each VM's new outbound flows to egress.jsonl in its data directory
+	BreakInCheck   bool   // Alert when anything but the hypervisor connects to a VM's SSH server
+
+	HTTPAddr      string // Address for the HTTP status and metrics listener (empty = disabled)
+	HTTPAllow     string // Client addresses allowed on the HTTP listener, as IPs or CIDRs separated by commas (empty = all)
+	HTTPProxies   string // Reverse proxies trusted to set X-Forwarded-For on the HTTP listener, as IPs or CIDRs
+	HTTPAccessLog bool   // Log every request to the HTTP listener
+	HTTPCert      string // Path to TLS certificate for the HTTP listener (empty = plain HTTP)
+	HTTPKey       string // Path to TLS private key for the HTTP listener
+	HTTPClientCA  string // CA whose client certificates may use the HTTP API (empty = no mutual TLS)
+	APITokens     string // File of "NAME SCOPE TOKEN" lines of clients allowed to use the HTTP API (empty = open)
+	PersistEvents bool   // Append VM lifecycle events to events.jsonl in each VM's data directory
+	ActivityFeed  string // Publish recent logins as JSON and RSS feeds: "names", "anonymous", or empty to disable
+
+	UsageExport   string        // Where per-user usage records go: csv:PATH, jsonl:PATH, or an HTTP URL (empty = disabled)
+	UsageInterval time.Duration // How often usage of running VMs is exported
+	QuotaHours    int           // Monthly VM-hours allowed per user (0 = unlimited)
+	QuotaTraffic  int           // Monthly traffic beyond the host allowed per user, in GB (0 = unlimited, needs CountTraffic)
+
+	VMLogLevel     string        // Log level for the per-VM Firecracker SDK log
+	VMLogMaxSize   int           // Size in MB at which per-VM logs are rotated (0 = unlimited)
+	VMLogMaxFiles  int           // Number of rotated per-VM log files to keep
+	VMLogRetention time.Duration // How long old logs are kept before pruning (0 = forever)
+	ConsoleRate    int           // Guest serial output kept in console.out, in KB per second, beyond which it is dropped (0 = unlimited)
+
+	MaxConcurrentIO int // Maximum concurrent heavy disk operations like rootfs copies (0 = unlimited)
+	MinFreeSpace    int // Free space in MB to keep on the data directory when creating VMs
+
+	GCKeepFor time.Duration // Remove data of VMs unused for longer than this (0 = forever)
+	GCMaxSize int           // Total size in MB of per-VM data before pruning old VMs (0 = unlimited)
+
+	Schedule       string // File of cron-like jobs that stop or destroy VMs by label (empty = none)
+	ScheduleDryRun bool   // Log what scheduled jobs would do without doing it
+
+	SessionCommand  string // Program run in VMs instead of the default shell (empty = shell)
+	SessionCommands string // File of "USER COMMAND" lines overriding SessionCommand per user
+
+	Reattach    time.Duration // How long VMs keep running after their user's last session ends, so reconnecting re-attaches to a multiplexer (0 = stop at once)
+	Multiplexer string        // Terminal multiplexer interactive sessions run in when Reattach is set: tmux or screen
+
+	ProxySubsystems string // SSH subsystems forwarded to the VM's sshd, separated by commas, e.g. "sftp"
+	VMLabels        string // JSON file of labels given to each user's VM at creation, by user or "*" for all
+	Hooks           string // Directory of pre-boot, post-boot, and pre-destroy executables run for each VM (empty = none)
+
+	AdminKeys   string // authorized_keys file of admins who may attach to any VM as "attach+USER" (empty = disabled)
+	AdminNotify bool   // Tell users logged in to a VM when an admin attaches
+	TOTPUsers   string // File of "USER SECRET" lines of users who must enter a TOTP code to log in (empty = none)
+	Tiers       string // File of "USER TIER" lines of admin and supporter users, whose new VMs stop idle VMs of lower tiers at capacity (empty = everyone is anonymous)
+
+	Terms        string // File of terms users must accept by answering "yes" before their first VM boots (empty = none)
+	TermsVersion string // Version of Terms recorded with each acceptance, asked again when it changes (default: a hash of the file)
+
+	DropPort int // Port on the VM networks' gateways where VMs copy text and files to their users (0 = disabled)
+
+	EgressProxy      int    // Port on the VM networks' gateways of an HTTP(S) proxy VMs reach allowed domains through (0 = disabled)
+	EgressProxyAllow string // File of domains the egress proxy may reach, one per line, "*.example.com" for subdomains (empty = any)
+	EgressProxyMaxMB int    // Largest response in MB the egress proxy passes to a VM (0 = unlimited)
+	PackageCache     int    // Port on the VM networks' gateways of a caching mirror of Alpine, Debian, PyPI, and npm (0 = disabled)
+	PackageCacheGB   int    // Size the package cache is kept under, in GB (0 = unlimited)
+	RegistryCache    int    // Port on the VM networks' gateways of a pull-through cache of Docker Hub (0 = disabled)
+	RegistryCacheGB  int    // Size the registry cache is kept under, in GB (0 = unlimited)
+
+	GeoIPDB     string // MaxMind country database (.mmdb) connections are tagged with (empty = disabled)
+	GeoIPAllow  string // Countries given VMs, as ISO codes separated by commas (empty = all)
+	GeoIPDeny   string // Countries refused VMs, as ISO codes separated by commas
+	GeoIPMaxVMs string // Running VMs allowed per country, like "US=50,*=10" (empty = unlimited)
+
+	Messages      string // JSON file of translated messages shown to users, by language
+	TerminalTitle bool   // Set the client's terminal title to the VM while connected, restoring it on exit
+	ShowCapacity  bool   // Show how many VMs are in use out of the server's capacity in the welcome message
+	AnimationMax  int    // Sessions provisioning at once above which progress bars aren't animated (0 = always animated)
+
+	Coordinator   string        // Base URL of the cluster coordinator this node registers with (empty = standalone)
+	NodeName      string        // Name this node registers as, and the host advertised for its listeners
+	AdvertiseAddr string        // SSH address advertised to the coordinator (default: NodeName and Port)
+	Heartbeat     time.Duration // How often node status is sent to the coordinator
+
+	PublicHost     string // Hostname shown to users in connection instructions
+	MoshPorts      string // Host UDP port range relayed to VMs for mosh, e.g. "60000-60999" (empty = disabled)
+	MoshPortsPerVM int    // Number of UDP ports relayed to each VM
 }
 
 // Validate checks if the configuration is valid
@@ -27,28 +193,257 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("port must be between 1 and 65535")
 	}
 
-	// Validate CIDR
-	_, ipNet, err := net.ParseCIDR(c.VMCIDR)
+	// Validate WebSocket listener
+	if c.WebSocketPort < 0 || c.WebSocketPort > 65535 {
+		return fmt.Errorf("WebSocket port must be between 1 and 65535 (or 0 to disable)")
+	}
+	if c.DropPort < 0 || c.DropPort > 65535 {
+		return fmt.Errorf("drop port must be between 0 and 65535")
+	}
+	if c.EgressProxy < 0 || c.EgressProxy > 65535 {
+		return fmt.Errorf("egress proxy port must be between 0 and 65535")
+	}
+	if c.EgressProxy != 0 && c.EgressProxy == c.DropPort {
+		return fmt.Errorf("egress proxy port must differ from the drop port")
+	}
+	if c.EgressProxyMaxMB < 0 {
+		return fmt.Errorf("egress proxy response limit cannot be negative (use 0 for unlimited)")
+	}
+	if (c.EgressProxyAllow != "" || c.EgressProxyMaxMB > 0) && c.EgressProxy == 0 {
+		return fmt.Errorf("egress proxy allow list and response limit require an egress proxy port")
+	}
+	if c.PackageCache < 0 || c.PackageCache > 65535 {
+		return fmt.Errorf("package cache port must be between 0 and 65535")
+	}
+	if c.PackageCache != 0 && (c.PackageCache == c.DropPort || c.PackageCache == c.EgressProxy) {
+		return fmt.Errorf("package cache port must differ from the drop and egress proxy ports")
+	}
+	if c.PackageCacheGB < 0 {
+		return fmt.Errorf("package cache size cannot be negative (use 0 for unlimited)")
+	}
+	if c.RegistryCache < 0 || c.RegistryCache > 65535 {
+		return fmt.Errorf("registry cache port must be between 0 and 65535")
+	}
+	if c.RegistryCache != 0 && (c.RegistryCache == c.DropPort || c.RegistryCache == c.EgressProxy || c.RegistryCache == c.PackageCache) {
+		return fmt.Errorf("registry cache port must differ from the drop, egress proxy, and package cache ports")
+	}
+	if c.RegistryCacheGB < 0 {
+		return fmt.Errorf("registry cache size cannot be negative (use 0 for unlimited)")
+	}
+	if c.WebSocketPort != 0 && c.WebSocketPort == c.Port {
+		return fmt.Errorf("WebSocket port must differ from the SSH port")
+	}
+	if (c.WebSocketCert == "") != (c.WebSocketKey == "") {
+		return fmt.Errorf("WebSocket TLS requires both a certificate and a key")
+	}
+
+	// Validate mosh relay
+	if c.MoshPorts != "" && c.MoshPortsPerVM < 1 {
+		return fmt.Errorf("mosh ports per VM must be at least 1")
+	}
+
+	// Validate rootfs mode
+	switch c.RootfsMode {
+	case "", RootfsCopy, RootfsEphemeral:
+	case RootfsOverlay:
+		if c.OverlaySize < 1 {
+			return fmt.Errorf("overlay size must be at least 1 MB")
+		}
+	default:
+		return fmt.Errorf("unknown rootfs mode %q (expected %s, %s, or %s)", c.RootfsMode, RootfsCopy, RootfsOverlay, RootfsEphemeral)
+	}
+
+	if c.ObjectStore != "" && !strings.HasPrefix(c.ObjectStore, "s3://") {
+		return fmt.Errorf("object storage must be an s3:// URL, got %q", c.ObjectStore)
+	}
+	if c.UserRootfs < 0 || c.DiskQuota < 0 {
+		return fmt.Errorf("user rootfs size and disk quota cannot be negative (use 0 to disable)")
+	}
+	if c.UserRootfs > 0 && c.RootfsMode == RootfsEphemeral {
+		return fmt.Errorf("user rootfs images can't be used in rootfs mode %s", RootfsEphemeral)
+	}
+	if c.Snapshots < 0 {
+		return fmt.Errorf("snapshots cannot be negative (use 0 to disable)")
+	}
+
+	// Validate storage driver
+	switch c.Storage {
+	case "", StorageCopy:
+	case StorageReflink, StorageLVMThin, StorageZFSClone, StorageDMThin:
+		if c.RootfsMode != "" && c.RootfsMode != RootfsCopy {
+			return fmt.Errorf("storage driver %s only applies to rootfs mode %s", c.Storage, RootfsCopy)
+		}
+		if c.Storage != StorageReflink && c.EncryptionKey != "" {
+			return fmt.Errorf("storage driver %s keeps disks on block devices, which can't be encrypted at rest", c.Storage)
+		}
+		if c.Storage != StorageReflink && c.ObjectStore != "" {
+			return fmt.Errorf("storage driver %s keeps disks on block devices, which can't be kept in object storage", c.Storage)
+		}
+	default:
+		return fmt.Errorf("unknown storage driver %q (expected %s, %s, %s, %s, or %s)", c.Storage, StorageCopy, StorageReflink, StorageLVMThin, StorageZFSClone, StorageDMThin)
+	}
+
+	if c.EgressMaxConns < 0 || c.EgressMaxDests < 0 {
+		return fmt.Errorf("egress limits cannot be negative")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout cannot be negative")
+	}
+	if c.HealthCheck < 0 {
+		return fmt.Errorf("health check interval cannot be negative (use 0 to disable)")
+	}
+	if c.Reattach < 0 {
+		return fmt.Errorf("reattach window cannot be negative (use 0 to disable)")
+	}
+	if c.Reattach > 0 && c.Multiplexer != MultiplexerTmux && c.Multiplexer != MultiplexerScreen {
+		return fmt.Errorf("unknown multiplexer %q (expected %s or %s)", c.Multiplexer, MultiplexerTmux, MultiplexerScreen)
+	}
+	if c.TermsVersion != "" && c.Terms == "" {
+		return fmt.Errorf("terms version requires a terms file")
+	}
+
+	if (c.UsageExport != "" || c.QuotaHours > 0 || c.QuotaTraffic > 0) && c.UsageInterval <= 0 {
+		return fmt.Errorf("usage interval must be positive")
+	}
+	if c.ClientRate < 0 {
+		return fmt.Errorf("client rate cannot be negative (use 0 for unlimited)")
+	}
+	if c.ClientStall < 0 {
+		return fmt.Errorf("client stall timeout cannot be negative (use 0 to wait forever)")
+	}
+	if c.AnimationMax < 0 {
+		return fmt.Errorf("animation max cannot be negative (use 0 to always animate)")
+	}
+	if c.QuotaHours < 0 {
+		return fmt.Errorf("quota hours cannot be negative (use 0 for unlimited)")
+	}
+	if c.QuotaTraffic < 0 {
+		return fmt.Errorf("traffic quota cannot be negative (use 0 for unlimited)")
+	}
+	if c.QuotaTraffic > 0 && !c.CountTraffic {
+		return fmt.Errorf("traffic quota requires traffic counting")
+	}
+
+	if c.Coordinator != "" {
+		if c.NodeName == "" {
+			return fmt.Errorf("node name is required with a coordinator")
+		}
+		if c.Heartbeat <= 0 {
+			return fmt.Errorf("heartbeat interval must be positive")
+		}
+	}
+
+	// Validate VM logging
+	if _, err := logrus.ParseLevel(c.VMLogLevel); err != nil {
+		return fmt.Errorf("invalid VM log level: %v", err)
+	}
+	if c.VMLogMaxSize < 0 || c.VMLogMaxFiles < 0 || c.VMLogRetention < 0 || c.ConsoleRate < 0 {
+		return fmt.Errorf("VM log limits cannot be negative")
+	}
+	if c.MinFreeSpace < 0 {
+		return fmt.Errorf("minimum free space cannot be negative")
+	}
+	if c.MaxConcurrentIO < 0 {
+		return fmt.Errorf("max concurrent IO cannot be negative")
+	}
+	if c.GCKeepFor < 0 || c.GCMaxSize < 0 {
+		return fmt.Errorf("garbage collection limits cannot be negative")
+	}
+
+	// Validate CIDRs
+	ipNets, err := c.GetVMIPRanges()
 	if err != nil {
 		return fmt.Errorf("invalid VM CIDR: %v", err)
 	}
-	if ipNet.IP.To4() == nil {
-		return fmt.Errorf("only IPv4 CIDR is supported")
+	total := 0
+	for i, ipNet := range ipNets {
+		if ipNet.IP.To4() == nil {
+			return fmt.Errorf("only IPv4 CIDR is supported")
+		}
+
+		// Check if CIDR is large enough (at least /28 for 14 usable IPs)
+		ones, bits := ipNet.Mask.Size()
+		if ones > 28 {
+			return fmt.Errorf("VM CIDR must be /28 or larger to accommodate multiple VMs")
+		}
+		total += 1 << (bits - ones)
+
+		for _, other := range ipNets[:i] {
+			if other.Contains(ipNet.IP) || ipNet.Contains(other.IP) {
+				return fmt.Errorf("VM CIDRs %s and %s overlap", other, ipNet)
+			}
+		}
+	}
+	if total > vmMaxAddresses {
+		return fmt.Errorf("VM CIDRs have %d addresses in total, more than the maximum of %d", total, vmMaxAddresses)
+	}
+
+	if c.GeoIPDB == "" && (c.GeoIPAllow != "" || c.GeoIPDeny != "" || c.GeoIPMaxVMs != "") {
+		return fmt.Errorf("country policies need a GeoIP database")
+	}
+
+	if c.Umask != "" {
+		if mask, err := strconv.ParseUint(c.Umask, 8, 32); err != nil || mask > 0777 {
+			return fmt.Errorf("umask must be an octal mode like 027, got %q", c.Umask)
+		}
+	}
+
+	if (c.HTTPCert == "") != (c.HTTPKey == "") {
+		return fmt.Errorf("HTTP TLS requires both a certificate and a key")
+	}
+	if c.HTTPClientCA != "" && c.HTTPCert == "" {
+		return fmt.Errorf("HTTP client certificates require a TLS certificate and key for the HTTP listener")
+	}
+	if _, err := ParseNetworks(c.HTTPAllow); err != nil {
+		return fmt.Errorf("invalid HTTP allowlist: %v", err)
+	}
+	if _, err := ParseNetworks(c.HTTPProxies); err != nil {
+		return fmt.Errorf("invalid HTTP proxies: %v", err)
 	}
 
-	// Check if CIDR is large enough (at least /28 for 14 usable IPs)
-	ones, _ := ipNet.Mask.Size()
-	if ones > 28 {
-		return fmt.Errorf("VM CIDR must be /28 or larger to accommodate multiple VMs")
+	if err := c.validateSSHAlgorithms(); err != nil {
+		return err
+	}
+	if c.SSHMinRSABits < 0 {
+		return fmt.Errorf("minimum RSA key size cannot be negative")
+	}
+	if c.MaxAuthTries < 0 {
+		return fmt.Errorf("max auth tries cannot be negative (use 0 for the default)")
+	}
+
+	switch c.ActivityFeed {
+	case "", "names", "anonymous":
+	default:
+		return fmt.Errorf("activity feed must be names, anonymous, or empty, got %q", c.ActivityFeed)
+	}
+
+	for _, name := range strings.Split(c.VMHosts, ",") {
+		name = strings.TrimSpace(name)
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-.") != "" {
+			return fmt.Errorf("invalid name for the host in VMs' /etc/hosts: %q", name)
+		}
+	}
+
+	if c.Hooks != "" {
+		if info, err := os.Stat(c.Hooks); err != nil || !info.IsDir() {
+			return fmt.Errorf("hooks directory not found: %s", c.Hooks)
+		}
 	}
 
 	// Validate VM resources
 	if c.VMMemory < 64 {
 		return fmt.Errorf("VM memory must be at least 64 MB")
 	}
+	if c.VMMaxMemory != 0 && c.VMMaxMemory < c.VMMemory {
+		return fmt.Errorf("VM max memory must be at least the VM memory")
+	}
 	if c.VMCPUs < 1 {
 		return fmt.Errorf("VM must have at least 1 CPU")
 	}
+	if c.EntropyBurst < 0 || c.EntropySeed < 0 {
+		return fmt.Errorf("entropy burst and seed cannot be negative")
+	}
 	if c.MaxConcurrentVMs < 0 {
 		return fmt.Errorf("max concurrent VMs cannot be negative (use 0 for unlimited)")
 	}
@@ -63,7 +458,16 @@ func (c *Config) Validate() error {
 		c.HostKey = filepath.Join(c.DataDir, "ssh_host_key")
 	}
 
-	// Validate rootfs image
+	// Validate rootfs image, or the catalog of them
+	if c.Images != "" {
+		if c.Rootfs != "" {
+			return fmt.Errorf("rootfs image and image catalog can't both be set")
+		}
+		if _, err := os.Stat(c.Images); err != nil {
+			return fmt.Errorf("image catalog not found: %s", c.Images)
+		}
+		return nil
+	}
 	if c.Rootfs == "" {
 		return fmt.Errorf("rootfs image path is required")
 	}
@@ -74,11 +478,109 @@ func (c *Config) Validate() error {
 	return nil
 }
 
-// GetVMIPRange returns the usable IP range for VMs
-func (c *Config) GetVMIPRange() (*net.IPNet, error) {
-	_, ipNet, err := net.ParseCIDR(c.VMCIDR)
-	if err != nil {
-		return nil, err
+// GetVMIPRanges returns the networks VM IP addresses are allocated from
+func (c *Config) GetVMIPRanges() ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range strings.Split(c.VMCIDR, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// ParseNetworks parses IP addresses and CIDR blocks separated by commas,
+// where an address stands for itself
+func ParseNetworks(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, term := range strings.Split(s, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(term); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(term)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", term)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// SSHAlgorithms returns the ciphers, MACs, and key exchanges the SSH server
+// offers, where nil lists mean the library's defaults
+func (c *Config) SSHAlgorithms() cryptoSSH.Algorithms {
+	return cryptoSSH.Algorithms{
+		Ciphers:      splitAlgorithms(c.SSHCiphers),
+		MACs:         splitAlgorithms(c.SSHMACs),
+		KeyExchanges: splitAlgorithms(c.SSHKeyExchanges),
+	}
+}
+
+// InsecureSSHAlgorithms returns the configured SSH algorithms that are known
+// to be weak, which old clients may still need
+func (c *Config) InsecureSSHAlgorithms() []string {
+	configured, insecure := c.SSHAlgorithms(), cryptoSSH.InsecureAlgorithms()
+	var weak []string
+	for _, name := range configured.Ciphers {
+		if slices.Contains(insecure.Ciphers, name) {
+			weak = append(weak, name)
+		}
+	}
+	for _, name := range configured.MACs {
+		if slices.Contains(insecure.MACs, name) {
+			weak = append(weak, name)
+		}
+	}
+	for _, name := range configured.KeyExchanges {
+		if slices.Contains(insecure.KeyExchanges, name) {
+			weak = append(weak, name)
+		}
+	}
+	return weak
+}
+
+// validateSSHAlgorithms checks that the configured SSH algorithms are ones
+// the library implements
+func (c *Config) validateSSHAlgorithms() error {
+	configured := c.SSHAlgorithms()
+	supported, insecure := cryptoSSH.SupportedAlgorithms(), cryptoSSH.InsecureAlgorithms()
+	lists := []struct {
+		kind       string
+		names      []string
+		known      []string
+		configured string
+	}{
+		{"cipher", configured.Ciphers, append(supported.Ciphers, insecure.Ciphers...), c.SSHCiphers},
+		{"MAC", configured.MACs, append(supported.MACs, insecure.MACs...), c.SSHMACs},
+		{"key exchange", configured.KeyExchanges, append(supported.KeyExchanges, insecure.KeyExchanges...), c.SSHKeyExchanges},
+	}
+	for _, list := range lists {
+		if list.configured != "" && len(list.names) == 0 {
+			return fmt.Errorf("SSH %s list is empty", list.kind)
+		}
+		for _, name := range list.names {
+			if !slices.Contains(list.known, name) {
+				return fmt.Errorf("unsupported SSH %s %q (supported: %s)", list.kind, name, strings.Join(list.known, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// splitAlgorithms splits a list of algorithm names separated by commas,
+// returning nil for an empty list
+func splitAlgorithms(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
-	return ipNet, nil
+	return names
 }
@@ -0,0 +1,322 @@
+// Package geoip looks up the countries of IP addresses in MaxMind DB files,
+// like the free GeoLite2 Country database.
+//
+// The format is described at https://maxmind.github.io/MaxMind-DB/. Only
+// what country lookups need is implemented.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata at the end of the file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the number of zero bytes between the search tree
+// and the data section
+const dataSectionSeparator = 16
+
+// Data section field types
+const (
+	typePointer = 1
+	typeString  = 2
+	typeDouble  = 3
+	typeBytes   = 4
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeInt32   = 8
+	typeUint64  = 9
+	typeUint128 = 10
+	typeArray   = 11
+	typeBool    = 14
+	typeFloat   = 15
+)
+
+// DB is a MaxMind DB loaded into memory
+type DB struct {
+	buf        []byte
+	data       []byte // Data section
+	nodeCount  uint
+	recordSize uint // Bits per record, 24, 28, or 32
+	ipVersion  uint
+	ipv4Start  uint // Node that IPv4 lookups start from in IPv6 databases
+	dbType     string
+}
+
+// Open reads a MaxMind DB file
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// parse reads the metadata of a database and checks its layout
+func parse(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("metadata not found")
+	}
+	metaBuf := buf[i+len(metadataMarker):]
+	value, _, err := decode(metaBuf, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	meta, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	db := &DB{buf: buf}
+	db.nodeCount = uint(toUint(meta["node_count"]))
+	db.recordSize = uint(toUint(meta["record_size"]))
+	db.ipVersion = uint(toUint(meta["ip_version"]))
+	db.dbType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	db.data = buf[treeSize+dataSectionSeparator : i]
+
+	// IPv4 addresses are in the ::/96 subtree of IPv6 databases
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Type returns the database type from its metadata, like "GeoLite2-Country"
+func (db *DB) Type() string {
+	return db.dbType
+}
+
+// readRecord returns the left (0) or right (1) record of a search tree node
+func (db *DB) readRecord(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the record for an IP address, or nil if it has none
+func (db *DB) Lookup(ip net.IP) (map[string]any, error) {
+	node := uint(0)
+	addr := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		addr, node = ip4, db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil // IPv6 addresses aren't in IPv4 databases
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP address %v", ip)
+	}
+
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = db.readRecord(node, bit)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("search tree is deeper than an address")
+	}
+
+	offset := node - db.nodeCount - dataSectionSeparator
+	value, _, err := decode(db.data, offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]any)
+	return record, nil
+}
+
+// Country returns the ISO 3166 code of the country an IP address is in, or
+// its registered country if its location is unknown, or "" if neither is
+// known
+func (db *DB) Country(ip net.IP) (string, error) {
+	record, err := db.Lookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]any); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// maxDecodeDepth bounds nesting, so corrupt files can't recurse forever
+const maxDecodeDepth = 32
+
+// decode decodes the field at offset in a data section, returning it and
+// the offset of the next field
+func decode(data []byte, offset uint, depth int) (any, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("data is nested too deeply")
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("data offset out of range")
+	}
+	ctrl := data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == typePointer {
+		size := uint(ctrl>>3) & 0x3
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, errors.New("pointer out of range")
+		}
+		var target uint
+		switch size {
+		case 0:
+			target = uint(ctrl&0x7)<<8 | uint(data[offset])
+		case 1:
+			target = (uint(ctrl&0x7)<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			target = (uint(ctrl&0x7)<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		case 3:
+			target = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		value, _, err := decode(data, target, depth+1)
+		return value, offset + size + 1, err
+	}
+
+	if typ == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("extended type out of range")
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("size out of range")
+		}
+		var extra uint
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for range size {
+			key, next, err := decode(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[k], offset, err = decode(data, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for range size {
+			value, next, err := decode(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("field out of range")
+	}
+	b := data[offset : offset+size]
+	next := offset + size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return bytes.Clone(b), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeInt32, typeUint64, typeUint128:
+		if size > 16 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		// Integers are big-endian with leading zero bytes omitted. Values
+		// too large for a uint64 are truncated, since none are needed.
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == typeInt32 {
+			return int64(int32(uint32(v))), next, nil
+		}
+		return v, next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// toUint converts an unsigned integer field to a uint64
+func toUint(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,102 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// encode encodes a value in the data section format, for building test
+// databases. Maps are given as alternating keys and values to keep order.
+func encode(v any) []byte {
+	header := func(typ int, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(header(typeString, len(v)), v...)
+	case uint16:
+		return append(header(typeUint16, 2), byte(v>>8), byte(v))
+	case uint32:
+		return append(header(typeUint32, 4), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case []any:
+		b := header(typeMap, len(v)/2)
+		for _, field := range v {
+			b = append(b, encode(field)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func TestCountry(t *testing.T) {
+	// Records for 1.0.0.0/8 and 2.0.0.0/8, and a pointer to the first one
+	// for 3.0.0.0/8
+	var data []byte
+	australia := uint(len(data))
+	data = append(data, encode([]any{"country", []any{"iso_code", "AU"}})...)
+	france := uint(len(data))
+	data = append(data, encode([]any{"registered_country", []any{"iso_code", "FR"}})...)
+	pointer := uint(len(data))
+	data = append(data, typePointer<<5, byte(australia))
+
+	// An IPv4 tree with record size 24: nodes 0-5 follow zero bits, node 6
+	// splits 0000000x from 0000001x, and nodes 7 and 8 hold the last bit
+	const nodeCount = 9
+	const empty = nodeCount
+	ref := func(offset uint) uint { return nodeCount + dataSectionSeparator + offset }
+	nodes := [nodeCount][2]uint{}
+	for i := range 6 {
+		nodes[i] = [2]uint{uint(i + 1), empty}
+	}
+	nodes[6] = [2]uint{7, 8}
+	nodes[7] = [2]uint{empty, ref(australia)}
+	nodes[8] = [2]uint{ref(france), ref(pointer)}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			buf.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data)
+	buf.Write(metadataMarker)
+	buf.Write(encode([]any{
+		"node_count", uint32(nodeCount),
+		"record_size", uint16(24),
+		"ip_version", uint16(4),
+		"database_type", "Test-Country",
+	}))
+
+	db, err := parse(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse database: %v", err)
+	}
+	if db.Type() != "Test-Country" {
+		t.Errorf("Expected database type Test-Country, got %q", db.Type())
+	}
+	tests := map[string]string{
+		"1.2.3.4":     "AU",
+		"2.255.0.1":   "FR", // Only has a registered country
+		"3.0.0.1":     "AU",
+		"4.0.0.1":     "",
+		"128.0.0.1":   "",
+		"2001:db8::1": "",
+	}
+	for ip, want := range tests {
+		got, err := db.Country(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("Failed to look up %s: %v", ip, err)
+		} else if got != want {
+			t.Errorf("Expected country %q for %s, got %q", want, ip, got)
+		}
+	}
+
+	if _, err := parse([]byte("not a database")); err == nil {
+		t.Errorf("Expected error for a file without metadata")
+	}
+}
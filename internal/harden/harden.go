@@ -0,0 +1,153 @@
+// Package harden limits what the server process can do to its host, and
+// checks that the process's resource limits fit the VMs it may run.
+package harden
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// File descriptors the server needs, estimated from what each VM holds open:
+// its log files and pipes, Firecracker API and guest SSH connections, and
+// the client and guest connections of a few sessions
+const (
+	baseFDs  = 128
+	fdsPerVM = 16
+)
+
+// RaiseFileLimit raises the soft limit on open files to the hard limit and
+// returns the new soft limit
+func RaiseFileLimit() (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, err
+	}
+	if rlim.Cur < rlim.Max {
+		raised := syscall.Rlimit{Cur: rlim.Max, Max: rlim.Max}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+			return rlim.Cur, err
+		}
+		rlim.Cur = rlim.Max
+	}
+	return rlim.Cur, nil
+}
+
+// RequiredFiles returns how many open files running maxVMs VMs needs
+func RequiredFiles(maxVMs int) uint64 {
+	return baseFDs + uint64(maxVMs)*fdsPerVM
+}
+
+// MaxVMs returns how many VMs limit open files are enough for
+func MaxVMs(limit uint64) int {
+	if limit < baseFDs {
+		return 0
+	}
+	return int((limit - baseFDs) / fdsPerVM)
+}
+
+// CheckFileLimit returns an error if limit open files aren't enough for
+// maxVMs VMs. Unlimited VMs (0) aren't checked.
+func CheckFileLimit(limit uint64, maxVMs int) error {
+	if maxVMs <= 0 {
+		return nil
+	}
+	if need := RequiredFiles(maxVMs); limit < need {
+		return fmt.Errorf("open file limit %d is too low for %d concurrent VMs, which need about %d; raise it with ulimit -n or LimitNOFILE", limit, maxVMs, need)
+	}
+	return nil
+}
+
+// Landlock access rights from <linux/landlock.h>, ABI version 1
+const (
+	accessFSWriteFile  = 1 << 1
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+
+	// Every right that changes the filesystem, leaving reads unrestricted
+	accessFSWrites = accessFSWriteFile | accessFSRemoveDir | accessFSRemoveFile |
+		accessFSMakeChar | accessFSMakeDir | accessFSMakeReg | accessFSMakeSock |
+		accessFSMakeFifo | accessFSMakeBlock | accessFSMakeSym
+)
+
+// Landlock system calls, which have the same numbers on amd64 and arm64
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+	prSetNoNewPrivs              = 38
+	oPath                        = 0x200000 // O_PATH, missing from package syscall
+)
+
+// landlockPathBeneathAttr is struct landlock_path_beneath_attr, which the
+// kernel reads as packed
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+	_             [4]byte
+}
+
+// ErrLandlockUnsupported is returned when the kernel lacks Landlock
+var ErrLandlockUnsupported = errors.New("kernel does not support Landlock (needs Linux 5.13+ with CONFIG_SECURITY_LANDLOCK)")
+
+// ErrLandlockCgo is returned when the binary was built with cgo, since the
+// Go runtime can't then apply Landlock to all of its threads
+var ErrLandlockCgo = errors.New("Landlock needs a binary built with CGO_ENABLED=0")
+
+// Landlock restricts the process and everything it starts, like
+// Firecracker, from changing the filesystem outside of writable paths.
+// Reads are not restricted. Paths that don't exist are skipped. Since it
+// sets no_new_privs, programs started afterward can't gain privileges
+// through setuid bits or file capabilities.
+func Landlock(writable []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 || abi < 1 {
+		return ErrLandlockUnsupported
+	}
+
+	handled := uint64(accessFSWrites)
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create Landlock ruleset: %w", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, path := range writable {
+		dir, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to open %s for Landlock: %w", path, err)
+		}
+		attr := landlockPathBeneathAttr{allowedAccess: accessFSWrites, parentFD: int32(dir.Fd())}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+		dir.Close()
+		if errno != 0 {
+			return fmt.Errorf("failed to allow writes to %s: %w", path, errno)
+		}
+	}
+
+	// Both apply per thread, so they go to every thread of the runtime. With
+	// cgo that's refused before any thread is changed.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno == syscall.ENOTSUP {
+		return ErrLandlockCgo
+	} else if errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce Landlock ruleset: %w", errno)
+	}
+	return nil
+}
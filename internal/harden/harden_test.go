@@ -0,0 +1,68 @@
+package harden
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLimit(t *testing.T) {
+	limit, err := RaiseFileLimit()
+	if err != nil {
+		t.Fatalf("Failed to raise open file limit: %v", err)
+	}
+	if limit == 0 {
+		t.Errorf("Expected a nonzero open file limit")
+	}
+
+	if err := CheckFileLimit(1024, 16); err != nil {
+		t.Errorf("Expected 1024 files to be enough for 16 VMs: %v", err)
+	}
+	if err := CheckFileLimit(1024, 1000); err == nil {
+		t.Errorf("Expected 1024 files to be too few for 1000 VMs")
+	}
+	if err := CheckFileLimit(64, 0); err != nil {
+		t.Errorf("Expected unlimited VMs not to be checked: %v", err)
+	}
+	if n := MaxVMs(RequiredFiles(50)); n != 50 {
+		t.Errorf("Expected MaxVMs to invert RequiredFiles, got %d", n)
+	}
+}
+
+func TestLandlock(t *testing.T) {
+	// Landlock can't be lifted, so it is tested in a child process
+	if dir := os.Getenv("HARDEN_TEST_LANDLOCK"); dir != "" {
+		if err := Landlock([]string{filepath.Join(dir, "writable")}); err != nil {
+			if errors.Is(err, ErrLandlockUnsupported) {
+				os.Exit(3)
+			}
+			t.Fatalf("Failed to enable Landlock: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "writable", "file"), nil, 0644); err != nil {
+			t.Fatalf("Expected writes to be allowed in the writable directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err == nil {
+			t.Fatalf("Expected writes to be denied outside the writable directory")
+		}
+		if _, err := os.ReadFile(filepath.Join(dir, "existing")); err != nil {
+			t.Fatalf("Expected reads to be allowed: %v", err)
+		}
+		return
+	}
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "writable"), 0755)
+	os.WriteFile(filepath.Join(dir, "existing"), []byte("data"), 0644)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLandlock$")
+	cmd.Env = append(os.Environ(), "HARDEN_TEST_LANDLOCK="+dir)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		t.Skip("Landlock is not supported by this kernel")
+	}
+	if err != nil {
+		t.Fatalf("Landlock test failed: %v\n%s", err, out)
+	}
+}
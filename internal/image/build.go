@@ -0,0 +1,93 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Build makes an ext4 rootfs image at output from a spec, running the setup
+// in a Docker container of the spec's base image. Files copied in are
+// relative to specDir. Build output goes to log. It needs root to mount the
+// image while it's filled.
+func Build(ctx context.Context, spec *Spec, specDir, output string, log io.Writer) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("building an image needs root to mount it")
+	}
+	for _, c := range spec.Copies {
+		if _, err := os.Stat(filepath.Join(specDir, c[0])); err != nil {
+			return fmt.Errorf("COPY source: %w", err)
+		}
+	}
+	specDir, err := filepath.Abs(specDir)
+	if err != nil {
+		return err
+	}
+
+	// Built under a temporary name, so a failed build never leaves a partial
+	// image that looks usable
+	tmp := output + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	err = f.Truncate(int64(spec.SizeMB) << 20)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to size image: %w", err)
+	}
+	if err := run(ctx, log, nil, "mkfs.ext4", "-q", "-F", tmp); err != nil {
+		return err
+	}
+
+	mountDir, err := os.MkdirTemp("", "sshvm-image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountDir)
+	if err := os.Chmod(mountDir, 0755); err != nil {
+		return err
+	}
+	if err := run(ctx, log, nil, "mount", "-o", "loop", tmp, mountDir); err != nil {
+		return err
+	}
+	mounted := true
+	defer func() {
+		if mounted {
+			run(context.Background(), log, nil, "umount", mountDir)
+		}
+	}()
+
+	err = run(ctx, log, strings.NewReader(spec.Script()), "docker", "run", "-i", "--rm",
+		"-v", mountDir+":/rootfs",
+		"-v", specDir+":/spec:ro",
+		spec.From, "sh")
+	if err != nil {
+		return fmt.Errorf("image setup failed: %w", err)
+	}
+	if err := run(ctx, log, nil, "umount", mountDir); err != nil {
+		return err
+	}
+	mounted = false
+	return os.Rename(tmp, output)
+}
+
+// run runs a build step, sending its output to log
+func run(ctx context.Context, log io.Writer, stdin io.Reader, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
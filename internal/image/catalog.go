@@ -0,0 +1,140 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Image is an entry in an image catalog, which lets users pick the system
+// their VM runs. Zero values fall back to the server's flags.
+type Image struct {
+	Name        string `json:"name"`
+	Rootfs      string `json:"rootfs"`              // Path to the ext4 rootfs, or an s3:// URL
+	SHA256      string `json:"sha256,omitempty"`    // Checksum of the rootfs, checked when the catalog is loaded
+	Memory      int    `json:"memory,omitempty"`    // VM memory in MB
+	CPUs        int    `json:"cpus,omitempty"`      // Number of VM CPUs
+	Disk        int    `json:"disk,omitempty"`      // Size in MB of the per-VM overlay drive in overlay mode
+	Kernel      string `json:"kernel,omitempty"`    // Path to a vmlinux kernel, instead of the built-in one
+	BootArgs    string `json:"boot_args,omitempty"` // Extra kernel command line arguments
+	Description string `json:"description,omitempty"`
+}
+
+// maxNameLength bounds image names, which are shown in a menu
+const maxNameLength = 32
+
+// validate checks an image's fields
+func (img *Image) validate() error {
+	if img.Name == "" || len(img.Name) > maxNameLength || strings.Trim(img.Name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+		return fmt.Errorf("invalid image name %q", img.Name)
+	}
+	if img.Rootfs == "" {
+		return fmt.Errorf("image %s has no rootfs", img.Name)
+	}
+	if img.Memory != 0 && img.Memory < 64 {
+		return fmt.Errorf("image %s: memory must be at least 64 MB", img.Name)
+	}
+	if img.CPUs < 0 || img.Disk < 0 {
+		return fmt.Errorf("image %s: CPUs and disk can't be negative", img.Name)
+	}
+	return nil
+}
+
+// LoadCatalog reads a JSON list of images. Relative paths in it are
+// relative to the catalog's directory. The first image is the default.
+func LoadCatalog(path string) ([]Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image catalog: %w", err)
+	}
+	var images []Image
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse image catalog %s: %w", path, err)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("image catalog %s is empty", path)
+	}
+	names := make(map[string]bool)
+	for i := range images {
+		img := &images[i]
+		if err := img.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if names[img.Name] {
+			return nil, fmt.Errorf("%s: duplicate image %s", path, img.Name)
+		}
+		names[img.Name] = true
+		img.Rootfs = resolvePath(filepath.Dir(path), img.Rootfs)
+		if img.Kernel != "" {
+			img.Kernel = resolvePath(filepath.Dir(path), img.Kernel)
+		}
+	}
+	return images, nil
+}
+
+// resolvePath makes a local path relative to dir absolute, leaving URLs as is
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || strings.Contains(path, "://") {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// AddToCatalog adds an image to a catalog, replacing any image with the same
+// name, and creates the catalog if it doesn't exist
+func AddToCatalog(path string, img Image) error {
+	if err := img.validate(); err != nil {
+		return err
+	}
+	var images []Image
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &images); err != nil {
+			return fmt.Errorf("failed to parse image catalog %s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read image catalog: %w", err)
+	}
+
+	replaced := false
+	for i := range images {
+		if images[i].Name == img.Name {
+			images[i], replaced = img, true
+		}
+	}
+	if !replaced {
+		images = append(images, img)
+	}
+
+	data, err = json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so the server never reads a
+	// partial catalog
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write image catalog: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// FileSHA256 returns the hex SHA-256 checksum of a file
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.json")
+
+	if err := AddToCatalog(path, Image{Name: "alpine", Rootfs: "alpine.ext4"}); err != nil {
+		t.Fatalf("AddToCatalog failed: %v", err)
+	}
+	if err := AddToCatalog(path, Image{Name: "python", Rootfs: "/srv/python.ext4", Memory: 512}); err != nil {
+		t.Fatalf("AddToCatalog failed: %v", err)
+	}
+	if err := AddToCatalog(path, Image{Name: "alpine", Rootfs: "alpine-2.ext4", Description: "Alpine Linux"}); err != nil {
+		t.Fatalf("AddToCatalog failed: %v", err)
+	}
+	if err := AddToCatalog(path, Image{Name: "bad name", Rootfs: "x.ext4"}); err == nil {
+		t.Errorf("Expected an invalid name to be refused")
+	}
+
+	images, err := LoadCatalog(path)
+	if err != nil {
+		t.Fatalf("LoadCatalog failed: %v", err)
+	}
+	if len(images) != 2 || images[0].Name != "alpine" || images[1].Name != "python" {
+		t.Fatalf("Expected alpine replaced in place, got %+v", images)
+	}
+	if images[0].Rootfs != filepath.Join(dir, "alpine-2.ext4") || images[0].Description != "Alpine Linux" {
+		t.Errorf("Expected relative rootfs resolved against the catalog, got %+v", images[0])
+	}
+	if images[1].Rootfs != "/srv/python.ext4" || images[1].Memory != 512 {
+		t.Errorf("Got %+v", images[1])
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`[{"name": "a", "rootfs": "a.ext4"}, {"name": "a", "rootfs": "b.ext4"}]`,
+		`[{"name": "a"}]`,
+		`[{"name": "a", "rootfs": "a.ext4", "memory": 16}]`,
+	} {
+		os.WriteFile(path, []byte(bad), 0644)
+		if _, err := LoadCatalog(path); err == nil {
+			t.Errorf("Expected catalog %s to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Fields of the ext2/3/4 superblock, which starts 1024 bytes into the
+// filesystem. Offsets are from the start of the superblock.
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	extMagic         = 0xEF53
+	extMagicOffset   = 0x38
+	extBlocksLo      = 0x04
+	extLogBlockSize  = 0x18
+	extIncompat      = 0x60
+	extBlocksHi      = 0x150
+	extIncompat64Bit = 0x80
+)
+
+// CheckRootfs checks that a file is an ext4 filesystem a VM can boot from,
+// like one a user brings, and that it is at most maxSize bytes. The kernel
+// mounts ext2 and ext3 filesystems as ext4, so they pass too.
+func CheckRootfs(path string, maxSize int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("image is not a regular file")
+	}
+	if info.Size() > maxSize {
+		return fmt.Errorf("image is %d MB, more than the limit of %d MB", info.Size()>>20, maxSize>>20)
+	}
+
+	sb := make([]byte, superblockSize)
+	if _, err := f.ReadAt(sb, superblockOffset); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("image is too small to be an ext4 filesystem")
+	} else if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint16(sb[extMagicOffset:]) != extMagic {
+		return fmt.Errorf("image is not an ext4 filesystem")
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[extLogBlockSize:])
+	if logBlockSize > 6 {
+		return fmt.Errorf("image has an invalid ext4 block size")
+	}
+	blocks := uint64(binary.LittleEndian.Uint32(sb[extBlocksLo:]))
+	if binary.LittleEndian.Uint32(sb[extIncompat:])&extIncompat64Bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[extBlocksHi:])) << 32
+	}
+	// A filesystem bigger than its image was truncated, and won't mount
+	if blocks<<(10+logBlockSize) > uint64(info.Size()) {
+		return fmt.Errorf("image is truncated: its filesystem is %d bytes, but the file is only %d", blocks<<(10+logBlockSize), info.Size())
+	}
+	return nil
+}
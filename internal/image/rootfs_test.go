@@ -0,0 +1,42 @@
+package image
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeExt4 returns an image of size bytes with just an ext4 superblock,
+// which says the filesystem has blocks 1 KB blocks
+func fakeExt4(size, blocks int) []byte {
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data[superblockOffset+extBlocksLo:], uint32(blocks))
+	binary.LittleEndian.PutUint16(data[superblockOffset+extMagicOffset:], extMagic)
+	return data
+}
+
+func TestCheckRootfs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, data, 0644)
+		return path
+	}
+
+	if err := CheckRootfs(write("ok.ext4", fakeExt4(64<<10, 64)), 1<<20); err != nil {
+		t.Errorf("Expected a valid image to pass, got %v", err)
+	}
+	if err := CheckRootfs(write("big.ext4", fakeExt4(64<<10, 64)), 32<<10); err == nil {
+		t.Errorf("Expected an image over the limit to fail")
+	}
+	if err := CheckRootfs(write("truncated.ext4", fakeExt4(64<<10, 128)), 1<<20); err == nil {
+		t.Errorf("Expected a truncated image to fail")
+	}
+	if err := CheckRootfs(write("zeros.img", make([]byte, 64<<10)), 1<<20); err == nil {
+		t.Errorf("Expected an image without a superblock to fail")
+	}
+	if err := CheckRootfs(write("tiny.img", []byte("hello")), 1<<20); err == nil {
+		t.Errorf("Expected a tiny file to fail")
+	}
+}
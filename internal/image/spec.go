@@ -0,0 +1,211 @@
+// Package image builds bootable rootfs images for VMs from a short spec,
+// like a Dockerfile:
+//
+//	FROM alpine:3.20
+//	SIZE 1024
+//	PACKAGES python3 nodejs npm
+//	COPY motd /etc/motd
+//	RUN pip install --break-system-packages httpie
+//	SERVICE nginx
+//
+// Images are built from an Alpine-based container image, which must have
+// apk and OpenRC. Every image gets sshd with passwordless root login, a
+// login terminal on the serial console, and /sbin/overlay-init for the
+// overlay and ephemeral rootfs modes.
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/shell"
+)
+
+// defaultSizeMB is the size of images whose spec has no SIZE
+const defaultSizeMB = 512
+
+// Spec describes an image to build
+type Spec struct {
+	From     string      // Container image the rootfs is made from
+	SizeMB   int         // Size of the ext4 filesystem
+	Packages []string    // apk packages installed on top of the base
+	Copies   [][2]string // Files copied in, as source relative to the spec and absolute destination
+	Runs     []string    // Shell commands run after the packages are installed
+	Services []string    // OpenRC services enabled at boot
+}
+
+// ParseSpec reads a spec. Blank lines and lines starting with # are ignored,
+// and a line ending in \ continues on the next.
+func ParseSpec(r io.Reader) (*Spec, error) {
+	spec := &Spec{SizeMB: defaultSizeMB}
+	scanner := bufio.NewScanner(r)
+	var pending string
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line, pending = pending+line, ""
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := spec.parseLine(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if spec.From == "" {
+		return nil, fmt.Errorf("spec needs a FROM line")
+	}
+	return spec, nil
+}
+
+// parseLine adds an instruction to the spec
+func (spec *Spec) parseLine(line string) error {
+	keyword, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	args := strings.Fields(rest)
+	switch strings.ToUpper(keyword) {
+	case "FROM":
+		if len(args) != 1 {
+			return fmt.Errorf("expected FROM IMAGE")
+		}
+		spec.From = args[0]
+	case "SIZE":
+		mb, err := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(rest), "MB"))
+		if err != nil || mb < 64 {
+			return fmt.Errorf("expected SIZE in MB, at least 64")
+		}
+		spec.SizeMB = mb
+	case "PACKAGE", "PACKAGES":
+		for _, pkg := range args {
+			if !validName(pkg) {
+				return fmt.Errorf("invalid package name %q", pkg)
+			}
+		}
+		spec.Packages = append(spec.Packages, args...)
+	case "COPY":
+		if len(args) != 2 {
+			return fmt.Errorf("expected COPY SOURCE DESTINATION")
+		}
+		src := path.Clean(args[0])
+		if path.IsAbs(src) || src == ".." || strings.HasPrefix(src, "../") {
+			return fmt.Errorf("COPY source %q must be inside the spec's directory", args[0])
+		}
+		if !path.IsAbs(args[1]) {
+			return fmt.Errorf("COPY destination %q must be an absolute path", args[1])
+		}
+		spec.Copies = append(spec.Copies, [2]string{src, args[1]})
+	case "RUN":
+		if rest == "" {
+			return fmt.Errorf("expected RUN COMMAND")
+		}
+		spec.Runs = append(spec.Runs, rest)
+	case "SERVICE", "SERVICES":
+		for _, service := range args {
+			if !validName(service) {
+				return fmt.Errorf("invalid service name %q", service)
+			}
+		}
+		spec.Services = append(spec.Services, args...)
+	default:
+		return fmt.Errorf("unknown instruction %q", keyword)
+	}
+	return nil
+}
+
+// validName reports whether a package or service name is safe to put in a
+// shell command unquoted
+func validName(name string) bool {
+	return name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._+-") == ""
+}
+
+// baseSetup makes the container's system bootable as a VM, like
+// scripts/create-rootfs.sh
+const baseSetup = `apk add --no-cache openrc util-linux openssh bash e2fsprogs
+
+# Login terminal on the serial console
+ln -s agetty /etc/init.d/agetty.ttyS0
+echo ttyS0 > /etc/securetty
+rc-update add agetty.ttyS0 default
+
+rc-update add devfs boot
+rc-update add procfs boot
+rc-update add sysfs boot
+rc-update add localmount boot
+echo "devpts  /dev/pts  devpts  defaults,gid=5,mode=620,ptmxmode=666  0  0" >> /etc/fstab
+
+rc-update add sshd default
+ssh-keygen -A
+passwd -d root
+sed -i 's/^#PermitRootLogin.*/PermitRootLogin yes/' /etc/ssh/sshd_config
+sed -i 's/^#PermitEmptyPasswords.*/PermitEmptyPasswords yes/' /etc/ssh/sshd_config
+
+sed -i 's|/bin/sh|/bin/bash|' /etc/passwd
+cat >> /root/.bash_profile <<'PROFILE'
+PS1='\[\033[01;32m\]\u@\h\[\033[00m\]:\[\033[01;34m\]\w\[\033[00m\]\$ '
+PROFILE
+rm -f /etc/motd
+
+cat > /sbin/overlay-init <<'INIT'
+#!/bin/sh
+set -e
+mount -t proc proc /proc
+mount -t devtmpfs devtmpfs /dev
+if [ "${overlay_root:-}" = tmpfs ]; then
+  mount -t tmpfs -o noatime,mode=0755 tmpfs /overlay
+else
+  dev="/dev/${overlay_root:-vdb}"
+  if ! mount -t ext4 -o noatime "$dev" /overlay 2>/dev/null; then
+    mkfs.ext4 -q "$dev"
+    mount -t ext4 -o noatime "$dev" /overlay
+  fi
+fi
+mkdir -p /overlay/root /overlay/work
+mount -t overlay -o noatime,lowerdir=/,upperdir=/overlay/root,workdir=/overlay/work overlay /mnt
+umount /dev /proc
+cd /mnt
+pivot_root . rom
+exec chroot . /sbin/init "$@"
+INIT
+chmod +x /sbin/overlay-init
+`
+
+// copyOut copies the configured system into the image mounted at /rootfs
+const copyOut = `for d in bin etc home lib root sbin usr; do
+  [ -d "/$d" ] && tar c "/$d" 2>/dev/null | tar x -C /rootfs
+done
+for d in dev proc run sys var mnt overlay rom tmp; do mkdir -p "/rootfs/$d"; done
+chmod 1777 /rootfs/tmp
+`
+
+// Script returns the shell script that runs in the base container to set
+// up the system and copy it into the image, which is mounted at /rootfs.
+// The spec's directory is mounted at /spec.
+func (spec *Spec) Script() string {
+	var b strings.Builder
+	b.WriteString("set -eu\n\n")
+	b.WriteString(baseSetup)
+	if len(spec.Packages) > 0 {
+		fmt.Fprintf(&b, "\napk add --no-cache %s\n", strings.Join(spec.Packages, " "))
+	}
+	for _, c := range spec.Copies {
+		dst := shell.Quote(c[1])
+		fmt.Fprintf(&b, "\nmkdir -p \"$(dirname %s)\"\ncp -a %s %s\n", dst, shell.Quote(path.Join("/spec", c[0])), dst)
+	}
+	for _, run := range spec.Runs {
+		fmt.Fprintf(&b, "\n%s\n", run)
+	}
+	for _, service := range spec.Services {
+		fmt.Fprintf(&b, "\nrc-update add %s default\n", service)
+	}
+	b.WriteString("\n" + copyOut)
+	return b.String()
+}
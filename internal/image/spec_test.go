@@ -0,0 +1,65 @@
+package image
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(`# A playground image
+FROM alpine:3.20
+SIZE 1024MB
+PACKAGES vim python3 \
+  nginx
+COPY files/motd /etc/motd
+RUN echo 'hello' > /etc/issue
+SERVICE nginx
+`))
+	if err != nil {
+		t.Fatalf("ParseSpec failed: %v", err)
+	}
+	if spec.From != "alpine:3.20" || spec.SizeMB != 1024 {
+		t.Errorf("Got FROM %q SIZE %d", spec.From, spec.SizeMB)
+	}
+	if !slices.Equal(spec.Packages, []string{"vim", "python3", "nginx"}) {
+		t.Errorf("Got packages %v", spec.Packages)
+	}
+	if len(spec.Copies) != 1 || spec.Copies[0] != [2]string{"files/motd", "/etc/motd"} {
+		t.Errorf("Got copies %v", spec.Copies)
+	}
+
+	script := spec.Script()
+	for _, want := range []string{
+		"rc-update add sshd default",
+		"/sbin/overlay-init",
+		"apk add --no-cache vim python3 nginx\n",
+		"cp -a '/spec/files/motd' '/etc/motd'\n",
+		"echo 'hello' > /etc/issue\n",
+		"rc-update add nginx default\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Script missing %q", want)
+		}
+	}
+	// User setup runs after the base and before copying out
+	if strings.Index(script, "echo 'hello'") > strings.Index(script, "tar x -C /rootfs") {
+		t.Errorf("RUN comes after the system is copied into the image")
+	}
+}
+
+func TestParseSpecErrors(t *testing.T) {
+	for _, spec := range []string{
+		"SIZE 512",
+		"FROM alpine\nSIZE 10",
+		"FROM alpine\nPACKAGES vim;reboot",
+		"FROM alpine\nCOPY ../secret /etc/secret",
+		"FROM alpine\nCOPY motd etc/motd",
+		"FROM alpine\nSERVICE $(reboot)",
+		"FROM alpine\nVOLUME /data",
+	} {
+		if _, err := ParseSpec(strings.NewReader(spec)); err == nil {
+			t.Errorf("ParseSpec(%q) succeeded", spec)
+		}
+	}
+}
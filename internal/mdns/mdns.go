@@ -0,0 +1,324 @@
+// Package mdns answers multicast DNS queries for a set of hosts on one
+// network interface, so machines on the link can resolve their names and
+// browse their services without a DNS server.
+//
+// Names are answered as described in RFC 6762 and services as in RFC 6763
+// (DNS-SD). Only the responder side is implemented, without probing for
+// conflicts, since the hosts are handed out names by the caller.
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// port is the mDNS port, which queries and responses are sent to and from
+const port = 5353
+
+// ttl is how long answers may be cached, in seconds. It is short so that
+// hosts that go away without a goodbye, like when the responder crashes,
+// are forgotten quickly.
+const ttl = 120
+
+// group is the IPv4 mDNS multicast group
+var group = net.IPv4(224, 0, 0, 251)
+
+// servicesName is browsed to list the service types on the link
+const servicesName = "_services._dns-sd._udp.local."
+
+// classCacheFlush marks records that a host is the only one to answer with,
+// so caches replace older records of the same name and type
+const classCacheFlush = dnsmessage.ClassINET | 0x8000
+
+// Service is a service offered by a host
+type Service struct {
+	Name  string // Service name, like "http" for _http._tcp
+	Proto string // "tcp" or "udp"
+	Port  int
+}
+
+// Type returns the DNS-SD service type, like "_http._tcp"
+func (svc Service) Type() string {
+	return "_" + svc.Name + "._" + svc.Proto
+}
+
+// Host is a machine announced under NAME.local
+type Host struct {
+	Name     string // Host name without .local, like "alice"
+	IP       net.IP // IPv4 address
+	Services []Service
+}
+
+// Responder answers mDNS queries for its hosts
+type Responder struct {
+	logger logrus.FieldLogger
+
+	mu    sync.Mutex
+	hosts []Host
+	conn  *net.UDPConn // Set while Run is running
+}
+
+// NewResponder creates a responder without any hosts
+func NewResponder(logger logrus.FieldLogger) *Responder {
+	return &Responder{logger: logger}
+}
+
+// Set replaces the hosts answered for. Hosts that are new or changed are
+// announced, and caches on the link are told to forget those removed.
+func (r *Responder) Set(hosts []Host) {
+	r.mu.Lock()
+	old := r.hosts
+	r.hosts = slices.Clone(hosts)
+	conn := r.conn
+	r.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	var announced, removed []Host
+	for _, host := range hosts {
+		if i := slices.IndexFunc(old, func(h Host) bool { return h.Name == host.Name }); i < 0 || !sameHost(old[i], host) {
+			announced = append(announced, host)
+		}
+	}
+	for _, host := range old {
+		if i := slices.IndexFunc(hosts, func(h Host) bool { return h.Name == host.Name }); i < 0 || !sameHost(hosts[i], host) {
+			removed = append(removed, host)
+		}
+	}
+	r.announce(conn, removed, 0)
+	r.announce(conn, announced, ttl)
+}
+
+// sameHost reports whether two hosts have the same records
+func sameHost(a, b Host) bool {
+	return a.Name == b.Name && a.IP.Equal(b.IP) && slices.Equal(a.Services, b.Services)
+}
+
+// Run answers queries from the link of the named interface until ctx is
+// done, then sends goodbyes for every host
+func (r *Responder) Run(ctx context.Context, ifaceName string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("failed to get addresses of %s: %w", ifaceName, err)
+	}
+	var link []*net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			link = append(link, ipNet)
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", iface, &net.UDPAddr{IP: group, Port: port})
+	if err != nil {
+		return fmt.Errorf("failed to listen for mDNS on %s: %w", ifaceName, err)
+	}
+
+	r.mu.Lock()
+	r.conn = conn
+	hosts := r.hosts
+	r.mu.Unlock()
+	r.announce(conn, hosts, ttl)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		r.mu.Lock()
+		r.conn = nil
+		hosts := r.hosts
+		r.mu.Unlock()
+		r.announce(conn, hosts, 0)
+		conn.Close()
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read mDNS query: %w", err)
+		}
+		// The socket gets the group's packets from every interface, but
+		// the hosts are only answered for on their own link
+		if !slices.ContainsFunc(link, func(ipNet *net.IPNet) bool { return ipNet.Contains(src.IP) }) {
+			continue
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+
+		r.mu.Lock()
+		response, ok := respond(r.hosts, query.Questions)
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+		dst := &net.UDPAddr{IP: group, Port: port}
+		if src.Port != port {
+			// Legacy unicast queries, like from dig -p 5353, are answered
+			// directly as in unicast DNS
+			response.ID = query.ID
+			response.Questions = query.Questions
+			dst = src
+		}
+		r.send(conn, response, dst)
+	}
+}
+
+// announce sends the records of each host unsolicited, or with a TTL of 0
+// to say goodbye
+func (r *Responder) announce(conn *net.UDPConn, hosts []Host, ttl uint32) {
+	for _, host := range hosts {
+		response := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+		for _, rec := range records(host, ttl) {
+			// Other hosts may still offer the service type
+			if ttl == 0 && rec.Header.Name.String() == servicesName {
+				continue
+			}
+			response.Answers = append(response.Answers, rec)
+		}
+		r.send(conn, response, &net.UDPAddr{IP: group, Port: port})
+	}
+}
+
+// send packs and sends a response
+func (r *Responder) send(conn *net.UDPConn, response dnsmessage.Message, dst *net.UDPAddr) {
+	packed, err := response.Pack()
+	if err != nil {
+		r.logger.Warnf("Failed to pack mDNS response: %v", err)
+		return
+	}
+	if _, err := conn.WriteToUDP(packed, dst); err != nil {
+		r.logger.Debugf("Failed to send mDNS response to %s: %v", dst, err)
+	}
+}
+
+// respond returns the response to questions about hosts, with the records
+// asked for as answers and those clients would ask for next, like the
+// address of a service's host, as additional records. It returns false if
+// none of the questions are about the hosts.
+func respond(hosts []Host, questions []dnsmessage.Question) (dnsmessage.Message, bool) {
+	var all []dnsmessage.Resource
+	for _, host := range hosts {
+		// The same service type can be offered by several hosts
+		for _, rec := range records(host, ttl) {
+			all = appendRecord(all, rec)
+		}
+	}
+
+	response := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	for _, q := range questions {
+		for _, rec := range all {
+			if strings.EqualFold(rec.Header.Name.String(), q.Name.String()) && (q.Type == dnsmessage.TypeALL || q.Type == rec.Header.Type) {
+				response.Answers = appendRecord(response.Answers, rec)
+			}
+		}
+	}
+	if len(response.Answers) == 0 {
+		return response, false
+	}
+
+	// Follow pointers and service targets from the answers
+	var targets []string
+	for _, rec := range response.Answers {
+		targets = append(targets, target(rec)...)
+	}
+	for len(targets) > 0 {
+		name := targets[0]
+		targets = targets[1:]
+		for _, rec := range all {
+			if !strings.EqualFold(rec.Header.Name.String(), name) || containsRecord(response.Answers, rec) || containsRecord(response.Additionals, rec) {
+				continue
+			}
+			response.Additionals = append(response.Additionals, rec)
+			targets = append(targets, target(rec)...)
+		}
+	}
+	return response, true
+}
+
+// target returns the names a record points to
+func target(rec dnsmessage.Resource) []string {
+	switch body := rec.Body.(type) {
+	case *dnsmessage.PTRResource:
+		return []string{body.PTR.String()}
+	case *dnsmessage.SRVResource:
+		return []string{body.Target.String()}
+	}
+	return nil
+}
+
+// appendRecord appends rec to records unless it is already there
+func appendRecord(records []dnsmessage.Resource, rec dnsmessage.Resource) []dnsmessage.Resource {
+	if containsRecord(records, rec) {
+		return records
+	}
+	return append(records, rec)
+}
+
+// containsRecord reports whether records has rec
+func containsRecord(records []dnsmessage.Resource, rec dnsmessage.Resource) bool {
+	return slices.ContainsFunc(records, func(r dnsmessage.Resource) bool { return sameRecord(r, rec) })
+}
+
+// sameRecord reports whether two records have the same name, type, and data
+func sameRecord(a, b dnsmessage.Resource) bool {
+	return a.Header.Name == b.Header.Name && a.Header.Type == b.Header.Type && a.Body.GoString() == b.Body.GoString()
+}
+
+// records returns the records answered for a host: its address, and for
+// each service the pointers browsed for and the instance's SRV and TXT
+func records(host Host, ttl uint32) []dnsmessage.Resource {
+	hostName := dnsmessage.MustNewName(host.Name + ".local.")
+	var ip [4]byte
+	copy(ip[:], host.IP.To4())
+	recs := []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeA, Class: classCacheFlush, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}}
+
+	// Instance names are a single label, so the dots of the host name
+	// can't appear in them
+	instance := strings.ReplaceAll(host.Name, ".", "-")
+	for _, svc := range host.Services {
+		typeName := dnsmessage.MustNewName(svc.Type() + ".local.")
+		instanceName := dnsmessage.MustNewName(instance + "." + svc.Type() + ".local.")
+		recs = append(recs,
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(servicesName), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: typeName},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: typeName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: instanceName},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeSRV, Class: classCacheFlush, TTL: ttl},
+				Body:   &dnsmessage.SRVResource{Port: uint16(svc.Port), Target: hostName},
+			},
+			dnsmessage.Resource{
+				// DNS-SD needs a TXT record even without any keys
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeTXT, Class: classCacheFlush, TTL: ttl},
+				Body:   &dnsmessage.TXTResource{TXT: []string{""}},
+			},
+		)
+	}
+	return recs
+}
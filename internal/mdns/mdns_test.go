@@ -0,0 +1,68 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func question(name string, qtype dnsmessage.Type) []dnsmessage.Question {
+	return []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}}
+}
+
+func TestRespond(t *testing.T) {
+	hosts := []Host{
+		{Name: "alice", IP: net.IPv4(192, 168, 100, 2), Services: []Service{{Name: "http", Proto: "tcp", Port: 8080}}},
+		{Name: "bob.box", IP: net.IPv4(192, 168, 100, 6), Services: []Service{{Name: "http", Proto: "tcp", Port: 80}}},
+	}
+
+	response, ok := respond(hosts, question("ALICE.local.", dnsmessage.TypeA))
+	if !ok || len(response.Answers) != 1 {
+		t.Fatalf("Expected one answer for alice's address, got %v", response.Answers)
+	}
+	if a := response.Answers[0].Body.(*dnsmessage.AResource).A; a != [4]byte{192, 168, 100, 2} {
+		t.Errorf("Expected alice's address, got %v", a)
+	}
+	if response.Answers[0].Header.Class != classCacheFlush {
+		t.Errorf("Expected addresses to flush caches, got class %v", response.Answers[0].Header.Class)
+	}
+
+	// Browsing a service type finds both instances, with what resolving
+	// them needs as additional records
+	response, ok = respond(hosts, question("_http._tcp.local.", dnsmessage.TypePTR))
+	if !ok || len(response.Answers) != 2 {
+		t.Fatalf("Expected two instances of _http._tcp, got %v", response.Answers)
+	}
+	if ptr := response.Answers[1].Body.(*dnsmessage.PTRResource).PTR.String(); ptr != "bob-box._http._tcp.local." {
+		t.Errorf("Expected the dots of host names to be replaced in instance names, got %s", ptr)
+	}
+	var srvPorts []uint16
+	var addresses int
+	for _, rec := range response.Additionals {
+		switch body := rec.Body.(type) {
+		case *dnsmessage.SRVResource:
+			srvPorts = append(srvPorts, body.Port)
+		case *dnsmessage.AResource:
+			addresses++
+		}
+	}
+	if len(srvPorts) != 2 || srvPorts[0] != 8080 || srvPorts[1] != 80 || addresses != 2 {
+		t.Errorf("Expected SRV and address records for both instances, got %v", response.Additionals)
+	}
+
+	response, ok = respond(hosts, question(servicesName, dnsmessage.TypePTR))
+	if !ok || len(response.Answers) != 1 {
+		t.Errorf("Expected the service type to be listed once, got %v", response.Answers)
+	}
+
+	if _, ok := respond(hosts, question("carol.local.", dnsmessage.TypeA)); ok {
+		t.Errorf("Expected no response for unknown hosts")
+	}
+	if _, ok := respond(hosts, question("alice.local.", dnsmessage.TypeAAAA)); ok {
+		t.Errorf("Expected no response for IPv6 addresses")
+	}
+	if response, ok := respond(hosts, question("alice.local.", dnsmessage.TypeALL)); !ok || len(response.Answers) != 1 {
+		t.Errorf("Expected ANY queries to be answered, got %v", response.Answers)
+	}
+}
@@ -0,0 +1,327 @@
+// Package metrics is a minimal registry of counters, gauges, and histograms
+// exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a named family of samples that can render itself
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]metric{}
+)
+
+// register adds a metric to the default registry, panicking on duplicates
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[m.name()]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// WriteAll writes every registered metric to w, sorted by name
+func WriteAll(w io.Writer) {
+	registryMu.Lock()
+	all := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		all = append(all, m)
+	}
+	registryMu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name() < all[j].name() })
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// Handler returns an HTTP handler serving all registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteAll(w)
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	metricName string
+	help       string
+	mu         sync.Mutex
+	value      float64
+}
+
+// NewCounter registers a new counter
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value += delta
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.metricName, formatValue(c.Value()))
+}
+
+// CounterVec is a family of counters partitioned by one label
+type CounterVec struct {
+	metricName string
+	help       string
+	label      string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// NewCounterVec registers a new counter family with the given label name
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{metricName: name, help: help, label: label, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for a label value by one
+func (c *CounterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+// Add increments the counter for a label value by delta
+func (c *CounterVec) Add(labelValue string, delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += delta
+}
+
+// Value returns the current value of the counter for a label value
+func (c *CounterVec) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	writeLabeled(w, c.metricName, c.label, c.values)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	metricName string
+	help       string
+	mu         sync.Mutex
+	value      float64
+	fn         func() float64
+}
+
+// NewGauge registers a new gauge
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, help: help}
+	register(g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn on each scrape
+func NewGaugeFunc(name, help string, fn func() float64) *Gauge {
+	g := &Gauge{metricName: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+// Add adds delta (possibly negative) to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += delta
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	fn := g.fn
+	v := g.value
+	g.mu.Unlock()
+
+	if fn != nil {
+		return fn()
+	}
+	return v
+}
+
+func (g *Gauge) name() string { return g.metricName }
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatValue(g.Value()))
+}
+
+// GaugeVec is a family of gauges partitioned by one label
+type GaugeVec struct {
+	metricName string
+	help       string
+	label      string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// NewGaugeVec registers a new gauge family with the given label name
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{metricName: name, help: help, label: label, values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for a label value to v
+func (g *GaugeVec) Set(labelValue string, v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[labelValue] = v
+}
+
+// Reset removes the gauges for all label values
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values = map[string]float64{}
+}
+
+// Value returns the current value of the gauge for a label value
+func (g *GaugeVec) Value(labelValue string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[labelValue]
+}
+
+func (g *GaugeVec) name() string { return g.metricName }
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.metricName, g.help, "gauge")
+	writeLabeled(w, g.metricName, g.label, g.values)
+}
+
+// Histogram counts observations in cumulative buckets by upper bound
+type Histogram struct {
+	metricName string
+	help       string
+	bounds     []float64 // Sorted upper bounds, without +Inf
+	mu         sync.Mutex
+	counts     []uint64 // Observations per bucket, not cumulative, plus one for +Inf
+	sum        float64
+}
+
+// NewHistogram registers a new histogram with the given bucket upper bounds
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	sorted := append([]float64(nil), bounds...)
+	sort.Float64s(sorted)
+	h := &Histogram{metricName: name, help: help, bounds: sorted, counts: make([]uint64, len(sorted)+1)}
+	register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.metricName, formatValue(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, cumulative)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeLabeled writes one sample per label value, sorted for stable output
+func writeLabeled(w io.Writer, name, label string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", name, label, strconv.Quote(k), formatValue(values[k]))
+	}
+}
+
+// formatValue formats a sample value as Prometheus expects
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteAll(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Total requests.")
+	counter.Inc()
+	counter.Add(2)
+
+	vec := NewCounterVec("test_failures_total", "Failures by reason.", "reason")
+	vec.Inc("timeout")
+	vec.Inc("capacity")
+	vec.Inc("timeout")
+
+	gauge := NewGauge("test_active", "Active things.")
+	gauge.Set(5)
+	gauge.Add(-2)
+
+	NewGaugeFunc("test_computed", "Computed value.", func() float64 { return 1.5 })
+
+	gaugeVec := NewGaugeVec("test_bytes", "Bytes by kind.", "kind")
+	gaugeVec.Set("stale", 5)
+	gaugeVec.Reset()
+	gaugeVec.Set("logs", 10)
+	gaugeVec.Set("logs", 20)
+
+	histogram := NewHistogram("test_seconds", "Durations.", []float64{1, 0.5})
+	histogram.Observe(0.5)
+	histogram.Observe(0.75)
+	histogram.Observe(3)
+
+	var buf bytes.Buffer
+	WriteAll(&buf)
+	output := buf.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\ntest_requests_total 3\n",
+		"test_failures_total{reason=\"capacity\"} 1\ntest_failures_total{reason=\"timeout\"} 2\n",
+		"# TYPE test_active gauge\ntest_active 3\n",
+		"test_computed 1.5\n",
+		"# TYPE test_bytes gauge\ntest_bytes{kind=\"logs\"} 20\n",
+		"# TYPE test_seconds histogram\n" +
+			"test_seconds_bucket{le=\"0.5\"} 1\n" +
+			"test_seconds_bucket{le=\"1\"} 2\n" +
+			"test_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_seconds_sum 4.25\n" +
+			"test_seconds_count 3\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "stale") {
+		t.Errorf("Expected reset gauge values to be gone, got:\n%s", output)
+	}
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	NewCounter("test_duplicate_total", "First.")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic registering a duplicate metric")
+		}
+	}()
+	NewCounter("test_duplicate_total", "Second.")
+}
@@ -0,0 +1,375 @@
+// Package objstore keeps files in S3-compatible object storage, like AWS S3,
+// MinIO, or Cloudflare R2.
+//
+// Requests are signed with AWS Signature Version 4, described at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html.
+// Only what the hypervisor needs is implemented: objects are uploaded in a
+// single PUT, so they can be at most 5 GB.
+package objstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyHash is the SHA-256 of an empty payload
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// unsignedPayload stands in for the hash of uploads, which are streamed
+// from disk instead of being read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Store is a bucket, or a prefix in a bucket, of S3-compatible storage
+type Store struct {
+	endpoint  *url.URL // Custom endpoint, or nil for AWS
+	bucket    string
+	prefix    string // Prepended to keys, ending in / unless empty
+	region    string
+	accessKey string
+	secretKey string
+	token     string // Session token of temporary credentials
+	client    *http.Client
+}
+
+// Object is an object listed in a Store
+type Object struct {
+	Key          string // Relative to the store's prefix
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// New returns the store at a URL like s3://bucket/prefix. Credentials,
+// region, and endpoint are read from the standard AWS environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION,
+// and AWS_ENDPOINT_URL for other providers.
+func New(rawURL string) (*Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid object storage URL %q (expected s3://bucket/prefix)", rawURL)
+	}
+	s := &Store{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{},
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		s.endpoint, err = url.Parse(endpoint)
+		if err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid object storage endpoint %q", endpoint)
+		}
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("object storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// firstEnv returns the first of the environment variables that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectURL returns the URL of a key. Custom endpoints get path-style URLs,
+// which all S3-compatible services support, and AWS gets virtual-hosted ones.
+func (s *Store) objectURL(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com", Path: "/" + key}
+	if s.endpoint != nil {
+		u = &url.URL{Scheme: s.endpoint.Scheme, Host: s.endpoint.Host, Path: "/" + s.bucket + "/" + key}
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return u
+}
+
+// do signs and sends a request for a key, returning an error for any status
+// but 2xx. A missing key is reported as fs.ErrNotExist.
+func (s *Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := emptyHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+	}
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3://%s/%s: %w", s.bucket, key, fs.ErrNotExist)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s s3://%s/%s: %s: %s", method, s.bucket, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Download writes an object to path, through a temporary file so path is
+// never left partially written. It returns the object's ETag.
+func (s *Store) Download(ctx context.Context, key, path string) (string, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// Upload stores the file at path as an object and returns its ETag
+func (s *Store) Upload(ctx context.Context, key, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+key, nil, f, info.Size())
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// ETag returns the ETag of an object, which changes whenever it does
+func (s *Store) ETag(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.prefix+key, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// Delete removes an object. Missing objects are not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is the part of a ListObjectsV2 response that we use
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the objects whose keys start with prefix
+func (s *Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid object listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, Object{Key: strings.TrimPrefix(c.Key, s.prefix), ETag: c.ETag, Size: c.Size, LastModified: c.LastModified})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Fetch downloads the object at a URL like s3://bucket/path/rootfs.ext4 into
+// cacheDir, and returns the path of the copy. A cached copy with the same
+// ETag is used without downloading again.
+func Fetch(ctx context.Context, rawURL, cacheDir string) (string, error) {
+	s, err := New(rawURL)
+	if err != nil {
+		return "", err
+	}
+	// The prefix is the key, and its hash names the cached copy
+	key := strings.TrimSuffix(s.prefix, "/")
+	sum := sha256.Sum256([]byte(rawURL))
+	dir := filepath.Join(cacheDir, hex.EncodeToString(sum[:8]))
+	path := filepath.Join(dir, filepath.Base(key))
+	etagPath := path + ".etag"
+	s.prefix = ""
+
+	etag, err := s.ETag(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if cached, err := os.ReadFile(etagPath); err == nil && string(cached) == etag {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if etag, err = s.Download(ctx, key, path); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(etagPath, []byte(etag), 0644)
+}
+
+// sign adds the Signature Version 4 headers to a request. Host, Range, and
+// X-Amz-* headers are signed.
+func (s *Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string sorted by key, as signing needs
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,441 @@
+// Package pkgcache is a caching mirror of common package registries and of
+// container registries, served to VMs over plain HTTP so fresh VMs install
+// packages and pull images without each one downloading them again.
+package pkgcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// IndexTTL is how long indexes, like APKINDEX.tar.gz or an npm package's
+// metadata, are served from the cache before they are fetched again.
+// Packages themselves never change, so they are kept until evicted.
+const IndexTTL = 5 * time.Minute
+
+// maxIndexSize bounds indexes, which are read into memory to rewrite the
+// registries' URLs in them
+const maxIndexSize = 64 << 20
+
+var (
+	cacheRequests = metrics.NewCounterVec(
+		"sshhv_package_cache_requests_total",
+		"Requests to the package cache, by result (hit, miss, stale, or error).",
+		"result",
+	)
+	cacheBytes = metrics.NewGauge(
+		"sshhv_package_cache_bytes",
+		"Size of the files in the package cache.",
+	)
+)
+
+// Registry is an upstream package registry mirrored under a path prefix
+type Registry struct {
+	Prefix   string                // Path it is served under, like "/alpine/"
+	Upstream string                // URL it mirrors, ending in "/"
+	Index    func(rel string) bool // Whether a path under the prefix is an index, which can change
+}
+
+// Registries are the registries mirrored by default. PyPI's index and its
+// files are on different hosts, so they are mirrored separately.
+var Registries = []Registry{
+	{"/alpine/", "https://dl-cdn.alpinelinux.org/alpine/", func(rel string) bool {
+		return path.Base(rel) == "APKINDEX.tar.gz"
+	}},
+	{"/debian/", "https://deb.debian.org/debian/", debianIndex},
+	{"/debian-security/", "https://deb.debian.org/debian-security/", debianIndex},
+	{"/pypi/", "https://pypi.org/", func(rel string) bool { return true }},
+	{"/pythonhosted/", "https://files.pythonhosted.org/", func(rel string) bool { return false }},
+	{"/npm/", "https://registry.npmjs.org/", func(rel string) bool {
+		return !strings.Contains(rel, "/-/") // Tarballs are at NAME/-/NAME-VERSION.tgz
+	}},
+}
+
+// debianIndex reports whether a path in a Debian archive is an index.
+// Everything but the package pool is under dists/.
+func debianIndex(rel string) bool {
+	return !strings.HasPrefix(rel, "pool/")
+}
+
+// entry is the metadata kept beside each cached file
+type entry struct {
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	Digest      string    `json:"digest,omitempty"` // Of OCI manifests and blobs
+	Fetched     time.Time `json:"fetched"`
+}
+
+// errNotFound is returned for requests outside the mirrored registries
+var errNotFound = errors.New("not a mirrored registry")
+
+// statusError is an upstream response that isn't cached
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("upstream returned %d %s", int(e), http.StatusText(int(e)))
+}
+
+// fetch is a download in progress, which concurrent requests for the same
+// file wait for instead of downloading it again
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// request is a file to serve from the cache
+type request struct {
+	key      string                         // Name of the cached copy, from cacheKey
+	upstream string                         // URL it is fetched from
+	index    bool                           // Whether it can change, so it is refetched after IndexTTL
+	digest   string                         // Expected digest of its content, like "sha256:...", if known
+	fetch    func() (*http.Response, error) // Requests it from the upstream
+}
+
+// Cache mirrors Registries into a directory, evicting the least recently
+// used files once it is over its size limit
+type Cache struct {
+	dir      string
+	maxBytes int64
+	client   *http.Client
+	logger   logrus.FieldLogger
+	requests *metrics.CounterVec
+	bytes    *metrics.Gauge
+
+	mu       sync.Mutex
+	size     int64
+	fetching map[string]*fetch
+}
+
+// New returns a cache in dir of at most maxBytes (0 = unlimited), counting
+// the files already in it
+func New(dir string, maxBytes int64, logger logrus.FieldLogger) (*Cache, error) {
+	return newCache(dir, maxBytes, logger, cacheRequests, cacheBytes)
+}
+
+// newCache returns a cache counting its requests and size in the given
+// metrics
+func newCache(dir string, maxBytes int64, logger logrus.FieldLogger, requests *metrics.CounterVec, bytes *metrics.Gauge) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache: %w", err)
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		client:   &http.Client{Timeout: 30 * time.Minute},
+		logger:   logger,
+		requests: requests,
+		bytes:    bytes,
+		fetching: make(map[string]*fetch),
+	}
+	for _, f := range c.files() {
+		c.size += f.size
+	}
+	c.bytes.Set(float64(c.size))
+	return c, nil
+}
+
+// ServeHTTP serves a file from the cache, downloading it first if it's
+// missing or a stale index. URLs of the registries in indexes are replaced
+// with the cache's own, as the client reached it.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reg, rel, err := lookup(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	upstream := reg.Upstream + rel
+	if r.URL.RawQuery != "" {
+		upstream += "?" + r.URL.RawQuery
+	}
+	// Registries may send another representation of an index by Accept,
+	// like npm's abbreviated metadata
+	accept := r.Header.Get("Accept")
+	req := request{
+		key:      cacheKey(upstream, accept),
+		upstream: upstream,
+		index:    reg.Index(rel),
+		fetch: func() (*http.Response, error) {
+			httpReq, err := http.NewRequest(http.MethodGet, upstream, nil)
+			if err != nil {
+				return nil, err
+			}
+			if accept != "" {
+				httpReq.Header.Set("Accept", accept)
+			}
+			return c.client.Do(httpReq)
+		},
+	}
+	meta, err := c.get(req)
+	if err != nil {
+		c.fail(w, req, err)
+		return
+	}
+	var base string
+	if req.index && textual(meta.ContentType) {
+		base = "http://" + r.Host
+	}
+	c.serve(w, r, req.key, meta, base)
+}
+
+// fail responds to a request that couldn't be served from the cache, with
+// the upstream's status if it refused it
+func (c *Cache) fail(w http.ResponseWriter, req request, err error) {
+	var status statusError
+	if errors.As(err, &status) {
+		http.Error(w, err.Error(), int(status))
+		return
+	}
+	c.requests.Inc("error")
+	c.logger.Warnf("Failed to fetch %s for the cache: %v", req.upstream, err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// serve writes a cached file, with the URLs of the mirrored registries in
+// it replaced by the cache's own at base, unless base is empty
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, key string, meta entry, base string) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now) // Recently used files are evicted last
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if base == "" {
+		http.ServeContent(w, r, "", meta.Fetched, f)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(f, maxIndexSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "", meta.Fetched, bytes.NewReader(rewrite(body, base)))
+}
+
+// lookup returns the registry mirrored under a path and the path relative
+// to it
+func lookup(urlPath string) (Registry, string, error) {
+	for _, reg := range Registries {
+		if rel, ok := strings.CutPrefix(urlPath, reg.Prefix); ok {
+			if rel == "" || strings.Contains("/"+rel+"/", "/../") {
+				break
+			}
+			return reg, rel, nil
+		}
+	}
+	return Registry{}, "", errNotFound
+}
+
+// rewrite replaces the URLs of the mirrored registries in an index with the
+// cache's own at base, so clients fetch the packages it lists through the
+// cache too
+func rewrite(body []byte, base string) []byte {
+	for _, reg := range Registries {
+		body = bytes.ReplaceAll(body, []byte(reg.Upstream), []byte(base+reg.Prefix))
+	}
+	return body
+}
+
+// textual reports whether a content type is text that URLs can be rewritten
+// in, unlike compressed or signed indexes
+func textual(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json")
+}
+
+// cacheKey names the cached copy of an upstream URL
+func cacheKey(upstream, accept string) string {
+	sum := sha256.Sum256([]byte(upstream + "\n" + accept))
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns where a cached file is kept. Its metadata is beside it with
+// a ".json" suffix.
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the metadata of a cached file, downloading it if it's missing
+// or an index older than IndexTTL. Concurrent requests for the same file
+// share one download. An index that can't be refreshed is served stale.
+func (c *Cache) get(req request) (entry, error) {
+	meta, err := c.meta(req.key)
+	if err == nil && (!req.index || time.Since(meta.Fetched) < IndexTTL) {
+		c.requests.Inc("hit")
+		return meta, nil
+	}
+
+	c.mu.Lock()
+	f, waiting := c.fetching[req.key]
+	if !waiting {
+		f = &fetch{done: make(chan struct{})}
+		c.fetching[req.key] = f
+	}
+	c.mu.Unlock()
+	if waiting {
+		<-f.done
+	} else {
+		f.err = c.download(req)
+		c.mu.Lock()
+		delete(c.fetching, req.key)
+		c.mu.Unlock()
+		close(f.done)
+	}
+
+	var status statusError
+	switch {
+	case f.err == nil:
+		c.requests.Inc("miss")
+		return c.meta(req.key)
+	case err == nil && !errors.As(f.err, &status):
+		c.requests.Inc("stale")
+		c.logger.Warnf("Serving stale %s from the cache: %v", req.upstream, f.err)
+		return meta, nil
+	default:
+		return entry{}, f.err
+	}
+}
+
+// meta reads the metadata of a cached file
+func (c *Cache) meta(key string) (entry, error) {
+	data, err := os.ReadFile(c.path(key) + ".json")
+	if err != nil {
+		return entry{}, err
+	}
+	var meta entry
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return entry{}, err
+	}
+	if _, err := os.Stat(c.path(key)); err != nil {
+		return entry{}, err
+	}
+	return meta, nil
+}
+
+// download fetches an upstream file into the cache, replacing any older
+// copy, then evicts files if the cache is over its limit
+func (c *Cache) download(req request) error {
+	resp, err := req.fetch()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+
+	dest := c.path(req.key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", req.upstream, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); req.digest != "" && req.digest != digest {
+		return fmt.Errorf("%s has digest %s, expected %s", req.upstream, digest, req.digest)
+	}
+
+	var old int64
+	if info, err := os.Stat(dest); err == nil {
+		old = info.Size()
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	meta, _ := json.Marshal(entry{
+		URL:         req.upstream,
+		ContentType: resp.Header.Get("Content-Type"),
+		Digest:      resp.Header.Get("Docker-Content-Digest"),
+		Fetched:     time.Now(),
+	})
+	if err := os.WriteFile(dest+".json", meta, 0644); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.size += n - old
+	c.mu.Unlock()
+	c.evict()
+	return nil
+}
+
+// cachedFile is a file in the cache, for eviction
+type cachedFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// files lists the cached files, not counting their metadata
+func (c *Cache) files() []cachedFile {
+	var files []cachedFile
+	filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".json") || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, cachedFile{path: p, size: info.Size(), used: info.ModTime()})
+		}
+		return nil
+	})
+	return files
+}
+
+// evict removes the least recently used files until the cache fits in its
+// limit
+func (c *Cache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer func() { c.bytes.Set(float64(c.size)) }()
+	if c.maxBytes <= 0 || c.size <= c.maxBytes {
+		return
+	}
+
+	files := c.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	for _, f := range files {
+		if c.size <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			continue
+		}
+		os.Remove(f.path + ".json")
+		c.size -= f.size
+		c.logger.Debugf("Evicted %s from the cache", filepath.Base(f.path))
+	}
+}
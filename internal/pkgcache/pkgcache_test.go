@@ -0,0 +1,111 @@
+package pkgcache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testRegistry mirrors an upstream serving packages under /pkg/ and an
+// index listing them at /index.json
+func testRegistry(t *testing.T) (upstream *httptest.Server, requests *atomic.Int32) {
+	requests = new(atomic.Int32)
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch {
+		case r.URL.Path == "/index.json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"tarball": "`+upstream.URL+`/pkg/a.tgz"}`)
+		case strings.HasPrefix(r.URL.Path, "/pkg/"):
+			io.WriteString(w, strings.Repeat("x", 1000))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	registries := Registries
+	Registries = []Registry{{"/test/", upstream.URL + "/", func(rel string) bool { return rel == "index.json" }}}
+	t.Cleanup(func() { Registries = registries })
+	return upstream, requests
+}
+
+func get(t *testing.T, c *Cache, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "http://192.168.100.1:3142"+path, nil)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCache(t *testing.T) {
+	upstream, requests := testRegistry(t)
+	c, err := New(t.TempDir(), 2500, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	// Indexes point at the cache instead of the upstream
+	rec := get(t, c, "/test/index.json")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"tarball": "http://192.168.100.1:3142/test/pkg/a.tgz"}` {
+		t.Fatalf("Expected a rewritten index, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for range 2 {
+		if rec := get(t, c, "/test/pkg/a.tgz"); rec.Code != http.StatusOK || rec.Body.Len() != 1000 {
+			t.Fatalf("Expected the package, got %d: %d bytes", rec.Code, rec.Body.Len())
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected the package to be downloaded once, got %d upstream requests", n)
+	}
+
+	if rec := get(t, c, "/test/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected upstream 404s to be passed on, got %d", rec.Code)
+	}
+	if rec := get(t, c, "/other/a.tgz"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected paths outside registries to be refused, got %d", rec.Code)
+	}
+
+	// Old indexes are served stale while the upstream is down
+	key := cacheKey(upstream.URL+"/index.json", "")
+	meta, _ := json.Marshal(entry{ContentType: "application/json", Fetched: time.Now().Add(-2 * IndexTTL)})
+	os.WriteFile(c.path(key)+".json", meta, 0644)
+	upstream.Close()
+	if rec := get(t, c, "/test/index.json"); rec.Code != http.StatusOK {
+		t.Errorf("Expected a stale index while the upstream is down, got %d", rec.Code)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	_, requests := testRegistry(t)
+	c, err := New(t.TempDir(), 2500, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	get(t, c, "/test/pkg/a.tgz")
+	time.Sleep(10 * time.Millisecond)
+	get(t, c, "/test/pkg/b.tgz")
+	time.Sleep(10 * time.Millisecond)
+	get(t, c, "/test/pkg/a.tgz") // Used after b.tgz, so b.tgz goes first
+	get(t, c, "/test/pkg/c.tgz")
+	if c.size > 2500 {
+		t.Errorf("Expected the cache to fit in its limit, got %d bytes", c.size)
+	}
+
+	requests.Store(0)
+	get(t, c, "/test/pkg/a.tgz")
+	get(t, c, "/test/pkg/b.tgz")
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected only the least recently used package to be evicted, got %d downloads", n)
+	}
+}
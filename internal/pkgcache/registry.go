@@ -0,0 +1,224 @@
+package pkgcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// DockerHub is the registry that images without a registry in their name,
+// like "alpine" or "library/alpine", are pulled from
+const DockerHub = "https://registry-1.docker.io"
+
+var (
+	registryRequests = metrics.NewCounterVec(
+		"sshhv_registry_cache_requests_total",
+		"Requests to the container registry cache, by result (hit, miss, stale, or error).",
+		"result",
+	)
+	registryBytes = metrics.NewGauge(
+		"sshhv_registry_cache_bytes",
+		"Size of the manifests and layers in the container registry cache.",
+	)
+)
+
+// registryPath matches the manifest and blob paths of the OCI distribution
+// API, like /v2/library/alpine/manifests/latest
+var registryPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/([^/]+)$`)
+
+// token is a bearer token for pulling from a repository
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// RegistryMirror is a pull-through cache of a container registry, served
+// with the OCI distribution API that Docker and Podman use for mirrors. Tags
+// are looked up again after IndexTTL, while manifests and layers by digest
+// are kept until evicted. Pushes aren't supported.
+type RegistryMirror struct {
+	cache    *Cache
+	upstream string
+
+	mu     sync.Mutex
+	tokens map[string]token // By scope, like "repository:library/alpine:pull"
+}
+
+// NewRegistryMirror returns a mirror of the registry at upstream, like
+// DockerHub, cached in dir up to maxBytes (0 = unlimited)
+func NewRegistryMirror(dir string, maxBytes int64, upstream string, logger logrus.FieldLogger) (*RegistryMirror, error) {
+	cache, err := newCache(dir, maxBytes, logger, registryRequests, registryBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistryMirror{cache: cache, upstream: upstream, tokens: make(map[string]token)}, nil
+}
+
+// ServeHTTP serves a manifest or blob from the cache, pulling it from the
+// upstream first if needed
+func (m *RegistryMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "the registry cache is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+	match := registryPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name, kind, ref := match[1], match[2], match[3]
+
+	upstream := m.upstream + r.URL.Path
+	var accept string
+	if kind == "manifests" {
+		// Clients list the manifest types they support, and the registry
+		// picks the best one
+		accept = strings.Join(r.Header.Values("Accept"), ", ")
+	}
+	req := request{
+		key:      cacheKey(upstream, accept),
+		upstream: upstream,
+		index:    true,
+		fetch:    func() (*http.Response, error) { return m.fetch(name, upstream, accept) },
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		// Content by digest never changes, and layers shared by images are
+		// only kept once
+		req.key, req.index, req.digest = cacheKey(ref, ""), false, ref
+	}
+	meta, err := m.cache.get(req)
+	if err != nil {
+		m.cache.fail(w, req, err)
+		return
+	}
+	if digest := meta.Digest; digest != "" || req.digest != "" {
+		if digest == "" {
+			digest = req.digest
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	}
+	m.cache.serve(w, r, req.key, meta, "")
+}
+
+// fetch requests a path from the upstream, getting an anonymous token to
+// pull from the repository first if the registry asks for one
+func (m *RegistryMirror) fetch(name, upstream, accept string) (*http.Response, error) {
+	scope := "repository:" + name + ":pull"
+	do := func(bearer string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, upstream, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return m.cache.client.Do(req)
+	}
+
+	m.mu.Lock()
+	cached := m.tokens[scope]
+	m.mu.Unlock()
+	if time.Now().After(cached.expires) {
+		cached.value = ""
+	}
+	resp, err := do(cached.value)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	bearer, err := m.authorize(challenge, scope)
+	if err != nil {
+		return nil, err
+	}
+	return do(bearer)
+}
+
+// authorize gets an anonymous token from the auth server of a bearer
+// challenge, like Docker Hub's, and keeps it until it expires
+func (m *RegistryMirror) authorize(challenge, scope string) (string, error) {
+	params := parseChallenge(challenge)
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry asked for unsupported authentication %q", challenge)
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	resp, err := m.cache.client.Get(realm.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.ExpiresIn == 0 {
+		body.ExpiresIn = 60 // The default of the token specification
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Renew tokens a little early, so they don't expire on their way
+	m.tokens[scope] = token{value: body.Token, expires: time.Now().Add(time.Duration(body.ExpiresIn-10) * time.Second)}
+	return body.Token, nil
+}
+
+// parseChallenge returns the parameters of a bearer challenge, like
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+// or nil for another scheme
+func parseChallenge(header string) map[string]string {
+	scheme, rest, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if quoted, ok := strings.CutPrefix(after, `"`); ok {
+			value, rest, _ = strings.Cut(quoted, `"`)
+			rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return params
+}
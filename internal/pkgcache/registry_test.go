@@ -0,0 +1,96 @@
+package pkgcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRegistryMirror(t *testing.T) {
+	layer := "layer contents"
+	sum := sha256.Sum256([]byte(layer))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	var pulls atomic.Int32
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:library/alpine:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"token": "secret", "expires_in": 300}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+upstream.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pulls.Add(1)
+		switch r.URL.Path {
+		case "/v2/library/alpine/manifests/latest":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", "sha256:abc")
+			io.WriteString(w, `{"layers": []}`)
+		case "/v2/library/alpine/blobs/" + digest:
+			io.WriteString(w, layer)
+		case "/v2/library/alpine/blobs/sha256:0000":
+			io.WriteString(w, "tampered")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	m, err := NewRegistryMirror(t.TempDir(), 0, upstream.URL, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+	pull := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := pull("GET", "/v2/"); rec.Code != http.StatusOK || rec.Header().Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Errorf("Expected the API version check to succeed, got %d", rec.Code)
+	}
+	for range 2 {
+		rec := pull("HEAD", "/v2/library/alpine/manifests/latest")
+		if rec.Code != http.StatusOK || rec.Header().Get("Docker-Content-Digest") != "sha256:abc" {
+			t.Fatalf("Expected the manifest with its digest, got %d: %v", rec.Code, rec.Header())
+		}
+		if rec := pull("GET", "/v2/library/alpine/blobs/"+digest); rec.Code != http.StatusOK || rec.Body.String() != layer {
+			t.Fatalf("Expected the layer, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if n := pulls.Load(); n != 2 {
+		t.Errorf("Expected the manifest and layer to be pulled once each, got %d pulls", n)
+	}
+
+	if rec := pull("GET", "/v2/library/alpine/blobs/sha256:0000"); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected a blob not matching its digest to be refused, got %d", rec.Code)
+	}
+	if rec := pull("PUT", "/v2/library/alpine/manifests/latest"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected pushes to be refused, got %d", rec.Code)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:a:pull,push"`)
+	if params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:a:pull,push" {
+		t.Errorf("Unexpected challenge parameters: %v", params)
+	}
+	if params := parseChallenge(`Basic realm="registry"`); params != nil {
+		t.Errorf("Expected no parameters for basic authentication, got %v", params)
+	}
+}
@@ -0,0 +1,143 @@
+// Package scheduler runs jobs on cron schedules, like tearing down the VMs
+// of a workshop when it ends.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with the five standard fields:
+// minute, hour, day of month, month, and day of week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // Bitsets of matching values
+
+	// As in cron, when both day fields are restricted, a day matches if
+	// either of them does
+	domAny, dowAny bool
+}
+
+// cronFields are the bounds of each field of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // Both 0 and 7 are Sunday
+}
+
+// Parse parses a cron expression like "0 18 * * 1-5" or "*/15 * * * *".
+// Each field is "*", a number, a range "a-b", or a list of them separated by
+// commas, and "*" or a range may be followed by a step like "/15".
+func Parse(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", spec)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %w", cronFields[i].name, spec, err)
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseField returns the bitset of values a cron field matches
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, term := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(term, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loText); err != nil {
+				return 0, fmt.Errorf("invalid value %q", term)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiText); err != nil {
+					return 0, fmt.Errorf("invalid value %q", term)
+				}
+			} else if hasStep {
+				return 0, fmt.Errorf("step needs * or a range in %q", term)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", term, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Matches reports whether the schedule fires in the minute of t
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Job is a function run whenever its schedule fires
+type Job struct {
+	Schedule *Schedule
+	Run      func(now time.Time)
+}
+
+// Run runs the jobs in the server's local time zone until ctx is done.
+// Jobs due in the same minute run one after another, in order.
+func Run(ctx context.Context, jobs []Job) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		for _, job := range jobs {
+			if job.Schedule.Matches(next) {
+				job.Run(next)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAndMatch(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatalf("Failed to parse time: %v", err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		spec  string
+		time  string
+		match bool
+	}{
+		{"0 18 * * *", "2024-06-03 18:00", true},
+		{"0 18 * * *", "2024-06-03 18:01", false},
+		{"*/15 * * * *", "2024-06-03 09:45", true},
+		{"*/15 * * * *", "2024-06-03 09:46", false},
+		{"0 9-17/4 * * *", "2024-06-03 13:00", true},
+		{"0 9-17/4 * * *", "2024-06-03 15:00", false},
+		{"30 3 * * 1-5", "2024-06-03 03:30", true},  // Monday
+		{"30 3 * * 1-5", "2024-06-02 03:30", false}, // Sunday
+		{"0 0 * * 7", "2024-06-02 00:00", true},     // 7 is Sunday too
+		{"0 0 1,15 * *", "2024-06-15 00:00", true},
+		{"0 0 1 * 1", "2024-06-03 00:00", true}, // Either day field matches
+		{"0 0 1 * 1", "2024-06-04 00:00", false},
+		{"0 0 * 12 *", "2024-06-03 00:00", false},
+	}
+	for _, tt := range tests {
+		schedule, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.spec, err)
+		}
+		if got := schedule.Matches(at(tt.time)); got != tt.match {
+			t.Errorf("%q at %s: expected %v, got %v", tt.spec, tt.time, tt.match, got)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5/2 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Expected error for schedule %q", bad)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// Names of the access lists
+const (
+	listBan   = "ban"   // Users and keys refused a VM
+	listAllow = "allow" // When not empty, the only users and keys given a VM
+)
+
+// AccessEntry bans or allows a username or a public key, given by its
+// SHA256 fingerprint
+type AccessEntry struct {
+	List    string    `json:"list"`
+	User    string    `json:"user,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // Zero for entries that never expire
+}
+
+// expired reports whether an entry no longer applies at now
+func (e AccessEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// matches reports whether an entry applies to a user or key fingerprint
+func (e AccessEntry) matches(user, key string) bool {
+	return (e.User != "" && e.User == user) || (e.Key != "" && e.Key == key)
+}
+
+// AccessLists are the ban and allow lists, kept in access.json in the data
+// directory so operators can manage them while the server runs
+type AccessLists struct {
+	mu       sync.Mutex
+	entries  []AccessEntry
+	dataFile string
+}
+
+// NewAccessLists creates access lists stored in dataDir
+func NewAccessLists(dataDir string) *AccessLists {
+	return &AccessLists{dataFile: filepath.Join(dataDir, "access.json")}
+}
+
+// Load reads the access lists from disk
+func (a *AccessLists) Load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	data, err := os.ReadFile(a.dataFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &a.entries)
+}
+
+// save writes the unexpired entries to disk. The caller must hold a.mu.
+func (a *AccessLists) save() error {
+	now := time.Now()
+	entries := make([]AccessEntry, 0, len(a.entries))
+	for _, e := range a.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	a.entries = entries
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.dataFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.dataFile)
+}
+
+// Entries returns the unexpired entries of both lists
+func (a *AccessLists) Entries() []AccessEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	entries := []AccessEntry{}
+	for _, e := range a.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Add adds an entry, replacing any entry for the same user or key in the
+// same list
+func (a *AccessLists) Add(entry AccessEntry) error {
+	if entry.List != listBan && entry.List != listAllow {
+		return fmt.Errorf("unknown list %q (expected %s or %s)", entry.List, listBan, listAllow)
+	}
+	if (entry.User == "") == (entry.Key == "") {
+		return fmt.Errorf("an entry needs either a user or a key")
+	}
+	if entry.Key != "" && !strings.HasPrefix(entry.Key, "SHA256:") {
+		return fmt.Errorf("keys are given by SHA256 fingerprint, like SHA256:...")
+	}
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removeLocked(entry.List, entry.User, entry.Key)
+	a.entries = append(a.entries, entry)
+	return a.save()
+}
+
+// Remove removes the entry for a user or key from a list, reporting whether
+// there was one
+func (a *AccessLists) Remove(list, user, key string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.removeLocked(list, user, key) {
+		return false, nil
+	}
+	return true, a.save()
+}
+
+// removeLocked removes matching entries. The caller must hold a.mu.
+func (a *AccessLists) removeLocked(list, user, key string) bool {
+	kept := a.entries[:0]
+	for _, e := range a.entries {
+		if e.List != list || e.User != user || e.Key != key {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(kept) < len(a.entries)
+	a.entries = kept
+	return removed
+}
+
+// Check returns errBanned if a user or key is banned, or errNotAllowed if
+// the allow list is in use and has neither of them. Bans take precedence.
+func (a *AccessLists) Check(user, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	allowList, allowed := false, false
+	for _, e := range a.entries {
+		if e.expired(now) {
+			continue
+		}
+		switch e.List {
+		case listBan:
+			if e.matches(user, key) {
+				if e.Reason != "" {
+					return fmt.Errorf("%w: %s", errBanned, e.Reason)
+				}
+				return errBanned
+			}
+		case listAllow:
+			allowList = true
+			allowed = allowed || e.matches(user, key)
+		}
+	}
+	if allowList && !allowed {
+		return errNotAllowed
+	}
+	return nil
+}
+
+// checkAccess checks a session's user and public key against the access
+// lists before a VM is provisioned for it
+func (s *Server) checkAccess(sess ssh.Session) error {
+	var fingerprint string
+	if key := sess.PublicKey(); key != nil {
+		fingerprint = cryptoSSH.FingerprintSHA256(key)
+	}
+	return s.access.Check(sess.User(), fingerprint)
+}
+
+// handleListAccess returns the entries of the access lists
+func (s *Server) handleListAccess(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.access.Entries())
+}
+
+// handleAddAccess adds an entry to an access list from a JSON body
+func (s *Server) handleAddAccess(w http.ResponseWriter, r *http.Request) {
+	var entry AccessEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("expected a JSON access entry: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry.Created = time.Time{}
+	if err := s.access.Add(entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Warnf("Added %s%s to the %s list from %s (reason: %q, expires: %v)", entry.User, entry.Key, entry.List, r.RemoteAddr, entry.Reason, entry.Expires)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleRemoveAccess removes the entry for ?user= or ?key= from a list
+func (s *Server) handleRemoveAccess(w http.ResponseWriter, r *http.Request) {
+	list, user, key := r.PathValue("list"), r.URL.Query().Get("user"), r.URL.Query().Get("key")
+	removed, err := s.access.Remove(list, user, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, fmt.Sprintf("no entry for %s%s in the %s list", user, key, list), http.StatusNotFound)
+		return
+	}
+	s.logger.Warnf("Removed %s%s from the %s list from %s", user, key, list, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal/shell"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// attachPrefix marks the SSH username of an administrator attaching to
+// another user's VM, as in "ssh attach+alice@host"
+const attachPrefix = "attach+"
+
+// attachNotifyTimeout bounds telling the VM's users that an admin attached
+const attachNotifyTimeout = 10 * time.Second
+
+// adminContextKey holds the fingerprint of the admin key a session
+// authenticated with
+type adminContextKey struct{}
+
+// attachTarget returns the user whose VM an SSH username attaches to, and
+// whether it is an admin attach
+func attachTarget(user string) (string, bool) {
+	if target, ok := strings.CutPrefix(user, attachPrefix); ok {
+		return target, true
+	}
+	return user, false
+}
+
+// authorizeAdmin records whether a key may attach to other users' VMs. The
+// admin keys are reread for every attempt, so revoking a key takes effect
+// without a restart.
+func (s *Server) authorizeAdmin(ctx ssh.Context, key ssh.PublicKey) bool {
+	if s.config.AdminKeys == "" {
+		return false
+	}
+	keys, err := loadAdminKeys(s.config.AdminKeys)
+	if err != nil {
+		s.logger.Errorf("Failed to load admin keys: %v", err)
+		return false
+	}
+	for _, admin := range keys {
+		if bytes.Equal(admin.Marshal(), key.Marshal()) {
+			ctx.SetValue(adminContextKey{}, cryptoSSH.FingerprintSHA256(key))
+			return true
+		}
+	}
+	s.logger.Warnf("Refused admin attach as %s from %s with key %s", ctx.User(), ctx.RemoteAddr(), cryptoSSH.FingerprintSHA256(key))
+	return false
+}
+
+// loadAdminKeys reads admin public keys from a file in authorized_keys format
+func loadAdminKeys(path string) ([]cryptoSSH.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin keys: %w", err)
+	}
+
+	var keys []cryptoSSH.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := cryptoSSH.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse admin keys in %s: %w", path, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// notifyAttach tells everyone logged in to a VM that an admin attached
+func (s *Server) notifyAttach(testVM *vm.VM, admin string) {
+	ctx, cancel := context.WithTimeout(context.Background(), attachNotifyTimeout)
+	defer cancel()
+	message := fmt.Sprintf("An administrator (%s) has attached to this VM to help debug it.", admin)
+	if _, err := testVM.RunCommand(ctx, "wall "+shell.Quote(message)); err != nil {
+		s.logger.Warnf("Failed to notify users of VM %s about admin attach: %v", testVM.ID, err)
+	}
+}
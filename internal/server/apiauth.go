@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scopes of API credentials
+const (
+	scopeRead  = "read"  // GET requests only, like listing VMs and metrics
+	scopeAdmin = "admin" // Everything, including bans, scheduling, and resizing
+)
+
+// noToken stands for the token of credentials that only match client
+// certificates
+const noToken = "-"
+
+// apiCredential is a client allowed to use the HTTP API, identified by a
+// bearer token or by the common name of its client certificate
+type apiCredential struct {
+	name  string
+	scope string
+	token string
+}
+
+// loadAPICredentials reads a file of "NAME SCOPE TOKEN" lines. Blank lines
+// and lines starting with # are ignored.
+func loadAPICredentials(path string) ([]apiCredential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %w", err)
+	}
+
+	var creds []apiCredential
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected NAME SCOPE TOKEN", path, n)
+		}
+		if fields[1] != scopeRead && fields[1] != scopeAdmin {
+			return nil, fmt.Errorf("%s:%d: scope of %s must be %s or %s", path, n, fields[0], scopeRead, scopeAdmin)
+		}
+		creds = append(creds, apiCredential{name: fields[0], scope: fields[1], token: fields[2]})
+	}
+	return creds, nil
+}
+
+// apiProtected reports whether a path needs credentials. Health checks and
+// the activity feeds stay open for load balancers and websites.
+func apiProtected(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+// apiCaller returns the name and scope of the client making a request, from
+// its bearer token or its verified client certificate. The tokens file is
+// reread for every request, so tokens can be revoked without a restart.
+func (s *Server) apiCaller(r *http.Request) (name, scope string, ok bool) {
+	var cn string
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if s.config.APITokens == "" {
+			return cn, scopeAdmin, true // The CA vouches for every certificate
+		}
+	}
+	if s.config.APITokens == "" {
+		return "", "", false
+	}
+	creds, err := loadAPICredentials(s.config.APITokens)
+	if err != nil {
+		s.logger.Errorf("Failed to load API tokens: %v", err)
+		return "", "", false
+	}
+
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, cred := range creds {
+		if hasToken && cred.token != noToken && subtle.ConstantTimeCompare([]byte(token), []byte(cred.token)) == 1 {
+			return cred.name, cred.scope, true
+		}
+		if cn != "" && cred.name == cn {
+			return cred.name, cred.scope, true
+		}
+	}
+	return "", "", false
+}
+
+// apiAuth requires credentials for the API and metrics when tokens or
+// client certificates are configured, and admin scope for requests that
+// change anything
+func (s *Server) apiAuth(next http.Handler) http.Handler {
+	if s.config.APITokens == "" && s.config.HTTPClientCA == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiProtected(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, scope, ok := s.apiCaller(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ssh-hypervisor"`)
+			http.Error(w, "missing or unknown API token", http.StatusUnauthorized)
+			return
+		}
+		if scope != scopeAdmin && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.logger.Warnf("Refused HTTP %s %s from %s, whose token %s is read-only", r.Method, r.URL.Path, r.RemoteAddr, name)
+			http.Error(w, "token is read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// Reasons given to clients whose authentication is refused
+const (
+	refusedAttach = "Attaching to another user's VM requires an admin key."
+	refusedTOTP   = "Verification failed."
+)
+
+// errAuthRefused is returned for key and password logins that are refused
+var errAuthRefused = errors.New("permission denied")
+
+// publicKeyExtension is the permissions extension where the SSH library looks
+// for the key a connection logged in with, which sessions report as their
+// PublicKey
+const publicKeyExtension = "gliderlabs/ssh.PublicKey"
+
+// Authenticator decides who may log in, for programs that embed the server
+// with their own accounts. It is asked about every key and password login
+// after the server's own checks pass, including those of users who then
+// answer prompts, and only logins it accepts get a VM.
+type Authenticator interface {
+	AuthorizeKey(user string, remote net.Addr, key cryptoSSH.PublicKey) bool
+	AuthorizePassword(user string, remote net.Addr, password string) bool
+}
+
+// SetAuthenticator makes logins also need a's approval. It must be called
+// before Run.
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.auth = a
+}
+
+// Manager returns the manager of the server's VMs
+func (s *Server) Manager() *vm.Manager {
+	return s.vmManager
+}
+
+// authorizeKey checks a public key login against the server's Authenticator
+func (s *Server) authorizeKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	return s.auth == nil || s.auth.AuthorizeKey(ctx.User(), ctx.RemoteAddr(), key)
+}
+
+// authorizePassword checks a password login against the server's Authenticator
+func (s *Server) authorizePassword(ctx ssh.Context, password string) bool {
+	return s.auth == nil || s.auth.AuthorizePassword(ctx.User(), ctx.RemoteAddr(), password)
+}
+
+// publicKeyCallback checks a connection's public key logins. Admins attaching
+// to a VM need an admin key, and everyone else gets partial success while
+// they have prompts pending.
+func (s *Server) publicKeyCallback(ctx ssh.Context) func(cryptoSSH.ConnMetadata, cryptoSSH.PublicKey) (*cryptoSSH.Permissions, error) {
+	return func(conn cryptoSSH.ConnMetadata, key cryptoSSH.PublicKey) (*cryptoSSH.Permissions, error) {
+		setConnMetadata(ctx, conn)
+		if !s.keyStrongEnough(key) {
+			return nil, errAuthRefused
+		}
+		perms := &cryptoSSH.Permissions{Extensions: map[string]string{
+			publicKeyExtension: base64.StdEncoding.EncodeToString(key.Marshal()),
+		}}
+		if _, attach := attachTarget(conn.User()); attach {
+			if !s.authorizeAdmin(ctx, key) || !s.authorizeKey(ctx, key) {
+				return nil, errAuthRefused
+			}
+			return perms, nil
+		}
+		if !s.authorizeKey(ctx, key) {
+			return nil, errAuthRefused
+		}
+		return s.afterFirstFactor(ctx, perms)
+	}
+}
+
+// passwordCallback checks a connection's password logins, which admins
+// attaching to a VM can't use
+func (s *Server) passwordCallback(ctx ssh.Context) func(cryptoSSH.ConnMetadata, []byte) (*cryptoSSH.Permissions, error) {
+	return func(conn cryptoSSH.ConnMetadata, password []byte) (*cryptoSSH.Permissions, error) {
+		setConnMetadata(ctx, conn)
+		if _, attach := attachTarget(conn.User()); attach || !s.authorizePassword(ctx, string(password)) {
+			return nil, errAuthRefused
+		}
+		return s.afterFirstFactor(ctx, &cryptoSSH.Permissions{})
+	}
+}
+
+// afterFirstFactor logs in a user whose key or password was accepted, unless
+// they have prompts pending, like a TOTP code. Then the login only partially
+// succeeds, and the client must answer the prompts over keyboard-interactive
+// to get perms.
+func (s *Server) afterFirstFactor(ctx ssh.Context, perms *cryptoSSH.Permissions) (*cryptoSSH.Permissions, error) {
+	if !s.promptsPending(ctx.User()) {
+		return perms, nil
+	}
+	return nil, &cryptoSSH.PartialSuccessError{Next: cryptoSSH.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: func(conn cryptoSSH.ConnMetadata, challenger cryptoSSH.KeyboardInteractiveChallenge) (*cryptoSSH.Permissions, error) {
+			if err := s.runPrompts(ctx.User(), ctx.RemoteAddr(), challenger); err != nil {
+				s.refuse(challenger, err.Error())
+				return nil, err
+			}
+			return perms, nil
+		},
+	}}
+}
+
+// setConnMetadata records who is logging in on the context, which the SSH
+// library only does itself in the handlers it runs
+func setConnMetadata(ctx ssh.Context, conn cryptoSSH.ConnMetadata) {
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// authorizeInteractive handles keyboard-interactive authentication tried
+// before a key or password, which never logs anyone in. Admin attaches are
+// told why they can't log in, since clients otherwise only report
+// "permission denied".
+func (s *Server) authorizeInteractive(ctx ssh.Context, challenger cryptoSSH.KeyboardInteractiveChallenge) bool {
+	if _, attach := attachTarget(ctx.User()); attach {
+		s.refuse(challenger, refusedAttach)
+	}
+	return false
+}
+
+// refuse shows the client why its authentication failed, followed by the
+// configured auth banner
+func (s *Server) refuse(challenger cryptoSSH.KeyboardInteractiveChallenge, reason string) {
+	message := reason + "\n"
+	if s.config.AuthBanner != "" {
+		message += s.config.AuthBanner + "\n"
+	}
+	// A challenge without questions is only displayed
+	challenger("", message, nil, nil)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// bundleCommand is the command users run on the hypervisor, as in
+// "ssh alice@host bundle", to get their connection bundle without a VM
+const bundleCommand = "bundle"
+
+// bundleHostAlias is the Host name used in the bundle's SSH config stanza
+const bundleHostAlias = "ssh-hypervisor"
+
+// connectionBundle returns a user's SSH config stanza, known_hosts entries for
+// the hypervisor's host keys, and the ports published for their VM, ready to
+// paste into files or scripts
+func (s *Server) connectionBundle(sess ssh.Session) string {
+	user := sess.User()
+	host := s.publicHost(sess)
+	port := strconv.Itoa(s.config.Port)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# ssh-hypervisor connection bundle for %s\n\n", user)
+
+	fmt.Fprintf(&b, "# ~/.ssh/config\n")
+	fmt.Fprintf(&b, "Host %s\n", bundleHostAlias)
+	fmt.Fprintf(&b, "    HostName %s\n", host)
+	fmt.Fprintf(&b, "    Port %s\n", port)
+	fmt.Fprintf(&b, "    User %s\n", user)
+	fmt.Fprintf(&b, "    ServerAliveInterval 30\n\n")
+
+	fmt.Fprintf(&b, "# ~/.ssh/known_hosts\n")
+	if server, ok := sess.Context().Value(ssh.ContextKeyServer).(*ssh.Server); ok {
+		address := knownhosts.Normalize(net.JoinHostPort(host, port))
+		for _, signer := range server.HostSigners {
+			fmt.Fprintf(&b, "%s\n", knownhosts.Line([]string{address}, signer.PublicKey()))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n# Published ports and endpoints\n")
+	fmt.Fprintf(&b, "ssh %s:%s\n", host, port)
+	if s.config.WebSocketPort != 0 {
+		scheme := "ws"
+		if s.config.WebSocketCert != "" {
+			scheme = "wss"
+		}
+		fmt.Fprintf(&b, "websocket %s://%s\n", scheme, net.JoinHostPort(host, strconv.Itoa(s.config.WebSocketPort)))
+	}
+	if s.config.MoshPorts != "" {
+		if testVM, ok := s.vmManager.GetVM(user); ok && testVM.MoshPorts != (vm.PortRange{}) {
+			fmt.Fprintf(&b, "mosh udp/%s (mosh -p %s --ssh=\"ssh -p %s\" %s@%s)\n", testVM.MoshPorts, testVM.MoshPorts, port, user, host)
+		} else {
+			fmt.Fprintf(&b, "mosh udp ports are assigned when your VM starts\n")
+		}
+	}
+	return b.String()
+}
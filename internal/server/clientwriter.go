@@ -0,0 +1,167 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+)
+
+// maxClientBuffer is how much output waits for a client before writers wait
+// too, which slows a VM's output down to the speed of its client's link
+const maxClientBuffer = 256 << 10
+
+// maxClientChunk is the most written to a client at once
+const maxClientChunk = 32 << 10
+
+var stalledClients = metrics.NewCounter(
+	"sshhv_stalled_clients_total",
+	"Number of sessions closed because their client stopped reading output.",
+)
+
+// clientWriter buffers output to an SSH client and writes it from its own
+// goroutine, at up to rate bytes per second, so provisioning and the proxy
+// never wait on a slow link. A client that reads nothing for stall has its
+// session closed, which fails the writes waiting on it.
+type clientWriter struct {
+	w       io.Writer
+	rate    int           // Bytes per second (0 = unlimited)
+	stall   time.Duration // 0 = wait on the client forever
+	onStall func()
+	next    time.Time // When the rate allows the next write, used by the writing goroutine
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signaled when output is buffered or written, or the writer fails or closes
+	buf     []byte
+	err     error
+	closing bool
+	done    chan struct{} // Closed when the writing goroutine exits
+}
+
+// newClientWriter starts writing output buffered for a client to w, calling
+// onStall if the client reads nothing for stall
+func newClientWriter(w io.Writer, rate int, stall time.Duration, onStall func()) *clientWriter {
+	c := &clientWriter{w: w, rate: rate, stall: stall, onStall: onStall, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// sessionWriter returns a client writer of a session's output to w, which is
+// the session or its stderr, closing the session if its client stalls
+func (s *Server) sessionWriter(sess ssh.Session, w io.Writer) *clientWriter {
+	stall := s.config.ClientStall
+	return newClientWriter(w, s.config.ClientRate*1024, stall, func() {
+		stalledClients.Inc()
+		s.logger.Warnf("Closing session of user %s, whose client read none of its output for %s", sess.User(), stall)
+		sess.Close()
+	})
+}
+
+// Write buffers p for the client, waiting only while the buffer is full
+func (c *clientWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Writes larger than the buffer go in whole once it is empty
+	for c.err == nil && !c.closing && len(c.buf) > 0 && len(c.buf)+len(p) > maxClientBuffer {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closing {
+		return 0, io.ErrClosedPipe
+	}
+	c.buf = append(c.buf, p...)
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+// Buffered returns how many bytes are waiting for the client
+func (c *clientWriter) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf)
+}
+
+// Close writes what is buffered, then stops the writing goroutine. It must
+// be called before the session ends, or the buffered output is lost.
+func (c *clientWriter) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+// run writes buffered output to the client until the writer closes or a
+// write fails
+func (c *clientWriter) run() {
+	defer close(c.done)
+	for {
+		c.mu.Lock()
+		for len(c.buf) == 0 && !c.closing {
+			c.cond.Wait()
+		}
+		if len(c.buf) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		// Writes only append to the buffer, so the chunk stays as it is
+		chunk := c.buf[:min(len(c.buf), c.chunkSize())]
+		c.mu.Unlock()
+
+		err := c.write(chunk)
+
+		c.mu.Lock()
+		c.buf = c.buf[len(chunk):]
+		if err != nil {
+			c.err, c.buf = err, nil
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+		c.throttle(len(chunk))
+	}
+}
+
+// chunkSize returns the most written to the client at once, a tenth of a
+// second's worth when the rate is limited, so output flows evenly
+func (c *clientWriter) chunkSize() int {
+	if c.rate > 0 {
+		return min(max(c.rate/10, 1), maxClientChunk)
+	}
+	return maxClientChunk
+}
+
+// write writes p to the client, calling onStall if that takes longer than
+// the stall timeout
+func (c *clientWriter) write(p []byte) error {
+	if c.stall > 0 {
+		timer := time.AfterFunc(c.stall, c.onStall)
+		defer timer.Stop()
+	}
+	_, err := c.w.Write(p)
+	return err
+}
+
+// throttle waits until n more bytes fit in the rate, letting output that
+// was idle burst for up to a second
+func (c *clientWriter) throttle(n int) {
+	if c.rate <= 0 {
+		return
+	}
+	now := time.Now()
+	if earliest := now.Add(-time.Second); c.next.Before(earliest) {
+		c.next = earliest
+	}
+	c.next = c.next.Add(time.Duration(n) * time.Second / time.Duration(c.rate))
+	if wait := c.next.Sub(now); wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/cluster"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// Scheduled VMs are held for their user for defaultScheduleHold, or the
+// request's hold parameter up to maxScheduleHold
+const (
+	defaultScheduleHold = 2 * time.Minute
+	maxScheduleHold     = time.Hour
+)
+
+// scheduleTimeout bounds booting a VM for a scheduled request
+const scheduleTimeout = 2 * time.Minute
+
+// nodeStatus reports this node's capacity to the coordinator
+func (s *Server) nodeStatus() cluster.NodeStatus {
+	status := cluster.NodeStatus{
+		Node:     s.config.NodeName,
+		SSHAddr:  s.config.AdvertiseAddr,
+		Capacity: s.config.MaxConcurrentVMs,
+		Active:   s.vmManager.GetActiveVMCount(),
+	}
+	_, status.Maintenance = s.maintenance()
+	if status.SSHAddr == "" {
+		status.SSHAddr = s.advertise(fmt.Sprintf(":%d", s.config.Port))
+	}
+	if s.config.HTTPAddr != "" {
+		status.HTTPAddr = s.advertise(s.config.HTTPAddr)
+	}
+	return status
+}
+
+// advertise fills in a missing or unspecified host in a listen address with
+// the node's name, so the coordinator can reach it
+func (s *Server) advertise(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = s.config.NodeName
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// handleScheduleVM boots a user's VM ahead of their SSH session, which the
+// coordinator then routes to this node. The VM is held for a while so the
+// session finds it running.
+func (s *Server) handleScheduleVM(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	hold := defaultScheduleHold
+	if h := r.URL.Query().Get("hold"); h != "" {
+		d, err := time.ParseDuration(h)
+		if err != nil || d <= 0 || d > maxScheduleHold {
+			http.Error(w, fmt.Sprintf("hold must be a duration up to %s", maxScheduleHold), http.StatusBadRequest)
+			return
+		}
+		hold = d
+	}
+	labels, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	testVM, err := s.scheduleVM(user, labels)
+	if err != nil {
+		reason := failureReason(err)
+		provisionFailures.Inc(reason)
+		s.logger.Errorf("Failed to schedule VM for user %s (%s): %v", user, reason, err)
+		status := http.StatusInternalServerError
+		switch reason {
+		case "quota", "traffic_quota":
+			status = http.StatusTooManyRequests
+		case "capacity", "ip_exhausted", "disk_full", "maintenance":
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	events := s.vmManager.Events()
+	events.Record(testVM.ID, vm.EventSessionAttached, fmt.Sprintf("scheduled by %s for %s", r.RemoteAddr, hold))
+	time.AfterFunc(hold, func() {
+		events.Record(testVM.ID, vm.EventSessionDetached, "scheduled hold expired")
+		s.releaseVM(testVM)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":   testVM.ID,
+		"node": s.config.NodeName,
+		"hold": hold.String(),
+	})
+}
+
+// scheduleVM gets a ready VM for a user with extra labels, holding a
+// reference to it
+func (s *Server) scheduleVM(user string, labels map[string]string) (*vm.VM, error) {
+	if err := s.checkMaintenance(user); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(user); err != nil {
+		return nil, err
+	}
+	s.labelVM(user)
+	if err := s.vmManager.MergeLabels(user, labels); err != nil {
+		return nil, err
+	}
+	// The timeout only bounds the boot; the VM runs until it is released
+	ctx, cancel := context.WithTimeout(context.Background(), scheduleTimeout)
+	defer cancel()
+	testVM, err := s.getOrCreateVM(ctx, user, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.vmManager.WaitReady(ctx, testVM, nil); err != nil {
+		s.releaseVM(testVM)
+		return nil, err
+	}
+	return testVM, nil
+}
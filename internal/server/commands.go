@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// sessionCommand returns the program to launch in a user's VM instead of the
+// default shell, or "" for the shell. Per-user commands are reread for every
+// session, so operators can edit the file without restarting.
+func (s *Server) sessionCommand(user string) (string, error) {
+	if s.config.SessionCommands != "" {
+		commands, err := loadSessionCommands(s.config.SessionCommands)
+		if err != nil {
+			return "", err
+		}
+		if command, ok := commands[user]; ok {
+			return command, nil
+		}
+	}
+	return s.config.SessionCommand, nil
+}
+
+// clientCommand returns the command the client asked to run in its VM, or
+// "" for a shell. The debug command only asks for a shell with debug output.
+func clientCommand(sess ssh.Session) string {
+	if command := sess.RawCommand(); command != debugCommand {
+		return command
+	}
+	return ""
+}
+
+// loadSessionCommands reads a file of "USER COMMAND" lines, where blank lines
+// and lines starting with # are ignored
+func loadSessionCommands(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session commands: %w", err)
+	}
+
+	commands := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, command, ok := strings.Cut(line, " ")
+		command = strings.TrimSpace(command)
+		if !ok || command == "" {
+			return nil, fmt.Errorf("%s:%d: expected USER COMMAND", path, n)
+		}
+		commands[user] = command
+	}
+	return commands, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// debugCommand is the command users run, as in "ssh -t alice@host debug", to
+// connect as usual but see each provisioning step as it happens. Setting
+// debugEnv in the session, as with "ssh -o SetEnv=HV_DEBUG=1", does the same.
+const (
+	debugCommand = "debug"
+	debugEnv     = "HV_DEBUG"
+)
+
+// debugRequested reports whether a session asked for debug output
+func debugRequested(sess ssh.Session) bool {
+	if sess.RawCommand() == debugCommand {
+		return true
+	}
+	for _, env := range sess.Environ() {
+		if name, value, ok := strings.Cut(env, "="); ok && name == debugEnv {
+			on, err := strconv.ParseBool(value)
+			return err == nil && on
+		}
+	}
+	return false
+}
+
+// debugln prints a line of debug output, stamped with the time since the
+// session connected
+func debugln(out *terminal, elapsed time.Duration, message string) {
+	wish.Println(out, fmt.Sprintf("\r\033[2K\033[2;37m[debug %7.3fs] %s\033[0m", elapsed.Seconds(), message))
+}
+
+// debugProgress prints provisioning events with their details as they pass
+// through to the returned channel, until ctx is done
+func debugProgress(ctx context.Context, out *terminal, connectedAt time.Time, progress <-chan vm.ProgressEvent) <-chan vm.ProgressEvent {
+	forward := make(chan vm.ProgressEvent, cap(progress))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-progress:
+				message := fmt.Sprintf("%s (VM %s)", event.Stage, event.State)
+				if event.Detail != "" {
+					message += ": " + event.Detail
+				}
+				debugln(out, event.Time.Sub(connectedAt), message)
+				select {
+				case forward <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return forward
+}
+
+// debugVM prints how a VM that is ready for a session is set up
+func (s *Server) debugVM(out *terminal, connectedAt time.Time, v *vm.VM) {
+	message := fmt.Sprintf("VM %s ready: IP %s, gateway %s, %d MB, %d vCPUs", v.ID, v.IP, v.Gateway, s.vmManager.Memory(v.ID), v.VCPUs())
+	if image := s.vmManager.VMImage(v.ID); image != "" {
+		message += ", image " + image
+	}
+	if v.MoshPorts != (vm.PortRange{}) {
+		message += ", mosh ports " + v.MoshPorts.String()
+	}
+	debugln(out, time.Since(connectedAt), message)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+// The drop service lets programs in a VM hand results to its user: text is
+// copied to the clipboard of their terminals with OSC 52, and files are kept
+// in an outbox on the host for "ssh alice@host fetch NAME".
+const (
+	fetchCommand   = "fetch"
+	outboxDir      = "outbox"
+	maxClipboard   = 64 * 1024         // Terminals drop longer OSC 52 sequences
+	maxDropFile    = 100 * 1024 * 1024 // Largest file a VM can drop
+	maxOutboxFiles = 100
+)
+
+// attachSession records an interactive session on a VM, for the drop service
+// to reach. The returned function detaches it.
+func (s *Server) attachSession(vmID string, sess *terminal) func() {
+	s.attachedMu.Lock()
+	defer s.attachedMu.Unlock()
+	if s.attached[vmID] == nil {
+		s.attached[vmID] = make(map[*terminal]bool)
+	}
+	s.attached[vmID][sess] = true
+
+	return func() {
+		s.attachedMu.Lock()
+		defer s.attachedMu.Unlock()
+		delete(s.attached[vmID], sess)
+		if len(s.attached[vmID]) == 0 {
+			delete(s.attached, vmID)
+		}
+	}
+}
+
+// dropHandler returns the handler of the drop service. Requests are only
+// accepted from running VMs, which are identified by their source address.
+func (s *Server) dropHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /clipboard", func(w http.ResponseWriter, r *http.Request) {
+		vmID, ok := s.dropVM(w, r)
+		if !ok {
+			return
+		}
+		text, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxClipboard))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("clipboard text is limited to %d bytes", maxClipboard), http.StatusRequestEntityTooLarge)
+			return
+		}
+		sent := s.copyToClipboard(vmID, text)
+		if sent == 0 {
+			http.Error(w, "no terminal is attached to this VM", http.StatusConflict)
+			return
+		}
+		fmt.Fprintf(w, "copied to %d terminals\n", sent)
+	})
+	mux.HandleFunc("PUT /files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		vmID, ok := s.dropVM(w, r)
+		if !ok {
+			return
+		}
+		name := r.PathValue("name")
+		if err := s.saveDrop(vmID, name, http.MaxBytesReader(w, r.Body, maxDropFile)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Printf("VM %s dropped file %s", vmID, name)
+		fmt.Fprintf(w, "saved, fetch it with: ssh %s@HOST %s %s\n", vmID, fetchCommand, name)
+	})
+	return mux
+}
+
+// dropVM returns the ID of the VM a drop request came from, or responds
+// with 403 Forbidden if it isn't from a running VM
+func (s *Server) dropVM(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if vmID, ok := s.remoteVM(r); ok {
+		return vmID, true
+	}
+	http.Error(w, "only VMs can use the drop service", http.StatusForbidden)
+	return "", false
+}
+
+// remoteVM returns the ID of the running VM a request came from, by its
+// source address
+func (s *Server) remoteVM(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	testVM, ok := s.vmManager.VMByIP(net.ParseIP(host))
+	if !ok {
+		return "", false
+	}
+	return testVM.ID, true
+}
+
+// copyToClipboard sets the clipboard of the VM's attached terminals with an
+// OSC 52 escape sequence, returning how many terminals it was sent to
+func (s *Server) copyToClipboard(vmID string, text []byte) int {
+	osc52 := "\033]52;c;" + base64.StdEncoding.EncodeToString(text) + "\a"
+
+	s.attachedMu.Lock()
+	defer s.attachedMu.Unlock()
+	sent := 0
+	for sess := range s.attached[vmID] {
+		if _, _, isPty := sess.Pty(); isPty {
+			io.WriteString(sess.rawOut(), osc52)
+			sent++
+		}
+	}
+	return sent
+}
+
+// validDropName reports whether a file name is safe to keep in the outbox
+func validDropName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 255 && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// saveDrop writes a file dropped by a VM to its outbox, replacing any file
+// of the same name
+func (s *Server) saveDrop(vmID, name string, body io.Reader) error {
+	if !validDropName(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	dir := filepath.Join(s.vmManager.DataDir(), vmID, outboxDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) >= maxOutboxFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("outbox is full (%d files), fetch some first", maxOutboxFiles)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".drop-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("files are limited to %d MB", maxDropFile/(1024*1024))
+	} else if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// runFetchCommand lists the files in a user's outbox, or writes one of them
+// to the session and removes it
+func (s *Server) runFetchCommand(sess ssh.Session, user, name string) {
+	dir := filepath.Join(s.vmManager.DataDir(), user, outboxDir)
+	if name = strings.TrimSpace(name); name == "" {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && !strings.HasPrefix(entry.Name(), ".") {
+				wish.Println(sess, entry.Name()+"\t"+strconv.FormatInt(info.Size(), 10))
+			}
+		}
+		return
+	}
+
+	if !validDropName(name) {
+		wish.Errorln(sess, fmt.Sprintf("Invalid file name %q.", name))
+		sess.Exit(1)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		wish.Errorln(sess, fmt.Sprintf("No file named %q was dropped by your VM.", name))
+		sess.Exit(1)
+		return
+	}
+	defer f.Close()
+	if _, err := io.Copy(sess, f); err != nil {
+		s.logger.Errorf("Failed to send dropped file %s to user %s: %v", name, user, err)
+		sess.Exit(1)
+		return
+	}
+	os.Remove(f.Name())
+}
+
+// startGatewayListeners serves a service for VMs on the host's address in
+// each VM network, so it isn't reachable from outside. A failing listener
+// only disables the service, so errors are logged rather than stopping the
+// server.
+func (s *Server) startGatewayListeners(ctx context.Context, lc net.ListenConfig, name string, port int, handler http.Handler) (*http.Server, error) {
+	httpServer := &http.Server{Handler: handler}
+	for _, gateway := range s.vmManager.Gateways() {
+		addr := net.JoinHostPort(gateway.String(), strconv.Itoa(port))
+		ln, err := lc.Listen(ctx, "tcp", addr)
+		if err != nil {
+			httpServer.Close()
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		go func() {
+			s.logger.Printf("Starting %s on %s", name, addr)
+			if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				s.logger.Errorf("Failed to serve %s on %s: %v", name, addr, err)
+			}
+		}()
+	}
+	return httpServer, nil
+}
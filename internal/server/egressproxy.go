@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+)
+
+// egressProxyRequests counts requests VMs made through the egress proxy
+var egressProxyRequests = metrics.NewCounterVec(
+	"sshhv_egress_proxy_requests_total",
+	"Requests VMs made through the egress proxy, by result (allowed, denied, failed, or too_large).",
+	"result",
+)
+
+// hopHeaders are the headers of a single connection, which a proxy must not
+// pass on
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// egressProxy is an HTTP(S) forward proxy on the VM networks' gateways, so
+// VMs without Internet access can still reach allowed domains, like package
+// mirrors. HTTPS is tunneled with CONNECT to port 443 only.
+type egressProxy struct {
+	s         *Server
+	maxBytes  int64 // Largest response passed to a VM (0 = unlimited)
+	transport *http.Transport
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// egressProxyHandler returns the handler of the egress proxy. Requests are
+// only accepted from running VMs, which are identified by their source
+// address.
+func (s *Server) egressProxyHandler() http.Handler {
+	p := &egressProxy{s: s, maxBytes: int64(s.config.EgressProxyMaxMB) << 20, dial: s.dialBeyondHost}
+	p.transport = &http.Transport{
+		DialContext:           p.dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	}
+	return p
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vmID, ok := p.s.remoteVM(r)
+	if !ok {
+		egressProxyRequests.Inc("denied")
+		http.Error(w, "only VMs can use the egress proxy", http.StatusForbidden)
+		return
+	}
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			egressProxyRequests.Inc("denied")
+			http.Error(w, "only http:// URLs and CONNECT to port 443 are proxied", http.StatusBadRequest)
+			return
+		}
+		target = r.URL.Host
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, "80"
+	}
+	if r.Method == http.MethodConnect && port != "443" {
+		egressProxyRequests.Inc("denied")
+		http.Error(w, "only port 443 can be tunneled", http.StatusForbidden)
+		return
+	}
+	if !p.s.egressAllowed(host) {
+		egressProxyRequests.Inc("denied")
+		p.s.logger.Infof("Egress proxy refused %s for VM %s", target, vmID)
+		http.Error(w, fmt.Sprintf("%s is not on the egress allow list", host), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, vmID, net.JoinHostPort(host, port))
+	} else {
+		p.forward(w, r, vmID)
+	}
+}
+
+// tunnel connects a VM to an HTTPS server, cutting the connection off once
+// the server has sent the response size limit
+func (p *egressProxy) tunnel(w http.ResponseWriter, r *http.Request, vmID, target string) {
+	upstream, err := p.dial(r.Context(), "tcp", target)
+	if err != nil {
+		egressProxyRequests.Inc("failed")
+		http.Error(w, fmt.Sprintf("failed to connect to %s: %v", target, err), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		p.s.logger.Errorf("Failed to take over egress proxy connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	egressProxyRequests.Inc("allowed")
+	p.s.logger.Debugf("Egress proxy tunneling VM %s to %s", vmID, target)
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(upstream, buf)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	var from io.Reader = upstream
+	if p.maxBytes > 0 {
+		from = io.LimitReader(upstream, p.maxBytes)
+	}
+	if n, _ := io.Copy(conn, from); p.maxBytes > 0 && n == p.maxBytes {
+		egressProxyRequests.Inc("too_large")
+		p.s.logger.Infof("Egress proxy cut off VM %s's tunnel to %s at %d MB", vmID, target, p.s.config.EgressProxyMaxMB)
+	}
+}
+
+// forward makes a plain HTTP request for a VM and copies the response back,
+// up to the response size limit
+func (p *egressProxy) forward(w http.ResponseWriter, r *http.Request, vmID string) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		egressProxyRequests.Inc("failed")
+		http.Error(w, fmt.Sprintf("failed to reach %s: %v", r.URL.Host, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if p.maxBytes > 0 && resp.ContentLength > p.maxBytes {
+		egressProxyRequests.Inc("too_large")
+		p.s.logger.Infof("Egress proxy refused %s for VM %s, a response of %d bytes", r.URL, vmID, resp.ContentLength)
+		http.Error(w, fmt.Sprintf("responses are limited to %d MB", p.s.config.EgressProxyMaxMB), http.StatusBadGateway)
+		return
+	}
+	egressProxyRequests.Inc("allowed")
+	p.s.logger.Debugf("Egress proxy forwarded %s %s for VM %s", r.Method, r.URL, vmID)
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	var from io.Reader = resp.Body
+	if p.maxBytes > 0 {
+		from = io.LimitReader(resp.Body, p.maxBytes+1)
+	}
+	if n, _ := io.Copy(w, from); p.maxBytes > 0 && n > p.maxBytes {
+		// Without a length up front, end the response early so the VM
+		// doesn't take a truncated body as complete
+		egressProxyRequests.Inc("too_large")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// egressAllowed reports whether the egress proxy may reach a host. The
+// allow list is reread on every request, and a list that can't be read
+// allows nothing.
+func (s *Server) egressAllowed(host string) bool {
+	if s.config.EgressProxyAllow == "" {
+		return true
+	}
+	f, err := os.Open(s.config.EgressProxyAllow)
+	if err != nil {
+		s.logger.Errorf("Failed to read egress allow list: %v", err)
+		return false
+	}
+	defer f.Close()
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if domainMatches(strings.TrimSpace(scanner.Text()), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatches reports whether a host matches a line of the egress allow
+// list: a domain, or "*.example.com" for its subdomains. Blank lines and
+// comments starting with "#" match nothing.
+func domainMatches(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// dialBeyondHost dials for the egress proxy, refusing addresses of the host
+// and the VM networks, so VMs can't use it to reach services that only
+// listen for the host or to reach each other
+func (s *Server) dialBeyondHost(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || s.hostAddress(ip) {
+				return fmt.Errorf("%s is an address of the host", host)
+			}
+			return nil
+		},
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// hostAddress reports whether an IP address reaches the host itself or its
+// VMs rather than the Internet
+func (s *Server) hostAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	for _, cidr := range strings.Split(s.config.VMCIDR, ",") {
+		if _, network, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/wish"
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+var provisionFailures = metrics.NewCounterVec(
+	"sshhv_vm_provision_failures_total",
+	"Number of sessions that failed to get a running VM, by reason.",
+	"reason",
+)
+
+var vmExits = metrics.NewCounter(
+	"sshhv_vm_exits_total",
+	"Number of VMs whose Firecracker process exited without being stopped, like after a crash or a guest shutdown.",
+)
+
+// errQuotaExhausted is returned when a user has no VM time left this month
+var errQuotaExhausted = errors.New("monthly VM-hour quota exhausted")
+
+// errTrafficQuotaExhausted is returned when a user has no traffic beyond the
+// host left this month
+var errTrafficQuotaExhausted = errors.New("monthly traffic quota exhausted")
+
+// errBanned is returned when a user or their key is on the ban list
+var errBanned = errors.New("banned")
+
+// errCountryDenied is returned when users may not connect from a country
+var errCountryDenied = errors.New("country not allowed")
+
+// errCountryLimit is returned when a country has all the VMs it may run
+var errCountryLimit = errors.New("country VM limit reached")
+
+// errNotAllowed is returned when the allow list is in use and has neither
+// the user nor their key
+var errNotAllowed = errors.New("not on the allow list")
+
+// failureReason classifies a provisioning error for metrics
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, errQuotaExhausted):
+		return "quota"
+	case errors.Is(err, errTrafficQuotaExhausted):
+		return "traffic_quota"
+	case errors.Is(err, errBanned):
+		return "banned"
+	case errors.Is(err, errMaintenance):
+		return "maintenance"
+	case errors.Is(err, errNotAllowed):
+		return "not_allowed"
+	case errors.Is(err, errCountryDenied):
+		return "country_denied"
+	case errors.Is(err, errCountryLimit):
+		return "country_limit"
+	case errors.Is(err, vm.ErrCapacity):
+		return "capacity"
+	case errors.Is(err, vm.ErrIPExhausted):
+		return "ip_exhausted"
+	case errors.Is(err, vm.ErrRootfsCopy):
+		return "rootfs_copy"
+	case errors.Is(err, vm.ErrDiskFull):
+		return "disk_full"
+	case errors.Is(err, vm.ErrBootTimeout):
+		return "boot_timeout"
+	default:
+		return "other"
+	}
+}
+
+// showProvisionError logs a provisioning failure and explains it to the user
+func (s *Server) showProvisionError(out *terminal, user string, err error) {
+	reason := failureReason(err)
+	provisionFailures.Inc(reason)
+	s.logger.Errorf("Failed to create VM for user %s (%s): %v", user, reason, err)
+
+	var message, hint string
+	switch reason {
+	case "quota":
+		message, hint = out.msg("error_quota", s.config.QuotaHours), out.msg("error_quota_hint")
+	case "traffic_quota":
+		message, hint = out.msg("error_traffic_quota", s.config.QuotaTraffic), out.msg("error_quota_hint")
+	case "banned":
+		message = out.msg("error_banned")
+		if _, reason, ok := strings.Cut(err.Error(), ": "); ok {
+			hint = out.msg("error_banned_reason", reason)
+		}
+	case "maintenance":
+		message, hint = out.msg("error_maintenance"), out.msg("hint_try_again_later")
+		if _, note, ok := strings.Cut(err.Error(), ": "); ok {
+			hint = note
+		}
+	case "not_allowed":
+		message = out.msg("error_not_allowed")
+	case "country_denied":
+		message = out.msg("error_country_denied")
+	case "country_limit":
+		message, hint = out.msg("error_country_limit"), out.msg("hint_wait_for_vms")
+	case "capacity":
+		message, hint = out.msg("error_capacity", s.config.MaxConcurrentVMs), out.msg("hint_wait_for_vms")
+	case "ip_exhausted":
+		message, hint = out.msg("error_ip_exhausted"), out.msg("hint_wait_for_vms")
+	case "rootfs_copy":
+		message, hint = out.msg("error_rootfs_copy"), out.msg("hint_our_side")
+	case "disk_full":
+		message, hint = out.msg("error_disk_full"), out.msg("hint_try_again_later")
+	case "boot_timeout":
+		message, hint = out.msg("error_boot_timeout"), out.msg("hint_reconnect")
+	default:
+		message = out.msg("error_other", err)
+	}
+
+	wish.Println(out, fmt.Sprintf("\n\033[31m%s\033[0m", message))
+	if hint != "" {
+		wish.Println(out, fmt.Sprintf("\033[31m%s\033[0m", hint))
+	}
+}
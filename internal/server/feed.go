@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Privacy modes of the activity feed
+const (
+	feedNames     = "names"     // Usernames and login times
+	feedAnonymous = "anonymous" // Login times rounded to the hour, without usernames
+)
+
+// feedSize is how many recent logins the activity feed lists
+const feedSize = 20
+
+// feedItem is a recent login as published in the activity feed
+type feedItem struct {
+	User string // Empty in anonymous mode
+	Time time.Time
+}
+
+// feedItems returns the recent logins to publish, with the privacy mode
+// applied
+func feedItems(stats StatsReader, mode string) []feedItem {
+	var items []feedItem
+	for _, stat := range stats.GetRecentUsers("", feedSize) {
+		item := feedItem{User: stat.Username, Time: stat.LastConnected.UTC()}
+		if mode == feedAnonymous {
+			item.User = ""
+			item.Time = item.Time.Truncate(time.Hour)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// title describes a feed item
+func (item feedItem) title() string {
+	if item.User == "" {
+		return "Someone logged in"
+	}
+	return item.User + " logged in"
+}
+
+// handleJSONFeed serves recent logins in the JSON Feed format
+// (https://jsonfeed.org/version/1.1)
+func (s *Server) handleJSONFeed(w http.ResponseWriter, r *http.Request) {
+	type jsonItem struct {
+		ID            string    `json:"id"`
+		Title         string    `json:"title"`
+		ContentText   string    `json:"content_text"`
+		DatePublished time.Time `json:"date_published"`
+		Authors       []any     `json:"authors,omitempty"`
+	}
+	feed := struct {
+		Version string     `json:"version"`
+		Title   string     `json:"title"`
+		Items   []jsonItem `json:"items"`
+	}{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   s.feedTitle(),
+		Items:   []jsonItem{},
+	}
+	for i, item := range feedItems(s.userStats, s.config.ActivityFeed) {
+		ji := jsonItem{
+			ID:            fmt.Sprintf("%s-%d", item.Time.Format(time.RFC3339), i),
+			Title:         item.title(),
+			ContentText:   item.title(),
+			DatePublished: item.Time,
+		}
+		if item.User != "" {
+			ji.ID = item.User + "@" + item.Time.Format(time.RFC3339)
+			ji.Authors = []any{map[string]string{"name": item.User}}
+		}
+		feed.Items = append(feed.Items, ji)
+	}
+
+	// Let community websites fetch the feed from the browser
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/feed+json")
+	json.NewEncoder(w).Encode(feed)
+}
+
+// handleRSSFeed serves recent logins as an RSS 2.0 feed
+func (s *Server) handleRSSFeed(w http.ResponseWriter, r *http.Request) {
+	type rssItem struct {
+		Title   string `xml:"title"`
+		GUID    string `xml:"guid"`
+		PubDate string `xml:"pubDate"`
+	}
+	type rssChannel struct {
+		Title       string    `xml:"title"`
+		Link        string    `xml:"link"`
+		Description string    `xml:"description"`
+		Items       []rssItem `xml:"item"`
+	}
+	feed := struct {
+		XMLName xml.Name   `xml:"rss"`
+		Version string     `xml:"version,attr"`
+		Channel rssChannel `xml:"channel"`
+	}{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       s.feedTitle(),
+			Link:        "http://" + r.Host + "/",
+			Description: "Recent logins",
+		},
+	}
+	for i, item := range feedItems(s.userStats, s.config.ActivityFeed) {
+		guid := fmt.Sprintf("%s-%d", item.Time.Format(time.RFC3339), i)
+		if item.User != "" {
+			guid = item.User + "@" + item.Time.Format(time.RFC3339)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:   item.title(),
+			GUID:    guid,
+			PubDate: item.Time.Format(time.RFC1123Z),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+// feedTitle names the feed after the server's public host
+func (s *Server) feedTitle() string {
+	if s.config.PublicHost != "" {
+		return "ssh-hypervisor on " + s.config.PublicHost
+	}
+	return "ssh-hypervisor"
+}
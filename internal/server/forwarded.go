@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+// containsAddr reports whether any of the networks contains addr
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the address of the client behind a request. If
+// the request came from a trusted proxy, X-Forwarded-For is read from the
+// right, skipping the trusted proxies each hop was added by, so clients
+// can't spoof their address by sending the header themselves.
+func forwardedClient(r *http.Request, proxies []netip.Prefix) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	client := addrPort.Addr().Unmap()
+	if !containsAddr(proxies, client) {
+		return client, true
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && containsAddr(proxies, client); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // Anything left of a malformed hop can't be trusted
+		}
+		client = addr.Unmap()
+	}
+	return client, true
+}
+
+// statusRecorder remembers the status code of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets followed streams through the recorder
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// httpClientFilter resolves the client behind each request to the HTTP
+// listener through trusted proxies, refuses clients not on the allowlist,
+// and logs requests when the access log is on. Handlers see the client's
+// address in RemoteAddr.
+func (s *Server) httpClientFilter(next http.Handler) http.Handler {
+	// Both were checked by Config.Validate
+	allow, _ := internal.ParseNetworks(s.config.HTTPAllow)
+	proxies, _ := internal.ParseNetworks(s.config.HTTPProxies)
+	if len(allow) == 0 && len(proxies) == 0 && !s.config.HTTPAccessLog {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		client, ok := forwardedClient(r, proxies)
+		if ok {
+			r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		if len(allow) > 0 && !(ok && containsAddr(allow, client)) {
+			s.logger.Warnf("Refused HTTP %s %s from %s, which is not allowed", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(rec, "forbidden", http.StatusForbidden)
+		} else {
+			next.ServeHTTP(rec, r)
+		}
+		if s.config.HTTPAccessLog {
+			s.logger.Printf("HTTP %s %s %d from %s in %v", r.Method, r.URL.RequestURI(), rec.status, client, time.Since(start).Round(time.Millisecond))
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/geoip"
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+)
+
+var connectionsByCountry = metrics.NewCounterVec(
+	"sshhv_connections_by_country_total",
+	"Number of SSH sessions by the country they connected from.",
+	"country",
+)
+
+// countryLabel is the label VMs are given with the country of the
+// connection that started them, so limits can count VMs per country
+const countryLabel = "country"
+
+// unknownCountry stands for addresses that aren't in the GeoIP database
+const unknownCountry = "unknown"
+
+// countryDB looks up the country of an IP address, as *geoip.DB does
+type countryDB interface {
+	Country(ip net.IP) (string, error)
+}
+
+// geoPolicy restricts which countries users may connect from
+type geoPolicy struct {
+	db     countryDB
+	allow  map[string]bool // Countries given VMs, empty for all
+	deny   map[string]bool // Countries refused VMs
+	maxVMs map[string]int  // Running VMs per country, with "*" for others
+}
+
+// loadGeoPolicy opens the GeoIP database and parses the country policies
+func loadGeoPolicy(config *internal.Config) (*geoPolicy, error) {
+	db, err := geoip.Open(config.GeoIPDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	p := &geoPolicy{db: db}
+	if p.allow, err = parseCountries(config.GeoIPAllow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseCountries(config.GeoIPDeny); err != nil {
+		return nil, err
+	}
+	if p.maxVMs, err = parseCountryLimits(config.GeoIPMaxVMs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseCountries parses ISO country codes separated by commas, where
+// "unknown" stands for addresses not in the database
+func parseCountries(s string) (map[string]bool, error) {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(s, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		if !validCountry(code) {
+			return nil, fmt.Errorf("invalid country code %q", code)
+		}
+		countries[strings.ToUpper(code)] = true
+	}
+	return countries, nil
+}
+
+// parseCountryLimits parses limits like "US=50,*=10"
+func parseCountryLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, term := range strings.Split(s, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		code, limitText, ok := strings.Cut(term, "=")
+		limit, err := strconv.Atoi(limitText)
+		if !ok || err != nil || limit < 0 || (code != "*" && !validCountry(code)) {
+			return nil, fmt.Errorf("invalid country limit %q, expected CODE=N or *=N", term)
+		}
+		limits[strings.ToUpper(code)] = limit
+	}
+	return limits, nil
+}
+
+// validCountry reports whether code is a two-letter country code or
+// "unknown"
+func validCountry(code string) bool {
+	if strings.EqualFold(code, unknownCountry) {
+		return true
+	}
+	return len(code) == 2 && strings.Trim(strings.ToUpper(code), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+// country returns the country an address is in, or "" if GeoIP is disabled
+func (s *Server) country(addr net.Addr) string {
+	if s.geo == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return unknownCountry
+	}
+	code, err := s.geo.db.Country(net.ParseIP(host))
+	if err != nil {
+		s.logger.Warnf("GeoIP lookup of %s failed: %v", host, err)
+	}
+	if code == "" {
+		return unknownCountry
+	}
+	return code
+}
+
+// checkCountry returns errCountryDenied if users may not connect from a
+// country, or errCountryLimit if it already has its share of running VMs.
+// The user's own running VM doesn't count, so they can always reconnect.
+func (s *Server) checkCountry(user, country string) error {
+	if s.geo == nil {
+		return nil
+	}
+	key := strings.ToUpper(country)
+	if s.geo.deny[key] || (len(s.geo.allow) > 0 && !s.geo.allow[key]) {
+		return fmt.Errorf("%w: %s", errCountryDenied, country)
+	}
+
+	limit, ok := s.geo.maxVMs[key]
+	if !ok {
+		limit, ok = s.geo.maxVMs["*"]
+	}
+	if !ok {
+		return nil
+	}
+	if _, running := s.vmManager.GetVM(user); running {
+		return nil
+	}
+	vms, err := s.vmManager.ListVMs(map[string]string{countryLabel: country})
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, info := range vms {
+		if info.Running {
+			count++
+		}
+	}
+	if count >= limit {
+		return fmt.Errorf("%w: %d VMs running for %s", errCountryLimit, count, country)
+	}
+	return nil
+}
+
+// labelCountry labels a user's VM with the country that started it
+func (s *Server) labelCountry(user, country string) {
+	if country == "" {
+		return
+	}
+	if err := s.vmManager.MergeLabels(user, map[string]string{countryLabel: country}); err != nil {
+		s.logger.Errorf("Failed to label VM of user %s with country: %v", user, err)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// sshfpAlgorithms maps SSH key types to SSHFP algorithm numbers (RFC 4255,
+// RFC 6594, RFC 7479)
+var sshfpAlgorithms = map[string]int{
+	cryptoSSH.KeyAlgoRSA:      1,
+	cryptoSSH.KeyAlgoDSA:      2,
+	cryptoSSH.KeyAlgoECDSA256: 3,
+	cryptoSSH.KeyAlgoECDSA384: 3,
+	cryptoSSH.KeyAlgoECDSA521: 3,
+	cryptoSSH.KeyAlgoED25519:  4,
+}
+
+// LoadHostPublicKey reads the public half of the host key at path
+func LoadHostPublicKey(path string) (cryptoSSH.PublicKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+	signer, err := cryptoSSH.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	return signer.PublicKey(), nil
+}
+
+// SSHFPRecords returns DNS SSHFP records publishing a host key for name, with
+// both SHA-1 and SHA-256 fingerprints, in zone file format
+func SSHFPRecords(name string, key cryptoSSH.PublicKey) ([]string, error) {
+	algorithm, ok := sshfpAlgorithms[key.Type()]
+	if !ok {
+		return nil, fmt.Errorf("no SSHFP algorithm for %s keys", key.Type())
+	}
+	if name != "@" && !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	sha1Sum := sha1.Sum(key.Marshal())
+	sha256Sum := sha256.Sum256(key.Marshal())
+	return []string{
+		fmt.Sprintf("%s IN SSHFP %d 1 %x", name, algorithm, sha1Sum),
+		fmt.Sprintf("%s IN SSHFP %d 2 %x", name, algorithm, sha256Sum),
+	}, nil
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+var activeVMs = metrics.NewGauge(
+	"sshhv_active_vms",
+	"Number of VMs currently running.",
+)
+
+var vmStates = metrics.NewGaugeVec(
+	"sshhv_vms_by_state",
+	"Number of VMs in each lifecycle state, counting VMs starting and stopping.",
+	"state",
+)
+
+var diskUsageBytes = metrics.NewGaugeVec(
+	"sshhv_data_dir_bytes",
+	"Space used by the data directory, by category.",
+	"category",
+)
+
+var diskFreeBytes = metrics.NewGauge(
+	"sshhv_data_dir_free_bytes",
+	"Free space on the data directory's filesystem.",
+)
+
+// updateDiskMetrics refreshes the disk usage gauges from a fresh scan
+func (s *Server) updateDiskMetrics() (vm.DiskUsage, error) {
+	usage, err := s.vmManager.DiskUsage()
+	if err != nil {
+		return usage, err
+	}
+	diskUsageBytes.Set("images", float64(usage.Images))
+	diskUsageBytes.Set("vm_disks", float64(usage.VMDisks))
+	diskUsageBytes.Set("logs", float64(usage.Logs))
+	diskUsageBytes.Set("other", float64(usage.Other))
+	diskFreeBytes.Set(float64(usage.Free))
+	return usage, nil
+}
+
+// updateStateMetrics refreshes the count of VMs in each state, including
+// states no VM is in
+func (s *Server) updateStateMetrics() {
+	counts := s.vmManager.StateCounts()
+	for _, state := range vm.States {
+		vmStates.Set(string(state), float64(counts[state]))
+	}
+}
+
+// checkReady returns why the server can't give a new user a VM right now,
+// like being in maintenance mode or out of capacity, or nil if it can
+func (s *Server) checkReady() error {
+	var errs []error
+	if message, enabled := s.maintenance(); enabled {
+		if message != "" {
+			errs = append(errs, fmt.Errorf("%w: %s", errMaintenance, message))
+		} else {
+			errs = append(errs, errMaintenance)
+		}
+	}
+	if err := s.vmManager.CheckReady(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// httpHandler returns the handler for the HTTP status and metrics listener
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkReady(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		activeVMs.Set(float64(s.vmManager.GetActiveVMCount()))
+		s.updateStateMetrics()
+		if _, err := s.updateDiskMetrics(); err != nil {
+			s.logger.Warnf("Failed to measure disk usage: %v", err)
+		}
+		if err := s.updateLabelMetrics(); err != nil {
+			s.logger.Warnf("Failed to count VMs by label: %v", err)
+		}
+		if err := s.updateVMMMetrics(); err != nil {
+			s.logger.Warnf("Failed to collect VMM metrics: %v", err)
+		}
+		if err := s.updateTrafficMetrics(); err != nil {
+			s.logger.Warnf("Failed to collect traffic metrics: %v", err)
+		}
+		metrics.Handler().ServeHTTP(w, r)
+	})
+	mux.HandleFunc("GET /api/disk", func(w http.ResponseWriter, r *http.Request) {
+		usage, err := s.updateDiskMetrics()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	})
+	mux.HandleFunc("GET /api/versions", func(w http.ResponseWriter, r *http.Request) {
+		versions, ok := s.vmManager.Versions()
+		if !ok {
+			http.Error(w, "VM backend doesn't report versions", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	})
+	if s.config.ActivityFeed != "" {
+		mux.HandleFunc("GET /feed.json", s.handleJSONFeed)
+		mux.HandleFunc("GET /feed.rss", s.handleRSSFeed)
+	}
+	mux.HandleFunc("GET /api/maintenance", s.handleGetMaintenance)
+	mux.HandleFunc("PUT /api/maintenance", s.handleSetMaintenance)
+	mux.HandleFunc("GET /api/access", s.handleListAccess)
+	mux.HandleFunc("POST /api/access", s.handleAddAccess)
+	mux.HandleFunc("DELETE /api/access/{list}", s.handleRemoveAccess)
+	mux.HandleFunc("GET /api/vms", s.handleListVMs)
+	mux.HandleFunc("POST /api/vms/{id}", s.handleScheduleVM)
+	mux.HandleFunc("GET /api/vms/{id}/labels", s.handleGetLabels)
+	mux.HandleFunc("PUT /api/vms/{id}/labels", s.handleSetLabels)
+	mux.HandleFunc("GET /api/vms/{id}/memory", s.handleMemory)
+	mux.HandleFunc("PUT /api/vms/{id}/memory", s.handleMemory)
+	mux.HandleFunc("GET /api/vms/{id}/metrics", s.handleVMMMetrics)
+	mux.HandleFunc("GET /api/vms/{id}/traffic", s.handleTraffic)
+	mux.HandleFunc("GET /api/vms/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		events := s.vmManager.Events().Events(r.PathValue("id"))
+		if events == nil {
+			events = []vm.Event{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+	return s.httpClientFilter(s.apiAuth(mux))
+}
+
+// startHTTPServer serves status and metrics on the configured HTTP address.
+// Serve errors are reported on the done channel.
+func (s *Server) startHTTPServer(ctx context.Context, lc net.ListenConfig, done chan<- error) (*http.Server, error) {
+	ln, err := lc.Listen(ctx, "tcp", s.config.HTTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", s.config.HTTPAddr, err)
+	}
+
+	httpServer := &http.Server{Addr: s.config.HTTPAddr, Handler: s.httpHandler()}
+	if s.config.HTTPClientCA != "" {
+		pem, err := os.ReadFile(s.config.HTTPClientCA)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			ln.Close()
+			return nil, fmt.Errorf("no certificates found in client CA %s", s.config.HTTPClientCA)
+		}
+		// Certificates are optional so health checks work without one
+		httpServer.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+
+	go func() {
+		var err error
+		if s.config.HTTPCert != "" {
+			s.logger.Printf("Starting HTTP status listener on %s (https://)", s.config.HTTPAddr)
+			err = httpServer.ServeTLS(ln, s.config.HTTPCert, s.config.HTTPKey)
+		} else {
+			s.logger.Printf("Starting HTTP status listener on %s", s.config.HTTPAddr)
+			err = httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			done <- fmt.Errorf("HTTP listener: %w", err)
+		}
+	}()
+
+	return httpServer, nil
+}
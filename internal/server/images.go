@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+)
+
+// maxPickerInput bounds what a user can type at the image picker
+const maxPickerInput = 64
+
+// pickImage asks a user whose VM has no image yet which catalog image it
+// should boot, when there is a choice. Clients without a terminal get the
+// default image.
+func (s *Server) pickImage(sess ssh.Session, out *terminal, user string) error {
+	images := s.vmManager.Images()
+	if len(images) < 2 || s.vmManager.VMImage(user) != "" {
+		return nil
+	}
+	if _, _, isPty := sess.Pty(); !isPty {
+		return nil
+	}
+
+	wish.Println(out, "")
+	wish.Println(out, fmt.Sprintf("\033[1m%s\033[0m", out.msg("pick_image")))
+	for i, img := range images {
+		line := fmt.Sprintf("  %d) %s", i+1, img.Name)
+		if img.Description != "" {
+			line += fmt.Sprintf("  \033[2;37m%s\033[0m", img.Description)
+		}
+		wish.Println(out, line)
+	}
+	for {
+		wish.Print(out, out.msg("pick_image_prompt", images[0].Name)+" ")
+		answer, err := readLine(out)
+		if err != nil {
+			return err
+		}
+		if name, ok := chooseImage(images, answer); ok {
+			return s.vmManager.SetVMImage(user, name)
+		}
+		wish.Println(out, fmt.Sprintf("\033[31m%s\033[0m", out.msg("unknown_image", answer)))
+	}
+}
+
+// chooseImage returns the image a user's answer to the picker names, by
+// number or name. An empty answer is the default image.
+func chooseImage(images []image.Image, answer string) (string, bool) {
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return images[0].Name, true
+	}
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(images) {
+		return images[n-1].Name, true
+	}
+	for _, img := range images {
+		if strings.EqualFold(img.Name, answer) {
+			return img.Name, true
+		}
+	}
+	return "", false
+}
+
+// readLine reads a line typed at a terminal in raw mode, echoing it and
+// handling backspace. Ctrl+C and Ctrl+D give io.EOF.
+func readLine(rw io.ReadWriter) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := rw.Read(buf); err != nil {
+			return "", err
+		}
+		switch c := buf[0]; {
+		case c == '\r' || c == '\n':
+			rw.Write([]byte("\r\n"))
+			return string(line), nil
+		case c == 3 || c == 4:
+			rw.Write([]byte("\r\n"))
+			return "", io.EOF
+		case c == 127 || c == '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				rw.Write([]byte("\b \b"))
+			}
+		case c >= ' ' && c < 127 && len(line) < maxPickerInput:
+			line = append(line, c)
+			rw.Write(buf)
+		}
+	}
+}
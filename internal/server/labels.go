@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// defaultProfile is the entry in the labels file applied to every user's VM
+const defaultProfile = "*"
+
+var labeledVMs = metrics.NewGaugeVec(
+	"sshhv_running_vms_by_label",
+	"Number of VMs currently running, by KEY=VALUE label.",
+	"label",
+)
+
+// loadProfileLabels reads a JSON file mapping users, or "*" for everyone, to
+// the labels their VMs get, like {"*": {"class": "workshop-2024"}}
+func loadProfileLabels(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM labels: %w", err)
+	}
+	var profiles map[string]map[string]string
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse VM labels in %s: %w", path, err)
+	}
+	for user, labels := range profiles {
+		if err := vm.ValidateLabels(labels); err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", path, user, err)
+		}
+	}
+	return profiles, nil
+}
+
+// applyProfileLabels adds the labels from a user's profile to their VM. The
+// file is reread every time, like the per-user session commands.
+func (s *Server) applyProfileLabels(user string) error {
+	if s.config.VMLabels == "" {
+		return nil
+	}
+	profiles, err := loadProfileLabels(s.config.VMLabels)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string)
+	for _, profile := range []string{defaultProfile, user} {
+		for key, value := range profiles[profile] {
+			labels[key] = value
+		}
+	}
+	return s.vmManager.MergeLabels(user, labels)
+}
+
+// labelVM applies a user's profile labels before their VM is created,
+// logging rather than refusing the session if the labels file is broken
+func (s *Server) labelVM(user string) {
+	if err := s.applyProfileLabels(user); err != nil {
+		s.logger.Errorf("Failed to label VM of user %s: %v", user, err)
+	}
+}
+
+// updateLabelMetrics refreshes the count of running VMs for each label
+func (s *Server) updateLabelMetrics() error {
+	vms, err := s.vmManager.ListVMs(nil)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, info := range vms {
+		if !info.Running {
+			continue
+		}
+		for key, value := range info.Labels {
+			counts[key+"="+value]++
+		}
+	}
+	labeledVMs.Reset()
+	for label, count := range counts {
+		labeledVMs.Set(label, float64(count))
+	}
+	return nil
+}
+
+// selectorParam parses the label selector from repeated ?label=KEY=VALUE
+// query parameters
+func selectorParam(r *http.Request) (map[string]string, error) {
+	return vm.ParseSelector(strings.Join(r.URL.Query()["label"], ","))
+}
+
+// handleListVMs lists running VMs and stopped VMs with labels, filtered by
+// the label selector
+func (s *Server) handleListVMs(w http.ResponseWriter, r *http.Request) {
+	selector, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vms, err := s.vmManager.ListVMs(selector)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vms)
+}
+
+// handleGetLabels returns a VM's labels
+func (s *Server) handleGetLabels(w http.ResponseWriter, r *http.Request) {
+	labels, err := s.vmManager.Labels(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// handleSetLabels replaces a VM's labels with the JSON object in the body
+func (s *Server) handleSetLabels(w http.ResponseWriter, r *http.Request) {
+	labels := make(map[string]string)
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		http.Error(w, fmt.Sprintf("expected a JSON object of labels: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.vmManager.SetLabels(r.PathValue("id"), labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+)
+
+var (
+	_ = metrics.NewGaugeFunc(
+		"sshhv_open_fds",
+		"Number of file descriptors the server has open.",
+		func() float64 { return float64(countOpenFDs()) },
+	)
+	_ = metrics.NewGaugeFunc(
+		"sshhv_goroutines",
+		"Number of goroutines in the server.",
+		func() float64 { return float64(runtime.NumGoroutine()) },
+	)
+	vmOpenFiles = metrics.NewGaugeVec(
+		"sshhv_vm_open_files",
+		"Files in each VM's data directory that the server has open, like logs and pipes, by VM.",
+		"vm",
+	)
+)
+
+// leakCheckInterval is how often the server samples its own handles
+const leakCheckInterval = time.Minute
+
+// Growth that counts as a leak: rising or flat for leakWindow samples in a
+// row, and up by at least a quarter and leakMinGrowth overall, which steady
+// load and bursts of connections don't do
+const (
+	leakWindow    = 30
+	leakMinGrowth = 32
+)
+
+// countOpenFDs returns how many file descriptors the process has open
+func countOpenFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// vmOpenFileCounts returns how many files the process has open in each VM's
+// data directory, by VM ID
+func vmOpenFileCounts(dataDir string) map[string]int {
+	counts := make(map[string]int)
+	// Descriptors link to resolved paths
+	root, err := filepath.Abs(dataDir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return counts
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return counts
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil {
+			continue // Closed since the directory was read
+		}
+		rel, err := filepath.Rel(root, target)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if vmID, _, nested := strings.Cut(rel, string(filepath.Separator)); nested {
+			counts[vmID]++
+		}
+	}
+	return counts
+}
+
+// growthDetector notices a value that keeps growing over many samples
+type growthDetector struct {
+	samples []int
+}
+
+// observe adds a sample and reports whether the value has grown like a leak.
+// After reporting, it needs a new full window before reporting again.
+func (d *growthDetector) observe(v int) bool {
+	d.samples = append(d.samples, v)
+	if len(d.samples) > leakWindow {
+		d.samples = d.samples[1:]
+	}
+	if len(d.samples) < leakWindow {
+		return false
+	}
+	for i := 1; i < len(d.samples); i++ {
+		if d.samples[i] < d.samples[i-1] {
+			return false
+		}
+	}
+	first, last := d.samples[0], d.samples[len(d.samples)-1]
+	if last-first < leakMinGrowth || last < first+first/4 {
+		return false
+	}
+	d.samples = nil
+	return true
+}
+
+// monitorLeaks samples the server's file descriptors and goroutines, and
+// the files it holds in VM directories, warning about steady growth and
+// about files still open for VMs that have stopped
+func (s *Server) monitorLeaks(ctx context.Context) {
+	ticker := time.NewTicker(leakCheckInterval)
+	defer ticker.Stop()
+
+	var fds, goroutines growthDetector
+	stoppedOpen := make(map[string]int) // Samples in a row each stopped VM had files open
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n := countOpenFDs(); fds.observe(n) {
+			s.logger.Warnf("Open file descriptors grew steadily to %d over the last %d checks, which may be a leak", n, leakWindow)
+		}
+		if n := runtime.NumGoroutine(); goroutines.observe(n) {
+			s.logger.Warnf("Goroutines grew steadily to %d over the last %d checks, which may be a leak", n, leakWindow)
+		}
+
+		counts := vmOpenFileCounts(s.config.DataDir)
+		vmOpenFiles.Reset()
+		for vmID, n := range counts {
+			vmOpenFiles.Set(vmID, float64(n))
+		}
+		for vmID := range stoppedOpen {
+			if _, open := counts[vmID]; !open {
+				delete(stoppedOpen, vmID)
+			}
+		}
+		for vmID, n := range counts {
+			if _, running := s.vmManager.GetVM(vmID); running || s.vmManager.Busy(vmID) {
+				delete(stoppedOpen, vmID)
+				continue
+			}
+			// Files are closed a moment after a VM stops, so only files
+			// open across two checks count
+			stoppedOpen[vmID]++
+			if stoppedOpen[vmID] == 2 {
+				s.logger.Warnf("VM %s is not running but the server still has %d files open in its directory, which is a leak", vmID, n)
+			}
+		}
+	}
+}
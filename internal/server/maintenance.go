@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maintenanceFile in the data directory puts the server in maintenance mode
+// while it exists. Its contents, if any, are shown to users who are turned
+// away. VM IDs can't contain dots, so it never clashes with a VM's directory.
+const maintenanceFile = "maintenance.flag"
+
+// errMaintenance is returned when new VMs aren't started for maintenance
+var errMaintenance = errors.New("server is in maintenance mode")
+
+// maintenanceStatus is the maintenance mode of the server, as returned and
+// set by its HTTP API
+type maintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// maintenance reports whether the server is in maintenance mode, with the
+// message for users. The file is checked for every connection, so operators
+// can create and remove it by hand. Anything there but a regular file is
+// ignored.
+func (s *Server) maintenance() (string, bool) {
+	path := filepath.Join(s.config.DataDir, maintenanceFile)
+	if info, err := os.Stat(path); errors.Is(err, os.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false
+	} else if err != nil {
+		s.logger.Errorf("Failed to read maintenance file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// checkMaintenance returns errMaintenance in maintenance mode, unless the
+// user's VM is already running, so existing work isn't interrupted
+func (s *Server) checkMaintenance(user string) error {
+	message, enabled := s.maintenance()
+	if !enabled {
+		return nil
+	}
+	if _, running := s.vmManager.GetVM(user); running {
+		return nil
+	}
+	if message != "" {
+		return fmt.Errorf("%w: %s", errMaintenance, message)
+	}
+	return errMaintenance
+}
+
+// handleGetMaintenance returns whether the server is in maintenance mode
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	message, enabled := s.maintenance()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceStatus{Enabled: enabled, Message: message})
+}
+
+// handleSetMaintenance turns maintenance mode on or off
+func (s *Server) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var status maintenanceStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		http.Error(w, fmt.Sprintf("invalid maintenance status: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(s.config.DataDir, maintenanceFile)
+	var err error
+	if status.Enabled {
+		err = os.WriteFile(path, []byte(status.Message+"\n"), 0644)
+	} else if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status.Enabled {
+		s.logger.Warnf("Maintenance mode turned on from %s, new VMs are refused", r.RemoteAddr)
+	} else {
+		s.logger.Warnf("Maintenance mode turned off from %s", r.RemoteAddr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
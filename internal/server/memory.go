@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+// memoryCommand is the command users run on the hypervisor, as in
+// "ssh alice@host memory 512", to resize their VM without logging in to it
+const memoryCommand = "memory"
+
+// runMemoryCommand shows a user's VM memory, or resizes it to the size in MB
+// given as the argument
+func (s *Server) runMemoryCommand(sess ssh.Session, user, arg string) {
+	if !s.vmManager.Resizable() {
+		wish.Errorln(sess, "VM memory can't be resized on this server.")
+		sess.Exit(1)
+		return
+	}
+	if arg = strings.TrimSpace(arg); arg == "" {
+		wish.Println(sess, fmt.Sprintf("Your VM has %d MB of memory, and can have up to %d MB.", s.vmManager.Memory(user), s.config.VMMaxMemory))
+		return
+	}
+
+	mb, err := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(arg), "MB"))
+	if err == nil {
+		err = s.vmManager.ResizeMemory(sess.Context(), user, mb)
+	}
+	if err != nil {
+		wish.Errorln(sess, fmt.Sprintf("Failed to resize VM: %v", err))
+		sess.Exit(1)
+		return
+	}
+	s.logger.Printf("User %s resized VM memory to %d MB", user, mb)
+	wish.Println(sess, fmt.Sprintf("Your VM now has %d MB of memory.", mb))
+}
+
+// memoryRequest is the body of PUT /api/vms/{id}/memory and its response
+type memoryRequest struct {
+	MemoryMB int `json:"memory_mb"`
+}
+
+// handleMemory returns a VM's memory size, or resizes it for PUT
+func (s *Server) handleMemory(w http.ResponseWriter, r *http.Request) {
+	vmID := r.PathValue("id")
+	if r.Method == http.MethodPut {
+		var req memoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("expected {\"memory_mb\": N}: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.vmManager.ResizeMemory(r.Context(), vmID, req.MemoryMB); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Printf("Resized memory of VM %s to %d MB from %s", vmID, req.MemoryMB, r.RemoteAddr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memoryRequest{MemoryMB: s.vmManager.Memory(vmID)})
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// englishMessages is the built-in catalog of text shown to users, keyed by
+// message ID. Formatting verbs are filled in by the caller, and styling is
+// applied outside the messages so translations don't need escape codes.
+// Messages that depend on a count have an ID for each plural category of
+// the language, like "ago_days.one" and "ago_days.other" in English.
+var englishMessages = map[string]string{
+	"hello":             "Hello, %s!",
+	"first_visit":       "Today is %s. It's your first time here.",
+	"last_login":        "Today is %s. Your last login was %s.",
+	"recent_logins":     "Recent logins:",
+	"column_user":       "User",
+	"column_last_login": "Last login",
+	"first_user":        "You're the first user to connect!",
+	"demo_vm":           "This is a demo VM. Nothing you do is saved after you disconnect.",
+	"quota_warning":     "You have used %.1f of your %d VM-hours this month.",
+	"traffic_warning":   "You have used %.1f of your %d GB of traffic this month.",
+	"vms_in_use":        "%d/%d VMs in use",
+	"booting":           "Booting your fresh VM...",
+	"connecting":        "Connecting to VM...",
+	"complete":          "Complete!",
+	"booted_in":         "Your VM booted in %s.",
+	"booted_in_p50":     "Your VM booted in %s (p50 %s).",
+	"cancelled":         "Cancelled during VM provisioning.",
+	"mosh_hint":         "Roam with mosh: %s",
+	"connection_failed": "Connection to VM failed: %v",
+	"vm_exited":         "Your VM crashed. Reconnecting will boot a fresh one.",
+	"misconfigured":     "Server is misconfigured, please try again later.",
+	"admin_attach":      "Attaching to the VM of %s as an administrator. This session is logged.",
+	"pick_image":        "Choose what your VM runs:",
+	"pick_image_prompt": "Image [%s]:",
+	"unknown_image":     "There is no image %q. Enter a number or name from the list.",
+
+	"sunday":    "Sunday",
+	"monday":    "Monday",
+	"tuesday":   "Tuesday",
+	"wednesday": "Wednesday",
+	"thursday":  "Thursday",
+	"friday":    "Friday",
+	"saturday":  "Saturday",
+
+	"just_now":          "just now",
+	"ago_seconds.one":   "%d second ago",
+	"ago_seconds.other": "%d seconds ago",
+	"ago_minutes.one":   "%d minute ago",
+	"ago_minutes.other": "%d minutes ago",
+	"ago_hours.one":     "%d hour ago",
+	"ago_hours.other":   "%d hours ago",
+	"ago_days.one":      "%d day ago",
+	"ago_days.other":    "%d days ago",
+	"ago_weeks.one":     "%d week ago",
+	"ago_weeks.other":   "%d weeks ago",
+	"ago_months.one":    "%d month ago",
+	"ago_months.other":  "%d months ago",
+	"ago_years.one":     "%d year ago",
+	"ago_years.other":   "%d years ago",
+
+	"stage_disk":    "Preparing disk",
+	"stage_queued":  "Waiting for other VMs to prepare their disks",
+	"stage_network": "Allocating network",
+	"stage_vm":      "Starting VM",
+	"stage_kernel":  "Booting kernel",
+	"stage_ssh":     "Starting SSH",
+
+	"error_quota":          "You have used all %d of your VM-hours for this month.",
+	"error_quota_hint":     "Your quota resets at the start of next month (UTC).",
+	"error_traffic_quota":  "You have used all %d GB of your traffic for this month.",
+	"error_banned":         "You have been banned from this server.",
+	"error_banned_reason":  "Reason: %s",
+	"error_maintenance":    "The server is down for maintenance.",
+	"error_not_allowed":    "This server is only open to invited users.",
+	"error_country_denied": "This server doesn't accept connections from your region.",
+	"error_country_limit":  "Server is at capacity for your region.",
+	"error_capacity":       "Server is at capacity! Maximum of %d concurrent VMs are allowed.",
+	"error_ip_exhausted":   "Server has run out of network addresses for new VMs.",
+	"error_rootfs_copy":    "Failed to prepare the disk for your VM.",
+	"error_disk_full":      "Server is running low on disk space for new VMs.",
+	"error_boot_timeout":   "Your VM took too long to boot.",
+	"error_other":          "Failed to provision VM: %v",
+	"hint_wait_for_vms":    "Please try again later when some VMs are freed up.",
+	"hint_our_side":        "This is a problem on our side, please try again later.",
+	"hint_try_again_later": "Please try again later.",
+	"hint_reconnect":       "Please try reconnecting.",
+}
+
+// catalog holds translations of messages by language, like "de" or "pt_BR"
+type catalog map[string]map[string]string
+
+// loadCatalog reads translations from a JSON file mapping languages to
+// message IDs to text
+func loadCatalog(path string) (catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message catalog: %w", err)
+	}
+	var c catalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse message catalog: %w", err)
+	}
+	for language, messages := range c {
+		for id := range messages {
+			// Any plural category may be translated for a message with plurals
+			base, _, plural := strings.Cut(id, ".")
+			if _, ok := englishMessages[base+".other"]; plural && ok {
+				continue
+			}
+			if _, ok := englishMessages[id]; !ok {
+				return nil, fmt.Errorf("message catalog: unknown message %q for language %q", id, language)
+			}
+		}
+	}
+	return c, nil
+}
+
+// localeLanguage returns the language of a POSIX locale, like "pt_BR" for
+// "pt_BR.UTF-8"
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(locale, ".")
+	language, _, _ = strings.Cut(language, "@")
+	return language
+}
+
+// lookup returns the catalogs for a POSIX locale like "pt_BR.UTF-8", from
+// most to least specific, ending with English
+func (c catalog) lookup(locale string) []map[string]string {
+	language := localeLanguage(locale)
+
+	var messages []map[string]string
+	if m, ok := c[language]; ok {
+		messages = append(messages, m)
+	}
+	if base, _, ok := strings.Cut(language, "_"); ok {
+		if m, ok := c[base]; ok {
+			messages = append(messages, m)
+		}
+	}
+	return append(messages, englishMessages)
+}
+
+// msg formats a message in the client's language
+func (t *terminal) msg(id string, args ...any) string {
+	for _, messages := range t.messages {
+		if format, ok := messages[id]; ok {
+			return fmt.Sprintf(format, args...)
+		}
+	}
+	return id
+}
+
+// plural formats a message that depends on a count n, in the plural form
+// the client's language uses for n
+func (t *terminal) plural(id string, n int) string {
+	category := pluralCategory(t.language, n)
+	for _, messages := range t.messages {
+		if format, ok := messages[id+"."+category]; ok {
+			return fmt.Sprintf(format, n)
+		}
+		if format, ok := messages[id+".other"]; ok {
+			return fmt.Sprintf(format, n)
+		}
+	}
+	return id
+}
+
+// pluralCategory returns the CLDR plural category of a whole number in a
+// language: "one", "few", "many", or "other". Languages without rules here
+// use English's.
+func pluralCategory(language string, n int) string {
+	base, _, _ := strings.Cut(strings.ToLower(language), "_")
+	mod10, mod100 := n%10, n%100
+	switch base {
+	case "ja", "ko", "zh", "vi", "th", "id", "ms":
+		return "other"
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+	case "ru", "uk", "be":
+		switch {
+		case mod10 == 1 && mod100 != 11:
+			return "one"
+		case mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14):
+			return "few"
+		default:
+			return "many"
+		}
+	case "pl":
+		switch {
+		case n == 1:
+			return "one"
+		case mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14):
+			return "few"
+		default:
+			return "many"
+		}
+	case "cs", "sk":
+		switch {
+		case n == 1:
+			return "one"
+		case n >= 2 && n <= 4:
+			return "few"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
+
+// weekdays are the message IDs of the days of the week, from Sunday
+var weekdays = [...]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// relativeTime formats how long ago a time was, like "3 weeks ago", in the
+// client's language
+func (t *terminal) relativeTime(when time.Time) string {
+	const day = 24 * time.Hour
+	diff := time.Since(when)
+	days := int(diff / day)
+	switch {
+	case diff < 5*time.Second:
+		return t.msg("just_now")
+	case diff < time.Minute:
+		return t.plural("ago_seconds", int(diff/time.Second))
+	case diff < time.Hour:
+		return t.plural("ago_minutes", int(diff/time.Minute))
+	case diff < day:
+		return t.plural("ago_hours", int(diff/time.Hour))
+	case days < 7:
+		return t.plural("ago_days", days)
+	case days < 30:
+		return t.plural("ago_weeks", days/7)
+	case days < 365:
+		return t.plural("ago_months", days/30)
+	default:
+		return t.plural("ago_years", days/365)
+	}
+}
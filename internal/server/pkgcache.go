@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/pkgcache"
+)
+
+// Directories in the data directory holding the package and registry
+// caches. VM IDs can't contain dots, so they never clash with a VM's
+// directory.
+const (
+	packageCacheDir  = "packages.cache"
+	registryCacheDir = "registry.cache"
+)
+
+// startPackageCache serves the package cache to VMs on the VM networks'
+// gateways
+func (s *Server) startPackageCache(ctx context.Context, lc net.ListenConfig) (*http.Server, error) {
+	cache, err := pkgcache.New(filepath.Join(s.config.DataDir, packageCacheDir), int64(s.config.PackageCacheGB)<<30, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	return s.startGatewayListeners(ctx, lc, "package cache", s.config.PackageCache, s.onlyVMs(cache))
+}
+
+// startRegistryCache serves the pull-through cache of Docker Hub to VMs on
+// the VM networks' gateways
+func (s *Server) startRegistryCache(ctx context.Context, lc net.ListenConfig) (*http.Server, error) {
+	mirror, err := pkgcache.NewRegistryMirror(filepath.Join(s.config.DataDir, registryCacheDir), int64(s.config.RegistryCacheGB)<<30, pkgcache.DockerHub, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	return s.startGatewayListeners(ctx, lc, "registry cache", s.config.RegistryCache, s.onlyVMs(mirror))
+}
+
+// onlyVMs wraps a handler to refuse requests that aren't from running VMs
+func (s *Server) onlyVMs(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.remoteVM(r); !ok {
+			http.Error(w, "only VMs can use this service", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/wish"
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+const maxProgressBlocks = 40
+
+// Progress bars share a budget of frames per second, so each is redrawn less
+// often the more sessions are provisioning at once, within these intervals
+const (
+	progressFrameBudget = 400
+	minFrameInterval    = 50 * time.Millisecond
+	maxFrameInterval    = time.Second
+)
+
+var (
+	provisionStageEvents = metrics.NewCounterVec(
+		"sshhv_provision_stage_events_total",
+		"Number of sessions that reached each VM provisioning stage.",
+		"stage",
+	)
+	provisionStageSeconds = metrics.NewCounterVec(
+		"sshhv_provision_stage_seconds_total",
+		"Total seconds from session start until each VM provisioning stage was reached.",
+		"stage",
+	)
+	progressFrames = metrics.NewCounter(
+		"sshhv_progress_frames_total",
+		"Number of progress bar frames drawn to sessions.",
+	)
+	unanimatedSessions = metrics.NewCounter(
+		"sshhv_progress_unanimated_sessions_total",
+		"Number of sessions shown boot stages without an animated progress bar, because too many were provisioning.",
+	)
+	vmBootSeconds = metrics.NewHistogram(
+		"sshhv_vm_boot_seconds",
+		"Seconds from connection until a fresh VM's shell was ready.",
+		[]float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+	)
+)
+
+// provisionStages lists provisioning stages in order, with the progress
+// percentage shown once each is reached and the message ID labeling the work
+// after it
+var provisionStages = []struct {
+	stage   vm.ProgressStage
+	percent int
+	next    string
+}{
+	{"", 0, "stage_disk"},
+	{vm.StageQueued, 0, "stage_queued"},
+	{vm.StageRootfsReady, 40, "stage_network"},
+	{vm.StageIPAllocated, 45, "stage_vm"},
+	{vm.StageVMMStarted, 55, "stage_kernel"},
+	{vm.StageKernelBooting, 70, "stage_ssh"},
+	{vm.StageSSHReady, 100, ""},
+}
+
+// stageIndex returns the position of a stage in provisionStages
+func stageIndex(stage vm.ProgressStage) int {
+	for i, s := range provisionStages {
+		if s.stage == stage {
+			return i
+		}
+	}
+	return 0
+}
+
+// frameInterval returns how long a progress bar waits between frames while
+// animating sessions are showing one
+func frameInterval(animating int64) time.Duration {
+	interval := time.Duration(animating) * time.Second / progressFrameBudget
+	return min(max(interval, minFrameInterval), maxFrameInterval)
+}
+
+// overAnimationMax reports whether more sessions are provisioning than
+// progress bars are animated for
+func (s *Server) overAnimationMax(animating int64) bool {
+	return s.config.AnimationMax > 0 && animating > int64(s.config.AnimationMax)
+}
+
+// showProgressBar displays a progress bar driven by provisioning events. Within
+// a stage, the bar creeps exponentially toward the next stage's percentage.
+// Terminals without ANSI support get a line per stage instead, as do sessions
+// that start while more than AnimationMax are provisioning.
+func (s *Server) showProgressBar(out *terminal, ctx context.Context, progress <-chan vm.ProgressEvent, provisionFailed <-chan struct{}) {
+	animating := s.animating.Add(1)
+	defer s.animating.Add(-1)
+	animate := out.ansi && !s.overAnimationMax(animating)
+	if out.ansi && !animate {
+		unanimatedSessions.Inc()
+	}
+	var timer *time.Timer
+	var frames <-chan time.Time // Nil without animation, so frames never come
+	if animate {
+		timer = time.NewTimer(frameInterval(animating))
+		defer timer.Stop()
+		frames = timer.C
+	}
+
+	sessionStart := time.Now()
+	stageStart := sessionStart
+	current := 0 // Index into provisionStages
+
+	// Ensure clean exit on context cancellation
+	defer func() {
+		if ctx.Err() != nil || out.Context().Err() != nil {
+			// Clear progress line if cancelled
+			wish.Print(out, "\r\033[2K")
+			wish.Println(out, fmt.Sprintf("\n\033[33m%s\033[0m", out.msg("cancelled")))
+		}
+	}()
+
+	if !animate {
+		wish.Println(out, out.msg(provisionStages[current].next)+"...")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-out.Context().Done():
+			// Session context cancelled (Ctrl+C)
+			return
+		case <-provisionFailed:
+			// Provisioning failed, clear progress line and return
+			wish.Print(out, "\r\033[2K")
+			return
+		case event := <-progress:
+			elapsed := event.Time.Sub(sessionStart)
+			provisionStageEvents.Inc(string(event.Stage))
+			provisionStageSeconds.Add(string(event.Stage), elapsed.Seconds())
+			s.logger.Debugf("VM %s reached stage %s after %s, while %s", event.VMID, event.Stage, elapsed, event.State)
+
+			if i := stageIndex(event.Stage); i > current {
+				current = i
+				stageStart = event.Time
+				if !animate && provisionStages[current].next != "" {
+					wish.Println(out, out.msg(provisionStages[current].next)+"...")
+				}
+			}
+			if event.Stage == vm.StageSSHReady {
+				// VM is ready, jump to 100%
+				bar := strings.Repeat("▮", maxProgressBlocks)
+				wish.Print(out, fmt.Sprintf("\r\033[2K\033[36m%s\033[0m 100%%", bar))
+				return
+			}
+		case <-frames:
+			// Bars already animating stand still while too many sessions are
+			// provisioning, or while the client hasn't read the last frame
+			animating := s.animating.Load()
+			timer.Reset(frameInterval(animating))
+			if s.overAnimationMax(animating) || out.buffered() > 0 {
+				continue
+			}
+
+			// Exponential progress toward the next stage: fast at start, slower at end
+			// Using exponential decay formula: 1 - e^(-k*t)
+			// Optional stages like queued share the previous percentage, so
+			// creep toward the next stage that actually moves the bar
+			floor := provisionStages[current].percent
+			next := current + 1
+			for provisionStages[next].percent <= floor {
+				next++
+			}
+			ceiling := provisionStages[next].percent - 1
+			elapsed := time.Since(stageStart).Seconds()
+			percent := floor + int(float64(ceiling-floor)*(1-math.Exp(-1.2*elapsed)))
+
+			// Calculate filled blocks
+			filled := min((percent*maxProgressBlocks)/100, maxProgressBlocks)
+
+			// Build progress bar
+			bar := strings.Repeat("▮", filled) + strings.Repeat("▯", maxProgressBlocks-filled)
+
+			// Update progress line
+			wish.Print(out, fmt.Sprintf("\r\033[2K\033[36m%s\033[0m %d%%  \033[2;37m%s...\033[0m", bar, percent, out.msg(provisionStages[current].next)))
+			progressFrames.Inc()
+		}
+	}
+}
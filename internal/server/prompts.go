@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net"
+
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// Prompter drives a keyboard-interactive exchange that users complete before
+// they log in and get a VM, like accepting terms of service, entering an
+// invite code, or a second factor. Users with any prompter pending still log
+// in with a key or password first, which then only partially succeeds, and
+// their SSH client goes on to keyboard-interactive to answer the prompts.
+type Prompter interface {
+	// Pending reports whether user must complete the exchange to log in
+	Pending(user string) bool
+	// Prompt asks user its questions through challenge, returning nil to let
+	// them in or an error whose message is shown to them
+	Prompt(user string, remote net.Addr, challenge cryptoSSH.KeyboardInteractiveChallenge) error
+}
+
+// AddPrompter makes users complete p's exchange before they log in, after
+// those of prompters added before it. It must be called before Run.
+func (s *Server) AddPrompter(p Prompter) {
+	s.prompters = append(s.prompters, p)
+}
+
+// promptsPending reports whether a user must complete a prompter's exchange
+// after their key or password is accepted
+func (s *Server) promptsPending(user string) bool {
+	for _, p := range s.prompters {
+		if p.Pending(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPrompts runs the exchanges a user has pending in order, stopping at the
+// first that refuses them
+func (s *Server) runPrompts(user string, remote net.Addr, challenge cryptoSSH.KeyboardInteractiveChallenge) error {
+	for _, p := range s.prompters {
+		if !p.Pending(user) {
+			continue
+		}
+		if err := p.Prompt(user, remote, challenge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
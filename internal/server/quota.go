@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/wish"
+)
+
+// quotaWarnings are the fractions of the monthly quota at which users are
+// warned in the welcome message, highest first, with the ANSI color used
+var quotaWarnings = []struct {
+	fraction float64
+	color    string
+}{
+	{0.9, "31"},
+	{0.75, "33"},
+}
+
+// quotaUsage returns a user's VM time this month and their monthly quota,
+// or a zero quota if quotas are disabled
+func (s *Server) quotaUsage(user string) (used, quota time.Duration) {
+	if s.ledger == nil {
+		return 0, 0
+	}
+	used = s.ledger.Used(user) + s.usage.Current(user)
+	return used, time.Duration(s.config.QuotaHours) * time.Hour
+}
+
+// trafficUsage returns a user's traffic beyond the host this month and their
+// monthly traffic quota in bytes, or a zero quota if it is disabled
+func (s *Server) trafficUsage(user string) (used, quota int64) {
+	if s.ledger == nil {
+		return 0, 0
+	}
+	used = s.ledger.TrafficUsed(user) + s.usage.CurrentTraffic(user)
+	return used, int64(s.config.QuotaTraffic) * 1e9
+}
+
+// checkQuota returns errQuotaExhausted if the user has no VM time left, or
+// errTrafficQuotaExhausted if they have no traffic left
+func (s *Server) checkQuota(user string) error {
+	used, quota := s.quotaUsage(user)
+	if s.config.QuotaHours > 0 && used >= quota {
+		return fmt.Errorf("%w (%.1f of %d hours)", errQuotaExhausted, used.Hours(), s.config.QuotaHours)
+	}
+	if used, quota := s.trafficUsage(user); s.config.QuotaTraffic > 0 && used >= quota {
+		return fmt.Errorf("%w (%.1f of %d GB)", errTrafficQuotaExhausted, float64(used)/1e9, s.config.QuotaTraffic)
+	}
+	return nil
+}
+
+// showQuotaWarning tells users when they are close to their monthly quotas
+func (s *Server) showQuotaWarning(out *terminal, user string) {
+	if used, quota := s.quotaUsage(user); s.config.QuotaHours > 0 {
+		showWarning(out, used.Hours()/quota.Hours(), out.msg("quota_warning", used.Hours(), s.config.QuotaHours))
+	}
+	if used, quota := s.trafficUsage(user); s.config.QuotaTraffic > 0 {
+		showWarning(out, float64(used)/float64(quota), out.msg("traffic_warning", float64(used)/1e9, s.config.QuotaTraffic))
+	}
+}
+
+// showWarning prints a quota warning in the color of the highest of
+// quotaWarnings reached by the fraction used, if any
+func showWarning(out *terminal, fraction float64, message string) {
+	for _, w := range quotaWarnings {
+		if fraction >= w.fraction {
+			wish.Println(out, fmt.Sprintf("\033[%sm%s\033[0m", w.color, message))
+			return
+		}
+	}
+}
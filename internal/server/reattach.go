@@ -0,0 +1,51 @@
+package server
+
+import (
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/shell"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// multiplexerSession is the name of the multiplexer session in each VM that
+// users re-attach to
+const multiplexerSession = "ssh-hypervisor"
+
+// multiplexerCommand wraps a session's command, or the login shell if it is
+// empty, in a multiplexer session that later sessions re-attach to instead of
+// starting another. Guests without the multiplexer installed run the command
+// directly, as if reattaching were off.
+func multiplexerCommand(multiplexer, command string) string {
+	var wrapped string
+	switch multiplexer {
+	case internal.MultiplexerScreen:
+		wrapped = "screen -xRR -S " + multiplexerSession
+		if command != "" {
+			wrapped += " sh -c " + shell.Quote(command)
+		}
+	default:
+		wrapped = "tmux new-session -A -s " + multiplexerSession
+		if command != "" {
+			wrapped += " " + shell.Quote(command)
+		}
+	}
+	fallback := `exec "${SHELL:-/bin/sh}" -l`
+	if command != "" {
+		fallback = command
+	}
+	return "if command -v " + multiplexer + " >/dev/null 2>&1; then exec " + wrapped + "; fi; " + fallback
+}
+
+// holdVM keeps a VM running for the reattach window after a session ends,
+// then drops the session's reference to it. Reconnecting in time finds the
+// VM running, with the user's terminal in its multiplexer.
+func (s *Server) holdVM(testVM *vm.VM, window time.Duration) {
+	if testVM.ExitErr() != nil {
+		return
+	}
+	s.logger.Printf("Keeping VM %s for %s so its user can reconnect", testVM.ID, window)
+	time.AfterFunc(window, func() {
+		s.releaseVM(testVM)
+	})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/scheduler"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// Actions of scheduled jobs
+const (
+	actionStop    = "stop"    // Stop running VMs, keeping their disks
+	actionDestroy = "destroy" // Stop VMs and delete their data
+)
+
+// scheduledJob is a line of the schedule file, like
+// "0 18 * * * destroy workshop=*"
+type scheduledJob struct {
+	line     string
+	schedule *scheduler.Schedule
+	action   string
+	selector map[string]string // Labels of the VMs acted on, empty for all
+}
+
+// loadSchedule reads a file of "MIN HOUR DOM MON DOW ACTION [SELECTOR]"
+// lines, where blank lines and lines starting with # are ignored
+func loadSchedule(path string) ([]scheduledJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+
+	var jobs []scheduledJob
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 6 || len(fields) > 7 {
+			return nil, fmt.Errorf("%s:%d: expected MIN HOUR DOM MON DOW ACTION [SELECTOR]", path, n)
+		}
+		schedule, err := scheduler.Parse(strings.Join(fields[:5], " "))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		job := scheduledJob{line: line, schedule: schedule, action: fields[5]}
+		if len(fields) == 7 {
+			if job.selector, err = vm.ParseSelector(fields[6]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		}
+		switch {
+		case job.action != actionStop && job.action != actionDestroy:
+			return nil, fmt.Errorf("%s:%d: unknown action %q (expected %s or %s)", path, n, job.action, actionStop, actionDestroy)
+		case job.action == actionDestroy && len(job.selector) == 0:
+			// Deleting every user's data is never what a schedule should do
+			return nil, fmt.Errorf("%s:%d: %s needs a label selector", path, n, actionDestroy)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// runSchedule runs the jobs in the schedule file until ctx is done
+func (s *Server) runSchedule(ctx context.Context, jobs []scheduledJob) {
+	var entries []scheduler.Job
+	for _, job := range jobs {
+		entries = append(entries, scheduler.Job{
+			Schedule: job.schedule,
+			Run:      func(time.Time) { s.runScheduledJob(ctx, job) },
+		})
+	}
+	scheduler.Run(ctx, entries)
+}
+
+// runScheduledJob applies a job's action to the VMs matching its selector,
+// logging each VM acted on, or only what would be done in dry-run mode
+func (s *Server) runScheduledJob(ctx context.Context, job scheduledJob) {
+	vms, err := s.vmManager.ListVMs(job.selector)
+	if err != nil {
+		s.logger.Errorf("Scheduled job %q failed: %v", job.line, err)
+		return
+	}
+
+	count := 0
+	for _, info := range vms {
+		if job.action == actionStop && !info.Running {
+			continue
+		}
+		count++
+		if s.config.ScheduleDryRun {
+			s.logger.Warnf("Scheduled job %q would %s VM %s (dry run)", job.line, job.action, info.ID)
+			continue
+		}
+		s.logger.Warnf("Scheduled job %q: %s VM %s", job.line, job.action, info.ID)
+		s.vmManager.Events().Record(info.ID, vm.EventScheduled, fmt.Sprintf("%s by %q", job.action, job.line))
+		if err := s.applyScheduledAction(ctx, job.action, info.ID); err != nil {
+			s.logger.Errorf("Scheduled job %q failed to %s VM %s: %v", job.line, job.action, info.ID, err)
+		}
+	}
+	s.logger.Printf("Scheduled job %q matched %d VMs", job.line, count)
+}
+
+// applyScheduledAction stops a VM, and deletes its data for destroy
+func (s *Server) applyScheduledAction(ctx context.Context, action, vmID string) error {
+	if _, running := s.vmManager.GetVM(vmID); running {
+		stopCtx, cancel := context.WithTimeout(ctx, s.config.ShutdownTimeout+stopGracePeriod)
+		err := s.vmManager.DestroyVM(stopCtx, vmID)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if action == actionDestroy {
+		return s.vmManager.RemoveVM(vmID)
+	}
+	return nil
+}
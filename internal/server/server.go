@@ -5,32 +5,55 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"math"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/ssh"
 	"github.com/charmbracelet/wish"
 	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/cluster"
+	"github.com/ekzhang/ssh-hypervisor/internal/usage"
 	"github.com/ekzhang/ssh-hypervisor/internal/vm"
 	"github.com/olekukonko/tablewriter"
 	"github.com/sirupsen/logrus"
 	cryptoSSH "golang.org/x/crypto/ssh"
 )
 
-const maxProgressBlocks = 40
-
 // Server represents the SSH hypervisor server
 type Server struct {
 	config    *internal.Config
 	vmManager *vm.Manager
 	userStats *UserStats
+	access    *AccessLists
+	geo       *geoPolicy     // Nil when GeoIP is disabled
+	usage     *usage.Tracker // Nil when usage export and quotas are disabled
+	ledger    *usage.Ledger  // Nil when quotas are disabled
 	logger    logrus.FieldLogger
+
+	subsystems map[string]ssh.SubsystemHandler // Extra SSH subsystems by name
+	catalog    catalog                         // Translations of messages shown to users
+	auth       Authenticator                   // Extra checks on logins, nil to allow everyone
+	prompters  []Prompter                      // Exchanges users complete before logging in, TOTP and terms first
+
+	animating atomic.Int64 // Sessions showing a provisioning progress bar
+
+	// Interactive sessions by VM, for the drop service to copy text to
+	attachedMu sync.Mutex
+	attached   map[string]map[*terminal]bool
+
+	// Sessions using or provisioning each VM, which is idle without any
+	inUseMu sync.Mutex
+	inUse   map[string]int
 }
 
 // NewServer creates a new SSH hypervisor server
@@ -40,18 +63,113 @@ func NewServer(config *internal.Config, logger logrus.FieldLogger) (*Server, err
 		return nil, fmt.Errorf("failed to create VM manager: %w", err)
 	}
 
+	var exporter usage.Exporter
+	if config.UsageExport != "" {
+		exporter, err = usage.NewExporter(config.UsageExport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create usage exporter: %w", err)
+		}
+	}
+
+	// Catch mistakes in the per-user commands at startup rather than on login
+	if config.SessionCommands != "" {
+		if _, err := loadSessionCommands(config.SessionCommands); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Schedule != "" {
+		if _, err := loadSchedule(config.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	if config.VMLabels != "" {
+		if _, err := loadProfileLabels(config.VMLabels); err != nil {
+			return nil, err
+		}
+	}
+	if config.AdminKeys != "" {
+		if _, err := loadAdminKeys(config.AdminKeys); err != nil {
+			return nil, err
+		}
+	}
+	if config.TOTPUsers != "" {
+		if _, err := loadTOTPSecrets(config.TOTPUsers); err != nil {
+			return nil, err
+		}
+	}
+	if config.Tiers != "" {
+		if _, err := loadTiers(config.Tiers); err != nil {
+			return nil, err
+		}
+	}
+
+	s := newServer(config, logger, vmManager, exporter)
+	if config.GeoIPDB != "" {
+		if s.geo, err = loadGeoPolicy(config); err != nil {
+			return nil, err
+		}
+	}
+	if config.Messages != "" {
+		if s.catalog, err = loadCatalog(config.Messages); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newServer creates a server around an existing VM manager, exporting usage
+// records with exporter if it is not nil
+func newServer(config *internal.Config, logger logrus.FieldLogger, vmManager *vm.Manager, exporter usage.Exporter) *Server {
 	userStats := NewUserStats(config.DataDir)
 	if err := userStats.Load(); err != nil {
 		logger.Errorf("Failed to load user stats: %v", err)
 		// Continue anyway with empty stats
 	}
+	access := NewAccessLists(config.DataDir)
+	if err := access.Load(); err != nil {
+		logger.Errorf("Failed to load access lists: %v", err)
+	}
+
+	s := &Server{
+		config:     config,
+		vmManager:  vmManager,
+		userStats:  userStats,
+		access:     access,
+		logger:     logger,
+		subsystems: make(map[string]ssh.SubsystemHandler),
+		attached:   make(map[string]map[*terminal]bool),
+		inUse:      make(map[string]int),
+	}
+	s.prompters = []Prompter{totpPrompter{s}, termsPrompter{s}}
+	vmManager.AddExitHook(func(*vm.VM, error) { vmExits.Inc() })
+	vmManager.AddAdmissionCheck(s.checkMaintenance)
+	vmManager.AddTrafficHook(s.chargeTraffic)
+	if weak := config.InsecureSSHAlgorithms(); len(weak) > 0 {
+		logger.Warnf("Offering weak SSH algorithms for old clients: %s", strings.Join(weak, ", "))
+	}
+	for _, name := range strings.Split(config.ProxySubsystems, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.ProxySubsystem(name)
+		}
+	}
+	if config.UserRootfs > 0 {
+		s.RegisterSubsystem(rootfsSubsystem, func(sess ssh.Session) {
+			sess.Exit(s.serveRootfsUpload(sess))
+		})
+	}
 
-	return &Server{
-		config:    config,
-		vmManager: vmManager,
-		userStats: userStats,
-		logger:    logger,
-	}, nil
+	// Usage is only metered when something consumes it
+	if config.QuotaHours > 0 || config.QuotaTraffic > 0 {
+		s.ledger = usage.NewLedger(config.DataDir)
+		if err := s.ledger.Load(); err != nil {
+			logger.Errorf("Failed to load usage ledger: %v", err)
+		}
+	}
+	if exporter != nil || s.ledger != nil {
+		s.usage = usage.NewTracker(exporter, s.ledger, logger)
+	}
+	return s
 }
 
 // Run starts the SSH server
@@ -64,23 +182,21 @@ func (s *Server) Run(ctx context.Context) error {
 	s.logger.Printf("  VM CPUs: %d", s.config.VMCPUs)
 	s.logger.Printf("  Max concurrent VMs: %d", s.config.MaxConcurrentVMs)
 	s.logger.Printf("  Data directory: %s", s.config.DataDir)
+	if s.config.WebSocketPort != 0 {
+		s.logger.Printf("  WebSocket port: %d", s.config.WebSocketPort)
+	}
+	if s.config.HTTPAddr != "" {
+		s.logger.Printf("  HTTP address: %s", s.config.HTTPAddr)
+	}
 
 	hostKey, err := s.loadOrGenerateHostKey()
 	if err != nil {
 		return fmt.Errorf("failed to load/generate host key: %w", err)
 	}
+	// Operators can compare this to what users see on first connect
+	s.logger.Printf("Host key fingerprint: %s %s", hostKey.PublicKey().Type(), cryptoSSH.FingerprintSHA256(hostKey.PublicKey()))
 
-	server := ssh.Server{
-		Addr:        fmt.Sprintf(":%d", s.config.Port),
-		Handler:     s.sshHandler,
-		HostSigners: []ssh.Signer{hostKey},
-		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			return true // Accept any public key
-		},
-		PasswordHandler: func(ctx ssh.Context, password string) bool {
-			return true // Accept any password
-		},
-	}
+	server := s.newSSHServer(hostKey)
 
 	s.logger.Printf("Starting SSH server on port %d", s.config.Port)
 
@@ -88,16 +204,141 @@ func (s *Server) Run(ctx context.Context) error {
 	statsCtx, statsCancel := context.WithCancel(ctx)
 	defer statsCancel()
 	go s.periodicStatsSave(statsCtx)
+	go s.monitorLeaks(statsCtx)
+	if s.config.VMLogRetention > 0 {
+		go s.periodicLogPrune(statsCtx)
+	}
+	if s.config.GCKeepFor > 0 || s.config.GCMaxSize > 0 {
+		go s.periodicGC(statsCtx)
+	}
+	if s.usage != nil {
+		go s.usage.Run(statsCtx, s.config.UsageInterval)
+	}
+	if s.config.AllowInternet && (s.config.EgressMaxConns > 0 || s.config.EgressMaxDests > 0 || s.config.EgressLog) {
+		go s.vmManager.MonitorEgress(statsCtx, egressCheckInterval)
+	}
+	if s.config.BreakInCheck {
+		go s.vmManager.MonitorGuestSSH(statsCtx, breakInCheckInterval)
+	}
+	if s.config.CountTraffic {
+		go s.vmManager.MonitorTraffic(statsCtx, trafficCountInterval)
+	}
+	if s.config.ClockSync > 0 {
+		go s.vmManager.SyncGuestClocks(statsCtx, s.config.ClockSync)
+	}
+	if s.config.HealthCheck > 0 {
+		go s.vmManager.MonitorHealth(statsCtx, s.config.HealthCheck)
+	}
+	if s.config.MDNS {
+		go func() {
+			if err := s.vmManager.AnnounceMDNS(statsCtx); err != nil {
+				s.logger.Errorf("Stopped announcing VMs over mDNS: %v", err)
+			}
+		}()
+	}
+	if s.config.Schedule != "" {
+		jobs, err := loadSchedule(s.config.Schedule)
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("Running %d scheduled jobs from %s", len(jobs), s.config.Schedule)
+		go s.runSchedule(statsCtx, jobs)
+	}
+
+	// Register with the cluster coordinator, if this is a node agent
+	agentDone := make(chan struct{})
+	if s.config.Coordinator != "" {
+		agent, err := cluster.NewAgent(s.config.Coordinator, s.config.NodeName, s.nodeStatus, s.logger)
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("Registering node %s with coordinator %s", s.config.NodeName, s.config.Coordinator)
+		go func() {
+			agent.Run(statsCtx, s.config.Heartbeat)
+			close(agentDone)
+		}()
+	} else {
+		close(agentDone)
+	}
+
+	lc := net.ListenConfig{KeepAlive: s.config.TCPKeepAlive}
+	ln, err := lc.Listen(ctx, "tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.config.Port, err)
+	}
 
 	// Start server in goroutine
-	done := make(chan error, 1)
+	done := make(chan error, 3)
 	go func() {
-		done <- server.ListenAndServe()
+		done <- server.Serve(ln)
 	}()
 
+	// Serve metrics and status over HTTP, if enabled
+	if s.config.HTTPAddr != "" {
+		httpServer, err := s.startHTTPServer(ctx, lc, done)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start HTTP listener: %w", err)
+		}
+		defer httpServer.Close()
+	}
+
+	// Optionally tunnel SSH over WebSocket for clients behind restrictive firewalls
+	if s.config.WebSocketPort != 0 {
+		wsServer, err := s.startWebSocketListener(ctx, server, lc, done)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start WebSocket listener: %w", err)
+		}
+		defer wsServer.Close()
+	}
+
+	// Let VMs copy text and files to their users, if enabled
+	if s.config.DropPort != 0 {
+		dropServer, err := s.startGatewayListeners(ctx, lc, "drop service", s.config.DropPort, s.dropHandler())
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start drop service: %w", err)
+		}
+		defer dropServer.Close()
+	}
+
+	// Let VMs without Internet access reach allowed domains, if enabled
+	if s.config.EgressProxy != 0 {
+		proxyServer, err := s.startGatewayListeners(ctx, lc, "egress proxy", s.config.EgressProxy, s.egressProxyHandler())
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start egress proxy: %w", err)
+		}
+		defer proxyServer.Close()
+	}
+
+	// Mirror package registries for VMs, if enabled
+	if s.config.PackageCache != 0 {
+		cacheServer, err := s.startPackageCache(ctx, lc)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start package cache: %w", err)
+		}
+		defer cacheServer.Close()
+	}
+
+	// Cache container images for VMs, if enabled
+	if s.config.RegistryCache != 0 {
+		registryServer, err := s.startRegistryCache(ctx, lc)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start registry cache: %w", err)
+		}
+		defer registryServer.Close()
+	}
+
 	// Wait for context cancellation or server error
 	select {
 	case <-ctx.Done():
+		// Deregister first so the coordinator stops sending users here
+		<-agentDone
+
 		s.logger.Printf("Shutting down SSH server...")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
@@ -127,6 +368,52 @@ func (s *Server) Run(ctx context.Context) error {
 	}
 }
 
+// newSSHServer configures the SSH server that provisions a VM per session
+func (s *Server) newSSHServer(hostKey ssh.Signer) *ssh.Server {
+	subsystems := make(map[string]ssh.SubsystemHandler, len(s.subsystems))
+	for name, handler := range s.subsystems {
+		subsystems[name] = handler
+	}
+
+	algorithms := s.config.SSHAlgorithms()
+	return &ssh.Server{
+		Addr:              fmt.Sprintf(":%d", s.config.Port),
+		Handler:           s.sshHandler,
+		SubsystemHandlers: subsystems,
+		HostSigners:       []ssh.Signer{hostKey},
+		// Keys and passwords are checked by the server's own callbacks, which
+		// can ask users with prompts pending for more, so only attaches
+		// refused a key are handled here
+		KeyboardInteractiveHandler: s.authorizeInteractive,
+		ServerConfigCallback: func(ctx ssh.Context) *cryptoSSH.ServerConfig {
+			return &cryptoSSH.ServerConfig{
+				Config: cryptoSSH.Config{
+					Ciphers:      algorithms.Ciphers,
+					MACs:         algorithms.MACs,
+					KeyExchanges: algorithms.KeyExchanges,
+				},
+				PublicKeyCallback: s.publicKeyCallback(ctx),
+				PasswordCallback:  s.passwordCallback(ctx),
+				MaxAuthTries:      s.config.MaxAuthTries,
+			}
+		},
+	}
+}
+
+// keyStrongEnough reports whether a client's public key meets the minimum
+// RSA key size. Other key types have fixed sizes and always pass.
+func (s *Server) keyStrongEnough(key ssh.PublicKey) bool {
+	if s.config.SSHMinRSABits == 0 || key.Type() != cryptoSSH.KeyAlgoRSA {
+		return true
+	}
+	cryptoKey, ok := key.(cryptoSSH.CryptoPublicKey)
+	if !ok {
+		return false
+	}
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	return ok && rsaKey.N.BitLen() >= s.config.SSHMinRSABits
+}
+
 // periodicStatsSave saves user stats to disk every 30 seconds
 func (s *Server) periodicStatsSave(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
@@ -144,6 +431,58 @@ func (s *Server) periodicStatsSave(ctx context.Context) {
 	}
 }
 
+// periodicLogPrune removes per-VM logs older than the retention period every hour
+func (s *Server) periodicLogPrune(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := s.vmManager.PruneLogs(s.config.VMLogRetention); err != nil {
+			s.logger.Errorf("Failed to prune VM logs: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// periodicGC prunes data directories of stopped VMs and unreferenced
+// artifacts every hour
+func (s *Server) periodicGC(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	policy := vm.GCPolicy{
+		KeepFor: s.config.GCKeepFor,
+		MaxSize: int64(s.config.GCMaxSize) * 1024 * 1024,
+	}
+	for {
+		pruned, err := s.vmManager.GC(policy)
+		if err != nil {
+			s.logger.Errorf("Failed to garbage collect VM data: %v", err)
+		}
+		for _, p := range pruned {
+			s.logger.Printf("Removed data for VM %s (%d MB, last used %s)", p.ID, p.Size/(1024*1024), p.LastUsed.Format(time.RFC3339))
+		}
+		blobs, err := s.vmManager.GCArtifacts()
+		if err != nil {
+			s.logger.Errorf("Failed to garbage collect artifacts: %v", err)
+		}
+		for _, b := range blobs {
+			s.logger.Printf("Removed unreferenced artifact %s (%d MB)", b.Digest, b.Size/(1024*1024))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // loadOrGenerateHostKey loads an existing host key or generates a new one
 func (s *Server) loadOrGenerateHostKey() (ssh.Signer, error) {
 	var keyPath string
@@ -205,292 +544,418 @@ func (s *Server) loadOrGenerateHostKey() (ssh.Signer, error) {
 
 // sshHandler handles incoming SSH connections
 func (s *Server) sshHandler(sess ssh.Session) {
-	user := sess.User()
+	// Admins attaching to a user's VM were checked during authentication
+	user, attach := attachTarget(sess.User())
+	admin, _ := sess.Context().Value(adminContextKey{}).(string)
 	remoteAddr := sess.RemoteAddr()
+	connectedAt := time.Now()
 
-	s.logger.Printf("SSH connection from %s (user: %s)", remoteAddr, user)
+	country := s.country(remoteAddr)
+	if country != "" {
+		s.logger.Printf("SSH connection from %s in %s (user: %s)", remoteAddr, country, sess.User())
+	} else {
+		s.logger.Printf("SSH connection from %s (user: %s)", remoteAddr, sess.User())
+	}
+	if attach {
+		s.logger.Warnf("Admin %s attaching to VM of user %s from %s", admin, user, remoteAddr)
+	}
+
+	// Messages go through out, which adapts them to the client's terminal
+	out := s.newTerminal(sess)
+	defer out.flush()
+	debug := debugRequested(sess)
+	if debug {
+		s.logger.Printf("Debug output on for session of user %s", user)
+		debugln(out, time.Since(connectedAt), fmt.Sprintf("connected from %s as %s", remoteAddr, sess.User()))
+	}
+
+	// Host commands are gated like shells, so users who can't start a VM
+	// can't reach them either
+	if !attach {
+		if err := s.checkMaintenance(user); err != nil {
+			s.showProvisionError(out, user, err)
+			return
+		}
+		if err := s.checkAccess(sess); err != nil {
+			s.showProvisionError(out, user, err)
+			return
+		}
+		if err := s.checkCountry(user, country); err != nil {
+			s.showProvisionError(out, user, err)
+			return
+		}
+		if err := s.checkQuota(user); err != nil {
+			s.showProvisionError(out, user, err)
+			return
+		}
+	}
+
+	// The connection bundle is answered by the hypervisor, without a VM
+	if sess.RawCommand() == bundleCommand {
+		wish.Print(sess, s.connectionBundle(sess))
+		return
+	}
+	if name, arg, _ := strings.Cut(sess.RawCommand(), " "); name == memoryCommand {
+		s.runMemoryCommand(sess, user, arg)
+		return
+	}
+	if name, arg, _ := strings.Cut(sess.RawCommand(), " "); name == snapshotCommand {
+		s.runSnapshotCommand(sess, user, arg)
+		return
+	}
+	if name, arg, _ := strings.Cut(sess.RawCommand(), " "); name == rootfsCommand {
+		s.runRootfsCommand(sess, user, arg)
+		return
+	}
+	if name, arg, _ := strings.Cut(sess.RawCommand(), " "); name == fetchCommand && s.config.DropPort != 0 {
+		s.runFetchCommand(sess, user, arg)
+		return
+	}
 
 	// Show animated progress bar while creating VM
 	ctx, cancel := context.WithCancel(sess.Context())
 	defer cancel()
 
+	// Never fall back to a full shell if the configured program is unknown
+	command, err := s.sessionCommand(user)
+	if err != nil {
+		s.logger.Errorf("Failed to look up session command for user %s: %v", user, err)
+		wish.Println(out, fmt.Sprintf("\n\033[31m%s\033[0m", out.msg("misconfigured")))
+		return
+	}
+	// Otherwise run what the client asked for, as in "ssh alice@host uptime"
+	pinned := command != ""
+	if !pinned {
+		command = clientCommand(sess)
+	}
+
 	// Check if VM already exists before getting/creating
 	_, vmExists := s.vmManager.GetVM(user)
+	if !vmExists && !attach {
+		if err := s.pickImage(sess, out, user); errors.Is(err, io.EOF) {
+			wish.Println(out, out.msg("cancelled"))
+			return
+		} else if err != nil {
+			s.logger.Errorf("Failed to choose image for user %s: %v", user, err)
+			wish.Println(out, fmt.Sprintf("\n\033[31m%s\033[0m", out.msg("misconfigured")))
+			return
+		}
+	}
+	if !vmExists {
+		s.labelVM(user)
+		if !attach {
+			s.labelCountry(user, country)
+		}
+	}
 
 	// Show welcome message with appropriate VM status
-	s.showWelcomeMessage(sess, user, !vmExists)
+	if attach {
+		wish.Println(out, fmt.Sprintf("\n\033[1;33m%s\033[0m", out.msg("admin_attach", user)))
+	} else {
+		s.showWelcomeMessage(out, user, !vmExists)
+	}
 
-	// Start VM creation in background
-	vmDone := make(chan *vm.VM, 1)
-	vmErr := make(chan error, 1)
-	go func() {
-		testVM, err := s.vmManager.GetOrCreateVM(ctx, user)
-		if err != nil {
-			vmErr <- err
+	if debug {
+		if vmExists {
+			debugln(out, time.Since(connectedAt), fmt.Sprintf("VM %s is already running, attaching to it", user))
 		} else {
-			vmDone <- testVM
+			debugln(out, time.Since(connectedAt), fmt.Sprintf("creating VM %s", user))
+		}
+	}
+
+	// Provision the VM in the background, reporting progress as it goes. It
+	// is in use from now on, so it can't be preempted once it is running.
+	defer s.useVM(user)()
+	progress := make(chan vm.ProgressEvent, 16)
+	vmResult := make(chan provisionResult, 1)
+	go func() {
+		testVM, err := s.getOrCreateVM(ctx, user, progress)
+		if err == nil {
+			if err = s.vmManager.WaitReady(ctx, testVM, progress); err != nil {
+				s.releaseVM(testVM)
+				testVM = nil
+			}
 		}
+		vmResult <- provisionResult{vm: testVM, err: err}
 	}()
 
-	// Show animated progress bar with health check in a separate goroutine
-	vmReady := make(chan string, 1)
+	// Show animated progress bar driven by provisioning events
 	progressDone := make(chan struct{})
-	vmCreateFailed := make(chan struct{})
+	provisionFailed := make(chan struct{})
+	barProgress := (<-chan vm.ProgressEvent)(progress)
+	if debug {
+		barProgress = debugProgress(ctx, out, connectedAt, progress)
+	}
 	go func() {
 		defer close(progressDone)
-		s.showProgressBarWithHealthCheck(sess, ctx, vmReady, vmCreateFailed)
+		s.showProgressBar(out, ctx, barProgress, provisionFailed)
 	}()
 
-	// Wait for VM creation to complete or context cancellation
+	// Wait for the VM to be ready or context cancellation
 	var testVM *vm.VM
 	select {
-	case testVM = <-vmDone:
-		// VM created successfully, start health check
-		go func() {
-			vmAddr := fmt.Sprintf("%s:22", testVM.IP.String())
-			if s.waitForVMSSH(ctx, vmAddr) == nil {
-				select {
-				case vmReady <- testVM.IP.String():
-				default:
+	case result := <-vmResult:
+		if result.err != nil {
+			// Signal progress bar that provisioning failed
+			close(provisionFailed)
+			// Wait for progress bar to complete before showing error
+			<-progressDone
+			if ctx.Err() == nil {
+				if debug {
+					debugln(out, time.Since(connectedAt), fmt.Sprintf("provisioning failed: %v", result.err))
 				}
+				s.showProvisionError(out, user, result.err)
 			}
-		}()
+			return
+		}
+		testVM = result.vm
 
 		// Wait for progress bar to complete
 		<-progressDone
-	case err := <-vmErr:
-		// Signal progress bar that VM creation failed
-		close(vmCreateFailed)
-		// Wait for progress bar to complete before showing error
-		<-progressDone
-		s.logger.Errorf("Failed to create VM for user %s: %v", user, err)
-
-		// Show user-friendly error message
-		errorMsg := err.Error()
-		if strings.Contains(errorMsg, "maximum number of concurrent VMs") {
-			wish.Println(sess, fmt.Sprintf("\n\033[31mServer is at capacity! Maximum of %d concurrent VMs are allowed.\033[0m", s.config.MaxConcurrentVMs))
-			wish.Println(sess, "\033[31mPlease try again later when some VMs are freed up.\033[0m")
-		} else {
-			wish.Println(sess, fmt.Sprintf("\n\033[31mFailed to provision VM: %v\033[0m", err))
-		}
-		return
 	case <-sess.Context().Done():
 		// Session was cancelled (Ctrl+C), wait for progress bar to clean up
 		<-progressDone
 		s.logger.Printf("SSH session cancelled for user %s during VM creation", user)
+
+		// Release the VM if provisioning still finishes
+		go func() {
+			if result := <-vmResult; result.vm != nil {
+				s.releaseVM(result.vm)
+			}
+		}()
 		return
 	}
 
+	// Users' VMs are kept for the reattach window after their sessions end,
+	// so a dropped connection doesn't lose what they were running
+	reattach := s.config.Reattach > 0 && !attach
 	defer func() {
-		if err := s.vmManager.ReleaseVM(testVM.ID); err != nil {
-			s.logger.Errorf("Error releasing VM %s: %v", testVM.ID, err)
+		if reattach {
+			s.holdVM(testVM, s.config.Reattach)
+		} else {
+			s.releaseVM(testVM)
 		}
 	}()
 
+	events := s.vmManager.Events()
+	var meter *usage.Meter
+	if attach {
+		// Admin sessions are audited, and not counted as the user's own
+		events.Record(testVM.ID, vm.EventAdminAttached, fmt.Sprintf("key %s from %s", admin, remoteAddr))
+		defer events.Record(testVM.ID, vm.EventSessionDetached, fmt.Sprintf("admin from %s", remoteAddr))
+		if s.config.AdminNotify {
+			go s.notifyAttach(testVM, admin)
+		}
+	} else {
+		from := remoteAddr.String()
+		if country != "" {
+			from += " in " + country
+			connectionsByCountry.Inc(country)
+		}
+		events.Record(testVM.ID, vm.EventSessionAttached, "from "+from)
+		defer events.Record(testVM.ID, vm.EventSessionDetached, "from "+from)
+
+		meter = s.usage.Attach(user, s.config.VMMemory)
+		defer s.usage.Detach(user)
+		s.userStats.RecordConnection(user, country)
+		defer s.attachSession(testVM.ID, out)()
+	}
+
 	s.logger.Printf("Created VM %s for user %s (IP: %s)", testVM.ID, user, testVM.IP)
-	s.userStats.RecordConnection(user)
 
-	// Clear progress line and show success
-	wish.Print(sess, "\r\033[2K")
+	// Clear progress line and show success, with how long a fresh VM took
+	// compared to recent boots
+	var bootTime string
+	if !vmExists {
+		elapsed := time.Since(connectedAt)
+		vmBootSeconds.Observe(elapsed.Seconds())
+		if p50, ok := s.userStats.BootTimePercentile(50); ok {
+			bootTime = out.msg("booted_in_p50", formatDuration(elapsed), formatDuration(p50))
+		} else {
+			bootTime = out.msg("booted_in", formatDuration(elapsed))
+		}
+		s.userStats.RecordBootTime(elapsed)
+	}
+	wish.Print(out, "\r\033[2K")
 	completeBars := strings.Repeat("▮", maxProgressBlocks)
-	wish.Println(sess, fmt.Sprintf("\033[32m%s\033[0m 100%%  🧨 \033[32mComplete!\033[0m", completeBars))
-	wish.Println(sess, "")
+	wish.Println(out, fmt.Sprintf("\033[32m%s\033[0m 100%%  🧨 \033[32m%s\033[0m \033[2;37m%s\033[0m", completeBars, out.msg("complete"), bootTime))
+	if debug {
+		s.debugVM(out, connectedAt, testVM)
+	}
+	wish.Println(out, "")
+
+	// Show how to reconnect with mosh, if UDP ports are relayed to this VM
+	// and mosh-server can be run in it
+	if testVM.MoshPorts != (vm.PortRange{}) && !pinned {
+		moshCommand := fmt.Sprintf("mosh -p %s --ssh=\"ssh -p %d\" %s@%s", testVM.MoshPorts, s.config.Port, user, s.publicHost(sess))
+		wish.Println(out, fmt.Sprintf("\033[2;37m%s\033[0m", out.msg("mosh_hint", moshCommand)))
+		wish.Println(out, "")
+	}
+
+	// Show which VM the window is connected to while the session lasts
+	if s.config.TerminalTitle {
+		defer out.setTitle(fmt.Sprintf("%s@%s (ssh-hypervisor)", user, testVM.ID))()
+	}
+
+	// Run interactive sessions in a multiplexer, so the next session can
+	// re-attach to the terminal if this connection drops. Commands from the
+	// client, like mosh-server, run as they are.
+	if _, _, isPty := sess.Pty(); reattach && isPty && (pinned || command == "") {
+		command = multiplexerCommand(s.config.Multiplexer, command)
+	}
 
 	// Start SSH proxy to VM
-	if err := s.proxySSHToVM(sess, testVM.IP.String()); err != nil {
+	if err := s.proxySSHToVM(out, testVM, command, meter); errors.Is(err, vm.ErrVMExited) {
+		s.logger.Warnf("VM %s of user %s exited during the session: %v", testVM.ID, user, err)
+		wish.Println(out, fmt.Sprintf("\r\n\033[31m%s\033[0m", out.msg("vm_exited")))
+		out.flush()
+		sess.Exit(1)
+	} else if err != nil {
 		s.logger.Errorf("SSH proxy error for user %s: %v", user, err)
-		wish.Println(sess, fmt.Sprintf("\033[31mConnection to VM failed: %v\033[0m", err))
+		wish.Println(out, fmt.Sprintf("\033[31m%s\033[0m", out.msg("connection_failed", err)))
 	}
 
-	s.logger.Printf("SSH session ended for user %s, destroying VM %s", user, testVM.ID)
+	s.logger.Printf("SSH session ended for user %s on VM %s", user, testVM.ID)
+}
+
+// egressCheckInterval is how often VMs' outbound connections are checked
+const egressCheckInterval = 10 * time.Second
+
+// breakInCheckInterval is how often connections to VMs' SSH servers are checked
+const breakInCheckInterval = 30 * time.Second
+
+// guestDialTimeout bounds connecting to a VM's sshd when no connection is cached
+const guestDialTimeout = 10 * time.Second
+
+// stopGracePeriod is how long stopping a VM may take beyond the guest's
+// shutdown timeout before it is killed
+const stopGracePeriod = 5 * time.Second
+
+// provisionResult is the outcome of getting a ready VM for a session
+type provisionResult struct {
+	vm  *vm.VM
+	err error
+}
+
+// releaseVM drops a session's reference to its VM. The session is already
+// gone, so stopping the VM gets its own deadline.
+func (s *Server) releaseVM(testVM *vm.VM) {
+	if testVM.ExitErr() != nil {
+		// The manager already cleaned up after the VM
+		return
+	}
+	if current, running := s.vmManager.GetVM(testVM.ID); !running || current != testVM {
+		// The VM was stopped already, like by a scheduled job or to make
+		// room for another, and the one running now isn't this session's
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout+stopGracePeriod)
+	defer cancel()
+	if err := s.vmManager.ReleaseVM(ctx, testVM.ID); err != nil {
+		s.logger.Errorf("Error releasing VM %s: %v", testVM.ID, err)
+	}
 }
 
 // showWelcomeMessage displays the welcome message with user stats
-func (s *Server) showWelcomeMessage(sess ssh.Session, user string, isNewVM bool) {
-	now := time.Now()
-	dayOfWeek := now.Weekday().String()
+func (s *Server) showWelcomeMessage(out *terminal, user string, isNewVM bool) {
+	dayOfWeek := out.msg(weekdays[time.Now().Weekday()])
 
-	wish.Println(sess, fmt.Sprintf("\n\033[1;35mHello, %s! 🌸\033[0m", user))
-	wish.Println(sess, "")
+	wish.Println(out, fmt.Sprintf("\n\033[1;35m%s 🌸\033[0m", out.msg("hello", user)))
+	wish.Println(out, "")
 
 	// Check if this is the user's first time
 	userStat, exists := s.userStats.GetUserStat(user)
 	if !exists {
-		wish.Println(sess, fmt.Sprintf("Today is \033[3m%s\033[0m. It's your first time here.", dayOfWeek))
+		wish.Println(out, out.msg("first_visit", italic(dayOfWeek)))
 	} else {
-		lastLogin := formatRelativeTime(userStat.LastConnected)
-		wish.Println(sess, fmt.Sprintf("Today is \033[3m%s\033[0m. Your last login was \033[3m%s\033[0m.", dayOfWeek, lastLogin))
+		lastLogin := out.relativeTime(userStat.LastConnected)
+		wish.Println(out, out.msg("last_login", italic(dayOfWeek), italic(lastLogin)))
 	}
 
-	wish.Println(sess, "")
+	wish.Println(out, "")
 
 	// Show recent logins table
 	recentUsers := s.userStats.GetRecentUsers(user, 10)
 	if len(recentUsers) > 0 {
-		wish.Println(sess, "\033[2;37mRecent logins:\033[0m")
+		wish.Println(out, fmt.Sprintf("\033[2;37m%s\033[0m", out.msg("recent_logins")))
 
 		var buf bytes.Buffer
 		table := tablewriter.NewTable(&buf,
-			tablewriter.WithHeader([]string{"User", "Last login"}),
+			tablewriter.WithHeader([]string{out.msg("column_user"), out.msg("column_last_login")}),
 		)
 		for _, userStat := range recentUsers {
-			lastLogin := formatRelativeTime(userStat.LastConnected)
+			lastLogin := out.relativeTime(userStat.LastConnected)
 			table.Append([]string{userStat.Username, lastLogin})
 		}
 
 		table.Render()
-		wish.Print(sess, buf.String())
+		wish.Print(out, buf.String())
 	} else {
-		wish.Println(sess, "You're the first user to connect! 🎉")
+		wish.Println(out, out.msg("first_user")+" 🎉")
 	}
 
-	wish.Println(sess, "")
+	wish.Println(out, "")
+	s.showQuotaWarning(out, user)
+	if s.config.RootfsMode == internal.RootfsEphemeral {
+		wish.Println(out, fmt.Sprintf("\033[33m%s\033[0m", out.msg("demo_vm")))
+	}
+	if s.config.ShowCapacity {
+		s.showCapacity(out)
+	}
 	if isNewVM {
-		wish.Println(sess, "\033[2;37mBooting your fresh VM...\033[0m")
+		wish.Println(out, fmt.Sprintf("\033[2;37m%s\033[0m", out.msg("booting")))
 	} else {
-		wish.Println(sess, "\033[2;37mConnecting to VM...\033[0m")
+		wish.Println(out, fmt.Sprintf("\033[2;37m%s\033[0m", out.msg("connecting")))
 	}
 }
 
-// formatRelativeTime formats a time as a human-readable relative time
-func formatRelativeTime(t time.Time) string {
-	now := time.Now()
-	diff := now.Sub(t)
-
-	if diff < 5*time.Second {
-		return "just now"
-	} else if diff < time.Minute {
-		seconds := int(diff.Seconds())
-		return fmt.Sprintf("%d seconds ago", seconds)
-	} else if diff < time.Hour {
-		minutes := int(diff.Minutes())
-		if minutes == 1 {
-			return "1 minute ago"
-		}
-		return fmt.Sprintf("%d minutes ago", minutes)
-	} else if diff < 24*time.Hour {
-		hours := int(diff.Hours())
-		if hours == 1 {
-			return "1 hour ago"
-		}
-		return fmt.Sprintf("%d hours ago", hours)
-	} else {
-		days := int(diff.Hours() / 24)
-		if days == 1 {
-			return "1 day ago"
-		}
-		return fmt.Sprintf("%d days ago", days)
+// showCapacity tells users how busy the server is, in yellow when it is
+// nearly full
+func (s *Server) showCapacity(out *terminal) {
+	active, capacity := s.vmManager.GetActiveVMCount(), s.vmManager.Capacity()
+	color := "2;37"
+	if active*10 >= capacity*9 {
+		color = "33"
 	}
+	wish.Println(out, fmt.Sprintf("\033[%sm%s\033[0m", color, out.msg("vms_in_use", active, capacity)))
 }
 
-// showProgressBarWithHealthCheck displays an animated exponential progress bar
-func (s *Server) showProgressBarWithHealthCheck(sess ssh.Session, ctx context.Context, vmReady <-chan string, vmCreateFailed <-chan struct{}) {
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
-
-	startTime := time.Now()
-	completed := false
-
-	// Ensure clean exit on context cancellation
-	defer func() {
-		if ctx.Err() != nil || sess.Context().Err() != nil {
-			// Clear progress line if cancelled
-			wish.Print(sess, "\r\033[2K")
-			wish.Println(sess, "\n\033[33mCancelled during VM provisioning.\033[0m")
-		}
-	}()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-sess.Context().Done():
-			// Session context cancelled (Ctrl+C)
-			return
-		case <-vmCreateFailed:
-			// VM creation failed, clear progress line and return
-			wish.Print(sess, "\r\033[2K")
-			return
-		case <-vmReady:
-			// VM is ready, jump to 100%
-			if !completed {
-				completed = true
-				bar := strings.Repeat("▮", maxProgressBlocks)
-				wish.Print(sess, fmt.Sprintf("\r\033[36m%s\033[0m 100%%", bar))
-				return
-			}
-		case <-ticker.C:
-			if completed {
-				return
-			}
-
-			// Check for cancellation before updating display
-			select {
-			case <-ctx.Done():
-				return
-			case <-sess.Context().Done():
-				return
-			case <-vmCreateFailed:
-				// VM creation failed, clear progress line and return
-				wish.Print(sess, "\r\033[2K")
-				return
-			default:
-			}
-
-			// Exponential progress: fast at start, slower at end
-			// Using exponential decay formula: 1 - e^(-k*t)
-			elapsed := time.Since(startTime).Seconds()
-			progress := int(100 * (1 - math.Exp(-1.2*elapsed)))
-
-			// Cap at 99% until VM is actually ready
-			if progress > 99 {
-				progress = 99
-			}
-
-			// Calculate filled blocks
-			filled := (progress * maxProgressBlocks) / 100
-			if filled > maxProgressBlocks {
-				filled = maxProgressBlocks
-			}
-
-			// Build progress bar
-			bar := strings.Repeat("▮", filled) + strings.Repeat("▯", maxProgressBlocks-filled)
+// italic styles text in italics
+func italic(text string) string {
+	return "\033[3m" + text + "\033[0m"
+}
 
-			// Update progress line
-			wish.Print(sess, fmt.Sprintf("\r\033[36m%s\033[0m %d%%", bar, progress))
-		}
+// publicHost returns the hostname users should connect to for this server
+func (s *Server) publicHost(sess ssh.Session) string {
+	if s.config.PublicHost != "" {
+		return s.config.PublicHost
 	}
+	host, _, err := net.SplitHostPort(sess.LocalAddr().String())
+	if err != nil {
+		return sess.LocalAddr().String()
+	}
+	return host
 }
 
-// proxySSHToVM establishes a transparent SSH proxy to the VM
-func (s *Server) proxySSHToVM(sess ssh.Session, vmIP string) error {
-	// Wait for VM SSH service to be ready (with timeout)
-	vmAddr := fmt.Sprintf("%s:22", vmIP)
-	if err := s.waitForVMSSH(sess.Context(), vmAddr); err != nil {
-		return fmt.Errorf("VM SSH service not ready: %w", err)
-	}
-
-	// Create SSH client connection to VM
-	config := &cryptoSSH.ClientConfig{
-		User: "root", // VMs run as root by default
-		Auth: []cryptoSSH.AuthMethod{
-			cryptoSSH.Password(""), // Empty password for now
-			cryptoSSH.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-				// Accept any keyboard interactive challenge
-				answers := make([]string, len(questions))
-				return answers, nil
-			}),
-		},
-		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(), // Skip host key verification for VMs
-		Timeout:         10 * time.Second,
+// formatDuration formats a short duration like "830ms" or "1.2s"
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
 	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
 
-	// Connect to VM SSH server
-	vmClient, err := cryptoSSH.Dial("tcp", vmAddr, config)
+// proxySSHToVM proxies a session over the VM's shared guest connection,
+// running command instead of the default shell if it is not empty and
+// counting traffic on meter if it is not nil
+func (s *Server) proxySSHToVM(sess *terminal, testVM *vm.VM, command string, meter *usage.Meter) error {
+	dialCtx, cancel := context.WithTimeout(sess.Context(), guestDialTimeout)
+	defer cancel()
+	vmClient, release, err := testVM.GuestClient(dialCtx)
 	if err != nil {
-		return fmt.Errorf("failed to connect to VM SSH: %w", err)
+		return err
 	}
-	defer vmClient.Close()
+	defer release()
 
 	// Create a session on the VM
 	vmSession, err := vmClient.NewSession()
@@ -500,9 +965,9 @@ func (s *Server) proxySSHToVM(sess ssh.Session, vmIP string) error {
 	defer vmSession.Close()
 
 	// Set up pipes between the client session and VM session
-	vmSession.Stdin = sess
-	vmSession.Stdout = sess
-	vmSession.Stderr = sess.Stderr()
+	vmSession.Stdin = meter.CountIn(sess)
+	vmSession.Stdout = meter.CountOut(sess.rawOut())
+	vmSession.Stderr = meter.CountOut(sess.rawErr())
 
 	// Forward environment variables
 	for _, env := range sess.Environ() {
@@ -515,7 +980,11 @@ func (s *Server) proxySSHToVM(sess ssh.Session, vmIP string) error {
 	// Handle terminal requests
 	pty, winCh, isPty := sess.Pty()
 	if isPty {
-		if err := vmSession.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, cryptoSSH.TerminalModes{}); err != nil {
+		modes := pty.Modes
+		if modes == nil {
+			modes = cryptoSSH.TerminalModes{}
+		}
+		if err := vmSession.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, modes); err != nil {
 			return fmt.Errorf("failed to request pty: %w", err)
 		}
 
@@ -527,8 +996,12 @@ func (s *Server) proxySSHToVM(sess ssh.Session, vmIP string) error {
 		}()
 	}
 
-	// Start shell on VM
-	if err := vmSession.Shell(); err != nil {
+	// Start the configured program or a shell on the VM
+	if command != "" {
+		if err := vmSession.Start(command); err != nil {
+			return fmt.Errorf("failed to start %q: %w", command, err)
+		}
+	} else if err := vmSession.Shell(); err != nil {
 		return fmt.Errorf("failed to start shell: %w", err)
 	}
 
@@ -540,34 +1013,18 @@ func (s *Server) proxySSHToVM(sess ssh.Session, vmIP string) error {
 
 	select {
 	case err := <-done:
-		// VM session ended normally
+		// VM session ended normally, or because the VM went away
+		if exitErr := testVM.ExitErr(); exitErr != nil {
+			return exitErr
+		}
 		return err
+	case <-testVM.Exited():
+		// The VMM died, so the guest connection would hang until it timed out
+		vmSession.Close()
+		return testVM.ExitErr()
 	case <-sess.Context().Done():
 		// Client session was cancelled (Ctrl+C)
 		vmSession.Close()
 		return sess.Context().Err()
 	}
 }
-
-// waitForVMSSH waits for the VM's SSH service to become available
-func (s *Server) waitForVMSSH(ctx context.Context, vmAddr string) error {
-	timeout := time.After(15 * time.Second)
-	ticker := time.NewTicker(200 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-timeout:
-			return fmt.Errorf("timeout waiting for VM SSH service")
-		case <-ticker.C:
-			conn, err := net.DialTimeout("tcp", vmAddr, 1*time.Second)
-			if err == nil {
-				conn.Close()
-				s.logger.Printf("VM SSH service is ready at %s", vmAddr)
-				return nil
-			}
-		}
-	}
-}
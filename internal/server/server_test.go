@@ -0,0 +1,2450 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/usage"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"github.com/sirupsen/logrus"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes and reads
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startTestServer runs a server backed by fake VMs on a loopback port, calling
+// setup functions before it starts serving
+func startTestServer(t *testing.T, config *internal.Config, setup ...func(*Server)) (*Server, string) {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	rootfsPath := filepath.Join(tempDir, "rootfs.ext4")
+	if err := os.WriteFile(rootfsPath, []byte("fake rootfs content"), 0644); err != nil {
+		t.Fatalf("Failed to create fake rootfs: %v", err)
+	}
+
+	config.VMCIDR = "192.168.100.0/28"
+	config.VMMemory = 128
+	config.VMCPUs = 1
+	config.DataDir = tempDir
+	config.Rootfs = rootfsPath
+
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	manager, err := vm.NewManagerWithBackend(config, logger, vm.NewFakeBackend(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create VM manager: %v", err)
+	}
+
+	s := newServer(config, logger, manager, nil)
+	for _, f := range setup {
+		f(s)
+	}
+	hostKey, err := s.loadOrGenerateHostKey()
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	sshServer := s.newSSHServer(hostKey)
+	go sshServer.Serve(ln)
+	t.Cleanup(func() {
+		sshServer.Close()
+		// VMs of closed sessions write to the data directory as they are
+		// destroyed, so let them finish stopping before it is removed
+		deadline := time.Now().Add(5 * time.Second)
+		for !vmsDrained(manager) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	return s, ln.Addr().String()
+}
+
+// vmsDrained reports whether the manager holds no VMs, counting ones that are
+// still starting or stopping
+func vmsDrained(manager *vm.Manager) bool {
+	for _, count := range manager.StateCounts() {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dialTestServer connects to the test server as the given user
+func dialTestServer(t *testing.T, addr, user string) *cryptoSSH.Client {
+	t.Helper()
+
+	client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+		User:            user,
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.Password("")},
+		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	return client
+}
+
+// waitForOutput polls buf until it contains want or the timeout expires
+func waitForOutput(t *testing.T, buf *lockedBuffer, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(buf.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %q in output:\n%s", want, buf.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSessionEndToEnd(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{})
+
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	var output lockedBuffer
+	session.Stdout = &output
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+
+	waitForOutput(t, &output, "Hello, alice!")
+	waitForOutput(t, &output, "Complete!")
+	waitForOutput(t, &output, "Your VM booted in")
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	if _, err := io.WriteString(stdin, "echo from client\n"); err != nil {
+		t.Fatalf("Failed to write to stdin: %v", err)
+	}
+	waitForOutput(t, &output, "echo from client")
+
+	if count := s.vmManager.GetActiveVMCount(); count != 1 {
+		t.Errorf("Expected 1 active VM, got %d", count)
+	}
+
+	io.WriteString(stdin, "exit\n")
+	session.Wait()
+
+	// The VM is released once the only session ends
+	deadline := time.Now().Add(5 * time.Second)
+	for s.vmManager.GetActiveVMCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected VM to be destroyed after session ended")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, exists := s.userStats.GetUserStat("alice"); !exists {
+		t.Errorf("Expected connection to be recorded in user stats")
+	}
+
+	// The VM's timeline is served by the admin API, ending once it is destroyed
+	expected := []vm.EventKind{vm.EventCreated, vm.EventBooted, vm.EventSessionAttached, vm.EventSessionDetached, vm.EventDestroyed}
+	var kinds []vm.EventKind
+	for len(kinds) < len(expected) && time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/vms/alice/events", nil))
+		var events []vm.Event
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+			t.Fatalf("Failed to decode events: %v", err)
+		}
+		kinds = kinds[:0]
+		for _, event := range events {
+			kinds = append(kinds, event.Kind)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v, got %v", expected, kinds)
+	}
+}
+
+func TestVMExitDuringSession(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{})
+
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	var output lockedBuffer
+	session.Stdout = &output
+	stdin, _ := session.StdinPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	// The session ends with a message instead of hanging when the VMM dies
+	io.WriteString(stdin, "crash\n")
+	waitForOutput(t, &output, "Your VM crashed")
+	session.Wait()
+
+	if count := s.vmManager.GetActiveVMCount(); count != 0 {
+		t.Errorf("Expected the exited VM to be cleaned up, got %d active", count)
+	}
+	var exited bool
+	for _, event := range s.vmManager.Events().Events("alice") {
+		exited = exited || event.Kind == vm.EventExited
+	}
+	if !exited {
+		t.Errorf("Expected an exited event, got %+v", s.vmManager.Events().Events("alice"))
+	}
+}
+func TestHealthz(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{})
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("Expected 200 ok, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{})
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("Expected 200 ok, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Servers in maintenance mode don't take new users
+	os.WriteFile(filepath.Join(s.config.DataDir, maintenanceFile), []byte("upgrading"), 0644)
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "upgrading") {
+		t.Errorf("Expected 503 in maintenance mode, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestVersionsAPI(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{})
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/versions", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %q", rec.Code, rec.Body.String())
+	}
+	var versions vm.Versions
+	if err := json.Unmarshal(rec.Body.Bytes(), &versions); err != nil {
+		t.Fatalf("Failed to parse versions: %v", err)
+	}
+	if versions.Firecracker != "fake" || versions.Kernel != "fake" {
+		t.Errorf("Expected the fake backend's versions, got %+v", versions)
+	}
+}
+
+func TestScheduleVM(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{NodeName: "node-a", HTTPAddr: ":9090"})
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/api/vms/bob?hold=forever", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid hold, got %d", rec.Code)
+	}
+
+	// The VM boots right away, outlives the request, and is released once
+	// the hold expires
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/api/vms/bob?hold=500ms", nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, ok := s.vmManager.GetVM("bob"); !ok || v.ExitErr() != nil {
+		t.Errorf("Expected scheduled VM to be running after the request")
+	}
+	status := s.nodeStatus()
+	if status.Active != 1 || status.SSHAddr != net.JoinHostPort("node-a", fmt.Sprint(s.config.Port)) || status.HTTPAddr != "node-a:9090" {
+		t.Errorf("Unexpected node status %+v", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.vmManager.GetActiveVMCount() != 0 || s.vmManager.Busy("bob") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected scheduled VM to be released after its hold")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestProvisionVMs boots VMs the way the provision command does, over HTTP
+// and in parallel, and checks they are all still running afterwards
+func TestProvisionVMs(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{})
+	api := httptest.NewServer(s.httpHandler())
+	defer api.Close()
+
+	users := []string{"alice", "bob", "carol"}
+	var wg sync.WaitGroup
+	for _, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(api.URL+"/api/vms/"+user+"?hold=1s&label=workshop=2024", "", nil)
+			if err != nil {
+				t.Errorf("Failed to provision %s: %v", user, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("Expected 201 provisioning %s, got %d", user, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	for _, user := range users {
+		v, ok := s.vmManager.GetVM(user)
+		if !ok || v.ExitErr() != nil {
+			t.Errorf("Expected %s's VM to be running after provisioning", user)
+			continue
+		}
+		if labels, _ := s.vmManager.Labels(user); labels["workshop"] != "2024" {
+			t.Errorf("Expected %s's VM to be labeled, got %v", user, labels)
+		}
+	}
+}
+
+func TestVMLabels(t *testing.T) {
+	labelsPath := filepath.Join(t.TempDir(), "labels.json")
+	os.WriteFile(labelsPath, []byte(`{"*": {"class": "workshop-2024"}, "bob": {"role": "ta"}}`), 0644)
+	s, _ := startTestServer(t, &internal.Config{VMLabels: labelsPath})
+	handler := s.httpHandler()
+
+	// Scheduled VMs get their profile's labels plus any passed by the caller
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/vms/bob?hold=500ms&label=team=a", nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/vms/carol/labels", strings.NewReader(`{"class": "other"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 setting labels, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/vms/carol/labels", strings.NewReader(`{"bad key": "x"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid label, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/vms?label=class=workshop-2024", nil))
+	var vms []vm.VMInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &vms); err != nil {
+		t.Fatalf("Failed to decode VM list: %v", err)
+	}
+	want := map[string]string{"class": "workshop-2024", "role": "ta", "team": "a"}
+	if len(vms) != 1 || vms[0].ID != "bob" || !vms[0].Running || fmt.Sprint(vms[0].Labels) != fmt.Sprint(want) {
+		t.Errorf("Expected only bob with labels %v, got %+v", want, vms)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `sshhv_running_vms_by_label{label="class=workshop-2024"} 1`) || strings.Contains(body, "class=other") {
+		t.Errorf("Expected running VMs to be counted by label, got:\n%s", body)
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, bad := range []string{"0 18 * * *", "0 18 * * * reboot", "0 18 * * * destroy", "0 25 * * * stop", "0 18 * * * stop class"} {
+		path := filepath.Join(dir, "bad")
+		os.WriteFile(path, []byte(bad+"\n"), 0644)
+		if _, err := loadSchedule(path); err == nil {
+			t.Errorf("Expected error for schedule line %q", bad)
+		}
+	}
+	path := filepath.Join(dir, "schedule")
+	os.WriteFile(path, []byte("# Nightly restart\n0 3 * * * stop\n\n0 18 * * 1-5 destroy workshop=*\n"), 0644)
+	jobs, err := loadSchedule(path)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("Failed to load schedule: %v, %v", jobs, err)
+	}
+	stop, destroy := jobs[0], jobs[1]
+
+	s, _ := startTestServer(t, &internal.Config{})
+	s.vmManager.SetLabels("alice", map[string]string{"workshop": "2024"})
+	s.vmManager.SetLabels("bob", map[string]string{"team": "a"})
+	if _, err := s.scheduleVM("alice", nil); err != nil {
+		t.Fatalf("Failed to start VM: %v", err)
+	}
+	if _, err := s.scheduleVM("bob", nil); err != nil {
+		t.Fatalf("Failed to start VM: %v", err)
+	}
+	ctx := context.Background()
+
+	// Dry runs change nothing
+	s.config.ScheduleDryRun = true
+	s.runScheduledJob(ctx, stop)
+	s.runScheduledJob(ctx, destroy)
+	if count := s.vmManager.GetActiveVMCount(); count != 2 {
+		t.Fatalf("Expected dry run to leave 2 VMs running, got %d", count)
+	}
+
+	// Destroying by label stops and removes only the matching VM
+	s.config.ScheduleDryRun = false
+	s.runScheduledJob(ctx, destroy)
+	if _, running := s.vmManager.GetVM("alice"); running {
+		t.Errorf("Expected alice's VM to be stopped")
+	}
+	if _, err := os.Stat(filepath.Join(s.config.DataDir, "alice")); !os.IsNotExist(err) {
+		t.Errorf("Expected alice's data to be removed, got %v", err)
+	}
+	if _, running := s.vmManager.GetVM("bob"); !running {
+		t.Errorf("Expected bob's VM to keep running")
+	}
+
+	// Stopping keeps the data
+	s.runScheduledJob(ctx, stop)
+	if count := s.vmManager.GetActiveVMCount(); count != 0 {
+		t.Errorf("Expected all VMs to be stopped, got %d", count)
+	}
+	if labels, _ := s.vmManager.Labels("bob"); labels["team"] != "a" {
+		t.Errorf("Expected bob's data to be kept, got labels %v", labels)
+	}
+	var scheduled bool
+	for _, event := range s.vmManager.Events().Events("bob") {
+		scheduled = scheduled || event.Kind == vm.EventScheduled
+	}
+	if !scheduled {
+		t.Errorf("Expected the scheduled stop in bob's timeline")
+	}
+}
+
+func TestMemoryCommand(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{VMMaxMemory: 512})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	run := func(command string) (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		output, err := session.CombinedOutput(command)
+		return string(output), err
+	}
+
+	if output, err := run("memory 256"); err != nil || !strings.Contains(output, "now has 256 MB") {
+		t.Errorf("Expected resize to succeed, got %q, %v", output, err)
+	}
+	if output, err := run("memory 4096"); err == nil || !strings.Contains(output, "between 128 and 512 MB") {
+		t.Errorf("Expected resize beyond the limit to fail, got %q, %v", output, err)
+	}
+	if output, _ := run("memory"); !strings.Contains(output, "256 MB of memory, and can have up to 512 MB") {
+		t.Errorf("Unexpected memory status %q", output)
+	}
+	if s.vmManager.GetActiveVMCount() != 0 {
+		t.Errorf("Expected no VM to be started by the memory command")
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("PUT", "/api/vms/alice/memory", strings.NewReader(`{"memory_mb": 384}`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"memory_mb":384`) {
+		t.Errorf("Expected admin resize to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSnapshotCommand(t *testing.T) {
+	config := &internal.Config{Snapshots: 1}
+	_, addr := startTestServer(t, config)
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	run := func(command string) (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		output, err := session.CombinedOutput(command)
+		return string(output), err
+	}
+
+	os.MkdirAll(filepath.Join(config.DataDir, "alice"), 0755)
+	os.WriteFile(filepath.Join(config.DataDir, "alice", "rootfs.img"), []byte("disk"), 0644)
+	if output, err := run("snapshot save before-upgrade"); err != nil || !strings.Contains(output, "Saved snapshot before-upgrade.") {
+		t.Errorf("Expected snapshot to succeed, got %q, %v", output, err)
+	}
+	if output, _ := run("snapshot"); !strings.Contains(output, "before-upgrade") {
+		t.Errorf("Expected the snapshot to be listed, got %q", output)
+	}
+	if output, err := run("snapshot save another"); err == nil || !strings.Contains(output, "the most allowed") {
+		t.Errorf("Expected a snapshot over the limit to fail, got %q, %v", output, err)
+	}
+	if output, err := run("snapshot restore"); err == nil || !strings.Contains(output, "Usage: snapshot") {
+		t.Errorf("Expected usage without a name, got %q, %v", output, err)
+	}
+	if output, err := run("snapshot restore before-upgrade"); err != nil || !strings.Contains(output, "Restored snapshot before-upgrade.") {
+		t.Errorf("Expected restore to succeed, got %q, %v", output, err)
+	}
+
+	// Disks aren't changed in maintenance mode
+	os.WriteFile(filepath.Join(config.DataDir, maintenanceFile), nil, 0644)
+	if output, _ := run("snapshot restore before-upgrade"); !strings.Contains(output, "maintenance") {
+		t.Errorf("Expected restore to be refused in maintenance mode, got %q", output)
+	}
+}
+
+func TestCapacityLimit(t *testing.T) {
+	_, addr := startTestServer(t, &internal.Config{MaxConcurrentVMs: 1})
+
+	first := dialTestServer(t, addr, "alice")
+	defer first.Close()
+	firstSession, err := first.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer firstSession.Close()
+	var firstOutput lockedBuffer
+	firstSession.Stdout = &firstOutput
+	// Keep stdin open so the first VM stays in use
+	if _, err := firstSession.StdinPipe(); err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := firstSession.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &firstOutput, "Welcome to fake VM alice")
+
+	second := dialTestServer(t, addr, "bob")
+	defer second.Close()
+	secondSession, err := second.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer secondSession.Close()
+	var secondOutput lockedBuffer
+	secondSession.Stdout = &secondOutput
+	if err := secondSession.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &secondOutput, "Server is at capacity")
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{QuotaHours: 1, UsageInterval: time.Minute})
+	s.ledger.Add(usage.Record{User: "alice", End: time.Now(), VMSeconds: 3600})
+
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "You have used all 1 of your VM-hours")
+
+	if count := s.vmManager.GetActiveVMCount(); count != 0 {
+		t.Errorf("Expected no VM for a user over quota, got %d", count)
+	}
+}
+
+func TestTrafficQuotaExhausted(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{CountTraffic: true, QuotaTraffic: 1, UsageInterval: time.Minute})
+	s.ledger.Add(usage.Record{User: "alice", End: time.Now(), NetBytesIn: 6e8, NetBytesOut: 4e8})
+
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "You have used all 1 GB of your traffic")
+
+	if count := s.vmManager.GetActiveVMCount(); count != 0 {
+		t.Errorf("Expected no VM for a user over their traffic quota, got %d", count)
+	}
+}
+
+// runSubsystem sends input to a subsystem and returns everything it writes
+func runSubsystem(t *testing.T, client *cryptoSSH.Client, name, input string) string {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdout: %v", err)
+	}
+	if err := session.RequestSubsystem(name); err != nil {
+		t.Fatalf("Failed to request %s subsystem: %v", name, err)
+	}
+	io.WriteString(stdin, input)
+	stdin.Close()
+
+	output, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Failed to read %s output: %v", name, err)
+	}
+	return string(output)
+}
+
+func TestSubsystems(t *testing.T) {
+	_, addr := startTestServer(t, &internal.Config{ProxySubsystems: "echo"}, func(s *Server) {
+		s.RegisterSubsystem("hvctl", func(sess ssh.Session) {
+			io.WriteString(sess, "hello from host\n")
+			sess.Exit(0)
+		})
+	})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	// Host-side subsystems are handled without a VM
+	if out := runSubsystem(t, client, "hvctl", ""); out != "hello from host\n" {
+		t.Errorf("Unexpected hvctl output %q", out)
+	}
+
+	// Proxied subsystems are forwarded to the VM's sshd
+	if out := runSubsystem(t, client, "echo", "ping"); out != "ping" {
+		t.Errorf("Expected VM to echo %q, got %q", "ping", out)
+	}
+
+	// Unknown subsystems are refused
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	if err := session.RequestSubsystem("netconf"); err == nil {
+		t.Errorf("Expected unregistered subsystem to be refused")
+	}
+}
+
+func TestSessionCommand(t *testing.T) {
+	commandsFile := filepath.Join(t.TempDir(), "commands")
+	os.WriteFile(commandsFile, []byte("# Per-user programs\nbob  python3 -q\n"), 0644)
+	_, addr := startTestServer(t, &internal.Config{SessionCommand: "rbash", SessionCommands: commandsFile})
+
+	for user, want := range map[string]string{"alice": "rbash", "bob": "python3 -q"} {
+		client := dialTestServer(t, addr, user)
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		var output lockedBuffer
+		session.Stdout = &output
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Failed to start shell: %v", err)
+		}
+		// The fake guest echoes the command it was asked to run
+		waitForOutput(t, &output, "Complete!")
+		waitForOutput(t, &output, want+"\n")
+		session.Close()
+		client.Close()
+	}
+
+	if _, err := loadSessionCommands(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected error for missing commands file")
+	}
+	os.WriteFile(commandsFile, []byte("carol\n"), 0644)
+	if _, err := loadSessionCommands(commandsFile); err == nil {
+		t.Errorf("Expected error for a line without a command")
+	}
+}
+
+// recordingSession is a session that records what is written to it
+type recordingSession struct {
+	ssh.Session
+	buf bytes.Buffer
+}
+
+func TestClientCommand(t *testing.T) {
+	commandsFile := filepath.Join(t.TempDir(), "commands")
+	os.WriteFile(commandsFile, []byte("bob rbash\n"), 0644)
+	_, addr := startTestServer(t, &internal.Config{SessionCommands: commandsFile})
+
+	run := func(user, command string) string {
+		client := dialTestServer(t, addr, user)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		output, _ := session.CombinedOutput(command)
+		return string(output)
+	}
+
+	// The fake guest echoes the command it was asked to run
+	if output := run("alice", "mosh-server new -p 60000"); !strings.HasSuffix(output, "\nmosh-server new -p 60000\n") {
+		t.Errorf("Expected the client's command to run in the VM, got %q", output)
+	}
+	if output := run("bob", "mosh-server new -p 60000"); !strings.HasSuffix(output, "\nrbash\n") {
+		t.Errorf("Expected the session command to win over the client's, got %q", output)
+	}
+}
+
+func TestConnectionBundle(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{Port: 2222, PublicHost: "vmcity.example.com", MoshPorts: "60000-60009", MoshPortsPerVM: 10})
+
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	output, err := session.Output(bundleCommand)
+	if err != nil {
+		t.Fatalf("Failed to run bundle command: %v", err)
+	}
+
+	bundle := string(output)
+	for _, want := range []string{"HostName vmcity.example.com\n", "Port 2222\n", "User alice\n", "mosh udp ports are assigned when your VM starts"} {
+		if !strings.Contains(bundle, want) {
+			t.Errorf("Expected bundle to contain %q, got:\n%s", want, bundle)
+		}
+	}
+
+	// The known_hosts entry has the server's host key
+	var entry string
+	for _, line := range strings.Split(bundle, "\n") {
+		if strings.HasPrefix(line, "[vmcity.example.com]:2222 ") {
+			entry = line
+		}
+	}
+	_, hosts, key, _, _, err := cryptoSSH.ParseKnownHosts([]byte(entry))
+	if err != nil {
+		t.Fatalf("Failed to parse known_hosts entry %q: %v", entry, err)
+	}
+	hostKey, err := s.loadOrGenerateHostKey()
+	if err != nil {
+		t.Fatalf("Failed to load host key: %v", err)
+	}
+	if len(hosts) != 1 || !bytes.Equal(key.Marshal(), hostKey.PublicKey().Marshal()) {
+		t.Errorf("Unexpected known_hosts entry %q", entry)
+	}
+
+	if s.vmManager.GetActiveVMCount() != 0 {
+		t.Errorf("Expected no VM to be started for the bundle")
+	}
+}
+
+func TestAdminAttach(t *testing.T) {
+	adminKey := generateTestSigner(t)
+	otherKey := generateTestSigner(t)
+	keysPath := filepath.Join(t.TempDir(), "admin_keys")
+	if err := os.WriteFile(keysPath, cryptoSSH.MarshalAuthorizedKey(adminKey.PublicKey()), 0644); err != nil {
+		t.Fatalf("Failed to write admin keys: %v", err)
+	}
+	s, addr := startTestServer(t, &internal.Config{AdminKeys: keysPath})
+
+	// Only admin keys may attach, and never with a password
+	for _, auth := range []cryptoSSH.AuthMethod{cryptoSSH.Password(""), cryptoSSH.PublicKeys(otherKey)} {
+		if _, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            "attach+alice",
+			Auth:            []cryptoSSH.AuthMethod{auth},
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		}); err == nil {
+			t.Errorf("Expected attach without an admin key to be refused")
+		}
+	}
+
+	client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+		User:            "attach+alice",
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.PublicKeys(adminKey)},
+		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to attach with admin key: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Attaching to the VM of alice as an administrator")
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	// The attach is audited in the VM's timeline, but isn't the user's login
+	var attached bool
+	for _, event := range s.vmManager.Events().Events("alice") {
+		if event.Kind == vm.EventAdminAttached && strings.Contains(event.Detail, cryptoSSH.FingerprintSHA256(adminKey.PublicKey())) {
+			attached = true
+		}
+	}
+	if !attached {
+		t.Errorf("Expected admin attach event with the key fingerprint")
+	}
+	if _, exists := s.userStats.GetUserStat("alice"); exists {
+		t.Errorf("Expected admin attach not to be recorded as a login of alice")
+	}
+}
+
+// generateTestSigner returns a fresh ed25519 SSH key
+func generateTestSigner(t *testing.T) cryptoSSH.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := cryptoSSH.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func TestSSHFPRecords(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{})
+	signer, err := s.loadOrGenerateHostKey()
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	key, err := LoadHostPublicKey(filepath.Join(s.config.DataDir, "ssh_host_ed25519_key"))
+	if err != nil {
+		t.Fatalf("Failed to load host key: %v", err)
+	}
+	if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("Loaded public key doesn't match the host key")
+	}
+
+	records, err := SSHFPRecords("vmcity.example.com", key)
+	if err != nil {
+		t.Fatalf("Failed to generate SSHFP records: %v", err)
+	}
+	// The SHA-256 record holds the same digest as the key's fingerprint
+	digest, _ := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(cryptoSSH.FingerprintSHA256(key), "SHA256:"))
+	expected := []string{"vmcity.example.com. IN SSHFP 4 1 ", fmt.Sprintf("vmcity.example.com. IN SSHFP 4 2 %x", digest)}
+	if len(records) != 2 || !strings.HasPrefix(records[0], expected[0]) || len(records[0]) != len(expected[0])+40 || records[1] != expected[1] {
+		t.Errorf("Expected records like %q, got %q", expected, records)
+	}
+}
+
+func (r *recordingSession) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+func TestTerminalFallbacks(t *testing.T) {
+	line := "\033[32m▮▮▯\033[0m 100%  🧨 \033[32mComplete!\033[0m ┌─┐ José"
+	cases := []struct {
+		ansi, utf8 bool
+		want       string
+	}{
+		{true, true, line},
+		{false, true, "▮▮▯ 100%  🧨 Complete! ┌─┐ José"},
+		{true, false, "\033[32m##.\033[0m 100%   \033[32mComplete!\033[0m +-+ Jos?"},
+		{false, false, "##. 100%   Complete! +-+ Jos?"},
+	}
+	for _, c := range cases {
+		rec := &recordingSession{}
+		out := &terminal{Session: rec, ansi: c.ansi, utf8: c.utf8}
+		if n, err := out.Write([]byte(line)); err != nil || n != len(line) {
+			t.Errorf("Write returned (%d, %v), want (%d, nil)", n, err, len(line))
+		}
+		if got := rec.buf.String(); got != c.want {
+			t.Errorf("ansi=%v utf8=%v: got %q, want %q", c.ansi, c.utf8, got, c.want)
+		}
+	}
+}
+
+func TestMessageCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte(`{"de": {"hello": "Hallo, %s!", "complete": "Fertig!"}, "de_AT": {"hello": "Servus, %s!"}}`), 0644)
+	c, err := loadCatalog(path)
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+
+	out := &terminal{messages: c.lookup("de_AT.UTF-8")}
+	if got := out.msg("hello", "alice"); got != "Servus, alice!" {
+		t.Errorf("Expected regional message, got %q", got)
+	}
+	if got := out.msg("complete"); got != "Fertig!" {
+		t.Errorf("Expected language message, got %q", got)
+	}
+	if got := out.msg("booting"); got != englishMessages["booting"] {
+		t.Errorf("Expected English fallback, got %q", got)
+	}
+	out = &terminal{messages: c.lookup("")}
+	if got := out.msg("hello", "bob"); got != "Hello, bob!" {
+		t.Errorf("Expected English without a locale, got %q", got)
+	}
+
+	os.WriteFile(path, []byte(`{"de": {"helo": "Hallo!"}}`), 0644)
+	if _, err := loadCatalog(path); err == nil {
+		t.Errorf("Expected error for unknown message ID")
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	out := &terminal{messages: catalog(nil).lookup("")}
+	now := time.Now()
+	cases := map[time.Duration]string{
+		time.Second:          "just now",
+		30 * time.Second:     "30 seconds ago",
+		time.Minute:          "1 minute ago",
+		5 * time.Hour:        "5 hours ago",
+		24 * time.Hour:       "1 day ago",
+		15 * 24 * time.Hour:  "2 weeks ago",
+		45 * 24 * time.Hour:  "1 month ago",
+		800 * 24 * time.Hour: "2 years ago",
+	}
+	for ago, want := range cases {
+		if got := out.relativeTime(now.Add(-ago)); got != want {
+			t.Errorf("relativeTime(-%v) = %q, want %q", ago, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte(`{"ru": {"ago_days.one": "%d день назад", "ago_days.few": "%d дня назад", "ago_days.many": "%d дней назад"}}`), 0644)
+	c, err := loadCatalog(path)
+	if err != nil {
+		t.Fatalf("Failed to load catalog with plurals: %v", err)
+	}
+	out = &terminal{messages: c.lookup("ru_RU.UTF-8"), language: localeLanguage("ru_RU.UTF-8")}
+	for days, want := range map[int]string{1: "1 день назад", 3: "3 дня назад", 5: "5 дней назад", 21: "21 день назад"} {
+		if got := out.plural("ago_days", days); got != want {
+			t.Errorf("Russian plural for %d days = %q, want %q", days, got, want)
+		}
+	}
+}
+
+func TestBootTimes(t *testing.T) {
+	dir := t.TempDir()
+	stats := NewUserStats(dir)
+	if _, ok := stats.BootTimePercentile(50); ok {
+		t.Errorf("Expected no percentile without boot times")
+	}
+	for _, ms := range []int{900, 100, 500, 300, 700} {
+		stats.RecordBootTime(time.Duration(ms) * time.Millisecond)
+	}
+	if p50, _ := stats.BootTimePercentile(50); p50 != 500*time.Millisecond {
+		t.Errorf("Expected p50 of 500ms, got %v", p50)
+	}
+
+	// Boot times are saved alongside the user stats
+	if err := stats.Save(); err != nil {
+		t.Fatalf("Failed to save stats: %v", err)
+	}
+	reloaded := NewUserStats(dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load stats: %v", err)
+	}
+	if p100, _ := reloaded.BootTimePercentile(100); p100 != 900*time.Millisecond {
+		t.Errorf("Expected reloaded max of 900ms, got %v", p100)
+	}
+
+	if got := formatDuration(830 * time.Millisecond); got != "830ms" {
+		t.Errorf("formatDuration(830ms) = %q", got)
+	}
+	if got := formatDuration(1234 * time.Millisecond); got != "1.2s" {
+		t.Errorf("formatDuration(1.234s) = %q", got)
+	}
+}
+
+func TestStatsMerge(t *testing.T) {
+	a := NewUserStats(t.TempDir())
+	a.RecordConnection("alice", "US")
+	a.RecordConnection("bob", "")
+	a.RecordBootTime(time.Second)
+	time.Sleep(10 * time.Millisecond)
+
+	b := NewUserStats(t.TempDir())
+	b.RecordConnection("alice", "FR")
+	b.RecordConnection("alice", "FR")
+	b.RecordBootTime(2 * time.Second)
+	a.AddTraffic("alice", 100, 10)
+	b.AddTraffic("alice", 200, 20)
+
+	// Round-trip through JSON, as the stats command does
+	data, err := json.Marshal(a.Export())
+	if err != nil {
+		t.Fatalf("Failed to export stats: %v", err)
+	}
+	var archive StatsArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		t.Fatalf("Failed to decode archive: %v", err)
+	}
+	if err := b.Merge(&archive); err != nil {
+		t.Fatalf("Failed to merge stats: %v", err)
+	}
+	alice, _ := b.GetUserStat("alice")
+	if alice.ConnectCount != 3 || alice.LastCountry != "FR" {
+		t.Errorf("Expected 3 connections last from FR for alice, got %+v", alice)
+	}
+	if alice.TrafficIn != 300 || alice.TrafficOut != 30 {
+		t.Errorf("Expected alice's traffic to be added, got %+v", alice)
+	}
+	if _, ok := b.GetUserStat("bob"); !ok {
+		t.Errorf("Expected bob to be merged")
+	}
+	if p100, _ := b.BootTimePercentile(100); p100 != 2*time.Second {
+		t.Errorf("Expected merged max boot time of 2s, got %v", p100)
+	}
+
+	// Importing replaces everything
+	if err := b.Import(&archive); err != nil {
+		t.Fatalf("Failed to import stats: %v", err)
+	}
+	if alice, _ := b.GetUserStat("alice"); alice.ConnectCount != 1 || alice.LastCountry != "US" {
+		t.Errorf("Expected imported stats for alice, got %+v", alice)
+	}
+
+	archive.Version = 99
+	if err := b.Merge(&archive); err == nil {
+		t.Errorf("Expected error for an unknown archive version")
+	}
+}
+
+func TestEgressProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", len(r.URL.Query().Get("n"))<<20+len(r.Host))
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+	allow := filepath.Join(t.TempDir(), "allow")
+	if err := os.WriteFile(allow, []byte("# Package mirrors\nexample.com\n*.debian.org\n"), 0644); err != nil {
+		t.Fatalf("Failed to write allow list: %v", err)
+	}
+	s, _ := startTestServer(t, &internal.Config{EgressProxy: 3128, EgressProxyAllow: allow, EgressProxyMaxMB: 1})
+	testVM, err := s.vmManager.GetOrCreateVM(context.Background(), "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer s.vmManager.DestroyVM(context.Background(), "alice")
+
+	// Send every allowed host to the test server, which is on loopback
+	p := s.egressProxyHandler().(*egressProxy)
+	p.transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	}
+	proxy := func(url, from string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = net.JoinHostPort(from, "40000")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := proxy("http://example.com/", "203.0.113.1"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected requests from outside VMs to be refused, got %d", rec.Code)
+	}
+	for _, url := range []string{"http://example.com/", "http://deb.debian.org/debian"} {
+		if rec := proxy(url, testVM.IP.String()); rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("Expected %s to be proxied, got %d: %s", url, rec.Code, rec.Body.String())
+		}
+	}
+	for _, url := range []string{"http://debian.org/", "http://example.com.evil.net/", "http://evil.net/"} {
+		if rec := proxy(url, testVM.IP.String()); rec.Code != http.StatusForbidden {
+			t.Errorf("Expected %s to be refused, got %d", url, rec.Code)
+		}
+	}
+	if rec := proxy("http://example.com/?n=xx", testVM.IP.String()); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected a 2 MB response to be refused, got %d", rec.Code)
+	}
+
+	if _, err := s.dialBeyondHost(context.Background(), "tcp", upstream.Listener.Addr().String()); err == nil {
+		t.Errorf("Expected the proxy to refuse dialing the host")
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	cases := map[error]string{
+		fmt.Errorf("%w (20.0 of 20 hours)", errQuotaExhausted):     "quota",
+		fmt.Errorf("%w (limit 4)", vm.ErrCapacity):                 "capacity",
+		fmt.Errorf("failed to allocate IP: %w", vm.ErrIPExhausted): "ip_exhausted",
+		fmt.Errorf("%w: disk full", vm.ErrRootfsCopy):              "rootfs_copy",
+		fmt.Errorf("%w (1 MB free)", vm.ErrDiskFull):               "disk_full",
+		vm.ErrBootTimeout:            "boot_timeout",
+		fmt.Errorf("something else"): "other",
+	}
+	for err, want := range cases {
+		if got := failureReason(err); got != want {
+			t.Errorf("failureReason(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestDropService(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{DropPort: 8053})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.RequestPty("xterm", 24, 80, cryptoSSH.TerminalModes{}); err != nil {
+		t.Fatalf("Failed to request pty: %v", err)
+	}
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	testVM, ok := s.vmManager.GetVM("alice")
+	if !ok {
+		t.Fatalf("Expected alice's VM to be running")
+	}
+	drop := func(method, path, body, from string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = net.JoinHostPort(from, "40000")
+		rec := httptest.NewRecorder()
+		s.dropHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := drop("POST", "/clipboard", "hello", "203.0.113.1"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected requests from outside VMs to be refused, got %d", rec.Code)
+	}
+	if rec := drop("POST", "/clipboard", "hello", testVM.IP.String()); rec.Code != http.StatusOK {
+		t.Errorf("Expected clipboard copy to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForOutput(t, &output, "\033]52;c;aGVsbG8=\a")
+
+	if rec := drop("PUT", "/files/a%5Cb", "x", testVM.IP.String()); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid file name to be refused, got %d", rec.Code)
+	}
+	if rec := drop("PUT", "/files/report.txt", "results", testVM.IP.String()); rec.Code != http.StatusOK {
+		t.Fatalf("Expected file drop to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	fetch, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer fetch.Close()
+	if got, err := fetch.Output("fetch report.txt"); err != nil || string(got) != "results" {
+		t.Errorf("Expected to fetch dropped file, got %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.vmManager.DataDir(), "alice", outboxDir, "report.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected fetched file to be removed from the outbox")
+	}
+}
+
+func TestTerminalTitle(t *testing.T) {
+	_, addr := startTestServer(t, &internal.Config{TerminalTitle: true})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.RequestPty("xterm", 24, 80, cryptoSSH.TerminalModes{}); err != nil {
+		t.Fatalf("Failed to request pty: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "\033[22;0t\033]0;alice@alice (ssh-hypervisor)\a")
+
+	stdin.Close()
+	session.Wait()
+	if !strings.HasSuffix(output.String(), "\033[23;0t") {
+		t.Errorf("Expected title to be restored on exit, got %q", output.String())
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// Test vector from RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	if code := totpCode(secret, time.Unix(59, 0)); code != "287082" {
+		t.Errorf("Expected code 287082, got %s", code)
+	}
+	now := time.Unix(1111111109, 0)
+	if !verifyTOTP(secret, totpCode(secret, now.Add(-totpPeriod)), now) {
+		t.Errorf("Expected code from the previous step to be accepted")
+	}
+	if verifyTOTP(secret, totpCode(secret, now.Add(-3*totpPeriod)), now) {
+		t.Errorf("Expected stale code to be refused")
+	}
+
+	path := filepath.Join(t.TempDir(), "totp")
+	// base32 of the RFC secret, in lowercase like some apps show it
+	if err := os.WriteFile(path, []byte("# admins\nalice gezdgnbvgy3tqojqgezdgnbvgy3tqojq\n"), 0600); err != nil {
+		t.Fatalf("Failed to write TOTP secrets: %v", err)
+	}
+	s, addr := startTestServer(t, &internal.Config{TOTPUsers: path})
+
+	dial := func(user string, auth ...cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	answer := func(code string) cryptoSSH.AuthMethod {
+		return cryptoSSH.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{code}, nil
+		})
+	}
+
+	// The code is asked for after a key or password, never instead of one
+	code := totpCode(secret, time.Now())
+	if err := dial("alice", cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected password login without a code to be refused for a user with TOTP")
+	}
+	if err := dial("alice", answer(code)); err == nil {
+		t.Errorf("Expected the code alone to be refused")
+	}
+	if err := dial("alice", cryptoSSH.Password(""), answer("000000")); err == nil {
+		t.Errorf("Expected wrong code to be refused")
+	}
+	if err := dial("alice", cryptoSSH.Password(""), answer(code)); err != nil {
+		t.Errorf("Expected login with a password and the current code to succeed: %v", err)
+	}
+	signer := generateTestSigner(t)
+	if err := dial("alice", cryptoSSH.PublicKeys(signer), answer(code)); err != nil {
+		t.Errorf("Expected login with a key and the current code to succeed: %v", err)
+	}
+
+	// Sessions still know the key, so key bans apply after the code
+	s.access.Add(AccessEntry{List: "ban", Key: cryptoSSH.FingerprintSHA256(signer.PublicKey())})
+	client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+		User:            "alice",
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.PublicKeys(signer), answer(code)},
+		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to log in with a key and code: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	if output, _ := session.CombinedOutput("echo hi"); !strings.Contains(string(output), "banned") {
+		t.Errorf("Expected the banned key to be refused a VM, got %q", output)
+	}
+	if err := dial("bob", cryptoSSH.Password("")); err != nil {
+		t.Errorf("Expected users without TOTP to log in as before: %v", err)
+	}
+}
+
+func TestTerms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terms.txt")
+	if err := os.WriteFile(path, []byte("Be nice. No crypto mining.\n"), 0644); err != nil {
+		t.Fatalf("Failed to write terms: %v", err)
+	}
+	s, addr := startTestServer(t, &internal.Config{Terms: path, TermsVersion: "1"})
+
+	dial := func(auth ...cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            "alice",
+			Auth:            auth,
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	var shown string
+	answer := func(reply string) cryptoSSH.AuthMethod {
+		return cryptoSSH.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			shown += instruction
+			if len(questions) == 0 {
+				return nil, nil
+			}
+			return []string{reply}, nil
+		})
+	}
+
+	if err := dial(cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected password login to be refused before accepting the terms")
+	}
+	if err := dial(cryptoSSH.Password(""), answer("no")); err == nil {
+		t.Errorf("Expected login to be refused without accepting the terms")
+	}
+	if !strings.Contains(shown, "No crypto mining.") || !strings.Contains(shown, refusedTerms) {
+		t.Errorf("Expected the terms and refusal to be shown, got %q", shown)
+	}
+	if err := dial(cryptoSSH.Password(""), answer(" Yes")); err != nil {
+		t.Fatalf("Expected login accepting the terms to succeed: %v", err)
+	}
+	if err := dial(cryptoSSH.Password("")); err != nil {
+		t.Errorf("Expected password login once the terms are accepted: %v", err)
+	}
+
+	// Acceptance is saved with the version, and asked again when it changes
+	reloaded := NewUserStats(s.config.DataDir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load user stats: %v", err)
+	}
+	stat, ok := reloaded.GetUserStat("alice")
+	if !ok || stat.TermsVersion != "1" || stat.TermsAccepted.IsZero() {
+		t.Errorf("Expected acceptance of version 1 to be saved, got %+v", stat)
+	}
+	s.config.TermsVersion = "2"
+	if err := dial(cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected users to accept changed terms again")
+	}
+}
+
+// invitePrompter asks users not yet invited for an invite code
+type invitePrompter struct {
+	mu      sync.Mutex
+	invited map[string]bool
+}
+
+func (p *invitePrompter) Pending(user string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.invited[user]
+}
+
+func (p *invitePrompter) Prompt(user string, remote net.Addr, challenge cryptoSSH.KeyboardInteractiveChallenge) error {
+	answers, err := challenge("", "Welcome! This server is invite-only.", []string{"Invite code: "}, []bool{true})
+	if err != nil || len(answers) != 1 || answers[0] != "sesame" {
+		return errors.New("That invite code isn't valid.")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invited[user] = true
+	return nil
+}
+
+func TestPrompters(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	path := filepath.Join(t.TempDir(), "totp")
+	if err := os.WriteFile(path, []byte("alice gezdgnbvgy3tqojqgezdgnbvgy3tqojq\n"), 0600); err != nil {
+		t.Fatalf("Failed to write TOTP secrets: %v", err)
+	}
+	invites := &invitePrompter{invited: map[string]bool{"carol": true}}
+	_, addr := startTestServer(t, &internal.Config{TOTPUsers: path}, func(s *Server) {
+		s.AddPrompter(invites)
+	})
+
+	dial := func(user string, auth ...cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	// answer answers each question in turn, recording what was asked and shown
+	answer := func(shown *[]string, answers ...string) cryptoSSH.AuthMethod {
+		return cryptoSSH.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			*shown = append(*shown, instruction)
+			*shown = append(*shown, questions...)
+			n := min(len(questions), len(answers))
+			reply := answers[:n]
+			answers = answers[n:]
+			return reply, nil
+		})
+	}
+
+	if err := dial("bob", cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected password login without answering a pending prompt to be refused")
+	}
+	var shown []string
+	if err := dial("bob", cryptoSSH.Password(""), answer(&shown, "open up")); err == nil {
+		t.Errorf("Expected a wrong invite code to be refused")
+	}
+	if !strings.Contains(strings.Join(shown, "\n"), "isn't valid") {
+		t.Errorf("Expected the prompter's error to be shown, got %q", shown)
+	}
+	if err := dial("bob", answer(&shown, "sesame")); err == nil {
+		t.Errorf("Expected the invite code alone to be refused")
+	}
+	if err := dial("bob", cryptoSSH.PublicKeys(generateTestSigner(t)), answer(&shown, "sesame")); err != nil {
+		t.Errorf("Expected login with a key and the invite code to succeed: %v", err)
+	}
+	if err := dial("bob", cryptoSSH.Password("")); err != nil {
+		t.Errorf("Expected password login once nothing is pending: %v", err)
+	}
+
+	// Prompts run in order, with TOTP first
+	shown = nil
+	if err := dial("alice", cryptoSSH.Password(""), answer(&shown, totpCode(secret, time.Now()), "sesame")); err != nil {
+		t.Errorf("Expected login answering both prompts to succeed: %v", err)
+	}
+	totp, invite := slices.Index(shown, totpPrompt), slices.Index(shown, "Invite code: ")
+	if totp < 0 || invite < totp {
+		t.Errorf("Expected the TOTP prompt before the invite code, got %q", shown)
+	}
+	if err := dial("carol", cryptoSSH.Password("")); err != nil {
+		t.Errorf("Expected invited users to log in as before: %v", err)
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{})
+
+	add := func(body string) {
+		rec := httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/api/access", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to add access entry %s: %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	run := func(user, command string) string {
+		client := dialTestServer(t, addr, user)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		output, _ := session.CombinedOutput(command)
+		return string(output)
+	}
+
+	add(`{"list": "ban", "user": "alice", "reason": "crypto mining"}`)
+	add(`{"list": "ban", "user": "bob", "expires": "2020-01-01T00:00:00Z"}`)
+	if output := run("alice", "echo hi"); !strings.Contains(output, "banned") || !strings.Contains(output, "crypto mining") {
+		t.Errorf("Expected alice to be refused as banned, got %q", output)
+	}
+	for _, command := range []string{bundleCommand, "memory 512", "snapshot list", "rootfs"} {
+		if output := run("alice", command); !strings.Contains(output, "banned") {
+			t.Errorf("Expected alice to be refused %q as banned, got %q", command, output)
+		}
+	}
+	if output := run("bob", "echo hi"); strings.Contains(output, "banned") {
+		t.Errorf("Expected expired ban to be ignored, got %q", output)
+	}
+
+	add(`{"list": "allow", "user": "carol"}`)
+	if output := run("bob", "echo hi"); !strings.Contains(output, "only open to invited users") {
+		t.Errorf("Expected bob to be refused by the allow list, got %q", output)
+	}
+
+	// Entries are kept across restarts, without expired ones
+	reloaded := NewAccessLists(s.config.DataDir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load access lists: %v", err)
+	}
+	if entries := reloaded.Entries(); len(entries) != 2 {
+		t.Errorf("Expected 2 saved entries, got %+v", entries)
+	}
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/access/ban?user=alice", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected ban to be removed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := s.access.Check("alice", ""); err != errNotAllowed {
+		t.Errorf("Expected alice to only be refused by the allow list, got %v", err)
+	}
+}
+
+// fakeCountryDB maps IP addresses to countries
+type fakeCountryDB map[string]string
+
+func (db fakeCountryDB) Country(ip net.IP) (string, error) {
+	return db[ip.String()], nil
+}
+
+func TestCountryPolicy(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{})
+	if err := s.checkCountry("alice", ""); err != nil {
+		t.Errorf("Expected no policy without GeoIP, got %v", err)
+	}
+
+	limits, err := parseCountryLimits("us=1, *=0")
+	if err != nil {
+		t.Fatalf("Failed to parse limits: %v", err)
+	}
+	deny, err := parseCountries("KP,unknown")
+	if err != nil {
+		t.Fatalf("Failed to parse countries: %v", err)
+	}
+	s.geo = &geoPolicy{db: fakeCountryDB{"127.0.0.1": "US"}, deny: deny, maxVMs: limits}
+
+	if err := s.checkCountry("alice", "KP"); !errors.Is(err, errCountryDenied) {
+		t.Errorf("Expected denied country to be refused, got %v", err)
+	}
+	if err := s.checkCountry("alice", unknownCountry); !errors.Is(err, errCountryDenied) {
+		t.Errorf("Expected unknown country to be refused, got %v", err)
+	}
+	if err := s.checkCountry("alice", "FR"); !errors.Is(err, errCountryLimit) {
+		t.Errorf("Expected default limit of 0 to refuse FR, got %v", err)
+	}
+
+	// The first US VM fits the limit, and is labeled with its country
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	if labels, _ := s.vmManager.Labels("alice"); labels[countryLabel] != "US" {
+		t.Errorf("Expected VM to be labeled with its country, got %v", labels)
+	}
+	if err := s.checkCountry("bob", "US"); !errors.Is(err, errCountryLimit) {
+		t.Errorf("Expected US to be at its limit, got %v", err)
+	}
+	if err := s.checkCountry("alice", "US"); err != nil {
+		t.Errorf("Expected alice to reconnect to their running VM, got %v", err)
+	}
+
+	for _, bad := range []string{"USA=1", "US", "US=-1", "*=x"} {
+		if _, err := parseCountryLimits(bad); err == nil {
+			t.Errorf("Expected error for limit %q", bad)
+		}
+	}
+}
+
+func TestActivityFeed(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{ActivityFeed: "names"})
+	s.userStats.RecordConnection("alice", "")
+	time.Sleep(10 * time.Millisecond)
+	s.userStats.RecordConnection("bob", "")
+
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/feed.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected the feed to allow all origins, got %q", origin)
+	}
+	var feed struct {
+		Items []struct {
+			Title string `json:"title"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("Failed to decode feed: %v", err)
+	}
+	if len(feed.Items) != 2 || feed.Items[0].Title != "bob logged in" || feed.Items[1].Title != "alice logged in" {
+		t.Errorf("Expected bob then alice in the feed, got %+v", feed.Items)
+	}
+
+	// Anonymous feeds leave out who logged in
+	s.config.ActivityFeed = "anonymous"
+	for _, path := range []string{"/feed.json", "/feed.rss"} {
+		rec = httptest.NewRecorder()
+		s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body := rec.Body.String()
+		if rec.Code != http.StatusOK || !strings.Contains(body, "Someone logged in") {
+			t.Errorf("Expected anonymous logins in %s, got %d %q", path, rec.Code, body)
+		}
+		if strings.Contains(body, "alice") || strings.Contains(body, "bob") {
+			t.Errorf("Expected no usernames in anonymous %s, got %q", path, body)
+		}
+	}
+
+	s.config.ActivityFeed = ""
+	rec = httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/feed.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with the feed disabled, got %d", rec.Code)
+	}
+}
+
+func TestSSHAlgorithms(t *testing.T) {
+	config := &internal.Config{Port: 2222, VMLogLevel: "warn", SSHCiphers: cryptoSSH.CipherAES256CTR, SSHMinRSABits: 2048}
+	_, addr := startTestServer(t, config)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid algorithms, got %v", err)
+	}
+
+	dial := func(ciphers []string, auth cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            "alice",
+			Auth:            []cryptoSSH.AuthMethod{auth},
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Config:          cryptoSSH.Config{Ciphers: ciphers},
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	if err := dial([]string{cryptoSSH.CipherAES128GCM}, cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected a client without the configured cipher to be refused")
+	}
+	if err := dial([]string{cryptoSSH.CipherAES256CTR}, cryptoSSH.Password("")); err != nil {
+		t.Errorf("Expected a client with the configured cipher to connect: %v", err)
+	}
+
+	for _, test := range []struct {
+		bits int
+		ok   bool
+	}{{1024, false}, {2048, true}} {
+		key, err := rsa.GenerateKey(rand.Reader, test.bits)
+		if err != nil {
+			t.Fatalf("Failed to generate RSA key: %v", err)
+		}
+		signer, err := cryptoSSH.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("Failed to create signer: %v", err)
+		}
+		err = dial([]string{cryptoSSH.CipherAES256CTR}, cryptoSSH.PublicKeys(signer))
+		if (err == nil) != test.ok {
+			t.Errorf("%d-bit RSA key: expected ok=%v, got error %v", test.bits, test.ok, err)
+		}
+	}
+
+	for _, algorithms := range []internal.Config{{SSHCiphers: "rot13"}, {SSHMACs: ","}, {SSHKeyExchanges: "curve25519-sha256,nope"}} {
+		bad := *config
+		bad.SSHCiphers, bad.SSHMACs, bad.SSHKeyExchanges = algorithms.SSHCiphers, algorithms.SSHMACs, algorithms.SSHKeyExchanges
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected algorithms %+v to be rejected", algorithms.SSHAlgorithms())
+		}
+	}
+	weak := internal.Config{SSHCiphers: "aes128-ctr,3des-cbc", SSHMACs: cryptoSSH.HMACSHA256}
+	if got := weak.InsecureSSHAlgorithms(); len(got) != 1 || got[0] != "3des-cbc" {
+		t.Errorf("Expected 3des-cbc to be reported as weak, got %v", got)
+	}
+}
+
+func TestAuthRefusal(t *testing.T) {
+	config := &internal.Config{AuthBanner: "Register a key at https://example.com/keys", MaxAuthTries: 2}
+	_, addr := startTestServer(t, config)
+
+	var instructions []string
+	interactive := cryptoSSH.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		instructions = append(instructions, instruction)
+		return nil, nil
+	})
+	dial := func(auth ...cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            "attach+alice",
+			Auth:            auth,
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	if err := dial(interactive); err == nil {
+		t.Fatalf("Expected attach without an admin key to be refused")
+	}
+	if len(instructions) != 1 || !strings.Contains(instructions[0], refusedAttach) || !strings.Contains(instructions[0], config.AuthBanner) {
+		t.Errorf("Expected the refusal reason and banner, got %q", instructions)
+	}
+
+	// Each key is an attempt, so the connection is closed before the
+	// client gets to keyboard-interactive
+	instructions = nil
+	keys := cryptoSSH.PublicKeys(generateTestSigner(t), generateTestSigner(t))
+	if err := dial(keys, interactive); err == nil {
+		t.Fatalf("Expected attach without an admin key to be refused")
+	}
+	if len(instructions) != 0 {
+		t.Errorf("Expected the connection to close after %d attempts, got keyboard-interactive %q", config.MaxAuthTries, instructions)
+	}
+}
+
+// testAuthenticator accepts one user's password and one key
+type testAuthenticator struct {
+	user     string
+	password string
+	key      cryptoSSH.PublicKey
+}
+
+func (a testAuthenticator) AuthorizeKey(user string, remote net.Addr, key cryptoSSH.PublicKey) bool {
+	return user == a.user && bytes.Equal(key.Marshal(), a.key.Marshal())
+}
+
+func (a testAuthenticator) AuthorizePassword(user string, remote net.Addr, password string) bool {
+	return user == a.user && password == a.password
+}
+
+func TestAuthenticator(t *testing.T) {
+	signer := generateTestSigner(t)
+	auth := testAuthenticator{user: "alice", password: "hunter2", key: signer.PublicKey()}
+	invites := &invitePrompter{invited: map[string]bool{"alice": true}}
+	_, addr := startTestServer(t, &internal.Config{}, func(s *Server) {
+		s.SetAuthenticator(auth)
+		s.AddPrompter(invites)
+	})
+
+	dial := func(user string, auth ...cryptoSSH.AuthMethod) error {
+		client, err := cryptoSSH.Dial("tcp", addr, &cryptoSSH.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	if err := dial("alice", cryptoSSH.Password("hunter2")); err != nil {
+		t.Errorf("Expected the accepted password to log in: %v", err)
+	}
+	if err := dial("alice", cryptoSSH.PublicKeys(signer)); err != nil {
+		t.Errorf("Expected the accepted key to log in: %v", err)
+	}
+	if err := dial("alice", cryptoSSH.Password("")); err == nil {
+		t.Errorf("Expected a wrong password to be refused")
+	}
+	if err := dial("alice", cryptoSSH.PublicKeys(generateTestSigner(t))); err == nil {
+		t.Errorf("Expected an unknown key to be refused")
+	}
+	if err := dial("bob", cryptoSSH.Password("hunter2")); err == nil {
+		t.Errorf("Expected another user to be refused")
+	}
+
+	// Answering prompts doesn't get around the Authenticator
+	invite := cryptoSSH.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return slices.Repeat([]string{"sesame"}, len(questions)), nil
+	})
+	if err := dial("bob", cryptoSSH.Password("hunter2"), invite); err == nil {
+		t.Errorf("Expected a user the Authenticator refuses to be refused with prompts pending")
+	}
+	if err := dial("bob", invite); err == nil {
+		t.Errorf("Expected prompts alone to be refused")
+	}
+	invites.mu.Lock()
+	invites.invited = map[string]bool{}
+	invites.mu.Unlock()
+	if err := dial("alice", cryptoSSH.Password("hunter2"), invite); err != nil {
+		t.Errorf("Expected the accepted password and invite code to log in: %v", err)
+	}
+}
+
+func TestHTTPForwardedClients(t *testing.T) {
+	s, _ := startTestServer(t, &internal.Config{HTTPAllow: "203.0.113.0/24", HTTPProxies: "10.0.0.1, 10.0.1.0/24"})
+	handler := s.httpHandler()
+
+	for _, test := range []struct {
+		remote    string
+		forwarded []string
+		want      int
+	}{
+		{"203.0.113.5:4000", nil, http.StatusOK},
+		{"198.51.100.7:4000", nil, http.StatusForbidden},
+		// Only trusted proxies can vouch for a client
+		{"198.51.100.7:4000", []string{"203.0.113.5"}, http.StatusForbidden},
+		{"10.0.0.1:4000", []string{"203.0.113.5"}, http.StatusOK},
+		{"10.0.0.1:4000", []string{"198.51.100.7"}, http.StatusForbidden},
+		// Hops are trusted from the right, so a spoofed first hop is ignored
+		{"10.0.0.1:4000", []string{"203.0.113.5, 198.51.100.7, 10.0.1.9"}, http.StatusForbidden},
+		{"10.0.0.1:4000", []string{"198.51.100.7", "203.0.113.5, 10.0.1.9"}, http.StatusOK},
+		{"10.0.0.1:4000", []string{"garbage"}, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		req.RemoteAddr = test.remote
+		for _, header := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("From %s with X-Forwarded-For %q: expected %d, got %d", test.remote, test.forwarded, test.want, rec.Code)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	lines := "# Dashboards\ngrafana read r3ad\nops admin adm1n\nci read -\n"
+	if err := os.WriteFile(tokens, []byte(lines), 0600); err != nil {
+		t.Fatalf("Failed to write tokens: %v", err)
+	}
+	s, _ := startTestServer(t, &internal.Config{APITokens: tokens})
+	handler := s.httpHandler()
+
+	request := func(method, path, token, cn string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"list": "ban", "user": "mallory"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, test := range []struct {
+		method, path, token, cn string
+		want                    int
+	}{
+		{"GET", "/healthz", "", "", http.StatusOK},
+		{"GET", "/api/vms", "", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/api/vms", "r3ad", "", http.StatusOK},
+		{"POST", "/api/access", "r3ad", "", http.StatusForbidden},
+		{"POST", "/api/access", "adm1n", "", http.StatusCreated},
+		// Certificate-only entries can't be used as tokens
+		{"GET", "/api/vms", "-", "", http.StatusUnauthorized},
+		{"GET", "/api/vms", "", "ci", http.StatusOK},
+		{"POST", "/api/access", "", "ci", http.StatusForbidden},
+		{"GET", "/api/vms", "", "stranger", http.StatusUnauthorized},
+	} {
+		if got := request(test.method, test.path, test.token, test.cn); got != test.want {
+			t.Errorf("%s %s with token %q and certificate %q: expected %d, got %d", test.method, test.path, test.token, test.cn, test.want, got)
+		}
+	}
+}
+
+func TestCapacityInWelcome(t *testing.T) {
+	// The /28 test network has fewer addresses than the limit
+	s, addr := startTestServer(t, &internal.Config{MaxConcurrentVMs: 20, ShowCapacity: true})
+	if capacity := s.vmManager.Capacity(); capacity != 13 {
+		t.Fatalf("Expected capacity of 13 addresses, got %d", capacity)
+	}
+
+	for i, user := range []string{"alice", "bob"} {
+		client := dialTestServer(t, addr, user)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+
+		var output lockedBuffer
+		session.Stdout = &output
+		if _, err := session.StdinPipe(); err != nil { // Keeps the session open
+			t.Fatalf("Failed to get stdin: %v", err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Failed to start shell: %v", err)
+		}
+		waitForOutput(t, &output, fmt.Sprintf("%d/13 VMs in use", i))
+		waitForOutput(t, &output, "Welcome to fake VM "+user)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{})
+	handler := s.httpHandler()
+
+	shell := func(user string) *lockedBuffer {
+		client := dialTestServer(t, addr, user)
+		t.Cleanup(func() { client.Close() })
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		output := &lockedBuffer{}
+		session.Stdout = output
+		if _, err := session.StdinPipe(); err != nil {
+			t.Fatalf("Failed to get stdin: %v", err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Failed to start shell: %v", err)
+		}
+		return output
+	}
+	setMaintenance := func(body string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/maintenance", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 setting maintenance, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// A user named after the flag file doesn't turn maintenance on
+	waitForOutput(t, shell("maintenance"), "Welcome to fake VM maintenance")
+	os.MkdirAll(filepath.Join(s.config.DataDir, "maintenance"), 0755)
+	if _, enabled := s.maintenance(); enabled {
+		t.Errorf("Expected a VM directory not to turn maintenance on")
+	}
+	os.Mkdir(filepath.Join(s.config.DataDir, maintenanceFile), 0755)
+	if _, enabled := s.maintenance(); enabled {
+		t.Errorf("Expected a directory in place of the flag file to be ignored")
+	}
+	os.Remove(filepath.Join(s.config.DataDir, maintenanceFile))
+
+	// Bob's session is running when maintenance starts
+	waitForOutput(t, shell("bob"), "Welcome to fake VM bob")
+	setMaintenance(`{"enabled": true, "message": "Updating the rootfs, back at 14:00 UTC."}`)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/maintenance", nil))
+	if !strings.Contains(rec.Body.String(), `"enabled":true`) {
+		t.Errorf("Expected maintenance to be enabled, got %s", rec.Body.String())
+	}
+
+	output := shell("alice")
+	waitForOutput(t, output, "The server is down for maintenance.")
+	waitForOutput(t, output, "Updating the rootfs, back at 14:00 UTC.")
+	if _, running := s.vmManager.GetVM("alice"); running {
+		t.Errorf("Expected no VM to start in maintenance mode")
+	}
+	// Another session to a running VM is still allowed
+	waitForOutput(t, shell("bob"), "Welcome to fake VM bob")
+
+	// Every other way of creating a VM is refused too
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/vms/carol", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 scheduling in maintenance mode, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := s.vmManager.GetOrCreateVM(context.Background(), "dave", nil); err == nil {
+		t.Errorf("Expected the manager to refuse new VMs in maintenance mode")
+	}
+	if !s.nodeStatus().Maintenance {
+		t.Errorf("Expected the node status to report maintenance")
+	}
+
+	setMaintenance(`{"enabled": false}`)
+	waitForOutput(t, shell("alice"), "Welcome to fake VM alice")
+}
+
+func TestPreemption(t *testing.T) {
+	dir := t.TempDir()
+	for _, bad := range []string{"alice", "alice root", "alice admin extra"} {
+		path := filepath.Join(dir, "bad")
+		os.WriteFile(path, []byte(bad+"\n"), 0644)
+		if _, err := loadTiers(path); err == nil {
+			t.Errorf("Expected error for tiers line %q", bad)
+		}
+	}
+	path := filepath.Join(dir, "tiers")
+	os.WriteFile(path, []byte("# Staff\nalice admin\ndave admin\n\ncarol supporter\n"), 0644)
+
+	s, addr := startTestServer(t, &internal.Config{MaxConcurrentVMs: 1, Snapshots: 1, Tiers: path})
+	handler := s.httpHandler()
+	schedule := func(user string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/vms/"+user+"?hold=1h", nil))
+		return rec.Code
+	}
+	shell := func(user string) *lockedBuffer {
+		client := dialTestServer(t, addr, user)
+		t.Cleanup(func() { client.Close() })
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		output := &lockedBuffer{}
+		session.Stdout = output
+		if _, err := session.StdinPipe(); err != nil {
+			t.Fatalf("Failed to get stdin: %v", err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Failed to start shell: %v", err)
+		}
+		return output
+	}
+
+	// Bob's VM is idle, but anonymous users can't preempt it
+	if code := schedule("bob"); code != http.StatusCreated {
+		t.Fatalf("Expected 201 scheduling bob, got %d", code)
+	}
+	if code := schedule("eve"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for an anonymous user at capacity, got %d", code)
+	}
+
+	// A supporter can
+	if code := schedule("carol"); code != http.StatusCreated {
+		t.Fatalf("Expected carol to preempt bob, got %d", code)
+	}
+	if _, running := s.vmManager.GetVM("bob"); running {
+		t.Errorf("Expected bob's VM to be stopped")
+	}
+	var preempted bool
+	for _, event := range s.vmManager.Events().Events("bob") {
+		preempted = preempted || event.Kind == vm.EventPreempted
+	}
+	if !preempted {
+		t.Errorf("Expected a preempted event for bob")
+	}
+	if snapshots, err := s.vmManager.ListSnapshots("bob"); err != nil || len(snapshots) != 1 || !strings.HasPrefix(snapshots[0].Name, "preempted-") {
+		t.Errorf("Expected bob's disk to be snapshotted, got %v, %v", snapshots, err)
+	}
+
+	// An admin preempts the supporter, but not another admin using their VM
+	waitForOutput(t, shell("alice"), "Welcome to fake VM alice")
+	if _, running := s.vmManager.GetVM("carol"); running {
+		t.Errorf("Expected carol's VM to be stopped")
+	}
+	waitForOutput(t, shell("dave"), "Server is at capacity!")
+	if _, running := s.vmManager.GetVM("alice"); !running {
+		t.Errorf("Expected alice's VM in use to keep running")
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	var d growthDetector
+	for i := range leakWindow - 1 {
+		if d.observe(100 + i*2) {
+			t.Fatalf("Expected no leak before a full window")
+		}
+	}
+	if !d.observe(200) {
+		t.Errorf("Expected steady growth from 100 to 200 to look like a leak")
+	}
+
+	// Growth with a dip in between, or too little of it, is fine
+	d = growthDetector{}
+	for i := range leakWindow {
+		v := 100 + i*2
+		if i == leakWindow/2 {
+			v = 90
+		}
+		if d.observe(v) {
+			t.Errorf("Expected a dip to rule out a leak")
+		}
+	}
+	d = growthDetector{}
+	for i := range leakWindow {
+		if d.observe(1000 + i) {
+			t.Errorf("Expected slow growth not to look like a leak")
+		}
+	}
+
+	dataDir := t.TempDir()
+	os.Mkdir(filepath.Join(dataDir, "alice"), 0755)
+	f, err := os.Create(filepath.Join(dataDir, "alice", "console.out"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer f.Close()
+	if counts := vmOpenFileCounts(dataDir); counts["alice"] != 1 || len(counts) != 1 {
+		t.Errorf("Expected one open file for alice, got %v", counts)
+	}
+}
+
+func TestImagePicker(t *testing.T) {
+	imagesDir := t.TempDir()
+	os.WriteFile(filepath.Join(imagesDir, "alpine.ext4"), []byte("alpine"), 0644)
+	os.WriteFile(filepath.Join(imagesDir, "python.ext4"), []byte("python"), 0644)
+	catalog := filepath.Join(imagesDir, "images.json")
+	os.WriteFile(catalog, []byte(`[
+		{"name": "alpine", "rootfs": "alpine.ext4"},
+		{"name": "python", "rootfs": "python.ext4", "description": "Python 3 with pip"}
+	]`), 0644)
+
+	s, addr := startTestServer(t, &internal.Config{Images: catalog})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.RequestPty("xterm", 24, 80, cryptoSSH.TerminalModes{}); err != nil {
+		t.Fatalf("Failed to request pty: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Python 3 with pip")
+	waitForOutput(t, &output, "Image [alpine]:")
+
+	stdin.Write([]byte("ruby\r"))
+	waitForOutput(t, &output, `There is no image "ruby"`)
+	stdin.Write([]byte("3\x7f2\r"))
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+	if got := s.vmManager.VMImage("alice"); got != "python" {
+		t.Errorf("Expected alice to pick python, got %q", got)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.vmManager.DataDir(), "alice", "rootfs.img")); string(data) != "python" {
+		t.Errorf("Expected alice's disk to be made from python, got %q", data)
+	}
+
+	// Without a terminal, the default image is used
+	bob := dialTestServer(t, addr, "bob")
+	defer bob.Close()
+	bobSession, err := bob.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer bobSession.Close()
+	if out, err := bobSession.CombinedOutput("echo hi"); err != nil {
+		t.Fatalf("Command failed: %v: %s", err, out)
+	}
+	if got := s.vmManager.VMImage("bob"); got != "alpine" {
+		t.Errorf("Expected bob to get the default image, got %q", got)
+	}
+}
+
+func TestUserRootfs(t *testing.T) {
+	config := &internal.Config{UserRootfs: 1}
+	_, addr := startTestServer(t, config)
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	// An ext4 superblock saying the filesystem has 64 1 KB blocks
+	disk := make([]byte, 64<<10)
+	binary.LittleEndian.PutUint32(disk[1024+0x04:], 64)
+	binary.LittleEndian.PutUint16(disk[1024+0x38:], 0xEF53)
+	diskPath := filepath.Join(config.DataDir, "alice", "rootfs.img")
+
+	// Upload over SFTP, as "sftp -s rootfs" with "put" would
+	var input bytes.Buffer
+	for _, packet := range [][]byte{
+		sftpMarshal(sftpInit, uint32(3)),
+		sftpMarshal(sftpOpen, uint32(1), "/my.ext4", uint32(sftpFlagWrite), uint32(0)),
+		sftpMarshal(sftpWrite, uint32(2), sftpUploadHandleID, uint64(0), string(disk)),
+		sftpMarshal(sftpClose, uint32(3), sftpUploadHandleID),
+	} {
+		writeSFTPPacket(&input, packet)
+	}
+	output := bytes.NewBufferString(runSubsystem(t, client, rootfsSubsystem, input.String()))
+	var last []byte
+	for {
+		packet, err := readSFTPPacket(output)
+		if err != nil {
+			break
+		}
+		last = packet
+	}
+	if want := sftpMarshal(sftpStatus, uint32(3), uint32(sftpOK), "", ""); !bytes.Equal(last, want) {
+		t.Errorf("Expected the upload to succeed, got reply %q", last)
+	}
+	if data, _ := os.ReadFile(diskPath); !bytes.Equal(data, disk) {
+		t.Errorf("Expected the upload to become alice's disk")
+	}
+
+	run := func(command string) (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		output, err := session.CombinedOutput(command)
+		return string(output), err
+	}
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/my.ext4" {
+			w.Write(disk[:32<<10])
+		} else {
+			w.Write(make([]byte, 32<<10))
+		}
+	}))
+	defer images.Close()
+
+	// Users can't make the host fetch from its own network
+	if output, err := run("rootfs fetch " + images.URL + "/my.ext4"); err == nil || !strings.Contains(output, "not allowed") {
+		t.Errorf("Expected fetching from loopback to fail, got %q, %v", output, err)
+	}
+
+	defaultClient := publicHTTPClient
+	publicHTTPClient = images.Client()
+	t.Cleanup(func() { publicHTTPClient = defaultClient })
+	if output, err := run("rootfs fetch " + images.URL + "/zeros.img"); err == nil || !strings.Contains(output, "not an ext4 filesystem") {
+		t.Errorf("Expected fetching a non-ext4 image to fail, got %q, %v", output, err)
+	}
+	if output, err := run("rootfs fetch " + images.URL + "/my.ext4"); err == nil || !strings.Contains(output, "truncated") {
+		t.Errorf("Expected fetching a truncated image to fail, got %q, %v", output, err)
+	}
+	if data, _ := os.ReadFile(diskPath); !bytes.Equal(data, disk) {
+		t.Errorf("Expected a failed fetch to keep alice's disk")
+	}
+	if output, err := run("rootfs"); err != nil || !strings.Contains(output, "sftp -s rootfs") {
+		t.Errorf("Expected instructions, got %q, %v", output, err)
+	}
+	if output, err := run("rootfs pull"); err == nil || !strings.Contains(output, "Usage: rootfs") {
+		t.Errorf("Expected usage, got %q, %v", output, err)
+	}
+}
+
+func TestDebugMode(t *testing.T) {
+	_, addr := startTestServer(t, &internal.Config{})
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	run := func(command string, env ...string) string {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Failed to open session: %v", err)
+		}
+		defer session.Close()
+		for i := 0; i+1 < len(env); i += 2 {
+			if err := session.Setenv(env[i], env[i+1]); err != nil {
+				t.Fatalf("Failed to set %s: %v", env[i], err)
+			}
+		}
+		output, err := session.CombinedOutput(command)
+		if err != nil {
+			t.Fatalf("Command failed: %v: %s", err, output)
+		}
+		return string(output)
+	}
+
+	output := run("echo hi", "HV_DEBUG", "1")
+	for _, want := range []string{"[debug", "creating VM alice", "ip-allocated (VM booting): IP 192.168.100.", "vmm-started (VM booting): PID", "VM alice ready: IP 192.168.100."} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected debug output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if output := run("debug"); !strings.Contains(output, "ssh-ready") {
+		t.Errorf("Expected the debug command to show provisioning steps, got:\n%s", output)
+	}
+	if output := run("echo hi", "HV_DEBUG", "0"); strings.Contains(output, "[debug") {
+		t.Errorf("Expected no debug output with HV_DEBUG=0, got:\n%s", output)
+	}
+}
+
+func TestMultiplexerCommand(t *testing.T) {
+	for _, tc := range []struct {
+		multiplexer, command, want string
+	}{
+		{"tmux", "", `if command -v tmux >/dev/null 2>&1; then exec tmux new-session -A -s ssh-hypervisor; fi; exec "${SHELL:-/bin/sh}" -l`},
+		{"tmux", "python3", `if command -v tmux >/dev/null 2>&1; then exec tmux new-session -A -s ssh-hypervisor 'python3'; fi; python3`},
+		{"screen", "echo 'hi'", `if command -v screen >/dev/null 2>&1; then exec screen -xRR -S ssh-hypervisor sh -c 'echo '\''hi'\'''; fi; echo 'hi'`},
+	} {
+		if got := multiplexerCommand(tc.multiplexer, tc.command); got != tc.want {
+			t.Errorf("multiplexerCommand(%q, %q) =\n%s\nwant\n%s", tc.multiplexer, tc.command, got, tc.want)
+		}
+	}
+}
+
+func TestReattach(t *testing.T) {
+	s, addr := startTestServer(t, &internal.Config{Reattach: 300 * time.Millisecond, Multiplexer: internal.MultiplexerTmux})
+
+	// Interactive sessions run in the multiplexer, which the fake VM echoes
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.RequestPty("xterm", 24, 80, cryptoSSH.TerminalModes{}); err != nil {
+		t.Fatalf("Failed to request pty: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "tmux new-session -A -s ssh-hypervisor")
+	session.Wait()
+
+	// The VM outlives the session for the reattach window, then is released
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := s.vmManager.GetVM("alice"); !ok || v.ExitErr() != nil {
+		t.Errorf("Expected the VM to be kept running after the session ended")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.vmManager.GetActiveVMCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the VM to be released after the reattach window")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFrameInterval(t *testing.T) {
+	tests := []struct {
+		animating int64
+		want      time.Duration
+	}{
+		{1, minFrameInterval},
+		{progressFrameBudget / 2, 500 * time.Millisecond},
+		{10 * progressFrameBudget, maxFrameInterval},
+	}
+	for _, tt := range tests {
+		if got := frameInterval(tt.animating); got != tt.want {
+			t.Errorf("frameInterval(%d) = %s, want %s", tt.animating, got, tt.want)
+		}
+	}
+}
+
+func TestProgressWithoutAnimation(t *testing.T) {
+	// Another session is already provisioning, the most animated
+	_, addr := startTestServer(t, &internal.Config{AnimationMax: 1}, func(s *Server) { s.animating.Store(1) })
+	client := dialTestServer(t, addr, "alice")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	defer session.Close()
+	var output lockedBuffer
+	session.Stdout = &output
+	if err := session.RequestPty("xterm", 24, 80, cryptoSSH.TerminalModes{}); err != nil {
+		t.Fatalf("Failed to request pty: %v", err)
+	}
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatalf("Failed to get stdin: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Failed to start shell: %v", err)
+	}
+	waitForOutput(t, &output, "Welcome to fake VM alice")
+
+	if !strings.Contains(output.String(), "Starting SSH...") {
+		t.Errorf("Expected a line per boot stage, got:\n%s", output.String())
+	}
+	if strings.Contains(output.String(), "▯") {
+		t.Errorf("Expected no animated progress bar, got:\n%s", output.String())
+	}
+}
+
+func TestClientWriterStall(t *testing.T) {
+	// A client that never reads: writes to the pipe block until it is closed
+	r, w := io.Pipe()
+	defer r.Close()
+	stalled := make(chan struct{})
+	c := newClientWriter(w, 0, 50*time.Millisecond, func() {
+		close(stalled)
+		w.CloseWithError(errors.New("session closed"))
+	})
+
+	start := time.Now()
+	for range 4 {
+		if _, err := c.Write(make([]byte, 1000)); err != nil {
+			t.Fatalf("Expected buffered writes to succeed, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Expected writes not to wait on the client, took %s", elapsed)
+	}
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the stalled client to be noticed")
+	}
+	c.Close()
+	if _, err := c.Write([]byte("more")); err == nil {
+		t.Errorf("Expected writes to fail after the client stalled")
+	}
+}
+
+func TestClientWriterRate(t *testing.T) {
+	var buf lockedBuffer
+	c := newClientWriter(&buf, 1000, 0, nil)
+	start := time.Now()
+	c.Write(make([]byte, 1500))
+	c.Close()
+
+	// A second's worth goes at once, and the rest at the rate
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected 1500 bytes at 1000 bytes/s to take about 500ms, took %s", elapsed)
+	}
+	if n := len(buf.String()); n != 1500 {
+		t.Errorf("Expected all output to be written by Close, got %d bytes", n)
+	}
+}
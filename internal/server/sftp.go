@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// SFTP version 3 packet types and status codes, from
+// draft-ietf-secsh-filexfer-02, which OpenSSH speaks
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpOK             = 0
+	sftpNoSuchFile     = 2
+	sftpDenied         = 3
+	sftpFailure        = 4
+	sftpBadMessage     = 5
+	sftpOpUnsupported  = 8
+	sftpFlagWrite      = 0x2
+	sftpAttrSize       = 0x1
+	sftpMaxPacket      = 1<<18 + 1024 // Largest write OpenSSH sends, plus its header
+	sftpUploadHandleID = "upload"
+)
+
+// sftpUpload serves a write-only SFTP session that receives one file at a
+// time, like "sftp -s NAME host" with "put FILE". Nothing can be read or
+// listed. create makes the file an upload is written to, and finish is
+// called with it when the client closes it. Errors from finish are sent to
+// the client. Files that aren't finished are removed.
+type sftpUpload struct {
+	limit  int64 // Largest file accepted, in bytes
+	create func() (*os.File, error)
+	finish func(f *os.File) error
+
+	file *os.File // Upload in progress, nil if none
+	size int64
+}
+
+// serve handles requests until the client closes the session
+func (u *sftpUpload) serve(rw io.ReadWriter) error {
+	defer u.abort()
+	for {
+		packet, err := readSFTPPacket(rw)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		reply := u.handle(packet)
+		if reply == nil {
+			continue
+		}
+		if err := writeSFTPPacket(rw, reply); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers one request packet
+func (u *sftpUpload) handle(packet []byte) []byte {
+	kind, r := packet[0], sftpReader(packet[1:])
+	if kind == sftpInit {
+		return sftpMarshal(sftpVersion, uint32(3))
+	}
+	id, ok := r.uint32()
+	if !ok {
+		return sftpMarshal(sftpStatus, uint32(0), uint32(sftpBadMessage), "bad message", "")
+	}
+	status := func(code uint32, message string) []byte {
+		return sftpMarshal(sftpStatus, id, code, message, "")
+	}
+
+	switch kind {
+	case sftpRealpath:
+		name, _ := r.string()
+		name = path.Join("/", name)
+		return sftpMarshal(sftpName, id, uint32(1), name, name, uint32(0))
+	case sftpStat, sftpLstat:
+		return status(sftpNoSuchFile, "no such file")
+	case sftpOpen:
+		r.string()
+		flags, _ := r.uint32()
+		if flags&sftpFlagWrite == 0 {
+			return status(sftpDenied, "files can only be uploaded")
+		}
+		if u.file != nil {
+			return status(sftpFailure, "another upload is in progress")
+		}
+		f, err := u.create()
+		if err != nil {
+			return status(sftpFailure, err.Error())
+		}
+		u.file, u.size = f, 0
+		return sftpMarshal(sftpHandle, id, sftpUploadHandleID)
+	case sftpWrite:
+		handle, _ := r.string()
+		offset, ok1 := r.uint64()
+		data, ok2 := r.string()
+		if handle != sftpUploadHandleID || u.file == nil || !ok1 || !ok2 {
+			return status(sftpFailure, "invalid handle")
+		}
+		end := int64(offset) + int64(len(data))
+		if offset > uint64(u.limit) || end > u.limit {
+			u.abort()
+			return status(sftpFailure, fmt.Sprintf("file is larger than the limit of %d MB", u.limit>>20))
+		}
+		if _, err := u.file.WriteAt([]byte(data), int64(offset)); err != nil {
+			return status(sftpFailure, err.Error())
+		}
+		u.size = max(u.size, end)
+		return status(sftpOK, "")
+	case sftpFstat:
+		return sftpMarshal(sftpAttrs, id, uint32(sftpAttrSize), uint64(u.size))
+	case sftpSetstat, sftpFsetstat:
+		// Permissions and times don't matter for an image
+		return status(sftpOK, "")
+	case sftpClose:
+		handle, _ := r.string()
+		if handle != sftpUploadHandleID || u.file == nil {
+			return status(sftpFailure, "invalid handle")
+		}
+		f := u.file
+		u.file = nil
+		defer os.Remove(f.Name())
+		err := f.Close()
+		if err == nil {
+			err = u.finish(f)
+		}
+		if err != nil {
+			return status(sftpFailure, err.Error())
+		}
+		return status(sftpOK, "")
+	}
+	return status(sftpOpUnsupported, "not supported")
+}
+
+// abort removes an unfinished upload
+func (u *sftpUpload) abort() {
+	if u.file != nil {
+		u.file.Close()
+		os.Remove(u.file.Name())
+		u.file = nil
+	}
+}
+
+// readSFTPPacket reads a length-prefixed packet
+func readSFTPPacket(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 || length > sftpMaxPacket {
+		return nil, fmt.Errorf("invalid SFTP packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// writeSFTPPacket writes a packet with its length
+func writeSFTPPacket(w io.Writer, packet []byte) error {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(packet)))
+	_, err := w.Write(append(out, packet...))
+	return err
+}
+
+// sftpMarshal encodes a packet of a type from uint32s, uint64s, and strings
+func sftpMarshal(kind byte, fields ...any) []byte {
+	packet := []byte{kind}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint32:
+			packet = binary.BigEndian.AppendUint32(packet, v)
+		case uint64:
+			packet = binary.BigEndian.AppendUint64(packet, v)
+		case string:
+			packet = binary.BigEndian.AppendUint32(packet, uint32(len(v)))
+			packet = append(packet, v...)
+		}
+	}
+	return packet
+}
+
+// sftpReader decodes the fields of a packet
+type sftpReader []byte
+
+func (r *sftpReader) uint32() (uint32, bool) {
+	if len(*r) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, true
+}
+
+func (r *sftpReader) uint64() (uint64, bool) {
+	if len(*r) < 8 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, true
+}
+
+func (r *sftpReader) string() (string, bool) {
+	n, ok := r.uint32()
+	if !ok || uint32(len(*r)) < n {
+		return "", false
+	}
+	v := string((*r)[:n])
+	*r = (*r)[n:]
+	return v, true
+}
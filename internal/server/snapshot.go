@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+// snapshotCommand is the command users run on the hypervisor, as in
+// "ssh alice@host snapshot save before-upgrade", to save and restore their
+// VM's disk while it is stopped
+const snapshotCommand = "snapshot"
+
+// snapshotUsage explains the snapshot command's arguments
+const snapshotUsage = "Usage: snapshot [list | save NAME | restore NAME | delete NAME]"
+
+// runSnapshotCommand lists a user's snapshots, or saves, restores, or
+// deletes one
+func (s *Server) runSnapshotCommand(sess ssh.Session, user, arg string) {
+	if s.config.Snapshots <= 0 {
+		wish.Errorln(sess, "Snapshots are disabled on this server.")
+		sess.Exit(1)
+		return
+	}
+	action, name, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	name = strings.TrimSpace(name)
+	if (action == "" || action == "list") != (name == "") {
+		wish.Errorln(sess, snapshotUsage)
+		sess.Exit(1)
+		return
+	}
+
+	if action == "" || action == "list" {
+		s.listSnapshots(sess, user)
+		return
+	}
+
+	if action == "save" || action == "restore" {
+		if err := s.checkSnapshot(sess, user); err != nil {
+			wish.Errorln(sess, fmt.Sprintf("Error: %v", err))
+			sess.Exit(1)
+			return
+		}
+	}
+
+	var err error
+	var done string
+	switch action {
+	case "save":
+		done = "Saved"
+		err = s.vmManager.SnapshotVM(sess.Context(), user, name)
+	case "restore":
+		done = "Restored"
+		err = s.vmManager.RestoreSnapshot(sess.Context(), user, name)
+	case "delete":
+		done = "Deleted"
+		err = s.vmManager.DeleteSnapshot(user, name)
+	default:
+		wish.Errorln(sess, snapshotUsage)
+		sess.Exit(1)
+		return
+	}
+	if err != nil {
+		if _, running := s.vmManager.GetVM(user); running && action != "delete" {
+			err = fmt.Errorf("your VM is running, so close its sessions first")
+		}
+		wish.Errorln(sess, fmt.Sprintf("Failed to %s snapshot: %v", action, err))
+		sess.Exit(1)
+		return
+	}
+	s.logger.Printf("User %s did snapshot %s %s", user, action, name)
+	wish.Println(sess, fmt.Sprintf("%s snapshot %s.", done, name))
+}
+
+// checkSnapshot checks that a user may save or restore a snapshot now
+func (s *Server) checkSnapshot(sess ssh.Session, user string) error {
+	if err := s.checkAccess(sess); err != nil {
+		return err
+	}
+	return s.checkMaintenance(user)
+}
+
+// listSnapshots prints a user's snapshots, oldest first
+func (s *Server) listSnapshots(sess ssh.Session, user string) {
+	snapshots, err := s.vmManager.ListSnapshots(user)
+	if err != nil {
+		wish.Errorln(sess, fmt.Sprintf("Failed to list snapshots: %v", err))
+		sess.Exit(1)
+		return
+	}
+	if len(snapshots) == 0 {
+		wish.Println(sess, fmt.Sprintf("Your VM has no snapshots. You can keep up to %d.", s.config.Snapshots))
+		return
+	}
+	for _, snapshot := range snapshots {
+		wish.Println(sess, fmt.Sprintf("%-24s %s", snapshot.Name, snapshot.Created.Format("2006-01-02 15:04")))
+	}
+}
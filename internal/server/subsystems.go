@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal/usage"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// RegisterSubsystem serves the named SSH subsystem on the host with handler,
+// without starting a VM. It must be called before Run.
+func (s *Server) RegisterSubsystem(name string, handler ssh.SubsystemHandler) {
+	s.subsystems[name] = handler
+}
+
+// ProxySubsystem forwards the named SSH subsystem to the sshd of the user's
+// VM, starting the VM if needed. It must be called before Run.
+func (s *Server) ProxySubsystem(name string) {
+	s.RegisterSubsystem(name, func(sess ssh.Session) {
+		sess.Exit(s.proxySubsystem(sess, name))
+	})
+}
+
+// proxySubsystem runs a proxied subsystem session, returning its exit status.
+// Subsystems speak binary protocols, so nothing is shown to the client.
+func (s *Server) proxySubsystem(sess ssh.Session, name string) int {
+	user := sess.User()
+	ctx := sess.Context()
+	s.logger.Printf("SSH %s subsystem from %s (user: %s)", name, sess.RemoteAddr(), user)
+
+	country := s.country(sess.RemoteAddr())
+	err := s.checkMaintenance(user)
+	if err == nil {
+		err = s.checkAccess(sess)
+	}
+	if err == nil {
+		err = s.checkCountry(user, country)
+	}
+	if err != nil {
+		provisionFailures.Inc(failureReason(err))
+		s.logger.Printf("Refused %s subsystem for user %s: %v", name, user, err)
+		return 1
+	}
+	if err := s.checkQuota(user); err != nil {
+		provisionFailures.Inc(failureReason(err))
+		s.logger.Printf("Refused %s subsystem for user %s: %v", name, user, err)
+		return 1
+	}
+
+	if _, exists := s.vmManager.GetVM(user); !exists {
+		s.labelVM(user)
+		s.labelCountry(user, country)
+	}
+	defer s.useVM(user)()
+	testVM, err := s.getOrCreateVM(ctx, user, nil)
+	if err == nil {
+		if err = s.vmManager.WaitReady(ctx, testVM, nil); err != nil {
+			s.releaseVM(testVM)
+		}
+	}
+	if err != nil {
+		provisionFailures.Inc(failureReason(err))
+		s.logger.Errorf("Failed to create VM for %s subsystem of user %s: %v", name, user, err)
+		return 1
+	}
+	defer s.releaseVM(testVM)
+
+	events := s.vmManager.Events()
+	detail := fmt.Sprintf("%s subsystem from %s", name, sess.RemoteAddr())
+	events.Record(testVM.ID, vm.EventSessionAttached, detail)
+	defer events.Record(testVM.ID, vm.EventSessionDetached, detail)
+
+	meter := s.usage.Attach(user, s.config.VMMemory)
+	defer s.usage.Detach(user)
+
+	status, err := proxySubsystemToVM(sess, testVM, name, meter)
+	if err != nil {
+		s.logger.Errorf("Subsystem %s proxy error for user %s: %v", name, user, err)
+	}
+	return status
+}
+
+// proxySubsystemToVM requests a subsystem on the VM and pipes it to the
+// client session, returning the subsystem's exit status
+func proxySubsystemToVM(sess ssh.Session, testVM *vm.VM, name string, meter *usage.Meter) (int, error) {
+	dialCtx, cancel := context.WithTimeout(sess.Context(), guestDialTimeout)
+	defer cancel()
+	vmClient, release, err := testVM.GuestClient(dialCtx)
+	if err != nil {
+		return 1, err
+	}
+	defer release()
+
+	// Use a raw channel, since cryptoSSH.Session can't wait on subsystems
+	channel, requests, err := vmClient.OpenChannel("session", nil)
+	if err != nil {
+		return 1, fmt.Errorf("failed to create VM session: %w", err)
+	}
+	defer channel.Close()
+
+	ok, err := channel.SendRequest("subsystem", true, cryptoSSH.Marshal(struct{ Name string }{name}))
+	if err != nil {
+		return 1, fmt.Errorf("failed to request %s subsystem: %w", name, err)
+	}
+	if !ok {
+		return 1, fmt.Errorf("VM refused %s subsystem", name)
+	}
+
+	// Forward client EOF so request/response protocols can finish cleanly
+	go func() {
+		io.Copy(channel, meter.CountIn(sess))
+		channel.CloseWrite()
+	}()
+	go io.Copy(meter.CountOut(sess.Stderr()), channel.Stderr())
+
+	// The exit status arrives as a request before the VM closes the channel
+	status := make(chan int, 1)
+	go func() {
+		exitStatus := 1
+		for req := range requests {
+			var msg struct{ Status uint32 }
+			if req.Type == "exit-status" && cryptoSSH.Unmarshal(req.Payload, &msg) == nil {
+				exitStatus = int(msg.Status)
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		status <- exitStatus
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(meter.CountOut(sess), channel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		select {
+		case code := <-status:
+			return code, nil
+		case <-testVM.Exited():
+			return 1, testVM.ExitErr()
+		case <-sess.Context().Done():
+			return 1, sess.Context().Err()
+		}
+	case <-testVM.Exited():
+		return 1, testVM.ExitErr()
+	case <-sess.Context().Done():
+		return 1, sess.Context().Err()
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// iutf8 is the RFC 8160 terminal mode opcode for UTF-8 input, which
+// x/crypto/ssh has no constant for
+const iutf8 = 42
+
+// terminal wraps a session to write what its client can display. Output to
+// clients without ANSI support has escape sequences stripped, and output to
+// clients without UTF-8 has symbols replaced with ASCII.
+type terminal struct {
+	ssh.Session
+	stdout   *clientWriter // Nil to write to the session directly
+	stderr   *clientWriter
+	ansi     bool
+	utf8     bool
+	messages []map[string]string // Catalogs to look messages up in, most specific first
+	language string              // Language of the client's locale, like "pt_BR", for plurals
+}
+
+// newTerminal detects the capabilities and language of a session's client
+func (s *Server) newTerminal(sess ssh.Session) *terminal {
+	env := make(map[string]string)
+	for _, kv := range sess.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	pty, _, isPty := sess.Pty()
+	t := &terminal{Session: sess, stdout: s.sessionWriter(sess, sess), stderr: s.sessionWriter(sess, sess.Stderr())}
+	t.ansi = isPty && pty.Term != "" && pty.Term != "dumb"
+
+	// Trust the locale if the client sent one, then the IUTF8 mode, and
+	// otherwise assume modern terminals speak UTF-8
+	locale := firstNonEmpty(env["LC_ALL"], env["LC_CTYPE"], env["LANG"])
+	if locale != "" && locale != "C" && locale != "POSIX" {
+		lower := strings.ToLower(locale)
+		t.utf8 = strings.Contains(lower, "utf-8") || strings.Contains(lower, "utf8")
+	} else if mode, ok := pty.Modes[iutf8]; ok {
+		t.utf8 = mode == 1
+	} else {
+		t.utf8 = t.ansi && locale == ""
+	}
+
+	language := firstNonEmpty(env["LC_ALL"], env["LC_MESSAGES"], env["LANG"])
+	t.messages = s.catalog.lookup(language)
+	t.language = localeLanguage(language)
+	return t
+}
+
+// rawOut returns the writer of the session's output, which isn't adapted to
+// the client
+func (t *terminal) rawOut() io.Writer {
+	if t.stdout == nil {
+		return t.Session
+	}
+	return t.stdout
+}
+
+// rawErr returns the writer of the session's error output
+func (t *terminal) rawErr() io.Writer {
+	if t.stderr == nil {
+		return t.Session.Stderr()
+	}
+	return t.stderr
+}
+
+// buffered returns how many bytes of output are waiting for the client
+func (t *terminal) buffered() int {
+	if t.stdout == nil {
+		return 0
+	}
+	return t.stdout.Buffered()
+}
+
+// flush writes the output still waiting for the client and stops writing
+// more. It must be called before the session exits.
+func (t *terminal) flush() {
+	if t.stdout != nil {
+		t.stdout.Close()
+		t.stderr.Close()
+	}
+}
+
+// setTitle sets the title of the client's terminal window, saving the
+// previous title on the terminal's title stack. The returned function
+// restores it, and both do nothing for clients without ANSI support.
+func (t *terminal) setTitle(title string) func() {
+	if !t.ansi {
+		return func() {}
+	}
+	// Control characters would end the sequence early
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title)
+	t.rawOut().Write([]byte("\033[22;0t\033]0;" + title + "\a"))
+	return func() {
+		t.rawOut().Write([]byte("\033[23;0t"))
+	}
+}
+
+// firstNonEmpty returns the first of values that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// asciiReplacements are ASCII stand-ins for symbols used in server output
+var asciiReplacements = map[rune]string{
+	'▮': "#", '▯': ".",
+	'─': "-", '━': "-", '│': "|", '┃': "|",
+	'┌': "+", '┐': "+", '└': "+", '┘': "+",
+	'├': "+", '┤': "+", '┬': "+", '┴': "+", '┼': "+",
+	'…': "...", '’': "'", '“': "\"", '”': "\"",
+}
+
+// Write writes p with anything the client can't display removed
+func (t *terminal) Write(p []byte) (int, error) {
+	if t.ansi && t.utf8 {
+		return t.rawOut().Write(p)
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(p); {
+		// Skip CSI escape sequences, which end in a byte from @ to ~
+		if !t.ansi && p[i] == '\033' && i+1 < len(p) && p[i+1] == '[' {
+			i += 2
+			for i < len(p) && (p[i] < '@' || p[i] > '~') {
+				i++
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(p[i:])
+		i += size
+		switch {
+		case t.utf8 || r < utf8.RuneSelf:
+			out.WriteRune(r)
+		case asciiReplacements[r] != "":
+			out.WriteString(asciiReplacements[r])
+		case unicode.Is(unicode.So, r) || unicode.Is(unicode.Variation_Selector, r):
+			// Drop emoji and other decorations
+		default:
+			out.WriteByte('?')
+		}
+	}
+
+	if _, err := t.rawOut().Write([]byte(out.String())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+const (
+	termsPrompt   = `Type "yes" to accept: `
+	refusedTerms  = "You must accept the terms of service to use this server."
+	termsReadFail = "The terms of service can't be shown right now. Please try again later."
+)
+
+// termsPrompter shows the terms of service to users who haven't accepted
+// their current version, and lets them in once they answer "yes"
+type termsPrompter struct {
+	s *Server
+}
+
+// loadTerms reads the terms of service and their version. The file is
+// reread on every login, so the terms can be changed without a restart.
+func (s *Server) loadTerms() (text, version string, err error) {
+	data, err := os.ReadFile(s.config.Terms)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read terms of service: %w", err)
+	}
+	text = strings.TrimSpace(string(data))
+	version = s.config.TermsVersion
+	if version == "" {
+		sum := sha256.Sum256([]byte(text))
+		version = hex.EncodeToString(sum[:6])
+	}
+	return text, version, nil
+}
+
+// Pending reports whether the user hasn't accepted the current terms. If
+// the terms can't be read, nobody is let in without them.
+func (p termsPrompter) Pending(user string) bool {
+	if p.s.config.Terms == "" {
+		return false
+	}
+	_, version, err := p.s.loadTerms()
+	if err != nil {
+		return true
+	}
+	stat, ok := p.s.userStats.GetUserStat(user)
+	return !ok || stat.TermsVersion != version
+}
+
+// Prompt shows the terms and records the user's acceptance
+func (p termsPrompter) Prompt(user string, remote net.Addr, challenge cryptoSSH.KeyboardInteractiveChallenge) error {
+	text, version, err := p.s.loadTerms()
+	if err != nil {
+		p.s.logger.Errorf("%v", err)
+		return errors.New(termsReadFail)
+	}
+	answers, err := challenge("", text+"\n", []string{termsPrompt}, []bool{true})
+	if err != nil || len(answers) != 1 || !strings.EqualFold(strings.TrimSpace(answers[0]), "yes") {
+		return errors.New(refusedTerms)
+	}
+
+	p.s.userStats.AcceptTerms(user, version)
+	if err := p.s.userStats.Save(); err != nil {
+		p.s.logger.Errorf("Failed to save user stats: %v", err)
+	}
+	p.s.logger.Printf("User %s from %s accepted terms of service version %s", user, remote, version)
+	return nil
+}
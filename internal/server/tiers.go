@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// tier ranks users for preemption. At capacity, a user's new VM may stop an
+// idle VM of a user in a lower tier.
+type tier int
+
+const (
+	tierAnonymous tier = iota // Everyone not in the tiers file
+	tierSupporter
+	tierAdmin
+)
+
+// tierNames are the names of the tiers in the tiers file
+var tierNames = []string{tierAnonymous: "anonymous", tierSupporter: "supporter", tierAdmin: "admin"}
+
+// String returns the tier's name in the tiers file
+func (t tier) String() string { return tierNames[t] }
+
+var preemptions = metrics.NewCounterVec(
+	"sshhv_vm_preemptions_total",
+	"Number of idle VMs stopped to make room for a user of a higher tier, by the tier of the stopped VM.",
+	"tier",
+)
+
+// loadTiers reads a file of "USER TIER" lines, where blank lines and lines
+// starting with # are ignored
+func loadTiers(path string) (map[string]tier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tiers: %w", err)
+	}
+
+	tiers := make(map[string]tier)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected USER TIER", path, n)
+		}
+		rank := slices.Index(tierNames, fields[1])
+		if rank < 0 {
+			return nil, fmt.Errorf("%s:%d: unknown tier %q (use admin, supporter, or anonymous)", path, n, fields[1])
+		}
+		tiers[fields[0]] = tier(rank)
+	}
+	return tiers, nil
+}
+
+// tiers returns the tier of every user not in the anonymous tier. The file is
+// reread every time, so users can be moved between tiers without a restart.
+func (s *Server) tiers() map[string]tier {
+	if s.config.Tiers == "" {
+		return nil
+	}
+	tiers, err := loadTiers(s.config.Tiers)
+	if err != nil {
+		s.logger.Errorf("Failed to load tiers: %v", err)
+		return nil
+	}
+	return tiers
+}
+
+// useVM marks a user's VM as in use by a session, including while it is
+// provisioned, so it isn't preempted. The returned function ends the use.
+func (s *Server) useVM(vmID string) func() {
+	s.inUseMu.Lock()
+	defer s.inUseMu.Unlock()
+	s.inUse[vmID]++
+
+	return func() {
+		s.inUseMu.Lock()
+		defer s.inUseMu.Unlock()
+		if s.inUse[vmID]--; s.inUse[vmID] == 0 {
+			delete(s.inUse, vmID)
+		}
+	}
+}
+
+// idle reports whether no session is using a VM, like one kept for the
+// reattach window or held for a user the coordinator scheduled
+func (s *Server) idle(vmID string) bool {
+	s.inUseMu.Lock()
+	defer s.inUseMu.Unlock()
+	return s.inUse[vmID] == 0
+}
+
+// getOrCreateVM gets a user's VM like the manager's GetOrCreateVM, but when
+// the server is at capacity it first preempts an idle VM of a lower tier
+func (s *Server) getOrCreateVM(ctx context.Context, user string, progress chan<- vm.ProgressEvent) (*vm.VM, error) {
+	testVM, err := s.vmManager.GetOrCreateVM(ctx, user, progress)
+	if !errors.Is(err, vm.ErrCapacity) && !errors.Is(err, vm.ErrIPExhausted) {
+		return testVM, err
+	}
+	if !s.preempt(ctx, user) {
+		return nil, err
+	}
+	return s.vmManager.GetOrCreateVM(ctx, user, progress)
+}
+
+// preempt stops the idle VM of the lowest tier below the user's, the one
+// running longest among those, to make room for the user's VM. Its disk is
+// snapshotted once it stops, if snapshots are enabled, so its user can see
+// where it was stopped. It reports whether a VM was stopped.
+func (s *Server) preempt(ctx context.Context, user string) bool {
+	tiers := s.tiers()
+	rank := tiers[user]
+	if rank == tierAnonymous {
+		return false
+	}
+	vms, err := s.vmManager.ListVMs(nil)
+	if err != nil {
+		s.logger.Errorf("Failed to list VMs to preempt: %v", err)
+		return false
+	}
+
+	var victim *vm.VMInfo
+	for i, info := range vms {
+		if !info.Running || tiers[info.ID] >= rank || !s.idle(info.ID) {
+			continue
+		}
+		if victim == nil || tiers[info.ID] < tiers[victim.ID] ||
+			(tiers[info.ID] == tiers[victim.ID] && info.StateSince.Before(victim.StateSince)) {
+			victim = &vms[i]
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	s.logger.Warnf("Preempting idle VM %s (%s) for user %s (%s)", victim.ID, tiers[victim.ID], user, rank)
+	s.vmManager.Events().Record(victim.ID, vm.EventPreempted, fmt.Sprintf("for %s user %s", rank, user))
+	stopCtx, cancel := context.WithTimeout(ctx, s.config.ShutdownTimeout+stopGracePeriod)
+	defer cancel()
+	if err := s.vmManager.DestroyVM(stopCtx, victim.ID); err != nil {
+		s.logger.Errorf("Failed to preempt VM %s: %v", victim.ID, err)
+		return false
+	}
+	preemptions.Inc(tiers[victim.ID].String())
+
+	if s.config.Snapshots > 0 {
+		name := "preempted-" + time.Now().UTC().Format("20060102-150405")
+		if err := s.vmManager.SnapshotVM(ctx, victim.ID, name); err != nil {
+			s.logger.Warnf("Failed to snapshot preempted VM %s: %v", victim.ID, err)
+		}
+	}
+	return true
+}
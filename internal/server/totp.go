@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// TOTP parameters from RFC 6238, as used by common authenticator apps
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	totpModulo = 1_000_000 // 10^totpDigits
+	totpSkew   = 1         // Steps of clock drift accepted either way
+)
+
+// totpPrompt is asked for over keyboard-interactive authentication
+const totpPrompt = "Verification code: "
+
+// loadTOTPSecrets reads a file of "USER SECRET" lines, where SECRET is the
+// base32 key shared with the user's authenticator app. Blank lines and lines
+// starting with # are ignored.
+func loadTOTPSecrets(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOTP secrets: %w", err)
+	}
+
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected USER SECRET", path, n)
+		}
+		encoded := strings.TrimRight(strings.ToUpper(fields[1]), "=")
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("%s:%d: secret of user %s is not valid base32", path, n, fields[0])
+		}
+		secrets[fields[0]] = secret
+	}
+	return secrets, nil
+}
+
+// totpCode returns the code for a secret in the time step containing t
+func totpCode(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpPeriod/time.Second)))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+// verifyTOTP reports whether code is valid for the secret at now, allowing
+// for clock drift of totpSkew steps
+func verifyTOTP(secret []byte, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return false
+	}
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		want := totpCode(secret, now.Add(time.Duration(skew)*totpPeriod))
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// totpSecret returns a user's TOTP secret, if they must enter a code to log
+// in. The file is reread for every attempt, so users can be enrolled without
+// a restart, and an unreadable file locks out everyone who might be in it.
+func (s *Server) totpSecret(user string) ([]byte, bool) {
+	if s.config.TOTPUsers == "" {
+		return nil, false
+	}
+	secrets, err := loadTOTPSecrets(s.config.TOTPUsers)
+	if err != nil {
+		s.logger.Errorf("Failed to load TOTP secrets: %v", err)
+		return nil, true
+	}
+	secret, ok := secrets[user]
+	return secret, ok
+}
+
+// totpPrompter asks users with a TOTP secret for their current code
+type totpPrompter struct {
+	s *Server
+}
+
+// Pending reports whether the user has a TOTP secret
+func (p totpPrompter) Pending(user string) bool {
+	_, ok := p.s.totpSecret(user)
+	return ok
+}
+
+// Prompt asks for the user's current code and checks it
+func (p totpPrompter) Prompt(user string, remote net.Addr, challenge cryptoSSH.KeyboardInteractiveChallenge) error {
+	secret, ok := p.s.totpSecret(user)
+	if !ok || secret == nil {
+		return errors.New(refusedTOTP)
+	}
+	answers, err := challenge("", "", []string{totpPrompt}, []bool{false})
+	if err != nil || len(answers) != 1 {
+		return errors.New(refusedTOTP)
+	}
+	if !verifyTOTP(secret, answers[0], time.Now()) {
+		p.s.logger.Warnf("Wrong verification code for user %s from %s", user, remote)
+		return errors.New(refusedTOTP)
+	}
+	return nil
+}
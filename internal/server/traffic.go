@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// trafficCountInterval is how often VMs' traffic counters are read
+const trafficCountInterval = 10 * time.Second
+
+// trafficGauges are each running VM's traffic beyond the host since it
+// started, like vmmGauges
+var trafficGauges = []struct {
+	gauge *metrics.GaugeVec
+	value func(vm.Traffic) uint64
+}{
+	{metrics.NewGaugeVec("sshhv_vm_traffic_in_bytes", "Bytes received by the VM from beyond the host since it started, by VM.", "vm"),
+		func(t vm.Traffic) uint64 { return t.BytesIn }},
+	{metrics.NewGaugeVec("sshhv_vm_traffic_out_bytes", "Bytes sent by the VM beyond the host since it started, by VM.", "vm"),
+		func(t vm.Traffic) uint64 { return t.BytesOut }},
+	{metrics.NewGaugeVec("sshhv_vm_traffic_in_packets", "Packets received by the VM from beyond the host since it started, by VM.", "vm"),
+		func(t vm.Traffic) uint64 { return t.PacketsIn }},
+	{metrics.NewGaugeVec("sshhv_vm_traffic_out_packets", "Packets sent by the VM beyond the host since it started, by VM.", "vm"),
+		func(t vm.Traffic) uint64 { return t.PacketsOut }},
+}
+
+// chargeTraffic adds new traffic of a VM to its user's statistics and usage
+func (s *Server) chargeTraffic(testVM *vm.VM, delta vm.Traffic) {
+	s.userStats.AddTraffic(testVM.ID, delta.BytesIn, delta.BytesOut)
+	s.usage.AddTraffic(testVM.ID, int64(delta.BytesIn), int64(delta.BytesOut))
+}
+
+// updateTrafficMetrics refreshes the per-VM traffic gauges from running VMs
+func (s *Server) updateTrafficMetrics() error {
+	if !s.config.CountTraffic {
+		return nil
+	}
+	vms, err := s.vmManager.ListVMs(nil)
+	if err != nil {
+		return err
+	}
+	for _, g := range trafficGauges {
+		g.gauge.Reset()
+	}
+	for _, info := range vms {
+		testVM, ok := s.vmManager.GetVM(info.ID)
+		if !info.Running || !ok {
+			continue
+		}
+		traffic := testVM.Traffic()
+		for _, g := range trafficGauges {
+			g.gauge.Set(info.ID, float64(g.value(traffic)))
+		}
+	}
+	return nil
+}
+
+// handleTraffic returns a running VM's traffic beyond the host since it
+// started, as of the last count
+func (s *Server) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	if !s.config.CountTraffic {
+		http.Error(w, "traffic counting is disabled", http.StatusNotFound)
+		return
+	}
+	testVM, ok := s.vmManager.GetVM(r.PathValue("id"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("VM %s is not running", r.PathValue("id")), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(testVM.Traffic())
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+)
+
+// rootfsCommand is the command users run on the hypervisor, as in
+// "ssh alice@host rootfs fetch https://example.com/my.ext4", to replace their
+// VM's disk with their own image. rootfsSubsystem takes uploads of one, as
+// in "sftp -s rootfs alice@host" followed by "put my.ext4".
+const (
+	rootfsCommand   = "rootfs"
+	rootfsSubsystem = "rootfs"
+)
+
+// rootfsUsage explains the rootfs command's arguments
+const rootfsUsage = "Usage: rootfs [fetch URL]"
+
+// rootfsFetchTimeout bounds downloading a user's rootfs
+const rootfsFetchTimeout = 30 * time.Minute
+
+// errVMRunning is returned when a user brings a rootfs while their VM runs
+var errVMRunning = errors.New("your VM is running, so close its sessions first")
+
+// rootfsLimit returns the size in bytes of the largest rootfs a user may
+// bring, which fits in both the size limit and their disk quota
+func (s *Server) rootfsLimit(user string) (int64, error) {
+	limit := int64(s.config.UserRootfs) << 20
+	if s.config.DiskQuota > 0 {
+		used, err := s.vmManager.VMDiskUsage(user)
+		if err != nil {
+			return 0, err
+		}
+		limit = min(limit, int64(s.config.DiskQuota)<<20-used)
+		if limit <= 0 {
+			return 0, fmt.Errorf("your VM's data already takes all of your %d MB disk quota", s.config.DiskQuota)
+		}
+	}
+	return limit, nil
+}
+
+// installRootfs checks a user's image and makes it their VM's disk
+func (s *Server) installRootfs(ctx context.Context, user, path string, limit int64) error {
+	if err := image.CheckRootfs(path, limit); err != nil {
+		return err
+	}
+	if _, running := s.vmManager.GetVM(user); running {
+		return errVMRunning
+	}
+	if err := s.vmManager.InstallRootfs(ctx, user, path); err != nil {
+		return err
+	}
+	s.logger.Printf("Installed rootfs brought by user %s", user)
+	return nil
+}
+
+// checkBringRootfs checks that a user may replace their VM's disk now
+func (s *Server) checkBringRootfs(sess ssh.Session, user string) error {
+	if s.config.UserRootfs <= 0 {
+		return fmt.Errorf("bringing your own rootfs is disabled on this server")
+	}
+	if err := s.checkAccess(sess); err != nil {
+		return err
+	}
+	if _, running := s.vmManager.GetVM(user); running {
+		return errVMRunning
+	}
+	return nil
+}
+
+// runRootfsCommand explains how to bring a rootfs, or fetches one from a URL
+func (s *Server) runRootfsCommand(sess ssh.Session, user, arg string) {
+	action, rawURL, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	rawURL = strings.TrimSpace(rawURL)
+	if action != "" && (action != "fetch" || rawURL == "") {
+		wish.Errorln(sess, rootfsUsage)
+		sess.Exit(1)
+		return
+	}
+	if err := s.checkBringRootfs(sess, user); err != nil {
+		wish.Errorln(sess, fmt.Sprintf("Error: %v", err))
+		sess.Exit(1)
+		return
+	}
+	limit, err := s.rootfsLimit(user)
+	if err != nil {
+		wish.Errorln(sess, fmt.Sprintf("Error: %v", err))
+		sess.Exit(1)
+		return
+	}
+
+	if action == "" {
+		wish.Println(sess, fmt.Sprintf("Replace your VM's disk with an ext4 image of up to %d MB, either by uploading it:", limit>>20))
+		wish.Println(sess, fmt.Sprintf("  echo 'put my.ext4' | sftp -s %s -P %d %s@%s", rootfsSubsystem, s.config.Port, user, s.publicHost(sess)))
+		wish.Println(sess, "or by fetching it:")
+		wish.Println(sess, fmt.Sprintf("  ssh -p %d %s@%s %s fetch https://example.com/my.ext4", s.config.Port, user, s.publicHost(sess), rootfsCommand))
+		wish.Println(sess, "Your current disk is discarded. Save a snapshot first to keep it.")
+		return
+	}
+
+	wish.Println(sess, "Fetching "+rawURL+"...")
+	if err := s.fetchRootfs(sess.Context(), user, rawURL, limit); err != nil {
+		s.logger.Printf("Failed to fetch rootfs for user %s from %s: %v", user, rawURL, err)
+		wish.Errorln(sess, fmt.Sprintf("Error: %v", err))
+		sess.Exit(1)
+		return
+	}
+	wish.Println(sess, "Installed your rootfs. Your VM boots it next time you connect.")
+}
+
+// fetchRootfs downloads a user's rootfs from an http(s) URL and installs it
+func (s *Server) fetchRootfs(ctx context.Context, user, rawURL string, limit int64) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	ctx, cancel := context.WithTimeout(ctx, rootfsFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := publicHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return fmt.Errorf("image is %d MB, more than the limit of %d MB", resp.ContentLength>>20, limit>>20)
+	}
+
+	f, err := s.vmManager.CreateUpload(user)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, io.LimitReader(resp.Body, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if n > limit {
+		return fmt.Errorf("image is more than the limit of %d MB", limit>>20)
+	}
+	return s.installRootfs(ctx, user, f.Name(), limit)
+}
+
+// serveRootfsUpload takes a rootfs upload over SFTP, returning the
+// session's exit status
+func (s *Server) serveRootfsUpload(sess ssh.Session) int {
+	user := sess.User()
+	s.logger.Printf("SSH rootfs upload from %s (user: %s)", sess.RemoteAddr(), user)
+	if err := s.checkBringRootfs(sess, user); err != nil {
+		s.logger.Printf("Refused rootfs upload for user %s: %v", user, err)
+		fmt.Fprintf(sess.Stderr(), "Error: %v\n", err)
+		return 1
+	}
+	limit, err := s.rootfsLimit(user)
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "Error: %v\n", err)
+		return 1
+	}
+	upload := &sftpUpload{
+		limit: limit,
+		create: func() (*os.File, error) {
+			if _, running := s.vmManager.GetVM(user); running {
+				return nil, errVMRunning
+			}
+			return s.vmManager.CreateUpload(user)
+		},
+		finish: func(f *os.File) error {
+			return s.installRootfs(sess.Context(), user, f.Name(), limit)
+		},
+	}
+	if err := upload.serve(sess); err != nil {
+		s.logger.Errorf("Rootfs upload error for user %s: %v", user, err)
+		return 1
+	}
+	return 0
+}
+
+// publicHTTPClient fetches from the Internet on users' behalf. It refuses to
+// connect to loopback, private, and link-local addresses, so users can't
+// reach services on the host or its network, like a cloud metadata server.
+var publicHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+					return fmt.Errorf("connecting to %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
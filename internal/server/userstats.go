@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,13 +16,32 @@ type UserStat struct {
 	Username      string    `json:"username"`
 	ConnectCount  int       `json:"connect_count"`
 	LastConnected time.Time `json:"last_connected"`
+	LastCountry   string    `json:"last_country,omitempty"` // Set when GeoIP is enabled
+
+	TermsVersion  string    `json:"terms_version,omitempty"` // Version of the terms the user last accepted
+	TermsAccepted time.Time `json:"terms_accepted,omitzero"` // When they accepted it
+
+	TrafficIn  uint64 `json:"traffic_in,omitempty"`  // Bytes the user's VMs received from beyond the host
+	TrafficOut uint64 `json:"traffic_out,omitempty"` // Bytes they sent beyond the host
+}
+
+// StatsReader is the read API of user statistics, for code that shows them
+// without recording connections
+type StatsReader interface {
+	GetUserStat(username string) (*UserStat, bool)
+	GetRecentUsers(excludeUser string, limit int) []*UserStat
 }
 
+// maxBootTimes is how many recent VM boot times are kept for percentiles
+const maxBootTimes = 1000
+
 // UserStats manages user connection statistics
 type UserStats struct {
-	mu       sync.Mutex
-	users    map[string]*UserStat
-	dataFile string
+	mu        sync.Mutex
+	users     map[string]*UserStat
+	bootTimes []float64 // Recent boot times in seconds, oldest first
+	dataFile  string
+	bootFile  string
 }
 
 // NewUserStats creates a new UserStats manager
@@ -28,14 +49,30 @@ func NewUserStats(dataDir string) *UserStats {
 	return &UserStats{
 		users:    make(map[string]*UserStat),
 		dataFile: filepath.Join(dataDir, "user_stats.json"),
+		bootFile: filepath.Join(dataDir, "boot_times.json"),
 	}
 }
 
-// Load reads user statistics from the JSON file
+// Load reads user statistics and boot times from their JSON files
 func (us *UserStats) Load() error {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
+	if err := us.loadUsers(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(us.bootFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &us.bootTimes)
+}
+
+// loadUsers reads per-user statistics. The caller must hold us.mu.
+func (us *UserStats) loadUsers() error {
 	if _, err := os.Stat(us.dataFile); os.IsNotExist(err) {
 		// File doesn't exist, start with empty stats
 		return nil
@@ -56,7 +93,6 @@ func (us *UserStats) Load() error {
 	for _, user := range users {
 		us.users[user.Username] = user
 	}
-
 	return nil
 }
 
@@ -86,36 +122,106 @@ func (us *UserStats) Save() error {
 		return err
 	}
 
-	return os.WriteFile(us.dataFile, data, 0644)
+	if err := os.WriteFile(us.dataFile, data, 0644); err != nil {
+		return err
+	}
+
+	bootData, err := json.Marshal(us.bootTimes)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(us.bootFile, bootData, 0644)
+}
+
+// RecordBootTime records how long a fresh VM took from connection to shell
+func (us *UserStats) RecordBootTime(d time.Duration) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.bootTimes = append(us.bootTimes, d.Seconds())
+	if len(us.bootTimes) > maxBootTimes {
+		us.bootTimes = us.bootTimes[len(us.bootTimes)-maxBootTimes:]
+	}
 }
 
-// RecordConnection records a user connection
-func (us *UserStats) RecordConnection(username string) {
+// BootTimePercentile returns the p-th percentile (0 to 100) of recent boot
+// times, or false if none have been recorded
+func (us *UserStats) BootTimePercentile(p float64) (time.Duration, bool) {
+	us.mu.Lock()
+	sorted := append([]float64(nil), us.bootTimes...)
+	us.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, false
+	}
+	sort.Float64s(sorted)
+	i := int(math.Round(p / 100 * float64(len(sorted)-1)))
+	return time.Duration(sorted[i] * float64(time.Second)), true
+}
+
+// RecordConnection records a user connection, with the country it came from
+// if GeoIP is enabled
+func (us *UserStats) RecordConnection(username, country string) {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
 	if user, exists := us.users[username]; exists {
 		user.ConnectCount++
 		user.LastConnected = time.Now()
+		user.LastCountry = country
 	} else {
 		us.users[username] = &UserStat{
 			Username:      username,
 			ConnectCount:  1,
 			LastConnected: time.Now(),
+			LastCountry:   country,
 		}
 	}
 }
 
-// GetUserStat returns statistics for a specific user
+// AcceptTerms records that a user accepted a version of the terms of service
+func (us *UserStats) AcceptTerms(username, version string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	user, exists := us.users[username]
+	if !exists {
+		user = &UserStat{Username: username}
+		us.users[username] = user
+	}
+	user.TermsVersion = version
+	user.TermsAccepted = time.Now()
+}
+
+// AddTraffic adds traffic of a user's VM beyond the host to their totals
+func (us *UserStats) AddTraffic(username string, in, out uint64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	user, exists := us.users[username]
+	if !exists {
+		user = &UserStat{Username: username}
+		us.users[username] = user
+	}
+	user.TrafficIn += in
+	user.TrafficOut += out
+}
+
+// GetUserStat returns a copy of the statistics for a specific user
 func (us *UserStats) GetUserStat(username string) (*UserStat, bool) {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
 	user, exists := us.users[username]
-	return user, exists
+	if !exists {
+		return nil, false
+	}
+	stat := *user
+	return &stat, true
 }
 
-// GetRecentUsers returns the most recent users (excluding the current user)
+// GetRecentUsers returns copies of the statistics of the most recent users
+// (excluding the current user)
 func (us *UserStats) GetRecentUsers(excludeUser string, limit int) []*UserStat {
 	us.mu.Lock()
 	defer us.mu.Unlock()
@@ -123,11 +229,8 @@ func (us *UserStats) GetRecentUsers(excludeUser string, limit int) []*UserStat {
 	users := make([]*UserStat, 0, len(us.users))
 	for _, user := range us.users {
 		if user.Username != excludeUser {
-			users = append(users, &UserStat{
-				Username:      user.Username,
-				ConnectCount:  user.ConnectCount,
-				LastConnected: user.LastConnected,
-			})
+			stat := *user
+			users = append(users, &stat)
 		}
 	}
 
@@ -142,3 +245,99 @@ func (us *UserStats) GetRecentUsers(excludeUser string, limit int) []*UserStat {
 
 	return users
 }
+
+// statsArchiveVersion is the format version of exported statistics
+const statsArchiveVersion = 1
+
+// StatsArchive is the statistics of an instance in a portable form, for
+// moving them between hosts and consolidating nodes
+type StatsArchive struct {
+	Version   int         `json:"version"`
+	Exported  time.Time   `json:"exported"`
+	Users     []*UserStat `json:"users"`
+	BootTimes []float64   `json:"boot_times,omitempty"` // Seconds, oldest first
+}
+
+// Export returns a copy of all statistics as an archive
+func (us *UserStats) Export() *StatsArchive {
+	archive := &StatsArchive{
+		Version:  statsArchiveVersion,
+		Exported: time.Now().UTC(),
+		Users:    us.GetRecentUsers("", 0),
+	}
+	us.mu.Lock()
+	archive.BootTimes = append([]float64(nil), us.bootTimes...)
+	us.mu.Unlock()
+	return archive
+}
+
+// Import replaces all statistics with those in an archive
+func (us *UserStats) Import(archive *StatsArchive) error {
+	if err := archive.check(); err != nil {
+		return err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.users = make(map[string]*UserStat)
+	us.bootTimes = nil
+	us.merge(archive)
+	return nil
+}
+
+// Merge adds the statistics in an archive to the current ones. Connection
+// counts and traffic of users in both are added, and the most recent
+// connection wins.
+func (us *UserStats) Merge(archive *StatsArchive) error {
+	if err := archive.check(); err != nil {
+		return err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.merge(archive)
+	return nil
+}
+
+// merge adds an archive's statistics. The caller must hold us.mu.
+func (us *UserStats) merge(archive *StatsArchive) {
+	for _, stat := range archive.Users {
+		user, exists := us.users[stat.Username]
+		if !exists {
+			copied := *stat
+			us.users[stat.Username] = &copied
+			continue
+		}
+		user.ConnectCount += stat.ConnectCount
+		user.TrafficIn += stat.TrafficIn
+		user.TrafficOut += stat.TrafficOut
+		if stat.LastConnected.After(user.LastConnected) {
+			user.LastConnected = stat.LastConnected
+			user.LastCountry = stat.LastCountry
+		}
+		if stat.TermsAccepted.After(user.TermsAccepted) {
+			user.TermsVersion = stat.TermsVersion
+			user.TermsAccepted = stat.TermsAccepted
+		}
+	}
+
+	// Boot times from different instances don't interleave meaningfully, so
+	// the archive's are appended and the oldest dropped past the limit
+	us.bootTimes = append(us.bootTimes, archive.BootTimes...)
+	if len(us.bootTimes) > maxBootTimes {
+		us.bootTimes = us.bootTimes[len(us.bootTimes)-maxBootTimes:]
+	}
+}
+
+// check returns an error if an archive can't be imported
+func (archive *StatsArchive) check() error {
+	if archive.Version != statsArchiveVersion {
+		return fmt.Errorf("unsupported stats archive version %d", archive.Version)
+	}
+	for _, stat := range archive.Users {
+		if stat == nil || stat.Username == "" {
+			return fmt.Errorf("stats archive has a user without a name")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/metrics"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+)
+
+// vmmGauges are Firecracker's per-VM statistics since each VM started. They
+// are gauges, since their series disappear when VMs stop.
+var vmmGauges = []struct {
+	gauge *metrics.GaugeVec
+	value func(*vm.VMMMetrics) uint64
+}{
+	{metrics.NewGaugeVec("sshhv_vm_vcpu_exits", "VCPU exits to the VMM for IO and MMIO since the VM started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.VcpuExits }},
+	{metrics.NewGaugeVec("sshhv_vm_block_read_bytes", "Bytes read from block devices since the VM started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.BlockReadBytes }},
+	{metrics.NewGaugeVec("sshhv_vm_block_write_bytes", "Bytes written to block devices since the VM started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.BlockWriteBytes }},
+	{metrics.NewGaugeVec("sshhv_vm_net_rx_bytes", "Bytes received by the VM's network interface since it started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.NetRxBytes }},
+	{metrics.NewGaugeVec("sshhv_vm_net_tx_bytes", "Bytes sent by the VM's network interface since it started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.NetTxBytes }},
+	{metrics.NewGaugeVec("sshhv_vm_dirty_pages", "Guest memory pages dirtied since the VM started, by VM.", "vm"),
+		func(m *vm.VMMMetrics) uint64 { return m.DirtyPages }},
+}
+
+// vmmFollowInterval is how often a followed VM's metrics are checked for a
+// new flush
+const vmmFollowInterval = time.Second
+
+// updateVMMMetrics refreshes the per-VM gauges from running VMs
+func (s *Server) updateVMMMetrics() error {
+	vms, err := s.vmManager.ListVMs(nil)
+	if err != nil {
+		return err
+	}
+	for _, g := range vmmGauges {
+		g.gauge.Reset()
+	}
+	for _, info := range vms {
+		if !info.Running {
+			continue
+		}
+		m, err := s.vmManager.VMMMetrics(info.ID)
+		if err != nil {
+			continue // No flush yet
+		}
+		for _, g := range vmmGauges {
+			g.gauge.Set(info.ID, float64(g.value(&m)))
+		}
+	}
+	return nil
+}
+
+// handleVMMMetrics returns a running VM's VMM-level statistics. With
+// ?follow=1, it streams them as a JSON line after each flush until the VM
+// stops or the client goes away.
+func (s *Server) handleVMMMetrics(w http.ResponseWriter, r *http.Request) {
+	vmID := r.PathValue("id")
+	m, err := s.vmManager.VMMMetrics(vmID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(m)
+	if r.URL.Query().Get("follow") == "" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(vmmFollowInterval)
+	defer ticker.Stop()
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		next, err := s.vmManager.VMMMetrics(vmID)
+		if err != nil {
+			return
+		}
+		if next.Updated.After(m.Updated) {
+			m = next
+			if enc.Encode(m) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/charmbracelet/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// wsConn is a WebSocket connection that reports the real client address
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the address of the HTTP client, not the WebSocket origin
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// startWebSocketListener serves SSH tunneled over WebSocket, feeding each
+// connection into the same SSH server. Uses TLS (wss://) when a certificate
+// is configured. Serve errors are reported on the done channel.
+func (s *Server) startWebSocketListener(ctx context.Context, server *ssh.Server, lc net.ListenConfig, done chan<- error) (*http.Server, error) {
+	handler := websocket.Server{
+		// Accept any origin, clients are usually not browsers
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+
+			remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			if err != nil {
+				s.logger.Errorf("Invalid WebSocket remote address %q: %v", ws.Request().RemoteAddr, err)
+				return
+			}
+
+			// Blocks until the SSH connection is closed
+			server.HandleConn(&wsConn{Conn: ws, remoteAddr: remoteAddr})
+		},
+	}
+
+	addr := fmt.Sprintf(":%d", s.config.WebSocketPort)
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", s.config.WebSocketPort, err)
+	}
+
+	httpServer := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		var err error
+		if s.config.WebSocketCert != "" {
+			s.logger.Printf("Starting SSH-over-WebSocket listener on port %d (wss://)", s.config.WebSocketPort)
+			err = httpServer.ServeTLS(ln, s.config.WebSocketCert, s.config.WebSocketKey)
+		} else {
+			s.logger.Printf("Starting SSH-over-WebSocket listener on port %d (ws://)", s.config.WebSocketPort)
+			err = httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			done <- fmt.Errorf("WebSocket listener: %w", err)
+		}
+	}()
+
+	return httpServer, nil
+}
@@ -0,0 +1,10 @@
+// Package shell holds helpers for building shell command lines.
+package shell
+
+import "strings"
+
+// Quote quotes s as a single word for a POSIX shell, which bash, zsh, and
+// fish all read the same way
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,18 @@
+package shell
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "two words", "it's", "'$HOME' `id` \\"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+Quote(s)).Output()
+		if err != nil {
+			t.Fatalf("Failed to run sh: %v", err)
+		}
+		if string(out) != s {
+			t.Errorf("Expected %q back from the shell, got %q", s, out)
+		}
+	}
+}
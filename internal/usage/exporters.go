@@ -0,0 +1,117 @@
+package usage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewExporter creates an exporter from a spec: "csv:PATH" or "jsonl:PATH" to
+// append to a file, or an http:// or https:// URL to POST JSON batches to
+func NewExporter(spec string) (Exporter, error) {
+	switch {
+	case strings.HasPrefix(spec, "csv:"):
+		return newFileExporter(strings.TrimPrefix(spec, "csv:"), true)
+	case strings.HasPrefix(spec, "jsonl:"):
+		return newFileExporter(strings.TrimPrefix(spec, "jsonl:"), false)
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpExporter{url: spec, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("invalid usage exporter %q, expected csv:PATH, jsonl:PATH, or an HTTP URL", spec)
+	}
+}
+
+// csvHeader names the columns written by the CSV exporter
+var csvHeader = []string{"user", "start", "end", "vm_seconds", "memory_mb_seconds", "bytes_in", "bytes_out", "net_bytes_in", "net_bytes_out"}
+
+// fileExporter appends records to a CSV or JSON Lines file
+type fileExporter struct {
+	file *os.File
+	csv  bool
+}
+
+func newFileExporter(path string, isCSV bool) (*fileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage file: %w", err)
+	}
+	e := &fileExporter{file: file, csv: isCSV}
+
+	// Start new CSV files with a header
+	if info, err := file.Stat(); err == nil && info.Size() == 0 && isCSV {
+		w := csv.NewWriter(file)
+		w.Write(csvHeader)
+		w.Flush()
+	}
+	return e, nil
+}
+
+// Export appends records to the file
+func (e *fileExporter) Export(records []Record) error {
+	var buf bytes.Buffer
+	if e.csv {
+		w := csv.NewWriter(&buf)
+		for _, r := range records {
+			w.Write([]string{
+				r.User,
+				r.Start.UTC().Format(time.RFC3339),
+				r.End.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(r.VMSeconds, 'f', 3, 64),
+				strconv.FormatFloat(r.MemoryMBSeconds, 'f', 3, 64),
+				strconv.FormatInt(r.BytesIn, 10),
+				strconv.FormatInt(r.BytesOut, 10),
+				strconv.FormatInt(r.NetBytesIn, 10),
+				strconv.FormatInt(r.NetBytesOut, 10),
+			})
+		}
+		w.Flush()
+	} else {
+		enc := json.NewEncoder(&buf)
+		for _, r := range records {
+			enc.Encode(r)
+		}
+	}
+
+	// A single write keeps each batch contiguous in the file
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the file
+func (e *fileExporter) Close() error {
+	return e.file.Close()
+}
+
+// httpExporter POSTs batches of records as a JSON array
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// Export posts records to the endpoint, which must respond with a 2xx status
+func (e *httpExporter) Export(records []Record) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("usage endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close does nothing, since requests hold no resources between exports
+func (e *httpExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package usage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ledger totals each user's VM time and traffic beyond the host for the
+// current calendar month (UTC), which quotas are checked against
+type Ledger struct {
+	mu       sync.Mutex
+	dataFile string
+	month    string
+	seconds  map[string]float64
+	traffic  map[string]int64 // Bytes in and out
+}
+
+// ledgerFile is the on-disk form of a Ledger
+type ledgerFile struct {
+	Month   string             `json:"month"`
+	Seconds map[string]float64 `json:"seconds"`
+	Traffic map[string]int64   `json:"traffic,omitempty"`
+}
+
+// NewLedger creates a ledger persisted in dataDir
+func NewLedger(dataDir string) *Ledger {
+	return &Ledger{
+		dataFile: filepath.Join(dataDir, "usage_ledger.json"),
+		month:    monthOf(time.Now()),
+		seconds:  make(map[string]float64),
+		traffic:  make(map[string]int64),
+	}
+}
+
+// monthOf returns the ledger month a time falls in
+func monthOf(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Load reads the ledger from disk, if it has been saved before
+func (l *Ledger) Load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := os.ReadFile(l.dataFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file ledgerFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Month == l.month && file.Seconds != nil {
+		l.seconds = file.Seconds
+	}
+	if file.Month == l.month && file.Traffic != nil {
+		l.traffic = file.Traffic
+	}
+	return nil
+}
+
+// Save writes the ledger to disk
+func (l *Ledger) Save() error {
+	l.mu.Lock()
+	data, err := json.MarshalIndent(ledgerFile{Month: l.month, Seconds: l.seconds, Traffic: l.traffic}, "", "  ")
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.dataFile, data, 0644)
+}
+
+// Add charges a usage record to its user in the month the record ends
+func (l *Ledger) Add(record Record) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rollover(record.End)
+	if monthOf(record.End) == l.month {
+		l.seconds[record.User] += record.VMSeconds
+		l.traffic[record.User] += record.NetBytesIn + record.NetBytesOut
+	}
+}
+
+// Used returns a user's VM time charged so far this month
+func (l *Ledger) Used(user string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rollover(time.Now())
+	return time.Duration(l.seconds[user] * float64(time.Second))
+}
+
+// TrafficUsed returns the bytes of a user's traffic beyond the host charged
+// so far this month
+func (l *Ledger) TrafficUsed(user string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rollover(time.Now())
+	return l.traffic[user]
+}
+
+// rollover starts a fresh month once now has moved past the current one
+func (l *Ledger) rollover(now time.Time) {
+	if month := monthOf(now); month > l.month {
+		l.month = month
+		l.seconds = make(map[string]float64)
+		l.traffic = make(map[string]int64)
+	}
+}
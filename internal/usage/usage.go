@@ -0,0 +1,276 @@
+// Package usage meters per-user VM usage and exports it as records that
+// operators can bill or report on.
+package usage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxPending caps records kept in memory while the exporter is failing
+const maxPending = 10000
+
+// Record is the usage of one user's VM over a period
+type Record struct {
+	User            string    `json:"user"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	VMSeconds       float64   `json:"vm_seconds"`
+	MemoryMBSeconds float64   `json:"memory_mb_seconds"`
+	BytesIn         int64     `json:"bytes_in"`  // From the user's SSH client to the VM
+	BytesOut        int64     `json:"bytes_out"` // From the VM to the user's SSH client
+
+	NetBytesIn  int64 `json:"net_bytes_in"`  // From beyond the host to the VM, when traffic is counted
+	NetBytesOut int64 `json:"net_bytes_out"` // From the VM to beyond the host
+}
+
+// Exporter writes usage records somewhere durable
+type Exporter interface {
+	Export(records []Record) error
+	Close() error
+}
+
+// Tracker meters each user's VM while sessions are attached, exporting a
+// record when the last session ends and for every interval before that
+type Tracker struct {
+	exporter Exporter // Nil if records are only charged to the ledger
+	ledger   *Ledger  // Nil if quotas are disabled
+	logger   logrus.FieldLogger
+
+	mu      sync.Mutex
+	meters  map[string]*Meter
+	pending []Record // Records not yet exported because the exporter failed
+}
+
+// Meter accumulates the usage of one user's VM for the current period
+type Meter struct {
+	user        string
+	memoryMB    int
+	sessions    int
+	periodStart time.Time
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	netBytesIn  atomic.Int64
+	netBytesOut atomic.Int64
+}
+
+// NewTracker creates a tracker that exports records with exporter and charges
+// them to ledger, either of which may be nil
+func NewTracker(exporter Exporter, ledger *Ledger, logger logrus.FieldLogger) *Tracker {
+	return &Tracker{exporter: exporter, ledger: ledger, logger: logger, meters: make(map[string]*Meter)}
+}
+
+// Attach starts or joins metering of a user's VM for a new session. It is a
+// no-op returning a nil Meter if the tracker is nil.
+func (t *Tracker) Attach(user string, memoryMB int) *Meter {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meter, ok := t.meters[user]
+	if !ok {
+		meter = &Meter{user: user, memoryMB: memoryMB, periodStart: time.Now()}
+		t.meters[user] = meter
+	}
+	meter.sessions++
+	return meter
+}
+
+// Detach ends a session, exporting the final record once no sessions remain
+func (t *Tracker) Detach(user string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	meter, ok := t.meters[user]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	meter.sessions--
+	if meter.sessions > 0 {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.meters, user)
+	t.record(meter.cut(time.Now()))
+	t.mu.Unlock()
+
+	t.export()
+}
+
+// Flush exports a record for every metered VM covering usage since the last one
+func (t *Tracker) Flush() {
+	now := time.Now()
+	t.mu.Lock()
+	for _, meter := range t.meters {
+		t.record(meter.cut(now))
+	}
+	t.mu.Unlock()
+
+	t.export()
+}
+
+// Current returns a user's VM time not yet charged to the ledger or exported
+func (t *Tracker) Current(user string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if meter, ok := t.meters[user]; ok {
+		return time.Since(meter.periodStart)
+	}
+	return 0
+}
+
+// AddTraffic meters traffic of a user's VM beyond the host. Traffic while
+// no sessions are attached isn't metered, like the VM's time.
+func (t *Tracker) AddTraffic(user string, in, out int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if meter, ok := t.meters[user]; ok {
+		meter.netBytesIn.Add(in)
+		meter.netBytesOut.Add(out)
+	}
+}
+
+// CurrentTraffic returns the bytes of a user's traffic beyond the host not
+// yet charged to the ledger or exported
+func (t *Tracker) CurrentTraffic(user string) int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if meter, ok := t.meters[user]; ok {
+		return meter.netBytesIn.Load() + meter.netBytesOut.Load()
+	}
+	return 0
+}
+
+// Run flushes usage every interval until ctx is done, then flushes a last
+// time and closes the exporter
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.Flush()
+			if t.exporter != nil {
+				if err := t.exporter.Close(); err != nil {
+					t.logger.Errorf("Failed to close usage exporter: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			t.Flush()
+		}
+	}
+}
+
+// record charges a finished period to the ledger and queues it for export.
+// The caller must hold t.mu.
+func (t *Tracker) record(r Record) {
+	if t.ledger != nil {
+		t.ledger.Add(r)
+	}
+	if t.exporter != nil {
+		t.pending = append(t.pending, r)
+	}
+}
+
+// export saves the ledger and sends pending records, keeping them for the
+// next attempt on failure
+func (t *Tracker) export() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ledger != nil {
+		if err := t.ledger.Save(); err != nil {
+			t.logger.Errorf("Failed to save usage ledger: %v", err)
+		}
+	}
+	if len(t.pending) == 0 {
+		return
+	}
+	if err := t.exporter.Export(t.pending); err != nil {
+		t.logger.Errorf("Failed to export %d usage records: %v", len(t.pending), err)
+		if len(t.pending) > maxPending {
+			t.pending = t.pending[len(t.pending)-maxPending:]
+		}
+		return
+	}
+	t.pending = nil
+}
+
+// cut returns the record for the current period and starts a new one
+func (m *Meter) cut(now time.Time) Record {
+	seconds := now.Sub(m.periodStart).Seconds()
+	record := Record{
+		User:            m.user,
+		Start:           m.periodStart,
+		End:             now,
+		VMSeconds:       seconds,
+		MemoryMBSeconds: seconds * float64(m.memoryMB),
+		BytesIn:         m.bytesIn.Swap(0),
+		BytesOut:        m.bytesOut.Swap(0),
+		NetBytesIn:      m.netBytesIn.Swap(0),
+		NetBytesOut:     m.netBytesOut.Swap(0),
+	}
+	m.periodStart = now
+	return record
+}
+
+// CountIn wraps a reader of client input so its bytes are metered
+func (m *Meter) CountIn(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &m.bytesIn}
+}
+
+// CountOut wraps a writer of VM output so its bytes are metered
+func (m *Meter) CountOut(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return &countingWriter{w: w, n: &m.bytesOut}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,225 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// memoryExporter records exported batches, failing while err is set
+type memoryExporter struct {
+	records []Record
+	err     error
+}
+
+func (e *memoryExporter) Export(records []Record) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.records = append(e.records, records...)
+	return nil
+}
+
+func (e *memoryExporter) Close() error { return nil }
+
+func TestTrackerSessions(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracker := NewTracker(exporter, nil, logrus.New())
+
+	first := tracker.Attach("alice", 128)
+	second := tracker.Attach("alice", 128)
+	if first != second {
+		t.Fatalf("Expected sessions of the same user to share a meter")
+	}
+	io.WriteString(first.CountOut(io.Discard), "hello")
+	io.ReadAll(first.CountIn(strings.NewReader("abc")))
+
+	tracker.Detach("alice")
+	if len(exporter.records) != 0 {
+		t.Fatalf("Expected no export while a session remains, got %v", exporter.records)
+	}
+
+	tracker.Detach("alice")
+	if len(exporter.records) != 1 {
+		t.Fatalf("Expected 1 record after the last session, got %d", len(exporter.records))
+	}
+	r := exporter.records[0]
+	if r.User != "alice" || r.BytesIn != 3 || r.BytesOut != 5 {
+		t.Errorf("Unexpected record %+v", r)
+	}
+	if r.MemoryMBSeconds != r.VMSeconds*128 {
+		t.Errorf("Expected memory MB-seconds to be 128x VM seconds, got %+v", r)
+	}
+}
+
+func TestTrackerFlushAndRetry(t *testing.T) {
+	exporter := &memoryExporter{err: errors.New("unavailable")}
+	tracker := NewTracker(exporter, nil, logrus.New())
+
+	meter := tracker.Attach("bob", 256)
+	io.WriteString(meter.CountOut(io.Discard), "12345678")
+	tracker.Flush()
+	if len(exporter.records) != 0 {
+		t.Fatalf("Expected failed export to record nothing")
+	}
+
+	// Records kept from the failed export are sent with the next one
+	exporter.err = nil
+	tracker.Flush()
+	if len(exporter.records) != 2 {
+		t.Fatalf("Expected 2 records after retry, got %d", len(exporter.records))
+	}
+	if exporter.records[0].BytesOut != 8 || exporter.records[1].BytesOut != 0 {
+		t.Errorf("Expected bytes to be counted in the first period only, got %+v", exporter.records)
+	}
+	if !exporter.records[0].End.Equal(exporter.records[1].Start) {
+		t.Errorf("Expected consecutive periods to be contiguous")
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	meter := tracker.Attach("alice", 128)
+	if meter != nil {
+		t.Fatalf("Expected nil meter from a nil tracker")
+	}
+	if w := meter.CountOut(io.Discard); w != io.Discard {
+		t.Errorf("Expected nil meter to leave writers unwrapped")
+	}
+	tracker.Detach("alice")
+}
+
+func TestFileExporters(t *testing.T) {
+	dir := t.TempDir()
+	records := []Record{{User: "alice", VMSeconds: 1.5, MemoryMBSeconds: 192, BytesIn: 10, BytesOut: 20, NetBytesIn: 30, NetBytesOut: 40}}
+
+	csvPath := filepath.Join(dir, "usage.csv")
+	for i := 0; i < 2; i++ {
+		exporter, err := NewExporter("csv:" + csvPath)
+		if err != nil {
+			t.Fatalf("Failed to create CSV exporter: %v", err)
+		}
+		if err := exporter.Export(records); err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+		exporter.Close()
+	}
+	data, _ := os.ReadFile(csvPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != strings.Join(csvHeader, ",") {
+		t.Fatalf("Expected header once and 2 rows, got:\n%s", data)
+	}
+	if !strings.HasPrefix(lines[1], "alice,") || !strings.HasSuffix(lines[1], ",1.500,192.000,10,20,30,40") {
+		t.Errorf("Unexpected CSV row %q", lines[1])
+	}
+
+	jsonlPath := filepath.Join(dir, "usage.jsonl")
+	exporter, err := NewExporter("jsonl:" + jsonlPath)
+	if err != nil {
+		t.Fatalf("Failed to create JSONL exporter: %v", err)
+	}
+	exporter.Export(records)
+	exporter.Close()
+	data, _ = os.ReadFile(jsonlPath)
+	var got Record
+	if err := json.Unmarshal(data, &got); err != nil || got.User != "alice" || got.BytesOut != 20 {
+		t.Errorf("Unexpected JSONL record %s (err %v)", data, err)
+	}
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var received []Record
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+
+	exporter, err := NewExporter(srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to create HTTP exporter: %v", err)
+	}
+	if err := exporter.Export([]Record{{User: "alice"}}); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if len(received) != 1 || received[0].User != "alice" {
+		t.Errorf("Unexpected records received: %+v", received)
+	}
+
+	fail = true
+	if err := exporter.Export([]Record{{User: "bob"}}); err == nil {
+		t.Errorf("Expected error on non-2xx response")
+	}
+
+	if _, err := NewExporter("ftp://example.com"); err == nil {
+		t.Errorf("Expected error for unknown exporter spec")
+	}
+}
+
+func TestLedger(t *testing.T) {
+	dir := t.TempDir()
+	ledger := NewLedger(dir)
+	tracker := NewTracker(nil, ledger, logrus.New())
+
+	tracker.Attach("alice", 128)
+	if tracker.Current("alice") <= 0 || tracker.Current("bob") != 0 {
+		t.Errorf("Expected only alice to have uncharged time")
+	}
+	tracker.Detach("alice")
+	if ledger.Used("alice") <= 0 {
+		t.Errorf("Expected alice's session to be charged to the ledger")
+	}
+
+	now := time.Now()
+	ledger.Add(Record{User: "bob", End: now, VMSeconds: 3600})
+	ledger.Add(Record{User: "bob", End: now.AddDate(0, -1, 0), VMSeconds: 3600})
+	if used := ledger.Used("bob"); used != time.Hour {
+		t.Errorf("Expected only this month's hour to count, got %v", used)
+	}
+
+	// The ledger survives restarts within the month
+	if err := ledger.Save(); err != nil {
+		t.Fatalf("Failed to save ledger: %v", err)
+	}
+	reloaded := NewLedger(dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load ledger: %v", err)
+	}
+	if used := reloaded.Used("bob"); used != time.Hour {
+		t.Errorf("Expected reloaded ledger to have bob's hour, got %v", used)
+	}
+
+	// Traffic beyond the host is metered while sessions are attached
+	tracker.AddTraffic("carol", 100, 100)
+	tracker.Attach("carol", 128)
+	tracker.AddTraffic("carol", 1000, 500)
+	if current := tracker.CurrentTraffic("carol"); current != 1500 {
+		t.Errorf("Expected 1500 bytes of uncharged traffic, got %d", current)
+	}
+	tracker.Detach("carol")
+	if used := ledger.TrafficUsed("carol"); used != 1500 {
+		t.Errorf("Expected carol's traffic to be charged to the ledger, got %d", used)
+	}
+
+	// A new month starts from zero
+	ledger.Add(Record{User: "carol", End: now.AddDate(0, 1, 0), VMSeconds: 60})
+	if used := ledger.Used("bob"); used != 0 {
+		t.Errorf("Expected bob's usage to reset in the new month, got %v", used)
+	}
+	if used := ledger.TrafficUsed("carol"); used != 0 {
+		t.Errorf("Expected carol's traffic to reset in the new month, got %d", used)
+	}
+}
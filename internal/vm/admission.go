@@ -0,0 +1,27 @@
+package vm
+
+// AdmissionCheck is asked before every new VM is created, and refuses it by
+// returning an error, which creating the VM then fails with. VMs already
+// running are never checked.
+type AdmissionCheck func(vmID string) error
+
+// AddAdmissionCheck registers a check that can refuse new VMs, like while the
+// host is in maintenance mode
+func (m *Manager) AddAdmissionCheck(check AdmissionCheck) {
+	m.admitMu.Lock()
+	defer m.admitMu.Unlock()
+	m.admitChecks = append(m.admitChecks, check)
+}
+
+// admit runs the admission checks on a VM about to be created
+func (m *Manager) admit(vmID string) error {
+	m.admitMu.Lock()
+	checks := append([]AdmissionCheck(nil), m.admitChecks...)
+	m.admitMu.Unlock()
+	for _, check := range checks {
+		if err := check(vmID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
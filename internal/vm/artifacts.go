@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/cas"
+)
+
+// ArtifactStoreDir is the directory in the data directory holding the
+// content store of kernels, Firecracker binaries, golden images downloaded
+// from object storage, and snapshots. VM IDs can't contain dots, so it never
+// clashes with a VM's directory.
+const ArtifactStoreDir = "artifacts.store"
+
+// OpenArtifacts opens the content store in a data directory
+func OpenArtifacts(dataDir string) (*cas.Store, error) {
+	return cas.Open(filepath.Join(dataDir, ArtifactStoreDir))
+}
+
+// storeArtifact adds a file's contents to the store under a named ref and
+// returns the path of its blob
+func storeArtifact(store *cas.Store, ref string, data []byte, mode fs.FileMode) (string, error) {
+	digest, err := store.Put(bytes.NewReader(data), mode)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Ref(ref, digest); err != nil {
+		return "", err
+	}
+	return store.Path(digest), nil
+}
+
+// StoreImage moves a golden image downloaded to the image cache into the
+// data directory's content store under the named ref, and returns the path
+// of its blob. When a new version of the image is downloaded, VMs
+// still booting the old one keep it until GC finds it unreferenced.
+func StoreImage(dataDir, name, path string) (string, error) {
+	store, err := OpenArtifacts(dataDir)
+	if err != nil {
+		return "", err
+	}
+	digest, err := store.Adopt(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to store image %s: %w", name, err)
+	}
+	if err := store.Ref(name, digest); err != nil {
+		return "", err
+	}
+	return store.Path(digest), nil
+}
+
+// storeSnapshot moves the disks of a snapshot into the content store, so
+// identical snapshots take space once. The snapshot's files become hard
+// links to their blobs, which keep them referenced until it is deleted.
+func (m *Manager) storeSnapshot(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// Snapshots work the same without the store, so this isn't fatal
+		if _, err := m.artifacts.Adopt(filepath.Join(dir, entry.Name())); err != nil {
+			m.logger.Warnf("Failed to add snapshot %s to the content store: %v", filepath.Join(dir, entry.Name()), err)
+		}
+	}
+}
+
+// GCArtifacts removes blobs from the content store that no kernel, image,
+// or snapshot references anymore
+func (m *Manager) GCArtifacts() ([]cas.Blob, error) {
+	return m.artifacts.GC(false)
+}
+
+// CollectArtifacts removes unreferenced blobs from the content store in a
+// data directory, or with dryRun only returns them. Like CollectGarbage, it
+// is safe to run beside a live server.
+func CollectArtifacts(dataDir string, dryRun bool) ([]cas.Blob, error) {
+	if _, err := os.Stat(filepath.Join(dataDir, ArtifactStoreDir)); err != nil {
+		return nil, nil
+	}
+	store, err := OpenArtifacts(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return store.GC(dryRun)
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestSnapshotsShareBlobs(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.Snapshots = 2 })
+	tempDir := manager.config.DataDir
+
+	os.MkdirAll(filepath.Join(tempDir, "alice"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "alice", "rootfs.img"), make([]byte, 1<<20), 0644)
+	ctx := context.Background()
+	for _, name := range []string{"first", "second"} {
+		if err := manager.SnapshotVM(ctx, "alice", name); err != nil {
+			t.Fatalf("Failed to snapshot: %v", err)
+		}
+	}
+
+	first, _ := os.Stat(filepath.Join(tempDir, "alice", snapshotDir, "first", "rootfs.img"))
+	second, _ := os.Stat(filepath.Join(tempDir, "alice", snapshotDir, "second", "rootfs.img"))
+	if first == nil || second == nil || !os.SameFile(first, second) {
+		t.Fatalf("Expected identical snapshots to share a blob")
+	}
+	blobs, err := manager.artifacts.Blobs()
+	if err != nil || len(blobs) != 1 || blobs[0].Refs != 2 {
+		t.Errorf("Expected one blob referenced by both snapshots, got %+v, %v", blobs, err)
+	}
+	usage, err := manager.DiskUsage()
+	if err != nil {
+		t.Fatalf("Failed to get disk usage: %v", err)
+	}
+	if usage.Other >= 2<<20 {
+		t.Errorf("Expected the shared snapshot to be counted once, got %d bytes", usage.Other)
+	}
+
+	// The VM's disk is restored as its own copy, leaving the blob as is
+	if err := manager.RestoreSnapshot(ctx, "alice", "first"); err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	disk, _ := os.Stat(filepath.Join(tempDir, "alice", "rootfs.img"))
+	if disk == nil || os.SameFile(disk, first) || disk.Mode().Perm() != 0644 {
+		t.Errorf("Expected the restored disk to be a writable copy")
+	}
+
+	if err := manager.DeleteSnapshot("alice", "first"); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	if blobs, _ := manager.artifacts.Blobs(); len(blobs) != 1 || blobs[0].Refs != 1 {
+		t.Errorf("Expected the blob to lose a reference, got %+v", blobs)
+	}
+}
@@ -0,0 +1,21 @@
+package vm
+
+import "context"
+
+// Backend runs the machines behind VMs. The Manager handles bookkeeping (IDs,
+// IP addresses, data directories, reference counts) and delegates the rest.
+type Backend interface {
+	// Setup prepares host resources shared by all VMs, such as networking
+	Setup(m *Manager) error
+
+	// Start boots the machine for a VM and returns once it is running. ctx
+	// lasts until the VM is stopped, so the machine may be tied to it.
+	Start(ctx context.Context, m *Manager, vm *VM) error
+
+	// Stop shuts down the machine for a VM, and is a no-op if already stopped.
+	// The machine must be killed if ctx expires before it has stopped.
+	Stop(ctx context.Context, vm *VM) error
+
+	// SSHAddr returns the host:port address of the VM's SSH server
+	SSHAddr(vm *VM) string
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshPeersCommand prints the guest's TCP connections in the kernel's format
+const sshPeersCommand = "cat /proc/net/tcp /proc/net/tcp6 2>/dev/null"
+
+// tcpEstablished is the state of established connections in /proc/net/tcp
+const tcpEstablished = "01"
+
+// parseSSHPeers returns the remote addresses of established connections to
+// local port 22 in the contents of /proc/net/tcp and /proc/net/tcp6, where
+// addresses are hex in the kernel's byte order, like "0100007F:0016"
+func parseSSHPeers(tables string) []net.IP {
+	var peers []net.IP
+	for _, line := range strings.Split(tables, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		_, localPort, ok := parseProcAddr(fields[1])
+		if !ok || localPort != 22 {
+			continue
+		}
+		if ip, _, ok := parseProcAddr(fields[2]); ok {
+			peers = append(peers, ip)
+		}
+	}
+	return peers
+}
+
+// parseProcAddr parses an address from /proc/net/tcp, whose IP is stored as
+// 32-bit words in little-endian order
+func parseProcAddr(s string) (net.IP, int, bool) {
+	addrText, portText, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, false
+	}
+	port, err := strconv.ParseUint(portText, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	addr, err := hex.DecodeString(addrText)
+	if err != nil || (len(addr) != net.IPv4len && len(addr) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(addr); i += 4 {
+		addr[i], addr[i+1], addr[i+2], addr[i+3] = addr[i+3], addr[i+2], addr[i+1], addr[i]
+	}
+	return net.IP(addr), int(port), true
+}
+
+// unexpectedSSHPeers returns the peers connected to a VM's SSH server other
+// than the hypervisor, which reaches VMs from their gateway address, and
+// connections from inside the VM itself
+func (vm *VM) unexpectedSSHPeers(peers []net.IP) []net.IP {
+	var unexpected []net.IP
+	for _, peer := range peers {
+		if !peer.Equal(vm.Gateway) && !peer.Equal(vm.IP) && !peer.IsLoopback() {
+			unexpected = append(unexpected, peer)
+		}
+	}
+	return unexpected
+}
+
+// MonitorGuestSSH checks the connections to each running VM's SSH server
+// every interval until ctx is done. VMs are only reachable through the
+// hypervisor, so any other peer means bridge isolation was bypassed, and is
+// logged as an error and recorded as a VM event once per VM and peer.
+func (m *Manager) MonitorGuestSSH(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	alerted := make(map[string]bool) // "vm-id peer" pairs already reported
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mutex.RLock()
+			vms := make([]*VM, 0, len(m.vms))
+			for _, vm := range m.vms {
+				vms = append(vms, vm)
+			}
+			m.mutex.RUnlock()
+
+			for _, vm := range vms {
+				checkCtx, cancel := context.WithTimeout(ctx, interval)
+				output, err := vm.RunCommand(checkCtx, sshPeersCommand)
+				cancel()
+				if err != nil {
+					vm.logger.Debugf("Failed to list guest SSH connections: %v", err)
+					continue
+				}
+				for _, peer := range vm.unexpectedSSHPeers(parseSSHPeers(output)) {
+					key := vm.ID + " " + peer.String()
+					if alerted[key] {
+						continue
+					}
+					alerted[key] = true
+					vm.logger.Errorf("Possible break-in: %s is connected to the VM's SSH server, bypassing the hypervisor", peer)
+					m.events.Record(vm.ID, EventBreakIn, fmt.Sprintf("SSH connection from %s", peer))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package vm
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSSHPeers(t *testing.T) {
+	tables := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1000 1 0000000000000000 100 0 0 10 0
+   1: 0264A8C0:0016 0164A8C0:D431 01 00000000:00000000 02:0008F1A5 00000000     0        0 1001 2 0000000000000000 20 4 29 10 -1
+   2: 0264A8C0:0016 0364A8C0:B2E0 01 00000000:00000000 02:0008F1A5 00000000     0        0 1002 2 0000000000000000 20 4 29 10 -1
+   3: 0264A8C0:C350 0364A8C0:0016 01 00000000:00000000 02:0008F1A5 00000000     0        0 1003 2 0000000000000000 20 4 29 10 -1
+  sl  local_address                         remote_port                           st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000264A8C0:0016 0000000000000000FFFF00000A00000A:E0C4 01 00000000:00000000 02:0008F1A5 00000000     0        0 1004 2 0000000000000000 20 4 29 10 -1
+   1: 00000000000000000000000001000000:0016 00000000000000000000000001000000:9C40 01 00000000:00000000 02:0008F1A5 00000000     0        0 1005 2 0000000000000000 20 4 29 10 -1
+`
+	peers := parseSSHPeers(tables)
+	want := []string{"192.168.100.1", "192.168.100.3", "10.0.0.10", "::1"}
+	if len(peers) != len(want) {
+		t.Fatalf("Expected peers %v, got %v", want, peers)
+	}
+	for i, peer := range peers {
+		if !peer.Equal(net.ParseIP(want[i])) {
+			t.Errorf("Expected peer %d to be %s, got %s", i, want[i], peer)
+		}
+	}
+
+	testVM := &VM{IP: net.ParseIP("192.168.100.2"), Gateway: net.ParseIP("192.168.100.1")}
+	unexpected := testVM.unexpectedSSHPeers(peers)
+	if len(unexpected) != 2 || !unexpected[0].Equal(net.ParseIP("192.168.100.3")) || !unexpected[1].Equal(net.ParseIP("10.0.0.10")) {
+		t.Errorf("Expected other VMs and outside hosts to be unexpected, got %v", unexpected)
+	}
+}
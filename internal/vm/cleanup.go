@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// staleFiles are the files in a VM's data directory that only mean anything
+// while its Firecracker process runs
+var staleFiles = []string{"firecracker.sock", "firecracker.pid", consoleFifo, metricsFifo, vmmLogFifo}
+
+// CleanupOptions decide what Cleanup removes besides host networking
+type CleanupOptions struct {
+	RemoveData bool // Also remove the data directories of all VMs
+	DryRun     bool // Report what would be removed without removing it
+}
+
+// Cleanup removes what the server leaves on the host: its bridge, TAP
+// devices, and iptables rules, and sockets and pipes of stopped VMs, calling
+// report for each. It refuses to run while any VM's Firecracker process is
+// alive, since it would cut the VM off the network.
+func Cleanup(dataDir string, opts CleanupOptions, report func(string)) error {
+	running, err := runningVMs(dataDir)
+	if err != nil {
+		return err
+	}
+	if len(running) > 0 {
+		return fmt.Errorf("VMs are still running: %s; stop the server first", strings.Join(running, ", "))
+	}
+
+	return errors.Join(
+		cleanupNetwork(opts.DryRun, report),
+		cleanupVMDirs(dataDir, opts, report),
+	)
+}
+
+// runningVMs returns the IDs of VMs in dataDir whose Firecracker process is
+// alive
+func runningVMs(dataDir string) ([]string, error) {
+	entries, err := os.ReadDir(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+	var running []string
+	for _, entry := range entries {
+		if entry.IsDir() && processAlive(filepath.Join(dataDir, entry.Name(), "firecracker.pid")) {
+			running = append(running, entry.Name())
+		}
+	}
+	return running, nil
+}
+
+// cleanupNetwork deletes the TAP devices and bridge, then the iptables
+// rules commented "ssh-hypervisor"
+func cleanupNetwork(dryRun bool, report func(string)) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	var errs []error
+	var devices []string
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, "sshvm-tap-") {
+			devices = append(devices, iface.Name)
+		}
+	}
+	// The bridge goes last, once nothing is attached to it
+	for _, iface := range ifaces {
+		if iface.Name == BridgeName {
+			devices = append(devices, iface.Name)
+		}
+	}
+	for _, name := range devices {
+		report("delete network device " + name)
+		if dryRun {
+			continue
+		}
+		if output, err := exec.Command("ip", "link", "delete", name).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s: %w: %s", name, err, strings.TrimSpace(string(output))))
+		}
+	}
+
+	report("remove iptables rules commented \"ssh-hypervisor\" and the " + egressChain + " chain")
+	if !dryRun {
+		if err := cleanupIptablesRules(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cleanupVMDirs removes the stale files of stopped VMs, or their whole data
+// directories with RemoveData
+func cleanupVMDirs(dataDir string, opts CleanupOptions, report func(string)) error {
+	entries, err := os.ReadDir(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var errs []error
+	if opts.RemoveData {
+		dirs, err := scanVMDirs(dataDir)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			report(fmt.Sprintf("remove data of VM %s (%d MB)", dir.id, dir.size/(1024*1024)))
+			if opts.DryRun {
+				continue
+			}
+			if err := removeVMDir(dir.path); err != nil {
+				errs = append(errs, fmt.Errorf("remove %s: %w", dir.id, err))
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		for _, name := range staleFiles {
+			path := filepath.Join(dataDir, entry.Name(), name)
+			if _, err := os.Lstat(path); err != nil {
+				continue // Never there, or removed with the VM's data
+			}
+			report("remove " + path)
+			if opts.DryRun {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCleanupVMDirs(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, id := range []string{"alice", "bob"} {
+		dir := filepath.Join(dataDir, id)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "rootfs.img"), []byte("disk"), 0644)
+		os.WriteFile(filepath.Join(dir, "firecracker.sock"), nil, 0644)
+	}
+	// A PID that isn't running, left by a crash
+	os.WriteFile(filepath.Join(dataDir, "alice", "firecracker.pid"), []byte("999999999"), 0644)
+
+	running, err := runningVMs(dataDir)
+	if err != nil || len(running) != 0 {
+		t.Fatalf("Expected no running VMs, got %v, %v", running, err)
+	}
+
+	var actions []string
+	report := func(action string) { actions = append(actions, action) }
+	if err := cleanupVMDirs(dataDir, CleanupOptions{DryRun: true}, report); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(actions) != 3 || !fileExists(filepath.Join(dataDir, "alice", "firecracker.sock")) {
+		t.Errorf("Expected a dry run to report 3 files and remove nothing, got %v", actions)
+	}
+
+	if err := cleanupVMDirs(dataDir, CleanupOptions{}, report); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if fileExists(filepath.Join(dataDir, id, "firecracker.sock")) {
+			t.Errorf("Expected the socket of %s to be removed", id)
+		}
+		if !fileExists(filepath.Join(dataDir, id, "rootfs.img")) {
+			t.Errorf("Expected the disk of %s to be kept", id)
+		}
+	}
+
+	if err := cleanupVMDirs(dataDir, CleanupOptions{RemoveData: true}, report); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if fileExists(filepath.Join(dataDir, "alice")) {
+		t.Errorf("Expected VM data to be removed")
+	}
+
+	// A live Firecracker process stops everything
+	os.MkdirAll(filepath.Join(dataDir, "carol"), 0755)
+	os.WriteFile(filepath.Join(dataDir, "carol", "firecracker.pid"), []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err := Cleanup(dataDir, CleanupOptions{DryRun: true}, report); err == nil {
+		t.Errorf("Expected cleanup to refuse while a VM is running")
+	}
+}
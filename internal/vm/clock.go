@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockCommand returns a shell command that sets a guest's clock to now.
+// Firecracker VMs have no RTC on x86, so they boot at whatever time the
+// kernel picks, and snapshots resume at the time they were taken.
+func clockCommand(now time.Time) string {
+	return "date -u -s '" + now.UTC().Format("2006-01-02 15:04:05") + "' >/dev/null"
+}
+
+// syncGuestClock sets a VM's clock from the host's over its SSH connection
+func (m *Manager) syncGuestClock(ctx context.Context, vm *VM) error {
+	if m.config.ClockSync < 0 {
+		return nil
+	}
+	client, release, err := vm.GuestClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	// Read the clock after the session is open, so it's as fresh as it can be
+	if out, err := session.CombinedOutput(clockCommand(time.Now())); err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// SyncGuestClocks sets each running VM's clock from the host's every
+// interval until ctx is done, correcting the drift of guests without NTP
+func (m *Manager) SyncGuestClocks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mutex.RLock()
+			vms := make([]*VM, 0, len(m.vms))
+			for _, vm := range m.vms {
+				vms = append(vms, vm)
+			}
+			m.mutex.RUnlock()
+
+			for _, vm := range vms {
+				syncCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				if err := m.syncGuestClock(syncCtx, vm); err != nil {
+					vm.logger.Debugf("Failed to set guest clock: %v", err)
+				}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package vm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockCommand(t *testing.T) {
+	now := time.Date(2024, 3, 9, 17, 4, 5, 0, time.FixedZone("PST", -8*60*60))
+	want := "date -u -s '2024-03-10 01:04:05' >/dev/null"
+	if got := clockCommand(now); got != want {
+		t.Errorf("clockCommand() = %q, want %q", got, want)
+	}
+}
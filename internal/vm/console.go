@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// consoleFifo is the named pipe in a VM's data directory that feeds the
+// guest's serial console
+const consoleFifo = "console.in"
+
+// errConsoleClosed is returned when writing to the console of a stopped VM
+var errConsoleClosed = errors.New("VM console is not open")
+
+// openConsole creates the pipe for the VM's serial input and opens it. The
+// VM keeps the pipe open while it runs, so the guest never sees the end of
+// its input and WriteConsole always has a reader, until closeConsole.
+func (vm *VM) openConsole() (*os.File, error) {
+	path := filepath.Join(vm.dataDir, consoleFifo)
+	os.Remove(path) // Left over from a VM that didn't stop cleanly
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, fmt.Errorf("mkfifo for %s: %w", consoleFifo, err)
+	}
+	// Opening for writing too keeps the open from blocking for a reader
+	f, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("open pipe for %s: %w", consoleFifo, err)
+	}
+
+	vm.consoleMu.Lock()
+	vm.console = f
+	vm.consoleMu.Unlock()
+	return f, nil
+}
+
+// WriteConsole writes input to the VM's serial console, as if typed on it
+func (vm *VM) WriteConsole(p []byte) (int, error) {
+	vm.consoleMu.Lock()
+	defer vm.consoleMu.Unlock()
+	if vm.console == nil {
+		return 0, errConsoleClosed
+	}
+	return vm.console.Write(p)
+}
+
+// closeConsole closes the VM's serial input and removes its pipe. It is
+// safe to call more than once.
+func (vm *VM) closeConsole() {
+	vm.consoleMu.Lock()
+	defer vm.consoleMu.Unlock()
+	if vm.console != nil {
+		vm.console.Close()
+		vm.console = nil
+	}
+	os.Remove(filepath.Join(vm.dataDir, consoleFifo))
+}
@@ -0,0 +1,38 @@
+package vm
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsole(t *testing.T) {
+	vm := &VM{ID: "alice", dataDir: t.TempDir()}
+	if _, err := vm.WriteConsole([]byte("root\n")); err == nil {
+		t.Errorf("Expected writing to an unopened console to fail")
+	}
+
+	in, err := vm.openConsole()
+	if err != nil {
+		t.Fatalf("Failed to open console: %v", err)
+	}
+	// Input stays readable by the guest, here the same handle, as it would
+	// be by Firecracker's inherited stdin
+	if _, err := vm.WriteConsole([]byte("root\n")); err != nil {
+		t.Fatalf("Failed to write to console: %v", err)
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil || line != "root\n" {
+		t.Errorf("Expected the guest to read %q, got %q, %v", "root\n", line, err)
+	}
+
+	vm.closeConsole()
+	vm.closeConsole()
+	if _, err := os.Stat(filepath.Join(vm.dataDir, consoleFifo)); !os.IsNotExist(err) {
+		t.Errorf("Expected the console pipe to be removed, got %v", err)
+	}
+	if _, err := vm.WriteConsole([]byte("x")); err != errConsoleClosed {
+		t.Errorf("Expected writes after closing to fail, got %v", err)
+	}
+}
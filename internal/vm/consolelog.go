@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxConsoleLogSize is the most console.out grows before it is rotated, even
+// when per-VM logs are otherwise larger or unlimited, since the guest decides
+// what it receives
+const maxConsoleLogSize = 64 * 1024 * 1024
+
+// consoleLogSize returns the size in bytes console.out is rotated at, given
+// the configured size of per-VM logs in MB (0 = unlimited)
+func consoleLogSize(logMaxSize int) int64 {
+	size := int64(logMaxSize) * 1024 * 1024
+	if size == 0 || size > maxConsoleLogSize {
+		return maxConsoleLogSize
+	}
+	return size
+}
+
+// consoleWriter keeps a guest's serial output in its console log at up to
+// rate bytes per second, after a burst of a second's worth. Output beyond
+// that is dropped rather than slowing the guest down, and once output fits
+// again, a line in the log and a warning say how much was lost.
+type consoleWriter struct {
+	w      io.WriteCloser
+	rate   float64
+	logger logrus.FieldLogger
+
+	mu      sync.Mutex
+	tokens  float64 // Bytes that may be written now
+	last    time.Time
+	dropped int64 // Bytes dropped since output last fit
+}
+
+// newConsoleWriter limits writes to w to rate bytes per second
+func newConsoleWriter(w io.WriteCloser, rate int, logger logrus.FieldLogger) *consoleWriter {
+	return &consoleWriter{w: w, rate: float64(rate), logger: logger, tokens: float64(rate), last: time.Now()}
+}
+
+// Write writes as much of p as the rate allows and drops the rest. It always
+// reports all of p written, so the copy from the VMM never stops.
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.tokens = min(c.tokens+now.Sub(c.last).Seconds()*c.rate, c.rate)
+	c.last = now
+
+	keep := min(len(p), int(c.tokens))
+	if keep > 0 && c.dropped > 0 {
+		if err := c.reportDropped(); err != nil {
+			return 0, err
+		}
+	}
+	if keep > 0 {
+		if _, err := c.w.Write(p[:keep]); err != nil {
+			return 0, err
+		}
+		c.tokens -= float64(keep)
+	}
+	c.dropped += int64(len(p) - keep)
+	return len(p), nil
+}
+
+// reportDropped notes the output dropped since it last fit in the log
+func (c *consoleWriter) reportDropped() error {
+	c.logger.Warnf("Dropped %d bytes of console output over the limit of %.0f bytes/s", c.dropped, c.rate)
+	_, err := fmt.Fprintf(c.w, "\r\n[ssh-hypervisor: dropped %d bytes of console output over the rate limit]\r\n", c.dropped)
+	c.dropped = 0
+	return err
+}
+
+// Close notes any output dropped at the end and closes the log
+func (c *consoleWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dropped > 0 {
+		c.reportDropped()
+	}
+	return c.w.Close()
+}
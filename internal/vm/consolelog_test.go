@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type nopCloser struct{ bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestConsoleLogSize(t *testing.T) {
+	tests := []struct {
+		logMaxSize int
+		want       int64
+	}{
+		{10, 10 * 1024 * 1024},
+		{0, maxConsoleLogSize},
+		{1024, maxConsoleLogSize},
+	}
+	for _, tt := range tests {
+		if got := consoleLogSize(tt.logMaxSize); got != tt.want {
+			t.Errorf("consoleLogSize(%d) = %d, want %d", tt.logMaxSize, got, tt.want)
+		}
+	}
+}
+
+func TestConsoleWriter(t *testing.T) {
+	var log nopCloser
+	c := newConsoleWriter(&log, 100, logrus.NewEntry(logrus.StandardLogger()))
+
+	// A second's worth is kept at once, and the rest dropped
+	if n, err := c.Write([]byte(strings.Repeat("a", 150))); n != 150 || err != nil {
+		t.Fatalf("Expected the whole write to be reported, got %d, %v", n, err)
+	}
+	if log.String() != strings.Repeat("a", 100) {
+		t.Fatalf("Expected 100 bytes kept, got %q", log.String())
+	}
+
+	// Once output fits again, the log says what was dropped
+	c.last = c.last.Add(-time.Second)
+	c.Write([]byte("b"))
+	if want := "dropped 50 bytes"; !strings.Contains(log.String(), want) || !strings.HasSuffix(log.String(), "]\r\nb") {
+		t.Errorf("Expected a note of the dropped output before new output, got %q", log.String())
+	}
+
+	// Output dropped at the end is noted on close
+	c.Write([]byte(strings.Repeat("c", 200)))
+	c.Close()
+	if !strings.HasSuffix(log.String(), "dropped 101 bytes of console output over the rate limit]\r\n") {
+		t.Errorf("Expected a note of the dropped output on close, got %q", log.String())
+	}
+}
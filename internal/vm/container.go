@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ipForwardPath is the sysctl that enables IPv4 forwarding
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// hostDevices are the device nodes Firecracker VMs need, with what each is for
+var hostDevices = [][2]string{
+	{"/dev/kvm", "hardware virtualization"},
+	{"/dev/net/tun", "TAP network devices"},
+}
+
+// checkHostDevices returns an error listing every device node in devices that
+// is missing, which usually means a container wasn't given access to them
+func checkHostDevices(devices [][2]string) error {
+	var missing []string
+	for _, device := range devices {
+		if _, err := os.Stat(device[0]); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s)", device[0], device[1]))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s; in a container, pass them with --device", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// enableIPForward turns on IPv4 forwarding through the sysctl at path if it is
+// off. Containers usually have a read-only /proc/sys and get forwarding from
+// the orchestrator instead, so in container mode or when the sysctl can't be
+// written, it is only checked. Forwarding is required for Internet access and
+// the mosh relay, and otherwise just warned about.
+func (m *Manager) enableIPForward(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) == "1" {
+		return nil
+	}
+
+	if !m.config.ContainerMode {
+		err := os.WriteFile(path, []byte("1\n"), 0644)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EROFS) && !errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		}
+	}
+
+	if m.config.AllowInternet || m.config.MoshPorts != "" {
+		return fmt.Errorf("IP forwarding is off and can't be enabled here; set net.ipv4.ip_forward=1 on the host or pod")
+	}
+	m.logger.Warnf("IP forwarding is off, VMs can only reach the host")
+	return nil
+}
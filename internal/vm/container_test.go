@@ -0,0 +1,53 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCheckHostDevices(t *testing.T) {
+	present := filepath.Join(t.TempDir(), "kvm")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHostDevices([][2]string{{present, "test"}}); err != nil {
+		t.Errorf("Expected no error for present device, got %v", err)
+	}
+
+	err := checkHostDevices([][2]string{{present, "test"}, {"/nonexistent/tun", "TAP"}})
+	if err == nil || !strings.Contains(err.Error(), "/nonexistent/tun (TAP)") {
+		t.Errorf("Expected error naming the missing device, got %v", err)
+	}
+}
+
+func TestEnableIPForward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_forward")
+	newManager := func(config *internal.Config) *Manager {
+		os.WriteFile(path, []byte("0\n"), 0644)
+		return &Manager{config: config, logger: logrus.New()}
+	}
+
+	// On a full host, forwarding is switched on
+	if err := newManager(&internal.Config{}).enableIPForward(path); err != nil {
+		t.Fatalf("Failed to enable IP forwarding: %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != "1" {
+		t.Errorf("Expected ip_forward to be 1, got %q", data)
+	}
+
+	// In a container, sysctls are left alone
+	if err := newManager(&internal.Config{ContainerMode: true}).enableIPForward(path); err != nil {
+		t.Errorf("Expected only a warning in container mode, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != "0" {
+		t.Errorf("Expected ip_forward to be untouched, got %q", data)
+	}
+	if err := newManager(&internal.Config{ContainerMode: true, AllowInternet: true}).enableIPForward(path); err == nil {
+		t.Errorf("Expected error when Internet access needs forwarding")
+	}
+}
@@ -0,0 +1,290 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted disks are sealed in chunks with AES-256-GCM under a key derived
+// from the master key, a random salt, and the VM ID and disk name, so no key
+// is ever reused and a disk can't be swapped into another VM. Every chunk
+// authenticates the header and its own index. All-zero chunks are stored as
+// just a tag, which keeps sparse overlay drives small.
+const (
+	sealedSuffix    = ".enc"
+	sealedMagic     = "SSHHVEN1"
+	sealedSaltSize  = 32
+	sealedChunkSize = 1 << 20
+)
+
+// sealedDisks are the per-VM disk images encrypted at rest
+var sealedDisks = []string{"rootfs.img", "overlay.img"}
+
+// LoadMasterKey reads a 32-byte master key from a file, written as hex or
+// base64, like the output of "openssl rand -hex 32"
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	text := strings.TrimSpace(string(data))
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key in %s must be 32 bytes as hex or base64", path)
+	}
+	return key, nil
+}
+
+// sealDisks encrypts a stopped VM's disk images in place, leaving only the
+// sealed copies in its data directory
+func (m *Manager) sealDisks(vmID string) error {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	for _, name := range sealedDisks {
+		path := filepath.Join(vmDataDir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := sealFile(m.masterKey, vmID+"/"+name, path, path+sealedSuffix); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", name, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsealDisks decrypts a VM's sealed disk images before it boots. The sealed
+// copies are removed, since the disks change while the VM runs.
+func (m *Manager) unsealDisks(vmID string) error {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	for _, name := range sealedDisks {
+		path := filepath.Join(vmDataDir, name)
+		if _, err := os.Stat(path + sealedSuffix); err != nil {
+			continue
+		}
+		if err := unsealFile(m.masterKey, vmID+"/"+name, path+sealedSuffix, path); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		if err := os.Remove(path + sealedSuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealStoppedVMs encrypts disks left in plaintext by VMs that weren't stopped
+// cleanly, such as after a crash
+func (m *Manager) sealStoppedVMs() {
+	entries, err := os.ReadDir(m.config.DataDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		vmID := entry.Name()
+		if !entry.IsDir() || validateVMID(vmID) != nil {
+			continue
+		}
+		if processAlive(filepath.Join(m.config.DataDir, vmID, "firecracker.pid")) {
+			continue
+		}
+		if err := m.sealDisks(vmID); err != nil {
+			m.logger.Errorf("Failed to encrypt disks of VM %s: %v", vmID, err)
+		}
+	}
+}
+
+// diskCipher derives the AEAD for one sealed file
+func diskCipher(masterKey []byte, salt []byte, name string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, []byte("ssh-hypervisor disk "+name)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkAAD returns the additional data authenticated with a chunk
+func chunkAAD(header []byte, index uint64, zero bool) []byte {
+	aad := binary.BigEndian.AppendUint64(bytes.Clone(header), index)
+	if zero {
+		return append(aad, 0)
+	}
+	return append(aad, 1)
+}
+
+// chunkNonce returns the nonce of a chunk, unique since each file has its own key
+func chunkNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+// sealFile encrypts src into dst, which is replaced atomically
+func sealFile(masterKey []byte, name, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(sealedMagic)+sealedSaltSize+8)
+	header = append(header, sealedMagic...)
+	salt := make([]byte, sealedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint64(header, uint64(info.Size()))
+	aead, err := diskCipher(masterKey, salt, name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeSealed(tmp, in, aead, header)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeSealed writes the header and every encrypted chunk of in to out
+func writeSealed(out io.Writer, in io.Reader, aead cipher.AEAD, header []byte) error {
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	buf := make([]byte, sealedChunkSize)
+	zeros := make([]byte, sealedChunkSize)
+	var sealed []byte
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, buf)
+		if n == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		chunk := buf[:n]
+		zero := bytes.Equal(chunk, zeros[:n])
+		if zero {
+			sealed = append([]byte{0}, aead.Seal(nil, chunkNonce(aead, index), nil, chunkAAD(header, index, true))...)
+		} else {
+			sealed = append([]byte{1}, aead.Seal(nil, chunkNonce(aead, index), chunk, chunkAAD(header, index, false))...)
+		}
+		if _, err := out.Write(sealed); err != nil {
+			return err
+		}
+	}
+}
+
+// unsealFile decrypts src into dst, which is replaced atomically. Zero chunks
+// are skipped, so sparse files stay sparse.
+func unsealFile(masterKey []byte, name, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header := make([]byte, len(sealedMagic)+sealedSaltSize+8)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(sealedMagic)]) != sealedMagic {
+		return fmt.Errorf("not an encrypted disk")
+	}
+	salt := header[len(sealedMagic) : len(sealedMagic)+sealedSaltSize]
+	size := int64(binary.BigEndian.Uint64(header[len(header)-8:]))
+	aead, err := diskCipher(masterKey, salt, name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = readSealed(tmp, in, aead, header, size)
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// readSealed decrypts every chunk of in into out, checking that none are missing
+func readSealed(out *os.File, in io.Reader, aead cipher.AEAD, header []byte, size int64) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	chunks := (size + sealedChunkSize - 1) / sealedChunkSize
+	sealed := make([]byte, 1+sealedChunkSize+aead.Overhead())
+	for index := int64(0); index < chunks; index++ {
+		n := min(size-index*sealedChunkSize, sealedChunkSize)
+		if _, err := io.ReadFull(in, sealed[:1]); err != nil {
+			return errors.New("encrypted disk is truncated")
+		}
+		zero := sealed[0] == 0
+		if zero {
+			n = 0
+		}
+		body := sealed[1 : 1+int(n)+aead.Overhead()]
+		if _, err := io.ReadFull(in, body); err != nil {
+			return errors.New("encrypted disk is truncated")
+		}
+		chunk, err := aead.Open(body[:0], chunkNonce(aead, uint64(index)), body, chunkAAD(header, uint64(index), zero))
+		if err != nil {
+			return errors.New("encrypted disk is corrupt or the key is wrong")
+		}
+		if !zero {
+			if _, err := out.WriteAt(chunk, index*sealedChunkSize); err != nil {
+				return err
+			}
+		}
+	}
+	if n, _ := in.Read(sealed[:1]); n != 0 {
+		return errors.New("encrypted disk has trailing data")
+	}
+	return nil
+}
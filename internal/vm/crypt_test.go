@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestSealFile(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	// A sparse-looking disk: data, a run of zeros, and a partial last chunk
+	plain := make([]byte, 3*sealedChunkSize+123)
+	copy(plain, "hello")
+	copy(plain[3*sealedChunkSize:], "tail")
+	src := filepath.Join(dir, "disk.img")
+	os.WriteFile(src, plain, 0644)
+
+	sealed := src + sealedSuffix
+	if err := sealFile(key, "alice/disk.img", src, sealed); err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	data, _ := os.ReadFile(sealed)
+	if bytes.Contains(data, []byte("hello")) {
+		t.Errorf("Sealed file contains plaintext")
+	}
+	if len(data) > 2*sealedChunkSize+1024 {
+		t.Errorf("Zero chunks should be stored compactly, sealed size is %d", len(data))
+	}
+
+	out := filepath.Join(dir, "out.img")
+	if err := unsealFile(key, "alice/disk.img", sealed, out); err != nil {
+		t.Fatalf("Failed to unseal: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, plain) {
+		t.Errorf("Unsealed file differs from the original")
+	}
+
+	// Wrong keys, other VMs, and tampering are all rejected
+	if err := unsealFile(bytes.Repeat([]byte{8}, 32), "alice/disk.img", sealed, out); err == nil {
+		t.Errorf("Expected error with the wrong key")
+	}
+	if err := unsealFile(key, "bob/disk.img", sealed, out); err == nil {
+		t.Errorf("Expected error unsealing another VM's disk")
+	}
+	os.WriteFile(sealed, data[:len(data)-10], 0644)
+	if err := unsealFile(key, "alice/disk.img", sealed, out); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("Expected truncation error, got %v", err)
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"hex":    strings.Repeat("ab", 32) + "\n",
+		"base64": "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0600)
+		key, err := LoadMasterKey(path)
+		if err != nil || !bytes.Equal(key, bytes.Repeat([]byte{0xab}, 32)) {
+			t.Errorf("Failed to load %s key: %x, %v", name, key, err)
+		}
+	}
+
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte("abcd"), 0600)
+	if _, err := LoadMasterKey(short); err == nil {
+		t.Errorf("Expected error for a short key")
+	}
+}
+
+func TestEncryptedDisks(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "master.key")
+	os.WriteFile(keyPath, []byte(strings.Repeat("42", 32)), 0600)
+	manager := newTestManager(t, func(c *internal.Config) { c.EncryptionKey = keyPath })
+	tempDir := manager.config.DataDir
+
+	ctx := context.Background()
+	diskPath := filepath.Join(tempDir, "alice", "rootfs.img")
+	for i := 0; i < 2; i++ {
+		if _, err := manager.GetOrCreateVM(ctx, "alice", nil); err != nil {
+			t.Fatalf("Failed to create VM: %v", err)
+		}
+		// While the VM runs, its disk is in plaintext
+		if data, err := os.ReadFile(diskPath); err != nil || string(data) != "fake rootfs content" {
+			t.Fatalf("Expected decrypted disk while running, got %q, %v", data, err)
+		}
+		if err := manager.ReleaseVM(ctx, "alice"); err != nil {
+			t.Fatalf("Failed to release VM: %v", err)
+		}
+
+		// Once stopped, only the sealed disk is left
+		if _, err := os.Stat(diskPath); !os.IsNotExist(err) {
+			t.Errorf("Expected plaintext disk to be removed, got %v", err)
+		}
+		if _, err := os.Stat(diskPath + sealedSuffix); err != nil {
+			t.Errorf("Expected sealed disk: %v", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DiskUsage breaks down the space used by the data directory, in bytes
+type DiskUsage struct {
+	Images  int64 `json:"images_bytes"`   // Shared artifacts: kernels, Firecracker binaries, golden rootfs
+	VMDisks int64 `json:"vm_disks_bytes"` // Writable per-VM rootfs copies and overlays, encrypted or not
+	Logs    int64 `json:"logs_bytes"`     // Per-VM console and SDK logs
+	Other   int64 `json:"other_bytes"`    // Snapshots, host keys, and other state
+	Free    int64 `json:"free_bytes"`     // Space available on the data directory's filesystem
+}
+
+// Used returns the total space taken by the data directory
+func (u DiskUsage) Used() int64 {
+	return u.Images + u.VMDisks + u.Logs + u.Other
+}
+
+// DiskUsage walks the data directory and reports its usage by category
+func (m *Manager) DiskUsage() (DiskUsage, error) {
+	var usage DiskUsage
+
+	dataDir := filepath.Clean(m.config.DataDir)
+	blobsDir := filepath.Join(dataDir, ArtifactStoreDir, "blobs")
+	linked := make(map[uint64]bool) // Inodes of hard linked files already counted
+	err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// Blobs linked from snapshots or the image cache are counted there
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if filepath.Dir(path) == blobsDir || linked[stat.Ino] {
+				return nil
+			}
+			linked[stat.Ino] = true
+		}
+
+		name := d.Name()
+		size := allocatedSize(info)
+		switch {
+		case filepath.Dir(path) == blobsDir,
+			filepath.Base(filepath.Dir(filepath.Dir(path))) == ImageCacheDir:
+			usage.Images += size
+		case filepath.Base(filepath.Dir(filepath.Dir(path))) == snapshotDir:
+			usage.Other += size
+		case name == "rootfs.img" || name == "overlay.img" || name == "rootfs.img"+sealedSuffix || name == "overlay.img"+sealedSuffix:
+			usage.VMDisks += size
+		case logFilePattern.MatchString(name):
+			usage.Logs += size
+		default:
+			usage.Other += size
+		}
+		return nil
+	})
+	if err != nil {
+		return usage, fmt.Errorf("failed to scan data directory: %w", err)
+	}
+
+	// Golden rootfs images usually live outside the data directory
+	rootfses := []string{m.config.Rootfs}
+	for _, img := range m.images {
+		rootfses = append(rootfses, img.Rootfs)
+	}
+	for _, rootfs := range rootfses {
+		if rel, err := filepath.Rel(dataDir, rootfs); rootfs == "" || (err == nil && !strings.HasPrefix(rel, "..")) {
+			continue
+		}
+		if info, err := os.Stat(rootfs); err == nil {
+			usage.Images += allocatedSize(info)
+		}
+	}
+
+	usage.Free, err = freeSpace(dataDir)
+	return usage, err
+}
+
+// allocatedSize returns the disk space taken by a file, which for sparse
+// files like overlay drives is much less than their apparent size
+func allocatedSize(info fs.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// checkFreeSpace refuses to create a VM needing the given number of bytes if
+// that would leave less than the configured minimum free on the data directory
+func (m *Manager) checkFreeSpace(needed int64) error {
+	free, err := freeSpace(m.config.DataDir)
+	if err != nil {
+		return err
+	}
+	minFree := int64(m.config.MinFreeSpace) * 1024 * 1024
+	if free-needed < minFree {
+		return fmt.Errorf("%w (%d MB free, %d MB needed)", ErrDiskFull, free/(1024*1024), (needed+minFree)/(1024*1024))
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem holding path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem: %w", err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
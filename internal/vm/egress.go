@@ -0,0 +1,304 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// conntrackPath lists the host's tracked connections, including VM egress
+const conntrackPath = "/proc/net/nf_conntrack"
+
+// maxLoggedFlows bounds how many distinct flows are remembered per VM for the
+// flow log, so a VM scanning the Internet can't grow it without limit
+const maxLoggedFlows = 10000
+
+// DefaultEgressBlock is the outbound traffic blocked for public instances:
+// mail submission (spam), common scanning targets (telnet, SMB and NetBIOS,
+// RDP, VNC), and UDP services abused for amplification (chargen, SSDP, memcached)
+const DefaultEgressBlock = "tcp/25,tcp/465,tcp/587,tcp/23,tcp/135-139,tcp/445,udp/137-138,tcp/3389,tcp/5900,udp/19,udp/1900,udp/11211"
+
+// PortRule matches traffic of one protocol to a range of ports
+type PortRule struct {
+	Proto string // "tcp" or "udp"
+	Ports PortRange
+}
+
+// ParsePortRules parses comma-separated rules like "tcp/25" or "udp/137-138".
+// A port without a protocol, like "53", matches both TCP and UDP.
+func ParsePortRules(s string) ([]PortRule, error) {
+	var rules []PortRule
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		protos := []string{"tcp", "udp"}
+		if proto, ports, ok := strings.Cut(spec, "/"); ok {
+			if proto != "tcp" && proto != "udp" {
+				return nil, fmt.Errorf("invalid port rule %q, expected tcp/PORTS or udp/PORTS", spec)
+			}
+			protos, spec = []string{proto}, ports
+		}
+		if !strings.Contains(spec, "-") {
+			spec += "-" + spec
+		}
+		ports, err := ParsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, proto := range protos {
+			rules = append(rules, PortRule{Proto: proto, Ports: ports})
+		}
+	}
+	return rules, nil
+}
+
+// Flow is a connection from a VM tracked by the host's netfilter
+type Flow struct {
+	Proto   string `json:"proto"`
+	Src     net.IP `json:"src"`
+	Dst     net.IP `json:"dst"`
+	DstPort int    `json:"dst_port,omitempty"`
+}
+
+// EgressHook inspects the open flows of a running VM and returns why the VM
+// should be quarantined, or "" if its traffic looks fine. Hooks are called
+// from a single goroutine.
+type EgressHook func(vm *VM, flows []Flow) string
+
+// MaxConnsHook quarantines VMs with more than max open connections
+func MaxConnsHook(max int) EgressHook {
+	return func(vm *VM, flows []Flow) string {
+		if len(flows) > max {
+			return fmt.Sprintf("%d open connections (limit %d)", len(flows), max)
+		}
+		return ""
+	}
+}
+
+// MaxDestsHook quarantines VMs connected to more than max distinct
+// destinations, which is typical of port scans and spam
+func MaxDestsHook(max int) EgressHook {
+	return func(vm *VM, flows []Flow) string {
+		dests := make(map[string]bool)
+		for _, flow := range flows {
+			dests[flow.Dst.String()] = true
+		}
+		if len(dests) > max {
+			return fmt.Sprintf("%d distinct destinations (limit %d)", len(dests), max)
+		}
+		return ""
+	}
+}
+
+// FlowLogHook appends every new flow of a VM to egress.jsonl in its data
+// directory. It never quarantines.
+func FlowLogHook() EgressHook {
+	seen := make(map[*VM]map[string]bool)
+	return func(vm *VM, flows []Flow) string {
+		if seen[vm] == nil {
+			// Forget VMs that have since stopped
+			for old := range seen {
+				if old.ID == vm.ID {
+					delete(seen, old)
+				}
+			}
+			seen[vm] = make(map[string]bool)
+		}
+
+		f, err := os.OpenFile(filepath.Join(vm.dataDir, "egress.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			vm.logger.Warnf("Failed to open flow log: %v", err)
+			return ""
+		}
+		defer f.Close()
+
+		encoder := json.NewEncoder(f)
+		now := time.Now().UTC()
+		for _, flow := range flows {
+			key := fmt.Sprintf("%s %s %d", flow.Proto, flow.Dst, flow.DstPort)
+			if seen[vm][key] || len(seen[vm]) >= maxLoggedFlows {
+				continue
+			}
+			seen[vm][key] = true
+			encoder.Encode(struct {
+				Time time.Time `json:"time"`
+				Flow
+			}{now, flow})
+		}
+		return ""
+	}
+}
+
+// AddEgressHook registers a hook run on every VM's flows by MonitorEgress
+func (m *Manager) AddEgressHook(hook EgressHook) {
+	m.egressMu.Lock()
+	defer m.egressMu.Unlock()
+	m.egressHooks = append(m.egressHooks, hook)
+}
+
+// MonitorEgress checks the flows of running VMs against the egress hooks
+// every interval until ctx is done, quarantining VMs that trip any of them
+func (m *Manager) MonitorEgress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flows, err := readConntrack(conntrackPath)
+			if err != nil {
+				m.logger.Warnf("Failed to read tracked connections: %v", err)
+				continue
+			}
+			m.checkEgress(flows)
+		}
+	}
+}
+
+// checkEgress runs the egress hooks on each running VM's flows
+func (m *Manager) checkEgress(flows []Flow) {
+	byIP := make(map[string][]Flow)
+	for _, flow := range flows {
+		byIP[flow.Src.String()] = append(byIP[flow.Src.String()], flow)
+	}
+
+	m.mutex.RLock()
+	vms := make([]*VM, 0, len(m.vms))
+	for _, vm := range m.vms {
+		if m.quarantined[vm.ID] == "" {
+			vms = append(vms, vm)
+		}
+	}
+	m.mutex.RUnlock()
+
+	m.egressMu.Lock()
+	hooks := m.egressHooks
+	m.egressMu.Unlock()
+
+	for _, vm := range vms {
+		vmFlows := byIP[vm.IP.String()]
+		if len(vmFlows) == 0 {
+			continue
+		}
+		for _, hook := range hooks {
+			if reason := hook(vm, vmFlows); reason != "" {
+				if err := m.Quarantine(vm, reason); err != nil {
+					m.logger.Errorf("Failed to quarantine VM %s: %v", vm.ID, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// Quarantine cuts a running VM off from the network beyond the host, while
+// its user can still reach it over SSH. It lasts until the VM stops.
+func (m *Manager) Quarantine(vm *VM, reason string) error {
+	m.mutex.Lock()
+	if m.quarantined[vm.ID] != "" {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.quarantined[vm.ID] = reason
+	m.mutex.Unlock()
+
+	vm.logger.Warnf("Quarantining VM: %s", reason)
+	m.events.Record(vm.ID, EventQuarantined, reason)
+
+	// VMs without Internet access have no egress to block
+	if !m.config.AllowInternet {
+		return nil
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	rule := m.quarantineRule(vm)
+	if err := ipt.Insert("filter", "FORWARD", 1, rule...); err != nil {
+		return fmt.Errorf("failed to add quarantine rule: %w", err)
+	}
+	return nil
+}
+
+// Quarantined returns why a VM is quarantined, or "" if it isn't
+func (m *Manager) Quarantined(vmID string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.quarantined[vmID]
+}
+
+// liftQuarantine removes a stopped VM's quarantine rule
+func (m *Manager) liftQuarantine(vm *VM) error {
+	m.mutex.Lock()
+	reason := m.quarantined[vm.ID]
+	delete(m.quarantined, vm.ID)
+	m.mutex.Unlock()
+
+	if reason == "" || !m.config.AllowInternet {
+		return nil
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	return ipt.DeleteIfExists("filter", "FORWARD", m.quarantineRule(vm)...)
+}
+
+// quarantineRule is the FORWARD rule dropping a VM's traffic off the bridge
+func (m *Manager) quarantineRule(vm *VM) []string {
+	return []string{"-s", vm.IP.String(), "-i", m.bridgeName, "-j", "DROP", "-m", "comment", "--comment", "ssh-hypervisor"}
+}
+
+// readConntrack parses the flows in a conntrack table, in the format of
+// /proc/net/nf_conntrack, like:
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=192.168.100.2 dst=1.1.1.1 sport=40000 dport=443 src=1.1.1.1 ...
+func readConntrack(path string) ([]Flow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var flows []Flow
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		flow := Flow{Proto: fields[2]}
+		// Only the first src, dst, and dport describe the original direction
+		for _, field := range fields[3:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			switch {
+			case key == "src" && flow.Src == nil:
+				flow.Src = net.ParseIP(value)
+			case key == "dst" && flow.Dst == nil:
+				flow.Dst = net.ParseIP(value)
+			case key == "dport" && flow.DstPort == 0:
+				flow.DstPort, _ = strconv.Atoi(value)
+			}
+		}
+		if flow.Src != nil && flow.Dst != nil {
+			flows = append(flows, flow)
+		}
+	}
+	return flows, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParsePortRules(t *testing.T) {
+	rules, err := ParsePortRules("tcp/25, udp/137-138,53")
+	if err != nil {
+		t.Fatalf("Failed to parse port rules: %v", err)
+	}
+	want := []PortRule{
+		{"tcp", PortRange{25, 25}},
+		{"udp", PortRange{137, 138}},
+		{"tcp", PortRange{53, 53}},
+		{"udp", PortRange{53, 53}},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("Expected %d rules, got %v", len(want), rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("Rule %d: expected %v, got %v", i, want[i], rules[i])
+		}
+	}
+
+	if rules, err := ParsePortRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("Expected no rules for an empty list, got %v, %v", rules, err)
+	}
+	if _, err := ParsePortRules(DefaultEgressBlock); err != nil {
+		t.Errorf("Failed to parse default egress blocklist: %v", err)
+	}
+	for _, bad := range []string{"icmp/1", "tcp/", "tcp/0", "udp/20-10", "smtp"} {
+		if _, err := ParsePortRules(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestReadConntrack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	os.WriteFile(path, []byte(strings.Join([]string{
+		"ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.100.2 dst=1.1.1.1 sport=40000 dport=443 src=1.1.1.1 dst=10.0.0.5 sport=443 dport=40000 [ASSURED] mark=0 zone=0 use=2",
+		"ipv4     2 udp      17 29 src=192.168.100.3 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.5 sport=53 dport=5353 mark=0 zone=0 use=2",
+		"ipv4     2 icmp     1 29 src=192.168.100.2 dst=9.9.9.9 type=8 code=0 id=7 src=9.9.9.9 dst=10.0.0.5 type=0 code=0 id=7 mark=0 zone=0 use=2",
+		"",
+	}, "\n")), 0644)
+
+	flows, err := readConntrack(path)
+	if err != nil {
+		t.Fatalf("Failed to read conntrack: %v", err)
+	}
+	expected := []string{"tcp 192.168.100.2 1.1.1.1 443", "udp 192.168.100.3 8.8.8.8 53", "icmp 192.168.100.2 9.9.9.9 0"}
+	if len(flows) != len(expected) {
+		t.Fatalf("Expected %d flows, got %+v", len(expected), flows)
+	}
+	for i, flow := range flows {
+		got := strings.Join([]string{flow.Proto, flow.Src.String(), flow.Dst.String(), strconv.Itoa(flow.DstPort)}, " ")
+		if got != expected[i] {
+			t.Errorf("Expected flow %q, got %q", expected[i], got)
+		}
+	}
+}
+
+func TestEgressQuarantine(t *testing.T) {
+	manager := newTestManager(t)
+	manager.AddEgressHook(FlowLogHook())
+	manager.AddEgressHook(MaxDestsHook(2))
+
+	ctx := context.Background()
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	flow := func(dst string) Flow {
+		return Flow{Proto: "tcp", Src: vm.IP, Dst: net.ParseIP(dst), DstPort: 22}
+	}
+
+	// Flows of other addresses and a few destinations are fine
+	manager.checkEgress([]Flow{flow("1.1.1.1"), flow("1.1.1.1"), flow("2.2.2.2"), {Proto: "tcp", Src: net.ParseIP("10.9.9.9"), Dst: net.ParseIP("3.3.3.3")}})
+	if reason := manager.Quarantined("alice"); reason != "" {
+		t.Fatalf("Expected no quarantine, got %q", reason)
+	}
+
+	// A scan trips the destination limit
+	manager.checkEgress([]Flow{flow("1.1.1.1"), flow("2.2.2.2"), flow("3.3.3.3")})
+	if reason := manager.Quarantined("alice"); !strings.Contains(reason, "3 distinct destinations") {
+		t.Errorf("Expected quarantine for destinations, got %q", reason)
+	}
+	events := manager.Events().Events("alice")
+	if last := events[len(events)-1]; last.Kind != EventQuarantined {
+		t.Errorf("Expected a quarantined event, got %+v", last)
+	}
+
+	// Each distinct flow is logged once
+	log, err := os.ReadFile(filepath.Join(vm.dataDir, "egress.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to read flow log: %v", err)
+	}
+	if lines := strings.Count(string(log), "\n"); lines != 3 {
+		t.Errorf("Expected 3 logged flows, got %d:\n%s", lines, log)
+	}
+
+	// Quarantine ends with the VM
+	if err := manager.ReleaseVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+	if reason := manager.Quarantined("alice"); reason != "" {
+		t.Errorf("Expected quarantine to be lifted, got %q", reason)
+	}
+}
@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// entropyConfig is the body of Firecracker's PUT /entropy, which adds a
+// virtio-rng device
+type entropyConfig struct {
+	RateLimiter *rateLimiter `json:"rate_limiter,omitempty"`
+}
+
+// rateLimiter is a Firecracker rate limiter
+type rateLimiter struct {
+	Bandwidth tokenBucket `json:"bandwidth"`
+}
+
+// tokenBucket is a Firecracker token bucket, which holds size tokens and
+// refills completely every refill time
+type tokenBucket struct {
+	Size         int64 `json:"size"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64 `json:"refill_time"` // Milliseconds
+}
+
+// entropyDevice returns the virtio-rng device of VMs that may read rate
+// bytes per second, plus burst bytes once. A rate of 0 is unlimited, and a
+// negative rate means VMs get no device, so this isn't called.
+func entropyDevice(rate, burst int) entropyConfig {
+	if rate == 0 {
+		return entropyConfig{}
+	}
+	// Refill a tenth of the rate every 100ms, which is smoother than the
+	// whole rate every second, unless that would round down to nothing
+	bucket := tokenBucket{Size: int64(rate), OneTimeBurst: int64(burst), RefillTime: 1000}
+	if rate >= 10 {
+		bucket.Size, bucket.RefillTime = int64(rate/10), 100
+	}
+	return entropyConfig{RateLimiter: &rateLimiter{Bandwidth: bucket}}
+}
+
+// entropyHandler returns the handler that adds a VM's virtio-rng device
+// before it boots
+func (b *firecrackerBackend) entropyHandler(vm *VM) firecracker.Handler {
+	return firecracker.Handler{
+		Name: "virtio-rng",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return putVMMConfig(ctx, m.Cfg.SocketPath, "/entropy", entropyDevice(vm.config.EntropyRate, vm.config.EntropyBurst))
+		},
+	}
+}
+
+// putVMMConfig sends a PUT to an API of the Firecracker process listening on
+// socketPath, for the devices and settings the SDK doesn't support
+func putVMMConfig(ctx context.Context, socketPath, path string, config any) error {
+	tr := &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}
+	c := &http.Client{Transport: tr}
+	defer c.CloseIdleConnections()
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, "http://unix"+path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s PUT failed: %s: %s", strings.TrimPrefix(path, "/"), resp.Status, string(msg))
+	}
+	return nil
+}
+
+// seedGuestEntropy mixes random bytes from the host into a VM's entropy pool
+// over its SSH connection, so crypto-heavy first boots don't wait on the rate
+// limited virtio-rng device
+func (m *Manager) seedGuestEntropy(ctx context.Context, vm *VM) error {
+	if vm.config.EntropySeed == 0 {
+		return nil
+	}
+	seed := make([]byte, vm.config.EntropySeed)
+	if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+
+	client, release, err := vm.GuestClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = bytes.NewReader(seed)
+	if out, err := session.CombinedOutput("cat > /dev/urandom"); err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestEntropyDevice(t *testing.T) {
+	tests := []struct {
+		rate, burst int
+		want        string
+	}{
+		{40960, 4096, `{"rate_limiter":{"bandwidth":{"size":4096,"one_time_burst":4096,"refill_time":100}}}`},
+		{5, 0, `{"rate_limiter":{"bandwidth":{"size":5,"refill_time":1000}}}`},
+		{0, 4096, `{}`},
+	}
+	for _, tt := range tests {
+		body, err := json.Marshal(entropyDevice(tt.rate, tt.burst))
+		if err != nil {
+			t.Fatalf("Failed to marshal entropy device: %v", err)
+		}
+		if string(body) != tt.want {
+			t.Errorf("entropyDevice(%d, %d) = %s, want %s", tt.rate, tt.burst, body, tt.want)
+		}
+	}
+}
+
+func TestSeedGuestEntropy(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.EntropySeed = 512 })
+	vm, err := manager.GetOrCreateVM(context.Background(), "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), "alice")
+	if err := manager.seedGuestEntropy(context.Background(), vm); err != nil {
+		t.Errorf("Failed to seed the guest's entropy pool: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package vm
+
+import "errors"
+
+// Errors returned by the Manager for failures that users should understand.
+// Callers should match them with errors.Is, since they are usually wrapped.
+var (
+	// ErrCapacity means the maximum number of concurrent VMs is running
+	ErrCapacity = errors.New("maximum number of concurrent VMs reached")
+
+	// ErrIPExhausted means the VM network has no free addresses
+	ErrIPExhausted = errors.New("no available IP addresses")
+
+	// ErrRootfsCopy means the VM's writable disk could not be prepared
+	ErrRootfsCopy = errors.New("failed to copy rootfs image")
+
+	// ErrDiskFull means there is not enough free disk space for a new VM
+	ErrDiskFull = errors.New("not enough free disk space")
+
+	// ErrBootTimeout means the VM started but never became reachable
+	ErrBootTimeout = errors.New("timed out waiting for VM to boot")
+)
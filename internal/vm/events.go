@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// eventsPerVM is how many recent lifecycle events are kept for each VM
+const eventsPerVM = 100
+
+// EventKind is a kind of VM lifecycle event
+type EventKind string
+
+const (
+	EventCreated         EventKind = "created"          // VMM started
+	EventBooted          EventKind = "booted"           // Guest SSH server became reachable
+	EventBootFailed      EventKind = "boot-failed"      // Guest never became reachable
+	EventSessionAttached EventKind = "session-attached" // User session connected to the VM
+	EventSessionDetached EventKind = "session-detached" // User session disconnected
+	EventAdminAttached   EventKind = "admin-attached"   // Administrator attached to debug the VM
+	EventExited          EventKind = "exited"           // VMM exited without being stopped
+	EventUnresponsive    EventKind = "unresponsive"     // Guest stopped answering health checks and was stopped
+	EventQuarantined     EventKind = "quarantined"      // Egress blocked after suspicious traffic
+	EventBreakIn         EventKind = "break-in"         // Something other than the hypervisor connected to the guest's SSH server
+	EventScheduled       EventKind = "scheduled"        // Stopped or removed by a scheduled job
+	EventPreempted       EventKind = "preempted"        // Idle VM stopped to make room for a user of a higher tier
+	EventHookFailed      EventKind = "hook-failed"      // An operator's lifecycle hook failed
+	EventDestroyed       EventKind = "destroyed"        // VM stopped and resources freed
+)
+
+// Event is an entry in a VM's lifecycle timeline
+type Event struct {
+	Time   time.Time `json:"time"`
+	VMID   string    `json:"vm_id"`
+	Kind   EventKind `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// EventLog keeps a ring buffer of recent lifecycle events per VM, optionally
+// appending them to events.jsonl in each VM's data directory so the timeline
+// survives restarts
+type EventLog struct {
+	dataDir string // Empty if events are not persisted
+	logger  logrus.FieldLogger
+
+	mu     sync.Mutex
+	events map[string][]Event
+}
+
+// NewEventLog creates an event log, persisting events under dataDir if it is not empty
+func NewEventLog(dataDir string, logger logrus.FieldLogger) *EventLog {
+	return &EventLog{dataDir: dataDir, logger: logger, events: make(map[string][]Event)}
+}
+
+// Record adds an event to a VM's timeline
+func (l *EventLog) Record(vmID string, kind EventKind, detail string) {
+	event := Event{Time: time.Now(), VMID: vmID, Kind: kind, Detail: detail}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.loadLocked(vmID)
+	if len(events) >= eventsPerVM {
+		events = events[len(events)-eventsPerVM+1:]
+	}
+	l.events[vmID] = append(events, event)
+
+	if l.dataDir != "" {
+		if err := l.persist(event); err != nil {
+			l.logger.Warnf("Failed to persist event for VM %s: %v", vmID, err)
+		}
+	}
+}
+
+// Events returns a copy of a VM's recent events, oldest first
+func (l *EventLog) Events(vmID string) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.loadLocked(vmID)...)
+}
+
+// loadLocked returns a VM's events, reading them from disk the first time if
+// they are persisted (assumes mu is held)
+func (l *EventLog) loadLocked(vmID string) []Event {
+	if events, ok := l.events[vmID]; ok || l.dataDir == "" {
+		return events
+	}
+
+	var events []Event
+	if f, err := os.Open(l.eventsPath(vmID)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event Event
+			if json.Unmarshal(scanner.Bytes(), &event) == nil {
+				events = append(events, event)
+			}
+		}
+		f.Close()
+	}
+	if len(events) > eventsPerVM {
+		events = events[len(events)-eventsPerVM:]
+	}
+	l.events[vmID] = events
+	return events
+}
+
+// persist appends an event to the VM's events file
+func (l *EventLog) persist(event Event) error {
+	path := l.eventsPath(event.VMID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// eventsPath returns the file holding a VM's persisted events
+func (l *EventLog) eventsPath(vmID string) string {
+	return filepath.Join(l.dataDir, vmID, "events.jsonl")
+}
@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestEventLogRingBuffer(t *testing.T) {
+	log := NewEventLog("", logrus.New())
+	for i := range eventsPerVM + 5 {
+		log.Record("alice", EventSessionAttached, fmt.Sprint(i))
+	}
+	log.Record("bob", EventCreated, "")
+
+	events := log.Events("alice")
+	if len(events) != eventsPerVM {
+		t.Fatalf("Expected %d events, got %d", eventsPerVM, len(events))
+	}
+	if events[0].Detail != "5" || events[len(events)-1].Detail != fmt.Sprint(eventsPerVM+4) {
+		t.Errorf("Expected oldest events to be dropped, got %s..%s", events[0].Detail, events[len(events)-1].Detail)
+	}
+	if len(log.Events("bob")) != 1 || len(log.Events("carol")) != 0 {
+		t.Errorf("Expected events to be kept per VM")
+	}
+}
+
+func TestEventLogPersistence(t *testing.T) {
+	dataDir := t.TempDir()
+
+	log := NewEventLog(dataDir, logrus.New())
+	log.Record("alice", EventCreated, "IP 192.168.100.2")
+	log.Record("alice", EventDestroyed, "")
+
+	// A new log, as after a restart, reads the timeline back from disk
+	reloaded := NewEventLog(dataDir, logrus.New())
+	events := reloaded.Events("alice")
+	if len(events) != 2 || events[0].Kind != EventCreated || events[1].Kind != EventDestroyed {
+		t.Fatalf("Unexpected persisted events: %+v", events)
+	}
+	if events[0].Detail != "IP 192.168.100.2" || events[0].VMID != "alice" {
+		t.Errorf("Unexpected event contents: %+v", events[0])
+	}
+
+	reloaded.Record("alice", EventCreated, "")
+	if n := len(reloaded.Events("alice")); n != 3 {
+		t.Errorf("Expected new events to follow persisted ones, got %d events", n)
+	}
+}
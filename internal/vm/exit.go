@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrVMExited is why a VM went away when its VMM exits without being
+// stopped, like when Firecracker crashes or the guest powers off, or when its
+// guest stops answering health checks
+var ErrVMExited = errors.New("VM exited")
+
+// ExitHook is called when a VM exits or is found dead without being stopped,
+// before the VM is cleaned up. err wraps ErrVMExited with what happened.
+type ExitHook func(vm *VM, err error)
+
+// AddExitHook registers a hook run whenever a VM exits unexpectedly
+func (m *Manager) AddExitHook(hook ExitHook) {
+	m.exitMu.Lock()
+	defer m.exitMu.Unlock()
+	m.exitHooks = append(m.exitHooks, hook)
+}
+
+// Exited returns a channel that is closed if the VM's VMM exits without
+// being stopped or its guest is found dead, so sessions attached to it can
+// end instead of hanging
+func (vm *VM) Exited() <-chan struct{} {
+	return vm.exited
+}
+
+// ExitErr returns why the VM exited or was found dead, or nil if it is
+// still running or was stopped by the manager
+func (vm *VM) ExitErr() error {
+	select {
+	case <-vm.exited:
+		return vm.exitErr
+	default:
+		return nil
+	}
+}
+
+// vmExited is called by backends when a VM's VMM process exits, with the
+// error of waiting for it
+func (m *Manager) vmExited(vm *VM, err error) {
+	// The guest powering off or rebooting also exits the VMM, cleanly
+	detail := "guest shut down"
+	if err != nil {
+		detail = err.Error()
+	}
+	m.vmDied(vm, EventExited, detail)
+}
+
+// vmDied handles a VM that went away or stopped working without being
+// stopped. Unless the VM is being stopped anyway, it is recorded as an event
+// of kind, sessions watching Exited are woken, exit hooks run, and the VM is
+// cleaned up like a destroyed one.
+func (m *Manager) vmDied(vm *VM, kind EventKind, detail string) {
+	m.mutex.Lock()
+	if running, ok := m.vms[vm.ID]; !ok || running != vm {
+		// Stopped on purpose, and whoever stopped it cleans up
+		m.mutex.Unlock()
+		return
+	}
+	done := m.detachVM(vm.ID)
+	m.mutex.Unlock()
+
+	vm.exitErr = fmt.Errorf("%w: %s", ErrVMExited, detail)
+	close(vm.exited)
+	vm.logger.Warnf("VM died: %s", detail)
+	m.events.Record(vm.ID, kind, detail)
+
+	m.exitMu.Lock()
+	hooks := append([]ExitHook(nil), m.exitHooks...)
+	m.exitMu.Unlock()
+	for _, hook := range hooks {
+		hook(vm, vm.exitErr)
+	}
+
+	if err := m.finishStop(context.Background(), vm, done); err != nil {
+		m.logger.Errorf("Failed to clean up VM %s after it died: %v", vm.ID, err)
+	}
+}
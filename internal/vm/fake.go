@@ -0,0 +1,268 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeBackend simulates VMs in-process: each "VM" is an SSH server on a
+// loopback port that starts accepting sessions after a boot delay. It needs no
+// KVM, root privileges, or real binaries, so the server can be tested in CI.
+type fakeBackend struct {
+	bootDelay time.Duration
+	config    *ssh.ServerConfig
+
+	mu       sync.Mutex
+	machines map[*VM]*fakeMachine
+}
+
+// fakeMachine is the state of a single simulated VM
+type fakeMachine struct {
+	manager  *Manager
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	stopped  bool
+}
+
+// SupportsSharedDirs reports true, since fake VMs run on the host and already see its files
+func (b *fakeBackend) SupportsSharedDirs() bool {
+	return true
+}
+
+// NewFakeBackend creates a backend that simulates VMs booting in bootDelay.
+// The guest SSH server accepts the root user with any password and runs a
+// shell that echoes each line of input until "exit", or until "crash", which
+// makes the VM exit as if Firecracker died. Any subsystem echoes its input
+// back.
+func NewFakeBackend(bootDelay time.Duration) Backend {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate fake host key: %v", err))
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create fake host signer: %v", err))
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != "root" {
+				return nil, fmt.Errorf("unknown user %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	return &fakeBackend{
+		bootDelay: bootDelay,
+		config:    config,
+		machines:  make(map[*VM]*fakeMachine),
+	}
+}
+
+// Setup is a no-op, fake VMs need no host resources
+func (b *fakeBackend) Setup(m *Manager) error {
+	return nil
+}
+
+// Start listens on a loopback port and begins serving SSH after the boot delay
+func (b *fakeBackend) Start(ctx context.Context, m *Manager, vm *VM) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	machine := &fakeMachine{manager: m, listener: listener, conns: make(map[net.Conn]bool)}
+	b.mu.Lock()
+	b.machines[vm] = machine
+	b.mu.Unlock()
+
+	go func() {
+		// Connections queue in the listen backlog until the "kernel" has booted
+		time.Sleep(b.bootDelay)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !machine.track(conn) {
+				conn.Close()
+				return
+			}
+			go b.serveConn(vm, machine, conn)
+		}
+	}()
+
+	// Like Firecracker under its SDK, the machine is killed when ctx ends
+	context.AfterFunc(ctx, func() {
+		if machine.stop() {
+			m.vmExited(vm, errors.New("signal: killed"))
+		}
+	})
+
+	vm.logger.Infof("Started fake VM listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop closes the listener and all open connections of a fake VM
+func (b *fakeBackend) Stop(ctx context.Context, vm *VM) error {
+	b.mu.Lock()
+	machine, ok := b.machines[vm]
+	delete(b.machines, vm)
+	b.mu.Unlock()
+
+	if ok {
+		machine.stop()
+	}
+	return nil
+}
+
+// SetMemory only logs the new size, since fake VMs use no guest memory
+func (b *fakeBackend) SetMemory(ctx context.Context, vm *VM, mb int) error {
+	vm.logger.Infof("Fake VM memory set to %d MB", mb)
+	return nil
+}
+
+// Versions reports that fake VMs run no real binaries
+func (b *fakeBackend) Versions() Versions {
+	return Versions{Firecracker: "fake", Kernel: "fake"}
+}
+
+// SSHAddr returns the loopback address of the fake VM's SSH server
+func (b *fakeBackend) SSHAddr(vm *VM) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if machine, ok := b.machines[vm]; ok {
+		return machine.listener.Addr().String()
+	}
+	return ""
+}
+
+// track registers an open connection, returning false if the machine stopped
+func (fm *fakeMachine) track(conn net.Conn) bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if fm.stopped {
+		return false
+	}
+	fm.conns[conn] = true
+	return true
+}
+
+// stop closes the listener and every tracked connection, returning false if
+// the machine had already stopped
+func (fm *fakeMachine) stop() bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if fm.stopped {
+		return false
+	}
+	fm.stopped = true
+	fm.listener.Close()
+	for conn := range fm.conns {
+		conn.Close()
+	}
+	return true
+}
+
+// serveConn runs the SSH protocol on a single connection to a fake VM
+func (b *fakeBackend) serveConn(vm *VM, machine *fakeMachine, conn net.Conn) {
+	defer func() {
+		machine.mu.Lock()
+		delete(machine.conns, conn)
+		machine.mu.Unlock()
+		conn.Close()
+	}()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, b.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go b.serveSession(vm, machine, channel, requests)
+	}
+}
+
+// serveSession handles requests on a session channel, running a fake shell
+func (b *fakeBackend) serveSession(vm *VM, machine *fakeMachine, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "shell":
+			req.Reply(true, nil)
+			fmt.Fprintf(channel, "Welcome to fake VM %s\r\n", vm.ID)
+			scanner := bufio.NewScanner(channel)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "exit" {
+					break
+				}
+				if line == "crash" {
+					// The VM is gone before its connections drop, like when a
+					// VMM dies and they are left to time out
+					machine.manager.vmExited(vm, errors.New("signal: killed"))
+					return
+				}
+				fmt.Fprintf(channel, "%s\r\n", line)
+			}
+			sendExitStatus(channel, 0)
+			return
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			fmt.Fprintf(channel, "%s\n", payload.Command)
+			sendExitStatus(channel, 0)
+			return
+		case "subsystem":
+			// Every subsystem echoes its input back until the client closes stdin
+			req.Reply(true, nil)
+			io.Copy(channel, channel)
+			sendExitStatus(channel, 0)
+			return
+		case "pty-req", "env", "window-change":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// sendExitStatus reports a command's exit status to the client
+func sendExitStatus(channel ssh.Channel, status uint32) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// metricsFifo is the named pipe in a VM's data directory that Firecracker
+// writes its metrics to
+const metricsFifo = "metrics.fifo"
+
+// fcMetricsInterval is how often Firecracker is asked to flush metrics. It
+// flushes every 60 seconds by itself, which is too coarse for scrapes.
+const fcMetricsInterval = 15 * time.Second
+
+// VMMMetrics are the VMM-level statistics of a running VM, totaled since it
+// started
+type VMMMetrics struct {
+	Updated         time.Time `json:"updated"`
+	VcpuExits       uint64    `json:"vcpu_exits"` // Exits to the VMM for IO and MMIO
+	VcpuFailures    uint64    `json:"vcpu_failures"`
+	BlockReadBytes  uint64    `json:"block_read_bytes"`
+	BlockWriteBytes uint64    `json:"block_write_bytes"`
+	BlockReadOps    uint64    `json:"block_read_ops"`
+	BlockWriteOps   uint64    `json:"block_write_ops"`
+	NetRxBytes      uint64    `json:"net_rx_bytes"`
+	NetTxBytes      uint64    `json:"net_tx_bytes"`
+	NetRxPackets    uint64    `json:"net_rx_packets"`
+	NetTxPackets    uint64    `json:"net_tx_packets"`
+	DirtyPages      uint64    `json:"dirty_pages"`
+}
+
+// fcMetricsSample is the part of a Firecracker metrics flush that we keep.
+// Counters in a flush count what happened since the previous one.
+type fcMetricsSample struct {
+	Timestamp int64 `json:"utc_timestamp_ms"`
+	Vcpu      struct {
+		ExitIOIn      uint64 `json:"exit_io_in"`
+		ExitIOOut     uint64 `json:"exit_io_out"`
+		ExitMMIORead  uint64 `json:"exit_mmio_read"`
+		ExitMMIOWrite uint64 `json:"exit_mmio_write"`
+		Failures      uint64 `json:"failures"`
+	} `json:"vcpu"`
+	Block struct {
+		ReadBytes  uint64 `json:"read_bytes"`
+		WriteBytes uint64 `json:"write_bytes"`
+		ReadCount  uint64 `json:"read_count"`
+		WriteCount uint64 `json:"write_count"`
+	} `json:"block"`
+	Net struct {
+		RxBytes   uint64 `json:"rx_bytes_count"`
+		TxBytes   uint64 `json:"tx_bytes_count"`
+		RxPackets uint64 `json:"rx_packets_count"`
+		TxPackets uint64 `json:"tx_packets_count"`
+	} `json:"net"`
+	Memory struct {
+		DirtyPages uint64 `json:"dirty_pages"`
+	} `json:"memory"`
+}
+
+// add adds a flush to the totals
+func (m *VMMMetrics) add(s *fcMetricsSample) {
+	m.Updated = time.UnixMilli(s.Timestamp).UTC()
+	m.VcpuExits += s.Vcpu.ExitIOIn + s.Vcpu.ExitIOOut + s.Vcpu.ExitMMIORead + s.Vcpu.ExitMMIOWrite
+	m.VcpuFailures += s.Vcpu.Failures
+	m.BlockReadBytes += s.Block.ReadBytes
+	m.BlockWriteBytes += s.Block.WriteBytes
+	m.BlockReadOps += s.Block.ReadCount
+	m.BlockWriteOps += s.Block.WriteCount
+	m.NetRxBytes += s.Net.RxBytes
+	m.NetTxBytes += s.Net.TxBytes
+	m.NetRxPackets += s.Net.RxPackets
+	m.NetTxPackets += s.Net.TxPackets
+	m.DirtyPages += s.Memory.DirtyPages
+}
+
+// readMetrics adds up the flushes Firecracker writes to r until it is closed
+func (vm *VM) readMetrics(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var sample fcMetricsSample
+		if err := dec.Decode(&sample); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				vm.logger.Warnf("Stopped reading VMM metrics: %v", err)
+			}
+			return
+		}
+		vm.metricsMu.Lock()
+		if vm.metrics == nil {
+			vm.metrics = &VMMMetrics{}
+		}
+		vm.metrics.add(&sample)
+		vm.metricsMu.Unlock()
+	}
+}
+
+// startMetrics reads the VM's metrics pipe and asks Firecracker to flush
+// every fcMetricsInterval. The pipe is closed with the logs when the VM
+// stops, which ends both.
+func (vm *VM) startMetrics(fifoPath string) error {
+	// Opening for writing too keeps the open from blocking, like console.in
+	f, err := os.OpenFile(fifoPath, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return fmt.Errorf("open pipe for metrics: %w", err)
+	}
+	vm.logClosers = append(vm.logClosers, f)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vm.readMetrics(f)
+	}()
+	go func() {
+		ticker := time.NewTicker(fcMetricsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := flushMetrics(ctx, vm.SocketPath); err != nil {
+					vm.logger.Debugf("Failed to flush VMM metrics: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+	return nil
+}
+
+// flushMetrics asks the Firecracker process behind an API socket to write
+// its metrics
+func flushMetrics(ctx context.Context, socketPath string) error {
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	defer c.CloseIdleConnections()
+
+	body := strings.NewReader(`{"action_type":"FlushMetrics"}`)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, "http://unix/actions", body)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("flush failed: %s: %s", resp.Status, string(b))
+	}
+	return nil
+}
+
+// VMMMetrics returns a copy of the VM's VMM-level statistics, or false if
+// none have been flushed yet or its backend has none
+func (vm *VM) VMMMetrics() (VMMMetrics, bool) {
+	vm.metricsMu.Lock()
+	defer vm.metricsMu.Unlock()
+	if vm.metrics == nil {
+		return VMMMetrics{}, false
+	}
+	return *vm.metrics, true
+}
+
+// VMMMetrics returns the VMM-level statistics of a running VM
+func (m *Manager) VMMMetrics(vmID string) (VMMMetrics, error) {
+	vm, running := m.GetVM(vmID)
+	if !running {
+		return VMMMetrics{}, fmt.Errorf("VM %s is not running", vmID)
+	}
+	metrics, ok := vm.VMMMetrics()
+	if !ok {
+		return VMMMetrics{}, fmt.Errorf("no VMM metrics for VM %s yet", vmID)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,32 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadMetrics(t *testing.T) {
+	vm := &VM{ID: "alice", logger: logrus.NewEntry(logrus.StandardLogger())}
+	if _, ok := vm.VMMMetrics(); ok {
+		t.Errorf("Expected no metrics before the first flush")
+	}
+
+	// Each flush counts what happened since the previous one
+	flushes := `{"utc_timestamp_ms":1700000000000,"vcpu":{"exit_io_in":3,"exit_mmio_write":2},"block":{"read_bytes":4096,"write_count":1},"net":{"tx_bytes_count":100},"memory":{"dirty_pages":7},"api_server":{"process_startup_time_us":12}}
+{"utc_timestamp_ms":1700000015000,"vcpu":{"exit_io_out":5},"block":{"read_bytes":512},"net":{"tx_bytes_count":50,"rx_packets_count":4}}
+`
+	vm.readMetrics(strings.NewReader(flushes))
+
+	m, ok := vm.VMMMetrics()
+	if !ok {
+		t.Fatalf("Expected metrics after flushes")
+	}
+	if m.VcpuExits != 10 || m.BlockReadBytes != 4608 || m.BlockWriteOps != 1 || m.NetTxBytes != 150 || m.NetRxPackets != 4 || m.DirtyPages != 7 {
+		t.Errorf("Unexpected totals %+v", m)
+	}
+	if m.Updated.UnixMilli() != 1700000015000 {
+		t.Errorf("Expected update time of the last flush, got %v", m.Updated)
+	}
+}
@@ -0,0 +1,565 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// vmmEnv is the entire environment of Firecracker processes. It needs none
+// of the server's variables, and backtraces make its panics debuggable.
+var vmmEnv = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin", "RUST_BACKTRACE=1"}
+
+// firecrackerBackend runs each VM as a Firecracker microVM attached to a TAP
+// device on the host bridge
+type firecrackerBackend struct {
+	firecrackerBinary []byte
+	vmlinuxBinary     []byte
+	firecrackerPath   string // Blobs of the binaries in the content store, set by Setup
+	vmlinuxPath       string
+	version           semver   // Version of the Firecracker binary, set by Setup
+	versions          Versions // Versions of both binaries, set by Setup
+	nestedKVM         bool     // Whether the host lets guests use KVM, set by Setup
+}
+
+// NewFirecrackerBackend creates a backend that runs the given Firecracker
+// binary and vmlinux kernel, which are written to the data directory's
+// content store
+func NewFirecrackerBackend(firecrackerBinary []byte, vmlinuxBinary []byte) Backend {
+	return &firecrackerBackend{
+		firecrackerBinary: firecrackerBinary,
+		vmlinuxBinary:     vmlinuxBinary,
+	}
+}
+
+// Setup writes the shared binaries and configures host networking
+func (b *firecrackerBackend) Setup(m *Manager) error {
+	if err := checkHostDevices(hostDevices); err != nil {
+		return err
+	}
+
+	// Binaries are kept in the content store, so an upgrade never runs VMs
+	// with the previous version's kernel or Firecracker
+	var err error
+	if b.firecrackerPath, err = storeArtifact(m.artifacts, "firecracker", b.firecrackerBinary, 0755); err != nil {
+		return fmt.Errorf("failed to write firecracker binary: %w", err)
+	}
+	if b.vmlinuxPath, err = storeArtifact(m.artifacts, "kernel", b.vmlinuxBinary, 0644); err != nil {
+		return fmt.Errorf("failed to write vmlinux kernel: %w", err)
+	}
+	// Left by versions that wrote them to fixed paths
+	os.Remove(filepath.Join(m.config.DataDir, "firecracker"))
+	os.Remove(filepath.Join(m.config.DataDir, "vmlinux"))
+
+	// Binaries outside the supported matrix may lack APIs VMs need, so they
+	// are refused unless the operator accepts the risk
+	if b.version, err = firecrackerVersion(b.firecrackerPath); err != nil {
+		m.logger.Warnf("Failed to detect the Firecracker version, assuming it's recent: %v", err)
+	}
+	b.versions = checkVersions(b.version, b.vmlinuxBinary)
+	if b.versions.Kernel == "unknown" {
+		m.logger.Warnf("Failed to detect the kernel version")
+	}
+	if len(b.versions.Unsupported) > 0 {
+		problems := strings.Join(b.versions.Unsupported, "; ")
+		if !m.config.AllowUnsupported {
+			return fmt.Errorf("unsupported binaries: %s (pass -allow-unsupported to start anyway)", problems)
+		}
+		m.logger.Warnf("Running with unsupported binaries: %s", problems)
+	}
+	// Features newer than the binary are left out of VMs rather than failing
+	// their boots
+	if m.config.EntropyRate >= 0 && !b.version.atLeast(entropyMinVersion) {
+		m.logger.Warnf("Firecracker %s has no virtio-rng device (added in %s), so VMs get no entropy device", b.version, entropyMinVersion)
+	}
+	b.nestedKVM = hostNestedKVM(nestedKVMParams)
+	if m.config.NestedKVM && !b.nestedKVM {
+		m.logger.Warnf("Nested virtualization is off in the host's KVM module, so no VM can use KVM")
+	}
+
+	// Set up network bridge
+	if err := m.setupNetworkBridge(); err != nil {
+		return fmt.Errorf("failed to setup network bridge: %w", err)
+	}
+
+	// Set up iptables rules for internet access if enabled
+	if err := cleanupIptablesRules(); err != nil {
+		return fmt.Errorf("failed to clean up existing iptables rules: %w", err)
+	}
+	if err := m.setupHostProtection(); err != nil {
+		return fmt.Errorf("failed to protect host ports: %w", err)
+	}
+	if m.config.AllowInternet {
+		if err := m.setupIptablesRules(); err != nil {
+			return fmt.Errorf("failed to setup iptables rules: %w", err)
+		}
+	}
+	if m.config.CountTraffic {
+		if err := m.setupTrafficChains(); err != nil {
+			return fmt.Errorf("failed to set up traffic accounting: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Versions returns the versions of Firecracker and the kernel found by Setup
+func (b *firecrackerBackend) Versions() Versions {
+	return b.versions
+}
+
+// Start starts the Firecracker process for a VM
+func (b *firecrackerBackend) Start(ctx context.Context, manager *Manager, vm *VM) error {
+	// Remove existing socket, if any
+	os.Remove(vm.SocketPath)
+
+	vmlinuxPath := b.vmlinuxPath
+	firecrackerPath := b.firecrackerPath
+
+	bootArgs := "console=ttyS0 reboot=k panic=1 random.trust_cpu=on"
+
+	// ip=IP::Gateway:Netmask:Hostname:Interface:off
+	bootArgs += fmt.Sprintf(" ip=%s::%s:%s:%s:eth0:off", vm.IP, vm.Gateway, vm.Netmask, manager.hostnameOf(vm))
+
+	// Name the TAP device and MAC after the IP's allocation index, which is
+	// unique across all of the pool's networks
+	vmNetID, ok := manager.ipPool.Index(vm.IP)
+	if !ok {
+		return fmt.Errorf("IP %s is not in the VM network", vm.IP)
+	}
+	tapName := tapDeviceName(vmNetID)
+	vm.netDevice = tapName
+
+	// Setup TAP device
+	if err := manager.setupTAPDevice(tapName); err != nil {
+		return fmt.Errorf("failed to setup TAP device: %w", err)
+	}
+
+	drives := []models.Drive{
+		{
+			DriveID:      firecracker.String("rootfs"),
+			IsRootDevice: firecracker.Bool(true),
+			IsReadOnly:   firecracker.Bool(false),
+			PathOnHost:   firecracker.String(filepath.Join(vm.dataDir, "rootfs.img")),
+		},
+	}
+	if vm.config.RootfsMode == internal.RootfsEphemeral {
+		// Any existing per-VM disk is ignored, so the VM is always stateless
+		drives = []models.Drive{
+			{
+				DriveID:      firecracker.String("rootfs"),
+				IsRootDevice: firecracker.Bool(true),
+				IsReadOnly:   firecracker.Bool(true),
+				PathOnHost:   firecracker.String(vm.config.Rootfs),
+			},
+		}
+		bootArgs += " init=/sbin/overlay-init overlay_root=tmpfs"
+	} else if usesOverlay(vm.config, vm.dataDir) {
+		// Share the golden image read-only and keep changes on a per-VM drive,
+		// which the guest's overlay-init mounts over / before running init
+		drives = []models.Drive{
+			{
+				DriveID:      firecracker.String("rootfs"),
+				IsRootDevice: firecracker.Bool(true),
+				IsReadOnly:   firecracker.Bool(true),
+				PathOnHost:   firecracker.String(vm.config.Rootfs),
+			},
+			{
+				DriveID:      firecracker.String("overlay"),
+				IsRootDevice: firecracker.Bool(false),
+				IsReadOnly:   firecracker.Bool(false),
+				PathOnHost:   firecracker.String(filepath.Join(vm.dataDir, "overlay.img")),
+			},
+		}
+		bootArgs += " init=/sbin/overlay-init overlay_root=vdb"
+	}
+
+	// Catalog images may bring their own kernel and arguments
+	if vm.image != nil {
+		if vm.image.Kernel != "" {
+			vmlinuxPath = vm.image.Kernel
+		}
+		if vm.image.BootArgs != "" {
+			bootArgs += " " + vm.image.BootArgs
+		}
+	}
+
+	// Create machine configuration
+	cfg := firecracker.Config{
+		SocketPath:      vm.SocketPath,
+		KernelImagePath: vmlinuxPath,
+		KernelArgs:      bootArgs,
+		ForwardSignals:  []os.Signal{}, // Don't forward any signals to firecracker
+		Drives:          drives,
+		NetworkInterfaces: []firecracker.NetworkInterface{
+			{
+				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+					// Network setup: https://gist.github.com/jvns/9b274f24cfa1db7abecd0d32483666a3
+					MacAddress:  macAddress(manager.macPrefix, vmNetID),
+					HostDevName: tapName,
+				},
+				AllowMMDS: false,
+			},
+		},
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  firecracker.Int64(int64(vm.config.VMCPUs)),
+			MemSizeMib: firecracker.Int64(int64(vm.config.VMMemory)),
+		},
+	}
+
+	// Resizable VMs get their maximum memory, minus what a balloon holds back
+	if manager.Resizable() {
+		cfg.MachineCfg.MemSizeMib = firecracker.Int64(int64(vm.config.VMMaxMemory))
+	}
+
+	// Create a custom command that uses our embedded firecracker binary
+	cmd := exec.CommandContext(ctx, firecrackerPath, "--api-sock", vm.SocketPath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// Create a process group so that signals (SIGINT) are not forwarded.
+		Setpgid: true,
+	}
+	// The VMM doesn't get the server's environment, which may hold
+	// credentials, and runs in the VM's own directory, where any core dump
+	// lands beside its logs
+	cmd.Env = vmmEnv
+	cmd.Dir = vm.dataDir
+
+	vm.logger.Infof("Starting VM with IP %s, TAP device %s, data dir %s", vm.IP, tapName, vm.dataDir)
+
+	// The SDK creates the metrics pipe and fails if one is left over
+	cfg.MetricsFifo = filepath.Join(vm.dataDir, metricsFifo)
+	os.Remove(cfg.MetricsFifo)
+	cfg.LogFifo = filepath.Join(vm.dataDir, vmmLogFifo)
+	cfg.LogLevel = vmmLogLevel(vm.config.VMLogLevel)
+	os.Remove(cfg.LogFifo)
+
+	// The VM owns its serial input pipe and log files from here on, and
+	// closes them when it stops, or below if it fails to start
+	consoleIn, err := vm.openConsole()
+	if err != nil {
+		return err
+	}
+
+	// Capture VM console output (boot logs, OpenRC, SSH, etc.), the VMM's
+	// own log, and SDK logs in per-VM rotated files, which stay open until
+	// the VM is stopped. Firecracker writes the guest's serial port to
+	// stdout, and panics that bypass its logger to stderr.
+	consoleLog, vmmLog, sdkLogger, err := vm.openLogs()
+	if err != nil {
+		vm.closeConsole()
+		return err
+	}
+	cfg.FifoLogWriter = vmmLog
+
+	cmd.Stdin = consoleIn
+	cmd.Stdout = consoleLog
+	cmd.Stderr = vmmLog
+
+	machine, err := firecracker.NewMachine(
+		ctx, cfg,
+		firecracker.WithProcessRunner(cmd),
+		firecracker.WithLogger(sdkLogger),
+	)
+	if err != nil {
+		vm.closeLogs()
+		vm.closeConsole()
+		return fmt.Errorf("failed to create machine: %w", err)
+	}
+
+	// Need to initialize virtio-rng (entropy) manually since not supported by SDK
+	// https://github.com/firecracker-microvm/firecracker-go-sdk/issues/505
+	if vm.config.EntropyRate >= 0 && b.version.atLeast(entropyMinVersion) {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.Append(b.entropyHandler(vm))
+	}
+
+	// Without nested virtualization on the host, guests never see the
+	// extensions, so only hosts that have it need them hidden
+	if b.nestedKVM {
+		if manager.nestedKVM(vm) {
+			vm.logger.Infof("VM may use nested KVM")
+		} else {
+			machine.Handlers.FcInit = machine.Handlers.FcInit.Append(hideVirtualizationHandler())
+		}
+	}
+
+	if manager.Resizable() {
+		balloon := int64(vm.config.VMMaxMemory - manager.Memory(vm.ID))
+		machine.Handlers.FcInit = machine.Handlers.FcInit.Append(firecracker.Handler{
+			Name: "balloon",
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				return m.CreateBalloon(ctx, balloon, true, 0)
+			},
+		})
+	}
+
+	// Start the machine
+	if err := machine.Start(ctx); err != nil {
+		vm.closeLogs()
+		vm.closeConsole()
+		os.Remove(vm.SocketPath)
+		os.Remove(vm.PIDFile)
+		os.Remove(cfg.MetricsFifo)
+		os.Remove(cfg.LogFifo)
+		return fmt.Errorf("failed to start machine: %w", err)
+	}
+
+	// Write PID file
+	pid, err := machine.PID()
+	if err == nil {
+		err = os.WriteFile(vm.PIDFile, fmt.Appendf(nil, "%d", pid), 0644)
+	}
+	if err != nil {
+		machine.StopVMM()
+		machine.Wait(context.Background())
+		vm.closeLogs()
+		vm.closeConsole()
+		os.Remove(vm.SocketPath)
+		os.Remove(vm.PIDFile)
+		os.Remove(cfg.MetricsFifo)
+		os.Remove(cfg.LogFifo)
+		return fmt.Errorf("failed to record PID: %w", err)
+	}
+
+	// Metrics only feed the API, so the VM runs on without them
+	if err := vm.startMetrics(cfg.MetricsFifo); err != nil {
+		vm.logger.Warnf("Failed to read VMM metrics: %v", err)
+	}
+
+	// Supervise the VMM, so the manager cleans up and tells sessions if it
+	// exits early. Also runs on clean shutdown, but this is a no-op then.
+	go func() {
+		manager.vmExited(vm, machine.Wait(context.Background()))
+	}()
+
+	vm.machine = machine
+	return nil
+}
+
+// Stop stops the Firecracker process for a VM
+func (b *firecrackerBackend) Stop(ctx context.Context, vm *VM) error {
+	vm.mutex.Lock()
+	defer vm.mutex.Unlock()
+
+	if vm.machine != nil {
+		if timeout := vm.config.ShutdownTimeout; timeout > 0 {
+			shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+			b.shutdownGuest(shutdownCtx, vm)
+			cancel()
+		}
+
+		// Hard-stop the VMM if the guest is still running, and kill it if
+		// even that takes longer than the caller allows
+		if err := vm.machine.StopVMM(); err != nil {
+			vm.logger.Warnf("Failed to stop VMM: %v", err)
+		}
+		if err := vm.machine.Wait(ctx); err != nil && ctx.Err() != nil {
+			vm.logger.Warnf("VMM did not exit in time, killing it")
+			if pid, err := vm.machine.PID(); err == nil {
+				if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+					// Still running, so its files are left for recovery
+					return fmt.Errorf("failed to kill VMM: %w", err)
+				}
+			}
+			vm.machine.Wait(context.Background())
+		}
+		vm.closeLogs()
+		vm.closeConsole() // console.in
+
+		// Clean up only VM-specific files, preserve data and console output
+		os.Remove(vm.SocketPath)                          // firecracker.sock
+		os.Remove(vm.PIDFile)                             // firecracker.pid
+		os.Remove(filepath.Join(vm.dataDir, metricsFifo)) // metrics.fifo
+		os.Remove(filepath.Join(vm.dataDir, vmmLogFifo))  // vmm.fifo
+
+		vm.machine = nil
+	}
+
+	return nil
+}
+
+// shutdownGuest asks the guest to shut down and waits for the VMM to exit,
+// until ctx expires. The guest runs with reboot=k, so rebooting exits Firecracker.
+func (b *firecrackerBackend) shutdownGuest(ctx context.Context, vm *VM) {
+	if vm.config.ShutdownCommand != "" {
+		// The SSH connection usually drops as the guest goes down, so errors
+		// are expected and only the VMM exiting counts
+		if _, err := vm.RunCommand(ctx, vm.config.ShutdownCommand); err != nil {
+			vm.logger.Debugf("Shutdown command returned: %v", err)
+		}
+	} else if runtime.GOARCH != "amd64" {
+		// Only x86 has Ctrl+Alt+Del, so nothing would ever shut the guest down
+		vm.logger.Debugf("No Ctrl+Alt+Del on %s, stopping the VMM without a guest shutdown", runtime.GOARCH)
+		return
+	} else if err := vm.machine.Shutdown(ctx); err != nil {
+		vm.logger.Warnf("Failed to send Ctrl+Alt+Del, stopping the VMM without a guest shutdown: %v", err)
+		return
+	}
+
+	if err := vm.machine.Wait(ctx); err != nil && ctx.Err() != nil {
+		vm.logger.Warnf("Guest did not shut down within %s, stopping it", vm.config.ShutdownTimeout)
+	}
+}
+
+// SetMemory resizes a running VM by inflating or deflating its balloon, so
+// the guest is left with mb of its VMMaxMemory
+func (b *firecrackerBackend) SetMemory(ctx context.Context, vm *VM, mb int) error {
+	vm.mutex.Lock()
+	machine := vm.machine
+	vm.mutex.Unlock()
+	if machine == nil {
+		return fmt.Errorf("VM is not running")
+	}
+	return machine.UpdateBalloon(ctx, int64(vm.config.VMMaxMemory-mb))
+}
+
+// SSHAddr returns the address of the guest SSH server on the bridge network
+func (b *firecrackerBackend) SSHAddr(vm *VM) string {
+	return net.JoinHostPort(vm.IP.String(), "22")
+}
+
+// tapDeviceName returns the TAP device name for an allocation index. Indexes
+// are below MaxPoolSize, so names fit in the kernel's 15-character limit.
+func tapDeviceName(index int) string {
+	return fmt.Sprintf("sshvm-tap-%x", index)
+}
+
+// DefaultMACPrefix is the MAC prefix used when none is configured
+const DefaultMACPrefix = "02:FC"
+
+// ParseMACPrefix parses the leading bytes of VM MAC addresses, like "02:FC",
+// or DefaultMACPrefix if s is empty. The prefix must be a locally administered
+// unicast address and leave room for every allocation index below MaxPoolSize.
+func ParseMACPrefix(s string) (net.HardwareAddr, error) {
+	if s == "" {
+		s = DefaultMACPrefix
+	}
+	var prefix net.HardwareAddr
+	for _, part := range strings.Split(s, ":") {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, fmt.Errorf("invalid MAC prefix %q, expected hex bytes like 02:FC", s)
+		}
+		prefix = append(prefix, byte(b))
+	}
+	if len(prefix) > 3 {
+		return nil, fmt.Errorf("MAC prefix %q is longer than 3 bytes", s)
+	}
+	if prefix[0]&0x03 != 0x02 {
+		return nil, fmt.Errorf("MAC prefix %q is not locally administered unicast (first byte must be x2, x6, xA, or xE)", s)
+	}
+	return prefix, nil
+}
+
+// macAddress returns the MAC address for an allocation index, which fills the
+// bytes after the prefix
+func macAddress(prefix net.HardwareAddr, index int) string {
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, prefix)
+	for i := 5; i >= len(prefix); i-- {
+		mac[i] = byte(index)
+		index >>= 8
+	}
+	return mac.String()
+}
+
+// CheckHost checks that the device nodes VMs need exist and the network
+// bridge is up, since either can disappear while the server runs, like when
+// someone runs "ip link del"
+func (b *firecrackerBackend) CheckHost(m *Manager) error {
+	if err := checkHostDevices(hostDevices); err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(m.bridgeName)
+	if err != nil {
+		return fmt.Errorf("bridge %s is missing: %w", m.bridgeName, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("bridge %s is down", m.bridgeName)
+	}
+	return nil
+}
+
+// setupNetworkBridge creates and configures the network bridge, with a gateway
+// address on it for each VM network
+func (m *Manager) setupNetworkBridge() error {
+	// Check if bridge already exists
+	if err := exec.Command("ip", "link", "show", m.bridgeName).Run(); err == nil {
+		m.logger.Infof("Bridge %s already exists", m.bridgeName)
+	} else {
+		// Create bridge
+		if err := exec.Command("ip", "link", "add", "name", m.bridgeName, "type", "bridge").Run(); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %w", m.bridgeName, err)
+		}
+		m.logger.Infof("Created bridge: %s", m.bridgeName)
+	}
+
+	// Configure bridge IPs (gateways), which may exist from a previous run
+	for _, network := range m.ipPool.Networks() {
+		maskSize, _ := network.Mask.Size()
+		gatewayWithMask := fmt.Sprintf("%s/%d", Gateway(network), maskSize)
+		if output, err := exec.Command("ip", "addr", "add", gatewayWithMask, "dev", m.bridgeName).CombinedOutput(); err != nil {
+			if !strings.Contains(string(output), "File exists") {
+				return fmt.Errorf("failed to add IP to bridge: %w", err)
+			}
+		}
+	}
+
+	// Bring bridge up
+	if err := exec.Command("ip", "link", "set", "dev", m.bridgeName, "up").Run(); err != nil {
+		return fmt.Errorf("failed to bring bridge up: %w", err)
+	}
+
+	if err := m.enableIPForward(ipForwardPath); err != nil {
+		return err
+	}
+
+	m.logger.Infof("Bridge %s configured for networks %v", m.bridgeName, m.ipPool.Networks())
+	return nil
+}
+
+// setupTAPDevice creates and configures a TAP device for a VM. In container
+// mode, a TAP device that already exists was handed to us and is reused.
+func (m *Manager) setupTAPDevice(tapName string) error {
+	// Check if TAP device already exists
+	exists := exec.Command("ip", "link", "show", tapName).Run() == nil
+	if exists && !m.config.ContainerMode {
+		// If TAP device exists, delete it
+		m.logger.Debugf("TAP device %s already exists, deleting it", tapName)
+		if err := exec.Command("ip", "link", "delete", tapName).Run(); err != nil {
+			return fmt.Errorf("failed to delete existing TAP device %s: %w", tapName, err)
+		}
+		exists = false
+	}
+
+	// Create TAP device
+	if !exists {
+		if err := exec.Command("ip", "tuntap", "add", tapName, "mode", "tap").Run(); err != nil {
+			return fmt.Errorf("failed to create TAP device %s: %w", tapName, err)
+		}
+	}
+
+	// Attach TAP device to bridge
+	if err := exec.Command("ip", "link", "set", "dev", tapName, "master", m.bridgeName).Run(); err != nil {
+		return fmt.Errorf("failed to attach TAP device to bridge: %w", err)
+	}
+
+	// Bring TAP device up
+	if err := exec.Command("ip", "link", "set", "dev", tapName, "up").Run(); err != nil {
+		return fmt.Errorf("failed to bring TAP device up: %w", err)
+	}
+
+	m.logger.Debugf("Created and configured TAP device: %s", tapName)
+	return nil
+}
@@ -0,0 +1,202 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// GCPolicy decides which data directories of stopped VMs are pruned
+type GCPolicy struct {
+	KeepFor time.Duration // Remove VMs unused for longer than this (0 = no age limit)
+	MaxSize int64         // Remove least recently used VMs until usage fits, in bytes (0 = unlimited)
+	DryRun  bool          // Report what would be removed without removing it
+}
+
+// PrunedVM describes a VM data directory removed by garbage collection
+type PrunedVM struct {
+	ID       string
+	Size     int64
+	LastUsed time.Time
+}
+
+// vmDirInfo is a per-VM data directory found while scanning the data dir
+type vmDirInfo struct {
+	id       string
+	path     string
+	size     int64
+	lastUsed time.Time
+	active   bool
+}
+
+// GC prunes data directories of stopped VMs according to the policy. Each
+// directory is reserved while it is removed, so no VM can start on it, but
+// the manager lock isn't held while scanning or removing.
+func (m *Manager) GC(policy GCPolicy) ([]PrunedVM, error) {
+	m.mutex.Lock()
+	active := make(map[string]bool, len(m.vms)+len(m.transitions))
+	for id := range m.vms {
+		active[id] = true
+	}
+	for id := range m.transitions {
+		active[id] = true
+	}
+	m.mutex.Unlock()
+
+	return collectGarbage(m.config.DataDir, policy, func(id string) bool { return active[id] }, m.holdStopped)
+}
+
+// RemoveVM deletes the data directory of a stopped VM, including its disks
+// and labels. The VM is reserved meanwhile, so it can't start until removed.
+func (m *Manager) RemoveVM(vmID string) error {
+	release, err := m.holdStopped(vmID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if m.objects != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), objectDeleteTimeout)
+		defer cancel()
+		if err := errors.Join(m.deleteObjects(ctx, vmKeyPrefix(vmID)), m.deleteObjects(ctx, snapshotKeyPrefix(vmID))); err != nil {
+			return fmt.Errorf("failed to remove VM %s from object storage: %w", vmID, err)
+		}
+	}
+	return removeVMDir(filepath.Join(m.config.DataDir, vmID))
+}
+
+// CollectGarbage prunes per-VM directories in dataDir according to the policy.
+// Directories of VMs reported by active, or whose Firecracker process is still
+// alive, are never removed, so it is safe to run beside a live server.
+func CollectGarbage(dataDir string, policy GCPolicy, active func(id string) bool) ([]PrunedVM, error) {
+	return collectGarbage(dataDir, policy, active, nil)
+}
+
+// collectGarbage is CollectGarbage, which with hold reserves each VM before
+// removing its directory and skips VMs that can't be reserved
+func collectGarbage(dataDir string, policy GCPolicy, active func(id string) bool, hold func(id string) (func(), error)) ([]PrunedVM, error) {
+	dirs, err := scanVMDirs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for i := range dirs {
+		dirs[i].active = (active != nil && active(dirs[i].id)) || processAlive(filepath.Join(dirs[i].path, "firecracker.pid"))
+		total += dirs[i].size
+	}
+
+	// Consider the least recently used VMs first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].lastUsed.Before(dirs[j].lastUsed) })
+
+	var pruned []PrunedVM
+	var errs []error
+	now := time.Now()
+	for _, dir := range dirs {
+		if dir.active {
+			continue
+		}
+		expired := policy.KeepFor > 0 && now.Sub(dir.lastUsed) > policy.KeepFor
+		overSize := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !overSize {
+			continue
+		}
+
+		release := func() {}
+		if hold != nil {
+			var err error
+			if release, err = hold(dir.id); err != nil {
+				continue // Started since the scan
+			}
+		}
+		var err error
+		if !policy.DryRun {
+			err = removeVMDir(dir.path)
+		}
+		release()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remove %s: %w", dir.id, err))
+			continue
+		}
+		total -= dir.size
+		pruned = append(pruned, PrunedVM{ID: dir.id, Size: dir.size, LastUsed: dir.lastUsed})
+	}
+
+	return pruned, errors.Join(errs...)
+}
+
+// scanVMDirs lists the per-VM directories in dataDir, recognized by holding a rootfs or overlay drive,
+// plain or sealed
+func scanVMDirs(dataDir string) ([]vmDirInfo, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var dirs []vmDirInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dataDir, entry.Name())
+		if !slices.ContainsFunc(sealedDisks, func(name string) bool {
+			return fileExists(filepath.Join(path, name)) || fileExists(filepath.Join(path, name+sealedSuffix))
+		}) {
+			continue
+		}
+
+		dir := vmDirInfo{id: entry.Name(), path: path}
+		filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				dir.size += allocatedSize(info)
+				if info.ModTime().After(dir.lastUsed) {
+					dir.lastUsed = info.ModTime()
+				}
+			}
+			return nil
+		})
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// processAlive reports whether the process in a PID file is still running
+func processAlive(pidFile string) bool {
+	pid := readPID(pidFile)
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// readPID returns the process ID in a PID file, or 0 if there is none
+func readPID(pidFile string) int {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// fileExists reports whether a file exists at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeVMDir creates a fake VM data directory of the given size and age
+func writeVMDir(t *testing.T, dataDir, id string, size int, age time.Duration) {
+	t.Helper()
+	writeVMDisk(t, dataDir, id, "rootfs.img", size, age)
+}
+
+// writeVMDisk creates a fake VM data directory holding one disk file
+func writeVMDisk(t *testing.T, dataDir, id, name string, size int, age time.Duration) {
+	t.Helper()
+	dir := filepath.Join(dataDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create VM dir: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Failed to write disk: %v", err)
+	}
+	mtime := time.Now().Add(-age)
+	os.Chtimes(path, mtime, mtime)
+}
+
+func TestCollectGarbageKeepFor(t *testing.T) {
+	dataDir := t.TempDir()
+	writeVMDir(t, dataDir, "old", 10, 48*time.Hour)
+	writeVMDir(t, dataDir, "old-active", 10, 48*time.Hour)
+	writeVMDir(t, dataDir, "recent", 10, time.Minute)
+	os.MkdirAll(filepath.Join(dataDir, "not-a-vm"), 0755)
+
+	// A live Firecracker process keeps its directory around
+	writeVMDir(t, dataDir, "old-running", 10, 48*time.Hour)
+	os.WriteFile(filepath.Join(dataDir, "old-running", "firecracker.pid"), fmt.Appendf(nil, "%d", os.Getpid()), 0644)
+
+	pruned, err := CollectGarbage(dataDir, GCPolicy{KeepFor: 24 * time.Hour}, func(id string) bool {
+		return id == "old-active"
+	})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].ID != "old" {
+		t.Fatalf("Expected only 'old' to be pruned, got %+v", pruned)
+	}
+
+	for id, kept := range map[string]bool{"old": false, "old-active": true, "old-running": true, "recent": true, "not-a-vm": true} {
+		_, err := os.Stat(filepath.Join(dataDir, id))
+		if exists := err == nil; exists != kept {
+			t.Errorf("Expected %s kept=%v, got exists=%v", id, kept, exists)
+		}
+	}
+}
+
+func TestCollectGarbageMaxSize(t *testing.T) {
+	dataDir := t.TempDir()
+	writeVMDir(t, dataDir, "a", 8192, 3*time.Hour)
+	writeVMDir(t, dataDir, "b", 8192, 2*time.Hour)
+	writeVMDir(t, dataDir, "c", 8192, 1*time.Hour)
+
+	// Dry run reports the least recently used VM without removing it
+	pruned, err := CollectGarbage(dataDir, GCPolicy{MaxSize: 20000, DryRun: true}, nil)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].ID != "a" || pruned[0].Size != 8192 {
+		t.Fatalf("Expected 'a' to be pruned, got %+v", pruned)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "a")); err != nil {
+		t.Errorf("Dry run should not remove anything: %v", err)
+	}
+
+	pruned, err = CollectGarbage(dataDir, GCPolicy{MaxSize: 12000}, nil)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(pruned) != 2 || pruned[0].ID != "a" || pruned[1].ID != "b" {
+		t.Fatalf("Expected 'a' and 'b' to be pruned, got %+v", pruned)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "c")); err != nil {
+		t.Errorf("Expected most recent VM to be kept: %v", err)
+	}
+}
+
+func TestCollectGarbageSealed(t *testing.T) {
+	dataDir := t.TempDir()
+	writeVMDisk(t, dataDir, "sealed", "rootfs.img"+sealedSuffix, 10, 48*time.Hour)
+	writeVMDisk(t, dataDir, "sealed-overlay", "overlay.img"+sealedSuffix, 10, 48*time.Hour)
+
+	pruned, err := CollectGarbage(dataDir, GCPolicy{KeepFor: 24 * time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(pruned) != 2 {
+		t.Fatalf("Expected both sealed VMs to be pruned, got %+v", pruned)
+	}
+	for _, id := range []string{"sealed", "sealed-overlay"} {
+		if _, err := os.Stat(filepath.Join(dataDir, id)); err == nil {
+			t.Errorf("Expected sealed VM %s to be removed", id)
+		}
+	}
+}
+
+func TestManagerGC(t *testing.T) {
+	manager := newTestManager(t)
+	dataDir := manager.config.DataDir
+	writeVMDir(t, dataDir, "alice", 10, 48*time.Hour)
+	writeVMDir(t, dataDir, "bob", 10, 48*time.Hour)
+
+	// Bob is starting, so his directory is kept
+	release, err := manager.holdStopped("bob")
+	if err != nil {
+		t.Fatalf("Failed to hold bob: %v", err)
+	}
+	defer release()
+
+	pruned, err := manager.GC(GCPolicy{KeepFor: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].ID != "alice" {
+		t.Fatalf("Expected only 'alice' to be pruned, got %+v", pruned)
+	}
+	if !fileExists(filepath.Join(dataDir, "bob")) {
+		t.Errorf("Expected bob's directory to be kept")
+	}
+	if _, busy := manager.transitions["alice"]; busy {
+		t.Errorf("Expected alice to be released after removal")
+	}
+
+	// A VM that starts after the scan can't be reserved, so it is skipped
+	writeVMDir(t, dataDir, "carol", 10, 48*time.Hour)
+	pruned, err = collectGarbage(dataDir, GCPolicy{KeepFor: 24 * time.Hour}, nil, func(id string) (func(), error) {
+		return nil, fmt.Errorf("VM %s is running", id)
+	})
+	if err != nil || len(pruned) != 0 || !fileExists(filepath.Join(dataDir, "carol")) {
+		t.Errorf("Expected carol to be skipped, got %+v, %v", pruned, err)
+	}
+}
+
+func TestRemoveVM(t *testing.T) {
+	manager := newTestManager(t)
+	dataDir := manager.config.DataDir
+	writeVMDir(t, dataDir, "alice", 10, time.Minute)
+
+	release, err := manager.holdStopped("alice")
+	if err != nil {
+		t.Fatalf("Failed to hold alice: %v", err)
+	}
+	if err := manager.RemoveVM("alice"); err == nil {
+		t.Errorf("Expected a VM being started not to be removed")
+	}
+	release()
+
+	if err := manager.RemoveVM("alice"); err != nil {
+		t.Fatalf("RemoveVM failed: %v", err)
+	}
+	if fileExists(filepath.Join(dataDir, "alice")) {
+		t.Errorf("Expected alice's directory to be removed")
+	}
+	if _, busy := manager.transitions["alice"]; busy {
+		t.Errorf("Expected alice to be released after removal")
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// guestHealthTimeout bounds the keepalive that checks a cached guest
+// connection before it is reused
+const guestHealthTimeout = 2 * time.Second
+
+// guestConn is a shared SSH connection to a VM's guest
+type guestConn struct {
+	client *ssh.Client
+	refs   int
+}
+
+// GuestClient returns an SSH connection to the guest as root, shared by all
+// callers so each session only opens a channel instead of a new connection.
+// The cached connection is health checked before reuse and redialed if it
+// has failed. Callers must call release when done, and the connection is
+// closed once it has no users. The context bounds only the dial.
+func (vm *VM) GuestClient(ctx context.Context) (client *ssh.Client, release func(), err error) {
+	vm.guestMu.Lock()
+	defer vm.guestMu.Unlock()
+
+	if vm.guest != nil && !guestHealthy(vm.guest.client) {
+		vm.logger.Warnf("Cached guest SSH connection failed its health check, redialing")
+		vm.guest.client.Close()
+		vm.guest = nil
+	}
+	if vm.guest == nil {
+		client, err := dialGuest(ctx, vm.SSHAddr())
+		if err != nil {
+			return nil, nil, err
+		}
+		vm.guest = &guestConn{client: client}
+	}
+
+	conn := vm.guest
+	conn.refs++
+	var released bool
+	release = func() {
+		vm.guestMu.Lock()
+		defer vm.guestMu.Unlock()
+
+		if released {
+			return
+		}
+		released = true
+		conn.refs--
+		if conn.refs == 0 {
+			conn.client.Close()
+			if vm.guest == conn {
+				vm.guest = nil
+			}
+		}
+	}
+	return conn.client, release, nil
+}
+
+// closeGuestClient closes the cached guest connection, ending all its sessions
+func (vm *VM) closeGuestClient() {
+	vm.guestMu.Lock()
+	defer vm.guestMu.Unlock()
+
+	if vm.guest != nil {
+		vm.guest.client.Close()
+		vm.guest = nil
+	}
+}
+
+// guestHealthy reports whether a guest connection still answers keepalives
+func guestHealthy(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(guestHealthTimeout):
+		return false
+	}
+}
+
+// dialGuest opens an SSH connection to a guest as root. The guest accepts an
+// empty password or answers to any keyboard-interactive challenge.
+func dialGuest(ctx context.Context, addr string) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{
+			ssh.Password(""),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				return make([]string, len(questions)), nil
+			}),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest: %w", err)
+	}
+	// Closing the connection unblocks the handshake if ctx expires
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to guest: %w", err)
+	}
+	if !stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// RunCommand runs a shell command in the guest as root over SSH and returns
+// its combined output. The context bounds the whole exchange.
+func (vm *VM) RunCommand(ctx context.Context, command string) (string, error) {
+	client, release, err := vm.GuestClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to open guest session: %w", err)
+	}
+	defer session.Close()
+	// Closing the session unblocks it if ctx expires
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		if ctx.Err() != nil {
+			return string(output), ctx.Err()
+		}
+		return string(output), fmt.Errorf("guest command failed: %w", err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+	vm, err := manager.GetOrCreateVM(ctx, "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+
+	// The fake guest echoes commands back
+	output, err := vm.RunCommand(ctx, "uname -a")
+	if err != nil {
+		t.Fatalf("Failed to run command: %v", err)
+	}
+	if output != "uname -a\n" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+
+	if err := manager.DestroyVM(context.Background(), vm.ID); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := vm.RunCommand(timeoutCtx, "true"); err == nil {
+		t.Errorf("Expected error running command in stopped VM")
+	}
+}
+
+func TestGuestClientShared(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+	vm, err := manager.GetOrCreateVM(ctx, "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(ctx, vm.ID)
+
+	first, releaseFirst, err := vm.GuestClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get guest client: %v", err)
+	}
+	second, releaseSecond, err := vm.GuestClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get guest client: %v", err)
+	}
+	if first != second {
+		t.Errorf("Expected concurrent users to share one connection")
+	}
+
+	// The connection stays open while anyone uses it
+	releaseFirst()
+	releaseFirst()
+	if _, _, err := second.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("Expected connection to stay open with a user left: %v", err)
+	}
+	releaseSecond()
+	if _, _, err := second.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Errorf("Expected connection to close after the last user released it")
+	}
+
+	// A failed cached connection is replaced
+	third, releaseThird, err := vm.GuestClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get guest client: %v", err)
+	}
+	defer releaseThird()
+	third.Close()
+	fourth, releaseFourth, err := vm.GuestClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to redial guest client: %v", err)
+	}
+	defer releaseFourth()
+	if fourth == third {
+		t.Errorf("Expected unhealthy connection to be redialed")
+	}
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// healthCheckMisses is how many health checks in a row a guest may fail
+// before it is considered dead. A busy guest can miss one, but a panicked
+// or hung kernel misses them all.
+const healthCheckMisses = 3
+
+// healthCheckTimeout bounds reaching a guest's SSH server in a health check
+const healthCheckTimeout = 5 * time.Second
+
+// MonitorHealth checks that each booted VM's guest answers SSH every
+// interval until ctx is done. A VM whose guest fails healthCheckMisses checks
+// in a row is treated like one whose VMM exited: it is recorded, sessions
+// attached to it end, and it is stopped, so users don't sit in a hung
+// terminal until TCP times out.
+func (m *Manager) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	misses := make(map[*VM]int)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mutex.RLock()
+			vms := make([]*VM, 0, len(m.vms))
+			for _, vm := range m.vms {
+				vms = append(vms, vm)
+			}
+			m.mutex.RUnlock()
+
+			checked := make(map[*VM]int, len(vms))
+			for _, vm := range vms {
+				// VMs still booting aren't expected to answer yet
+				if vm.State() != StateReady {
+					continue
+				}
+				if err := checkGuest(ctx, vm); err != nil {
+					checked[vm] = misses[vm] + 1
+					vm.logger.Warnf("Guest failed health check %d of %d: %v", checked[vm], healthCheckMisses, err)
+					if checked[vm] >= healthCheckMisses {
+						go m.vmDied(vm, EventUnresponsive, fmt.Sprintf("guest failed %d health checks: %v", checked[vm], err))
+					}
+				}
+			}
+			misses = checked
+		}
+	}
+}
+
+// checkGuest returns an error if a VM's guest doesn't answer SSH keepalives
+func checkGuest(ctx context.Context, vm *VM) error {
+	checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	client, release, err := vm.GuestClient(checkCtx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if !guestHealthy(client) {
+		return errors.New("no answer to keepalive")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMonitorHealth(t *testing.T) {
+	manager := newTestManager(t)
+	backend := manager.backend.(*fakeBackend)
+	var hooked error
+	manager.AddExitHook(func(vm *VM, err error) { hooked = err })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if err := manager.WaitReady(ctx, vm, nil); err != nil {
+		t.Fatalf("VM didn't become ready: %v", err)
+	}
+	go manager.MonitorHealth(ctx, 20*time.Millisecond)
+
+	// A healthy guest is left alone
+	time.Sleep(5 * 20 * time.Millisecond)
+	if _, ok := manager.GetVM("alice"); !ok {
+		t.Fatalf("Expected a healthy VM to keep running")
+	}
+
+	// A guest that stops answering, like after a kernel panic, is stopped
+	// and its sessions told
+	backend.mu.Lock()
+	backend.machines[vm].stop()
+	backend.mu.Unlock()
+	select {
+	case <-vm.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the unresponsive VM to be found dead")
+	}
+	if err := vm.ExitErr(); !errors.Is(err, ErrVMExited) {
+		t.Errorf("Expected ErrVMExited, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.Busy("alice") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := manager.GetVM("alice"); ok {
+		t.Errorf("Expected the dead VM to be removed")
+	}
+	if !errors.Is(hooked, ErrVMExited) {
+		t.Errorf("Expected exit hooks to run, got %v", hooked)
+	}
+	var kinds []EventKind
+	for _, event := range manager.Events().Events("alice") {
+		kinds = append(kinds, event.Kind)
+	}
+	if len(kinds) < 2 || kinds[len(kinds)-2] != EventUnresponsive || kinds[len(kinds)-1] != EventDestroyed {
+		t.Errorf("Expected unresponsive and destroyed events, got %v", kinds)
+	}
+}
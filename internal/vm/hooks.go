@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HookPoint is a point in a VM's lifecycle where an operator's hook runs
+type HookPoint string
+
+const (
+	HookPreBoot    HookPoint = "pre-boot"    // Disk and address ready, before the VMM starts; failing stops the boot
+	HookPostBoot   HookPoint = "post-boot"   // Guest SSH server reachable for the first time since the VM started
+	HookPreDestroy HookPoint = "pre-destroy" // Before the VM is stopped
+)
+
+// hookTimeout is how long a hook may run before it is killed
+const hookTimeout = 30 * time.Second
+
+// hookEnvPrefix starts the names of the environment variables hooks get
+const hookEnvPrefix = "SSH_HYPERVISOR_"
+
+// runHook runs the executable named after a lifecycle point in the hooks
+// directory, with the VM's metadata in its environment. Points without a
+// hook are skipped. Failures are recorded in the VM's events and returned.
+func (m *Manager) runHook(ctx context.Context, point HookPoint, vm *VM) error {
+	if m.config.Hooks == "" {
+		return nil
+	}
+	path := filepath.Join(m.config.Hooks, string(point))
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), m.hookEnv(point, vm)...)
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		err = fmt.Errorf("%s hook failed: %w", point, err)
+		m.events.Record(vm.ID, EventHookFailed, err.Error())
+		return err
+	}
+	vm.logger.Infof("Ran %s hook in %s", point, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// hookEnv returns the environment variables describing a VM to its hooks
+func (m *Manager) hookEnv(point HookPoint, vm *VM) []string {
+	dataDir, err := filepath.Abs(vm.dataDir)
+	if err != nil {
+		dataDir = vm.dataDir
+	}
+	vars := map[string]string{
+		"HOOK":        string(point),
+		"VM_ID":       vm.ID,
+		"USER":        vm.ID, // VMs are named after their users
+		"VM_IP":       vm.IP.String(),
+		"VM_GATEWAY":  vm.Gateway.String(),
+		"VM_NETMASK":  vm.Netmask.String(),
+		"VM_HOSTNAME": m.hostnameOf(vm),
+		"VM_DATA_DIR": dataDir,
+		"VM_IMAGE":    m.VMImage(vm.ID),
+	}
+	if labels, err := m.Labels(vm.ID); err == nil {
+		var pairs []string
+		for key, value := range labels {
+			pairs = append(pairs, key+"="+value)
+		}
+		sort.Strings(pairs)
+		vars["VM_LABELS"] = strings.Join(pairs, ",")
+	}
+
+	var env []string
+	for name, value := range vars {
+		env = append(env, hookEnvPrefix+name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
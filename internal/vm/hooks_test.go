@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+// writeHook writes an executable shell script hook
+func writeHook(t *testing.T, dir string, point HookPoint, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, string(point)), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Failed to write %s hook: %v", point, err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	hooksDir := t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	for _, point := range []HookPoint{HookPreBoot, HookPostBoot, HookPreDestroy} {
+		writeHook(t, hooksDir, point, `env | grep ^SSH_HYPERVISOR_ | sort >> "`+logFile+`"; echo --- >> "`+logFile+`"`+"\n")
+	}
+	manager := newTestManager(t, func(c *internal.Config) { c.Hooks = hooksDir })
+
+	ctx := context.Background()
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := manager.WaitReady(ctx, vm, nil); err != nil {
+			t.Fatalf("VM didn't become ready: %v", err)
+		}
+	}
+	if err := manager.DestroyVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read hook log: %v", err)
+	}
+	runs := strings.Split(strings.TrimSuffix(string(data), "---\n"), "---\n")
+	if len(runs) != 3 {
+		t.Fatalf("Expected 3 hook runs (post-boot only once), got %d:\n%s", len(runs), data)
+	}
+	dataDir, _ := filepath.Abs(filepath.Join(manager.config.DataDir, "alice"))
+	for i, point := range []HookPoint{HookPreBoot, HookPostBoot, HookPreDestroy} {
+		for _, want := range []string{
+			"SSH_HYPERVISOR_HOOK=" + string(point),
+			"SSH_HYPERVISOR_VM_ID=alice",
+			"SSH_HYPERVISOR_USER=alice",
+			"SSH_HYPERVISOR_VM_IP=" + vm.IP.String(),
+			"SSH_HYPERVISOR_VM_DATA_DIR=" + dataDir,
+		} {
+			if !strings.Contains(runs[i], want+"\n") {
+				t.Errorf("Expected %s hook environment to contain %s, got:\n%s", point, want, runs[i])
+			}
+		}
+	}
+
+	// A failing pre-boot hook keeps the VM from starting
+	writeHook(t, hooksDir, HookPreBoot, "echo no storage for $SSH_HYPERVISOR_USER >&2\nexit 1\n")
+	_, err = manager.GetOrCreateVM(ctx, "bob", nil)
+	if err == nil || !strings.Contains(err.Error(), "no storage for bob") {
+		t.Fatalf("Expected the pre-boot hook's error, got %v", err)
+	}
+	if _, ok := manager.GetVM("bob"); ok {
+		t.Errorf("Expected no VM after a failed pre-boot hook")
+	}
+	found := false
+	for _, event := range manager.Events().Events("bob") {
+		found = found || event.Kind == EventHookFailed
+	}
+	if !found {
+		t.Errorf("Expected a hook-failed event for bob")
+	}
+}
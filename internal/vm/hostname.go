@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// maxHostnameLength is the longest hostname the kernel accepts
+const maxHostnameLength = 64
+
+// hostsMarker ends the lines of a guest's /etc/hosts that the hypervisor
+// manages, so they are replaced rather than repeated on every boot
+const hostsMarker = "# ssh-hypervisor"
+
+// hostnameData is what a hostname template can refer to
+type hostnameData struct {
+	User  string // User the VM belongs to
+	ID    string // VM ID, currently the same as User
+	Image string // Image the VM boots from the catalog, empty with a single rootfs
+	Node  string // Name of this host in a cluster
+}
+
+// parseHostnameTemplate parses a template of guests' hostnames, like
+// "{{.User}}.box"
+func parseHostnameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("hostname").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VM hostname template: %w", err)
+	}
+	// Catch references to fields that don't exist at startup, not at boot
+	if err := tmpl.Execute(new(strings.Builder), hostnameData{}); err != nil {
+		return nil, fmt.Errorf("invalid VM hostname template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// hostnameOf returns a VM's guest hostname, rendered from the hostname
+// template if there is one and made valid for DNS
+func (m *Manager) hostnameOf(vm *VM) string {
+	name := vm.ID
+	if m.hostname != nil {
+		var b strings.Builder
+		data := hostnameData{User: vm.ID, ID: vm.ID, Image: m.VMImage(vm.ID), Node: m.config.NodeName}
+		if err := m.hostname.Execute(&b, data); err != nil {
+			vm.logger.Warnf("Failed to render hostname, using the VM ID: %v", err)
+		} else {
+			name = b.String()
+		}
+	}
+	return sanitizeHostname(name)
+}
+
+// sanitizeHostname replaces characters that can't appear in hostnames with
+// dashes and trims the result to the kernel's limit. User names can hold
+// anything, but the kernel's ip= parameter splits on colons.
+func sanitizeHostname(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name) > maxHostnameLength {
+		name = name[:maxHostnameLength]
+	}
+	name = strings.Trim(name, "-.")
+	if name == "" {
+		return "vm"
+	}
+	return name
+}
+
+// hostsCommand returns a shell command that replaces the hypervisor's lines
+// in a guest's /etc/hosts with its own hostname and the host's names for its
+// gateway
+func hostsCommand(hostname string, gateway net.IP, hostNames []string) string {
+	names := hostname
+	if short, _, ok := strings.Cut(hostname, "."); ok {
+		names += " " + short
+	}
+	lines := []string{"127.0.1.1 " + names + " " + hostsMarker}
+	if len(hostNames) > 0 {
+		lines = append(lines, gateway.String()+" "+strings.Join(hostNames, " ")+" "+hostsMarker)
+	}
+	// Every character in these lines is safe in single quotes, since
+	// hostnames and host names are checked
+	return fmt.Sprintf("sed -i '/ %s$/d' /etc/hosts && printf '%%s\\n' '%s' >> /etc/hosts",
+		hostsMarker, strings.Join(lines, "' '"))
+}
+
+// writeGuestHosts adds the VM's hostname, and the host's names for its
+// gateway if configured, to the guest's /etc/hosts
+func (m *Manager) writeGuestHosts(ctx context.Context, vm *VM) error {
+	var hostNames []string
+	for _, name := range strings.Split(m.config.VMHosts, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			hostNames = append(hostNames, name)
+		}
+	}
+	if m.hostname == nil && len(hostNames) == 0 {
+		return nil
+	}
+	if out, err := vm.RunCommand(ctx, hostsCommand(m.hostnameOf(vm), vm.Gateway, hostNames)); err != nil {
+		if out = strings.TrimSpace(out); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
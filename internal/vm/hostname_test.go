@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestSanitizeHostname(t *testing.T) {
+	tests := map[string]string{
+		"alice":                 "alice",
+		"alice.box":             "alice.box",
+		"bob_smith@example:22":  "bob-smith-example-22",
+		"-.weird.-":             "weird",
+		"":                      "vm",
+		strings.Repeat("a", 80): strings.Repeat("a", maxHostnameLength),
+	}
+	for name, want := range tests {
+		if got := sanitizeHostname(name); got != want {
+			t.Errorf("sanitizeHostname(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHostnameTemplate(t *testing.T) {
+	if _, err := parseHostnameTemplate("{{.User"); err == nil {
+		t.Errorf("Expected an unclosed action to be refused")
+	}
+	if _, err := parseHostnameTemplate("{{.Username}}.box"); err == nil {
+		t.Errorf("Expected an unknown field to be refused")
+	}
+
+	manager := newTestManager(t, func(c *internal.Config) {
+		c.NodeName = "node1"
+		c.VMHostname = "{{.User}}.{{.Node}}.box"
+		c.VMHosts = "hypervisor"
+	})
+	vm, err := manager.GetOrCreateVM(context.Background(), "Alice_B", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), "Alice_B")
+	if got := manager.hostnameOf(vm); got != "Alice-B.node1.box" {
+		t.Errorf("Expected hostname Alice-B.node1.box, got %q", got)
+	}
+	if err := manager.writeGuestHosts(context.Background(), vm); err != nil {
+		t.Errorf("Failed to update the guest's hosts file: %v", err)
+	}
+}
+
+func TestHostsCommand(t *testing.T) {
+	got := hostsCommand("alice.box", net.ParseIP("192.168.100.1"), []string{"hypervisor", "hv.local"})
+	want := `sed -i '/ # ssh-hypervisor$/d' /etc/hosts && printf '%s\n' ` +
+		`'127.0.1.1 alice.box alice # ssh-hypervisor' '192.168.100.1 hypervisor hv.local # ssh-hypervisor' >> /etc/hosts`
+	if got != want {
+		t.Errorf("Unexpected hosts command:\n got: %s\nwant: %s", got, want)
+	}
+
+	got = hostsCommand("alice", net.ParseIP("192.168.100.1"), nil)
+	if strings.Contains(got, "192.168.100.1") || !strings.Contains(got, "'127.0.1.1 alice # ssh-hypervisor'") {
+		t.Errorf("Expected only the VM's own hostname, got: %s", got)
+	}
+}
@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/cas"
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+	"github.com/ekzhang/ssh-hypervisor/internal/objstore"
+)
+
+// imageRecord is the file in a VM's data directory naming the catalog image
+// it was created from, so it keeps booting that image
+const imageRecord = "image"
+
+// loadImages reads the image catalog, downloading images in object storage
+// to the image cache and checking each rootfs against its checksum. Images
+// from object storage and kernels are kept in the content store, so a new
+// version never overwrites one that VMs are booting.
+func loadImages(config *internal.Config, store *cas.Store) ([]image.Image, error) {
+	images, err := image.LoadCatalog(config.Images)
+	if err != nil {
+		return nil, err
+	}
+	// Images removed from the catalog no longer hold on to their blobs
+	if err := store.Unref("catalog"); err != nil {
+		return nil, err
+	}
+	for i := range images {
+		img := &images[i]
+		sum := ""
+		if strings.HasPrefix(img.Rootfs, "s3://") {
+			path, err := objstore.Fetch(context.Background(), img.Rootfs, filepath.Join(config.DataDir, ImageCacheDir))
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch image %s: %w", img.Name, err)
+			}
+			if sum, err = store.Adopt(path); err != nil {
+				return nil, fmt.Errorf("failed to store image %s: %w", img.Name, err)
+			}
+			if err := store.Ref("catalog/images/"+img.Name, sum); err != nil {
+				return nil, err
+			}
+			img.Rootfs = store.Path(sum)
+		}
+		if _, err := os.Stat(img.Rootfs); err != nil {
+			return nil, fmt.Errorf("image %s: %w", img.Name, err)
+		}
+		if img.SHA256 != "" {
+			if sum == "" {
+				if sum, err = image.FileSHA256(img.Rootfs); err != nil {
+					return nil, fmt.Errorf("image %s: %w", img.Name, err)
+				}
+			}
+			if !strings.EqualFold(sum, img.SHA256) {
+				return nil, fmt.Errorf("image %s: rootfs %s has checksum %s, expected %s", img.Name, img.Rootfs, sum, img.SHA256)
+			}
+		}
+		if img.Kernel != "" {
+			digest, err := store.Import(img.Kernel)
+			if err != nil {
+				return nil, fmt.Errorf("image %s: %w", img.Name, err)
+			}
+			if err := store.Ref("catalog/kernels/"+img.Name, digest); err != nil {
+				return nil, err
+			}
+			img.Kernel = store.Path(digest)
+		}
+		if config.VMMaxMemory != 0 && img.Memory > config.VMMaxMemory {
+			return nil, fmt.Errorf("image %s: memory %d MB is more than the maximum of %d MB", img.Name, img.Memory, config.VMMaxMemory)
+		}
+	}
+	return images, nil
+}
+
+// Images returns the image catalog, with the default image first, or nil
+// if VMs all boot the same rootfs
+func (m *Manager) Images() []image.Image {
+	return m.images
+}
+
+// findImage returns the catalog image with a name
+func (m *Manager) findImage(name string) (*image.Image, bool) {
+	for i := range m.images {
+		if m.images[i].Name == name {
+			return &m.images[i], true
+		}
+	}
+	return nil, false
+}
+
+// VMImage returns the name of the catalog image a VM boots, or "" if none
+// was chosen yet. VMs with disks from before the catalog boot the default.
+func (m *Manager) VMImage(vmID string) string {
+	if len(m.images) == 0 || validateVMID(vmID) != nil {
+		return ""
+	}
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if data, err := os.ReadFile(filepath.Join(vmDataDir, imageRecord)); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if len(diskFiles(vmDataDir)) > 0 {
+		return m.images[0].Name
+	}
+	return ""
+}
+
+// SetVMImage chooses the catalog image a new VM boots. A VM's image can't be
+// changed once chosen, since its disk was made from it.
+func (m *Manager) SetVMImage(vmID, name string) error {
+	if err := validateVMID(vmID); err != nil {
+		return err
+	}
+	if _, ok := m.findImage(name); !ok {
+		return fmt.Errorf("unknown image %q", name)
+	}
+	if current := m.VMImage(vmID); current != "" && current != name {
+		return fmt.Errorf("VM %s already boots image %s", vmID, current)
+	}
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM data directory: %w", err)
+	}
+	return os.WriteFile(filepath.Join(vmDataDir, imageRecord), []byte(name+"\n"), 0644)
+}
+
+// vmConfig returns the config a VM boots with, which is the server's config
+// with its image's defaults filled in, along with the image. The image is
+// nil without a catalog.
+func (m *Manager) vmConfig(vmID string) (*internal.Config, *image.Image) {
+	if len(m.images) == 0 {
+		return m.config, nil
+	}
+	img, ok := m.findImage(m.VMImage(vmID))
+	if !ok {
+		// Like an image removed from the catalog
+		img = &m.images[0]
+	}
+	config := *m.config
+	config.Rootfs = img.Rootfs
+	if img.Memory != 0 {
+		config.VMMemory = img.Memory
+	}
+	if img.CPUs != 0 {
+		config.VMCPUs = img.CPUs
+	}
+	if img.Disk != 0 {
+		config.OverlaySize = img.Disk
+	}
+	return &config, img
+}
+
+// recordImage remembers the image a VM is being created from, if it wasn't
+// chosen, so a later change to the catalog's default doesn't apply to it
+func (m *Manager) recordImage(vmID string, img *image.Image) error {
+	if img == nil {
+		return nil
+	}
+	path := filepath.Join(m.config.DataDir, vmID, imageRecord)
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(img.Name+"\n"), 0644)
+}
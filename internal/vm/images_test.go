@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+	"github.com/sirupsen/logrus"
+)
+
+func TestImageCatalog(t *testing.T) {
+	imagesDir := t.TempDir()
+	os.WriteFile(filepath.Join(imagesDir, "alpine.ext4"), []byte("alpine rootfs"), 0644)
+	os.WriteFile(filepath.Join(imagesDir, "python.ext4"), []byte("python rootfs"), 0644)
+	sum, _ := image.FileSHA256(filepath.Join(imagesDir, "python.ext4"))
+	catalog := filepath.Join(imagesDir, "images.json")
+	os.WriteFile(catalog, []byte(fmt.Sprintf(`[
+		{"name": "alpine", "rootfs": "alpine.ext4"},
+		{"name": "python", "rootfs": "python.ext4", "sha256": %q, "memory": 512, "cpus": 2}
+	]`, sum)), 0644)
+
+	manager := newTestManager(t, func(c *internal.Config) {
+		c.Rootfs = ""
+		c.Images = catalog
+	})
+	tempDir := manager.config.DataDir
+	if len(manager.Images()) != 2 {
+		t.Fatalf("Expected 2 images, got %v", manager.Images())
+	}
+
+	if got := manager.VMImage("alice"); got != "" {
+		t.Errorf("Expected a new VM to have no image, got %q", got)
+	}
+	if err := manager.SetVMImage("alice", "ruby"); err == nil {
+		t.Errorf("Expected an unknown image to be refused")
+	}
+	if err := manager.SetVMImage("alice", "python"); err != nil {
+		t.Fatalf("Failed to set image: %v", err)
+	}
+
+	ctx := context.Background()
+	alice, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if alice.config.VMMemory != 512 || alice.config.VMCPUs != 2 || alice.config.Rootfs != filepath.Join(imagesDir, "python.ext4") {
+		t.Errorf("Expected python's defaults, got memory %d, CPUs %d, rootfs %s", alice.config.VMMemory, alice.config.VMCPUs, alice.config.Rootfs)
+	}
+	if data, _ := os.ReadFile(filepath.Join(tempDir, "alice", "rootfs.img")); string(data) != "python rootfs" {
+		t.Errorf("Expected the python rootfs to be copied, got %q", data)
+	}
+	if manager.Memory("alice") != 512 {
+		t.Errorf("Expected 512 MB of memory, got %d", manager.Memory("alice"))
+	}
+	if err := manager.SetVMImage("alice", "alpine"); err == nil {
+		t.Errorf("Expected changing a VM's image to be refused")
+	}
+
+	// VMs that never chose get the default, and keep it
+	bob, err := manager.GetOrCreateVM(ctx, "bob", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if bob.config.VMMemory != 128 || manager.VMImage("bob") != "alpine" {
+		t.Errorf("Expected the default image with the server's memory, got %s with %d MB", manager.VMImage("bob"), bob.config.VMMemory)
+	}
+	manager.ReleaseVM(ctx, "alice")
+	manager.ReleaseVM(ctx, "bob")
+
+	// A rootfs that doesn't match its checksum is refused
+	os.WriteFile(filepath.Join(imagesDir, "python.ext4"), []byte("tampered"), 0644)
+	if _, err := NewManagerWithBackend(manager.config, logrus.NewEntry(logrus.StandardLogger()), NewFakeBackend(0)); err == nil {
+		t.Errorf("Expected a checksum mismatch to fail")
+	}
+}
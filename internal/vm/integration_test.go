@@ -51,7 +51,7 @@ func TestVMIntegrationWithRealBinaries(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	vm, err := manager.GetOrCreateVM(ctx, vmID)
+	vm, err := manager.GetOrCreateVM(ctx, vmID, nil)
 	if err != nil {
 		t.Fatalf("VM creation failed with minimal test setup: %v", err)
 	}
@@ -70,7 +70,7 @@ func TestVMIntegrationWithRealBinaries(t *testing.T) {
 		}
 
 		// Stop the VM
-		if err := vm.Stop(); err != nil {
+		if err := vm.Stop(context.Background()); err != nil {
 			t.Errorf("Failed to stop VM: %v", err)
 		}
 	}
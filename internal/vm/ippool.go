@@ -1,70 +1,278 @@
 package vm
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 )
 
-// IPPool manages allocation of IP addresses for VMs
+// MaxPoolSize is the most addresses an IPPool can hold across all its
+// networks, since each VM's allocation index must fit in a TAP device name
+const MaxPoolSize = 1 << 20
+
+// IPPool manages allocation of IP addresses for VMs from one or more networks.
+// Each VM is bound to the address it last used, which it gets again whenever
+// that address is free.
 type IPPool struct {
-	network   *net.IPNet
-	allocated map[string]bool
-	available []net.IP
+	ranges    []ipRange
+	size      int               // Usable addresses across all ranges
+	allocated map[uint32]string // Allocated address to the VM holding it ("" if anonymous)
+	bindings  map[string]uint32 // VM ID to the address it last used
+	boundTo   map[uint32]string // Address to the VM bound to it, the inverse of bindings
+	full      int               // Allocation index below which every address is allocated
+	stateFile string            // Where allocations are persisted, empty if they aren't
 	mu        sync.Mutex
 }
 
-// NewIPPool creates a new IP pool from the given network
-func NewIPPool(network *net.IPNet) (*IPPool, error) {
+// ipRange is the usable addresses of one network in a pool, which are all
+// but the network address, the gateway (network + 1), and the broadcast address
+type ipRange struct {
+	network *net.IPNet
+	first   uint32 // First usable address, network + 2
+	count   int    // Number of usable addresses
+	offset  int    // Allocation index of the first usable address
+}
+
+// ipPoolState is the persisted form of an IPPool
+type ipPoolState struct {
+	Allocated map[string]string `json:"allocated"`
+	Bindings  map[string]string `json:"bindings"`
+}
+
+// NewIPPool creates a new IP pool from the given IPv4 networks, which must
+// not overlap
+func NewIPPool(networks ...*net.IPNet) (*IPPool, error) {
 	pool := &IPPool{
-		network:   network,
-		allocated: make(map[string]bool),
-		available: make([]net.IP, 0),
+		allocated: make(map[uint32]string),
+		bindings:  make(map[string]uint32),
+		boundTo:   make(map[uint32]string),
 	}
 
-	// Generate all usable IPs in the network
-	// Skip network address, gateway (.1), and broadcast address
-	for ip := network.IP.Mask(network.Mask); network.Contains(ip); inc(ip) {
-		if !ip.Equal(network.IP) && !isBroadcast(ip, network) && !isGateway(ip, network) {
-			pool.available = append(pool.available, copyIP(ip))
+	for _, network := range networks {
+		if network.IP.To4() == nil {
+			return nil, fmt.Errorf("network %s is not IPv4", network)
 		}
+		ones, bits := network.Mask.Size()
+		count := (1 << (bits - ones)) - 3
+		if count <= 0 {
+			return nil, fmt.Errorf("no available IP addresses in network %s", network.String())
+		}
+		for _, r := range pool.ranges {
+			if r.network.Contains(network.IP) || network.Contains(r.network.IP) {
+				return nil, fmt.Errorf("networks %s and %s overlap", r.network, network)
+			}
+		}
+		pool.ranges = append(pool.ranges, ipRange{
+			network: network,
+			first:   ipToUint32(network.IP.Mask(network.Mask)) + 2,
+			count:   count,
+			offset:  pool.size,
+		})
+		pool.size += count
 	}
 
-	if len(pool.available) == 0 {
-		return nil, fmt.Errorf("no available IP addresses in network %s", network.String())
+	if pool.size == 0 {
+		return nil, fmt.Errorf("no networks for IP pool")
+	}
+	if pool.size > MaxPoolSize {
+		return nil, fmt.Errorf("IP pool has %d addresses, more than the maximum of %d", pool.size, MaxPoolSize)
 	}
-
 	return pool, nil
 }
 
-// Allocate allocates an IP address from the pool
+// rangeOf returns the range a usable address is in
+func (p *IPPool) rangeOf(addr uint32) (ipRange, bool) {
+	for _, r := range p.ranges {
+		if addr >= r.first && addr < r.first+uint32(r.count) {
+			return r, true
+		}
+	}
+	return ipRange{}, false
+}
+
+// addrAt returns the address with the given allocation index
+func (p *IPPool) addrAt(index int) uint32 {
+	for _, r := range p.ranges {
+		if index < r.offset+r.count {
+			return r.first + uint32(index-r.offset)
+		}
+	}
+	panic("vm: IP pool index out of range")
+}
+
+// Index returns the allocation index of an address in the pool, which is
+// unique across all of its networks and less than MaxPoolSize
+func (p *IPPool) Index(ip net.IP) (int, bool) {
+	addr, ok := parseIPv4(ip)
+	if !ok {
+		return 0, false
+	}
+	r, ok := p.rangeOf(addr)
+	if !ok {
+		return 0, false
+	}
+	return r.offset + int(addr-r.first), true
+}
+
+// Persist loads allocations saved at path and saves every change there from
+// now on. Saved allocations are kept only for VMs that alive reports are
+// still running, so addresses of VMs that outlived a restart aren't reused.
+func (p *IPPool) Persist(path string, alive func(vmID string) bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read IP allocations: %w", err)
+	}
+	if err == nil {
+		var state ipPoolState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse IP allocations: %w", err)
+		}
+		// Addresses outside the pool's current networks are dropped
+		for vmID, ipStr := range state.Bindings {
+			if addr, ok := p.parseUsable(ipStr); ok {
+				p.bind(vmID, addr)
+			}
+		}
+		for ipStr, vmID := range state.Allocated {
+			if addr, ok := p.parseUsable(ipStr); ok && vmID != "" && alive(vmID) {
+				p.allocated[addr] = vmID
+			}
+		}
+	}
+
+	p.stateFile = path
+	return p.save()
+}
+
+// parseUsable parses an address, reporting whether it is usable in the pool
+func (p *IPPool) parseUsable(ipStr string) (uint32, bool) {
+	addr, ok := parseIPv4(net.ParseIP(ipStr))
+	if !ok {
+		return 0, false
+	}
+	_, ok = p.rangeOf(addr)
+	return addr, ok
+}
+
+// save writes allocations to the state file, if the pool is persisted. The
+// caller must hold p.mu.
+func (p *IPPool) save() error {
+	if p.stateFile == "" {
+		return nil
+	}
+	state := ipPoolState{Allocated: make(map[string]string), Bindings: make(map[string]string)}
+	for addr, vmID := range p.allocated {
+		state.Allocated[uint32ToIP(addr).String()] = vmID
+	}
+	for vmID, addr := range p.bindings {
+		state.Bindings[vmID] = uint32ToIP(addr).String()
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save IP allocations: %w", err)
+	}
+	if err := os.Rename(tmp, p.stateFile); err != nil {
+		return fmt.Errorf("failed to save IP allocations: %w", err)
+	}
+	return nil
+}
+
+// Allocate allocates an IP address from the pool without binding it to a VM
 func (p *IPPool) Allocate() (net.IP, error) {
+	return p.AllocateFor("")
+}
+
+// AllocateFor allocates an IP address for a VM. It prefers the address the VM
+// last used, then addresses no other VM is bound to, and only then takes over
+// another VM's binding.
+func (p *IPPool) AllocateFor(vmID string) (net.IP, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for i, ip := range p.available {
-		ipStr := ip.String()
-		if !p.allocated[ipStr] {
-			p.allocated[ipStr] = true
-			return ip, nil
+	addr, ok := p.pick(vmID)
+	if !ok {
+		return nil, ErrIPExhausted
+	}
+
+	p.allocated[addr] = vmID
+	if vmID != "" {
+		p.bind(vmID, addr)
+	}
+	if err := p.save(); err != nil {
+		delete(p.allocated, addr)
+		return nil, err
+	}
+	return uint32ToIP(addr), nil
+}
+
+// pick chooses a free address for a VM. The caller must hold p.mu.
+func (p *IPPool) pick(vmID string) (uint32, bool) {
+	if bound, ok := p.bindings[vmID]; ok && vmID != "" {
+		if _, taken := p.allocated[bound]; !taken {
+			return bound, true
 		}
+	}
 
-		// If we've reached the end, no IPs available
-		if i == len(p.available)-1 {
-			break
+	var fallback uint32
+	var found bool
+	for i := p.full; i < p.size; i++ {
+		addr := p.addrAt(i)
+		if _, taken := p.allocated[addr]; taken {
+			if !found && i == p.full {
+				p.full++
+			}
+			continue
+		}
+		if _, bound := p.boundTo[addr]; !bound {
+			return addr, true
+		}
+		if !found {
+			fallback, found = addr, true
 		}
 	}
+	return fallback, found
+}
 
-	return nil, fmt.Errorf("no available IP addresses")
+// bind records that a VM uses an address, replacing both the VM's previous
+// binding and any other VM's binding to the address. The caller must hold p.mu.
+func (p *IPPool) bind(vmID string, addr uint32) {
+	if old, ok := p.bindings[vmID]; ok {
+		delete(p.boundTo, old)
+	}
+	if other, ok := p.boundTo[addr]; ok {
+		delete(p.bindings, other)
+	}
+	p.bindings[vmID] = addr
+	p.boundTo[addr] = vmID
 }
 
-// Release releases an IP address back to the pool
+// Release releases an IP address back to the pool. The VM keeps its binding
+// so it gets the same address next time.
 func (p *IPPool) Release(ip net.IP) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	ipStr := ip.String()
-	delete(p.allocated, ipStr)
+	addr, ok := parseIPv4(ip)
+	if !ok {
+		return
+	}
+	delete(p.allocated, addr)
+	if r, ok := p.rangeOf(addr); ok {
+		p.full = min(p.full, r.offset+int(addr-r.first))
+	}
+	// A failed save only leaves a stale allocation, which is dropped on the
+	// next restart since its VM isn't running
+	p.save()
 }
 
 // IsAllocated checks if an IP address is allocated
@@ -72,7 +280,12 @@ func (p *IPPool) IsAllocated(ip net.IP) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	return p.allocated[ip.String()]
+	addr, ok := parseIPv4(ip)
+	if !ok {
+		return false
+	}
+	_, allocated := p.allocated[addr]
+	return allocated
 }
 
 // Available returns the number of available IP addresses
@@ -80,68 +293,56 @@ func (p *IPPool) Available() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	return len(p.available) - len(p.allocated)
+	return p.size - len(p.allocated)
 }
 
-// Gateway returns the gateway IP address (network + 1) for this network
-func (p *IPPool) Gateway() net.IP {
-	gateway := make(net.IP, len(p.network.IP))
-	copy(gateway, p.network.IP.Mask(p.network.Mask))
-
-	// Increment by 1 to get the first host address (gateway)
-	inc(gateway)
-
-	return gateway
+// Size returns the number of addresses in the pool
+func (p *IPPool) Size() int {
+	return p.size
 }
 
-// Netmask returns the subnet mask (e.g. 255.255.255.0) for this network
-func (p *IPPool) Netmask() net.IP {
-	return net.IP(p.network.Mask)
+// Networks returns the networks addresses are allocated from
+func (p *IPPool) Networks() []*net.IPNet {
+	networks := make([]*net.IPNet, len(p.ranges))
+	for i, r := range p.ranges {
+		networks[i] = r.network
+	}
+	return networks
 }
 
-// MaskSize returns the number of bits in the network mask (e.g. 24 for /24)
-func (p *IPPool) MaskSize() int {
-	maskSize, _ := p.network.Mask.Size()
-	return maskSize
+// Gateway returns the gateway IP address (network + 1) of a network
+func Gateway(network *net.IPNet) net.IP {
+	return uint32ToIP(ipToUint32(network.IP.Mask(network.Mask)) + 1)
 }
 
-// inc increments an IP address
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// GatewayFor returns the gateway and subnet mask of the network an allocated
+// address is in
+func (p *IPPool) GatewayFor(ip net.IP) (gateway, netmask net.IP) {
+	addr, _ := parseIPv4(ip)
+	r, ok := p.rangeOf(addr)
+	if !ok {
+		return nil, nil
 	}
+	return Gateway(r.network), net.IP(r.network.Mask)
 }
 
-// copyIP creates a copy of an IP address
-func copyIP(ip net.IP) net.IP {
-	dup := make(net.IP, len(ip))
-	copy(dup, ip)
-	return dup
-}
-
-// isBroadcast checks if an IP is the broadcast address for the network
-func isBroadcast(ip net.IP, network *net.IPNet) bool {
-	broadcast := make(net.IP, len(network.IP))
-	copy(broadcast, network.IP)
-
-	// Set all host bits to 1
-	for i := 0; i < len(broadcast); i++ {
-		broadcast[i] |= ^network.Mask[i]
+// parseIPv4 converts an IPv4 address to an integer
+func parseIPv4(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
 	}
-
-	return ip.Equal(broadcast)
+	return ipToUint32(ip4), true
 }
 
-// isGateway checks if an IP is the gateway address (network + 1) for the network
-func isGateway(ip net.IP, network *net.IPNet) bool {
-	gateway := make(net.IP, len(network.IP))
-	copy(gateway, network.IP.Mask(network.Mask))
-
-	// Increment by 1 to get the first host address (gateway)
-	inc(gateway)
+// ipToUint32 converts an IPv4 address to an integer
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
 
-	return ip.Equal(gateway)
+// uint32ToIP converts an integer to an IPv4 address
+func uint32ToIP(addr uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip
 }
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
 )
 
@@ -133,3 +134,162 @@ func TestIPPoolInvalidNetwork(t *testing.T) {
 		t.Errorf("Expected error when creating pool with /31 network")
 	}
 }
+
+func TestIPPoolBindings(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.100.0/28")
+	pool, err := NewIPPool(network)
+	if err != nil {
+		t.Fatalf("Failed to create IP pool: %v", err)
+	}
+
+	alice, _ := pool.AllocateFor("alice")
+	bob, _ := pool.AllocateFor("bob")
+	pool.Release(alice)
+	pool.Release(bob)
+
+	// New VMs avoid addresses bound to others, and VMs get theirs back
+	carol, _ := pool.AllocateFor("carol")
+	if carol.Equal(alice) || carol.Equal(bob) {
+		t.Errorf("Expected carol to get an unbound address, got %s", carol)
+	}
+	if ip, _ := pool.AllocateFor("bob"); !ip.Equal(bob) {
+		t.Errorf("Expected bob to get %s again, got %s", bob, ip)
+	}
+	if ip, _ := pool.AllocateFor("alice"); !ip.Equal(alice) {
+		t.Errorf("Expected alice to get %s again, got %s", alice, ip)
+	}
+
+	// Once every address is bound, free ones are taken over
+	for pool.Available() > 0 {
+		if _, err := pool.Allocate(); err != nil {
+			t.Fatalf("Failed to allocate: %v", err)
+		}
+	}
+	pool.Release(alice)
+	if ip, _ := pool.AllocateFor("dave"); !ip.Equal(alice) {
+		t.Errorf("Expected dave to take over %s, got %s", alice, ip)
+	}
+	if _, err := pool.AllocateFor("alice"); err != ErrIPExhausted {
+		t.Errorf("Expected exhausted pool, got %v", err)
+	}
+}
+
+func TestIPPoolPersist(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.100.0/28")
+	path := filepath.Join(t.TempDir(), "ip_allocations.json")
+	running := map[string]bool{"alice": true}
+	alive := func(vmID string) bool { return running[vmID] }
+
+	pool, _ := NewIPPool(network)
+	if err := pool.Persist(path, alive); err != nil {
+		t.Fatalf("Failed to persist pool: %v", err)
+	}
+	alice, _ := pool.AllocateFor("alice")
+	bob, _ := pool.AllocateFor("bob")
+
+	// After a restart, only VMs still running keep their allocation
+	restarted, _ := NewIPPool(network)
+	if err := restarted.Persist(path, alive); err != nil {
+		t.Fatalf("Failed to load pool: %v", err)
+	}
+	if !restarted.IsAllocated(alice) {
+		t.Errorf("Expected running VM's address %s to stay allocated", alice)
+	}
+	if restarted.IsAllocated(bob) {
+		t.Errorf("Expected stopped VM's address %s to be released", bob)
+	}
+	if ip, _ := restarted.AllocateFor("bob"); !ip.Equal(bob) {
+		t.Errorf("Expected bob's binding to %s to survive a restart, got %s", bob, ip)
+	}
+}
+
+func TestIPPoolMultipleNetworks(t *testing.T) {
+	_, large, _ := net.ParseCIDR("10.20.0.0/16")
+	_, small, _ := net.ParseCIDR("192.168.100.0/28")
+
+	pool, err := NewIPPool(large, small)
+	if err != nil {
+		t.Fatalf("Failed to create IP pool: %v", err)
+	}
+	if pool.Available() != 65533+13 {
+		t.Errorf("Expected %d available IPs, got %d", 65533+13, pool.Available())
+	}
+
+	// Addresses past the last octet get distinct indexes, continuing into the next network
+	for _, tc := range []struct {
+		ip    string
+		index int
+	}{
+		{"10.20.0.2", 0},
+		{"10.20.1.2", 256},
+		{"10.20.255.254", 65532},
+		{"192.168.100.2", 65533},
+		{"192.168.100.14", 65545},
+	} {
+		index, ok := pool.Index(net.ParseIP(tc.ip))
+		if !ok || index != tc.index {
+			t.Errorf("Index(%s) = %d, %v; expected %d", tc.ip, index, ok, tc.index)
+		}
+	}
+	for _, ip := range []string{"10.20.0.1", "10.20.255.255", "192.168.100.15", "10.21.0.2"} {
+		if _, ok := pool.Index(net.ParseIP(ip)); ok {
+			t.Errorf("Index(%s) should not be in the pool", ip)
+		}
+	}
+
+	gateway, netmask := pool.GatewayFor(net.ParseIP("192.168.100.7"))
+	if gateway.String() != "192.168.100.1" || netmask.String() != "255.255.255.240" {
+		t.Errorf("Expected gateway 192.168.100.1/255.255.255.240, got %s/%s", gateway, netmask)
+	}
+
+	// Once the first network is full, allocations come from the second
+	for i := 0; i < 65533; i++ {
+		if _, err := pool.Allocate(); err != nil {
+			t.Fatalf("Failed to allocate IP %d: %v", i, err)
+		}
+	}
+	ip, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Failed to allocate IP: %v", err)
+	}
+	if !small.Contains(ip) {
+		t.Errorf("Expected IP from %s, got %s", small, ip)
+	}
+
+	if _, err := NewIPPool(large, large); err == nil {
+		t.Error("Expected error for overlapping networks")
+	}
+}
+
+func TestTAPAndMACNames(t *testing.T) {
+	if name := tapDeviceName(MaxPoolSize - 1); len(name) > 15 {
+		t.Errorf("TAP device name %q is longer than 15 characters", name)
+	}
+	if tapDeviceName(256) == tapDeviceName(1) {
+		t.Error("TAP device names should differ")
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		mac    string
+	}{
+		{"", "02:fc:00:01:02:03"},
+		{"0a", "0a:00:00:01:02:03"},
+		{"02:AB:CD", "02:ab:cd:01:02:03"},
+	} {
+		prefix, err := ParseMACPrefix(tc.prefix)
+		if err != nil {
+			t.Fatalf("Failed to parse MAC prefix %q: %v", tc.prefix, err)
+		}
+		if mac := macAddress(prefix, 0x10203); mac != tc.mac {
+			t.Errorf("Expected MAC %s with prefix %q, got %s", tc.mac, tc.prefix, mac)
+		}
+	}
+
+	// Prefixes must be locally administered unicast and leave room for the index
+	for _, prefix := range []string{"00:FC", "03:FC", "02:FC:00:00", "2:FC", "02-FC", "zz"} {
+		if _, err := ParseMACPrefix(prefix); err == nil {
+			t.Errorf("Expected error for MAC prefix %q", prefix)
+		}
+	}
+}
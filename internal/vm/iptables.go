@@ -2,11 +2,69 @@ package vm
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// egressChain holds the rules blocking outbound traffic from VMs by port
+const egressChain = "SSHVM-EGRESS"
+
+// rejectRule returns the rulespec rejecting traffic matched by a port rule
+func rejectRule(rule PortRule) []string {
+	reject := "icmp-port-unreachable"
+	if rule.Proto == "tcp" {
+		reject = "tcp-reset"
+	}
+	return []string{"-p", rule.Proto, "--dport", rule.Ports.String(), "-j", "REJECT", "--reject-with", reject}
+}
+
+// hostProtectionRules returns the rules keeping VMs from opening connections
+// to the host's management ports, like its sshd and the hypervisor's own
+// listeners, as (table, chain, rulespec) triples
+func (m *Manager) hostProtectionRules() [][]string {
+	var rules [][]string
+	for _, port := range m.hostPorts() {
+		// iptables -I INPUT -i sshvm-br0 -p tcp --dport 22 -m conntrack --ctstate NEW -j REJECT -m comment --comment "ssh-hypervisor"
+		rules = append(rules, []string{"filter", "INPUT", "-i", m.bridgeName, "-p", "tcp", "--dport", strconv.Itoa(port), "-m", "conntrack", "--ctstate", "NEW", "-j", "REJECT", "--reject-with", "tcp-reset", "-m", "comment", "--comment", "ssh-hypervisor"})
+	}
+	return rules
+}
+
+// setupHostProtection inserts the host protection rules
+func (m *Manager) setupHostProtection() error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+
+	for _, rule := range m.hostProtectionRules() {
+		if err := ipt.Insert(rule[0], rule[1], 1, rule[2:]...); err != nil {
+			return fmt.Errorf("failed to add INPUT rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// hostPorts returns the host TCP ports VMs may not connect to
+func (m *Manager) hostPorts() []int {
+	ports := []int{22}
+	if m.config.Port != 0 && m.config.Port != 22 {
+		ports = append(ports, m.config.Port)
+	}
+	if m.config.WebSocketPort != 0 {
+		ports = append(ports, m.config.WebSocketPort)
+	}
+	if _, port, err := net.SplitHostPort(m.config.HTTPAddr); err == nil {
+		if n, err := strconv.Atoi(port); err == nil && n != 0 {
+			ports = append(ports, n)
+		}
+	}
+	return ports
+}
+
 // cleanupIptablesRules removes any existing iptables rules with the "ssh-hypervisor" comment
 func cleanupIptablesRules() error {
 	ipt, err := iptables.New()
@@ -19,11 +77,29 @@ func cleanupIptablesRules() error {
 		return fmt.Errorf("failed to clean up FORWARD rules: %w", err)
 	}
 
+	// Clean up INPUT rules (host protection), the egress blocklist, and the
+	// traffic counters
+	if err := cleanupRulesWithComment(ipt, "filter", "INPUT"); err != nil {
+		return fmt.Errorf("failed to clean up INPUT rules: %w", err)
+	}
+	for _, chain := range []string{egressChain, trafficInChain, trafficOutChain} {
+		if exists, err := ipt.ChainExists("filter", chain); err == nil && exists {
+			if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+				return fmt.Errorf("failed to delete %s chain: %w", chain, err)
+			}
+		}
+	}
+
 	// Clean up NAT POSTROUTING rules
 	if err := cleanupRulesWithComment(ipt, "nat", "POSTROUTING"); err != nil {
 		return fmt.Errorf("failed to clean up POSTROUTING rules: %w", err)
 	}
 
+	// Clean up NAT PREROUTING rules (mosh relay)
+	if err := cleanupRulesWithComment(ipt, "nat", "PREROUTING"); err != nil {
+		return fmt.Errorf("failed to clean up PREROUTING rules: %w", err)
+	}
+
 	return nil
 }
 
@@ -54,6 +130,27 @@ func cleanupRulesWithComment(ipt *iptables.IPTables, table, chain string) error
 	return nil
 }
 
+// internetRules returns the rules giving VMs Internet access, as (table,
+// chain, rulespec) triples appended in order. The egress chain must exist.
+func (m *Manager) internetRules() [][]string {
+	var rules [][]string
+	for _, rule := range m.egressBlock {
+		// iptables -A SSHVM-EGRESS -p tcp --dport 25:25 -j REJECT --reject-with tcp-reset
+		rules = append(rules, append([]string{"filter", egressChain}, rejectRule(rule)...))
+	}
+	rules = append(rules,
+		// Outbound traffic passes through the egress blocklist before being accepted
+		[]string{"filter", "FORWARD", "-i", m.bridgeName, "!", "-o", m.bridgeName, "-j", egressChain, "-m", "comment", "--comment", "ssh-hypervisor"},
+		[]string{"filter", "FORWARD", "-i", m.bridgeName, "!", "-o", m.bridgeName, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"},
+		[]string{"filter", "FORWARD", "!", "-i", m.bridgeName, "-o", m.bridgeName, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"},
+	)
+	// NAT for each VM network
+	for _, vmNet := range m.ipPool.Networks() {
+		rules = append(rules, []string{"nat", "POSTROUTING", "-s", vmNet.String(), "!", "-o", m.bridgeName, "-j", "MASQUERADE", "-m", "comment", "--comment", "ssh-hypervisor"})
+	}
+	return rules
+}
+
 // setupIptablesRules configures the necessary iptables rules for VM networking
 func (m *Manager) setupIptablesRules() error {
 	ipt, err := iptables.New()
@@ -61,29 +158,72 @@ func (m *Manager) setupIptablesRules() error {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
-	// Get the VM network CIDR
-	vmNet, err := m.config.GetVMIPRange()
+	// iptables -N SSHVM-EGRESS
+	if err := ipt.ClearChain("filter", egressChain); err != nil {
+		return fmt.Errorf("failed to create %s chain: %w", egressChain, err)
+	}
+	for _, rule := range m.internetRules() {
+		if err := ipt.Append(rule[0], rule[1], rule[2:]...); err != nil {
+			return fmt.Errorf("failed to add %s rule: %w", rule[1], err)
+		}
+	}
+
+	m.logger.Infof("Configured iptables rules for bridge %s and networks %v", m.bridgeName, m.ipPool.Networks())
+	return nil
+}
+
+// moshRelayRules returns the iptables rules relaying a VM's UDP port block to
+// the same ports inside the VM, as (table, chain, rulespec) triples
+func (m *Manager) moshRelayRules(vm *VM) [][]string {
+	ports := vm.MoshPorts.String()
+	ip := vm.IP.String()
+	return [][]string{
+		{"nat", "PREROUTING", "!", "-i", m.bridgeName, "-p", "udp", "--dport", ports, "-j", "DNAT", "--to-destination", ip, "-m", "comment", "--comment", "ssh-hypervisor"},
+		{"filter", "FORWARD", "-d", ip, "-p", "udp", "--dport", ports, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"},
+		{"filter", "FORWARD", "-s", ip, "-p", "udp", "--sport", ports, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"},
+	}
+}
+
+// setupMoshRelay allocates a block of host UDP ports for a VM and forwards them into it
+func (m *Manager) setupMoshRelay(vm *VM) error {
+	ports, err := m.moshPool.Allocate()
 	if err != nil {
-		return fmt.Errorf("failed to get VM IP range: %w", err)
+		return err
 	}
+	vm.MoshPorts = ports
 
-	// Add FORWARD rules
-	// iptables -A FORWARD -i sshvm-br0 ! -o sshvm-br0 -j ACCEPT -m comment --comment "ssh-hypervisor"
-	if err := ipt.Append("filter", "FORWARD", "-i", m.bridgeName, "!", "-o", m.bridgeName, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"); err != nil {
-		return fmt.Errorf("failed to add FORWARD rule (outbound): %w", err)
+	ipt, err := iptables.New()
+	if err != nil {
+		m.moshPool.Release(ports)
+		vm.MoshPorts = PortRange{}
+		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
-	// iptables -A FORWARD ! -i sshvm-br0 -o sshvm-br0 -j ACCEPT -m comment --comment "ssh-hypervisor"
-	if err := ipt.Append("filter", "FORWARD", "!", "-i", m.bridgeName, "-o", m.bridgeName, "-j", "ACCEPT", "-m", "comment", "--comment", "ssh-hypervisor"); err != nil {
-		return fmt.Errorf("failed to add FORWARD rule (inbound): %w", err)
+	// iptables -t nat -A PREROUTING ! -i sshvm-br0 -p udp --dport <PORTS> -j DNAT --to-destination <VM_IP>
+	for _, rule := range m.moshRelayRules(vm) {
+		if err := ipt.Insert(rule[0], rule[1], 1, rule[2:]...); err != nil {
+			m.removeMoshRelay(vm)
+			m.moshPool.Release(ports)
+			vm.MoshPorts = PortRange{}
+			return fmt.Errorf("failed to add %s rule: %w", rule[1], err)
+		}
 	}
 
-	// Add NAT POSTROUTING rule
-	// iptables -t nat -A POSTROUTING -s <VM_CIDR> ! -o sshvm-br0 -j MASQUERADE -m comment --comment "ssh-hypervisor"
-	if err := ipt.Append("nat", "POSTROUTING", "-s", vmNet.String(), "!", "-o", m.bridgeName, "-j", "MASQUERADE", "-m", "comment", "--comment", "ssh-hypervisor"); err != nil {
-		return fmt.Errorf("failed to add POSTROUTING rule: %w", err)
+	vm.logger.Infof("Relaying UDP ports %s to VM for mosh", ports)
+	return nil
+}
+
+// removeMoshRelay deletes the iptables rules added by setupMoshRelay
+func (m *Manager) removeMoshRelay(vm *VM) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
-	m.logger.Infof("Configured iptables rules for bridge %s and network %s", m.bridgeName, vmNet.String())
+	for _, rule := range m.moshRelayRules(vm) {
+		if err := ipt.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+			return fmt.Errorf("failed to delete %s rule: %w", rule[1], err)
+		}
+	}
 	return nil
 }
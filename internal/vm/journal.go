@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Journal operations, in the order they happen to a VM. An intent is open
+// from journalCreate until journalDone, which is written once a VM has been
+// stopped or its creation failed and was rolled back.
+const (
+	journalCreate  = "create"  // Creation started
+	journalCopy    = "copy"    // Copying the rootfs to Path
+	journalIP      = "ip"      // Allocated IP
+	journalStarted = "started" // Machine running as PID
+	journalStop    = "stop"    // Stopping the machine
+	journalDone    = "done"    // Nothing left to roll back
+)
+
+// maxJournalLines is how long the journal grows before it is compacted to
+// the entries of open intents
+const maxJournalLines = 1000
+
+// orphanKillTimeout is how long recovery waits for a killed machine to exit
+const orphanKillTimeout = 5 * time.Second
+
+// journalEntry is a line of the journal
+type journalEntry struct {
+	Time time.Time `json:"time"`
+	VM   string    `json:"vm"`
+	Op   string    `json:"op"`
+	IP   string    `json:"ip,omitempty"`
+	PID  int       `json:"pid,omitempty"`
+	Path string    `json:"path,omitempty"`
+}
+
+// journal is a write-ahead log of VM lifecycle intents. Each entry is synced
+// to disk before the step it describes, so after a crash the manager knows
+// exactly which VMs were mid-creation or still running.
+type journal struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	open  map[string][]journalEntry // Entries of open intents by VM
+	lines int                       // Lines in the file
+}
+
+// openJournal reads the journal at path, creating it if needed
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path, open: make(map[string][]journalEntry)}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry journalEntry
+			// A line cut short by a crash is the only one that can be corrupt
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.VM == "" {
+				continue
+			}
+			j.apply(entry)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read journal: %w", err)
+		}
+	}
+
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// apply adds an entry to the open intents. The caller must hold j.mu.
+func (j *journal) apply(entry journalEntry) {
+	if entry.Op == journalDone {
+		delete(j.open, entry.VM)
+	} else {
+		j.open[entry.VM] = append(j.open[entry.VM], entry)
+	}
+}
+
+// record appends an entry and syncs it to disk
+func (j *journal) record(vmID, op string, entry journalEntry) error {
+	entry.Time = time.Now().UTC()
+	entry.VM = vmID
+	entry.Op = op
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.apply(entry)
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.lines++
+	if j.lines > maxJournalLines {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the entries of open intents and
+// reopens it for appending. The caller must hold j.mu, or be opening it.
+func (j *journal) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal.tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	lines := 0
+	w := bufio.NewWriter(tmp)
+	for _, entries := range j.open {
+		for _, entry := range entries {
+			data, _ := json.Marshal(entry)
+			w.Write(append(data, '\n'))
+			lines++
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, j.lines = f, lines
+	return nil
+}
+
+// pending returns the entries of open intents by VM
+func (j *journal) pending() map[string][]journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := make(map[string][]journalEntry, len(j.open))
+	for vmID, entries := range j.open {
+		pending[vmID] = append([]journalEntry(nil), entries...)
+	}
+	return pending
+}
+
+// journalRecord writes an entry of a VM's lifecycle to the journal, logging
+// failures, which only lose precision in recovery after a crash
+func (m *Manager) journalRecord(vmID, op string, entry journalEntry) {
+	if err := m.journal.record(vmID, op, entry); err != nil {
+		m.logger.Errorf("Failed to journal %s of VM %s: %v", op, vmID, err)
+	}
+}
+
+// recoverJournal resolves the intents left open by a previous run that
+// crashed. Machines it left running are killed, since their sessions are
+// gone and they can't be reattached, and half-finished creations are rolled
+// back. Users' disks are always kept.
+func recoverJournal(j *journal, dataDir string, logger logrus.FieldLogger) {
+	for vmID, entries := range j.pending() {
+		var pid int
+		var last string
+		var tmpFiles []string
+		for _, entry := range entries {
+			last = entry.Op
+			switch entry.Op {
+			case journalCopy:
+				tmpFiles = append(tmpFiles, entry.Path)
+			case journalStarted:
+				pid = entry.PID
+			}
+		}
+
+		vmDataDir := filepath.Join(dataDir, vmID)
+		pidFile := filepath.Join(vmDataDir, "firecracker.pid")
+		if pid > 0 && readPID(pidFile) == pid && processAlive(pidFile) {
+			logger.Warnf("Killing VM %s (PID %d) left running by a previous run", vmID, pid)
+			if err := killProcess(pid, orphanKillTimeout); err != nil {
+				// Keep the intent, so the next start tries again
+				logger.Errorf("Failed to kill VM %s: %v", vmID, err)
+				continue
+			}
+		} else {
+			logger.Warnf("Rolling back VM %s, interrupted after %s", vmID, last)
+		}
+
+		for _, path := range tmpFiles {
+			os.Remove(path)
+		}
+		os.Remove(filepath.Join(vmDataDir, "firecracker.sock"))
+		os.Remove(pidFile)
+		os.Remove(filepath.Join(vmDataDir, consoleFifo))
+		os.Remove(filepath.Join(vmDataDir, metricsFifo))
+		os.Remove(filepath.Join(vmDataDir, vmmLogFifo))
+		if err := j.record(vmID, journalDone, journalEntry{}); err != nil {
+			logger.Errorf("Failed to journal recovery of VM %s: %v", vmID, err)
+		}
+	}
+}
+
+// killProcess kills a process that isn't our child and waits until it has
+// exited, or until timeout
+func killProcess(pid int, timeout time.Duration) error {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %d did not exit", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournal(t *testing.T) {
+	manager := newTestManager(t)
+	config, tempDir := manager.config, manager.config.DataDir
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	ctx := context.Background()
+	if _, err := manager.GetOrCreateVM(ctx, "alice", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	ops := func() []string {
+		var ops []string
+		for _, entry := range manager.journal.pending()["alice"] {
+			ops = append(ops, entry.Op)
+		}
+		return ops
+	}
+	if got := fmt.Sprint(ops()); got != "[create ip copy started]" {
+		t.Errorf("Expected an open intent for the running VM, got %s", got)
+	}
+	if err := manager.ReleaseVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+	if got := ops(); len(got) != 0 {
+		t.Errorf("Expected no open intent after stopping, got %v", got)
+	}
+
+	// Simulate a crash that left bob's machine running and carol's rootfs
+	// copy half done
+	machine := exec.Command("sleep", "60")
+	if err := machine.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		machine.Wait()
+		close(exited)
+	}()
+	defer machine.Process.Kill()
+	os.MkdirAll(filepath.Join(tempDir, "bob"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "bob", "firecracker.pid"), fmt.Appendf(nil, "%d", machine.Process.Pid), 0644)
+	os.MkdirAll(filepath.Join(tempDir, "carol"), 0755)
+	partial := filepath.Join(tempDir, "carol", "rootfs.img.tmp-1")
+	os.WriteFile(partial, []byte("fake"), 0644)
+
+	j := manager.journal
+	j.record("bob", journalCreate, journalEntry{})
+	j.record("bob", journalStarted, journalEntry{PID: machine.Process.Pid})
+	j.record("carol", journalCreate, journalEntry{})
+	j.record("carol", journalCopy, journalEntry{Path: partial})
+
+	restarted, err := NewManagerWithBackend(config, logger, NewFakeBackend(0))
+	if err != nil {
+		t.Fatalf("Failed to restart VM manager: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the orphaned machine to be killed")
+	}
+	if fileExists(partial) {
+		t.Errorf("Expected the partial rootfs copy to be removed")
+	}
+	if fileExists(filepath.Join(tempDir, "bob", "firecracker.pid")) {
+		t.Errorf("Expected the orphan's PID file to be removed")
+	}
+	if pending := restarted.journal.pending(); len(pending) != 0 {
+		t.Errorf("Expected recovery to close all intents, got %v", pending)
+	}
+}
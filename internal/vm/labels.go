@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// labelsFile holds a VM's labels in its data directory, so they outlive
+// the VM and apply again whenever it starts
+const labelsFile = "labels.json"
+
+// maxLabelLength bounds label keys and values
+const maxLabelLength = 63
+
+// VMInfo describes a VM known to the manager, running or not
+type VMInfo struct {
+	ID         string            `json:"id"`
+	Running    bool              `json:"running"`
+	State      State             `json:"state"`
+	StateSince time.Time         `json:"state_since,omitzero"` // Zero for VMs stopped before this run
+	IP         string            `json:"ip,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// ValidateLabels checks that label keys are made of letters, digits, and
+// "-_./", and that values don't contain separators
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if key == "" || len(key) > maxLabelLength || strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./") != "" {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if len(value) > maxLabelLength || strings.ContainsAny(value, ",=\n") {
+			return fmt.Errorf("invalid value for label %s: %q", key, value)
+		}
+	}
+	return nil
+}
+
+// ParseSelector parses label constraints like "class=workshop-2024,team=a"
+func ParseSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, term := range strings.Split(s, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label selector %q, expected KEY=VALUE", term)
+		}
+		selector[key] = value
+	}
+	return selector, ValidateLabels(selector)
+}
+
+// MatchLabels reports whether labels have every key and value in selector,
+// where a value of "*" matches any value
+func MatchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || (v != value && value != "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// Labels returns a VM's labels, which are empty if none were set
+func (m *Manager) Labels(vmID string) (map[string]string, error) {
+	if err := validateVMID(vmID); err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(m.config.DataDir, vmID, labelsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return labels, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read labels: %w", err)
+	}
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("failed to parse labels of VM %s: %w", vmID, err)
+	}
+	return labels, nil
+}
+
+// SetLabels replaces a VM's labels. The VM doesn't need to be running.
+func (m *Manager) SetLabels(vmID string, labels map[string]string) error {
+	if err := validateVMID(vmID); err != nil {
+		return err
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return err
+	}
+
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM directory: %w", err)
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename, so readers never see a partial file
+	path := filepath.Join(vmDataDir, labelsFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write labels: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// MergeLabels adds labels to a VM, replacing existing values for the same keys
+func (m *Manager) MergeLabels(vmID string, labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	current, err := m.Labels(vmID)
+	if err != nil {
+		return err
+	}
+	for key, value := range labels {
+		current[key] = value
+	}
+	return m.SetLabels(vmID, current)
+}
+
+// ListVMs returns the running VMs, the VMs starting or stopping, and the
+// stopped VMs with labels, sorted by ID, keeping only those matching selector
+func (m *Manager) ListVMs(selector map[string]string) ([]VMInfo, error) {
+	m.mutex.RLock()
+	infos := make(map[string]*VMInfo, len(m.vms)+len(m.transitions))
+	for id, vm := range m.vms {
+		infos[id] = &VMInfo{ID: id, Running: true, State: vm.State(), StateSince: vm.StateSince(), IP: vm.IP.String()}
+	}
+	for id, t := range m.transitions {
+		if t.vm != nil {
+			infos[id] = &VMInfo{ID: id, State: t.vm.State(), StateSince: t.vm.StateSince()}
+		}
+	}
+	m.mutex.RUnlock()
+
+	entries, err := os.ReadDir(m.config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		if _, ok := infos[id]; ok || !entry.IsDir() || validateVMID(id) != nil {
+			continue
+		}
+		if fileExists(filepath.Join(m.config.DataDir, id, labelsFile)) {
+			infos[id] = &VMInfo{ID: id, State: StateStopped}
+		}
+	}
+
+	list := make([]VMInfo, 0, len(infos))
+	for id, info := range infos {
+		labels, err := m.Labels(id)
+		if err != nil {
+			m.logger.Warnf("Failed to read labels of VM %s: %v", id, err)
+			labels = map[string]string{}
+		}
+		info.Labels = labels
+		info.Image = m.VMImage(id)
+		if MatchLabels(labels, selector) {
+			list = append(list, *info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
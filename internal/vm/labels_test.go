@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+
+	// Labels can be set before a VM ever starts, and persist while it runs
+	if err := manager.SetLabels("alice", map[string]string{"class": "workshop-2024"}); err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	if err := manager.MergeLabels("alice", map[string]string{"team": "a"}); err != nil {
+		t.Fatalf("Failed to merge labels: %v", err)
+	}
+	if err := manager.SetLabels("bob", map[string]string{"class": "other"}); err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	alice, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(ctx, alice.ID)
+	carol, err := manager.GetOrCreateVM(ctx, "carol", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(ctx, carol.ID)
+
+	labels, err := manager.Labels("alice")
+	if err != nil || labels["class"] != "workshop-2024" || labels["team"] != "a" {
+		t.Errorf("Unexpected labels %v, %v", labels, err)
+	}
+
+	all, err := manager.ListVMs(nil)
+	if err != nil {
+		t.Fatalf("Failed to list VMs: %v", err)
+	}
+	if len(all) != 3 || all[0].ID != "alice" || !all[0].Running || all[0].State != StateBooting || all[1].ID != "bob" || all[1].Running || all[1].State != StateStopped || all[2].ID != "carol" {
+		t.Errorf("Unexpected VM list %+v", all)
+	}
+
+	selected, err := manager.ListVMs(map[string]string{"class": "workshop-2024"})
+	if err != nil {
+		t.Fatalf("Failed to list VMs: %v", err)
+	}
+	if len(selected) != 1 || selected[0].ID != "alice" || selected[0].IP != alice.IP.String() {
+		t.Errorf("Expected only alice to match, got %+v", selected)
+	}
+
+	for _, bad := range []map[string]string{{"": "x"}, {"a b": "x"}, {"class": "a,b"}} {
+		if err := manager.SetLabels("alice", bad); err == nil {
+			t.Errorf("Expected error for labels %v", bad)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("class=workshop-2024, team=a,")
+	if err != nil || len(selector) != 2 || selector["class"] != "workshop-2024" || selector["team"] != "a" {
+		t.Errorf("Unexpected selector %v, %v", selector, err)
+	}
+	if !MatchLabels(map[string]string{"class": "workshop-2024", "team": "a", "x": "y"}, selector) {
+		t.Errorf("Expected labels with extra keys to match")
+	}
+	if MatchLabels(map[string]string{"class": "workshop-2024"}, selector) {
+		t.Errorf("Expected labels missing a key not to match")
+	}
+	if !MatchLabels(map[string]string{"workshop": "2024"}, map[string]string{"workshop": "*"}) || MatchLabels(nil, map[string]string{"workshop": "*"}) {
+		t.Errorf("Expected * to match any value of a present label")
+	}
+	if _, err := ParseSelector("class"); err == nil {
+		t.Errorf("Expected error for selector without a value")
+	}
+}
@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logFilePattern matches per-VM log files and their rotated copies
+var logFilePattern = regexp.MustCompile(`^(console\.out|firecracker\.log|vmm\.log)(\.\d+)?$`)
+
+// vmmLogFifo is the named pipe in a VM's data directory that Firecracker
+// writes its own log to, which is copied into vmm.log
+const vmmLogFifo = "vmm.fifo"
+
+// openLogs opens the rotated console, VMM, and SDK log files for a VM, which
+// are closed by closeLogs once the VM has stopped. The guest's serial output
+// goes to the console log, and Firecracker's own messages to the VMM log.
+func (vm *VM) openLogs() (console io.Writer, vmm io.Writer, sdk *logrus.Entry, err error) {
+	maxSize := int64(vm.config.VMLogMaxSize) * 1024 * 1024
+
+	rotatingConsole, err := openRotatingWriter(filepath.Join(vm.dataDir, "console.out"), consoleLogSize(vm.config.VMLogMaxSize), vm.config.VMLogMaxFiles)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create console log: %w", err)
+	}
+	// A guest flooding its serial console would otherwise churn the disk
+	var consoleLog io.WriteCloser = rotatingConsole
+	if vm.config.ConsoleRate > 0 {
+		consoleLog = newConsoleWriter(rotatingConsole, vm.config.ConsoleRate*1024, vm.logger)
+	}
+
+	vmmLog, err := openRotatingWriter(filepath.Join(vm.dataDir, "vmm.log"), maxSize, vm.config.VMLogMaxFiles)
+	if err != nil {
+		consoleLog.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create VMM log: %w", err)
+	}
+
+	sdkLog, err := openRotatingWriter(filepath.Join(vm.dataDir, "firecracker.log"), maxSize, vm.config.VMLogMaxFiles)
+	if err != nil {
+		consoleLog.Close()
+		vmmLog.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create firecracker log: %w", err)
+	}
+
+	level, err := logrus.ParseLevel(vm.config.VMLogLevel)
+	if err != nil {
+		level = logrus.WarnLevel
+	}
+	sdkLogger := logrus.New()
+	sdkLogger.SetOutput(sdkLog)
+	sdkLogger.SetLevel(level)
+
+	vm.logClosers = []io.Closer{consoleLog, vmmLog, sdkLog}
+	return consoleLog, vmmLog, sdkLogger.WithField("vm_id", vm.ID), nil
+}
+
+// vmmLogLevel converts a logrus level to the matching Firecracker log level
+func vmmLogLevel(level string) string {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return "Warning"
+	}
+	switch parsed {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return "Error"
+	case logrus.WarnLevel:
+		return "Warning"
+	case logrus.InfoLevel:
+		return "Info"
+	case logrus.DebugLevel:
+		return "Debug"
+	default:
+		return "Trace"
+	}
+}
+
+// closeLogs closes the VM's log files, it is safe to call more than once
+func (vm *VM) closeLogs() {
+	for _, c := range vm.logClosers {
+		c.Close()
+	}
+	vm.logClosers = nil
+}
+
+// PruneLogs removes log files older than the retention period. Logs of
+// destroyed VMs are removed entirely, while running VMs only lose rotated files.
+func (m *Manager) PruneLogs(retention time.Duration) error {
+	entries, err := os.ReadDir(m.config.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		_, running := m.GetVM(entry.Name())
+
+		vmDir := filepath.Join(m.config.DataDir, entry.Name())
+		files, err := os.ReadDir(vmDir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			match := logFilePattern.FindStringSubmatch(file.Name())
+			if match == nil || (running && match[2] == "") {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(vmDir, file.Name())); err == nil {
+				m.logger.Debugf("Pruned old log file %s", filepath.Join(vmDir, file.Name()))
+			}
+		}
+	}
+
+	return nil
+}
@@ -5,18 +5,16 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
-	"syscall"
-	"time"
+	"text/template"
 
 	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/cas"
+	"github.com/ekzhang/ssh-hypervisor/internal/image"
+	"github.com/ekzhang/ssh-hypervisor/internal/objstore"
 	"github.com/firecracker-microvm/firecracker-go-sdk"
-	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/sirupsen/logrus"
 )
 
@@ -33,102 +31,292 @@ type VM struct {
 	Netmask    net.IP
 	SocketPath string
 	PIDFile    string
+	MoshPorts  PortRange   // UDP ports relayed to this VM (zero if disabled)
+	SharedDirs []SharedDir // Host directories mounted into this VM
 	config     *internal.Config
+	image      *image.Image
 	dataDir    string
 	logger     *logrus.Entry
+	backend    Backend
+	logClosers []io.Closer // Log files kept open while the VM runs
+	netDevice  string      // Host network device of the VM, like its TAP device ("" if none)
 
 	mutex   sync.Mutex // Protects machine after Start()
 	machine *firecracker.Machine
+
+	guestMu sync.Mutex // Protects guest
+	guest   *guestConn // Shared SSH connection to the guest, nil until first used
+
+	consoleMu sync.Mutex // Protects console
+	console   *os.File   // Serial input pipe, open while the VM runs
+
+	metricsMu sync.Mutex  // Protects metrics
+	metrics   *VMMMetrics // Totals of Firecracker's metrics flushes, nil until the first
+
+	trafficMu sync.Mutex // Protects traffic
+	traffic   Traffic    // Counters of the VM's traffic rules at the last count
+
+	postBoot sync.Once // Sets up the guest and runs the post-boot hook once it is first reachable
+
+	stopLifetime context.CancelFunc // Ends the context the VM was started with, once it has stopped
+
+	lifecycle lifecycle // State, which is ready once the guest was first reachable, when health checks start
+
+	exited  chan struct{} // Closed if the VMM exits without being stopped or the guest is found dead
+	exitErr error         // Why the VM exited, set before exited is closed
 }
 
 // Manager manages the lifecycle of Firecracker VMs
 type Manager struct {
-	config *internal.Config
+	config  *internal.Config
+	backend Backend
 
-	mutex  sync.RWMutex // Protects vms and vmRefs maps
-	vms    map[string]*VM
-	vmRefs map[string]int // Reference count for each VM
+	mutex       sync.RWMutex // Protects vms, vmRefs, transitions, and quarantined maps
+	vms         map[string]*VM
+	vmRefs      map[string]int         // Reference count for each VM
+	transitions map[string]*transition // VMs starting or stopping, or held stopped
 
 	ipPool     *IPPool
+	moshPool   *PortPool   // nil if mosh relay is disabled
+	sharedDirs []SharedDir // Host directories mounted into every VM
+	events     *EventLog
+	journal    *journal
+	storage    StorageDriver // Makes per-VM rootfs copies
+	images     []image.Image // Catalog of images VMs boot, nil if they all boot Rootfs
+	objects    ObjectStore   // Keeps disks and snapshots off the host, nil if disabled
+	artifacts  *cas.Store    // Content store of kernels, binaries, images, and snapshots
+	ioSlots    chan struct{} // Limits concurrent heavy disk IO, nil if unlimited
 	bridgeName string
+	macPrefix  net.HardwareAddr
+	masterKey  []byte // Key VM disks are encrypted at rest with, nil if they aren't
 	logger     logrus.FieldLogger
+	hostname   *template.Template // Renders guests' hostnames, nil to use the VM ID
+
+	metaMu sync.Mutex // Serializes updates of per-VM labels and memory size
+
+	exitMu    sync.Mutex // Protects exitHooks
+	exitHooks []ExitHook
+
+	admitMu     sync.Mutex // Protects admitChecks
+	admitChecks []AdmissionCheck
+
+	trafficMu    sync.Mutex // Protects trafficHooks
+	trafficHooks []TrafficHook
+
+	egressMu    sync.Mutex // Protects egressHooks
+	egressHooks []EgressHook
+	egressBlock []PortRule        // Outbound ports rejected by the firewall
+	quarantined map[string]string // VM ID to why its egress is blocked
+}
+
+// transition is a VM starting or stopping, or a stopped VM held while its
+// disk is used
+type transition struct {
+	done chan struct{} // Closed when the transition is over
+	vm   *VM           // The VM starting or stopping, nil for a held stopped VM
 }
 
-// NewManager creates a new VM manager
+// NewManager creates a new VM manager that runs VMs with Firecracker
 func NewManager(config *internal.Config, logger logrus.FieldLogger, firecrackerBinary []byte, vmlinuxBinary []byte) (*Manager, error) {
-	ipNet, err := config.GetVMIPRange()
+	return NewManagerWithBackend(config, logger, NewFirecrackerBackend(firecrackerBinary, vmlinuxBinary))
+}
+
+// NewManagerWithBackend creates a new VM manager that runs VMs with the given backend
+func NewManagerWithBackend(config *internal.Config, logger logrus.FieldLogger, backend Backend) (*Manager, error) {
+	ipNets, err := config.GetVMIPRanges()
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse VM IP range: %w", err)
 	}
 
-	ipPool, err := NewIPPool(ipNet)
+	// Resolve what a previous run left half done when it crashed, before
+	// anything else trusts the state of the data directory
+	journal, err := openJournal(filepath.Join(config.DataDir, "journal.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	recoverJournal(journal, config.DataDir, logger)
+
+	ipPool, err := NewIPPool(ipNets...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create IP pool: %w", err)
 	}
+	// Keep addresses of VMs still running from before a restart reserved
+	err = ipPool.Persist(filepath.Join(config.DataDir, "ip_allocations.json"), func(vmID string) bool {
+		return processAlive(filepath.Join(config.DataDir, vmID, "firecracker.pid"))
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	manager := &Manager{
-		config:     config,
-		vms:        make(map[string]*VM),
-		vmRefs:     make(map[string]int),
-		ipPool:     ipPool,
-		bridgeName: BridgeName,
-		logger:     logger,
-	}
-
-	// Write Firecracker binary to main data directory (shared across VMs)
-	firecrackerPath := filepath.Join(config.DataDir, "firecracker")
-	if _, err := os.Stat(firecrackerPath); os.IsNotExist(err) {
-		if err := os.WriteFile(firecrackerPath, firecrackerBinary, 0755); err != nil {
-			return nil, fmt.Errorf("failed to write firecracker binary: %w", err)
+	var moshPool *PortPool
+	if config.MoshPorts != "" {
+		ports, err := ParsePortRange(config.MoshPorts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse mosh port range: %w", err)
+		}
+		moshPool, err = NewPortPool(ports, config.MoshPortsPerVM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mosh port pool: %w", err)
 		}
 	}
 
-	// Write vmlinux kernel to main data directory (shared across VMs)
-	vmlinuxPath := filepath.Join(config.DataDir, "vmlinux")
-	if _, err := os.Stat(vmlinuxPath); os.IsNotExist(err) {
-		if err := os.WriteFile(vmlinuxPath, vmlinuxBinary, 0644); err != nil {
-			return nil, fmt.Errorf("failed to write vmlinux kernel: %w", err)
-		}
+	egressBlock, err := ParsePortRules(config.EgressBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse egress blocklist: %w", err)
+	}
+
+	storage, err := NewStorageDriver(config.Storage)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set up network bridge
-	if err := manager.setupNetworkBridge(); err != nil {
-		return nil, fmt.Errorf("failed to setup network bridge: %w", err)
+	macPrefix, err := ParseMACPrefix(config.MACPrefix)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set up iptables rules for internet access if enabled
-	if err := cleanupIptablesRules(); err != nil {
-		return nil, fmt.Errorf("failed to clean up existing iptables rules: %w", err)
+	sharedDirs, err := ParseSharedDirs(config.SharedDirs)
+	if err != nil {
+		return nil, err
 	}
-	if config.AllowInternet {
-		if err := manager.setupIptablesRules(); err != nil {
-			return nil, fmt.Errorf("failed to setup iptables rules: %w", err)
+	if len(sharedDirs) > 0 {
+		if sb, ok := backend.(SharedDirBackend); !ok || !sb.SupportsSharedDirs() {
+			return nil, fmt.Errorf("VM backend does not support shared directories")
 		}
 	}
 
+	manager := &Manager{
+		config:      config,
+		backend:     backend,
+		vms:         make(map[string]*VM),
+		vmRefs:      make(map[string]int),
+		transitions: make(map[string]*transition),
+		quarantined: make(map[string]string),
+		ipPool:      ipPool,
+		journal:     journal,
+		storage:     storage,
+		macPrefix:   macPrefix,
+		egressBlock: egressBlock,
+		moshPool:    moshPool,
+		sharedDirs:  sharedDirs,
+		bridgeName:  BridgeName,
+		logger:      logger,
+	}
+	eventsDir := ""
+	if config.PersistEvents {
+		eventsDir = config.DataDir
+	}
+	manager.events = NewEventLog(eventsDir, logger)
+	if config.ObjectStore != "" {
+		if manager.objects, err = objstore.New(config.ObjectStore); err != nil {
+			return nil, err
+		}
+	}
+	if manager.artifacts, err = OpenArtifacts(config.DataDir); err != nil {
+		return nil, err
+	}
+	if config.Images != "" {
+		if manager.images, err = loadImages(config, manager.artifacts); err != nil {
+			return nil, err
+		}
+	}
+	if config.VMHostname != "" {
+		if manager.hostname, err = parseHostnameTemplate(config.VMHostname); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxConcurrentIO > 0 {
+		manager.ioSlots = make(chan struct{}, config.MaxConcurrentIO)
+	}
+
+	if config.EncryptionKey != "" {
+		if config.RootfsMode == internal.RootfsEphemeral {
+			return nil, fmt.Errorf("encryption at rest does not apply to ephemeral VMs")
+		}
+		manager.masterKey, err = LoadMasterKey(config.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		manager.sealStoppedVMs()
+	}
+
+	// Log flows first, so the traffic that got a VM quarantined is recorded
+	if config.EgressLog {
+		manager.AddEgressHook(FlowLogHook())
+	}
+	if config.EgressMaxConns > 0 {
+		manager.AddEgressHook(MaxConnsHook(config.EgressMaxConns))
+	}
+	if config.EgressMaxDests > 0 {
+		manager.AddEgressHook(MaxDestsHook(config.EgressMaxDests))
+	}
+
+	if err := backend.Setup(manager); err != nil {
+		return nil, err
+	}
+
 	return manager, nil
 }
 
-// GetOrCreateVM gets an existing VM or creates a new one if it doesn't exist
-func (m *Manager) GetOrCreateVM(ctx context.Context, vmID string) (*VM, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// GetOrCreateVM gets an existing VM or creates a new one if it doesn't exist.
+// Provisioning stages are reported on the progress channel, which may be nil.
+// ctx only bounds creating the VM, which keeps running after it ends.
+func (m *Manager) GetOrCreateVM(ctx context.Context, vmID string, progress chan<- ProgressEvent) (*VM, error) {
+	if err := validateVMID(vmID); err != nil {
+		return nil, err
+	}
+
+	// Wait out another session starting or stopping the same VM
+	for {
+		m.mutex.Lock()
+		if existingVM, exists := m.vms[vmID]; exists {
+			m.vmRefs[vmID]++
+			refCount := m.vmRefs[vmID]
+			m.mutex.Unlock()
+			m.logger.Printf("Using existing VM %s (ref count: %d)", vmID, refCount)
+			return existingVM, nil
+		}
+		t, busy := m.transitions[vmID]
+		if !busy {
+			break
+		}
+		m.mutex.Unlock()
+
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 
-	// Check if VM already exists and increment reference count
-	if existingVM, exists := m.vms[vmID]; exists {
-		m.vmRefs[vmID]++
-		m.logger.Printf("Using existing VM %s (ref count: %d)", vmID, m.vmRefs[vmID])
-		return existingVM, nil
+	// Check VM limit, counting VMs still starting or stopping (0 = unlimited)
+	if max := m.config.MaxConcurrentVMs; max > 0 && len(m.vms)+len(m.transitions) >= max {
+		m.mutex.Unlock()
+		return nil, fmt.Errorf("%w (limit %d)", ErrCapacity, max)
 	}
 
-	// Check VM limit before creating new VM (0 = unlimited)
-	if m.config.MaxConcurrentVMs > 0 && len(m.vms) >= m.config.MaxConcurrentVMs {
-		return nil, fmt.Errorf("maximum number of concurrent VMs (%d) reached", m.config.MaxConcurrentVMs)
+	// Reserve the VM ID, then create the VM without holding the lock, since
+	// copying the rootfs and booting can take a while
+	vm := &VM{
+		ID:        vmID,
+		logger:    m.logger.WithField("vm_id", vmID),
+		backend:   m.backend,
+		lifecycle: newLifecycle(),
+		exited:    make(chan struct{}),
 	}
+	t := &transition{done: make(chan struct{}), vm: vm}
+	m.transitions[vmID] = t
+	m.mutex.Unlock()
+
+	err := m.createVMInternal(ctx, vm, progress)
 
-	// Create new VM
-	vm, err := m.createVMInternal(ctx, vmID)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.transitions, vmID)
+	close(t.done)
 	if err != nil {
+		vm.setState(StateFailed, err.Error())
+		m.journalRecord(vmID, journalDone, journalEntry{})
 		return nil, err
 	}
 
@@ -136,70 +324,125 @@ func (m *Manager) GetOrCreateVM(ctx context.Context, vmID string) (*VM, error) {
 	m.vms[vmID] = vm
 	m.vmRefs[vmID] = 1
 	m.logger.Printf("Created new VM %s (ref count: 1)", vmID)
+	m.events.Record(vmID, EventCreated, fmt.Sprintf("IP %s", vm.IP))
 
 	return vm, nil
 }
 
-// createVMInternal creates and starts a new VM (internal method, assumes mutex is held)
-func (m *Manager) createVMInternal(ctx context.Context, vmID string) (*VM, error) {
-	// Validate VM ID, should be alphanumeric with - and _, not empty, and at most 48 chars
-	if vmID == "" {
-		return nil, fmt.Errorf("VM ID cannot be empty")
+// createVMInternal sets up and starts a new VM, moving it through its
+// states until it boots (internal method, the caller must have reserved its
+// ID in transitions)
+func (m *Manager) createVMInternal(ctx context.Context, vm *VM, progress chan<- ProgressEvent) error {
+	vmID := vm.ID
+	if err := m.admit(vmID); err != nil {
+		return err
 	}
-	if strings.Trim(vmID, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
-		return nil, fmt.Errorf("invalid VM ID: %s", vmID)
+	if err := m.journal.record(vmID, journalCreate, journalEntry{}); err != nil {
+		return fmt.Errorf("failed to journal VM creation: %w", err)
 	}
-	if len(vmID) > 48 {
-		return nil, fmt.Errorf("VM ID too long: %s", vmID)
+	config, img := m.vmConfig(vmID)
+	if err := m.recordImage(vmID, img); err != nil {
+		return fmt.Errorf("failed to record VM image: %w", err)
 	}
 
 	// Allocate IP address
-	ip, err := m.ipPool.Allocate()
+	ip, err := m.ipPool.AllocateFor(vmID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		return fmt.Errorf("failed to allocate IP: %w", err)
 	}
+	m.journalRecord(vmID, journalIP, journalEntry{IP: ip.String()})
+	gateway, netmask := m.ipPool.GatewayFor(ip)
 
-	// Create VM data directory
-	vmDataDir := filepath.Join(m.config.DataDir, vmID)
-	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+	vm.setState(StateCopying, "")
+	if err := m.prepareRootfs(ctx, vmID, config, progress); err != nil {
+		m.ipPool.Release(ip)
+		return err
+	}
+	if err := m.checkFreeSpace(0); err != nil {
 		m.ipPool.Release(ip)
-		return nil, fmt.Errorf("failed to create VM data directory: %w", err)
+		return err
 	}
+	vm.setState(StateBooting, "")
+	mode := config.RootfsMode
+	if mode == "" {
+		mode = internal.RootfsCopy
+	}
+	rootfsDetail := fmt.Sprintf("%s disk from %s", mode, config.Rootfs)
+	if img != nil {
+		rootfsDetail = fmt.Sprintf("%s disk from image %s", mode, img.Name)
+	}
+	sendProgress(progress, vmID, vm.State(), StageRootfsReady, rootfsDetail)
+	sendProgress(progress, vmID, vm.State(), StageIPAllocated, fmt.Sprintf("IP %s, gateway %s, netmask %s", ip, gateway, netmask))
 
-	vm := &VM{
-		ID:         vmID,
-		IP:         ip,
-		Gateway:    m.ipPool.Gateway(),
-		Netmask:    m.ipPool.Netmask(),
-		SocketPath: filepath.Join(vmDataDir, "firecracker.sock"),
-		PIDFile:    filepath.Join(vmDataDir, "firecracker.pid"),
-		config:     m.config,
-		dataDir:    vmDataDir,
-		logger:     m.logger.WithField("vm_id", vmID),
-	}
-
-	// Copy the rootfs image to the VM data directory (writable)
-	rootfsPath := filepath.Join(vmDataDir, "rootfs.img")
-	if _, err := os.Stat(rootfsPath); os.IsNotExist(err) {
-		buf, err := os.ReadFile(vm.config.Rootfs)
-		if err == nil {
-			err = os.WriteFile(rootfsPath, buf, 0644)
-		}
+	var sharedDirs []SharedDir
+	for _, dir := range m.sharedDirs {
+		dir, err := dir.forVM(vmID)
 		if err != nil {
 			m.ipPool.Release(ip)
-			os.RemoveAll(vmDataDir)
-			return nil, fmt.Errorf("failed to copy rootfs image: %w", err)
+			return err
 		}
+		sharedDirs = append(sharedDirs, dir)
 	}
 
-	// Start the VM
-	if err := vm.Start(ctx, m); err != nil {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	vm.IP, vm.Gateway, vm.Netmask = ip, gateway, netmask
+	vm.SocketPath = filepath.Join(vmDataDir, "firecracker.sock")
+	vm.PIDFile = filepath.Join(vmDataDir, "firecracker.pid")
+	vm.config, vm.image, vm.dataDir = config, img, vmDataDir
+	vm.SharedDirs = sharedDirs
+
+	if err := m.runHook(ctx, HookPreBoot, vm); err != nil {
 		m.ipPool.Release(ip)
-		os.RemoveAll(vmDataDir)
-		return nil, fmt.Errorf("failed to start VM: %w", err)
+		return err
 	}
 
-	return vm, nil
+	// Start the VM. It runs until it is stopped rather than only as long as
+	// whoever started it, so the backend gets a context of its own, which
+	// ctx only cancels while the machine starts.
+	lifetime, stopLifetime := context.WithCancel(context.WithoutCancel(ctx))
+	vm.stopLifetime = stopLifetime
+	stopBound := context.AfterFunc(ctx, stopLifetime)
+	err = vm.Start(lifetime, m)
+	if !stopBound() && err == nil {
+		vm.Stop(context.Background())
+		err = ctx.Err()
+	}
+	if err != nil {
+		stopLifetime()
+		m.ipPool.Release(ip)
+		removeVMDir(vmDataDir)
+		return fmt.Errorf("failed to start VM: %w", err)
+	}
+	m.journalRecord(vmID, journalStarted, journalEntry{PID: readPID(vm.PIDFile)})
+	vmmDetail := fmt.Sprintf("PID %d, %d MB, %d vCPUs", readPID(vm.PIDFile), config.VMMemory, config.VMCPUs)
+	if vm.netDevice != "" {
+		vmmDetail += ", network device " + vm.netDevice
+	}
+	sendProgress(progress, vmID, vm.State(), StageVMMStarted, vmmDetail)
+
+	// Relay a block of UDP ports for mosh, if enabled
+	if m.moshPool != nil {
+		if err := m.setupMoshRelay(vm); err != nil {
+			vm.Stop(ctx)
+			stopLifetime()
+			m.ipPool.Release(ip)
+			removeVMDir(vmDataDir)
+			return fmt.Errorf("failed to set up mosh relay: %w", err)
+		}
+	}
+
+	// Count traffic beyond the host, if enabled
+	if m.config.CountTraffic {
+		if err := m.setupTrafficRules(vm); err != nil {
+			vm.Stop(ctx)
+			stopLifetime()
+			m.releaseNetwork(vm)
+			removeVMDir(vmDataDir)
+			return fmt.Errorf("failed to set up traffic accounting: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // GetVM returns the VM for a given user ID
@@ -210,6 +453,40 @@ func (m *Manager) GetVM(vmID string) (*VM, bool) {
 	return vm, exists
 }
 
+// VMByIP returns the running VM with an IP address
+func (m *Manager) VMByIP(ip net.IP) (*VM, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, vm := range m.vms {
+		if vm.IP.Equal(ip) {
+			return vm, true
+		}
+	}
+	return nil, false
+}
+
+// Gateways returns the host's address in each VM network
+func (m *Manager) Gateways() []net.IP {
+	var gateways []net.IP
+	for _, network := range m.ipPool.Networks() {
+		gateways = append(gateways, Gateway(network))
+	}
+	return gateways
+}
+
+// DataDir returns the directory holding shared artifacts and per-VM data
+func (m *Manager) DataDir() string {
+	return m.config.DataDir
+}
+
+// Busy reports whether a VM is starting or stopping
+func (m *Manager) Busy(vmID string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, busy := m.transitions[vmID]
+	return busy
+}
+
 // GetActiveVMCount returns the current number of active VMs
 func (m *Manager) GetActiveVMCount() int {
 	m.mutex.RLock()
@@ -217,13 +494,23 @@ func (m *Manager) GetActiveVMCount() int {
 	return len(m.vms)
 }
 
-// ReleaseVM decrements the reference count for a VM and destroys it if no more references
-func (m *Manager) ReleaseVM(vmID string) error {
+// Capacity returns how many VMs can run at once, which is the concurrency
+// limit or the number of VM addresses, whichever is smaller
+func (m *Manager) Capacity() int {
+	if max := m.config.MaxConcurrentVMs; max > 0 && max < m.ipPool.Size() {
+		return max
+	}
+	return m.ipPool.Size()
+}
+
+// ReleaseVM decrements the reference count for a VM and destroys it if no
+// more references. Stopping the VM is bounded by ctx.
+func (m *Manager) ReleaseVM(ctx context.Context, vmID string) error {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
 
 	vm, exists := m.vms[vmID]
 	if !exists {
+		m.mutex.Unlock()
 		return fmt.Errorf("VM %s not found", vmID)
 	}
 
@@ -234,290 +521,141 @@ func (m *Manager) ReleaseVM(vmID string) error {
 	m.logger.Printf("Released VM %s (ref count: %d)", vmID, refCount)
 
 	// Only destroy VM if no more references
-	if refCount <= 0 {
-		m.logger.Printf("Destroying VM %s (no more references)", vmID)
-
-		if err := vm.Stop(); err != nil {
-			return fmt.Errorf("failed to stop VM: %w", err)
-		}
-
-		m.ipPool.Release(vm.IP)
-		delete(m.vms, vmID)
-		delete(m.vmRefs, vmID)
+	if refCount > 0 {
+		m.mutex.Unlock()
+		return nil
 	}
 
-	return nil
+	m.logger.Printf("Destroying VM %s (no more references)", vmID)
+	done := m.detachVM(vmID)
+	m.mutex.Unlock()
+
+	return m.finishStop(ctx, vm, done)
 }
 
-// DestroyVM forcibly stops and removes a VM
-func (m *Manager) DestroyVM(vmID string) error {
+// DestroyVM forcibly stops and removes a VM. Stopping the VM is bounded by ctx.
+func (m *Manager) DestroyVM(ctx context.Context, vmID string) error {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
 
 	vm, exists := m.vms[vmID]
 	if !exists {
+		m.mutex.Unlock()
 		return fmt.Errorf("VM %s not found", vmID)
 	}
 
 	m.logger.Printf("Forcibly destroying VM %s", vmID)
+	done := m.detachVM(vmID)
+	m.mutex.Unlock()
 
-	if err := vm.Stop(); err != nil {
-		return fmt.Errorf("failed to stop VM: %w", err)
-	}
+	return m.finishStop(ctx, vm, done)
+}
 
-	m.ipPool.Release(vm.IP)
+// detachVM removes a VM from the running set and marks it as draining, so its
+// ID can't be reused until finishStop completes (assumes mutex is held)
+func (m *Manager) detachVM(vmID string) chan struct{} {
+	vm := m.vms[vmID]
 	delete(m.vms, vmID)
 	delete(m.vmRefs, vmID)
-
-	return nil
+	vm.setState(StateDraining, "")
+	done := make(chan struct{})
+	m.transitions[vmID] = &transition{done: done, vm: vm}
+	return done
 }
 
-// Start starts the Firecracker process for this VM
-func (vm *VM) Start(ctx context.Context, manager *Manager) error {
-	// Remove existing socket, if any
-	os.Remove(vm.SocketPath)
-
-	vmlinuxPath := filepath.Join(vm.config.DataDir, "vmlinux")
-	firecrackerPath := filepath.Join(vm.config.DataDir, "firecracker")
-
-	bootArgs := "console=ttyS0 reboot=k panic=1 random.trust_cpu=on"
-
-	// ip=IP::Gateway:Netmask:Hostname:Interface:off
-	bootArgs += fmt.Sprintf(" ip=%s::%s:%s:%s:eth0:off", vm.IP, vm.Gateway, vm.Netmask, vm.ID)
-
-	// Generate unique ID from VM IP for MAC and TAP device (only works for <65535 VMs)
-	vmNetID := int(vm.IP[len(vm.IP)-2])*256 + int(vm.IP[len(vm.IP)-1])
-	tapName := fmt.Sprintf("sshvm-tap-%d", vmNetID)
-
-	// Setup TAP device
-	if err := manager.setupTAPDevice(tapName); err != nil {
-		return fmt.Errorf("failed to setup TAP device: %w", err)
-	}
-
-	// Create machine configuration
-	cfg := firecracker.Config{
-		SocketPath:      vm.SocketPath,
-		KernelImagePath: vmlinuxPath,
-		KernelArgs:      bootArgs,
-		ForwardSignals:  []os.Signal{}, // Don't forward any signals to firecracker
-		Drives: []models.Drive{
-			{
-				DriveID:      firecracker.String("rootfs"),
-				IsRootDevice: firecracker.Bool(true),
-				IsReadOnly:   firecracker.Bool(false),
-				PathOnHost:   firecracker.String(filepath.Join(vm.dataDir, "rootfs.img")),
-			},
-		},
-		NetworkInterfaces: []firecracker.NetworkInterface{
-			{
-				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-					// Network setup: https://gist.github.com/jvns/9b274f24cfa1db7abecd0d32483666a3
-					MacAddress:  fmt.Sprintf("02:FC:00:00:%02x:%02x", vmNetID>>8, vmNetID&0xFF),
-					HostDevName: tapName,
-				},
-				AllowMMDS: false,
-			},
-		},
-		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  firecracker.Int64(int64(vm.config.VMCPUs)),
-			MemSizeMib: firecracker.Int64(int64(vm.config.VMMemory)),
-		},
-	}
-
-	// Create a custom command that uses our embedded firecracker binary
-	cmd := exec.CommandContext(ctx, firecrackerPath, "--api-sock", vm.SocketPath)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		// Create a process group so that signals (SIGINT) are not forwarded.
-		Setpgid: true,
-	}
-
-	vm.logger.Infof("Starting VM with IP %s, TAP device %s, data dir %s", vm.IP, tapName, vm.dataDir)
-
-	// Create a named pipe for VM serial input
-	pipePath := filepath.Join(vm.dataDir, "console.in")
-	// Remove existing pipe if it exists
-	os.Remove(pipePath)
-	if err := syscall.Mkfifo(pipePath, 0600); err != nil {
-		return fmt.Errorf("mkfifo for console.in: %w", err)
-	}
-	pipeFile, err := os.OpenFile(pipePath, os.O_RDWR, os.ModeNamedPipe)
-	if err != nil {
-		return fmt.Errorf("open pipe for console.in: %v", err)
-	}
-	defer pipeFile.Close()
-
-	// Capture VM console output (boot logs, OpenRC, SSH, etc.)
-	logPath := filepath.Join(vm.dataDir, "console.out")
-	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create log file: %w", err)
+// finishStop stops a detached VM and frees its resources without holding the
+// lock, leaving it stopped, or failed if it died or didn't stop
+func (m *Manager) finishStop(ctx context.Context, vm *VM, done chan struct{}) error {
+	m.journalRecord(vm.ID, journalStop, journalEntry{})
+	if err := m.runHook(ctx, HookPreDestroy, vm); err != nil {
+		m.logger.Errorf("VM %s: %v", vm.ID, err)
+	}
+	err := vm.Stop(ctx)
+	vm.stopLifetime()
+	m.releaseNetwork(vm)
+	if err == nil && m.masterKey != nil {
+		// The VM can't start again until its disks are sealed
+		if sealErr := m.sealDisks(vm.ID); sealErr != nil {
+			m.logger.Errorf("Failed to encrypt disks of VM %s: %v", vm.ID, sealErr)
+		}
 	}
-	defer logFile.Close()
-
-	cmd.Stdin = pipeFile
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
-
-	machine, err := firecracker.NewMachine(
-		ctx, cfg,
-		firecracker.WithProcessRunner(cmd),
-		firecracker.WithLogger(vm.logger),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to create machine: %w", err)
-	}
-
-	// Need to initialize virtio-rng (entropy) manually since not supported by SDK
-	// https://github.com/firecracker-microvm/firecracker-go-sdk/issues/505
-	machine.Handlers.FcInit = machine.Handlers.FcInit.Append(firecracker.Handler{
-		Name: "virtio-rng",
-		Fn: func(ctx context.Context, m *firecracker.Machine) error {
-			tr := &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("unix", m.Cfg.SocketPath)
-				},
-			}
-			c := &http.Client{Transport: tr}
-			defer c.CloseIdleConnections()
-
-			body := strings.NewReader(`{"rate_limiter":{"bandwidth":{"size":4096,"one_time_burst":4096,"refill_time":100}}}`)
-			req, _ := http.NewRequestWithContext(ctx, http.MethodPut, "http://unix/entropy", body)
-			req.Header.Set("Content-Type", "application/json")
-			resp, err := c.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusNoContent {
-				b, _ := io.ReadAll(resp.Body)
-				return fmt.Errorf("entropy PUT failed: %s: %s", resp.Status, string(b))
-			}
-			return nil
-		},
-	})
-
-	// Start the machine
-	if err := machine.Start(ctx); err != nil {
-		os.Remove(vm.SocketPath)
-		os.Remove(vm.PIDFile)
-		os.Remove(filepath.Join(vm.dataDir, "console.in"))
-		return fmt.Errorf("failed to start machine: %w", err)
+	if err == nil && m.objects != nil {
+		// Uploaded before the VM can start again, here or on another host
+		if pushErr := m.pushDisks(context.Background(), vm.ID); pushErr != nil {
+			m.logger.Errorf("Failed to upload disks of VM %s to object storage: %v", vm.ID, pushErr)
+		}
 	}
-
-	// Write PID file
-	pid, err := machine.PID()
 	if err == nil {
-		err = os.WriteFile(vm.PIDFile, fmt.Appendf(nil, "%d", pid), 0644)
+		// A VM that failed to stop may still be running, so its intent
+		// stays open for recovery
+		m.journalRecord(vm.ID, journalDone, journalEntry{})
 	}
+
 	if err != nil {
-		machine.StopVMM()
-		os.Remove(vm.SocketPath)
-		os.Remove(vm.PIDFile)
-		os.Remove(filepath.Join(vm.dataDir, "console.in"))
-		return fmt.Errorf("failed to record PID: %w", err)
+		vm.setState(StateFailed, err.Error())
+	} else if died := vm.ExitErr(); died != nil {
+		vm.setState(StateFailed, died.Error())
+	} else {
+		vm.setState(StateStopped, "")
 	}
 
-	// Make sure the manager destroys the VM on early exit.
-	// Also runs on clean shutdown, but this is a no-op in that case.
-	go func() {
-		machine.Wait(context.Background())
-		manager.DestroyVM(vm.ID)
-	}()
-
-	vm.machine = machine
-	return nil
-}
-
-// Stop stops the Firecracker process
-func (vm *VM) Stop() error {
-	vm.mutex.Lock()
-	defer vm.mutex.Unlock()
-
-	if vm.machine != nil {
-		ctx := context.Background()
-		vm.machine.Shutdown(ctx)
-
-		// HACK: Give it a moment to shut down cleanly
-		time.Sleep(250 * time.Millisecond)
-		vm.machine.StopVMM()
-		vm.machine.Wait(ctx)
-
-		// Clean up only VM-specific files, preserve data and console output
-		os.Remove(vm.SocketPath)                           // firecracker.sock
-		os.Remove(vm.PIDFile)                              // firecracker.pid
-		os.Remove(filepath.Join(vm.dataDir, "console.in")) // console.in
+	m.mutex.Lock()
+	delete(m.transitions, vm.ID)
+	close(done)
+	m.mutex.Unlock()
 
-		vm.machine = nil
+	if err != nil {
+		m.events.Record(vm.ID, EventDestroyed, err.Error())
+		return fmt.Errorf("failed to stop VM: %w", err)
 	}
-
+	m.events.Record(vm.ID, EventDestroyed, "")
 	return nil
 }
 
-// setupNetworkBridge creates and configures the network bridge
-func (m *Manager) setupNetworkBridge() error {
-	// Check if bridge already exists
-	if err := exec.Command("ip", "link", "show", m.bridgeName).Run(); err == nil {
-		m.logger.Infof("Bridge %s already exists", m.bridgeName)
-		return nil
-	}
-
-	// Create bridge
-	if err := exec.Command("ip", "link", "add", "name", m.bridgeName, "type", "bridge").Run(); err != nil {
-		return fmt.Errorf("failed to create bridge %s: %w", m.bridgeName, err)
-	}
-	m.logger.Infof("Created bridge: %s", m.bridgeName)
+// Events returns the lifecycle event log of all VMs
+func (m *Manager) Events() *EventLog {
+	return m.events
+}
 
-	// Configure bridge IP (gateway)
-	gateway := m.ipPool.Gateway()
-	maskSize := m.ipPool.MaskSize()
-	gatewayWithMask := fmt.Sprintf("%s/%d", gateway, maskSize)
-	if err := exec.Command("ip", "addr", "add", gatewayWithMask, "dev", m.bridgeName).Run(); err != nil {
-		// Ignore error if address already exists
-		if !strings.Contains(err.Error(), "File exists") {
-			return fmt.Errorf("failed to add IP to bridge: %w", err)
+// releaseNetwork returns a stopped VM's IP address and relayed ports to their
+// pools, lifts any quarantine, and stops counting its traffic
+func (m *Manager) releaseNetwork(vm *VM) {
+	if m.config.CountTraffic {
+		if err := m.removeTrafficRules(vm); err != nil {
+			m.logger.Errorf("Failed to remove traffic rules for VM %s: %v", vm.ID, err)
 		}
 	}
-
-	// Bring bridge up
-	if err := exec.Command("ip", "link", "set", "dev", m.bridgeName, "up").Run(); err != nil {
-		return fmt.Errorf("failed to bring bridge up: %w", err)
+	if vm.MoshPorts != (PortRange{}) {
+		if err := m.removeMoshRelay(vm); err != nil {
+			m.logger.Errorf("Failed to remove mosh relay for VM %s: %v", vm.ID, err)
+		}
+		m.moshPool.Release(vm.MoshPorts)
+		vm.MoshPorts = PortRange{}
 	}
-
-	// Enable IP forwarding
-	if err := exec.Command("sh", "-c", "echo 1 > /proc/sys/net/ipv4/ip_forward").Run(); err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+	if err := m.liftQuarantine(vm); err != nil {
+		m.logger.Errorf("Failed to lift quarantine of VM %s: %v", vm.ID, err)
 	}
-
-	m.logger.Infof("Bridge %s configured with gateway %s", m.bridgeName, gateway)
-	return nil
+	m.ipPool.Release(vm.IP)
 }
 
-// setupTAPDevice creates and configures a TAP device for a VM
-func (m *Manager) setupTAPDevice(tapName string) error {
-	// Check if TAP device already exists
-	if err := exec.Command("ip", "link", "show", tapName).Run(); err == nil {
-		// If TAP device exists, delete it
-		m.logger.Debugf("TAP device %s already exists, deleting it", tapName)
-		if err := exec.Command("ip", "link", "delete", tapName).Run(); err != nil {
-			return fmt.Errorf("failed to delete existing TAP device %s: %w", tapName, err)
-		}
-	}
-
-	// Create TAP device
-	if err := exec.Command("ip", "tuntap", "add", tapName, "mode", "tap").Run(); err != nil {
-		return fmt.Errorf("failed to create TAP device %s: %w", tapName, err)
-	}
+// Start boots the machine for this VM, which may run only as long as ctx
+func (vm *VM) Start(ctx context.Context, manager *Manager) error {
+	return vm.backend.Start(ctx, manager, vm)
+}
 
-	// Attach TAP device to bridge
-	if err := exec.Command("ip", "link", "set", "dev", tapName, "master", m.bridgeName).Run(); err != nil {
-		return fmt.Errorf("failed to attach TAP device to bridge: %w", err)
-	}
+// Stop shuts down the machine for this VM, killing it if ctx expires first
+func (vm *VM) Stop(ctx context.Context) error {
+	// The backend may still shut the guest down over the shared connection
+	err := vm.backend.Stop(ctx, vm)
+	vm.closeGuestClient()
+	return err
+}
 
-	// Bring TAP device up
-	if err := exec.Command("ip", "link", "set", "dev", tapName, "up").Run(); err != nil {
-		return fmt.Errorf("failed to bring TAP device up: %w", err)
-	}
+// SSHAddr returns the address of the VM's SSH server
+func (vm *VM) SSHAddr() string {
+	return vm.backend.SSHAddr(vm)
+}
 
-	m.logger.Debugf("Created and configured TAP device: %s", tapName)
-	return nil
+// VCPUs returns the number of vCPUs the VM booted with
+func (vm *VM) VCPUs() int {
+	return vm.config.VMCPUs
 }
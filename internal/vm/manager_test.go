@@ -2,6 +2,7 @@ package vm
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -11,6 +12,33 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// newTestManager creates a manager backed by fake VMs that boot instantly,
+// with a small fake rootfs. Each configure func adjusts the config first.
+func newTestManager(t *testing.T, configure ...func(*internal.Config)) *Manager {
+	t.Helper()
+
+	rootfsPath := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := os.WriteFile(rootfsPath, []byte("fake rootfs content"), 0644); err != nil {
+		t.Fatalf("Failed to create fake rootfs: %v", err)
+	}
+	config := &internal.Config{
+		VMCIDR:   "192.168.100.0/24",
+		VMMemory: 128,
+		VMCPUs:   1,
+		DataDir:  t.TempDir(),
+		Rootfs:   rootfsPath,
+	}
+	for _, f := range configure {
+		f(config)
+	}
+
+	manager, err := NewManagerWithBackend(config, logrus.NewEntry(logrus.StandardLogger()), NewFakeBackend(0))
+	if err != nil {
+		t.Fatalf("Failed to create VM manager: %v", err)
+	}
+	return manager
+}
+
 func TestNewManager(t *testing.T) {
 	// Create temporary directory for test
 	tempDir, err := os.MkdirTemp("", "ssh-hypervisor-test-*")
@@ -96,12 +124,12 @@ func TestVMCreationFlow(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	vm, err := manager.GetOrCreateVM(ctx, vmID)
+	vm, err := manager.GetOrCreateVM(ctx, vmID, nil)
 	// We expect this to fail since we're using a fake binary
 	if err == nil {
 		t.Errorf("Expected error with fake firecracker binary")
 		if vm != nil {
-			vm.Stop() // Clean up if somehow it worked
+			vm.Stop(context.Background()) // Clean up if somehow it worked
 		}
 	}
 
@@ -157,3 +185,284 @@ func TestGetVM(t *testing.T) {
 		t.Errorf("Expected to get the same VM instance")
 	}
 }
+
+func TestManagerWithFakeBackend(t *testing.T) {
+	manager := newTestManager(t)
+
+	ctx := context.Background()
+	vm, err := manager.GetOrCreateVM(ctx, "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if vm.SSHAddr() == "" {
+		t.Errorf("Expected fake VM to have an SSH address")
+	}
+
+	// A second session shares the same VM
+	again, err := manager.GetOrCreateVM(ctx, "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to get existing VM: %v", err)
+	}
+	if again != vm {
+		t.Errorf("Expected to get the same VM instance")
+	}
+
+	if err := manager.ReleaseVM(context.Background(), "testuser"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+	if manager.GetActiveVMCount() != 1 {
+		t.Errorf("Expected VM to survive while referenced")
+	}
+
+	if err := manager.ReleaseVM(context.Background(), "testuser"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+	if manager.GetActiveVMCount() != 0 {
+		t.Errorf("Expected VM to be destroyed after last release")
+	}
+	if manager.ipPool.IsAllocated(vm.IP) {
+		t.Errorf("Expected IP %s to be released", vm.IP)
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	manager := newTestManager(t)
+
+	ctx := context.Background()
+	progress := make(chan ProgressEvent, 16)
+	vm, err := manager.GetOrCreateVM(ctx, "testuser", progress)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), vm.ID)
+
+	if err := manager.WaitReady(ctx, vm, progress); err != nil {
+		t.Fatalf("VM did not become ready: %v", err)
+	}
+	close(progress)
+
+	var stages []ProgressStage
+	for event := range progress {
+		if event.VMID != "testuser" {
+			t.Errorf("Unexpected VM ID in event: %s", event.VMID)
+		}
+		stages = append(stages, event.Stage)
+	}
+
+	expected := []ProgressStage{StageRootfsReady, StageIPAllocated, StageVMMStarted, StageKernelBooting, StageSSHReady}
+	if len(stages) != len(expected) {
+		t.Fatalf("Expected stages %v, got %v", expected, stages)
+	}
+	for i := range expected {
+		if stages[i] != expected[i] {
+			t.Errorf("Expected stage %d to be %s, got %s", i, expected[i], stages[i])
+		}
+	}
+}
+
+func TestDiskUsageAndFreeSpace(t *testing.T) {
+	rootfsPath := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := os.WriteFile(rootfsPath, make([]byte, 8192), 0644); err != nil {
+		t.Fatalf("Failed to create fake rootfs: %v", err)
+	}
+	manager := newTestManager(t, func(c *internal.Config) { c.Rootfs = rootfsPath })
+
+	vm, err := manager.GetOrCreateVM(context.Background(), "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	os.WriteFile(filepath.Join(vm.dataDir, "console.out"), make([]byte, 4096), 0644)
+	if err := manager.DestroyVM(context.Background(), vm.ID); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+
+	usage, err := manager.DiskUsage()
+	if err != nil {
+		t.Fatalf("Failed to measure disk usage: %v", err)
+	}
+	if usage.Images != 8192 || usage.VMDisks != 8192 || usage.Logs != 4096 {
+		t.Errorf("Unexpected disk usage: %+v", usage)
+	}
+	if usage.Free <= 0 {
+		t.Errorf("Expected free space to be reported, got %d", usage.Free)
+	}
+
+	// Demanding more free space than exists refuses new VMs
+	manager.config.MinFreeSpace = int(usage.Free/(1024*1024)) + 1024
+	available := manager.ipPool.Available()
+	_, err = manager.GetOrCreateVM(context.Background(), "another", nil)
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("Expected ErrDiskFull, got %v", err)
+	}
+	if manager.ipPool.Available() != available {
+		t.Errorf("Expected no IP to be leaked")
+	}
+}
+
+func TestRootfsCopyQueue(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.MaxConcurrentIO = 1 })
+
+	// Occupy the only IO slot so the next copy has to wait
+	release, err := manager.acquireIO(context.Background(), "other", nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire IO slot: %v", err)
+	}
+
+	progress := make(chan ProgressEvent, 16)
+	result := make(chan error, 1)
+	go func() {
+		_, err := manager.GetOrCreateVM(context.Background(), "testuser", progress)
+		result <- err
+	}()
+
+	select {
+	case event := <-progress:
+		if event.Stage != StageQueued {
+			t.Fatalf("Expected queued stage first, got %s", event.Stage)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for queued stage")
+	}
+
+	// Other sessions are not blocked while the copy waits
+	if count := manager.GetActiveVMCount(); count != 0 {
+		t.Errorf("Expected no active VMs, got %d", count)
+	}
+
+	release()
+	if err := <-result; err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), "testuser")
+
+	data, err := os.ReadFile(filepath.Join(manager.config.DataDir, "testuser", "rootfs.img"))
+	if err != nil || string(data) != "fake rootfs content" {
+		t.Errorf("Expected rootfs to be copied, got %q (%v)", data, err)
+	}
+}
+
+func TestOverlayRootfs(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) {
+		c.RootfsMode = internal.RootfsOverlay
+		c.OverlaySize = 64
+	})
+
+	vm, err := manager.GetOrCreateVM(context.Background(), "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), vm.ID)
+
+	if _, err := os.Stat(filepath.Join(vm.dataDir, "rootfs.img")); !os.IsNotExist(err) {
+		t.Errorf("Expected no rootfs copy in overlay mode")
+	}
+	info, err := os.Stat(filepath.Join(vm.dataDir, "overlay.img"))
+	if err != nil {
+		t.Fatalf("Expected overlay drive to be created: %v", err)
+	}
+	if info.Size() != 64*1024*1024 {
+		t.Errorf("Expected 64 MB overlay drive, got %d bytes", info.Size())
+	}
+	if allocatedSize(info) >= info.Size() {
+		t.Errorf("Expected overlay drive to be sparse")
+	}
+	if !usesOverlay(manager.config, vm.dataDir) {
+		t.Errorf("Expected VM to boot with an overlay")
+	}
+
+	// VMs with an existing full copy keep using it
+	os.WriteFile(filepath.Join(vm.dataDir, "rootfs.img"), []byte("copy"), 0644)
+	if usesOverlay(manager.config, vm.dataDir) {
+		t.Errorf("Expected existing rootfs copy to take precedence")
+	}
+}
+
+func TestEphemeralRootfs(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.RootfsMode = internal.RootfsEphemeral })
+
+	vm, err := manager.GetOrCreateVM(context.Background(), "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), vm.ID)
+
+	for _, name := range []string{"rootfs.img", "overlay.img"} {
+		if _, err := os.Stat(filepath.Join(vm.dataDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s in ephemeral mode", name)
+		}
+	}
+}
+
+func TestCreateDoesNotBlockManager(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.MaxConcurrentIO = 1 })
+	tempDir := manager.config.DataDir
+	ctx := context.Background()
+
+	// Hold alice's VM mid-creation by occupying the only IO slot
+	release, err := manager.acquireIO(ctx, "other", nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire IO slot: %v", err)
+	}
+	progress := make(chan ProgressEvent, 16)
+	results := make(chan *VM, 2)
+	for range 2 {
+		go func() {
+			vm, err := manager.GetOrCreateVM(ctx, "alice", progress)
+			if err != nil {
+				t.Errorf("Failed to create VM: %v", err)
+			}
+			results <- vm
+		}()
+	}
+	<-progress // Queued
+
+	// Other VMs can still be created and destroyed meanwhile
+	os.MkdirAll(filepath.Join(tempDir, "bob"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "bob", "rootfs.img"), []byte("existing"), 0644)
+	bob, err := manager.GetOrCreateVM(ctx, "bob", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM while another is starting: %v", err)
+	}
+	if err := manager.DestroyVM(ctx, bob.ID); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+
+	// Both sessions for alice share the VM once it has started
+	release()
+	first, second := <-results, <-results
+	if first == nil || first != second {
+		t.Fatalf("Expected both sessions to share one VM")
+	}
+	manager.mutex.RLock()
+	refs := manager.vmRefs["alice"]
+	manager.mutex.RUnlock()
+	if refs != 2 {
+		t.Errorf("Expected 2 references, got %d", refs)
+	}
+	manager.DestroyVM(ctx, "alice")
+}
+
+func TestVMOutlivesStartContext(t *testing.T) {
+	manager := newTestManager(t)
+
+	// The fake backend kills a VM when the context it was started with ends,
+	// like Firecracker, so the VM must not get the caller's
+	ctx, cancel := context.WithCancel(context.Background())
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), vm.ID)
+	if err := manager.WaitReady(ctx, vm, nil); err != nil {
+		t.Fatalf("VM did not become ready: %v", err)
+	}
+	cancel()
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := manager.GetVM("alice"); !ok || vm.ExitErr() != nil {
+		t.Fatalf("Expected the VM to keep running after its start context ended, got %v", vm.ExitErr())
+	}
+	if _, err := vm.RunCommand(context.Background(), "true"); err != nil {
+		t.Errorf("Expected the VM to still run commands: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/mdns"
+)
+
+// mdnsRefreshInterval is how often the VMs announced over mDNS are updated
+// from the running ones
+const mdnsRefreshInterval = 5 * time.Second
+
+// Labels of a VM that control how it is announced over mDNS, usually set
+// from its user's profile in the labels file
+const (
+	mdnsLabel         = "mdns"          // "off" to not announce the VM
+	mdnsServicesLabel = "mdns-services" // Services the VM offers, like "http:8080 syslog:514/udp"
+)
+
+// maxServiceName is the longest DNS-SD service name, from RFC 6335
+const maxServiceName = 15
+
+// AnnounceMDNS answers mDNS queries on the bridge with each booted VM's
+// hostname under .local and the services in its mdns-services label, until
+// ctx is done. VMs labeled mdns=off aren't announced.
+func (m *Manager) AnnounceMDNS(ctx context.Context) error {
+	responder := mdns.NewResponder(m.logger)
+	responder.Set(m.mdnsHosts())
+	go func() {
+		ticker := time.NewTicker(mdnsRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				responder.Set(m.mdnsHosts())
+			}
+		}
+	}()
+	m.logger.Infof("Announcing VMs over mDNS on %s", m.bridgeName)
+	return responder.Run(ctx, m.bridgeName)
+}
+
+// mdnsHosts returns the hosts announced for the booted VMs, sorted by name
+func (m *Manager) mdnsHosts() []mdns.Host {
+	m.mutex.RLock()
+	vms := make([]*VM, 0, len(m.vms))
+	for _, vm := range m.vms {
+		vms = append(vms, vm)
+	}
+	m.mutex.RUnlock()
+
+	var hosts []mdns.Host
+	for _, vm := range vms {
+		// VMs still booting can't answer on their services yet
+		if vm.State() != StateReady {
+			continue
+		}
+		labels, err := m.Labels(vm.ID)
+		if err != nil {
+			vm.logger.Warnf("Failed to read labels for mDNS: %v", err)
+			continue
+		}
+		if labels[mdnsLabel] == "off" {
+			continue
+		}
+		services, err := parseServices(labels[mdnsServicesLabel])
+		if err != nil {
+			vm.logger.Warnf("Announcing VM over mDNS without services: %v", err)
+		}
+		hosts = append(hosts, mdns.Host{Name: m.hostnameOf(vm), IP: vm.IP, Services: services})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// parseServices parses services separated by spaces like "http:8080" or
+// "syslog:514/udp", where the name is a DNS-SD service type without its
+// underscore and the protocol is TCP unless given
+func parseServices(s string) ([]mdns.Service, error) {
+	var services []mdns.Service
+	for _, spec := range strings.Fields(s) {
+		name, port, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid service %q, expected NAME:PORT or NAME:PORT/udp", spec)
+		}
+		if name == "" || len(name) > maxServiceName || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			return nil, fmt.Errorf("invalid service name %q", name)
+		}
+		proto := "tcp"
+		if p, protoName, ok := strings.Cut(port, "/"); ok {
+			if protoName != "tcp" && protoName != "udp" {
+				return nil, fmt.Errorf("invalid protocol in service %q, expected tcp or udp", spec)
+			}
+			port, proto = p, protoName
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port in service %q", spec)
+		}
+		services = append(services, mdns.Service{Name: name, Proto: proto, Port: n})
+	}
+	return services, nil
+}
@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/mdns"
+)
+
+func TestParseServices(t *testing.T) {
+	services, err := parseServices(" http:8080  syslog:514/udp ")
+	if err != nil {
+		t.Fatalf("Failed to parse services: %v", err)
+	}
+	expected := []mdns.Service{{Name: "http", Proto: "tcp", Port: 8080}, {Name: "syslog", Proto: "udp", Port: 514}}
+	if len(services) != len(expected) || services[0] != expected[0] || services[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, services)
+	}
+	for _, bad := range []string{"http", "_http:80", "http:0", "http:80/sctp", "a-very-long-service-name:80"} {
+		if _, err := parseServices(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestMDNSHosts(t *testing.T) {
+	manager := newTestManager(t)
+
+	ctx := context.Background()
+	if err := manager.SetLabels("alice", map[string]string{mdnsServicesLabel: "http:8080"}); err != nil {
+		t.Fatalf("Failed to label VM: %v", err)
+	}
+	if err := manager.SetLabels("bob", map[string]string{mdnsLabel: "off"}); err != nil {
+		t.Fatalf("Failed to label VM: %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		vm, err := manager.GetOrCreateVM(ctx, user, nil)
+		if err != nil {
+			t.Fatalf("Failed to create VM: %v", err)
+		}
+		if err := manager.WaitReady(ctx, vm, nil); err != nil {
+			t.Fatalf("VM didn't become ready: %v", err)
+		}
+		defer manager.DestroyVM(ctx, user)
+	}
+
+	hosts := manager.mdnsHosts()
+	if len(hosts) != 1 || hosts[0].Name != "alice" {
+		t.Fatalf("Expected only alice's VM to be announced, got %v", hosts)
+	}
+	alice, _ := manager.GetVM("alice")
+	if !hosts[0].IP.Equal(alice.IP) {
+		t.Errorf("Expected alice's VM to be announced at %s, got %s", alice.IP, hosts[0].IP)
+	}
+	if len(hosts[0].Services) != 1 || hosts[0].Services[0].Port != 8080 {
+		t.Errorf("Expected alice's labeled service, got %v", hosts[0].Services)
+	}
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// memoryFile holds the memory size chosen for a VM, so it keeps the size
+// across restarts
+const memoryFile = "memory"
+
+// MemoryBackend is implemented by backends that can resize running VMs.
+// VMs boot with VMMaxMemory, and SetMemory leaves mb of it to the guest,
+// like Firecracker does by inflating or deflating a balloon device.
+type MemoryBackend interface {
+	Backend
+	SetMemory(ctx context.Context, vm *VM, mb int) error
+}
+
+// Resizable reports whether VMs can change their memory size
+func (m *Manager) Resizable() bool {
+	_, ok := m.backend.(MemoryBackend)
+	return ok && m.config.VMMaxMemory > m.config.VMMemory
+}
+
+// Memory returns the memory size in MB that a VM runs with
+func (m *Manager) Memory(vmID string) int {
+	config, _ := m.vmConfig(vmID)
+	if !m.Resizable() {
+		return config.VMMemory
+	}
+	data, err := os.ReadFile(filepath.Join(m.config.DataDir, vmID, memoryFile))
+	if err != nil {
+		return config.VMMemory
+	}
+	mb, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return config.VMMemory
+	}
+	return min(max(mb, config.VMMemory), m.config.VMMaxMemory)
+}
+
+// ResizeMemory sets a VM's memory size in MB, between the configured VM
+// memory and VMMaxMemory. A running VM is resized right away, and the size
+// is kept for the VM's later boots. CPUs can't be resized, since Firecracker
+// has no vCPU hotplug.
+func (m *Manager) ResizeMemory(ctx context.Context, vmID string, mb int) error {
+	if err := validateVMID(vmID); err != nil {
+		return err
+	}
+	if !m.Resizable() {
+		return fmt.Errorf("VM memory can't be resized on this server")
+	}
+	if mb < m.config.VMMemory || mb > m.config.VMMaxMemory {
+		return fmt.Errorf("memory must be between %d and %d MB", m.config.VMMemory, m.config.VMMaxMemory)
+	}
+
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+
+	if vm, running := m.GetVM(vmID); running {
+		if err := m.backend.(MemoryBackend).SetMemory(ctx, vm, mb); err != nil {
+			return fmt.Errorf("failed to resize VM: %w", err)
+		}
+		vm.logger.Infof("Resized memory to %d MB", mb)
+	}
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM directory: %w", err)
+	}
+	return os.WriteFile(filepath.Join(vmDataDir, memoryFile), []byte(strconv.Itoa(mb)+"\n"), 0644)
+}
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResizeMemory(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+	if manager.Resizable() || manager.ResizeMemory(ctx, "alice", 256) == nil {
+		t.Fatalf("Expected VMs not to be resizable without a max memory")
+	}
+
+	manager.config.VMMaxMemory = 512
+	if !manager.Resizable() {
+		t.Fatalf("Expected VMs to be resizable")
+	}
+	if got := manager.Memory("alice"); got != 128 {
+		t.Errorf("Expected default memory of 128 MB, got %d", got)
+	}
+	for _, mb := range []int{64, 1024} {
+		if err := manager.ResizeMemory(ctx, "alice", mb); err == nil {
+			t.Errorf("Expected error resizing to %d MB", mb)
+		}
+	}
+
+	// Stopped VMs keep the size for their next boot, running VMs resize now
+	if err := manager.ResizeMemory(ctx, "alice", 256); err != nil {
+		t.Fatalf("Failed to resize stopped VM: %v", err)
+	}
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(ctx, vm.ID)
+	if got := manager.Memory("alice"); got != 256 {
+		t.Errorf("Expected 256 MB after resize, got %d", got)
+	}
+	if err := manager.ResizeMemory(ctx, "alice", 512); err != nil {
+		t.Fatalf("Failed to resize running VM: %v", err)
+	}
+	if got := manager.Memory("alice"); got != 512 {
+		t.Errorf("Expected 512 MB after resize, got %d", got)
+	}
+}
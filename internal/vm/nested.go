@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// nestedKVMLabel is the label of a VM, usually set from its user's profile in
+// the labels file, that gives it the CPU's virtualization extensions when the
+// server allows nested KVM
+const nestedKVMLabel = "nested-kvm" // "on" to let the guest use KVM
+
+// nestedKVMParams are the KVM module parameters that say whether the host
+// lets its guests run their own VMs, for Intel and AMD CPUs
+var nestedKVMParams = []string{
+	"/sys/module/kvm_intel/parameters/nested",
+	"/sys/module/kvm_amd/parameters/nested",
+}
+
+// hostNestedKVM reports whether the host's KVM module has nested
+// virtualization enabled. It's off by default on older kernels, and turned on
+// with a module option like "options kvm_intel nested=1".
+func hostNestedKVM(params []string) bool {
+	for _, param := range params {
+		data, err := os.ReadFile(param)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "Y", "1":
+			return true
+		}
+	}
+	return false
+}
+
+// cpuTemplate is the body of Firecracker's PUT /cpu-config, a custom CPU
+// template that changes the CPUID seen by the guest
+type cpuTemplate struct {
+	CPUIDModifiers []cpuidModifier `json:"cpuid_modifiers"`
+}
+
+// cpuidModifier changes registers of a CPUID leaf
+type cpuidModifier struct {
+	Leaf      string             `json:"leaf"`
+	Subleaf   string             `json:"subleaf"`
+	Flags     int                `json:"flags"`
+	Modifiers []registerModifier `json:"modifiers"`
+}
+
+// registerModifier sets the bits of a register given as 0 or 1 in a bitmap
+// of 32 characters, from the most significant, and leaves those given as x
+type registerModifier struct {
+	Register string `json:"register"`
+	Bitmap   string `json:"bitmap"`
+}
+
+// clearBit returns a register bitmap that clears one bit
+func clearBit(bit int) string {
+	bitmap := []byte(strings.Repeat("x", 32))
+	bitmap[31-bit] = '0'
+	return "0b" + string(bitmap)
+}
+
+// noVirtualization is the CPU template of VMs that may not use KVM, which
+// hides VMX on Intel and SVM on AMD. Each bit is reserved on the other
+// vendor's CPUs, so one template fits both.
+var noVirtualization = cpuTemplate{
+	CPUIDModifiers: []cpuidModifier{
+		{Leaf: "0x1", Subleaf: "0x0", Modifiers: []registerModifier{{Register: "ecx", Bitmap: clearBit(5)}}},
+		{Leaf: "0x80000001", Subleaf: "0x0", Modifiers: []registerModifier{{Register: "ecx", Bitmap: clearBit(2)}}},
+	},
+}
+
+// nestedKVM reports whether a VM may use KVM inside, which needs -nested-kvm
+// and the VM's nested-kvm=on label
+func (m *Manager) nestedKVM(vm *VM) bool {
+	if !m.config.NestedKVM {
+		return false
+	}
+	labels, err := m.Labels(vm.ID)
+	if err != nil {
+		vm.logger.Warnf("Failed to read labels for nested KVM: %v", err)
+		return false
+	}
+	return labels[nestedKVMLabel] == "on"
+}
+
+// hideVirtualizationHandler returns the handler that hides the CPU's
+// virtualization extensions from a VM before it boots
+func hideVirtualizationHandler() firecracker.Handler {
+	return firecracker.Handler{
+		Name: "hide-virtualization",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return putVMMConfig(ctx, m.Cfg.SocketPath, "/cpu-config", noVirtualization)
+		},
+	}
+}
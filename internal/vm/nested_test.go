@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHostNestedKVM(t *testing.T) {
+	dir := t.TempDir()
+	intel, amd := filepath.Join(dir, "kvm_intel"), filepath.Join(dir, "kvm_amd")
+	params := []string{intel, amd}
+	if hostNestedKVM(params) {
+		t.Errorf("Expected no nested KVM without the KVM modules")
+	}
+	os.WriteFile(intel, []byte("N\n"), 0644)
+	if hostNestedKVM(params) {
+		t.Errorf("Expected no nested KVM with nested=N")
+	}
+	os.WriteFile(amd, []byte("1\n"), 0644)
+	if !hostNestedKVM(params) {
+		t.Errorf("Expected nested KVM with kvm_amd nested=1")
+	}
+}
+
+func TestNoVirtualization(t *testing.T) {
+	body, err := json.Marshal(noVirtualization)
+	if err != nil {
+		t.Fatalf("Failed to marshal CPU template: %v", err)
+	}
+	vmx := `{"leaf":"0x1","subleaf":"0x0","flags":0,"modifiers":[{"register":"ecx","bitmap":"0bxxxxxxxxxxxxxxxxxxxxxxxxxx0xxxxx"}]}`
+	svm := `{"leaf":"0x80000001","subleaf":"0x0","flags":0,"modifiers":[{"register":"ecx","bitmap":"0bxxxxxxxxxxxxxxxxxxxxxxxxxxxxx0xx"}]}`
+	if !strings.Contains(string(body), vmx) || !strings.Contains(string(body), svm) {
+		t.Errorf("Expected VMX and SVM to be cleared, got %s", body)
+	}
+}
+
+func TestNestedKVMLabel(t *testing.T) {
+	manager := newTestManager(t)
+	if err := manager.SetLabels("alice", map[string]string{nestedKVMLabel: "on"}); err != nil {
+		t.Fatalf("Failed to label VM: %v", err)
+	}
+	alice := &VM{ID: "alice", logger: logrus.NewEntry(logrus.StandardLogger())}
+	bob := &VM{ID: "bob", logger: logrus.NewEntry(logrus.StandardLogger())}
+
+	if manager.nestedKVM(alice) {
+		t.Errorf("Expected no nested KVM without -nested-kvm")
+	}
+	manager.config.NestedKVM = true
+	if !manager.nestedKVM(alice) {
+		t.Errorf("Expected nested KVM for a VM labeled nested-kvm=on")
+	}
+	if manager.nestedKVM(bob) {
+		t.Errorf("Expected no nested KVM for a VM without the label")
+	}
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+// NetworkPlan returns the host networking commands the server runs for a
+// configuration, as lines of a shell script, without running any of them.
+// Operators can review the plan, or run it ahead of time where the server
+// isn't allowed to change the host.
+func NetworkPlan(config *internal.Config) ([]string, error) {
+	ipNets, err := config.GetVMIPRanges()
+	if err != nil {
+		return nil, fmt.Errorf("invalid VM CIDR: %w", err)
+	}
+	ipPool, err := NewIPPool(ipNets...)
+	if err != nil {
+		return nil, err
+	}
+	egressBlock, err := ParsePortRules(config.EgressBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse egress blocklist: %w", err)
+	}
+	m := &Manager{config: config, ipPool: ipPool, egressBlock: egressBlock, bridgeName: BridgeName}
+	return m.networkPlan(), nil
+}
+
+// networkPlan returns the commands of setupNetworkBridge, the firewall
+// setup, and setupTAPDevice for every address in the pool
+func (m *Manager) networkPlan() []string {
+	plan := []string{"# Bridge, with the gateway address of each VM network", "ip link add name " + m.bridgeName + " type bridge"}
+	for _, network := range m.ipPool.Networks() {
+		maskSize, _ := network.Mask.Size()
+		plan = append(plan, fmt.Sprintf("ip addr add %s/%d dev %s", Gateway(network), maskSize, m.bridgeName))
+	}
+	plan = append(plan, "ip link set dev "+m.bridgeName+" up", "")
+
+	if m.config.ContainerMode {
+		plan = append(plan, "# IP forwarding is only checked in container mode, so the orchestrator must set it", "# sysctl -w net.ipv4.ip_forward=1", "")
+	} else {
+		plan = append(plan, "# IP forwarding, if it is off", "sysctl -w net.ipv4.ip_forward=1", "")
+	}
+
+	plan = append(plan, "# Firewall, after removing rules commented \"ssh-hypervisor\" and the "+egressChain+" and traffic chains left by an earlier run")
+	for _, rule := range m.hostProtectionRules() {
+		plan = append(plan, iptablesCommand("-I", rule, "1"))
+	}
+	if m.config.AllowInternet {
+		plan = append(plan, "iptables -t filter -N "+egressChain)
+		for _, rule := range m.internetRules() {
+			plan = append(plan, iptablesCommand("-A", rule))
+		}
+	}
+	if m.config.CountTraffic {
+		plan = append(plan, "iptables -t filter -N "+trafficInChain, "iptables -t filter -N "+trafficOutChain)
+		for _, rule := range m.trafficJumpRules() {
+			plan = append(plan, iptablesCommand("-I", rule, "1"))
+		}
+	}
+	plan = append(plan, "")
+
+	plan = append(plan, "# A TAP device for each VM address, set up when the VM starts")
+	if m.config.MoshPorts != "" {
+		plan = append(plan, "# VMs also get DNAT rules for their mosh ports, which are allocated when they start")
+	}
+	if m.config.CountTraffic {
+		plan = append(plan, "# VMs also get rules in the traffic chains counting their traffic, added when they start")
+	}
+	for i := 0; i < m.ipPool.size; i++ {
+		tapName := tapDeviceName(i)
+		plan = append(plan,
+			"ip tuntap add "+tapName+" mode tap",
+			"ip link set dev "+tapName+" master "+m.bridgeName,
+			"ip link set dev "+tapName+" up",
+		)
+	}
+	return plan
+}
+
+// iptablesCommand formats a (table, chain, rulespec) triple as an iptables
+// command line, with the rule number for inserts after the chain
+func iptablesCommand(op string, rule []string, position ...string) string {
+	args := append([]string{"iptables", "-t", rule[0], op, rule[1]}, position...)
+	return strings.Join(append(args, rule[2:]...), " ")
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestNetworkPlan(t *testing.T) {
+	config := &internal.Config{
+		Port:          2222,
+		VMCIDR:        "10.10.0.0/28,10.20.0.0/28",
+		AllowInternet: true,
+		EgressBlock:   "tcp/25",
+	}
+	plan, err := NetworkPlan(config)
+	if err != nil {
+		t.Fatalf("Failed to plan network: %v", err)
+	}
+
+	for _, want := range []string{
+		"ip link add name sshvm-br0 type bridge",
+		"ip addr add 10.10.0.1/28 dev sshvm-br0",
+		"ip addr add 10.20.0.1/28 dev sshvm-br0",
+		"sysctl -w net.ipv4.ip_forward=1",
+		"iptables -t filter -I INPUT 1 -i sshvm-br0 -p tcp --dport 2222 -m conntrack --ctstate NEW -j REJECT --reject-with tcp-reset -m comment --comment ssh-hypervisor",
+		"iptables -t filter -A SSHVM-EGRESS -p tcp --dport 25:25 -j REJECT --reject-with tcp-reset",
+		"iptables -t nat -A POSTROUTING -s 10.20.0.0/28 ! -o sshvm-br0 -j MASQUERADE -m comment --comment ssh-hypervisor",
+		"ip tuntap add sshvm-tap-0 mode tap",
+		"ip tuntap add sshvm-tap-19 mode tap", // The last of 2*13 addresses
+	} {
+		if !slices.Contains(plan, want) {
+			t.Errorf("Expected plan to contain %q, got:\n%s", want, strings.Join(plan, "\n"))
+		}
+	}
+	if slices.Contains(plan, "ip tuntap add sshvm-tap-1a mode tap") {
+		t.Errorf("Expected one TAP device per address")
+	}
+
+	// Without Internet access, VMs get no forwarding or NAT rules
+	config.AllowInternet = false
+	config.ContainerMode = true
+	plan, err = NetworkPlan(config)
+	if err != nil {
+		t.Fatalf("Failed to plan network: %v", err)
+	}
+	for _, line := range plan {
+		if strings.Contains(line, "FORWARD") || strings.Contains(line, "POSTROUTING") {
+			t.Errorf("Expected no forwarding rules without Internet access, got %q", line)
+		}
+		if strings.HasPrefix(line, "sysctl") {
+			t.Errorf("Expected no sysctl in container mode, got %q", line)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal/objstore"
+)
+
+// ObjectStore keeps stopped VMs' disks and snapshots off the host, so any
+// host can start any VM, like objstore.Store
+type ObjectStore interface {
+	Download(ctx context.Context, key, path string) (string, error)
+	Upload(ctx context.Context, key, path string) (string, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]objstore.Object, error)
+}
+
+// ImageCacheDir is the directory in the data directory that golden images
+// downloaded from object storage are cached in. VM IDs can't contain dots,
+// so it never clashes with a VM's directory.
+const ImageCacheDir = "images.cache"
+
+// syncedRecord is the file in a VM's data directory with the ETags of its
+// disks when they were last synced with object storage, so unchanged disks
+// aren't downloaded again
+const syncedRecord = "synced.json"
+
+// objectDeleteTimeout bounds removing a VM's objects, which may take a
+// request per object
+const objectDeleteTimeout = 2 * time.Minute
+
+// vmKeyPrefix and snapshotKeyPrefix are where a VM's disks and snapshots are
+// kept in object storage
+func vmKeyPrefix(vmID string) string       { return "vms/" + vmID + "/" }
+func snapshotKeyPrefix(vmID string) string { return "snapshots/" + vmID + "/" }
+
+// readSynced returns the ETags of a VM's disks when they were last synced
+func readSynced(vmDataDir string) map[string]string {
+	synced := make(map[string]string)
+	if data, err := os.ReadFile(filepath.Join(vmDataDir, syncedRecord)); err == nil {
+		json.Unmarshal(data, &synced)
+	}
+	return synced
+}
+
+// writeSynced records the ETags of a VM's disks after syncing them
+func writeSynced(vmDataDir string, synced map[string]string) error {
+	data, err := json.Marshal(synced)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(vmDataDir, syncedRecord), data, 0644)
+}
+
+// pullDisks brings a VM's disks up to date from object storage before it
+// boots. Disks that haven't changed since they were last synced are kept.
+// If object storage has no disks for the VM, its local ones are used as is.
+func (m *Manager) pullDisks(ctx context.Context, vmID string) error {
+	objects, err := m.objects.List(ctx, vmKeyPrefix(vmID))
+	if err != nil {
+		return fmt.Errorf("failed to list disks in object storage: %w", err)
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM data directory: %w", err)
+	}
+	synced := readSynced(vmDataDir)
+	remote := make(map[string]string)
+	for _, object := range objects {
+		file := path.Base(object.Key)
+		if !slices.Contains(sealedDisks, strings.TrimSuffix(file, sealedSuffix)) {
+			continue
+		}
+		remote[file] = object.ETag
+		if _, err := os.Stat(filepath.Join(vmDataDir, file)); err == nil && synced[file] == object.ETag {
+			continue
+		}
+		m.logger.Printf("Downloading %s of VM %s from object storage", file, vmID)
+		if _, err := m.objects.Download(ctx, object.Key, filepath.Join(vmDataDir, file)); err != nil {
+			return err
+		}
+	}
+	// Object storage has the latest disks, so others are stale
+	for _, file := range diskFiles(vmDataDir) {
+		if _, ok := remote[file]; !ok {
+			os.Remove(filepath.Join(vmDataDir, file))
+		}
+	}
+	return writeSynced(vmDataDir, remote)
+}
+
+// pushDisks uploads a stopped VM's disks to object storage
+func (m *Manager) pushDisks(ctx context.Context, vmID string) error {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	files := diskFiles(vmDataDir)
+	if len(files) == 0 {
+		return nil
+	}
+	synced := make(map[string]string)
+	for _, file := range files {
+		etag, err := m.objects.Upload(ctx, vmKeyPrefix(vmID)+file, filepath.Join(vmDataDir, file))
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", file, err)
+		}
+		synced[file] = etag
+	}
+	// Like a plaintext disk left from before it was sealed
+	for _, name := range sealedDisks {
+		for _, file := range []string{name, name + sealedSuffix} {
+			if _, ok := synced[file]; !ok {
+				if err := m.objects.Delete(ctx, vmKeyPrefix(vmID)+file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return writeSynced(vmDataDir, synced)
+}
+
+// pushSnapshot uploads a VM's snapshot to object storage
+func (m *Manager) pushSnapshot(ctx context.Context, vmID, name string) error {
+	dir := filepath.Join(m.config.DataDir, vmID, snapshotDir, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := m.objects.Upload(ctx, snapshotKeyPrefix(vmID)+name+"/"+entry.Name(), filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to upload snapshot %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pullSnapshot downloads a VM's snapshot from object storage. A copy the
+// host already has may be stale, since the snapshot may have been deleted
+// and saved again on another host.
+func (m *Manager) pullSnapshot(ctx context.Context, vmID, name string) error {
+	dir := filepath.Join(m.config.DataDir, vmID, snapshotDir, name)
+	objects, err := m.objects.List(ctx, snapshotKeyPrefix(vmID)+name+"/")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+	// Downloaded under a temporary name, so a partial snapshot is never used
+	tmpDir := dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, object := range objects {
+		if _, err := m.objects.Download(ctx, object.Key, filepath.Join(tmpDir, path.Base(object.Key))); err != nil {
+			return err
+		}
+	}
+	m.storeSnapshot(tmpDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+// remoteSnapshots returns the snapshots of a VM in object storage
+func (m *Manager) remoteSnapshots(ctx context.Context, vmID string) ([]Snapshot, error) {
+	objects, err := m.objects.List(ctx, snapshotKeyPrefix(vmID))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, object := range objects {
+		name, _, _ := strings.Cut(strings.TrimPrefix(object.Key, snapshotKeyPrefix(vmID)), "/")
+		if !slices.ContainsFunc(snapshots, func(s Snapshot) bool { return s.Name == name }) {
+			snapshots = append(snapshots, Snapshot{Name: name, Created: object.LastModified})
+		}
+	}
+	return snapshots, nil
+}
+
+// deleteObjects removes every object under a prefix
+func (m *Manager) deleteObjects(ctx context.Context, prefix string) error {
+	objects, err := m.objects.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, object := range objects {
+		if err := m.objects.Delete(ctx, object.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
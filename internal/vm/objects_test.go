@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/objstore"
+)
+
+// memoryStore is an ObjectStore in memory
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+	version int
+}
+
+func (s *memoryStore) Download(ctx context.Context, key, path string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return "", fs.ErrNotExist
+	}
+	return s.etag(data), os.WriteFile(path, []byte(data), 0644)
+}
+
+func (s *memoryStore) Upload(ctx context.Context, key, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = string(data)
+	return s.etag(string(data)), nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string) ([]objstore.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []objstore.Object
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, objstore.Object{Key: key, ETag: s.etag(data), Size: int64(len(data)), LastModified: time.Now()})
+		}
+	}
+	return objects, nil
+}
+
+func (s *memoryStore) etag(data string) string {
+	return fmt.Sprintf("%q", data)
+}
+
+func TestObjectStorage(t *testing.T) {
+	store := &memoryStore{objects: make(map[string]string)}
+
+	// Two hosts with their own data directories share the store
+	newHost := func() *Manager {
+		manager := newTestManager(t, func(c *internal.Config) { c.Snapshots = 3 })
+		manager.objects = store
+		return manager
+	}
+	hostA, hostB := newHost(), newHost()
+
+	ctx := context.Background()
+	if _, err := hostA.GetOrCreateVM(ctx, "alice", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	os.WriteFile(filepath.Join(hostA.config.DataDir, "alice", "rootfs.img"), []byte("written on a"), 0644)
+	if err := hostA.ReleaseVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+	if store.objects["vms/alice/rootfs.img"] != "written on a" {
+		t.Fatalf("Expected the stopped VM's disk to be uploaded, got %v", store.objects)
+	}
+
+	// The VM continues on the other host
+	if _, err := hostB.GetOrCreateVM(ctx, "alice", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(hostB.config.DataDir, "alice", "rootfs.img")); string(data) != "written on a" {
+		t.Errorf("Expected the disk from object storage, got %q", data)
+	}
+	hostB.ReleaseVM(ctx, "alice")
+	if err := hostB.SnapshotVM(ctx, "alice", "from-b"); err != nil {
+		t.Fatalf("Failed to snapshot VM: %v", err)
+	}
+
+	// Snapshots are visible to and restored on every host
+	snapshots, err := hostA.ListSnapshots("alice")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "from-b" {
+		t.Fatalf("Expected the snapshot from b, got %v, %v", snapshots, err)
+	}
+	if err := hostA.RestoreSnapshot(ctx, "alice", "from-b"); err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if err := hostA.DeleteSnapshot("alice", "from-b"); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	if snapshots, _ := hostB.ListSnapshots("alice"); len(snapshots) != 0 {
+		t.Errorf("Expected the snapshot deleted on a to be gone on b, got %v", snapshots)
+	}
+
+	if err := hostA.RemoveVM("alice"); err != nil {
+		t.Fatalf("Failed to remove VM: %v", err)
+	}
+	if len(store.objects) != 0 {
+		t.Errorf("Expected removing the VM to empty object storage, got %v", store.objects)
+	}
+}
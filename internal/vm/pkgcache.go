@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// packageCacheCommand returns a shell command that points a guest's package
+// managers at the package cache: the Alpine and Debian repositories it
+// already uses, and pip and npm through their environment variables
+func packageCacheCommand(gateway net.IP, port int) string {
+	base := "http://" + net.JoinHostPort(gateway.String(), strconv.Itoa(port))
+	env := environmentCommand([][2]string{
+		{"PIP_INDEX_URL", base + "/pypi/simple/"},
+		{"PIP_TRUSTED_HOST", gateway.String()},
+		{"NPM_CONFIG_REGISTRY", base + "/npm/"},
+	})
+	// Repositories keep their release and component, and rewriting them again
+	// on the next boot changes nothing
+	return fmt.Sprintf("%s; "+
+		"[ -f /etc/apk/repositories ] && sed -i -E 's#https?://[^/ ]+/alpine/#%s/alpine/#' /etc/apk/repositories; "+
+		"for f in /etc/apt/sources.list /etc/apt/sources.list.d/*.list /etc/apt/sources.list.d/*.sources; do "+
+		"[ -f \"$f\" ] && sed -i -E 's#https?://(deb|security)\\.debian\\.org/#%s/#' \"$f\"; done; true",
+		env, base, base)
+}
+
+// writeGuestPackageCache points the guest's package managers at the package
+// cache, if it is enabled
+func (m *Manager) writeGuestPackageCache(ctx context.Context, vm *VM) error {
+	if m.config.PackageCache == 0 {
+		return nil
+	}
+	return m.runGuestSetup(ctx, vm, packageCacheCommand(vm.Gateway, m.config.PackageCache))
+}
+
+// podmanMirrorConf is where guests with Podman, or other tools using
+// containers/image, are told to pull Docker Hub images through the registry
+// cache
+const podmanMirrorConf = "/etc/containers/registries.conf.d/90-ssh-hypervisor-mirror.conf"
+
+// registryCacheCommand returns a shell command that points Podman and Docker
+// in a guest at the registry cache. Docker is only configured if it has no
+// daemon.json yet, which is then reloaded if Docker is running.
+func registryCacheCommand(gateway net.IP, port int) string {
+	addr := net.JoinHostPort(gateway.String(), strconv.Itoa(port))
+	podman := []string{
+		`[[registry]]`, `prefix = "docker.io"`, `location = "docker.io"`,
+		`[[registry.mirror]]`, `location = "` + addr + `"`, `insecure = true`,
+	}
+	docker := fmt.Sprintf(`{"registry-mirrors": ["http://%s"], "insecure-registries": ["%s"]}`, addr, addr)
+	// Every character in these lines is safe in single quotes
+	return fmt.Sprintf("if [ -d /etc/containers ]; then mkdir -p %s && printf '%%s\\n' '%s' > %s; fi; "+
+		"if command -v dockerd >/dev/null && [ ! -s /etc/docker/daemon.json ]; then "+
+		"mkdir -p /etc/docker && echo '%s' > /etc/docker/daemon.json && { pkill -HUP -x dockerd; true; }; fi",
+		path.Dir(podmanMirrorConf), strings.Join(podman, "' '"), podmanMirrorConf, docker)
+}
+
+// writeGuestRegistryCache points the guest's container tools at the registry
+// cache, if it is enabled
+func (m *Manager) writeGuestRegistryCache(ctx context.Context, vm *VM) error {
+	if m.config.RegistryCache == 0 {
+		return nil
+	}
+	return m.runGuestSetup(ctx, vm, registryCacheCommand(vm.Gateway, m.config.RegistryCache))
+}
@@ -0,0 +1,33 @@
+package vm
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPackageCacheCommand(t *testing.T) {
+	got := packageCacheCommand(net.ParseIP("192.168.100.1"), 3142)
+	for _, want := range []string{
+		"'PIP_INDEX_URL=http://192.168.100.1:3142/pypi/simple/' 'PIP_TRUSTED_HOST=192.168.100.1' 'NPM_CONFIG_REGISTRY=http://192.168.100.1:3142/npm/'",
+		"s#https?://[^/ ]+/alpine/#http://192.168.100.1:3142/alpine/#",
+		"/^(PIP_INDEX_URL|PIP_TRUSTED_HOST|NPM_CONFIG_REGISTRY)=/d",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected package cache command to contain %s, got: %s", want, got)
+		}
+	}
+}
+
+func TestRegistryCacheCommand(t *testing.T) {
+	got := registryCacheCommand(net.ParseIP("192.168.100.1"), 5000)
+	for _, want := range []string{
+		`'[[registry.mirror]]' 'location = "192.168.100.1:5000"' 'insecure = true' > ` + podmanMirrorConf,
+		`{"registry-mirrors": ["http://192.168.100.1:5000"], "insecure-registries": ["192.168.100.1:5000"]}`,
+		"[ ! -s /etc/docker/daemon.json ]",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected registry cache command to contain %s, got: %s", want, got)
+		}
+	}
+}
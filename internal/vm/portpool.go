@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortRange is an inclusive range of host ports
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// ParsePortRange parses a port range of the form "60000-61000"
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return PortRange{}, fmt.Errorf("invalid port range %q, expected FIRST-LAST", s)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{First: first, Last: last}, nil
+}
+
+// Size returns the number of ports in the range
+func (r PortRange) Size() int {
+	return r.Last - r.First + 1
+}
+
+// String formats the range as "FIRST:LAST", as understood by iptables and mosh
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d:%d", r.First, r.Last)
+}
+
+// PortPool hands out fixed-size blocks of ports from a larger range
+type PortPool struct {
+	ports     PortRange
+	blockSize int
+	allocated map[int]bool // Keyed by first port of each block
+	mu        sync.Mutex
+}
+
+// NewPortPool creates a new pool dividing ports into blocks of blockSize
+func NewPortPool(ports PortRange, blockSize int) (*PortPool, error) {
+	if blockSize < 1 {
+		return nil, fmt.Errorf("port block size must be at least 1")
+	}
+	if ports.Size() < blockSize {
+		return nil, fmt.Errorf("port range %s is smaller than block size %d", ports, blockSize)
+	}
+	return &PortPool{
+		ports:     ports,
+		blockSize: blockSize,
+		allocated: make(map[int]bool),
+	}, nil
+}
+
+// Allocate reserves the first free block of ports
+func (p *PortPool) Allocate() (PortRange, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for first := p.ports.First; first+p.blockSize-1 <= p.ports.Last; first += p.blockSize {
+		if !p.allocated[first] {
+			p.allocated[first] = true
+			return PortRange{First: first, Last: first + p.blockSize - 1}, nil
+		}
+	}
+
+	return PortRange{}, fmt.Errorf("no available port blocks")
+}
+
+// Release returns a block of ports to the pool
+func (p *PortPool) Release(r PortRange) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.allocated, r.First)
+}
+
+// Available returns the number of free blocks
+func (p *PortPool) Available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ports.Size()/p.blockSize - len(p.allocated)
+}
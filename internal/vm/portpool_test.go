@@ -0,0 +1,75 @@
+package vm
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	r, err := ParsePortRange("60000-60999")
+	if err != nil {
+		t.Fatalf("Failed to parse port range: %v", err)
+	}
+	if r.First != 60000 || r.Last != 60999 {
+		t.Errorf("Unexpected port range: %+v", r)
+	}
+	if r.Size() != 1000 {
+		t.Errorf("Expected size 1000, got %d", r.Size())
+	}
+	if r.String() != "60000:60999" {
+		t.Errorf("Unexpected string form: %s", r.String())
+	}
+
+	for _, bad := range []string{"", "60000", "a-b", "0-10", "10-5", "60000-70000"} {
+		if _, err := ParsePortRange(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestPortPoolAllocation(t *testing.T) {
+	pool, err := NewPortPool(PortRange{First: 60000, Last: 60024}, 10)
+	if err != nil {
+		t.Fatalf("Failed to create port pool: %v", err)
+	}
+
+	// 25 ports only fit two full blocks of 10
+	if pool.Available() != 2 {
+		t.Errorf("Expected 2 available blocks, got %d", pool.Available())
+	}
+
+	r1, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Failed to allocate block: %v", err)
+	}
+	if r1.First != 60000 || r1.Last != 60009 {
+		t.Errorf("Unexpected first block: %+v", r1)
+	}
+
+	r2, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Failed to allocate second block: %v", err)
+	}
+	if r2.First != 60010 {
+		t.Errorf("Unexpected second block: %+v", r2)
+	}
+
+	if _, err := pool.Allocate(); err == nil {
+		t.Errorf("Expected error when allocating from exhausted pool")
+	}
+
+	pool.Release(r1)
+	r3, err := pool.Allocate()
+	if err != nil {
+		t.Fatalf("Failed to allocate after release: %v", err)
+	}
+	if r3 != r1 {
+		t.Errorf("Expected to get back the same block after release: %+v != %+v", r3, r1)
+	}
+}
+
+func TestPortPoolInvalid(t *testing.T) {
+	if _, err := NewPortPool(PortRange{First: 60000, Last: 60004}, 10); err == nil {
+		t.Errorf("Expected error when range is smaller than block size")
+	}
+	if _, err := NewPortPool(PortRange{First: 60000, Last: 60004}, 0); err == nil {
+		t.Errorf("Expected error with zero block size")
+	}
+}
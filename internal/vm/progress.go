@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bootTimeout is how long WaitReady waits for a VM's SSH server
+const bootTimeout = 15 * time.Second
+
+// ProgressStage is a milestone reached while provisioning a VM
+type ProgressStage string
+
+const (
+	StageQueued        ProgressStage = "queued"         // Waiting for other VMs' disk copies to finish
+	StageRootfsReady   ProgressStage = "rootfs-ready"   // Writable disk prepared
+	StageIPAllocated   ProgressStage = "ip-allocated"   // Network address reserved
+	StageVMMStarted    ProgressStage = "vmm-started"    // Hypervisor process running
+	StageKernelBooting ProgressStage = "kernel-booting" // Guest produced console output
+	StageSSHReady      ProgressStage = "ssh-ready"      // Guest SSH server accepts connections
+)
+
+// ProgressEvent reports that a VM reached a provisioning stage
+type ProgressEvent struct {
+	VMID   string
+	Stage  ProgressStage
+	State  State // The VM's state when it reached the stage
+	Time   time.Time
+	Detail string // What was set up, like the VM's IP, for debugging boots
+}
+
+// sendProgress reports a stage on the progress channel without blocking, so a
+// slow or departed consumer can never stall the Manager. Channels should be
+// buffered to hold every stage.
+func sendProgress(progress chan<- ProgressEvent, vmID string, state State, stage ProgressStage, detail string) {
+	if progress == nil {
+		return
+	}
+	select {
+	case progress <- ProgressEvent{VMID: vmID, Stage: stage, State: state, Time: time.Now(), Detail: detail}:
+	default:
+	}
+}
+
+// WaitReady waits until the VM's SSH server accepts connections, reporting
+// kernel-booting and ssh-ready on the progress channel (which may be nil)
+func (m *Manager) WaitReady(ctx context.Context, vm *VM, progress chan<- ProgressEvent) error {
+	timeout := time.After(bootTimeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	kernelBooting := false
+	for {
+		if !kernelBooting && vm.hasConsoleOutput() {
+			kernelBooting = true
+			sendProgress(progress, vm.ID, vm.State(), StageKernelBooting, "console output after "+time.Since(start).Round(time.Millisecond).String())
+		}
+
+		conn, err := net.DialTimeout("tcp", vm.SSHAddr(), 1*time.Second)
+		if err == nil {
+			conn.Close()
+			if !kernelBooting {
+				sendProgress(progress, vm.ID, vm.State(), StageKernelBooting, "")
+			}
+			if vm.State() == StateBooting {
+				vm.setState(StateReady, "")
+			}
+			sendProgress(progress, vm.ID, vm.State(), StageSSHReady, fmt.Sprintf("%s accepted a connection after %s", vm.SSHAddr(), time.Since(start).Round(time.Millisecond)))
+			vm.logger.Debugf("VM SSH service is ready at %s", vm.SSHAddr())
+			m.events.Record(vm.ID, EventBooted, fmt.Sprintf("after %s", time.Since(start).Round(time.Millisecond)))
+			m.afterBoot(ctx, vm)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			m.events.Record(vm.ID, EventBootFailed, ErrBootTimeout.Error())
+			if vm.State() == StateBooting {
+				vm.setState(StateFailed, ErrBootTimeout.Error())
+			}
+			return ErrBootTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+// afterBoot sets up the guest and runs the post-boot hook the first time a
+// VM's guest is reachable after it started. Failures are only logged, since
+// the VM is already running.
+func (m *Manager) afterBoot(ctx context.Context, vm *VM) {
+	vm.postBoot.Do(func() {
+		if err := m.syncGuestClock(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to set the guest's clock: %v", err)
+		}
+		if err := m.seedGuestEntropy(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to seed the guest's entropy pool: %v", err)
+		}
+		if err := m.writeGuestHosts(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to update /etc/hosts in the guest: %v", err)
+		}
+		if err := m.writeGuestProxy(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to configure the egress proxy in the guest: %v", err)
+		}
+		if err := m.writeGuestPackageCache(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to point the guest at the package cache: %v", err)
+		}
+		if err := m.writeGuestRegistryCache(ctx, vm); err != nil {
+			vm.logger.Warnf("Failed to point the guest at the registry cache: %v", err)
+		}
+		if err := m.runHook(ctx, HookPostBoot, vm); err != nil {
+			vm.logger.Errorf("%v", err)
+		}
+	})
+}
+
+// hasConsoleOutput reports whether the guest has written to its serial console
+func (vm *VM) hasConsoleOutput() bool {
+	info, err := os.Stat(filepath.Join(vm.dataDir, "console.out"))
+	return err == nil && info.Size() > 0
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// aptProxyConf is where guests with apt are told to use the egress proxy,
+// since sudo drops the proxy variables from the environment
+const aptProxyConf = "/etc/apt/apt.conf.d/90ssh-hypervisor-proxy"
+
+// environmentCommand returns a shell command that sets variables in a
+// guest's /etc/environment, which SSH sessions read, replacing any earlier
+// values. Every character in the names and values must be safe in single
+// quotes.
+func environmentCommand(vars [][2]string) string {
+	names := make([]string, len(vars))
+	lines := make([]string, len(vars))
+	for i, v := range vars {
+		names[i] = v[0]
+		lines[i] = v[0] + "=" + v[1]
+	}
+	return fmt.Sprintf("touch /etc/environment && sed -i -E '/^(%s)=/d' /etc/environment && printf '%%s\\n' '%s' >> /etc/environment",
+		strings.Join(names, "|"), strings.Join(lines, "' '"))
+}
+
+// proxyCommand returns a shell command that points a guest's programs at the
+// egress proxy, with the proxy variables and apt's configuration if it is
+// installed. Other services on the gateway are reached directly.
+func proxyCommand(gateway net.IP, port int) string {
+	proxyURL := "http://" + net.JoinHostPort(gateway.String(), strconv.Itoa(port))
+	noProxy := "localhost,127.0.0.1," + gateway.String()
+	var vars [][2]string
+	for _, name := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		value := proxyURL
+		if name == "no_proxy" {
+			value = noProxy
+		}
+		vars = append(vars, [2]string{name, value}, [2]string{strings.ToUpper(name), value})
+	}
+	apt := fmt.Sprintf(`Acquire::http::Proxy "%s"; Acquire::https::Proxy "%s"; Acquire::http::Proxy::%s "DIRECT";`, proxyURL, proxyURL, gateway)
+	return fmt.Sprintf("%s && if [ -d /etc/apt/apt.conf.d ]; then echo '%s' > %s; fi", environmentCommand(vars), apt, aptProxyConf)
+}
+
+// writeGuestProxy tells the guest to reach the Internet through the egress
+// proxy, if it is enabled
+func (m *Manager) writeGuestProxy(ctx context.Context, vm *VM) error {
+	if m.config.EgressProxy == 0 {
+		return nil
+	}
+	return m.runGuestSetup(ctx, vm, proxyCommand(vm.Gateway, m.config.EgressProxy))
+}
+
+// runGuestSetup runs a command configuring the guest, with its output in the
+// error if it fails
+func (m *Manager) runGuestSetup(ctx context.Context, vm *VM, command string) error {
+	if out, err := vm.RunCommand(ctx, command); err != nil {
+		if out = strings.TrimSpace(out); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package vm
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyCommand(t *testing.T) {
+	got := proxyCommand(net.ParseIP("192.168.100.1"), 3128)
+	for _, want := range []string{
+		"'http_proxy=http://192.168.100.1:3128' 'HTTP_PROXY=http://192.168.100.1:3128'",
+		"'no_proxy=localhost,127.0.0.1,192.168.100.1'",
+		`Acquire::https::Proxy "http://192.168.100.1:3128";`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected proxy command to contain %s, got: %s", want, got)
+		}
+	}
+}
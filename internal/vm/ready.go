@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HealthBackend is implemented by backends that can check that the host
+// resources they set up, like a network bridge, are still in place
+type HealthBackend interface {
+	Backend
+	CheckHost(m *Manager) error
+}
+
+// CheckReady returns why a new VM can't be started right now, or nil if one
+// can. A VM can't start when the backend's host resources are missing, when
+// every VM slot or address is taken, or when the data directory is too full.
+func (m *Manager) CheckReady() error {
+	var errs []error
+	if hb, ok := m.backend.(HealthBackend); ok {
+		if err := hb.CheckHost(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	m.mutex.RLock()
+	busy := len(m.vms) + len(m.transitions)
+	m.mutex.RUnlock()
+	if max := m.config.MaxConcurrentVMs; max > 0 && busy >= max {
+		errs = append(errs, fmt.Errorf("%w (limit %d)", ErrCapacity, max))
+	}
+	if m.ipPool.Available() == 0 {
+		errs = append(errs, fmt.Errorf("all %d VM addresses are in use", m.ipPool.Size()))
+	}
+	if err := m.checkFreeSpace(0); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
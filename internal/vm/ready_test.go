@@ -0,0 +1,34 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestCheckReady(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.MaxConcurrentVMs = 1 })
+	if err := manager.CheckReady(); err != nil {
+		t.Fatalf("Expected a new manager to be ready, got %v", err)
+	}
+
+	if _, err := manager.GetOrCreateVM(context.Background(), "testuser", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if err := manager.CheckReady(); !errors.Is(err, ErrCapacity) {
+		t.Errorf("Expected ErrCapacity with every slot taken, got %v", err)
+	}
+	if err := manager.DestroyVM(context.Background(), "testuser"); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+	if err := manager.CheckReady(); err != nil {
+		t.Errorf("Expected the manager to be ready again, got %v", err)
+	}
+
+	manager.config.MinFreeSpace = 1 << 30
+	if err := manager.CheckReady(); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Expected ErrDiskFull, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+// validateVMID checks that a VM ID is alphanumeric with - and _, not empty, and at most 48 chars
+func validateVMID(vmID string) error {
+	if vmID == "" {
+		return fmt.Errorf("VM ID cannot be empty")
+	}
+	if strings.Trim(vmID, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return fmt.Errorf("invalid VM ID: %s", vmID)
+	}
+	if len(vmID) > 48 {
+		return fmt.Errorf("VM ID too long: %s", vmID)
+	}
+	return nil
+}
+
+// prepareRootfs copies the golden rootfs of the VM's config into its data
+// directory with the storage driver, unless it is already there. The copy is
+// written to a temporary file and linked into place, so concurrent callers
+// for the same VM never see a partial image.
+func (m *Manager) prepareRootfs(ctx context.Context, vmID string, config *internal.Config, progress chan<- ProgressEvent) error {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if m.config.RootfsMode == internal.RootfsEphemeral {
+		// Nothing to prepare, the VM only writes to memory
+		if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+			return fmt.Errorf("failed to create VM data directory: %w", err)
+		}
+		return nil
+	}
+
+	if m.objects != nil {
+		if err := m.pullDisks(ctx, vmID); err != nil {
+			return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+		}
+	}
+	if m.masterKey != nil {
+		if err := m.unsealDisks(vmID); err != nil {
+			return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+		}
+	}
+
+	rootfsPath := filepath.Join(vmDataDir, "rootfs.img")
+	if _, err := os.Stat(rootfsPath); err == nil {
+		return nil
+	}
+	if usesOverlay(config, vmDataDir) {
+		return m.prepareOverlay(vmDataDir, config.OverlaySize)
+	}
+
+	// Refuse up front rather than failing mid-copy once the disk fills up
+	src, err := os.Open(config.Rootfs)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+	}
+	if err := m.checkFreeSpace(info.Size()); err != nil {
+		return err
+	}
+
+	release, err := m.acquireIO(ctx, vmID, progress)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM data directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(vmDataDir, "rootfs.img.tmp-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	m.journalRecord(vmID, journalCopy, journalEntry{Path: tmp.Name()})
+
+	volume, err := m.storage.Clone(ctx, storageName(vmID), config.Rootfs, tmp.Name())
+	if err == nil && volume != "" {
+		err = recordVolume(vmDataDir, m.config.Storage, volume)
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), rootfsPath)
+	}
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		if volume != "" {
+			m.storage.Remove(volume)
+			os.Remove(filepath.Join(vmDataDir, storageRecord))
+		}
+		return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+	}
+	return nil
+}
+
+// usesOverlay reports whether a VM boots from the shared golden image with an
+// overlay drive. VMs that already have a full copy keep using it, so switching
+// modes never hides a user's files.
+func usesOverlay(config *internal.Config, vmDataDir string) bool {
+	if config.RootfsMode != internal.RootfsOverlay {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(vmDataDir, "rootfs.img"))
+	return err != nil
+}
+
+// prepareOverlay creates the VM's sparse overlay drive, which the guest formats
+// on first boot. This takes no time or space up front, unlike a full copy.
+func (m *Manager) prepareOverlay(vmDataDir string, sizeMB int) error {
+	overlayPath := filepath.Join(vmDataDir, "overlay.img")
+	if _, err := os.Stat(overlayPath); err == nil {
+		return nil
+	}
+	if err := m.checkFreeSpace(0); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM data directory: %w", err)
+	}
+	f, err := os.OpenFile(overlayPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err == nil {
+		err = f.Truncate(int64(sizeMB) * 1024 * 1024)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(overlayPath)
+		return fmt.Errorf("%w: %w", ErrRootfsCopy, err)
+	}
+	return nil
+}
+
+// acquireIO waits for a slot to run a heavy disk operation, such as a rootfs
+// copy, reporting StageQueued of a VM copying its disk if it has to wait. The returned function frees the slot.
+func (m *Manager) acquireIO(ctx context.Context, vmID string, progress chan<- ProgressEvent) (func(), error) {
+	if m.ioSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-m.ioSlots }
+
+	select {
+	case m.ioSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	m.logger.Printf("Disk IO for VM %s queued behind %d other operations", vmID, cap(m.ioSlots))
+	sendProgress(progress, vmID, StateCopying, StageQueued, "")
+	select {
+	case m.ioSlots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
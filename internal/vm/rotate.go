@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingWriter is a log file that is rotated once it exceeds a maximum size,
+// keeping a fixed number of older files as path.1, path.2, and so on
+type rotatingWriter struct {
+	path     string
+	maxSize  int64 // Bytes before rotating (0 = unlimited)
+	maxFiles int   // Rotated files to keep
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingWriter rotates any existing log at path, then opens a fresh one
+func openRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if _, err := os.Stat(path); err == nil {
+		if err := w.shift(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends to the current file, rotating first if it would grow too large
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate closes the current file, shifts old files, and opens a new one
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("close log file: %w", err)
+	}
+	w.file = nil
+	if err := w.shift(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// shift renames path.N to path.N+1 and path to path.1, dropping the oldest file
+func (w *rotatingWriter) shift() error {
+	if w.maxFiles < 1 {
+		return os.Remove(w.path)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	return nil
+}
+
+// open creates a new, empty file at path
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	w.file = file
+	w.size = 0
+	return nil
+}
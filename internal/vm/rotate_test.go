@@ -0,0 +1,142 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.out")
+
+	w, err := openRotatingWriter(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Failed to open rotating writer: %v", err)
+	}
+
+	for _, chunk := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Each chunk overflows the 10 byte limit, so only the newest three survive
+	expected := map[string]string{
+		path:        "dddddddd",
+		path + ".1": "cccccccc",
+		path + ".2": "bbbbbbbb",
+	}
+	for file, want := range expected {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s to contain %q, got %q", file, want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected oldest log to be removed")
+	}
+
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Errorf("Expected error writing to closed writer")
+	}
+}
+
+func TestRotatingWriterRotatesOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.out")
+	if err := os.WriteFile(path, []byte("previous boot"), 0644); err != nil {
+		t.Fatalf("Failed to write existing log: %v", err)
+	}
+
+	w, err := openRotatingWriter(path, 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to open rotating writer: %v", err)
+	}
+	defer w.Close()
+
+	got, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("Expected previous log to be kept: %v", err)
+	}
+	if string(got) != "previous boot" {
+		t.Errorf("Unexpected previous log contents: %q", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat new log: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Expected new log to be empty")
+	}
+}
+
+func TestPruneLogs(t *testing.T) {
+	dataDir := t.TempDir()
+	manager := &Manager{
+		config: &internal.Config{DataDir: dataDir},
+		logger: logrus.New(),
+		vms:    make(map[string]*VM),
+	}
+	manager.vms["running"] = &VM{ID: "running"}
+
+	old := time.Now().Add(-48 * time.Hour)
+	files := []string{
+		"running/console.out",
+		"running/console.out.1",
+		"stopped/firecracker.log",
+		"stopped/firecracker.log.1",
+		"stopped/vmm.log",
+		"stopped/rootfs.ext4",
+	}
+	for _, f := range files {
+		path := filepath.Join(dataDir, f)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("log"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+		os.Chtimes(path, old, old)
+	}
+
+	if err := manager.PruneLogs(24 * time.Hour); err != nil {
+		t.Fatalf("PruneLogs failed: %v", err)
+	}
+
+	for f, kept := range map[string]bool{
+		"running/console.out":       true,
+		"running/console.out.1":     false,
+		"stopped/firecracker.log":   false,
+		"stopped/firecracker.log.1": false,
+		"stopped/vmm.log":           false,
+		"stopped/rootfs.ext4":       true,
+	} {
+		_, err := os.Stat(filepath.Join(dataDir, f))
+		if exists := err == nil; exists != kept {
+			t.Errorf("Expected %s kept=%v, got exists=%v", f, kept, exists)
+		}
+	}
+}
+
+func TestVMMLogLevel(t *testing.T) {
+	for level, expected := range map[string]string{
+		"error": "Error",
+		"warn":  "Warning",
+		"info":  "Info",
+		"debug": "Debug",
+		"trace": "Trace",
+		"bogus": "Warning",
+	} {
+		if got := vmmLogLevel(level); got != expected {
+			t.Errorf("vmmLogLevel(%q) = %q, expected %q", level, got, expected)
+		}
+	}
+}
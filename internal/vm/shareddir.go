@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SharedDir is a host directory mounted into VMs
+type SharedDir struct {
+	HostPath  string // May contain {user}, replaced by the VM ID for per-user directories
+	GuestPath string
+	ReadOnly  bool
+}
+
+// SharedDirBackend is implemented by backends that can mount host directories
+// into VMs, e.g. with virtio-fs. Firecracker has no such device.
+type SharedDirBackend interface {
+	Backend
+	SupportsSharedDirs() bool
+}
+
+// ParseSharedDirs parses a comma-separated list of HOST:GUEST[:ro] mounts
+func ParseSharedDirs(s string) ([]SharedDir, error) {
+	var dirs []SharedDir
+	for spec := range strings.SplitSeq(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid shared directory %q, expected HOST:GUEST[:ro]", spec)
+		}
+		dir := SharedDir{HostPath: parts[0], GuestPath: parts[1]}
+		if len(parts) == 3 {
+			if parts[2] != "ro" {
+				return nil, fmt.Errorf("invalid shared directory option %q in %q", parts[2], spec)
+			}
+			dir.ReadOnly = true
+		}
+		if !path.IsAbs(dir.GuestPath) {
+			return nil, fmt.Errorf("guest path must be absolute in %q", spec)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// forVM returns the mount with {user} expanded, creating the host directory
+// if it is per-user and does not exist yet
+func (d SharedDir) forVM(vmID string) (SharedDir, error) {
+	if !strings.Contains(d.HostPath, "{user}") {
+		return d, nil
+	}
+	d.HostPath = filepath.Clean(strings.ReplaceAll(d.HostPath, "{user}", vmID))
+	if err := os.MkdirAll(d.HostPath, 0755); err != nil {
+		return d, fmt.Errorf("failed to create shared directory: %w", err)
+	}
+	return d, nil
+}
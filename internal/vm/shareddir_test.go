@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseSharedDirs(t *testing.T) {
+	dirs, err := ParseSharedDirs("/srv/data:/data:ro, /home/hv/{user}:/mnt/home")
+	if err != nil {
+		t.Fatalf("Failed to parse shared dirs: %v", err)
+	}
+	expected := []SharedDir{
+		{HostPath: "/srv/data", GuestPath: "/data", ReadOnly: true},
+		{HostPath: "/home/hv/{user}", GuestPath: "/mnt/home"},
+	}
+	if len(dirs) != len(expected) {
+		t.Fatalf("Expected %d dirs, got %+v", len(expected), dirs)
+	}
+	for i := range expected {
+		if dirs[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], dirs[i])
+		}
+	}
+
+	for _, bad := range []string{"/srv", ":/data", "/srv:", "/srv:data", "/srv:/data:rw", "/a:/b:ro:x"} {
+		if _, err := ParseSharedDirs(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestSharedDirsRequireBackendSupport(t *testing.T) {
+	homes := t.TempDir()
+	manager := newTestManager(t, func(c *internal.Config) {
+		c.SharedDirs = filepath.Join(homes, "{user}") + ":/mnt/home"
+	})
+
+	// Firecracker has no virtio-fs, so the manager refuses to start
+	_, err := NewManagerWithBackend(manager.config, logrus.NewEntry(logrus.StandardLogger()), NewFirecrackerBackend(nil, nil))
+	if err == nil || !strings.Contains(err.Error(), "shared directories") {
+		t.Fatalf("Expected shared directories to be rejected, got %v", err)
+	}
+
+	vm, err := manager.GetOrCreateVM(context.Background(), "testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer manager.DestroyVM(context.Background(), vm.ID)
+
+	hostPath := filepath.Join(homes, "testuser")
+	if len(vm.SharedDirs) != 1 || vm.SharedDirs[0].HostPath != hostPath {
+		t.Fatalf("Expected per-user shared dir %s, got %+v", hostPath, vm.SharedDirs)
+	}
+	if info, err := os.Stat(hostPath); err != nil || !info.IsDir() {
+		t.Errorf("Expected per-user directory to be created: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotDir is the directory in a VM's data directory holding snapshots of
+// its disk, one directory of disk images per snapshot
+const snapshotDir = "snapshots"
+
+// Snapshot is a saved state of a VM's disk that it can be restored to
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// SnapshotDriver is implemented by storage drivers whose volumes can be
+// snapshotted in place, which is instant and only stores what changes.
+// Other VMs' disks are snapshotted by cloning them into snapshotDir.
+type SnapshotDriver interface {
+	StorageDriver
+	Snapshot(volume, name string) error
+	Restore(volume, name string) error
+	DeleteSnapshot(volume, name string) error
+	Snapshots(volume string) ([]Snapshot, error)
+}
+
+// validateSnapshotName checks that a snapshot name is alphanumeric with - and
+// _, not empty, and at most 48 chars
+func validateSnapshotName(name string) error {
+	if name == "" {
+		return fmt.Errorf("snapshot name cannot be empty")
+	}
+	if strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" || len(name) > 48 {
+		return fmt.Errorf("invalid snapshot name %q (use up to 48 letters, digits, - and _)", name)
+	}
+	return nil
+}
+
+// holdStopped marks a stopped VM as busy, so it can't start while its disk
+// is snapshotted or restored. The returned function releases it.
+func (m *Manager) holdStopped(vmID string) (func(), error) {
+	if err := validateVMID(vmID); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, running := m.vms[vmID]
+	_, busy := m.transitions[vmID]
+	if running || busy {
+		return nil, fmt.Errorf("VM %s is running", vmID)
+	}
+	t := &transition{done: make(chan struct{})}
+	m.transitions[vmID] = t
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		delete(m.transitions, vmID)
+		close(t.done)
+	}, nil
+}
+
+// volumeSnapshots returns the driver and volume behind a VM's disk if its
+// driver snapshots volumes in place, or false if its disk is a file
+func volumeSnapshots(vmDataDir string) (SnapshotDriver, string, bool, error) {
+	record, err := readVolume(vmDataDir)
+	if err != nil || record == nil {
+		return nil, "", false, err
+	}
+	driver, err := NewStorageDriver(record.Driver)
+	if err != nil {
+		return nil, "", false, err
+	}
+	sd, ok := driver.(SnapshotDriver)
+	if !ok {
+		return nil, "", false, fmt.Errorf("snapshots aren't supported with storage driver %s", record.Driver)
+	}
+	return sd, record.Volume, true, nil
+}
+
+// diskFiles returns the disk images of a stopped VM, which may be sealed
+func diskFiles(vmDataDir string) []string {
+	var files []string
+	for _, name := range sealedDisks {
+		for _, file := range []string{name, name + sealedSuffix} {
+			if info, err := os.Lstat(filepath.Join(vmDataDir, file)); err == nil && info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// fileCloner returns the storage driver that copies disk images for
+// snapshots, which is the configured one if it works on files
+func (m *Manager) fileCloner() StorageDriver {
+	switch m.storage.(type) {
+	case copyDriver, reflinkDriver:
+		return m.storage
+	}
+	return copyDriver{}
+}
+
+// cloneDisk copies the disk image src to dst through a temporary file, so
+// dst is never left partially written
+func (m *Manager) cloneDisk(ctx context.Context, src, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := m.fileCloner().Clone(ctx, "", src, tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// SnapshotVM saves the disk of a stopped VM as a snapshot with the given
+// name. VMs can keep up to Config.Snapshots snapshots.
+func (m *Manager) SnapshotVM(ctx context.Context, vmID, name string) error {
+	if m.config.Snapshots <= 0 {
+		return fmt.Errorf("snapshots are disabled on this server")
+	}
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	release, err := m.holdStopped(vmID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	snapshots, err := m.listSnapshots(vmID)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s.Name == name {
+			return fmt.Errorf("snapshot %s already exists", name)
+		}
+	}
+	if len(snapshots) >= m.config.Snapshots {
+		return fmt.Errorf("VM %s already has %d snapshots, the most allowed", vmID, len(snapshots))
+	}
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if driver, volume, ok, err := volumeSnapshots(vmDataDir); err != nil {
+		return err
+	} else if ok {
+		return driver.Snapshot(volume, name)
+	}
+
+	files := diskFiles(vmDataDir)
+	if len(files) == 0 {
+		return fmt.Errorf("VM %s has no disk to snapshot", vmID)
+	}
+	if _, ok := m.fileCloner().(copyDriver); ok {
+		var size int64
+		for _, file := range files {
+			if info, err := os.Stat(filepath.Join(vmDataDir, file)); err == nil {
+				size += allocatedSize(info)
+			}
+		}
+		if err := m.checkFreeSpace(size); err != nil {
+			return err
+		}
+	}
+	releaseIO, err := m.acquireIO(ctx, vmID, nil)
+	if err != nil {
+		return err
+	}
+	defer releaseIO()
+
+	// Written under a temporary name, so a partial snapshot is never listed
+	dir := filepath.Join(vmDataDir, snapshotDir, name)
+	tmpDir := dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, file := range files {
+		if err := m.cloneDisk(ctx, filepath.Join(vmDataDir, file), filepath.Join(tmpDir, file)); err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", file, err)
+		}
+	}
+	m.storeSnapshot(tmpDir)
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+	if m.objects != nil {
+		if err := m.pushSnapshot(ctx, vmID, name); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot puts a stopped VM's disk back to a snapshot, discarding
+// its changes since
+func (m *Manager) RestoreSnapshot(ctx context.Context, vmID, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	release, err := m.holdStopped(vmID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if driver, volume, ok, err := volumeSnapshots(vmDataDir); err != nil {
+		return err
+	} else if ok {
+		return driver.Restore(volume, name)
+	}
+
+	if m.objects != nil {
+		if err := m.pullSnapshot(ctx, vmID, name); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Join(vmDataDir, snapshotDir, name)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("snapshot %s not found", name)
+	} else if err != nil {
+		return err
+	}
+	releaseIO, err := m.acquireIO(ctx, vmID, nil)
+	if err != nil {
+		return err
+	}
+	defer releaseIO()
+
+	current := diskFiles(vmDataDir)
+	for _, entry := range entries {
+		if err := m.cloneDisk(ctx, filepath.Join(dir, entry.Name()), filepath.Join(vmDataDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entry.Name(), err)
+		}
+	}
+	// Drop disks the snapshot doesn't have, like a plaintext disk when the
+	// snapshot was taken sealed
+	for _, file := range current {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			os.Remove(filepath.Join(vmDataDir, file))
+		}
+	}
+	if m.objects != nil {
+		return m.pushDisks(ctx, vmID)
+	}
+	return nil
+}
+
+// DeleteSnapshot removes a VM's snapshot
+func (m *Manager) DeleteSnapshot(vmID, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	if err := validateVMID(vmID); err != nil {
+		return err
+	}
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if driver, volume, ok, err := volumeSnapshots(vmDataDir); err != nil {
+		return err
+	} else if ok {
+		return driver.DeleteSnapshot(volume, name)
+	}
+	dir := filepath.Join(vmDataDir, snapshotDir, name)
+	if m.objects != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), objectDeleteTimeout)
+		defer cancel()
+		if err := m.deleteObjects(ctx, snapshotKeyPrefix(vmID)+name+"/"); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListSnapshots returns a VM's snapshots, oldest first
+func (m *Manager) ListSnapshots(vmID string) ([]Snapshot, error) {
+	if err := validateVMID(vmID); err != nil {
+		return nil, err
+	}
+	return m.listSnapshots(vmID)
+}
+
+func (m *Manager) listSnapshots(vmID string) ([]Snapshot, error) {
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if driver, volume, ok, err := volumeSnapshots(vmDataDir); err != nil {
+		return nil, err
+	} else if ok {
+		return driver.Snapshots(volume)
+	}
+
+	// Object storage has every host's snapshots, and local ones may be stale
+	if m.objects != nil {
+		snapshots, err := m.remoteSnapshots(context.Background(), vmID)
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+		return snapshots, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(vmDataDir, snapshotDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		if !entry.IsDir() || validateSnapshotName(entry.Name()) != nil {
+			continue // Left over from a snapshot that was interrupted
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: entry.Name(), Created: info.ModTime()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+var _ SnapshotDriver = zfsCloneDriver{}
+
+// Snapshot takes a ZFS snapshot of the VM's clone
+func (zfsCloneDriver) Snapshot(volume, name string) error {
+	_, err := runStorageCommand(context.Background(), "zfs", "snapshot", volume+"@"+name)
+	return err
+}
+
+// Restore rolls the VM's clone back to a snapshot. ZFS can only roll back to
+// the latest snapshot, so later ones are destroyed.
+func (zfsCloneDriver) Restore(volume, name string) error {
+	_, err := runStorageCommand(context.Background(), "zfs", "rollback", "-r", volume+"@"+name)
+	return err
+}
+
+func (zfsCloneDriver) DeleteSnapshot(volume, name string) error {
+	_, err := runStorageCommand(context.Background(), "zfs", "destroy", volume+"@"+name)
+	return err
+}
+
+func (zfsCloneDriver) Snapshots(volume string) ([]Snapshot, error) {
+	out, err := runStorageCommand(context.Background(), "zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,creation", "-s", "creation", "-d", "1", volume)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		_, name, _ := strings.Cut(fields[0], "@")
+		created, _ := strconv.ParseInt(fields[1], 10, 64)
+		snapshots = append(snapshots, Snapshot{Name: name, Created: time.Unix(created, 0)})
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestSnapshots(t *testing.T) {
+	manager := newTestManager(t, func(c *internal.Config) { c.Snapshots = 2 })
+	tempDir := manager.config.DataDir
+
+	ctx := context.Background()
+	if _, err := manager.GetOrCreateVM(ctx, "alice", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if err := manager.SnapshotVM(ctx, "alice", "first"); err == nil {
+		t.Errorf("Expected snapshotting a running VM to fail")
+	}
+	if err := manager.ReleaseVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+
+	diskPath := filepath.Join(tempDir, "alice", "rootfs.img")
+	if err := manager.SnapshotVM(ctx, "alice", "first"); err != nil {
+		t.Fatalf("Failed to snapshot VM: %v", err)
+	}
+	os.WriteFile(diskPath, []byte("changed"), 0644)
+	if err := manager.SnapshotVM(ctx, "alice", "second"); err != nil {
+		t.Fatalf("Failed to snapshot VM: %v", err)
+	}
+	if err := manager.SnapshotVM(ctx, "alice", "third"); err == nil {
+		t.Errorf("Expected a snapshot over the limit to fail")
+	}
+	if err := manager.SnapshotVM(ctx, "alice", "../escape"); err == nil {
+		t.Errorf("Expected an invalid snapshot name to fail")
+	}
+
+	snapshots, err := manager.ListSnapshots("alice")
+	if err != nil || len(snapshots) != 2 || snapshots[0].Name != "first" {
+		t.Fatalf("Expected 2 snapshots, got %v, %v", snapshots, err)
+	}
+
+	if err := manager.RestoreSnapshot(ctx, "alice", "first"); err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if data, _ := os.ReadFile(diskPath); string(data) != "fake rootfs content" {
+		t.Errorf("Expected the restored disk, got %q", data)
+	}
+	if err := manager.DeleteSnapshot("alice", "first"); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	if err := manager.RestoreSnapshot(ctx, "alice", "first"); err == nil {
+		t.Errorf("Expected restoring a deleted snapshot to fail")
+	}
+
+}
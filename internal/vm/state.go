@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// State is where a VM is in its lifecycle
+type State string
+
+const (
+	StateAllocating State = "allocating" // ID and capacity reserved, waiting to prepare its disk
+	StateCopying    State = "copying"    // Writable disk being prepared
+	StateBooting    State = "booting"    // VMM starting, guest not yet reachable
+	StateReady      State = "ready"      // Guest reachable over SSH
+	StateDraining   State = "draining"   // Being stopped and its resources freed
+	StateStopped    State = "stopped"    // Stopped, with its disk kept
+	StateFailed     State = "failed"     // Failed to start, or died without being stopped
+)
+
+// States lists the VM states in lifecycle order
+var States = []State{StateAllocating, StateCopying, StateBooting, StateReady, StateDraining, StateStopped, StateFailed}
+
+// stateTransitions lists the states each state may move to. VMs that die
+// are drained like stopped ones, then left failed, and neither state moves on.
+var stateTransitions = map[State][]State{
+	StateAllocating: {StateCopying, StateFailed},
+	StateCopying:    {StateBooting, StateFailed},
+	StateBooting:    {StateReady, StateDraining, StateFailed},
+	StateReady:      {StateDraining, StateFailed},
+	StateDraining:   {StateStopped, StateFailed},
+}
+
+// StateChange records a VM entering a state
+type StateChange struct {
+	State  State     `json:"state"`
+	Time   time.Time `json:"time"`
+	Detail string    `json:"detail,omitempty"` // Why, like the error a VM failed with
+}
+
+// lifecycle tracks a VM's state and the states it went through
+type lifecycle struct {
+	mu      sync.Mutex
+	history []StateChange // Oldest first, never empty
+}
+
+// newLifecycle starts a lifecycle in the allocating state
+func newLifecycle() lifecycle {
+	return lifecycle{history: []StateChange{{State: StateAllocating, Time: time.Now()}}}
+}
+
+// current returns the latest state change
+func (l *lifecycle) current() StateChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.history[len(l.history)-1]
+}
+
+// set moves to a state, returning an error and staying put if the current
+// state can't move there
+func (l *lifecycle) set(to State, detail string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	from := l.history[len(l.history)-1].State
+	if !slices.Contains(stateTransitions[from], to) {
+		return fmt.Errorf("invalid VM state transition from %s to %s", from, to)
+	}
+	l.history = append(l.history, StateChange{State: to, Time: time.Now(), Detail: detail})
+	return nil
+}
+
+// State returns the VM's current state
+func (vm *VM) State() State {
+	return vm.lifecycle.current().State
+}
+
+// StateSince returns when the VM entered its current state
+func (vm *VM) StateSince() time.Time {
+	return vm.lifecycle.current().Time
+}
+
+// StateHistory returns the states the VM went through, oldest first
+func (vm *VM) StateHistory() []StateChange {
+	vm.lifecycle.mu.Lock()
+	defer vm.lifecycle.mu.Unlock()
+	return slices.Clone(vm.lifecycle.history)
+}
+
+// setState moves the VM to a state, logging transitions the lifecycle
+// doesn't allow instead, which happen when the VM already moved on, like a
+// boot finishing after the VM died
+func (vm *VM) setState(to State, detail string) {
+	if err := vm.lifecycle.set(to, detail); err != nil {
+		vm.logger.Debugf("%v", err)
+		return
+	}
+	vm.logger.Debugf("VM is %s", to)
+}
+
+// StateCounts returns how many VMs the manager holds in each state, counting
+// VMs starting and stopping along with running ones
+func (m *Manager) StateCounts() map[State]int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	counts := make(map[State]int, len(States))
+	for _, vm := range m.vms {
+		counts[vm.State()]++
+	}
+	for _, t := range m.transitions {
+		if t.vm != nil {
+			counts[t.vm.State()]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	l := newLifecycle()
+	if got := l.current().State; got != StateAllocating {
+		t.Fatalf("Expected a new VM to be allocating, got %s", got)
+	}
+	for _, to := range []State{StateCopying, StateBooting, StateReady, StateDraining, StateStopped} {
+		if err := l.set(to, ""); err != nil {
+			t.Fatalf("Failed to move to %s: %v", to, err)
+		}
+	}
+
+	// Stopped and failed VMs go nowhere, and a failed move keeps the state
+	if err := l.set(StateReady, ""); err == nil {
+		t.Errorf("Expected an error moving a stopped VM to ready")
+	}
+	if got := l.current().State; got != StateStopped {
+		t.Errorf("Expected the VM to stay stopped, got %s", got)
+	}
+	if len(stateTransitions[StateStopped]) != 0 || len(stateTransitions[StateFailed]) != 0 {
+		t.Errorf("Expected stopped and failed to be final states")
+	}
+
+	// VMs can fail at any point before they stop
+	for _, from := range []State{StateAllocating, StateCopying, StateBooting, StateReady, StateDraining} {
+		if !slices.Contains(stateTransitions[from], StateFailed) {
+			t.Errorf("Expected a VM that is %s to be able to fail", from)
+		}
+	}
+	if err := (&lifecycle{history: []StateChange{{State: StateAllocating}}}).set(StateReady, ""); err == nil {
+		t.Errorf("Expected an error skipping from allocating to ready")
+	}
+}
+
+func TestVMStates(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+
+	progress := make(chan ProgressEvent, 16)
+	vm, err := manager.GetOrCreateVM(ctx, "alice", progress)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if vm.State() != StateBooting {
+		t.Errorf("Expected a created VM to be booting, got %s", vm.State())
+	}
+	if err := manager.WaitReady(ctx, vm, progress); err != nil {
+		t.Fatalf("VM didn't become ready: %v", err)
+	}
+	if vm.State() != StateReady {
+		t.Errorf("Expected a reachable VM to be ready, got %s", vm.State())
+	}
+	close(progress)
+	states := map[ProgressStage]State{}
+	for event := range progress {
+		states[event.Stage] = event.State
+	}
+	if states[StageRootfsReady] != StateBooting || states[StageSSHReady] != StateReady {
+		t.Errorf("Unexpected states in progress events %v", states)
+	}
+	if counts := manager.StateCounts(); counts[StateReady] != 1 || len(counts) != 1 {
+		t.Errorf("Expected one ready VM, got %v", counts)
+	}
+
+	if err := manager.DestroyVM(ctx, vm.ID); err != nil {
+		t.Fatalf("Failed to destroy VM: %v", err)
+	}
+	var history []State
+	for i, change := range vm.StateHistory() {
+		history = append(history, change.State)
+		if i > 0 && change.Time.Before(vm.StateHistory()[i-1].Time) {
+			t.Errorf("Expected state changes in time order, got %+v", vm.StateHistory())
+		}
+	}
+	want := []State{StateAllocating, StateCopying, StateBooting, StateReady, StateDraining, StateStopped}
+	if fmt.Sprint(history) != fmt.Sprint(want) {
+		t.Errorf("Expected states %v, got %v", want, history)
+	}
+	if counts := manager.StateCounts(); len(counts) != 0 {
+		t.Errorf("Expected no VMs counted after stopping, got %v", counts)
+	}
+}
+
+func TestDiedVMStates(t *testing.T) {
+	manager := newTestManager(t)
+	ctx := context.Background()
+
+	vm, err := manager.GetOrCreateVM(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if err := manager.WaitReady(ctx, vm, nil); err != nil {
+		t.Fatalf("VM didn't become ready: %v", err)
+	}
+
+	// A VM that dies is drained, and stays failed once it is cleaned up
+	manager.vmExited(vm, errors.New("signal: killed"))
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.Busy("alice") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var history []State
+	for _, change := range vm.StateHistory() {
+		history = append(history, change.State)
+	}
+	want := []State{StateAllocating, StateCopying, StateBooting, StateReady, StateDraining, StateFailed}
+	if fmt.Sprint(history) != fmt.Sprint(want) {
+		t.Errorf("Expected states %v, got %v", want, history)
+	}
+	if detail := vm.StateHistory()[len(history)-1].Detail; !strings.Contains(detail, "signal: killed") {
+		t.Errorf("Expected the failed state to say why, got %q", detail)
+	}
+
+	// Without a free address, a VM fails before its disk is copied
+	for {
+		if _, err := manager.ipPool.Allocate(); err != nil {
+			break
+		}
+	}
+	if _, err := manager.GetOrCreateVM(ctx, "bob", nil); err == nil {
+		t.Fatalf("Expected creating a VM without a free address to fail")
+	}
+	if _, err := os.Stat(filepath.Join(manager.config.DataDir, "bob", "rootfs.img")); err == nil {
+		t.Errorf("Expected no disk to be copied for a VM without an address")
+	}
+}
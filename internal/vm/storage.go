@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+// StorageDriver makes the writable rootfs of each VM from the golden image
+// in copy mode. Drivers backed by block devices clone the golden image's
+// volume and link the VM's rootfs.img to the clone.
+type StorageDriver interface {
+	// Clone makes a writable copy of the golden image src at dst, which is an
+	// empty file the driver fills or replaces. name is unique to the VM. It
+	// returns the volume it created, if any, for Remove.
+	Clone(ctx context.Context, name, src, dst string) (volume string, err error)
+
+	// Remove frees a volume returned by Clone
+	Remove(volume string) error
+}
+
+// storageRecord is the file in a VM's data directory that remembers the
+// volume behind its rootfs, so it can be freed without the server's config
+const storageRecord = "storage.json"
+
+// storageVolume is the content of storageRecord
+type storageVolume struct {
+	Driver string `json:"driver"`
+	Volume string `json:"volume"`
+}
+
+// zfsSnapshot is the snapshot of the golden zvol that VMs are cloned from
+const zfsSnapshot = "sshvm"
+
+// volumeWait is how long block drivers wait for a new volume's device node
+const volumeWait = 10 * time.Second
+
+// NewStorageDriver returns the storage driver with the given name, as in
+// Config.Storage. An empty name is StorageCopy.
+func NewStorageDriver(name string) (StorageDriver, error) {
+	switch name {
+	case "", internal.StorageCopy:
+		return copyDriver{}, nil
+	case internal.StorageReflink:
+		return reflinkDriver{}, nil
+	case internal.StorageLVMThin:
+		return lvmThinDriver{}, nil
+	case internal.StorageZFSClone:
+		return zfsCloneDriver{}, nil
+	case internal.StorageDMThin:
+		return dmThinDriver{}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", name)
+}
+
+// copyDriver copies the golden image byte for byte
+type copyDriver struct{}
+
+func (copyDriver) Clone(ctx context.Context, name, src, dst string) (string, error) {
+	return "", cloneFile(src, dst, func(in, out *os.File) error {
+		_, err := io.Copy(out, in)
+		return err
+	})
+}
+
+func (copyDriver) Remove(string) error { return nil }
+
+// reflinkDriver shares the golden image's blocks copy-on-write, which is
+// instant on filesystems like XFS and Btrfs
+type reflinkDriver struct{}
+
+// ficlone is the FICLONE ioctl from <linux/fs.h>
+const ficlone = 0x40049409
+
+func (reflinkDriver) Clone(ctx context.Context, name, src, dst string) (string, error) {
+	return "", cloneFile(src, dst, func(in, out *os.File) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+		if errno != 0 {
+			return fmt.Errorf("reflink not supported by the data directory's filesystem: %w", errno)
+		}
+		return nil
+	})
+}
+
+func (reflinkDriver) Remove(string) error { return nil }
+
+// cloneFile fills dst from src with clone and makes it readable
+func cloneFile(src, dst string, clone func(in, out *os.File) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	err = clone(in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dst, 0644)
+}
+
+// lvmThinDriver takes a thin snapshot of the golden image's LVM thin volume,
+// like /dev/vg/golden
+type lvmThinDriver struct{}
+
+func (lvmThinDriver) Clone(ctx context.Context, name, src, dst string) (string, error) {
+	out, err := runStorageCommand(ctx, "lvs", "--noheadings", "-o", "vg_name,lv_name", src)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("%s is not an LVM logical volume", src)
+	}
+	vg, origin := fields[0], fields[1]
+	// Thin snapshots skip activation by default, which -kn turns off
+	if _, err := runStorageCommand(ctx, "lvcreate", "--snapshot", "-kn", "--name", name, vg+"/"+origin); err != nil {
+		return "", err
+	}
+	volume := vg + "/" + name
+	if err := linkDevice(ctx, filepath.Join("/dev", vg, name), dst); err != nil {
+		lvmThinDriver{}.Remove(volume)
+		return "", err
+	}
+	return volume, nil
+}
+
+func (lvmThinDriver) Remove(volume string) error {
+	_, err := runStorageCommand(context.Background(), "lvremove", "-y", volume)
+	return err
+}
+
+// zfsCloneDriver clones a snapshot of the golden image's zvol, like
+// /dev/zvol/tank/golden. The snapshot is taken the first time it's needed.
+type zfsCloneDriver struct{}
+
+func (zfsCloneDriver) Clone(ctx context.Context, name, src, dst string) (string, error) {
+	dataset, ok := strings.CutPrefix(src, "/dev/zvol/")
+	if !ok {
+		return "", fmt.Errorf("%s is not a ZFS volume under /dev/zvol", src)
+	}
+	snapshot := dataset + "@" + zfsSnapshot
+	if _, err := runStorageCommand(ctx, "zfs", "list", "-t", "snapshot", snapshot); err != nil {
+		if _, err := runStorageCommand(ctx, "zfs", "snapshot", snapshot); err != nil {
+			return "", err
+		}
+	}
+	volume := filepath.Join(filepath.Dir(dataset), name)
+	if _, err := runStorageCommand(ctx, "zfs", "clone", snapshot, volume); err != nil {
+		return "", err
+	}
+	if err := linkDevice(ctx, filepath.Join("/dev/zvol", volume), dst); err != nil {
+		zfsCloneDriver{}.Remove(volume)
+		return "", err
+	}
+	return volume, nil
+}
+
+func (zfsCloneDriver) Remove(volume string) error {
+	// Along with the VM's snapshots of it
+	_, err := runStorageCommand(context.Background(), "zfs", "destroy", "-r", volume)
+	return err
+}
+
+// dmThinDriver snapshots the golden image's device-mapper thin device, like
+// /dev/mapper/golden, in its thin pool
+type dmThinDriver struct{}
+
+// dmThinProbes is how many device IDs are tried for a snapshot before
+// giving up, starting from one derived from its name
+const dmThinProbes = 64
+
+func (dmThinDriver) Clone(ctx context.Context, name, src, dst string) (string, error) {
+	origin := filepath.Base(src)
+	// A thin device's table is "0 SECTORS thin POOL_MAJOR:MINOR DEVICE_ID"
+	table, err := runStorageCommand(ctx, "dmsetup", "table", origin)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(table)
+	if len(fields) < 5 || fields[2] != "thin" {
+		return "", fmt.Errorf("%s is not a device-mapper thin device", src)
+	}
+	sectors, pool, originID := fields[1], fields[3], fields[4]
+
+	// The origin is suspended while snapshotting, so its writes are flushed.
+	// IDs in use are refused by the pool, so probe for a free one.
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	start := int(h.Sum32() % (1 << 24))
+	if _, err := runStorageCommand(ctx, "dmsetup", "suspend", origin); err != nil {
+		return "", err
+	}
+	id := -1
+	for i := range dmThinProbes {
+		candidate := (start + i) % (1 << 24)
+		if _, err := dmPoolMessage(ctx, pool, fmt.Sprintf("create_snap %d %s", candidate, originID)); err == nil {
+			id = candidate
+			break
+		}
+	}
+	if _, err := runStorageCommand(ctx, "dmsetup", "resume", origin); err != nil {
+		return "", err
+	}
+	if id < 0 {
+		return "", fmt.Errorf("no free device ID for a snapshot in thin pool %s", pool)
+	}
+
+	volume := fmt.Sprintf("%s %s %d", name, pool, id)
+	if _, err := runStorageCommand(ctx, "dmsetup", "create", name, "--table", fmt.Sprintf("0 %s thin %s %d", sectors, pool, id)); err != nil {
+		dmPoolMessage(ctx, pool, fmt.Sprintf("delete %d", id))
+		return "", err
+	}
+	if err := linkDevice(ctx, filepath.Join("/dev/mapper", name), dst); err != nil {
+		dmThinDriver{}.Remove(volume)
+		return "", err
+	}
+	return volume, nil
+}
+
+func (dmThinDriver) Remove(volume string) error {
+	fields := strings.Fields(volume)
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid dm-thin volume %q", volume)
+	}
+	ctx := context.Background()
+	if _, err := runStorageCommand(ctx, "dmsetup", "remove", fields[0]); err != nil {
+		return err
+	}
+	_, err := dmPoolMessage(ctx, fields[1], "delete "+fields[2])
+	return err
+}
+
+// dmPoolMessage sends a message to the thin pool with device number pool,
+// like "253:0"
+func dmPoolMessage(ctx context.Context, pool, message string) (string, error) {
+	major, minor, ok := strings.Cut(pool, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid thin pool device %q", pool)
+	}
+	return runStorageCommand(ctx, "dmsetup", "message", "-j", major, "-m", minor, "0", message)
+}
+
+// linkDevice replaces dst with a link to a new block device, waiting for
+// udev to create its node
+func linkDevice(ctx context.Context, device, dst string) error {
+	ctx, cancel := context.WithTimeout(ctx, volumeWait)
+	defer cancel()
+	for {
+		if _, err := os.Stat(device); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("device %s did not appear", device)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(device, dst)
+}
+
+// runStorageCommand runs a volume management command and returns its output
+func runStorageCommand(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// recordVolume remembers the volume behind a VM's rootfs
+func recordVolume(vmDataDir, driver, volume string) error {
+	data, err := json.Marshal(storageVolume{Driver: driver, Volume: volume})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(vmDataDir, storageRecord), data, 0644)
+}
+
+// readVolume returns the volume behind a VM's rootfs, or nil if its disk
+// is a file
+func readVolume(vmDataDir string) (*storageVolume, error) {
+	data, err := os.ReadFile(filepath.Join(vmDataDir, storageRecord))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var record storageVolume
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", storageRecord, err)
+	}
+	return &record, nil
+}
+
+// releaseStorage frees the volume behind a VM's rootfs, if its storage
+// driver made one
+func releaseStorage(vmDataDir string) error {
+	record, err := readVolume(vmDataDir)
+	if err != nil || record == nil {
+		return err
+	}
+	driver, err := NewStorageDriver(record.Driver)
+	if err != nil {
+		return err
+	}
+	if err := driver.Remove(record.Volume); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(vmDataDir, storageRecord))
+}
+
+// removeVMDir deletes a VM's data directory along with the volume behind
+// its rootfs. The directory is kept if the volume can't be freed, so it
+// isn't leaked.
+func removeVMDir(vmDataDir string) error {
+	if err := releaseStorage(vmDataDir); err != nil {
+		return fmt.Errorf("failed to free storage of %s: %w", filepath.Base(vmDataDir), err)
+	}
+	return os.RemoveAll(vmDataDir)
+}
+
+// storageName is the volume name block drivers give a VM's rootfs
+func storageName(vmID string) string {
+	return "sshvm-" + vmID
+}
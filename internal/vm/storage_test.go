@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekzhang/ssh-hypervisor/internal"
+)
+
+func TestFileStorageDrivers(t *testing.T) {
+	dir := t.TempDir()
+	golden := filepath.Join(dir, "golden.img")
+	os.WriteFile(golden, []byte("golden image"), 0600)
+
+	for _, name := range []string{internal.StorageCopy, internal.StorageReflink} {
+		driver, err := NewStorageDriver(name)
+		if err != nil {
+			t.Fatalf("Failed to create driver %s: %v", name, err)
+		}
+		dst := filepath.Join(dir, name+".img")
+		os.WriteFile(dst, nil, 0600)
+		volume, err := driver.Clone(context.Background(), "sshvm-alice", golden, dst)
+		if name == internal.StorageReflink && err != nil {
+			t.Logf("Skipping reflink, unsupported here: %v", err)
+			continue
+		}
+		if err != nil || volume != "" {
+			t.Fatalf("Clone with %s = %q, %v", name, volume, err)
+		}
+		data, _ := os.ReadFile(dst)
+		info, _ := os.Stat(dst)
+		if string(data) != "golden image" || info.Mode().Perm() != 0644 {
+			t.Errorf("Expected a readable copy with %s, got %q with mode %v", name, data, info.Mode())
+		}
+	}
+
+	if _, err := NewStorageDriver("nfs"); err == nil {
+		t.Errorf("Expected an unknown driver to be rejected")
+	}
+}
+
+func TestRemoveVMDirStorage(t *testing.T) {
+	dataDir := t.TempDir()
+	alice := filepath.Join(dataDir, "alice")
+	os.MkdirAll(alice, 0755)
+	if err := recordVolume(alice, internal.StorageCopy, "unused"); err != nil {
+		t.Fatalf("Failed to record volume: %v", err)
+	}
+	if err := removeVMDir(alice); err != nil || fileExists(alice) {
+		t.Errorf("Expected the directory to be removed, got %v", err)
+	}
+
+	// A volume that can't be freed keeps its directory, so it isn't leaked
+	bob := filepath.Join(dataDir, "bob")
+	os.MkdirAll(bob, 0755)
+	recordVolume(bob, "nfs", "server:/bob")
+	if err := removeVMDir(bob); err == nil || !fileExists(bob) {
+		t.Errorf("Expected the directory to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Chains counting each VM's forwarded traffic, with a rule per VM that
+// returns to FORWARD after counting its packets
+const (
+	trafficInChain  = "SSHVM-TRAFFIC-IN"
+	trafficOutChain = "SSHVM-TRAFFIC-OUT"
+)
+
+// Traffic is what a VM sent and received beyond the host, like to the
+// Internet, not counting its SSH sessions through the hypervisor
+type Traffic struct {
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"`
+}
+
+// sub returns the traffic since an earlier count. Counters that went down
+// were reset, so they count from zero.
+func (t Traffic) sub(earlier Traffic) Traffic {
+	delta := func(now, then uint64) uint64 {
+		if now < then {
+			return now
+		}
+		return now - then
+	}
+	return Traffic{
+		BytesIn:    delta(t.BytesIn, earlier.BytesIn),
+		BytesOut:   delta(t.BytesOut, earlier.BytesOut),
+		PacketsIn:  delta(t.PacketsIn, earlier.PacketsIn),
+		PacketsOut: delta(t.PacketsOut, earlier.PacketsOut),
+	}
+}
+
+// TrafficHook is called with the traffic a VM had since it was last
+// counted, like to charge it to the VM's user
+type TrafficHook func(vm *VM, delta Traffic)
+
+// AddTrafficHook registers a hook run with each VM's new traffic whenever
+// it is counted
+func (m *Manager) AddTrafficHook(hook TrafficHook) {
+	m.trafficMu.Lock()
+	defer m.trafficMu.Unlock()
+	m.trafficHooks = append(m.trafficHooks, hook)
+}
+
+// Traffic returns the VM's traffic since it started, as of the last count
+func (vm *VM) Traffic() Traffic {
+	vm.trafficMu.Lock()
+	defer vm.trafficMu.Unlock()
+	return vm.traffic
+}
+
+// trafficJumpRules returns the FORWARD rules sending traffic through the
+// counting chains, as (table, chain, rulespec) triples
+func (m *Manager) trafficJumpRules() [][]string {
+	return [][]string{
+		{"filter", "FORWARD", "-o", m.bridgeName, "-j", trafficInChain, "-m", "comment", "--comment", "ssh-hypervisor"},
+		{"filter", "FORWARD", "-i", m.bridgeName, "-j", trafficOutChain, "-m", "comment", "--comment", "ssh-hypervisor"},
+	}
+}
+
+// trafficRules returns the rules counting a VM's traffic, as (table, chain,
+// rulespec) triples
+func (m *Manager) trafficRules(vm *VM) [][]string {
+	ip := vm.IP.String()
+	return [][]string{
+		{"filter", trafficInChain, "-d", ip, "-j", "RETURN"},
+		{"filter", trafficOutChain, "-s", ip, "-j", "RETURN"},
+	}
+}
+
+// setupTrafficChains creates the counting chains and sends forwarded
+// traffic through them, ahead of the rules accepting or rejecting it
+func (m *Manager) setupTrafficChains() error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	for _, chain := range []string{trafficInChain, trafficOutChain} {
+		if err := ipt.ClearChain("filter", chain); err != nil {
+			return fmt.Errorf("failed to create %s chain: %w", chain, err)
+		}
+	}
+	for _, rule := range m.trafficJumpRules() {
+		if err := ipt.Insert(rule[0], rule[1], 1, rule[2:]...); err != nil {
+			return fmt.Errorf("failed to add %s rule: %w", rule[1], err)
+		}
+	}
+	return nil
+}
+
+// setupTrafficRules starts counting a VM's traffic
+func (m *Manager) setupTrafficRules(vm *VM) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	for _, rule := range m.trafficRules(vm) {
+		if err := ipt.Append(rule[0], rule[1], rule[2:]...); err != nil {
+			m.removeTrafficRules(vm)
+			return fmt.Errorf("failed to add %s rule: %w", rule[1], err)
+		}
+	}
+	return nil
+}
+
+// removeTrafficRules counts a stopped VM's traffic a last time, then deletes
+// the rules added by setupTrafficRules
+func (m *Manager) removeTrafficRules(vm *VM) error {
+	if counts, err := readTraffic(); err != nil {
+		m.logger.Warnf("Failed to count traffic of VM %s before it stops: %v", vm.ID, err)
+	} else if total, ok := counts[vm.IP.String()]; ok {
+		m.updateTraffic(vm, total)
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	for _, rule := range m.trafficRules(vm) {
+		if err := ipt.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+			return fmt.Errorf("failed to delete %s rule: %w", rule[1], err)
+		}
+	}
+	return nil
+}
+
+// MonitorTraffic counts the traffic of running VMs every interval until ctx
+// is done, running the traffic hooks with what each had since the last count
+func (m *Manager) MonitorTraffic(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			counts, err := readTraffic()
+			if err != nil {
+				m.logger.Warnf("Failed to count VM traffic: %v", err)
+				continue
+			}
+			m.mutex.RLock()
+			vms := make([]*VM, 0, len(m.vms))
+			for _, vm := range m.vms {
+				vms = append(vms, vm)
+			}
+			m.mutex.RUnlock()
+
+			for _, vm := range vms {
+				// VMs whose rules aren't set up yet, or were just removed,
+				// have nothing to count
+				if total, ok := counts[vm.IP.String()]; ok {
+					m.updateTraffic(vm, total)
+				}
+			}
+		}
+	}
+}
+
+// updateTraffic records the counters of a VM's rules and runs the traffic
+// hooks with what changed since the last count
+func (m *Manager) updateTraffic(vm *VM, total Traffic) {
+	vm.trafficMu.Lock()
+	delta := total.sub(vm.traffic)
+	vm.traffic = total
+	vm.trafficMu.Unlock()
+	if delta == (Traffic{}) {
+		return
+	}
+
+	m.trafficMu.Lock()
+	hooks := append([]TrafficHook(nil), m.trafficHooks...)
+	m.trafficMu.Unlock()
+	for _, hook := range hooks {
+		hook(vm, delta)
+	}
+}
+
+// readTraffic returns the counters of the traffic rules by VM IP address
+func readTraffic() (map[string]Traffic, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+	in, err := ipt.StructuredStats("filter", trafficInChain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s counters: %w", trafficInChain, err)
+	}
+	out, err := ipt.StructuredStats("filter", trafficOutChain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s counters: %w", trafficOutChain, err)
+	}
+	return trafficByIP(in, out), nil
+}
+
+// trafficByIP totals the counters of the traffic chains' rules by the VM IP
+// address each matches
+func trafficByIP(in, out []iptables.Stat) map[string]Traffic {
+	counts := make(map[string]Traffic)
+	for _, stat := range in {
+		ip := stat.Destination.IP.String()
+		t := counts[ip]
+		t.BytesIn += stat.Bytes
+		t.PacketsIn += stat.Packets
+		counts[ip] = t
+	}
+	for _, stat := range out {
+		ip := stat.Source.IP.String()
+		t := counts[ip]
+		t.BytesOut += stat.Bytes
+		t.PacketsOut += stat.Packets
+		counts[ip] = t
+	}
+	return counts
+}
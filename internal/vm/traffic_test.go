@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestTrafficByIP(t *testing.T) {
+	_, alice, _ := net.ParseCIDR("192.168.100.2/32")
+	_, bob, _ := net.ParseCIDR("192.168.100.6/32")
+	in := []iptables.Stat{
+		{Packets: 10, Bytes: 1000, Destination: alice},
+		{Packets: 1, Bytes: 60, Destination: bob},
+	}
+	out := []iptables.Stat{
+		{Packets: 5, Bytes: 400, Source: alice},
+	}
+
+	counts := trafficByIP(in, out)
+	if got := counts["192.168.100.2"]; got != (Traffic{BytesIn: 1000, BytesOut: 400, PacketsIn: 10, PacketsOut: 5}) {
+		t.Errorf("Unexpected traffic for alice: %+v", got)
+	}
+	if got := counts["192.168.100.6"]; got != (Traffic{BytesIn: 60, PacketsIn: 1}) {
+		t.Errorf("Unexpected traffic for bob: %+v", got)
+	}
+}
+
+func TestUpdateTraffic(t *testing.T) {
+	m := &Manager{}
+	vm := &VM{ID: "alice"}
+
+	var charged []Traffic
+	m.AddTrafficHook(func(_ *VM, delta Traffic) { charged = append(charged, delta) })
+
+	m.updateTraffic(vm, Traffic{BytesIn: 100, PacketsIn: 1})
+	m.updateTraffic(vm, Traffic{BytesIn: 100, PacketsIn: 1})
+	m.updateTraffic(vm, Traffic{BytesIn: 250, BytesOut: 40, PacketsIn: 3, PacketsOut: 1})
+	if len(charged) != 2 || charged[1] != (Traffic{BytesIn: 150, BytesOut: 40, PacketsIn: 2, PacketsOut: 1}) {
+		t.Errorf("Expected hooks to run with new traffic only, got %+v", charged)
+	}
+
+	// Counters that went down were reset, like by recreating the rules
+	m.updateTraffic(vm, Traffic{BytesIn: 50, BytesOut: 40, PacketsIn: 1, PacketsOut: 1})
+	if len(charged) != 3 || charged[2] != (Traffic{BytesIn: 50, PacketsIn: 1}) {
+		t.Errorf("Expected reset counters to count from zero, got %+v", charged)
+	}
+	if got := vm.Traffic(); got.BytesIn != 50 {
+		t.Errorf("Expected the VM's traffic to be the latest count, got %+v", got)
+	}
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// InstallRootfs makes a rootfs image that a user brought the disk of their
+// stopped VM, discarding its current disk. The image at path is moved into
+// the VM's data directory, so it must be on the same filesystem, like a file
+// made with CreateUpload. The VM boots it as a full disk in every rootfs mode.
+func (m *Manager) InstallRootfs(ctx context.Context, vmID, path string) error {
+	release, err := m.holdStopped(vmID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := releaseStorage(vmDataDir); err != nil {
+		return fmt.Errorf("failed to free storage of the old disk: %w", err)
+	}
+	for _, name := range sealedDisks {
+		for _, file := range []string{name, name + sealedSuffix} {
+			if err := os.Remove(filepath.Join(vmDataDir, file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove the old disk: %w", err)
+			}
+		}
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(vmDataDir, "rootfs.img")); err != nil {
+		return fmt.Errorf("failed to install rootfs: %w", err)
+	}
+
+	// Like the disk of any stopped VM
+	if m.masterKey != nil {
+		if err := m.sealDisks(vmID); err != nil {
+			return err
+		}
+	}
+	if m.objects != nil {
+		return m.pushDisks(ctx, vmID)
+	}
+	return nil
+}
+
+// uploadPrefix starts the names of rootfs images being uploaded to a VM's
+// data directory
+const uploadPrefix = "upload.img.tmp-"
+
+// CreateUpload creates a temporary file in a VM's data directory for a
+// rootfs image the user is uploading. The caller removes it if it isn't
+// installed.
+func (m *Manager) CreateUpload(vmID string) (*os.File, error) {
+	if err := validateVMID(vmID); err != nil {
+		return nil, err
+	}
+	vmDataDir := filepath.Join(m.config.DataDir, vmID)
+	if err := os.MkdirAll(vmDataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create VM data directory: %w", err)
+	}
+	return os.CreateTemp(vmDataDir, uploadPrefix+"*")
+}
+
+// VMDiskUsage returns the disk space a VM's data takes in bytes, leaving out
+// its disk images and uploads in progress, which an uploaded rootfs replaces
+func (m *Manager) VMDiskUsage(vmID string) (int64, error) {
+	if err := validateVMID(vmID); err != nil {
+		return 0, err
+	}
+	var size int64
+	err := filepath.WalkDir(filepath.Join(m.config.DataDir, vmID), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || strings.HasPrefix(name, uploadPrefix) {
+			return nil
+		}
+		if filepath.Dir(path) == filepath.Join(m.config.DataDir, vmID) && slices.Contains(sealedDisks, strings.TrimSuffix(name, sealedSuffix)) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += allocatedSize(info)
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallRootfs(t *testing.T) {
+	manager := newTestManager(t)
+	tempDir := manager.config.DataDir
+
+	upload := func(content string) string {
+		f, err := manager.CreateUpload("alice")
+		if err != nil {
+			t.Fatalf("Failed to create upload: %v", err)
+		}
+		f.WriteString(content)
+		f.Close()
+		return f.Name()
+	}
+
+	ctx := context.Background()
+	if _, err := manager.GetOrCreateVM(ctx, "alice", nil); err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	if err := manager.InstallRootfs(ctx, "alice", upload("mine")); err == nil {
+		t.Errorf("Expected installing a rootfs for a running VM to fail")
+	}
+	if err := manager.ReleaseVM(ctx, "alice"); err != nil {
+		t.Fatalf("Failed to release VM: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(tempDir, "alice", "notes.txt"), []byte("12345"), 0644)
+	pending := upload(string(make([]byte, 2<<20)))
+	if err := manager.InstallRootfs(ctx, "alice", upload("mine")); err != nil {
+		t.Fatalf("Failed to install rootfs: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(tempDir, "alice", "rootfs.img")); string(data) != "mine" {
+		t.Errorf("Expected the upload to become the disk, got %q", data)
+	}
+
+	// The disk and uploads don't count toward the VM's data, other files do
+	usage, err := manager.VMDiskUsage("alice")
+	if err != nil {
+		t.Fatalf("Failed to get disk usage: %v", err)
+	}
+	if usage == 0 || usage >= 1<<20 {
+		t.Errorf("Expected usage of just the notes, got %d bytes", usage)
+	}
+	os.Remove(pending)
+	os.WriteFile(filepath.Join(tempDir, "alice", "notes.txt"), make([]byte, 1<<20), 0644)
+	if usage, _ := manager.VMDiskUsage("alice"); usage < 1<<20 {
+		t.Errorf("Expected usage of at least 1 MB, got %d bytes", usage)
+	}
+}
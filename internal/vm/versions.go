@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semver is a release as major, minor, and patch numbers. The zero value
+// means the version is unknown.
+type semver [3]int
+
+// The supported matrix of Firecracker and guest kernel versions. Releases
+// outside it may lack APIs the hypervisor uses, or change them.
+var (
+	minFirecracker   = semver{1, 4, 0}           // First release with every API used, the last being the entropy device
+	maxFirecracker   = semver{2, 0, 0}           // First release not supported, since major releases change the API
+	supportedKernels = []semver{{5, 10}, {6, 1}} // Guest kernel series Firecracker supports, by major and minor
+)
+
+// entropyMinVersion is the first Firecracker release with a virtio-rng device
+var entropyMinVersion = semver{1, 4, 0}
+
+// firecrackerVersionPattern finds the version in the output of
+// firecracker --version, like "Firecracker v1.13.1"
+var firecrackerVersionPattern = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+
+// kernelVersionPattern finds the version in a kernel's banner, like
+// "Linux version 6.1.150 (builder@host) ..."
+var kernelVersionPattern = regexp.MustCompile(`Linux version ((\d+)\.(\d+)(?:\.(\d+))?\S*)`)
+
+// Versions are the versions of the Firecracker and kernel binaries that VMs
+// run with, and how they fall outside the supported matrix
+type Versions struct {
+	Firecracker string   `json:"firecracker"`           // Like "v1.13.1", or "unknown"
+	Kernel      string   `json:"kernel"`                // Like "6.1.150", or "unknown"
+	Unsupported []string `json:"unsupported,omitempty"` // Reasons the versions aren't supported
+}
+
+// VersionBackend is implemented by backends that know the versions of the
+// binaries their VMs run with
+type VersionBackend interface {
+	Backend
+	Versions() Versions
+}
+
+// parseFirecrackerVersion reads the version from firecracker --version
+func parseFirecrackerVersion(output string) (semver, error) {
+	match := firecrackerVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return semver{}, fmt.Errorf("no version in %q", output)
+	}
+	var v semver
+	for i := range v {
+		v[i], _ = strconv.Atoi(match[i+1])
+	}
+	return v, nil
+}
+
+// firecrackerVersion runs a Firecracker binary to ask for its version
+func firecrackerVersion(path string) (semver, error) {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return semver{}, err
+	}
+	return parseFirecrackerVersion(string(out))
+}
+
+// kernelVersion finds the release of a kernel image in its banner, returning
+// the release as the kernel prints it and its parsed version
+func kernelVersion(image []byte) (string, semver, error) {
+	i := bytes.Index(image, []byte("Linux version "))
+	if i < 0 {
+		return "", semver{}, fmt.Errorf("no version banner in kernel image")
+	}
+	// The banner is one line, so a short window is enough
+	match := kernelVersionPattern.FindSubmatch(image[i:min(len(image), i+256)])
+	if match == nil {
+		return "", semver{}, fmt.Errorf("no version in kernel banner")
+	}
+	var v semver
+	for j := range v {
+		v[j], _ = strconv.Atoi(string(match[j+2]))
+	}
+	return string(match[1]), v, nil
+}
+
+// checkVersions describes the versions of Firecracker and a kernel image,
+// noting how they fall outside the supported matrix. Unknown versions are
+// not counted as unsupported.
+func checkVersions(firecracker semver, kernelImage []byte) Versions {
+	versions := Versions{Firecracker: firecracker.String(), Kernel: "unknown"}
+	if firecracker.known() && (!firecracker.atLeast(minFirecracker) || firecracker.atLeast(maxFirecracker)) {
+		versions.Unsupported = append(versions.Unsupported,
+			fmt.Sprintf("Firecracker %s is outside the supported range %s to %s", firecracker, minFirecracker, maxFirecracker))
+	}
+
+	release, kernel, err := kernelVersion(kernelImage)
+	if err != nil {
+		return versions
+	}
+	versions.Kernel = release
+	supported := false
+	var series []string
+	for _, s := range supportedKernels {
+		supported = supported || (kernel[0] == s[0] && kernel[1] == s[1])
+		series = append(series, fmt.Sprintf("%d.%d", s[0], s[1]))
+	}
+	if !supported {
+		versions.Unsupported = append(versions.Unsupported,
+			fmt.Sprintf("kernel %s is not in a supported series (%s)", release, strings.Join(series, ", ")))
+	}
+	return versions
+}
+
+// DetectVersions finds the versions of Firecracker and kernel binaries, like
+// the embedded ones, and checks them against the supported matrix. The
+// Firecracker binary is run from a temporary file to ask for its version.
+func DetectVersions(firecrackerBinary, vmlinuxBinary []byte) Versions {
+	var firecracker semver
+	if f, err := os.CreateTemp("", "firecracker-*"); err == nil {
+		_, err = f.Write(firecrackerBinary)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			if err = os.Chmod(f.Name(), 0755); err == nil {
+				firecracker, _ = firecrackerVersion(f.Name())
+			}
+		}
+		os.Remove(f.Name())
+	}
+	return checkVersions(firecracker, vmlinuxBinary)
+}
+
+// Versions returns the versions of Firecracker and the kernel that VMs run
+// with, if the backend knows them
+func (m *Manager) Versions() (Versions, bool) {
+	vb, ok := m.backend.(VersionBackend)
+	if !ok {
+		return Versions{}, false
+	}
+	return vb.Versions(), true
+}
+
+// known reports whether the version was detected
+func (v semver) known() bool {
+	return v != semver{}
+}
+
+// atLeast reports whether v is min or a later release. Unknown versions are
+// assumed to be recent, like the embedded binary.
+func (v semver) atLeast(min semver) bool {
+	if !v.known() {
+		return true
+	}
+	for i := range v {
+		if v[i] != min[i] {
+			return v[i] > min[i]
+		}
+	}
+	return true
+}
+
+func (v semver) String() string {
+	if !v.known() {
+		return "unknown"
+	}
+	return fmt.Sprintf("v%d.%d.%d", v[0], v[1], v[2])
+}
@@ -0,0 +1,54 @@
+package vm
+
+import "testing"
+
+func TestFirecrackerVersion(t *testing.T) {
+	v, err := parseFirecrackerVersion("Firecracker v1.13.1\n\nSupported snapshot data format versions: v6.0.0\n")
+	if err != nil {
+		t.Fatalf("Failed to parse version: %v", err)
+	}
+	if v != (semver{1, 13, 1}) || v.String() != "v1.13.1" {
+		t.Errorf("Expected v1.13.1, got %s", v)
+	}
+	if _, err := parseFirecrackerVersion("firecracker: unknown option"); err == nil {
+		t.Errorf("Expected an error without a version")
+	}
+
+	tests := []struct {
+		v, min semver
+		want   bool
+	}{
+		{semver{1, 13, 1}, entropyMinVersion, true},
+		{semver{1, 4, 0}, entropyMinVersion, true},
+		{semver{1, 3, 9}, entropyMinVersion, false},
+		{semver{0, 25, 0}, entropyMinVersion, false},
+		{semver{}, entropyMinVersion, true}, // Unknown versions are assumed recent
+	}
+	for _, tt := range tests {
+		if got := tt.v.atLeast(tt.min); got != tt.want {
+			t.Errorf("%s.atLeast(%s) = %v, want %v", tt.v, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVersions(t *testing.T) {
+	kernel := []byte("\x00\x7fELF...Linux version 6.1.150 (builder@host) (gcc 11) #1 SMP\n\x00")
+	versions := checkVersions(semver{1, 13, 1}, kernel)
+	if versions.Firecracker != "v1.13.1" || versions.Kernel != "6.1.150" || len(versions.Unsupported) != 0 {
+		t.Errorf("Expected supported v1.13.1 and 6.1.150, got %+v", versions)
+	}
+
+	versions = checkVersions(semver{1, 3, 0}, []byte("Linux version 4.14.55-84.37.amzn2.x86_64 (mockbuild@host)"))
+	if versions.Kernel != "4.14.55-84.37.amzn2.x86_64" || len(versions.Unsupported) != 2 {
+		t.Errorf("Expected old Firecracker and kernel to be unsupported, got %+v", versions)
+	}
+	if versions := checkVersions(semver{2, 0, 0}, kernel); len(versions.Unsupported) != 1 {
+		t.Errorf("Expected the next major Firecracker release to be unsupported, got %+v", versions)
+	}
+
+	// Versions that can't be detected are reported but not refused
+	versions = checkVersions(semver{}, []byte("not a kernel"))
+	if versions.Firecracker != "unknown" || versions.Kernel != "unknown" || len(versions.Unsupported) != 0 {
+		t.Errorf("Expected unknown versions, got %+v", versions)
+	}
+}
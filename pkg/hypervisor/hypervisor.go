@@ -0,0 +1,186 @@
+// Package hypervisor embeds ssh-hypervisor in other Go programs. Server runs
+// the whole "SSH in, get a microVM" service, optionally behind the program's
+// own authentication, and Manager boots and stops VMs directly for programs
+// with their own front end.
+//
+// VMs are named by ID, which the server takes from the SSH user name. Both
+// need Linux with KVM, and the Firecracker and kernel binaries built into the
+// program, like the ssh-hypervisor command.
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/ekzhang/ssh-hypervisor/internal"
+	"github.com/ekzhang/ssh-hypervisor/internal/server"
+	"github.com/ekzhang/ssh-hypervisor/internal/vm"
+	"github.com/sirupsen/logrus"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// Config configures a Server or Manager, with the same settings as the
+// ssh-hypervisor command's flags
+type Config = internal.Config
+
+// Authenticator decides who may log in to a Server. It is asked about every
+// key and password login after the server's own checks pass, including those
+// of users who then answer prompts, and only logins it accepts get a VM.
+type Authenticator = server.Authenticator
+
+// Prompter drives a keyboard-interactive exchange users complete after their
+// key or password is accepted, like accepting terms or entering an invite code
+type Prompter = server.Prompter
+
+// VMInfo describes a running VM, or a stopped VM with labels
+type VMInfo = vm.VMInfo
+
+// Server is an SSH server that boots a microVM for each user who connects
+type Server struct {
+	server *server.Server
+}
+
+// NewServer validates config and creates a server, setting up the host's
+// network for VMs
+func NewServer(config *Config, logger logrus.FieldLogger) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	s, err := server.NewServer(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{server: s}, nil
+}
+
+// SetAuthenticator makes logins also need a's approval. It must be called
+// before Run.
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.server.SetAuthenticator(a)
+}
+
+// AddPrompter makes users with p pending answer its questions after their
+// key or password, before they get a VM. It must be called before Run.
+func (s *Server) AddPrompter(p Prompter) {
+	s.server.AddPrompter(p)
+}
+
+// RegisterSubsystem serves the named SSH subsystem on the host with handler,
+// without starting a VM. It must be called before Run.
+func (s *Server) RegisterSubsystem(name string, handler ssh.SubsystemHandler) {
+	s.server.RegisterSubsystem(name, handler)
+}
+
+// Manager returns the manager of the server's VMs
+func (s *Server) Manager() *Manager {
+	return &Manager{manager: s.server.Manager()}
+}
+
+// Run serves SSH, and HTTP and WebSocket if configured, until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	return s.server.Run(ctx)
+}
+
+// Manager boots, tracks, and stops VMs
+type Manager struct {
+	manager *vm.Manager
+}
+
+// NewManager validates config and creates a VM manager, setting up the
+// host's network for VMs. Programs that also run a Server should use its
+// Manager instead, since two managers would hand out the same addresses.
+func NewManager(config *Config, logger logrus.FieldLogger) (*Manager, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	m, err := vm.NewManager(config, logger, vm.GetFirecrackerBinary(), vm.GetVmlinuxBinary())
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{manager: m}, nil
+}
+
+// Start returns the VM with the given ID once its SSH server is reachable,
+// booting or resuming it if needed. ctx only bounds the boot, and the VM
+// keeps running after it ends. Each call holds a reference to the VM until
+// Release.
+func (m *Manager) Start(ctx context.Context, id string) (*VM, error) {
+	v, err := m.manager.GetOrCreateVM(ctx, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.manager.WaitReady(ctx, v, nil); err != nil {
+		m.manager.ReleaseVM(context.Background(), id)
+		return nil, err
+	}
+	return &VM{vm: v}, nil
+}
+
+// Release drops a reference taken by Start. The VM stops when its last
+// reference is released.
+func (m *Manager) Release(ctx context.Context, id string) error {
+	return m.manager.ReleaseVM(ctx, id)
+}
+
+// Destroy stops a VM regardless of its references
+func (m *Manager) Destroy(ctx context.Context, id string) error {
+	return m.manager.DestroyVM(ctx, id)
+}
+
+// Get returns a running VM without taking a reference to it
+func (m *Manager) Get(id string) (*VM, bool) {
+	v, ok := m.manager.GetVM(id)
+	if !ok {
+		return nil, false
+	}
+	return &VM{vm: v}, true
+}
+
+// List returns running VMs and stopped VMs with labels, keeping those with
+// every label in selector
+func (m *Manager) List(selector map[string]string) ([]VMInfo, error) {
+	return m.manager.ListVMs(selector)
+}
+
+// SetLabels replaces a VM's labels
+func (m *Manager) SetLabels(id string, labels map[string]string) error {
+	return m.manager.SetLabels(id, labels)
+}
+
+// Ready returns why the host can't start another VM right now, or nil
+func (m *Manager) Ready() error {
+	return m.manager.CheckReady()
+}
+
+// VM is a running microVM
+type VM struct {
+	vm *vm.VM
+}
+
+// ID returns the VM's ID
+func (v *VM) ID() string {
+	return v.vm.ID
+}
+
+// IP returns the VM's address on the host's VM network
+func (v *VM) IP() net.IP {
+	return v.vm.IP
+}
+
+// SSHAddr returns the address of the SSH server in the VM
+func (v *VM) SSHAddr() string {
+	return v.vm.SSHAddr()
+}
+
+// Client returns an SSH client logged in to the VM as root, shared with
+// other callers. Call release instead of closing it when done.
+func (v *VM) Client(ctx context.Context) (client *cryptoSSH.Client, release func(), err error) {
+	return v.vm.GuestClient(ctx)
+}
+
+// Run runs a shell command in the VM and returns its combined output
+func (v *VM) Run(ctx context.Context, command string) (string, error) {
+	return v.vm.RunCommand(ctx, command)
+}
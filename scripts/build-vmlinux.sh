@@ -44,6 +44,9 @@ cd linux
 echo "[*] Fetching Firecracker ${KERNEL_ARCH} microvm config..."
 curl -fsSL "${FC_CFG_URL}" -o .config
 
+# Let guests follow the host's clock with chrony reading /dev/ptp0
+./scripts/config --enable PTP_1588_CLOCK --enable PTP_1588_CLOCK_KVM
+
 # Make sure no stale prompts block us
 make olddefconfig
 
@@ -24,10 +24,10 @@ docker run -i --rm \
 set -euo pipefail
 
 apk add --no-cache openrc
-apk add --no-cache util-linux openssh bash
+apk add --no-cache util-linux openssh bash e2fsprogs
 
 # Add interesting packages for user convenience:
-apk add --no-cache vim htop curl wget iproute2 net-tools python3 nodejs npm
+apk add --no-cache vim htop curl wget iproute2 net-tools python3 nodejs npm mosh-server
 
 # Set up a login terminal on the serial console (ttyS0):
 ln -s agetty /etc/init.d/agetty.ttyS0
@@ -58,6 +58,33 @@ passwd -d root
 sed -i 's/^#PermitRootLogin.*/PermitRootLogin yes/' /etc/ssh/sshd_config
 sed -i 's/^#PermitEmptyPasswords.*/PermitEmptyPasswords yes/' /etc/ssh/sshd_config
 
+# In overlay and ephemeral modes, the rootfs is shared read-only between VMs
+# and this init wrapper mounts a writable overlay over it. The overlay lives on
+# the drive named by overlay_root on the kernel command line, formatted on
+# first boot, or in memory if overlay_root=tmpfs.
+cat > /sbin/overlay-init <<'INIT'
+#!/bin/sh
+set -e
+mount -t proc proc /proc
+mount -t devtmpfs devtmpfs /dev
+if [ "\${overlay_root:-}" = tmpfs ]; then
+  mount -t tmpfs -o noatime,mode=0755 tmpfs /overlay
+else
+  dev="/dev/\${overlay_root:-vdb}"
+  if ! mount -t ext4 -o noatime "\$dev" /overlay 2>/dev/null; then
+    mkfs.ext4 -q "\$dev"
+    mount -t ext4 -o noatime "\$dev" /overlay
+  fi
+fi
+mkdir -p /overlay/root /overlay/work
+mount -t overlay -o noatime,lowerdir=/,upperdir=/overlay/root,workdir=/overlay/work overlay /mnt
+umount /dev /proc
+cd /mnt
+pivot_root . rom
+exec chroot . /sbin/init "\$@"
+INIT
+chmod +x /sbin/overlay-init
+
 # Then, copy the newly configured system to the rootfs image:
 for d in bin etc lib root sbin usr; do tar c "/\$d" | tar x -C /my-rootfs; done
 
@@ -66,7 +93,7 @@ for d in bin etc lib root sbin usr; do tar c "/\$d" | tar x -C /my-rootfs; done
 # However, this is just a warning, so you should be able to
 # proceed with the setup process.
 
-for dir in dev proc run sys var; do mkdir /my-rootfs/\${dir}; done
+for dir in dev proc run sys var mnt overlay rom; do mkdir /my-rootfs/\${dir}; done
 EOS
 
 echo "Rootfs image created successfully: rootfs.ext4"